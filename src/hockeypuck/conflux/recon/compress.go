@@ -0,0 +1,232 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"compress/zlib"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Compression algorithms for recon sessions.
+const (
+	CompressionZlib = "zlib"
+)
+
+// compressionAlgorithms are the supported compression algorithms, in order
+// of preference.
+var compressionAlgorithms = []string{CompressionZlib}
+
+// configCompression is the config key under which the compression
+// algorithms a peer accepts are advertised, as a comma-separated list.
+const configCompression = "compression"
+
+func validCompression(algo string) bool {
+	for _, known := range compressionAlgorithms {
+		if algo == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Compression returns the compression algorithms advertised in the config.
+func (msg *Config) Compression() []string {
+	v := msg.Custom[configCompression]
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// SetCompression sets the compression algorithms advertised in the config.
+func (msg *Config) SetCompression(algos []string) {
+	if len(algos) == 0 {
+		delete(msg.Custom, configCompression)
+		return
+	}
+	if msg.Custom == nil {
+		msg.Custom = map[string]string{}
+	}
+	msg.Custom[configCompression] = strings.Join(algos, ",")
+}
+
+// NegotiateCompression returns the compression algorithm used in a session
+// between peers which exchanged the given configs and negotiated the given
+// protocol version, or an empty string if the session is not compressed.
+// The most preferred algorithm accepted by both peers is chosen, so that
+// both arrive at the same choice.
+func NegotiateCompression(local, remote *Config, version int) string {
+	if version < ProtocolVersionCompression {
+		return ""
+	}
+	accepted := func(algos []string, algo string) bool {
+		for _, a := range algos {
+			if a == algo {
+				return true
+			}
+		}
+		return false
+	}
+	localAlgos, remoteAlgos := local.Compression(), remote.Compression()
+	for _, algo := range compressionAlgorithms {
+		if accepted(localAlgos, algo) && accepted(remoteAlgos, algo) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// compressedConn compresses a recon session after the config handshake.
+// Each write is flushed to the peer, so that buffered messages are sent
+// when the caller flushes them.
+//
+// Recon polls for messages with short read deadlines, and a decompressor
+// cannot resume after a read times out. The session is therefore
+// decompressed in the background without a deadline, and read deadlines are
+// applied to reading the decompressed data.
+type compressedConn struct {
+	net.Conn
+
+	w *zlib.Writer
+
+	chunks  chan []byte
+	pending []byte
+	readErr error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newCompressedConn(conn net.Conn, algo string) (net.Conn, error) {
+	switch algo {
+	case "":
+		return conn, nil
+	case CompressionZlib:
+		c := &compressedConn{
+			Conn:   conn,
+			w:      zlib.NewWriter(conn),
+			chunks: make(chan []byte),
+			closed: make(chan struct{}),
+		}
+		go c.decompress()
+		return c, nil
+	}
+	return nil, errors.Errorf("unsupported compression %q", algo)
+}
+
+func (c *compressedConn) decompress() {
+	defer close(c.chunks)
+	// Deadlines set before the session started no longer apply.
+	c.Conn.SetReadDeadline(time.Time{})
+	r, err := zlib.NewReader(c.Conn)
+	if err != nil {
+		c.readErr = err
+		return
+	}
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := r.Read(buf)
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, timeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = chunk
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressedConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *compressedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *compressedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
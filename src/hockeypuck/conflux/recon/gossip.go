@@ -23,6 +23,7 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -32,6 +33,7 @@ import (
 	log "hockeypuck/logrus"
 
 	cf "hockeypuck/conflux"
+	"hockeypuck/tracing"
 )
 
 const GOSSIP = "gossip"
@@ -40,7 +42,7 @@ const GOSSIP = "gossip"
 // with a randomised skew of between +/-10%, giving 90% to 110%
 // of the configured interval.
 func (p *Peer) skewedGossipInterval() time.Duration {
-	interval := float32(p.settings.GossipIntervalSecs)
+	interval := float32(p.Settings().GossipIntervalSecs)
 	base := time.Duration(interval * 0.9)
 	skew := time.Duration(rand.Intn(int(interval*0.2) + 1))
 	return (base + skew) * time.Second
@@ -95,7 +97,7 @@ var ErrPeerBusy error = fmt.Errorf("peer is busy handling another request")
 var ErrReconDone = fmt.Errorf("reconciliation done")
 
 func (p *Peer) choosePartner() (net.Addr, error) {
-	partner, err := p.settings.RandomPartnerAddr()
+	partner, err := p.Settings().RandomPartnerAddr()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -105,21 +107,49 @@ func (p *Peer) choosePartner() (net.Addr, error) {
 	return partner, nil
 }
 
-func (p *Peer) InitiateRecon(addr net.Addr) error {
+// ReconWith reconciles with the peer at addr now, rather than waiting for it
+// to be chosen to gossip with. ErrPeerBusy is returned if the prefix tree is
+// being updated.
+func (p *Peer) ReconWith(addr net.Addr) error {
+	if !p.readAcquire() {
+		return errors.WithStack(ErrPeerBusy)
+	}
+	defer p.readRelease()
+
+	start := time.Now()
+	recordReconInitiate(addr, CLIENT)
+	err := p.InitiateRecon(addr)
+	if errors.Is(err, ErrPeerBusy) {
+		recordReconBusyPeer(addr, CLIENT)
+	} else if err != nil {
+		recordReconFailure(addr, time.Since(start), CLIENT)
+	} else {
+		recordReconSuccess(addr, time.Since(start), CLIENT)
+	}
+	return err
+}
+
+func (p *Peer) InitiateRecon(addr net.Addr) (_err error) {
 	p.log(GOSSIP).Debugf("initiating recon with peer %v", addr)
+	ctx, span := tracing.Start(context.Background(), "recon.session", tracing.KindClient,
+		tracing.String("net.peer.name", addr.String()))
+	defer func() {
+		span.SetError(_err)
+		span.Finish()
+	}()
 	conn, err := net.DialTimeout(addr.Network(), addr.String(), 30*time.Second)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	defer conn.Close()
 
-	remoteConfig, err := p.handleConfig(conn, GOSSIP, "")
+	sessionConn, remoteConfig, version, err := p.handleConfig(conn, GOSSIP, "")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	// Interact with peer
-	return p.clientRecon(conn, remoteConfig)
+	return p.clientRecon(ctx, sessionConn, remoteConfig, version)
 }
 
 type msgProgress struct {
@@ -147,11 +177,11 @@ func msgTypes(messages []ReconMsg) []string {
 
 type msgProgressChan chan *msgProgress
 
-func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
+func (p *Peer) clientRecon(ctx context.Context, conn net.Conn, remoteConfig *Config, version int) error {
 	w := bufio.NewWriter(conn)
 	respSet := cf.NewZSet()
 	defer func() {
-		p.sendItems(respSet.Items(), conn, remoteConfig)
+		p.sendItems(ctx, respSet.Items(), conn, remoteConfig, version)
 	}()
 
 	var pendingMessages []ReconMsg
@@ -247,7 +277,7 @@ func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly, conn net.Conn) *msgProgres
 		remoteSamples, localSamples, remoteSize, localSize, points, conn)
 	if errors.Is(err, cf.ErrLowMBar) {
 		p.logConn(GOSSIP, conn).Debug("ReconRqstPoly: low MBar")
-		if node.IsLeaf() || node.Size() < (p.settings.ThreshMult*p.settings.MBar) {
+		if node.IsLeaf() || node.Size() < (p.Settings().ThreshMult*p.Settings().MBar) {
 			p.logConnFields(GOSSIP, conn, log.Fields{
 				"node": node.Key(),
 			}).Debug("sending full elements")
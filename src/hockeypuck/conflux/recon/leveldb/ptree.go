@@ -49,6 +49,11 @@ type prefixTree struct {
 	root   *prefixNode
 	db     *leveldb.DB
 	points []cf.Zp
+
+	// batch, if not nil, holds the writes deferred until CommitBatch, and
+	// pending the values written by it, nil for deleted keys.
+	batch   *leveldb.Batch
+	pending map[string][]byte
 }
 
 type prefixNode struct {
@@ -96,6 +101,8 @@ func mustDecodeZZarray(buf []byte) []cf.Zp {
 
 const COLLECTION_NAME = "conflux.recon"
 
+var _ recon.BatchPrefixTree = (*prefixTree)(nil)
+
 func New(config recon.PTreeConfig, path string) (recon.PrefixTree, error) {
 	return &prefixTree{
 		PTreeConfig: config,
@@ -146,15 +153,61 @@ func (t *prefixTree) Root() (recon.PrefixNode, error) {
 	return n, nil
 }
 
+func (t *prefixTree) BeginBatch() {
+	if t.batch == nil {
+		t.batch = new(leveldb.Batch)
+		t.pending = map[string][]byte{}
+	}
+}
+
+func (t *prefixTree) CommitBatch() error {
+	if t.batch == nil {
+		return nil
+	}
+	batch := t.batch
+	t.batch, t.pending = nil, nil
+	return errors.WithStack(t.db.Write(batch, nil))
+}
+
+func (t *prefixTree) get(key []byte) ([]byte, error) {
+	if t.batch != nil {
+		if val, ok := t.pending[string(key)]; ok {
+			if val == nil {
+				return nil, leveldb.ErrNotFound
+			}
+			return val, nil
+		}
+	}
+	return t.db.Get(key, nil)
+}
+
+func (t *prefixTree) put(key, val []byte) error {
+	if t.batch != nil {
+		t.batch.Put(key, val)
+		t.pending[string(key)] = val
+		return nil
+	}
+	return t.db.Put(key, val, nil)
+}
+
+func (t *prefixTree) delete(key []byte) error {
+	if t.batch != nil {
+		t.batch.Delete(key)
+		t.pending[string(key)] = nil
+		return nil
+	}
+	return t.db.Delete(key, nil)
+}
+
 func (t *prefixTree) hasKey(key []byte) bool {
-	_, err := t.db.Get(key, nil)
+	_, err := t.get(key)
 	return err == nil
 }
 
 func (t *prefixTree) getNode(key []byte) (*prefixNode, error) {
 	var val []byte
 	var err error
-	if val, err = t.db.Get(key, nil); err != nil {
+	if val, err = t.get(key); err != nil {
 		if err == leveldb.ErrNotFound {
 			return nil, errors.WithStack(recon.ErrNodeNotFound)
 		}
@@ -226,7 +279,7 @@ func (n *prefixNode) insert(z *cf.Zp, marray []cf.Zp, bs *cf.Bitstring, depth in
 }
 
 func (n *prefixNode) deleteNode() error {
-	err := n.db.Delete(n.NodeKey, nil)
+	err := n.delete(n.NodeKey)
 	return errors.WithStack(err)
 }
 
@@ -358,7 +411,7 @@ func ErrElementNotFound(z *cf.Zp) error {
 }
 
 func (t *prefixTree) Insert(z *cf.Zp) error {
-	_, lookupErr := t.db.Get(z.Bytes(), nil)
+	_, lookupErr := t.get(z.Bytes())
 	if lookupErr == nil {
 		return errors.WithStack(ErrDuplicateElement(z))
 	} else if lookupErr != leveldb.ErrNotFound {
@@ -377,11 +430,11 @@ func (t *prefixTree) Insert(z *cf.Zp) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(t.db.Put(z.Bytes(), []byte{}, nil))
+	return errors.WithStack(t.put(z.Bytes(), []byte{}))
 }
 
 func (t *prefixTree) Remove(z *cf.Zp) error {
-	_, lookupErr := t.db.Get(z.Bytes(), nil)
+	_, lookupErr := t.get(z.Bytes())
 	if lookupErr != nil {
 		return errors.WithStack(lookupErr)
 	}
@@ -395,7 +448,7 @@ func (t *prefixTree) Remove(z *cf.Zp) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return t.db.Delete(z.Bytes(), nil)
+	return t.delete(z.Bytes())
 }
 
 func (t *prefixTree) newChildNode(parent *prefixNode, childIndex int) *prefixNode {
@@ -431,7 +484,7 @@ func (n *prefixNode) upsertNode() error {
 	if err := enc.Encode(n); err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(n.db.Put(n.NodeKey, buf.Bytes(), nil))
+	return errors.WithStack(n.put(n.NodeKey, buf.Bytes()))
 }
 
 func (n *prefixNode) IsLeaf() bool {
@@ -210,3 +210,30 @@ func (s *PtreeSuite) TestNewChildIndex(c *gc.C) {
 	c.Assert(child11.Key().Get(0), gc.Equals, 1)
 	c.Assert(child11.Key().Get(1), gc.Equals, 1)
 }
+
+func (s *PtreeSuite) TestBatch(c *gc.C) {
+	bt := s.ptree.(recon.BatchPrefixTree)
+	bt.BeginBatch()
+	// Enough elements to split the root.
+	for i := 1; i <= 1000; i++ {
+		c.Assert(s.ptree.Insert(cf.Zi(cf.P_SKS, i*65537)), gc.IsNil)
+	}
+	c.Assert(s.ptree.Remove(cf.Zi(cf.P_SKS, 65537)), gc.IsNil)
+	c.Assert(s.ptree.Insert(cf.Zi(cf.P_SKS, 2*65537)), gc.NotNil)
+	root, err := s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.Size(), gc.Equals, 999)
+	c.Assert(bt.CommitBatch(), gc.IsNil)
+
+	// The committed batch persists when the tree is reopened.
+	c.Assert(s.ptree.Close(), gc.IsNil)
+	ptree, err := New(s.config, s.path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+	s.ptree = ptree
+	root, err = s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.Size(), gc.Equals, 999)
+	c.Assert(root.IsLeaf(), gc.Equals, false)
+	c.Assert(recon.MustElements(root), gc.HasLen, 999)
+}
@@ -27,6 +27,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/pkg/errors"
 
@@ -489,9 +490,62 @@ type Config struct {
 	Custom     map[string]string
 }
 
+// Recon protocol versions. Peers advertise the latest version they support
+// in their config, and speak the earlier of their two versions, so that
+// extensions to the protocol are only used between peers which both
+// support them.
+const (
+	// ProtocolVersionSKS is the protocol spoken by SKS, and by peers which
+	// do not advertise a version.
+	ProtocolVersionSKS = 1
+
+	// ProtocolVersionCompression adds compression of the session following
+	// the config handshake, using an algorithm both peers advertise.
+	ProtocolVersionCompression = 2
+
+	// LatestProtocolVersion is the latest protocol version supported.
+	LatestProtocolVersion = ProtocolVersionCompression
+
+	// configProtocolVersion is the config key under which the protocol
+	// version is advertised. SKS ignores config keys it does not recognize.
+	configProtocolVersion = "protocol version"
+)
+
+// ProtocolVersion returns the protocol version advertised in the config.
+func (msg *Config) ProtocolVersion() int {
+	v, err := strconv.Atoi(msg.Custom[configProtocolVersion])
+	if err != nil || v < ProtocolVersionSKS {
+		return ProtocolVersionSKS
+	}
+	return v
+}
+
+// SetProtocolVersion sets the protocol version advertised in the config.
+// The SKS protocol version is advertised by omission.
+func (msg *Config) SetProtocolVersion(v int) {
+	if v <= ProtocolVersionSKS {
+		delete(msg.Custom, configProtocolVersion)
+		return
+	}
+	if msg.Custom == nil {
+		msg.Custom = map[string]string{}
+	}
+	msg.Custom[configProtocolVersion] = strconv.Itoa(v)
+}
+
+// NegotiateProtocolVersion returns the protocol version spoken between peers
+// which exchanged the given configs.
+func NegotiateProtocolVersion(local, remote *Config) int {
+	lv, rv := local.ProtocolVersion(), remote.ProtocolVersion()
+	if rv < lv {
+		return rv
+	}
+	return lv
+}
+
 func (msg *Config) String() string {
-	return fmt.Sprintf("%v: Version=%v HTTPPort=%v BitQuantum=%v MBar=%v Filters=%s", msg.MsgType(),
-		msg.Version, msg.HTTPPort, msg.BitQuantum, msg.MBar, msg.Filters)
+	return fmt.Sprintf("%v: Version=%v HTTPPort=%v BitQuantum=%v MBar=%v Filters=%s ProtocolVersion=%d", msg.MsgType(),
+		msg.Version, msg.HTTPPort, msg.BitQuantum, msg.MBar, msg.Filters, msg.ProtocolVersion())
 }
 
 func (msg *Config) MsgType() MsgType {
@@ -67,3 +67,35 @@ func (s *MessagesSuite) TestConfigMsgRoundTrip(c *gc.C) {
 	c.Assert(conf.BitQuantum, gc.Equals, conf2.BitQuantum)
 	c.Assert(conf.MBar, gc.Equals, conf2.MBar)
 }
+
+func (s *MessagesSuite) TestConfigProtocolVersion(c *gc.C) {
+	conf := &Config{Version: "3.1415", HTTPPort: 11371, BitQuantum: 2, MBar: 5}
+	c.Assert(conf.ProtocolVersion(), gc.Equals, ProtocolVersionSKS)
+
+	// The SKS version is advertised by omission, so that SKS peers are sent
+	// the config they expect.
+	conf.SetProtocolVersion(ProtocolVersionSKS)
+	c.Assert(conf.Custom, gc.HasLen, 0)
+
+	conf.SetProtocolVersion(3)
+	buf := bytes.NewBuffer(nil)
+	err := WriteMsg(buf, conf)
+	c.Assert(err, gc.IsNil)
+	msg, err := ReadMsg(bytes.NewBuffer(buf.Bytes()))
+	c.Assert(err, gc.IsNil)
+	conf2 := msg.(*Config)
+	c.Assert(conf2.ProtocolVersion(), gc.Equals, 3)
+
+	sks := &Config{Custom: map[string]string{}}
+	c.Assert(NegotiateProtocolVersion(conf, conf2), gc.Equals, 3)
+	c.Assert(NegotiateProtocolVersion(conf, sks), gc.Equals, ProtocolVersionSKS)
+	c.Assert(NegotiateProtocolVersion(sks, conf), gc.Equals, ProtocolVersionSKS)
+	conf2.SetProtocolVersion(2)
+	c.Assert(NegotiateProtocolVersion(conf, conf2), gc.Equals, 2)
+
+	// Invalid versions are treated as SKS.
+	conf2.Custom[configProtocolVersion] = "x"
+	c.Assert(conf2.ProtocolVersion(), gc.Equals, ProtocolVersionSKS)
+	conf2.Custom[configProtocolVersion] = "-1"
+	c.Assert(conf2.ProtocolVersion(), gc.Equals, ProtocolVersionSKS)
+}
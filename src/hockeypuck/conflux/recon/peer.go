@@ -23,6 +23,7 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -34,6 +35,7 @@ import (
 	log "hockeypuck/logrus"
 
 	cf "hockeypuck/conflux"
+	"hockeypuck/tracing"
 )
 
 const SERVE = "serve"
@@ -47,6 +49,14 @@ type Recover struct {
 	RemoteConfig   *Config
 	RemoteElements []cf.Zp
 	Done           chan struct{}
+
+	// ProtocolVersion is the recon protocol version negotiated with the
+	// remote peer.
+	ProtocolVersion int
+
+	// Context carries the trace of the recon session which found the
+	// elements, so that recovering them is traced as part of it.
+	Context context.Context
 }
 
 func (r *Recover) String() string {
@@ -77,8 +87,11 @@ var (
 )
 
 type Peer struct {
-	settings *Settings
-	ptree    PrefixTree
+	muSettings sync.RWMutex
+	settings   *Settings
+	matcher    IPMatcher
+
+	ptree PrefixTree
 
 	RecoverChan RecoverChan
 
@@ -113,6 +126,39 @@ func NewPeer(settings *Settings, tree PrefixTree) *Peer {
 	return p
 }
 
+// Settings returns the current settings of the peer, which must not be
+// modified.
+func (p *Peer) Settings() *Settings {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	return p.settings
+}
+
+// SetPartners changes the partners the peer gossips with and accepts
+// connections from, and the networks it otherwise accepts connections from.
+// Sessions in progress are unaffected.
+func (p *Peer) SetPartners(partners PartnerMap, allowCIDRs []string) error {
+	p.muSettings.Lock()
+	defer p.muSettings.Unlock()
+	settings := *p.settings
+	settings.Partners = partners
+	settings.AllowCIDRs = allowCIDRs
+	matcher, err := settings.Matcher()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p.settings = &settings
+	p.matcher = matcher
+	return nil
+}
+
+// allowed returns whether connections are accepted from ip.
+func (p *Peer) allowed(ip net.IP) bool {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	return p.matcher.Match(ip)
+}
+
 func NewMemPeer() *Peer {
 	settings := DefaultSettings()
 	tree := new(MemPrefixTree)
@@ -129,7 +175,7 @@ func (p *Peer) logConn(label string, conn net.Conn) *log.Entry {
 }
 
 func (p *Peer) logFields(label string, fields log.Fields) *log.Entry {
-	fields["label"] = fmt.Sprintf("%s %s", label, p.settings.ReconAddr)
+	fields["label"] = fmt.Sprintf("%s %s", label, p.Settings().ReconAddr)
 	return log.WithFields(fields)
 }
 
@@ -147,6 +193,7 @@ func (p *Peer) logConnErr(label string, conn net.Conn, err error) *log.Entry {
 }
 
 func (p *Peer) StartMode(mode PeerMode) {
+	p.t.Go(p.flushPeriodically)
 	switch mode {
 	case PeerModeGossipOnly:
 		p.t.Go(p.Gossip)
@@ -159,6 +206,7 @@ func (p *Peer) StartMode(mode PeerMode) {
 }
 
 func (p *Peer) Start() {
+	p.t.Go(p.flushPeriodically)
 	p.t.Go(p.Serve)
 	p.t.Go(p.Gossip)
 }
@@ -169,7 +217,10 @@ func (p *Peer) Stop() error {
 	p.t.Kill(nil)
 	p.muDie.Unlock()
 
-	return p.t.Wait()
+	err := p.t.Wait()
+	// Write any pending changes, which would otherwise be lost.
+	p.flush()
+	return err
 }
 
 func (p *Peer) Flush() {
@@ -257,15 +308,68 @@ func (p *Peer) mutate() {
 	})
 }
 
+// maxFlushBatch limits the number of elements written to a BatchPrefixTree
+// in a single batch.
+const maxFlushBatch = 10000
+
+// flushPeriodically writes pending changes to the prefix tree, so that they
+// are not held indefinitely while there are no recon sessions.
+func (p *Peer) flushPeriodically() error {
+	if p.Settings().FlushIntervalSecs <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(time.Duration(p.Settings().FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.t.Dying():
+			return nil
+		case <-ticker.C:
+			// Acquiring the tree schedules a flush once it is released.
+			if p.hasPending() && p.readAcquire() {
+				p.readRelease()
+			}
+		}
+	}
+}
+
+func (p *Peer) hasPending() bool {
+	p.muElements.Lock()
+	defer p.muElements.Unlock()
+	return len(p.insertElements) > 0 || len(p.removeElements) > 0
+}
+
 func (p *Peer) flush() {
 	p.muElements.Lock()
 
+	// Group the changes into batches where the tree supports them, rather
+	// than writing each node as it changes.
+	bt, batched := p.ptree.(BatchPrefixTree)
+	var n int
+	commit := func() {
+		err := bt.CommitBatch()
+		if err != nil {
+			log.Errorf("cannot write batch of prefix tree changes: %v", err)
+		}
+	}
+	next := func() {
+		n++
+		if batched && n%maxFlushBatch == 0 {
+			commit()
+			bt.BeginBatch()
+		}
+	}
+	if batched {
+		bt.BeginBatch()
+	}
+
 	for i := range p.insertElements {
 		z := &p.insertElements[i]
 		err := p.ptree.Insert(z)
 		if err != nil {
 			log.Warningf("cannot insert %q (%s) into prefix tree: %v", z, z.FullKeyHash(), err)
 		}
+		next()
 	}
 	if len(p.insertElements) > 0 {
 		p.logFields("mutate", log.Fields{"elements": len(p.insertElements)}).Debugf("inserted")
@@ -277,6 +381,10 @@ func (p *Peer) flush() {
 		if err != nil {
 			log.Warningf("cannot remove %q (%s) from prefix tree: %v", z, z.FullKeyHash(), err)
 		}
+		next()
+	}
+	if batched {
+		commit()
 	}
 	if len(p.removeElements) > 0 {
 		p.logFields("mutate", log.Fields{"elements": len(p.removeElements)}).Debugf("removed")
@@ -291,11 +399,13 @@ func (p *Peer) flush() {
 }
 
 func (p *Peer) Serve() error {
-	addr, err := p.settings.ReconNet.Resolve(p.settings.ReconAddr)
+	addr, err := p.Settings().ReconNet.Resolve(p.Settings().ReconAddr)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	matcher, err := p.settings.Matcher()
+	p.muSettings.Lock()
+	p.matcher, err = p.settings.Matcher()
+	p.muSettings.Unlock()
 	if err != nil {
 		log.Errorf("cannot create matcher: %v", err)
 		return errors.WithStack(err)
@@ -321,7 +431,7 @@ func (p *Peer) Serve() error {
 			tcConn.SetKeepAlivePeriod(3 * time.Minute)
 
 			remoteAddr := tcConn.RemoteAddr().(*net.TCPAddr)
-			if !matcher.Match(remoteAddr.IP) {
+			if !p.allowed(remoteAddr.IP) {
 				log.Warningf("connection rejected from %q", remoteAddr)
 				conn.Close()
 				continue
@@ -448,20 +558,33 @@ func (p *Peer) ackConfig(conn net.Conn) error {
 	return t.Wait()
 }
 
-func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Config, _err error) {
+// handleConfig exchanges configs with the remote peer, returning the
+// connection over which the session continues, the remote config and the
+// negotiated protocol version.
+func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ net.Conn, _ *Config, _ int, _err error) {
 	p.setReadDeadline(conn, defaultTimeout)
 
-	config, err := p.settings.Config()
+	config, err := p.Settings().Config()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, 0, errors.WithStack(err)
+	}
+	config.SetProtocolVersion(p.Settings().ProtocolVersionFor(conn.RemoteAddr()))
+	if config.ProtocolVersion() < ProtocolVersionCompression {
+		config.SetCompression(nil)
 	}
 
 	remoteConfig, err := p.remoteConfig(conn, role, config)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, 0, errors.WithStack(err)
 	}
+	version := NegotiateProtocolVersion(config, remoteConfig)
+	compression := NegotiateCompression(config, remoteConfig, version)
 
-	p.logConnFields(role, conn, log.Fields{"remoteConfig": remoteConfig}).Debug()
+	p.logConnFields(role, conn, log.Fields{
+		"remoteConfig":    remoteConfig,
+		"protocolVersion": version,
+		"compression":     compression,
+	}).Debug()
 
 	if failResp == "" {
 		if remoteConfig.BitQuantum != config.BitQuantum {
@@ -499,15 +622,19 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 			p.logConnErr(role, conn, err)
 		}
 
-		return nil, errors.Errorf("cannot peer: %v", failResp)
+		return nil, nil, 0, errors.Errorf("cannot peer: %v", failResp)
 	}
 
 	err = p.ackConfig(conn)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, 0, errors.WithStack(err)
 	}
 
-	return remoteConfig, nil
+	sessionConn, err := newCompressedConn(conn, compression)
+	if err != nil {
+		return nil, nil, 0, errors.WithStack(err)
+	}
+	return sessionConn, remoteConfig, version, nil
 }
 
 func (p *Peer) Accept(conn net.Conn) (_err error) {
@@ -527,13 +654,18 @@ func (p *Peer) Accept(conn net.Conn) (_err error) {
 		failResp = "sync not available, currently mutating"
 	}
 
-	remoteConfig, err := p.handleConfig(conn, SERVE, failResp)
+	sessionConn, remoteConfig, version, err := p.handleConfig(conn, SERVE, failResp)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	if failResp == "" {
-		return p.interactWithClient(conn, remoteConfig, cf.NewBitstring(0))
+		ctx, span := tracing.Start(context.Background(), "recon.session", tracing.KindServer,
+			tracing.String("net.peer.name", conn.RemoteAddr().String()))
+		defer span.Finish()
+		err := p.interactWithClient(ctx, sessionConn, remoteConfig, version, cf.NewBitstring(0))
+		span.SetError(err)
+		return err
 	}
 	return nil
 }
@@ -643,7 +775,7 @@ func (rwc *reconWithClient) sendRequest(p *Peer, req *requestEntry) error {
 	}
 
 	var msg ReconMsg
-	if req.node.IsLeaf() || (req.node.Size() < p.settings.MBar) {
+	if req.node.IsLeaf() || (req.node.Size() < p.Settings().MBar) {
 		elements, err := req.node.Elements()
 		if err != nil {
 			return errors.WithStack(err)
@@ -724,7 +856,7 @@ func (rwc *reconWithClient) flushQueue() error {
 
 var zeroTime time.Time
 
-func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring *cf.Bitstring) error {
+func (p *Peer) interactWithClient(ctx context.Context, conn net.Conn, remoteConfig *Config, version int, bitstring *cf.Bitstring) error {
 	p.logConn(SERVE, conn).Debug("interacting with client")
 	p.setReadDeadline(conn, defaultTimeout)
 
@@ -740,7 +872,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 	}
 
 	defer func() {
-		p.sendItems(recon.rcvrSet.Items(), conn, remoteConfig)
+		p.sendItems(ctx, recon.rcvrSet.Items(), conn, remoteConfig, version)
 	}()
 	defer func() {
 		WriteMsg(recon.bwr, &Done{})
@@ -785,7 +917,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 				if err != nil {
 					return errors.WithStack(err)
 				}
-			} else if len(recon.bottomQ) > p.settings.MaxOutstandingReconRequests ||
+			} else if len(recon.bottomQ) > p.Settings().MaxOutstandingReconRequests ||
 				len(recon.requestQ) == 0 {
 				if !recon.flushing {
 					err = recon.flushQueue()
@@ -819,15 +951,19 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 	return nil
 }
 
-func (p *Peer) sendItems(items []cf.Zp, conn net.Conn, remoteConfig *Config) error {
-	if len(items) > 0 && p.t.Alive() {
+func (p *Peer) sendItems(ctx context.Context, items []cf.Zp, conn net.Conn, remoteConfig *Config, version int) error {
+	// Items found by a session are recovered even if the peer is stopping,
+	// so that the session is not wasted.
+	if len(items) > 0 {
 		done := make(chan struct{})
 		select {
 		case p.RecoverChan <- &Recover{
-			RemoteAddr:     conn.RemoteAddr(),
-			RemoteConfig:   remoteConfig,
-			RemoteElements: items,
-			Done:           done,
+			RemoteAddr:      conn.RemoteAddr(),
+			RemoteConfig:    remoteConfig,
+			RemoteElements:  items,
+			Done:            done,
+			ProtocolVersion: version,
+			Context:         ctx,
 		}:
 			p.logConn(SERVE, conn).Infof("recovering %d items", len(items))
 			<-done
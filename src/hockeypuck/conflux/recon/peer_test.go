@@ -22,9 +22,12 @@
 package recon
 
 import (
+	"bufio"
 	"net"
 
 	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
 )
 
 type PeerSuite struct{}
@@ -61,3 +64,106 @@ func (s *PeerSuite) TestResolveRecoverAddr(c *gc.C) {
 		c.Assert(testHost, gc.Equals, hkpHost)
 	}
 }
+
+// handshake exchanges configs between two peers, returning their session
+// connections and negotiated protocol versions.
+func handshake(c *gc.C, p1, p2 *Peer) (net.Conn, net.Conn, int) {
+	conn1, conn2 := net.Pipe()
+	type result struct {
+		conn    net.Conn
+		version int
+		err     error
+	}
+	ch := make(chan result)
+	go func() {
+		conn, _, version, err := p2.handleConfig(conn2, SERVE, "")
+		ch <- result{conn, version, err}
+	}()
+	sess1, config, version, err := p1.handleConfig(conn1, GOSSIP, "")
+	c.Assert(err, gc.IsNil)
+	r := <-ch
+	c.Assert(r.err, gc.IsNil)
+	c.Assert(r.version, gc.Equals, version)
+	c.Assert(config.BitQuantum, gc.Equals, DefaultBitQuantum)
+	return sess1, r.conn, version
+}
+
+func (s *PeerSuite) TestHandleConfig(c *gc.C) {
+	for i, tc := range []struct {
+		maxVersion1, maxVersion2 int
+		compression1             []string
+		version                  int
+		compressed               bool
+	}{
+		{0, 0, []string{CompressionZlib}, LatestProtocolVersion, true},
+		{0, 0, nil, LatestProtocolVersion, false},
+		{ProtocolVersionSKS, 0, []string{CompressionZlib}, ProtocolVersionSKS, false},
+		{0, ProtocolVersionSKS, []string{CompressionZlib}, ProtocolVersionSKS, false},
+	} {
+		c.Logf("test#%d", i)
+		p1, p2 := NewMemPeer(), NewMemPeer()
+		p1.settings.MaxProtocolVersion = tc.maxVersion1
+		p2.settings.MaxProtocolVersion = tc.maxVersion2
+		p1.settings.Compression = tc.compression1
+
+		conn1, conn2, version := handshake(c, p1, p2)
+		c.Assert(version, gc.Equals, tc.version)
+		_, ok1 := conn1.(*compressedConn)
+		_, ok2 := conn2.(*compressedConn)
+		c.Assert(ok1, gc.Equals, tc.compressed)
+		c.Assert(ok2, gc.Equals, tc.compressed)
+
+		// The session continues over the negotiated connections.
+		go func() {
+			w := bufio.NewWriter(conn1)
+			WriteMsg(w, &ReconRqstFull{Prefix: cf.NewBitstring(0), Elements: cf.NewZSet(cf.Zi(cf.P_SKS, 65537))})
+			w.Flush()
+		}()
+		msg, err := ReadMsg(conn2)
+		c.Assert(err, gc.IsNil)
+		c.Assert(msg.(*ReconRqstFull).Elements.Contains(cf.Zi(cf.P_SKS, 65537)), gc.Equals, true)
+		conn1.Close()
+		conn2.Close()
+	}
+}
+
+func (s *PeerSuite) TestProtocolVersionFor(c *gc.C) {
+	settings := DefaultSettings()
+	settings.Partners["sks"] = Partner{
+		HTTPAddr:           "1.2.3.4:11371",
+		ReconAddr:          "1.2.3.4:11370",
+		MaxProtocolVersion: ProtocolVersionSKS,
+	}
+	sks := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 54321}
+	other := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 54321}
+	c.Assert(settings.ProtocolVersionFor(sks), gc.Equals, ProtocolVersionSKS)
+	c.Assert(settings.ProtocolVersionFor(other), gc.Equals, LatestProtocolVersion)
+
+	settings.MaxProtocolVersion = ProtocolVersionSKS
+	c.Assert(settings.ProtocolVersionFor(other), gc.Equals, ProtocolVersionSKS)
+}
+
+func (s *PeerSuite) TestSetPartners(c *gc.C) {
+	p := NewMemPeer()
+	initial := p.Settings()
+	err := p.SetPartners(PartnerMap{"sks": Partner{
+		HTTPAddr:  "1.2.3.4:11371",
+		ReconAddr: "1.2.3.4:11370",
+	}}, []string{"10.0.0.0/8"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Settings().Partners, gc.HasLen, 1)
+	c.Assert(initial.Partners, gc.HasLen, 0)
+	c.Assert(p.allowed(net.ParseIP("1.2.3.4")), gc.Equals, true)
+	c.Assert(p.allowed(net.ParseIP("10.1.2.3")), gc.Equals, true)
+	c.Assert(p.allowed(net.ParseIP("1.2.3.5")), gc.Equals, false)
+
+	addr, err := p.choosePartner()
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr.String(), gc.Equals, "1.2.3.4:11370")
+
+	// Invalid settings are not applied.
+	err = p.SetPartners(nil, []string{"10.0.0.0/33"})
+	c.Assert(err, gc.NotNil)
+	c.Assert(p.Settings().Partners, gc.HasLen, 1)
+	c.Assert(p.allowed(net.ParseIP("1.2.3.4")), gc.Equals, true)
+}
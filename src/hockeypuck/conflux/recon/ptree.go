@@ -41,6 +41,17 @@ type PrefixTree interface {
 	Remove(z *cf.Zp) error
 }
 
+// BatchPrefixTree is implemented by prefix trees which can group a series of
+// insertions and removals into a single write to the underlying storage.
+type BatchPrefixTree interface {
+	PrefixTree
+	// BeginBatch defers writes to the tree until CommitBatch. Reads from
+	// the tree in the meantime observe the deferred writes.
+	BeginBatch()
+	// CommitBatch writes the changes made since BeginBatch.
+	CommitBatch() error
+}
+
 type PrefixNode interface {
 	Config() *PTreeConfig
 	Parent() (PrefixNode, bool, error)
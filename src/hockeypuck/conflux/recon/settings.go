@@ -67,6 +67,19 @@ type Settings struct {
 
 	GossipIntervalSecs          int `toml:"gossipIntervalSecs" json:"-"`
 	MaxOutstandingReconRequests int `toml:"maxOutstandingReconRequests" json:"-"`
+
+	// FlushIntervalSecs is how often pending insertions and removals are
+	// written to the prefix tree, when they are not written sooner by a
+	// recon session.
+	FlushIntervalSecs int `toml:"flushIntervalSecs" json:"-"`
+
+	// MaxProtocolVersion limits the recon protocol version advertised to
+	// peers. Zero advertises LatestProtocolVersion.
+	MaxProtocolVersion int `toml:"maxProtocolVersion"`
+
+	// Compression lists the compression algorithms accepted for recon
+	// sessions. Sessions are compressed with peers which accept one of them.
+	Compression []string `toml:"compression"`
 }
 
 type Partner struct {
@@ -75,6 +88,11 @@ type Partner struct {
 	ReconAddr string  `toml:"reconAddr"`
 	ReconNet  netType `toml:"reconNet" json:"-"`
 	Weight    int     `toml:"weight"`
+
+	// MaxProtocolVersion limits the recon protocol version advertised to
+	// this partner, overriding the setting for all peers if lower. Zero
+	// applies the setting for all peers.
+	MaxProtocolVersion int `toml:"maxProtocolVersion"`
 }
 
 type matchAccessType uint8
@@ -98,7 +116,7 @@ func newIPMatcher() *ipMatcher {
 func (m *ipMatcher) allow(partner Partner) error {
 	var httpAddr *net.TCPAddr
 	if partner.HTTPNet == NetworkDefault || partner.HTTPNet == NetworkTCP {
-		httpAddr, resolveErr := net.ResolveTCPAddr("tcp", partner.HTTPAddr)
+		httpAddr, resolveErr := net.ResolveTCPAddr("tcp", withPort(partner.HTTPAddr))
 		if resolveErr == nil && httpAddr.IP != nil {
 			err := m.allowCIDR(fmt.Sprintf("%s/32", httpAddr.IP.String()))
 			if err != nil {
@@ -115,6 +133,16 @@ func (m *ipMatcher) allow(partner Partner) error {
 	return nil
 }
 
+// withPort adds a port to addr if it has none, so that a partner configured
+// by a bare domain, whose HTTP address is found by the SRV records of the
+// domain, can still be resolved for access control.
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "0")
+}
+
 func (m *ipMatcher) allowCIDR(cidr string) error {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -186,6 +214,7 @@ const (
 	DefaultReconAddr                   = ":11370"
 	DefaultGossipIntervalSecs          = 60
 	DefaultMaxOutstandingReconRequests = 100
+	DefaultFlushIntervalSecs           = 10
 
 	DefaultThreshMult = 10
 	DefaultBitQuantum = 2
@@ -208,6 +237,9 @@ var defaultSettings = Settings{
 
 	GossipIntervalSecs:          DefaultGossipIntervalSecs,
 	MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+	FlushIntervalSecs:           DefaultFlushIntervalSecs,
+
+	Compression: []string{CompressionZlib},
 }
 
 // Resolve resolves network addresses and backwards-compatible settings. Use
@@ -234,6 +266,12 @@ func (s *Settings) Resolve() error {
 		}
 	}
 
+	for _, algo := range s.Compression {
+		if !validCompression(algo) {
+			return errors.Errorf("unsupported compression %q", algo)
+		}
+	}
+
 	_, err := s.HTTPNet.Resolve(s.HTTPAddr)
 	if err != nil {
 		return errors.Wrapf(err, "invalid httpNet %q httpAddr %q", s.HTTPNet, s.HTTPAddr)
@@ -272,6 +310,7 @@ func ParseSettings(data string) (*Settings, error) {
 func DefaultSettings() *Settings {
 	settings := defaultSettings
 	settings.Partners = make(PartnerMap)
+	settings.Compression = append([]string(nil), defaultSettings.Compression...)
 	return &settings
 }
 
@@ -294,6 +333,8 @@ func (s *Settings) Config() (*Config, error) {
 		MBar:       s.MBar,
 		Filters:    strings.Join(s.Filters, ","),
 	}
+	config.SetProtocolVersion(s.ProtocolVersionFor(nil))
+	config.SetCompression(s.Compression)
 
 	// Try to obtain httpPort
 	addr, err := s.HTTPNet.Resolve(s.HTTPAddr)
@@ -308,6 +349,46 @@ func (s *Settings) Config() (*Config, error) {
 	return config, nil
 }
 
+// ProtocolVersionFor returns the recon protocol version to advertise to the
+// peer at the given address.
+func (s *Settings) ProtocolVersionFor(addr net.Addr) int {
+	v := LatestProtocolVersion
+	if s.MaxProtocolVersion > 0 && s.MaxProtocolVersion < v {
+		v = s.MaxProtocolVersion
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return v
+	}
+	for _, partner := range s.Partners {
+		if partner.MaxProtocolVersion <= 0 || partner.MaxProtocolVersion >= v {
+			continue
+		}
+		if partner.matchIP(tcpAddr.IP) {
+			v = partner.MaxProtocolVersion
+		}
+	}
+	return v
+}
+
+// matchIP returns whether the partner's HTTP or recon address resolves to the
+// given IP address.
+func (p *Partner) matchIP(ip net.IP) bool {
+	for _, pa := range []struct {
+		network netType
+		addr    string
+	}{{p.ReconNet, p.ReconAddr}, {p.HTTPNet, p.HTTPAddr}} {
+		if pa.network != NetworkDefault && pa.network != NetworkTCP {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", pa.addr)
+		if err == nil && addr.IP != nil && addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // SplitThreshold returns the maximum number of elements a prefix tree node may
 // contain before creating child nodes and distributing the elements among them.
 func (c *PTreeConfig) SplitThreshold() int {
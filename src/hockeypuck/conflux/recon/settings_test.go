@@ -63,6 +63,8 @@ filters=["something","else"]
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			FlushIntervalSecs:           DefaultFlushIntervalSecs,
+			Compression:                 []string{CompressionZlib},
 		},
 		"",
 	}, {
@@ -85,8 +87,49 @@ filters=["something","else"]
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			FlushIntervalSecs:           DefaultFlushIntervalSecs,
+			Compression:                 []string{CompressionZlib},
 		},
 		"",
+	}, {
+		"protocol version limits",
+		`
+[conflux.recon]
+maxProtocolVersion=1
+
+[conflux.recon.partner.sks]
+httpAddr="1.2.3.4:11371"
+reconAddr="1.2.3.4:11370"
+maxProtocolVersion=1
+`,
+		&Settings{
+			PTreeConfig: defaultPTreeConfig,
+			Version:     DefaultVersion,
+			LogName:     DefaultLogName,
+			HTTPAddr:    ":11371",
+			ReconAddr:   ":11370",
+			Partners: PartnerMap{
+				"sks": Partner{
+					HTTPAddr:           "1.2.3.4:11371",
+					ReconAddr:          "1.2.3.4:11370",
+					MaxProtocolVersion: 1,
+				},
+			},
+			GossipIntervalSecs:          DefaultGossipIntervalSecs,
+			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			FlushIntervalSecs:           DefaultFlushIntervalSecs,
+			MaxProtocolVersion:          1,
+			Compression:                 []string{CompressionZlib},
+		},
+		"",
+	}, {
+		"unsupported compression",
+		`
+[conflux.recon]
+compression=["lzma"]
+`,
+		nil,
+		`unsupported compression "lzma"`,
 	}, {
 		"invalid toml",
 		`nope`,
@@ -154,6 +197,8 @@ reconAddr="8.7.6.5:11370"
 			ReconAddr:                   DefaultReconAddr,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			FlushIntervalSecs:           DefaultFlushIntervalSecs,
+			Compression:                 []string{CompressionZlib},
 			Partners: map[string]Partner{
 				"alice": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
@@ -184,6 +229,8 @@ partners=["1.2.3.4:11370","5.6.7.8:11370"]
 			CompatReconPort:             11370,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			FlushIntervalSecs:           DefaultFlushIntervalSecs,
+			Compression:                 []string{CompressionZlib},
 			Partners: map[string]Partner{
 				"1.2.3.4": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
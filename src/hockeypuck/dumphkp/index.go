@@ -0,0 +1,618 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package dumphkp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	// DumpPattern matches the key dump files written by hockeypuck-dump.
+	DumpPattern = "hkp-dump-*.pgp"
+
+	// IndexFile is the name of the index built over the dump files in a
+	// directory.
+	IndexFile = "hkp-dump.idx"
+
+	indexVersion = 2
+)
+
+// The index file is a header followed by sections of fixed-width records,
+// each sorted so that it can be searched where it is memory-mapped, like the
+// dump files, rather than being decoded onto the heap. The header holds a
+// magic number, the version, and the offset and number of records of each
+// section. Integers are little-endian. Dump file names and search keywords
+// are kept in the strings section, and referred to by offset and length.
+var indexMagic = []byte("hkpidx\x00\x00")
+
+const (
+	// sectionFiles holds the dump files, in the order they were read.
+	sectionFiles = iota
+	// sectionKeys holds the keys, sorted by rfingerprint.
+	sectionKeys
+	// sectionMD5s holds the position of each key, sorted by its digest.
+	sectionMD5s
+	// sectionSubKeys holds the position of the primary key of each subkey,
+	// sorted by the subkey's rfingerprint.
+	sectionSubKeys
+	// sectionKeywords holds the postings of each search keyword, sorted by
+	// keyword.
+	sectionKeywords
+	// sectionPostings holds the positions of the keys matching each keyword.
+	sectionPostings
+	// sectionStrings holds the bytes of the strings referred to by records.
+	sectionStrings
+	numSections
+)
+
+const (
+	headerSize = 16 + numSections*16
+
+	// rfpSize is the size of an rfingerprint in hex, padded with NULs, so
+	// that records compare in the same order as rfingerprints.
+	rfpSize    = 64
+	md5Size    = 16
+	stringSize = 12
+)
+
+// recordSizes are the sizes of the records in each section.
+var recordSizes = [numSections]int{
+	sectionFiles:    stringSize + 8 + 8,     // name, size, mtime
+	sectionKeys:     rfpSize + md5Size + 20, // rfingerprint, digest, file, offset, length
+	sectionMD5s:     md5Size + 4,            // digest, key
+	sectionSubKeys:  rfpSize + 4,            // rfingerprint, key
+	sectionKeywords: stringSize + 8 + 4,     // keyword, postings offset, count
+	sectionPostings: 4,                      // key
+	sectionStrings:  1,
+}
+
+// index locates the keys in a set of dump files, and records the keys'
+// identifiers and search keywords.
+type index struct {
+	data     []byte
+	sections [numSections][]byte
+}
+
+type indexFile struct {
+	Name  string
+	Size  int64
+	MTime time.Time
+}
+
+type indexKey struct {
+	RFingerprint string
+	MD5          string
+	File         int
+	Offset       int64
+	Length       int64
+}
+
+type indexSubKey struct {
+	RFingerprint string
+	// Key is the position of the primary key in Keys.
+	Key int
+}
+
+// indexData is the contents of an index, as it is built.
+type indexData struct {
+	Files []indexFile
+	// Keys is sorted by RFingerprint.
+	Keys []indexKey
+	// SubKeys is sorted by RFingerprint.
+	SubKeys []indexSubKey
+	// Keywords maps each search keyword to the positions in Keys of the keys
+	// it matches.
+	Keywords map[string][]int
+}
+
+// BuildIndex indexes the dump files in dir, replacing any existing index.
+// It must be run again whenever the dump files change.
+func BuildIndex(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, DumpPattern))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sort.Strings(names)
+
+	type indexed struct {
+		indexKey
+		subKeys  []string
+		keywords []string
+	}
+	idx := &indexData{}
+	var entries []indexed
+	for i, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		idx.Files = append(idx.Files, indexFile{
+			Name:  filepath.Base(name),
+			Size:  fi.Size(),
+			MTime: fi.ModTime(),
+		})
+
+		data, err := mmapFile(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = scanDump(data, func(offset, length int64, key *openpgp.PrimaryKey) {
+			entry := indexed{
+				indexKey: indexKey{
+					RFingerprint: key.RFingerprint,
+					MD5:          key.MD5,
+					File:         i,
+					Offset:       offset,
+					Length:       length,
+				},
+				keywords: hkpstorage.Keywords(key),
+			}
+			for _, subKey := range key.SubKeys {
+				entry.subKeys = append(entry.subKeys, subKey.RFingerprint)
+			}
+			entries = append(entries, entry)
+		})
+		munmapFile(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to index %q", name)
+		}
+		log.Infof("indexed %q", name)
+	}
+
+	// A key may appear in more than one dump file; the last one read wins.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].RFingerprint < entries[j].RFingerprint
+	})
+	idx.Keywords = map[string][]int{}
+	for i, entry := range entries {
+		if i+1 < len(entries) && entries[i+1].RFingerprint == entry.RFingerprint {
+			continue
+		}
+		pos := len(idx.Keys)
+		idx.Keys = append(idx.Keys, entry.indexKey)
+		for _, rfp := range entry.subKeys {
+			idx.SubKeys = append(idx.SubKeys, indexSubKey{RFingerprint: rfp, Key: pos})
+		}
+		for _, keyword := range entry.keywords {
+			idx.Keywords[keyword] = append(idx.Keywords[keyword], pos)
+		}
+	}
+	sort.Slice(idx.SubKeys, func(i, j int) bool {
+		return idx.SubKeys[i].RFingerprint < idx.SubKeys[j].RFingerprint
+	})
+
+	return idx.write(filepath.Join(dir, IndexFile))
+}
+
+// scanDump calls f with the offset, length and contents of each key in a dump
+// file.
+func scanDump(data []byte, f func(offset, length int64, key *openpgp.PrimaryKey)) error {
+	r := bytes.NewReader(data)
+	or := packet.NewOpaqueReader(r)
+	start := int64(-1)
+	emit := func(end int64) error {
+		if start < 0 {
+			return nil
+		}
+		keys, err := openpgp.NewKeyReader(bytes.NewReader(data[start:end])).Read()
+		if err != nil {
+			return errors.Wrapf(err, "invalid key at offset %d", start)
+		}
+		for _, key := range keys {
+			f(start, end-start, key)
+		}
+		return nil
+	}
+	for {
+		pos := r.Size() - int64(r.Len())
+		op, err := or.Next()
+		if err == io.EOF {
+			return emit(pos)
+		} else if err != nil {
+			return errors.Wrapf(err, "invalid packet at offset %d", pos)
+		}
+		if op.Tag == 6 { //packet.PacketTypePublicKey
+			err = emit(pos)
+			if err != nil {
+				return err
+			}
+			start = pos
+		}
+	}
+}
+
+func (idx *indexData) write(path string) error {
+	if len(idx.Keys) > math.MaxUint32 {
+		return errors.Errorf("too many keys to index: %d", len(idx.Keys))
+	}
+	type md5Entry struct {
+		digest []byte
+		key    int
+	}
+	md5s := make([]md5Entry, len(idx.Keys))
+	for i, key := range idx.Keys {
+		if len(key.RFingerprint) > rfpSize {
+			return errors.Errorf("fingerprint %q is too long to index", key.RFingerprint)
+		}
+		digest, err := hex.DecodeString(key.MD5)
+		if err != nil || len(digest) != md5Size {
+			return errors.Errorf("invalid digest %q of key %q", key.MD5, key.RFingerprint)
+		}
+		md5s[i] = md5Entry{digest: digest, key: i}
+	}
+	sort.SliceStable(md5s, func(i, j int) bool {
+		return bytes.Compare(md5s[i].digest, md5s[j].digest) < 0
+	})
+	for _, subKey := range idx.SubKeys {
+		if len(subKey.RFingerprint) > rfpSize {
+			return errors.Errorf("fingerprint %q is too long to index", subKey.RFingerprint)
+		}
+	}
+	words := make([]string, 0, len(idx.Keywords))
+	var numPostings int
+	for word, positions := range idx.Keywords {
+		words = append(words, word)
+		numPostings += len(positions)
+	}
+	sort.Strings(words)
+	// Strings are written last, file names first, in the order they are
+	// referred to.
+	var strs []string
+	var numStrings int
+	for _, file := range idx.Files {
+		strs = append(strs, file.Name)
+		numStrings += len(file.Name)
+	}
+	for _, word := range words {
+		strs = append(strs, word)
+		numStrings += len(word)
+	}
+
+	counts := [numSections]int{
+		sectionFiles:    len(idx.Files),
+		sectionKeys:     len(idx.Keys),
+		sectionMD5s:     len(md5s),
+		sectionSubKeys:  len(idx.SubKeys),
+		sectionKeywords: len(words),
+		sectionPostings: numPostings,
+		sectionStrings:  numStrings,
+	}
+	var offsets [numSections]int
+	offset := headerSize
+	for sec, n := range counts {
+		offsets[sec] = offset
+		offset += n * recordSizes[sec]
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w := &indexWriter{w: bufio.NewWriter(f)}
+	w.bytes(indexMagic)
+	w.uint64(indexVersion)
+	for sec, n := range counts {
+		w.uint64(uint64(offsets[sec]))
+		w.uint64(uint64(n))
+	}
+	stringOffset := offsets[sectionStrings]
+	str := func(s string) {
+		w.uint64(uint64(stringOffset))
+		w.uint32(uint32(len(s)))
+		stringOffset += len(s)
+	}
+	for _, file := range idx.Files {
+		str(file.Name)
+		w.uint64(uint64(file.Size))
+		w.uint64(uint64(file.MTime.UnixNano()))
+	}
+	for _, key := range idx.Keys {
+		w.rfingerprint(key.RFingerprint)
+		// Digests were checked above, when they were sorted.
+		digest, _ := hex.DecodeString(key.MD5)
+		w.bytes(digest)
+		w.uint32(uint32(key.File))
+		w.uint64(uint64(key.Offset))
+		w.uint64(uint64(key.Length))
+	}
+	for _, entry := range md5s {
+		w.bytes(entry.digest)
+		w.uint32(uint32(entry.key))
+	}
+	for _, subKey := range idx.SubKeys {
+		w.rfingerprint(subKey.RFingerprint)
+		w.uint32(uint32(subKey.Key))
+	}
+	var postings int
+	for _, word := range words {
+		str(word)
+		w.uint64(uint64(postings))
+		w.uint32(uint32(len(idx.Keywords[word])))
+		postings += len(idx.Keywords[word])
+	}
+	for _, word := range words {
+		for _, pos := range idx.Keywords[word] {
+			w.uint32(uint32(pos))
+		}
+	}
+	for _, s := range strs {
+		w.bytes([]byte(s))
+	}
+
+	err = w.flush()
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
+
+// indexWriter writes the fields of index records, keeping the first error.
+type indexWriter struct {
+	w       *bufio.Writer
+	scratch [8]byte
+	err     error
+}
+
+func (w *indexWriter) bytes(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *indexWriter) uint32(n uint32) {
+	binary.LittleEndian.PutUint32(w.scratch[:4], n)
+	w.bytes(w.scratch[:4])
+}
+
+func (w *indexWriter) uint64(n uint64) {
+	binary.LittleEndian.PutUint64(w.scratch[:], n)
+	w.bytes(w.scratch[:])
+}
+
+func (w *indexWriter) rfingerprint(rfp string) {
+	var field [rfpSize]byte
+	copy(field[:], rfp)
+	w.bytes(field[:])
+}
+
+func (w *indexWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// readIndex maps the index at path into memory. It must be closed when it is
+// no longer used.
+func readIndex(path string) (*index, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	idx := &index{data: data}
+	err = idx.parse()
+	if err != nil {
+		munmapFile(data)
+		return nil, errors.Wrapf(err, "failed to read index %q", path)
+	}
+	return idx, nil
+}
+
+func (idx *index) parse() error {
+	if len(idx.data) < headerSize || !bytes.Equal(idx.data[:len(indexMagic)], indexMagic) {
+		return errors.New("not an index")
+	}
+	version := binary.LittleEndian.Uint64(idx.data[8:])
+	if version != indexVersion {
+		return errors.Errorf("unsupported version %d", version)
+	}
+	size := uint64(len(idx.data))
+	for sec := range idx.sections {
+		offset := binary.LittleEndian.Uint64(idx.data[16+sec*16:])
+		n := binary.LittleEndian.Uint64(idx.data[24+sec*16:])
+		if offset > size || n > (size-offset)/uint64(recordSizes[sec]) {
+			return errors.Errorf("section %d is out of bounds", sec)
+		}
+		idx.sections[sec] = idx.data[offset : offset+n*uint64(recordSizes[sec])]
+	}
+	return nil
+}
+
+func (idx *index) close() error {
+	data := idx.data
+	idx.data = nil
+	idx.sections = [numSections][]byte{}
+	return munmapFile(data)
+}
+
+// count returns the number of records in a section.
+func (idx *index) count(sec int) int {
+	return len(idx.sections[sec]) / recordSizes[sec]
+}
+
+// record returns the i'th record of a section.
+func (idx *index) record(sec, i int) []byte {
+	size := recordSizes[sec]
+	return idx.sections[sec][i*size : (i+1)*size]
+}
+
+// str returns the string referred to at the start of b.
+func (idx *index) str(b []byte) []byte {
+	offset := binary.LittleEndian.Uint64(b)
+	n := uint64(binary.LittleEndian.Uint32(b[8:]))
+	if offset > uint64(len(idx.data)) || n > uint64(len(idx.data))-offset {
+		return nil
+	}
+	return idx.data[offset : offset+n]
+}
+
+// rfingerprint returns the rfingerprint at the start of b, without padding.
+func rfingerprint(b []byte) []byte {
+	return bytes.TrimRight(b[:rfpSize], "\x00")
+}
+
+func (idx *index) numFiles() int {
+	return idx.count(sectionFiles)
+}
+
+func (idx *index) file(i int) indexFile {
+	b := idx.record(sectionFiles, i)
+	return indexFile{
+		Name:  string(idx.str(b)),
+		Size:  int64(binary.LittleEndian.Uint64(b[stringSize:])),
+		MTime: time.Unix(0, int64(binary.LittleEndian.Uint64(b[stringSize+8:]))),
+	}
+}
+
+func (idx *index) numKeys() int {
+	return idx.count(sectionKeys)
+}
+
+func (idx *index) key(i int) indexKey {
+	b := idx.record(sectionKeys, i)
+	return indexKey{
+		RFingerprint: string(rfingerprint(b)),
+		MD5:          hex.EncodeToString(b[rfpSize : rfpSize+md5Size]),
+		File:         idx.keyFile(i),
+		Offset:       int64(binary.LittleEndian.Uint64(b[rfpSize+md5Size+4:])),
+		Length:       int64(binary.LittleEndian.Uint64(b[rfpSize+md5Size+12:])),
+	}
+}
+
+// keyFile returns the position in the files of the dump file containing the
+// i'th key, without decoding the rest of the key's record.
+func (idx *index) keyFile(i int) int {
+	b := idx.record(sectionKeys, i)
+	return int(binary.LittleEndian.Uint32(b[rfpSize+md5Size:]))
+}
+
+// keyRFingerprint returns the rfingerprint of the i'th key.
+func (idx *index) keyRFingerprint(i int) string {
+	return string(rfingerprint(idx.record(sectionKeys, i)))
+}
+
+// searchKeys returns the position of the first key whose rfingerprint is not
+// less than rfp.
+func (idx *index) searchKeys(rfp string) int {
+	return sort.Search(idx.numKeys(), func(i int) bool {
+		return string(rfingerprint(idx.record(sectionKeys, i))) >= rfp
+	})
+}
+
+// find returns the position of the key with the given rfingerprint.
+func (idx *index) find(rfp string) (int, bool) {
+	i := idx.searchKeys(rfp)
+	if i < idx.numKeys() && string(rfingerprint(idx.record(sectionKeys, i))) == rfp {
+		return i, true
+	}
+	return -1, false
+}
+
+func (idx *index) numSubKeys() int {
+	return idx.count(sectionSubKeys)
+}
+
+func (idx *index) subKey(i int) indexSubKey {
+	b := idx.record(sectionSubKeys, i)
+	return indexSubKey{
+		RFingerprint: string(rfingerprint(b)),
+		Key:          int(binary.LittleEndian.Uint32(b[rfpSize:])),
+	}
+}
+
+// searchSubKeys returns the position of the first subkey whose rfingerprint
+// is not less than rfp.
+func (idx *index) searchSubKeys(rfp string) int {
+	return sort.Search(idx.numSubKeys(), func(i int) bool {
+		return string(rfingerprint(idx.record(sectionSubKeys, i))) >= rfp
+	})
+}
+
+// findMD5 returns the position of the key with the given digest.
+func (idx *index) findMD5(md5 string) (int, bool) {
+	digest, err := hex.DecodeString(md5)
+	if err != nil || len(digest) != md5Size {
+		return -1, false
+	}
+	n := idx.count(sectionMD5s)
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(idx.record(sectionMD5s, i)[:md5Size], digest) >= 0
+	})
+	if i == n {
+		return -1, false
+	}
+	b := idx.record(sectionMD5s, i)
+	if !bytes.Equal(b[:md5Size], digest) {
+		return -1, false
+	}
+	key := int(binary.LittleEndian.Uint32(b[md5Size:]))
+	return key, key < idx.numKeys()
+}
+
+// keyword returns the positions of the keys matching a search keyword, in
+// ascending order.
+func (idx *index) keyword(word string) []int {
+	n := idx.count(sectionKeywords)
+	i := sort.Search(n, func(i int) bool {
+		return string(idx.str(idx.record(sectionKeywords, i))) >= word
+	})
+	if i == n {
+		return nil
+	}
+	b := idx.record(sectionKeywords, i)
+	if string(idx.str(b)) != word {
+		return nil
+	}
+	start := int(binary.LittleEndian.Uint64(b[stringSize:]))
+	count := int(binary.LittleEndian.Uint32(b[stringSize+8:]))
+	if start > idx.count(sectionPostings) || count > idx.count(sectionPostings)-start {
+		return nil
+	}
+	positions := make([]int, 0, count)
+	for j := 0; j < count; j++ {
+		pos := int(binary.LittleEndian.Uint32(idx.record(sectionPostings, start+j)))
+		if pos < idx.numKeys() {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
@@ -0,0 +1,297 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package dumphkp provides read-only HKP storage over a set of key dump
+// files, as written by hockeypuck-dump and indexed by BuildIndex. It needs no
+// database, and is suitable for disaster recovery or cheap mirrors.
+package dumphkp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// ErrReadOnly is returned by any attempt to modify dump storage.
+var ErrReadOnly = errors.New("dump storage is read-only")
+
+const maxResults = 100
+
+type storage struct {
+	dir   string
+	idx   *index
+	files [][]byte
+
+	hkpstorage.Listeners
+}
+
+var _ hkpstorage.Storage = (*storage)(nil)
+
+// Open returns read-only storage serving the dump files in dir, which must
+// have been indexed by BuildIndex since they were last changed. The dump files
+// and their index are memory-mapped, so that only the keys looked up are read.
+func Open(dir string) (hkpstorage.Storage, error) {
+	idx, err := readIndex(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	st := &storage{
+		dir: dir,
+		idx: idx,
+	}
+	for i := 0; i < idx.numFiles(); i++ {
+		file := idx.file(i)
+		name := filepath.Join(dir, file.Name)
+		fi, err := os.Stat(name)
+		if err != nil {
+			st.Close()
+			return nil, errors.WithStack(err)
+		}
+		if fi.Size() != file.Size || !fi.ModTime().Equal(file.MTime) {
+			st.Close()
+			return nil, errors.Errorf("dump file %q has changed since it was indexed", name)
+		}
+		data, err := mmapFile(name)
+		if err != nil {
+			st.Close()
+			return nil, errors.WithStack(err)
+		}
+		st.files = append(st.files, data)
+	}
+	log.Infof("serving %d keys from %d dump files in %q", idx.numKeys(), idx.numFiles(), dir)
+	return st, nil
+}
+
+func init() {
+	// The data source is the directory of indexed key dump files.
+	hkpstorage.Register("dump", func(dsn string, _ *hkpstorage.Config) (hkpstorage.Storage, error) {
+		return Open(hkpstorage.DSNPath(dsn))
+	})
+}
+
+func (st *storage) Close() error {
+	var err error
+	for _, data := range st.files {
+		if unmapErr := munmapFile(data); unmapErr != nil {
+			err = unmapErr
+		}
+	}
+	st.files = nil
+	if st.idx != nil {
+		if unmapErr := st.idx.close(); unmapErr != nil {
+			err = unmapErr
+		}
+	}
+	return err
+}
+
+func (st *storage) MatchMD5(md5s []string) ([]string, error) {
+	var result []string
+	for _, md5 := range md5s {
+		if i, ok := st.idx.findMD5(strings.ToLower(md5)); ok {
+			result = append(result, st.idx.keyRFingerprint(i))
+		}
+	}
+	return result, nil
+}
+
+// Resolve returns all keys matching each key ID, by their own fingerprint or
+// that of a subkey, in rfingerprint order.
+func (st *storage) Resolve(keyids []string) ([]string, error) {
+	var result []string
+	for _, keyid := range keyids {
+		keyid = strings.ToLower(keyid)
+		matches := map[string]bool{}
+		for i := st.idx.searchKeys(keyid); i < st.idx.numKeys(); i++ {
+			rfp := st.idx.keyRFingerprint(i)
+			if !strings.HasPrefix(rfp, keyid) {
+				break
+			}
+			matches[rfp] = true
+		}
+		for i := st.idx.searchSubKeys(keyid); i < st.idx.numSubKeys(); i++ {
+			subKey := st.idx.subKey(i)
+			if !strings.HasPrefix(subKey.RFingerprint, keyid) {
+				break
+			}
+			if subKey.Key >= st.idx.numKeys() {
+				continue
+			}
+			matches[st.idx.keyRFingerprint(subKey.Key)] = true
+		}
+		var rfps []string
+		for rfp := range matches {
+			rfps = append(rfps, rfp)
+		}
+		sort.Strings(rfps)
+		result = append(result, rfps...)
+	}
+	return result, nil
+}
+
+// MatchKeyword returns the keys matching all of the words in each search
+// term, as keywords are extracted from user IDs when indexed.
+func (st *storage) MatchKeyword(search []string) ([]string, error) {
+	var result []string
+	for _, term := range search {
+		var matches map[int]bool
+		for _, word := range strings.Fields(strings.ToLower(term)) {
+			word = strings.Trim(word, "<>")
+			next := map[int]bool{}
+			for _, i := range st.idx.keyword(word) {
+				if matches == nil || matches[i] {
+					next[i] = true
+				}
+			}
+			matches = next
+		}
+		var positions []int
+		for i := range matches {
+			positions = append(positions, i)
+		}
+		sort.Ints(positions)
+		if len(positions) > maxResults {
+			positions = positions[:maxResults]
+		}
+		for _, i := range positions {
+			result = append(result, st.idx.keyRFingerprint(i))
+		}
+	}
+	return result, nil
+}
+
+// ModifiedSince returns keys in dump files modified since the given time,
+// most recently modified first.
+func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
+	var files []int
+	for i := 0; i < st.idx.numFiles(); i++ {
+		if st.idx.file(i).MTime.After(t) {
+			files = append(files, i)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return st.idx.file(files[i]).MTime.After(st.idx.file(files[j]).MTime)
+	})
+	var result []string
+	for _, file := range files {
+		for i := 0; i < st.idx.numKeys(); i++ {
+			if st.idx.keyFile(i) != file {
+				continue
+			}
+			result = append(result, st.idx.keyRFingerprint(i))
+			if len(result) >= maxResults {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := st.FetchKeyrings(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+// FetchKeyrings returns the keys matching the given rfingerprints. Dump files
+// do not record when keys were created or modified, so the time that the dump
+// file containing each key was last modified is given instead.
+func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
+	var result []*hkpstorage.Keyring
+	for _, rfp := range rfps {
+		_, err := hex.DecodeString(rfp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
+		}
+		i, ok := st.idx.find(strings.ToLower(rfp))
+		if !ok {
+			continue
+		}
+		key := st.idx.key(i)
+		if key.File >= len(st.files) {
+			return nil, errors.Errorf("key %q is in unknown dump file %d", key.RFingerprint, key.File)
+		}
+		data := st.files[key.File]
+		file := st.idx.file(key.File)
+		if key.Offset < 0 || key.Length < 0 || key.Offset+key.Length > int64(len(data)) {
+			return nil, errors.Errorf("key %q is outside of dump file %q", key.RFingerprint, file.Name)
+		}
+		pubkey, err := readOneKey(data[key.Offset:key.Offset+key.Length], key.RFingerprint)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		mtime := file.MTime
+		result = append(result, &hkpstorage.Keyring{
+			PrimaryKey: pubkey,
+			CTime:      mtime,
+			MTime:      mtime,
+		})
+	}
+	return result, nil
+}
+
+func readOneKey(data []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range keys {
+		if key.RFingerprint == rfingerprint {
+			return key, nil
+		}
+	}
+	return nil, errors.Errorf("key %q not found in dump file at indexed location", rfingerprint)
+}
+
+func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, int, error) {
+	return 0, 0, ErrReadOnly
+}
+
+func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	return ErrReadOnly
+}
+
+func (st *storage) Replace(key *openpgp.PrimaryKey) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (st *storage) Delete(fp string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (st *storage) RenotifyAll() error {
+	for i := 0; i < st.idx.numKeys(); i++ {
+		st.Notify(hkpstorage.KeyAdded{Digest: st.idx.key(i).MD5})
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package dumphkp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type StorageSuite struct {
+	dir string
+	st  hkpstorage.Storage
+}
+
+var _ = gc.Suite(&StorageSuite{})
+
+func (s *StorageSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.writeDump(c, 0, "alice_signed.asc", "uat.asc")
+	s.writeDump(c, 1, "e68e311d.asc")
+	err := BuildIndex(s.dir)
+	c.Assert(err, gc.IsNil)
+	s.st, err = Open(s.dir)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StorageSuite) TearDownTest(c *gc.C) {
+	if s.st != nil {
+		s.st.Close()
+	}
+}
+
+func (s *StorageSuite) writeDump(c *gc.C, num int, names ...string) {
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("hkp-dump-%04d.pgp", num)))
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	for _, name := range names {
+		for _, key := range openpgp.MustReadArmorKeys(testing.MustInput(name)) {
+			err = openpgp.WritePackets(f, key)
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
+
+func (s *StorageSuite) TestResolve(c *gc.C) {
+	// Key ID, fingerprint, subkey ID, and an unknown key ID.
+	rfps, err := s.st.Resolve([]string{
+		"accd0e32",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+		"9ac8abc6",
+		"deadbeef",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{
+		"accd0e320f1cb163a2aa9305257f384b1fc8ef01",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+		"bd1d2a44ad26397fada207187bf98ce7eee97218",
+	})
+}
+
+func (s *StorageSuite) TestResolveAmbiguous(c *gc.C) {
+	// The primary key of one key is a subkey of the other.
+	s.writeDump(c, 2, "subkey_collision/subkey.asc", "subkey_collision/pubkey.asc")
+	err := BuildIndex(s.dir)
+	c.Assert(err, gc.IsNil)
+	st, err := Open(s.dir)
+	c.Assert(err, gc.IsNil)
+	defer st.Close()
+
+	rfps, err := st.Resolve([]string{"40ae08dc6a8557a8"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{
+		"40ae08dc6a8557a8f7988777ca4dfaf4dc6b0349",
+		"94ca694a604c48c92e69f79396ea9d862ef5880a",
+	})
+}
+
+func (s *StorageSuite) TestFetchKeys(c *gc.C) {
+	rfps := []string{
+		"bd1d2a44ad26397fada207187bf98ce7eee97218",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+	}
+	keys, err := s.st.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 2)
+	for i, key := range keys {
+		c.Assert(key.RFingerprint, gc.Equals, rfps[i])
+	}
+	c.Assert(keys[0].MD5, gc.Equals, "16283c09a091f558ca9e9257822fe7e5")
+
+	rfps, err = s.st.MatchMD5([]string{"8E433EC97018E80A3E1BC26BE0693A07"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"d113e86ebae6324d2fa392ff64a66194a1b6c7d8"})
+}
+
+func (s *StorageSuite) TestMatchKeyword(c *gc.C) {
+	rfps, err := s.st.MatchKeyword([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	rfps, err = s.st.MatchKeyword([]string{"Casey Marshall"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+
+	rfps, err = s.st.MatchKeyword([]string{"casey gmail.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"bd1d2a44ad26397fada207187bf98ce7eee97218"})
+}
+
+func (s *StorageSuite) TestModifiedSince(c *gc.C) {
+	rfps, err := s.st.ModifiedSince(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 3)
+
+	rfps, err = s.st.ModifiedSince(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *StorageSuite) TestReadOnly(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	_, _, err := s.st.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.Equals, ErrReadOnly)
+	_, err = s.st.Replace(key)
+	c.Assert(err, gc.Equals, ErrReadOnly)
+	_, err = s.st.Delete(key.Fingerprint())
+	c.Assert(err, gc.Equals, ErrReadOnly)
+}
+
+func (s *StorageSuite) TestRenotifyAll(c *gc.C) {
+	var digests []string
+	s.st.Subscribe(func(kc hkpstorage.KeyChange) error {
+		digests = append(digests, kc.InsertDigests()...)
+		return nil
+	})
+	err := s.st.RenotifyAll()
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 3)
+}
+
+func (s *StorageSuite) TestStaleIndex(c *gc.C) {
+	s.writeDump(c, 1, "alice_unsigned.asc")
+	_, err := Open(s.dir)
+	c.Assert(err, gc.ErrorMatches, ".*has changed since it was indexed")
+
+	err = BuildIndex(s.dir)
+	c.Assert(err, gc.IsNil)
+	st, err := Open(s.dir)
+	c.Assert(err, gc.IsNil)
+	defer st.Close()
+	// The key in the replaced dump file is no longer served.
+	rfps, err := st.Resolve([]string{"d113e86e"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *StorageSuite) TestInvalidIndex(c *gc.C) {
+	path := filepath.Join(s.dir, IndexFile)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+
+	// An index truncated within a section is refused.
+	err = ioutil.WriteFile(path, data[:len(data)-1], 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = Open(s.dir)
+	c.Assert(err, gc.ErrorMatches, ".*section \\d+ is out of bounds")
+
+	// So is an index which is not one.
+	err = ioutil.WriteFile(path, []byte("not an index"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = Open(s.dir)
+	c.Assert(err, gc.ErrorMatches, ".*not an index")
+}
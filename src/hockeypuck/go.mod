@@ -1,48 +1,69 @@
 module hockeypuck
 
-go 1.12
+go 1.19
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/bitly/go-simplejson v0.5.0 // indirect
-	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
 	github.com/bugsnag/bugsnag-go v1.5.3
+	github.com/carbocation/interpose v0.0.0-20161206215253-723534742ba3
+	github.com/getsentry/raven-go v0.2.0
+	github.com/hashicorp/golang-lru v0.5.1
+	github.com/jackc/pgconn v1.14.3
+	github.com/jackc/pgx/v4 v4.18.3
+	github.com/jmcvetta/randutil v0.0.0-20150817122601-2bb1b664bcff
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.13.6
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/stretchr/testify v1.8.1
+	github.com/stvp/go-udp-testing v0.0.0-20171104055251-c4434f09ec13
+	github.com/syndtr/goleveldb v0.0.0-20200815110645-5c35d600f0ca
+	github.com/tobi/airbrake-go v0.0.0-20151005181455-a3cdd910a3ff
+	golang.org/x/crypto v0.20.0
+	gopkg.in/basen.v1 v1.0.0-20150613233243-308119dd1d4c
+	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f
+	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/bitly/go-simplejson v0.5.0 // indirect
 	github.com/bugsnag/panicwrap v1.2.0 // indirect
 	github.com/carbocation/handlers v0.0.0-20140528190747-c939c6d9ef31 // indirect
-	github.com/carbocation/interpose v0.0.0-20161206215253-723534742ba3
 	github.com/certifi/gocertifi v0.0.0-20200211180108-c7c1fbc02894 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/cmars/basen v0.0.0-20150613233007-fe3947df716e // indirect
 	github.com/codegangsta/inject v0.0.0-20150114235600-33e0aa1cb7c0 // indirect
-	github.com/getsentry/raven-go v0.2.0
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-martini/martini v0.0.0-20170121215854-22fa46961aab // indirect
-	github.com/gofrs/uuid v3.3.0+incompatible // indirect
+	github.com/gofrs/uuid v4.0.0+incompatible // indirect
+	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/goods/httpbuf v0.0.0-20120503183857-5709e9bb814c // indirect
-	github.com/hashicorp/golang-lru v0.5.1
 	github.com/interpose/middleware v0.0.0-20150216143757-05ed56ed52fa // indirect
-	github.com/jmcvetta/randutil v0.0.0-20150817122601-2bb1b664bcff
-	github.com/julienschmidt/httprouter v1.3.0
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
+	github.com/jackc/pgio v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgproto3/v2 v2.3.3 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/pgtype v1.14.0 // indirect
 	github.com/justinas/nosurf v0.0.0-20190416172904-05988550ea18 // indirect
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	github.com/kr/pretty v0.2.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	github.com/lib/pq v1.8.0
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/meatballhat/negroni-logrus v0.0.0-20170801195057-31067281800f // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/phyber/negroni-gzip v0.0.0-20180113114010-ef6356a5d029 // indirect
-	github.com/pkg/errors v0.9.1
-	github.com/prometheus/client_golang v1.7.1
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.13.0 // indirect
-	github.com/stretchr/testify v1.4.0
-	github.com/stvp/go-udp-testing v0.0.0-20171104055251-c4434f09ec13
-	github.com/syndtr/goleveldb v0.0.0-20200815110645-5c35d600f0ca
-	github.com/tobi/airbrake-go v0.0.0-20151005181455-a3cdd910a3ff
+	github.com/prometheus/procfs v0.1.3 // indirect
 	github.com/urfave/negroni v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
-	golang.org/x/sys v0.0.0-20200821140526-fda516888d29 // indirect
+	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
-	gopkg.in/basen.v1 v1.0.0-20150613233243-308119dd1d4c
-	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f
-	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
 )
 
@@ -0,0 +1,485 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package admin serves an HTTP API with which operators moderate and
+// maintain a keyserver, banning, deleting and re-indexing keys, setting
+// their state, reconciling with peers and switching maintenance mode,
+// without changing storage by hand.
+// Every request must carry one of the configured bearer tokens.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Peers are the recon partners managed through the API.
+type Peers interface {
+	// Partners returns the configured recon partners, by name.
+	Partners() recon.PartnerMap
+
+	// ReconWith reconciles with the named partner now.
+	ReconWith(name string) error
+}
+
+// Maintenance switches the keyserver in and out of maintenance mode.
+type Maintenance interface {
+	// Maintenance reports whether the keyserver is in maintenance mode.
+	Maintenance() bool
+
+	// SetMaintenance enables or disables maintenance mode.
+	SetMaintenance(enabled bool)
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	storage     storage.Storage
+	tokens      map[string]string
+	peers       Peers
+	maintenance Maintenance
+	statsFunc   func() (interface{}, error)
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// Tokens sets the bearer tokens accepted, by the name of the operator or
+// tool holding them, which is logged with the changes each makes.
+func Tokens(tokens map[string]string) Option {
+	return func(h *Handler) { h.tokens = tokens }
+}
+
+// PeerManager sets the recon partners managed.
+func PeerManager(p Peers) Option {
+	return func(h *Handler) { h.peers = p }
+}
+
+// MaintenanceSwitch sets the switch for maintenance mode.
+func MaintenanceSwitch(m Maintenance) Option {
+	return func(h *Handler) { h.maintenance = m }
+}
+
+// StatsFunc sets the source of the statistics served.
+func StatsFunc(f func() (interface{}, error)) Option {
+	return func(h *Handler) { h.statsFunc = f }
+}
+
+// NewHandler returns a Handler administering st. A token is required, as
+// the API would otherwise be open to anyone.
+func NewHandler(st storage.Storage, options ...Option) (*Handler, error) {
+	h := &Handler{storage: st}
+	for _, option := range options {
+		option(h)
+	}
+	if len(h.tokens) == 0 {
+		return nil, errors.New("no admin tokens configured")
+	}
+	for name, token := range h.tokens {
+		if token == "" {
+			return nil, errors.Errorf("empty admin token %q", name)
+		}
+	}
+	return h, nil
+}
+
+// Register adds the API's routes to r.
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET("/admin/stats", h.auth(h.Stats))
+	r.GET("/admin/keys/:fp", h.auth(h.Key))
+	r.DELETE("/admin/keys/:fp", h.auth(h.DeleteKey))
+	r.PUT("/admin/keys/:fp/state", h.auth(h.SetState))
+	r.POST("/admin/keys/:fp/reindex", h.auth(h.Reindex))
+	r.PUT("/admin/keys/:fp/ban", h.auth(h.Ban))
+	r.DELETE("/admin/keys/:fp/ban", h.auth(h.Unban))
+	r.GET("/admin/bans", h.auth(h.Bans))
+	r.GET("/admin/peers", h.auth(h.Peers))
+	r.POST("/admin/peers/:name/recon", h.auth(h.Recon))
+	r.GET("/admin/maintenance", h.auth(h.Maintenance))
+	r.PUT("/admin/maintenance", h.auth(h.SetMaintenance))
+	r.DELETE("/admin/maintenance", h.auth(h.SetMaintenance))
+}
+
+// handle is an admin API handler, called with the name of the token which
+// authorized the request.
+type handle func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string)
+
+// auth refuses requests without a valid bearer token.
+func (h *Handler) auth(next handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		operator, ok := h.operator(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hockeypuck-admin"`)
+			httpError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			return
+		}
+		next(w, r, ps, operator)
+	}
+}
+
+// operator returns the name of the token presented with r. Every token is
+// compared, in constant time, so that timing does not reveal which tokens
+// exist.
+func (h *Handler) operator(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	presented := []byte(strings.TrimSpace(header[len(prefix):]))
+	var found string
+	for name, token := range h.tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+func httpError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode >= http.StatusInternalServerError {
+		log.Errorf("HTTP %d: %+v", statusCode, err)
+	}
+	writeJSON(w, statusCode, &ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ErrorResponse describes why a request failed.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// KeyResponse describes the moderation state of a key.
+type KeyResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Stored      bool   `json:"stored"`
+	State       string `json:"state,omitempty"`
+	Banned      bool   `json:"banned"`
+}
+
+// BanResponse describes a banned key.
+type BanResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Reason      string `json:"reason"`
+	Banned      string `json:"banned"`
+}
+
+// PeerResponse describes a recon partner.
+type PeerResponse struct {
+	Name      string `json:"name"`
+	HTTPAddr  string `json:"httpAddr"`
+	ReconAddr string `json:"reconAddr"`
+	Weight    int    `json:"weight"`
+}
+
+// MaintenanceResponse describes whether the keyserver is in maintenance
+// mode.
+type MaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// fingerprint returns the lower-cased fingerprint named by the request
+// path, which may be prefixed with 0x.
+func fingerprint(ps httprouter.Params) (string, error) {
+	fp := strings.TrimPrefix(strings.ToLower(ps.ByName("fp")), "0x")
+	if len(fp) != 40 && len(fp) != 64 || strings.Trim(fp, "0123456789abcdef") != "" {
+		return "", errors.Errorf("invalid fingerprint %q", ps.ByName("fp"))
+	}
+	return fp, nil
+}
+
+// Stats serves the keyserver's statistics.
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request, _ httprouter.Params, _ string) {
+	if h.statsFunc == nil {
+		httpError(w, http.StatusNotFound, errors.New("statistics not available"))
+		return
+	}
+	stats, err := h.statsFunc()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// Key serves the moderation state of a key, whether or not it is served.
+func (h *Handler) Key(w http.ResponseWriter, r *http.Request, ps httprouter.Params, _ string) {
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	rfp := openpgp.Reverse(fp)
+	resp := KeyResponse{Fingerprint: fp}
+	if kss, ok := h.storage.(storage.KeyStateStore); ok {
+		state, err := kss.KeyState(rfp)
+		if err == nil {
+			resp.Stored = true
+			resp.State = state.String()
+		} else if !storage.IsNotFound(err) {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+	} else {
+		keys, err := h.storage.FetchKeys([]string{rfp})
+		if err != nil && !storage.IsNotFound(err) {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		resp.Stored = len(keys) > 0
+	}
+	if b, ok := h.storage.(storage.Blocker); ok {
+		resp.Banned, err = b.IsBlocked(fp)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// DeleteKey deletes a key. Unlike a ban, the key may be stored again if it
+// is submitted or received from a peer.
+func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	_, err = storage.DeleteKey(h.storage, fp)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "fp": fp}).Info("admin delete")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetState sets the state of a key to that given by the state parameter.
+func (h *Handler) SetState(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	kss, ok := h.storage.(storage.KeyStateStore)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, errors.New("storage does not support key states"))
+		return
+	}
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	state, err := storage.ParseKeyState(r.Form.Get("state"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = kss.SetKeyState(openpgp.Reverse(fp), state)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "fp": fp, "state": state.String()}).Info("admin set state")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reindex stores a key again as it is, so that the documents and keywords
+// derived from it are rebuilt.
+func (h *Handler) Reindex(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = storage.ReindexKey(h.storage, fp)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "fp": fp}).Info("admin reindex")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Ban deletes a key and refuses it from now on, recording the reason
+// parameter.
+func (h *Handler) Ban(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	b, ok := h.storage.(storage.Blocker)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, errors.New("storage does not support banning keys"))
+		return
+	}
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		reason = "banned by " + operator
+	}
+	err = b.Block(fp, reason)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "fp": fp, "reason": reason}).Info("admin ban")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unban stops refusing a key. It is not restored, but may be stored again
+// when it is next submitted or received from a peer.
+func (h *Handler) Unban(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	b, ok := h.storage.(storage.Blocker)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, errors.New("storage does not support banning keys"))
+		return
+	}
+	fp, err := fingerprint(ps)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = b.Unblock(fp)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "fp": fp}).Info("admin unban")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Bans serves the banned keys.
+func (h *Handler) Bans(w http.ResponseWriter, r *http.Request, _ httprouter.Params, _ string) {
+	b, ok := h.storage.(storage.Blocker)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, errors.New("storage does not support banning keys"))
+		return
+	}
+	blocked, err := b.BlockedKeys()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	resp := []BanResponse{}
+	for _, bk := range blocked {
+		resp = append(resp, BanResponse{
+			Fingerprint: bk.Fingerprint,
+			Reason:      bk.Reason,
+			Banned:      bk.Blocked.UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Peers serves the recon partners, ordered by name.
+func (h *Handler) Peers(w http.ResponseWriter, r *http.Request, _ httprouter.Params, _ string) {
+	resp := []PeerResponse{}
+	if h.peers != nil {
+		for name, partner := range h.peers.Partners() {
+			resp = append(resp, PeerResponse{
+				Name:      name,
+				HTTPAddr:  partner.HTTPAddr,
+				ReconAddr: partner.ReconAddr,
+				Weight:    partner.Weight,
+			})
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Recon reconciles with the named partner, responding once the session is
+// complete.
+func (h *Handler) Recon(w http.ResponseWriter, r *http.Request, ps httprouter.Params, operator string) {
+	name := ps.ByName("name")
+	if h.peers == nil {
+		httpError(w, http.StatusNotFound, errors.Errorf("unknown recon partner %q", name))
+		return
+	}
+	if _, ok := h.peers.Partners()[name]; !ok {
+		httpError(w, http.StatusNotFound, errors.Errorf("unknown recon partner %q", name))
+		return
+	}
+	log.WithFields(log.Fields{"operator": operator, "peer": name}).Info("admin recon")
+	err := h.peers.ReconWith(name)
+	if errors.Is(err, recon.ErrPeerBusy) {
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusBadGateway, errors.WithStack(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Maintenance serves whether the keyserver is in maintenance mode.
+func (h *Handler) Maintenance(w http.ResponseWriter, r *http.Request, _ httprouter.Params, _ string) {
+	if h.maintenance == nil {
+		httpError(w, http.StatusNotFound, errors.New("maintenance mode not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, &MaintenanceResponse{Enabled: h.maintenance.Maintenance()})
+}
+
+// SetMaintenance enables maintenance mode on PUT, and disables it on
+// DELETE.
+func (h *Handler) SetMaintenance(w http.ResponseWriter, r *http.Request, _ httprouter.Params, operator string) {
+	if h.maintenance == nil {
+		httpError(w, http.StatusNotFound, errors.New("maintenance mode not available"))
+		return
+	}
+	enabled := r.Method == http.MethodPut
+	log.WithFields(log.Fields{"operator": operator, "enabled": enabled}).Info("admin maintenance")
+	h.maintenance.SetMaintenance(enabled)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,244 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type AdminSuite struct {
+	storage     *mock.Storage
+	peers       *fakePeers
+	maintenance *fakeMaintenance
+	srv         *httptest.Server
+}
+
+var _ = gc.Suite(&AdminSuite{})
+
+type fakePeers struct {
+	recons []string
+	err    error
+}
+
+func (p *fakePeers) Partners() recon.PartnerMap {
+	return recon.PartnerMap{
+		"beta":  {ReconAddr: "beta.example.com:11370", Weight: 50},
+		"alpha": {HTTPAddr: "alpha.example.com:11371", ReconAddr: "alpha.example.com:11370"},
+	}
+}
+
+func (p *fakePeers) ReconWith(name string) error {
+	p.recons = append(p.recons, name)
+	return p.err
+}
+
+type fakeMaintenance struct {
+	enabled bool
+}
+
+func (m *fakeMaintenance) Maintenance() bool { return m.enabled }
+
+func (m *fakeMaintenance) SetMaintenance(enabled bool) { m.enabled = enabled }
+
+func (s *AdminSuite) SetUpTest(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	s.storage = mock.NewStorage(
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if rfps[0] == key.RFingerprint {
+				return []*openpgp.PrimaryKey{key}, nil
+			}
+			return nil, nil
+		}),
+		mock.Delete(func(fp string) (string, error) {
+			if fp != key.Fingerprint() {
+				return "", storage.ErrKeyNotFound
+			}
+			return key.MD5, nil
+		}),
+	)
+	s.peers = &fakePeers{}
+	s.maintenance = &fakeMaintenance{}
+	h, err := NewHandler(s.storage,
+		Tokens(map[string]string{"alice": "alice-secret", "bob": "bob-secret"}),
+		PeerManager(s.peers),
+		MaintenanceSwitch(s.maintenance),
+		StatsFunc(func() (interface{}, error) { return map[string]int{"total": 1}, nil }))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	h.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *AdminSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *AdminSuite) do(c *gc.C, method, path, token string, form url.Values) *http.Response {
+	req, err := http.NewRequest(method, s.srv.URL+path, strings.NewReader(form.Encode()))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	return res
+}
+
+func (s *AdminSuite) TestNoTokens(c *gc.C) {
+	_, err := NewHandler(s.storage)
+	c.Assert(err, gc.ErrorMatches, "no admin tokens configured")
+	_, err = NewHandler(s.storage, Tokens(map[string]string{"alice": ""}))
+	c.Assert(err, gc.ErrorMatches, `empty admin token "alice"`)
+}
+
+func (s *AdminSuite) TestAuth(c *gc.C) {
+	for _, token := range []string{"", "alice", "alice-secret2"} {
+		res := s.do(c, "GET", "/admin/stats", token, nil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusUnauthorized, gc.Commentf("%q", token))
+		c.Assert(res.Header.Get("WWW-Authenticate"), gc.Matches, "Bearer .*")
+	}
+
+	res := s.do(c, "GET", "/admin/stats", "bob-secret", nil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var stats map[string]int
+	c.Assert(json.NewDecoder(res.Body).Decode(&stats), gc.IsNil)
+	c.Assert(stats, gc.DeepEquals, map[string]int{"total": 1})
+}
+
+func (s *AdminSuite) TestKey(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	res := s.do(c, "GET", "/admin/keys/0x"+strings.ToUpper(key.Fingerprint()), "alice-secret", nil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var resp KeyResponse
+	c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+	c.Assert(resp, gc.Equals, KeyResponse{Fingerprint: key.Fingerprint(), Stored: true, State: "normal"})
+
+	// Keys are named by fingerprint, not key ID.
+	res = s.do(c, "GET", "/admin/keys/"+key.KeyID(), "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestModerate(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	path := "/admin/keys/" + key.Fingerprint()
+
+	res := s.do(c, "PUT", path+"/state", "alice-secret", url.Values{"state": {"quarantined"}})
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	res = s.do(c, "PUT", path+"/state", "alice-secret", url.Values{"state": {"lost"}})
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("SetKeyState"), gc.Equals, 1)
+
+	res = s.do(c, "PUT", path+"/ban", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	res = s.do(c, "DELETE", path+"/ban", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(s.storage.MethodCount("Block"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("Unblock"), gc.Equals, 1)
+
+	res = s.do(c, "POST", path+"/reindex", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 1)
+
+	res = s.do(c, "DELETE", path, "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	res = s.do(c, "DELETE", "/admin/keys/"+strings.Repeat("0", 40), "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	res = s.do(c, "POST", "/admin/keys/"+strings.Repeat("0", 40)+"/reindex", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestPeers(c *gc.C) {
+	res := s.do(c, "GET", "/admin/peers", "alice-secret", nil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var peers []PeerResponse
+	c.Assert(json.NewDecoder(res.Body).Decode(&peers), gc.IsNil)
+	c.Assert(peers, gc.DeepEquals, []PeerResponse{
+		{Name: "alpha", HTTPAddr: "alpha.example.com:11371", ReconAddr: "alpha.example.com:11370"},
+		{Name: "beta", ReconAddr: "beta.example.com:11370", Weight: 50},
+	})
+
+	res = s.do(c, "POST", "/admin/peers/beta/recon", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	res = s.do(c, "POST", "/admin/peers/gamma/recon", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	s.peers.err = recon.ErrPeerBusy
+	res = s.do(c, "POST", "/admin/peers/alpha/recon", "alice-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(s.peers.recons, gc.DeepEquals, []string{"beta", "alpha"})
+}
+
+func (s *AdminSuite) TestMaintenance(c *gc.C) {
+	get := func() bool {
+		res := s.do(c, "GET", "/admin/maintenance", "alice-secret", nil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var resp MaintenanceResponse
+		c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+		return resp.Enabled
+	}
+	c.Assert(get(), gc.Equals, false)
+
+	res := s.do(c, "PUT", "/admin/maintenance", "bob-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(s.maintenance.enabled, gc.Equals, true)
+	c.Assert(get(), gc.Equals, true)
+
+	res = s.do(c, "DELETE", "/admin/maintenance", "bob-secret", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(s.maintenance.enabled, gc.Equals, false)
+
+	res = s.do(c, "PUT", "/admin/maintenance", "", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnauthorized)
+	c.Assert(s.maintenance.enabled, gc.Equals, false)
+}
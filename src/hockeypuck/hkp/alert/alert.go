@@ -0,0 +1,271 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package alert notifies operators of conditions detected by the keyserver
+// which need their attention, by email, webhook or PagerDuty.
+package alert
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// Severity ranks alerts by urgency.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Critical
+)
+
+var severityNames = []string{"info", "warning", "critical"}
+
+func (s Severity) String() string {
+	if s < Info || s > Critical {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity returns the severity with the given name. An empty name is
+// Info.
+func ParseSeverity(name string) (Severity, error) {
+	if name == "" {
+		return Info, nil
+	}
+	for i, sn := range severityNames {
+		if strings.EqualFold(name, sn) {
+			return Severity(i), nil
+		}
+	}
+	return Info, errors.Errorf("unknown alert severity %q", name)
+}
+
+// Conditions raising alerts.
+const (
+	// ReconDivergence is raised when a recon partner holds more keys
+	// missing from this keyserver than expected.
+	ReconDivergence = "recon-divergence"
+
+	// InsertErrors is raised when a large fraction of submitted keys cannot
+	// be stored.
+	InsertErrors = "insert-errors"
+
+	// StorageHealth is raised when the storage backend cannot be reached.
+	StorageHealth = "storage-health"
+
+	// PinnedKey is raised when an update to a pinned key is refused.
+	PinnedKey = "pinned-key"
+)
+
+// Alert describes a condition needing an operator's attention.
+type Alert struct {
+	Severity  Severity
+	Condition string
+	// Subject identifies the instance of the condition, such as the
+	// address of a recon partner. Alerts are deduplicated by condition and
+	// subject.
+	Subject string
+	Summary string
+	Details map[string]string
+	Time    time.Time
+}
+
+func (a *Alert) dedupKey() string {
+	return a.Condition + " " + a.Subject
+}
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(a *Alert) error
+}
+
+type target struct {
+	notifier Notifier
+	min      Severity
+}
+
+const (
+	// DefaultDedupInterval is how long an alert is suppressed after it has
+	// been sent, unless it is raised again at a higher severity.
+	DefaultDedupInterval = time.Hour
+
+	// queueSize is the number of alerts waiting to be sent before further
+	// alerts are dropped.
+	queueSize = 100
+)
+
+// Alerter sends the alerts raised to its notifiers, suppressing repeats.
+// The methods of a nil *Alerter do nothing, so that callers need not check
+// whether alerting is configured.
+type Alerter struct {
+	targets []target
+	dedup   time.Duration
+	now     func() time.Time
+
+	mu   sync.Mutex
+	sent map[string]*Alert
+
+	queue chan *Alert
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Option modifies the behavior of an Alerter.
+type Option func(*Alerter)
+
+// To sends alerts of at least the given severity to n.
+func To(n Notifier, min Severity) Option {
+	return func(a *Alerter) { a.targets = append(a.targets, target{notifier: n, min: min}) }
+}
+
+// Dedup sets how long an alert is suppressed after it has been sent.
+func Dedup(d time.Duration) Option {
+	return func(a *Alerter) {
+		if d > 0 {
+			a.dedup = d
+		}
+	}
+}
+
+// Clock sets the source of the current time, for testing.
+func Clock(now func() time.Time) Option {
+	return func(a *Alerter) { a.now = now }
+}
+
+// New returns a new Alerter.
+func New(options ...Option) *Alerter {
+	a := &Alerter{
+		dedup: DefaultDedupInterval,
+		now:   time.Now,
+		sent:  map[string]*Alert{},
+		queue: make(chan *Alert, queueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, option := range options {
+		option(a)
+	}
+	return a
+}
+
+// Raise queues an alert to be sent, unless the same condition has already
+// been alerted at the same or higher severity within the deduplication
+// interval.
+func (a *Alerter) Raise(alert Alert) {
+	if a == nil {
+		return
+	}
+	if alert.Time.IsZero() {
+		alert.Time = a.now()
+	}
+	if !a.admit(&alert) {
+		return
+	}
+	select {
+	case a.queue <- &alert:
+	default:
+		log.Warningf("alert queue full, dropped %s alert %q", alert.Severity, alert.Summary)
+	}
+}
+
+func (a *Alerter) admit(alert *Alert) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := alert.dedupKey()
+	last, ok := a.sent[key]
+	if ok && alert.Time.Sub(last.Time) < a.dedup && alert.Severity <= last.Severity {
+		return false
+	}
+	a.sent[key] = alert
+	for k, v := range a.sent {
+		if alert.Time.Sub(v.Time) >= a.dedup {
+			delete(a.sent, k)
+		}
+	}
+	return true
+}
+
+// Resolve forgets an alerted condition, so that it is alerted again as soon
+// as it recurs.
+func (a *Alerter) Resolve(condition, subject string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sent, (&Alert{Condition: condition, Subject: subject}).dedupKey())
+}
+
+// Start sends queued alerts in the background until Stop is called.
+func (a *Alerter) Start() {
+	if a == nil {
+		return
+	}
+	go func() {
+		defer close(a.done)
+		for {
+			select {
+			case <-a.stop:
+				return
+			case alert := <-a.queue:
+				a.send(alert)
+			}
+		}
+	}()
+}
+
+// Stop sends any alerts still queued, and stops sending alerts.
+func (a *Alerter) Stop() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	for {
+		select {
+		case alert := <-a.queue:
+			a.send(alert)
+		default:
+			return
+		}
+	}
+}
+
+func (a *Alerter) send(alert *Alert) {
+	log.WithFields(log.Fields{
+		"severity":  alert.Severity.String(),
+		"condition": alert.Condition,
+		"subject":   alert.Subject,
+	}).Warning(alert.Summary)
+	for _, t := range a.targets {
+		if alert.Severity < t.min {
+			continue
+		}
+		err := t.notifier.Notify(alert)
+		if err != nil {
+			log.Errorf("failed to send alert %q: %v", alert.Summary, err)
+		}
+	}
+}
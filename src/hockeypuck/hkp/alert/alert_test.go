@@ -0,0 +1,168 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type AlertSuite struct{}
+
+var _ = gc.Suite(&AlertSuite{})
+
+type recorder struct {
+	mu     sync.Mutex
+	alerts []*Alert
+}
+
+func (r *recorder) Notify(a *Alert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func (r *recorder) summaries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []string
+	for _, a := range r.alerts {
+		result = append(result, a.Summary)
+	}
+	return result
+}
+
+func (s *AlertSuite) TestDedup(c *gc.C) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var all, critical recorder
+	a := New(To(&all, Info), To(&critical, Critical), Dedup(time.Hour), Clock(func() time.Time { return now }))
+	a.Start()
+
+	a.Raise(Alert{Severity: Warning, Condition: ReconDivergence, Subject: "192.0.2.1", Summary: "first"})
+	a.Raise(Alert{Severity: Warning, Condition: ReconDivergence, Subject: "192.0.2.1", Summary: "repeat"})
+	a.Raise(Alert{Severity: Warning, Condition: ReconDivergence, Subject: "192.0.2.2", Summary: "other peer"})
+	// Escalation is not suppressed.
+	a.Raise(Alert{Severity: Critical, Condition: ReconDivergence, Subject: "192.0.2.1", Summary: "escalated"})
+	now = now.Add(30 * time.Minute)
+	a.Raise(Alert{Severity: Critical, Condition: ReconDivergence, Subject: "192.0.2.1", Summary: "still critical"})
+	now = now.Add(time.Hour)
+	a.Raise(Alert{Severity: Warning, Condition: ReconDivergence, Subject: "192.0.2.1", Summary: "again"})
+	a.Raise(Alert{Severity: Critical, Condition: StorageHealth, Summary: "down"})
+	a.Resolve(StorageHealth, "")
+	a.Raise(Alert{Severity: Critical, Condition: StorageHealth, Summary: "down again"})
+	a.Stop()
+
+	c.Assert(all.summaries(), gc.DeepEquals, []string{"first", "other peer", "escalated", "again", "down", "down again"})
+	c.Assert(critical.summaries(), gc.DeepEquals, []string{"escalated", "down", "down again"})
+}
+
+func (s *AlertSuite) TestNilAlerter(c *gc.C) {
+	var a *Alerter
+	a.Start()
+	a.Raise(Alert{Severity: Critical, Summary: "ignored"})
+	a.Resolve(StorageHealth, "")
+	a.Stop()
+}
+
+func (s *AlertSuite) TestParseSeverity(c *gc.C) {
+	for name, expect := range map[string]Severity{"": Info, "info": Info, "Warning": Warning, "CRITICAL": Critical} {
+		sev, err := ParseSeverity(name)
+		c.Assert(err, gc.IsNil)
+		c.Check(sev, gc.Equals, expect)
+	}
+	_, err := ParseSeverity("panic")
+	c.Assert(err, gc.ErrorMatches, `unknown alert severity "panic"`)
+}
+
+var testAlert = &Alert{
+	Severity:  Critical,
+	Condition: StorageHealth,
+	Subject:   "postgres-jsonb",
+	Summary:   "storage is unreachable",
+	Details:   map[string]string{"error": "connection refused"},
+	Time:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func (s *AlertSuite) TestWebhook(c *gc.C) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Content-Type"), gc.Equals, "application/json")
+		c.Check(json.NewDecoder(r.Body).Decode(&got), gc.IsNil)
+	}))
+	defer srv.Close()
+
+	w := &Webhook{URL: srv.URL, Hostname: "keys.example.com"}
+	c.Assert(w.Notify(testAlert), gc.IsNil)
+	c.Assert(got["hostname"], gc.Equals, "keys.example.com")
+	c.Assert(got["severity"], gc.Equals, "critical")
+	c.Assert(got["condition"], gc.Equals, StorageHealth)
+	c.Assert(got["summary"], gc.Equals, "storage is unreachable")
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	w = &Webhook{URL: missing.URL}
+	c.Assert(w.Notify(testAlert), gc.ErrorMatches, `alert rejected by .*: 404 Not Found: .*`)
+}
+
+func (s *AlertSuite) TestPagerDuty(c *gc.C) {
+	var got pagerDutyEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(json.NewDecoder(r.Body).Decode(&got), gc.IsNil)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	p := &PagerDuty{RoutingKey: "R0UT1NG", URL: srv.URL, Hostname: "keys.example.com"}
+	c.Assert(p.Notify(testAlert), gc.IsNil)
+	c.Assert(got.RoutingKey, gc.Equals, "R0UT1NG")
+	c.Assert(got.EventAction, gc.Equals, "trigger")
+	c.Assert(got.DedupKey, gc.Equals, "storage-health postgres-jsonb")
+	c.Assert(got.Payload.Severity, gc.Equals, "critical")
+	c.Assert(got.Payload.Source, gc.Equals, "keys.example.com")
+	c.Assert(got.Payload.CustomDetails, gc.DeepEquals, map[string]string{"error": "connection refused"})
+}
+
+func (s *AlertSuite) TestEmail(c *gc.C) {
+	var gotTo []string
+	var gotMsg string
+	e := &Email{
+		Addr:     "localhost:25",
+		From:     "hockeypuck@example.com",
+		To:       []string{"ops@example.com"},
+		Hostname: "keys.example.com",
+		sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotTo, gotMsg = to, string(msg)
+			return nil
+		},
+	}
+	c.Assert(e.Notify(testAlert), gc.IsNil)
+	c.Assert(gotTo, gc.DeepEquals, []string{"ops@example.com"})
+	c.Assert(strings.Contains(gotMsg, "Subject: [CRITICAL] keys.example.com: storage is unreachable\r\n"), gc.Equals, true)
+	c.Assert(strings.Contains(gotMsg, "error: connection refused\r\n"), gc.Equals, true)
+}
@@ -0,0 +1,183 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// Email sends alerts by email through an SMTP server.
+type Email struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	Auth smtp.Auth
+	From string
+	To   []string
+	// Hostname identifies the keyserver in the subject.
+	Hostname string
+
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (e *Email) Notify(a *Alert) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [%s] %s: %s\r\n", strings.ToUpper(a.Severity.String()), e.Hostname, a.Summary)
+	fmt.Fprintf(&buf, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", a.Summary)
+	fmt.Fprintf(&buf, "Condition: %s\r\n", a.Condition)
+	if a.Subject != "" {
+		fmt.Fprintf(&buf, "Affected: %s\r\n", a.Subject)
+	}
+	for _, k := range sortedKeys(a.Details) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, a.Details[k])
+	}
+	sendMail := e.sendMail
+	if sendMail == nil {
+		sendMail = smtp.SendMail
+	}
+	return errors.WithStack(sendMail(e.Addr, e.Auth, e.From, e.To, buf.Bytes()))
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Webhook posts alerts as JSON to a URL.
+type Webhook struct {
+	URL string
+	// Hostname identifies the keyserver in the alert.
+	Hostname string
+	Client   *http.Client
+}
+
+type webhookAlert struct {
+	Hostname  string            `json:"hostname,omitempty"`
+	Severity  string            `json:"severity"`
+	Condition string            `json:"condition"`
+	Subject   string            `json:"subject,omitempty"`
+	Summary   string            `json:"summary"`
+	Details   map[string]string `json:"details,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+func (w *Webhook) Notify(a *Alert) error {
+	return postJSON(w.Client, w.URL, &webhookAlert{
+		Hostname:  w.Hostname,
+		Severity:  a.Severity.String(),
+		Condition: a.Condition,
+		Subject:   a.Subject,
+		Summary:   a.Summary,
+		Details:   a.Details,
+		Time:      a.Time,
+	})
+}
+
+// DefaultPagerDutyURL is the PagerDuty Events API v2 endpoint.
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty triggers incidents with the PagerDuty Events API v2, or a
+// compatible service. Incidents are deduplicated by condition and subject.
+type PagerDuty struct {
+	RoutingKey string
+	// URL defaults to DefaultPagerDutyURL.
+	URL string
+	// Hostname is reported as the source of the incident.
+	Hostname string
+	Client   *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Class         string            `json:"class"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+func (p *PagerDuty) Notify(a *Alert) error {
+	url := p.URL
+	if url == "" {
+		url = DefaultPagerDutyURL
+	}
+	source := p.Hostname
+	if source == "" {
+		source = "hockeypuck"
+	}
+	return postJSON(p.Client, url, &pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    a.dedupKey(),
+		Payload: pagerDutyPayload{
+			Summary:       a.Summary,
+			Source:        source,
+			Severity:      a.Severity.String(),
+			Timestamp:     a.Time,
+			Class:         a.Condition,
+			CustomDetails: a.Details,
+		},
+	})
+}
+
+func postJSON(client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = &http.Client{Timeout: notifyTimeout}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("alert rejected by %q: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
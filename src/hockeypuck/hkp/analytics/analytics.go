@@ -0,0 +1,162 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package analytics collects aggregate statistics about key searches, without
+// retaining the search terms themselves.
+package analytics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultK is the default minimum number of searches for a domain before
+	// it is reported.
+	DefaultK = 10
+
+	// maxDomains bounds the number of distinct domains counted. Searches for
+	// further domains are only counted in the total volume.
+	maxDomains = 10000
+
+	// maxTopDomains is the number of domains reported in a summary.
+	maxTopDomains = 20
+)
+
+// Analytics counts searches by the email domain they contain, and search
+// volume by hour and operation. Domains are only reported once they have been
+// searched for at least k times, so that a summary cannot be used to learn
+// about searches for individual, rarely queried addresses.
+type Analytics struct {
+	k int
+
+	mu      sync.Mutex
+	domains map[string]int
+	hourly  map[time.Time]map[string]int
+}
+
+// New returns a new Analytics which reports domains searched at least k
+// times.
+func New(k int) *Analytics {
+	if k <= 0 {
+		k = DefaultK
+	}
+	return &Analytics{
+		k:       k,
+		domains: map[string]int{},
+		hourly:  map[time.Time]map[string]int{},
+	}
+}
+
+// Record counts a search. Only the operation and the domain part of an email
+// address in the search, if any, are retained.
+func (a *Analytics) Record(op, search string) {
+	domain := searchDomain(search)
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if domain != "" {
+		if _, ok := a.domains[domain]; ok || len(a.domains) < maxDomains {
+			a.domains[domain]++
+		}
+	}
+	ops, ok := a.hourly[hour]
+	if !ok {
+		ops = map[string]int{}
+		a.hourly[hour] = ops
+		a.prune(hour)
+	}
+	ops[op]++
+}
+
+// prune discards hourly volume older than a day. The caller must hold a.mu.
+func (a *Analytics) prune(now time.Time) {
+	yesterday := now.Add(-24 * time.Hour)
+	for k := range a.hourly {
+		if k.Before(yesterday) {
+			delete(a.hourly, k)
+		}
+	}
+}
+
+func searchDomain(search string) string {
+	at := strings.LastIndex(search, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(search[at+1:])
+	if end := strings.IndexAny(domain, "> \t"); end >= 0 {
+		domain = domain[:end]
+	}
+	return domain
+}
+
+// DomainCount is the number of searches for addresses in a domain.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  int    `json:"count"`
+}
+
+// Volume is the number of searches in an hour, by operation.
+type Volume struct {
+	Time       time.Time      `json:"time"`
+	Operations map[string]int `json:"operations"`
+}
+
+// Summary is the reportable subset of the statistics collected.
+type Summary struct {
+	TopDomains []DomainCount `json:"topDomains"`
+	Hourly     []Volume      `json:"hourly"`
+}
+
+// Summary returns the most frequently searched domains which meet the
+// anonymity threshold, and the hourly search volume over the last day.
+func (a *Analytics) Summary() *Summary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var s Summary
+	for domain, count := range a.domains {
+		if count >= a.k {
+			s.TopDomains = append(s.TopDomains, DomainCount{Domain: domain, Count: count})
+		}
+	}
+	sort.Slice(s.TopDomains, func(i, j int) bool {
+		if s.TopDomains[i].Count != s.TopDomains[j].Count {
+			return s.TopDomains[i].Count > s.TopDomains[j].Count
+		}
+		return s.TopDomains[i].Domain < s.TopDomains[j].Domain
+	})
+	if len(s.TopDomains) > maxTopDomains {
+		s.TopDomains = s.TopDomains[:maxTopDomains]
+	}
+	for t, ops := range a.hourly {
+		v := Volume{Time: t, Operations: map[string]int{}}
+		for op, n := range ops {
+			v.Operations[op] = n
+		}
+		s.Hourly = append(s.Hourly, v)
+	}
+	sort.Slice(s.Hourly, func(i, j int) bool {
+		return s.Hourly[i].Time.Before(s.Hourly[j].Time)
+	})
+	return &s
+}
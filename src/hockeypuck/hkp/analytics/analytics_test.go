@@ -0,0 +1,58 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package analytics
+
+import (
+	"testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type AnalyticsSuite struct{}
+
+var _ = gc.Suite(&AnalyticsSuite{})
+
+func (s *AnalyticsSuite) TestKAnonymity(c *gc.C) {
+	a := New(3)
+	for i := 0; i < 3; i++ {
+		a.Record("index", "alice@Example.com")
+	}
+	a.Record("get", "Bob <bob@example.org>")
+	a.Record("get", "0xdecafbad")
+
+	summary := a.Summary()
+	c.Assert(summary.TopDomains, gc.DeepEquals, []DomainCount{{Domain: "example.com", Count: 3}})
+	c.Assert(summary.Hourly, gc.HasLen, 1)
+	c.Assert(summary.Hourly[0].Operations, gc.DeepEquals, map[string]int{"index": 3, "get": 2})
+
+	a.Record("index", "carol@example.org")
+	a.Record("index", "dave@example.org")
+	summary = a.Summary()
+	c.Assert(summary.TopDomains, gc.DeepEquals, []DomainCount{
+		{Domain: "example.com", Count: 3},
+		{Domain: "example.org", Count: 3},
+	})
+}
+
+func (s *AnalyticsSuite) TestSearchDomain(c *gc.C) {
+	c.Assert(searchDomain("alice"), gc.Equals, "")
+	c.Assert(searchDomain("alice@example.com"), gc.Equals, "example.com")
+	c.Assert(searchDomain("Alice <alice@EXAMPLE.com>"), gc.Equals, "example.com")
+}
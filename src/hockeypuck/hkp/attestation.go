@@ -0,0 +1,132 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// Attestation is a statement of a keyserver's state. It is published signed
+// by the server's own key, so that pool operators can check membership
+// criteria without scraping the stats page.
+type Attestation struct {
+	Time     string   `json:"time"`
+	Hostname string   `json:"hostname"`
+	Software string   `json:"software"`
+	Version  string   `json:"version"`
+	NumKeys  int      `json:"numkeys"`
+	Peers    []string `json:"peers"`
+}
+
+// Attestor keeps the most recently signed attestation.
+type Attestor struct {
+	signer *xopenpgp.Entity
+	f      func() (*Attestation, error)
+
+	mu     sync.RWMutex
+	signed []byte
+}
+
+// ReadAttestationKey reads the armored private key used to sign attestations.
+// The key must not be protected by a passphrase.
+func ReadAttestationKey(r io.Reader) (*xopenpgp.Entity, error) {
+	el, err := xopenpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, e := range el {
+		if e.PrivateKey != nil {
+			return e, nil
+		}
+	}
+	return nil, errors.New("no private key found")
+}
+
+// NewAttestor returns an Attestor that signs the attestations produced by f
+// with signer.
+func NewAttestor(signer *xopenpgp.Entity, f func() (*Attestation, error)) (*Attestor, error) {
+	if signer.PrivateKey == nil {
+		return nil, errors.New("attestation key has no private key")
+	}
+	if signer.PrivateKey.Encrypted {
+		return nil, errors.New("attestation key must not be encrypted")
+	}
+	return &Attestor{signer: signer, f: f}, nil
+}
+
+// Refresh produces and signs a new attestation.
+func (a *Attestor) Refresh() error {
+	att, err := a.f()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	doc, err := json.MarshalIndent(att, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, a.signer.PrivateKey, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = w.Write(doc)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	a.mu.Lock()
+	a.signed = buf.Bytes()
+	a.mu.Unlock()
+	return nil
+}
+
+// Signed returns the most recent clearsigned attestation, or nil if none has
+// been produced yet.
+func (a *Attestor) Signed() []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.signed
+}
+
+// Attestation serves the most recent signed attestation.
+func (h *Handler) Attestation(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.attestor == nil {
+		httpError(w, http.StatusNotFound, errors.New("attestations not configured"))
+		return
+	}
+	signed := h.attestor.Signed()
+	if signed == nil {
+		httpError(w, http.StatusServiceUnavailable, errors.New("attestation not yet available"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(signed)
+}
@@ -0,0 +1,375 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package blocklist periodically fetches externally maintained blocklists
+// and applies them to the keyserver, so that abuse responses agreed across
+// a pool of keyservers propagate without each operator copying them into
+// their configuration.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultInterval = time.Hour
+
+	// maxListLength limits the size of a fetched list or signature.
+	maxListLength = 16 << 20
+)
+
+// Feed is an externally maintained blocklist, published over HTTPS along
+// with a detached signature.
+type Feed struct {
+	// Name identifies the feed's entries in the blocklist.
+	Name string
+	// URL of the list.
+	URL string
+	// URL of the armored detached signature of the list. Defaults to URL
+	// with ".asc" appended.
+	SignatureURL string
+	// Keys trusted to sign the list.
+	Keyring xopenpgp.EntityList
+
+	etag string
+}
+
+func (f *Feed) signatureURL() string {
+	if f.SignatureURL != "" {
+		return f.SignatureURL
+	}
+	return f.URL + ".asc"
+}
+
+// Parse reads a blocklist. Each line contains either a key fingerprint, in
+// hex with optional spaces and "0x" prefix, or "uid:" followed by a regular
+// expression matching the user IDs of blocked keys. Blank lines and lines
+// starting with "#" are ignored. The whole list is rejected if any line is
+// invalid, rather than applying part of it.
+func Parse(r io.Reader) (fps []string, uids []*regexp.Regexp, err error) {
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "uid:") {
+			re, err := regexp.Compile(strings.TrimSpace(line[len("uid:"):]))
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid user ID pattern on line %d", n)
+			}
+			uids = append(uids, re)
+			continue
+		}
+		fp := strings.ToLower(strings.Replace(line, " ", "", -1))
+		fp = strings.TrimPrefix(fp, "0x")
+		if _, err := hex.DecodeString(fp); err != nil || (len(fp) != 40 && len(fp) != 64) {
+			return nil, nil, errors.Errorf("invalid fingerprint on line %d", n)
+		}
+		fps = append(fps, fp)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return fps, uids, nil
+}
+
+// Updater applies feeds to a Blocklist, removing keys from storage as they
+// become blocked.
+type Updater struct {
+	bl       *openpgp.Blocklist
+	st       storage.Storage
+	interval time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	feeds []*Feed
+
+	reload chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type Option func(*Updater)
+
+// Interval sets how often feeds are fetched.
+func Interval(d time.Duration) Option {
+	return func(u *Updater) {
+		if d > 0 {
+			u.interval = d
+		}
+	}
+}
+
+// HTTPClient sets the client used to fetch feeds.
+func HTTPClient(c *http.Client) Option {
+	return func(u *Updater) { u.client = c }
+}
+
+// New returns an Updater applying feeds to bl. Every feed must be fetched
+// over HTTPS, and have at least one trusted key.
+func New(bl *openpgp.Blocklist, st storage.Storage, feeds []*Feed, options ...Option) (*Updater, error) {
+	err := checkFeeds(feeds)
+	if err != nil {
+		return nil, err
+	}
+	u := &Updater{
+		bl:       bl,
+		st:       st,
+		feeds:    feeds,
+		interval: DefaultInterval,
+		client:   http.DefaultClient,
+		reload:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(u)
+	}
+	return u, nil
+}
+
+func checkFeeds(feeds []*Feed) error {
+	names := map[string]bool{}
+	for _, feed := range feeds {
+		if names[feed.Name] {
+			return errors.Errorf("duplicate blocklist feed %q", feed.Name)
+		}
+		names[feed.Name] = true
+		for _, s := range []string{feed.URL, feed.signatureURL()} {
+			u, err := url.Parse(s)
+			if err != nil {
+				return errors.Wrapf(err, "invalid URL for blocklist feed %q", feed.Name)
+			}
+			if u.Scheme != "https" {
+				return errors.Errorf("blocklist feed %q must be fetched over https", feed.Name)
+			}
+		}
+		if len(feed.Keyring) == 0 {
+			return errors.Errorf("blocklist feed %q has no trusted keys", feed.Name)
+		}
+	}
+	return nil
+}
+
+// SetFeeds replaces the feeds applied, such as when the configuration is
+// reloaded. The entries of feeds no longer given are removed from the
+// blocklist, and the feeds are fetched again without waiting for the next
+// interval. Feeds still fetched from the same URL are only applied again if
+// they have changed.
+func (u *Updater) SetFeeds(feeds []*Feed) error {
+	err := checkFeeds(feeds)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	prev := map[string]*Feed{}
+	for _, feed := range u.feeds {
+		prev[feed.Name] = feed
+	}
+	for _, feed := range feeds {
+		if p, ok := prev[feed.Name]; ok {
+			if p.URL == feed.URL && p.signatureURL() == feed.signatureURL() {
+				feed.etag = p.etag
+			}
+			delete(prev, feed.Name)
+		}
+	}
+	u.feeds = feeds
+	for name := range prev {
+		_, removed := u.bl.Set(name, nil, nil)
+		log.WithFields(log.Fields{
+			"feed":    name,
+			"removed": len(removed),
+		}).Info("blocklist feed removed")
+	}
+	u.mu.Unlock()
+
+	select {
+	case u.reload <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// hasFeed returns whether feed is among those applied. u.mu must be held.
+func (u *Updater) hasFeed(feed *Feed) bool {
+	for _, f := range u.feeds {
+		if f == feed {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Updater) currentFeeds() []*Feed {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.feeds
+}
+
+// Start fetches all feeds, and then fetches them again every interval until
+// Stop is called.
+func (u *Updater) Start() {
+	go u.run()
+}
+
+// Stop stops fetching feeds. Entries already applied remain in the
+// blocklist.
+func (u *Updater) Stop() {
+	close(u.stop)
+	<-u.done
+}
+
+func (u *Updater) run() {
+	defer close(u.done)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		for _, feed := range u.currentFeeds() {
+			err := u.Update(feed)
+			if err != nil {
+				log.Errorf("failed to update blocklist feed %q: %v", feed.Name, err)
+			}
+		}
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+		case <-u.reload:
+		}
+	}
+}
+
+// Update fetches feed and, if it has changed and is validly signed, replaces
+// the feed's entries in the blocklist. Stored keys which become blocked are
+// deleted. If the feed cannot be fetched or verified, the entries last
+// applied from it are kept.
+//
+// Update is not safe to call concurrently for the same feed.
+func (u *Updater) Update(feed *Feed) error {
+	req, err := http.NewRequest("GET", feed.URL, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	u.mu.Lock()
+	prevETag := feed.etag
+	u.mu.Unlock()
+	if prevETag != "" {
+		req.Header.Set("If-None-Match", prevETag)
+	}
+	list, etag, err := u.fetch(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if list == nil {
+		log.Debugf("blocklist feed %q not modified", feed.Name)
+		return nil
+	}
+	req, err = http.NewRequest("GET", feed.signatureURL(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sig, _, err := u.fetch(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch signature")
+	}
+	_, err = xopenpgp.CheckArmoredDetachedSignature(feed.Keyring, bytes.NewReader(list), bytes.NewReader(sig), nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	fps, uids, err := Parse(bytes.NewReader(list))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	u.mu.Lock()
+	if !u.hasFeed(feed) {
+		// The feed was removed while it was being fetched.
+		u.mu.Unlock()
+		return nil
+	}
+	added, removed := u.bl.Set(feed.Name, fps, uids)
+	feed.etag = etag
+	u.mu.Unlock()
+	var deleted int
+	for _, fp := range added {
+		// The key's digest is left in the reconciliation prefix tree, so
+		// that peers which still have the key do not keep sending it.
+		_, err := storage.DeleteKey(u.st, fp)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			log.Errorf("failed to delete blocklisted key %q: %v", fp, err)
+			continue
+		}
+		deleted++
+	}
+	log.WithFields(log.Fields{
+		"feed":    feed.Name,
+		"fps":     len(fps),
+		"uids":    len(uids),
+		"added":   len(added),
+		"removed": len(removed),
+		"deleted": deleted,
+	}).Info("blocklist updated")
+	return nil
+}
+
+// fetch returns the response body for req, and its ETag. The body is nil if
+// the resource is not modified.
+func (u *Updater) fetch(req *http.Request) ([]byte, string, error) {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", nil
+	default:
+		return nil, "", errors.Errorf("unexpected status fetching %q: %s", req.URL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListLength+1))
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	if len(body) > maxListLength {
+		return nil, "", errors.Errorf("%q exceeds %d bytes", req.URL, maxListLength)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
@@ -0,0 +1,223 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package blocklist
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type BlocklistSuite struct {
+	signer *xopenpgp.Entity
+}
+
+var _ = gc.Suite(&BlocklistSuite{})
+
+const (
+	fp1 = "81279eee7ec89fb781702adaf79362da44a2d1db"
+	fp2 = "8cf61fcf70f9b2d6c9bc5d4fc7d29c6b3e1c2ab0"
+)
+
+func (s *BlocklistSuite) SetUpSuite(c *gc.C) {
+	var err error
+	s.signer, err = xopenpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *BlocklistSuite) sign(c *gc.C, list string) string {
+	var buf bytes.Buffer
+	err := xopenpgp.ArmoredDetachSign(&buf, s.signer, strings.NewReader(list), nil)
+	c.Assert(err, gc.IsNil)
+	return buf.String()
+}
+
+// feedServer serves a list and its signature, counting requests for the
+// list which were answered in full.
+type feedServer struct {
+	list, sig string
+	served    int
+}
+
+func (f *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	etag := fmt.Sprintf(`"%x"`, md5.Sum([]byte(f.list)))
+	switch r.URL.Path {
+	case "/list":
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		f.served++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(f.list))
+	case "/list.asc":
+		w.Write([]byte(f.sig))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *BlocklistSuite) TestParse(c *gc.C) {
+	fps, uids, err := Parse(strings.NewReader(`
+# comment
+0x8127 9EEE 7EC8 9FB7 8170  2ADA F793 62DA 44A2 D1DB
+uid: spam@example\.com
+`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(fps, gc.DeepEquals, []string{fp1})
+	c.Assert(uids, gc.HasLen, 1)
+	c.Assert(uids[0].MatchString("Spammer <spam@example.com>"), gc.Equals, true)
+
+	_, _, err = Parse(strings.NewReader(fp1 + "\n1234\n"))
+	c.Assert(err, gc.ErrorMatches, "invalid fingerprint on line 2")
+	_, _, err = Parse(strings.NewReader("uid:(\n"))
+	c.Assert(err, gc.ErrorMatches, "invalid user ID pattern on line 1.*")
+}
+
+func (s *BlocklistSuite) TestNew(c *gc.C) {
+	bl := openpgp.NewBlocklist()
+	st := mock.NewStorage()
+	_, err := New(bl, st, []*Feed{{Name: "a", URL: "http://example.com/list", Keyring: xopenpgp.EntityList{s.signer}}})
+	c.Assert(err, gc.ErrorMatches, `blocklist feed "a" must be fetched over https`)
+	_, err = New(bl, st, []*Feed{{Name: "a", URL: "https://example.com/list"}})
+	c.Assert(err, gc.ErrorMatches, `blocklist feed "a" has no trusted keys`)
+	_, err = New(bl, st, []*Feed{
+		{Name: "a", URL: "https://example.com/list", Keyring: xopenpgp.EntityList{s.signer}},
+		{Name: "a", URL: "https://example.com/other", Keyring: xopenpgp.EntityList{s.signer}},
+	})
+	c.Assert(err, gc.ErrorMatches, `duplicate blocklist feed "a"`)
+}
+
+func (s *BlocklistSuite) TestUpdate(c *gc.C) {
+	list := fp1 + "\n" + fp2 + "\nuid:spam\n"
+	fs := &feedServer{list: list, sig: s.sign(c, list)}
+	srv := httptest.NewTLSServer(fs)
+	defer srv.Close()
+
+	st := mock.NewStorage(mock.Delete(func(fp string) (string, error) {
+		if fp == fp2 {
+			return "", storage.ErrKeyNotFound
+		}
+		return "digest", nil
+	}))
+	bl := openpgp.NewBlocklist()
+	feed := &Feed{Name: "pool", URL: srv.URL + "/list", Keyring: xopenpgp.EntityList{s.signer}}
+	u, err := New(bl, st, []*Feed{feed}, HTTPClient(srv.Client()))
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(u.Update(feed), gc.IsNil)
+	c.Assert(fs.served, gc.Equals, 1)
+	c.Assert(bl.BlocksFingerprint(fp1), gc.Equals, true)
+	c.Assert(bl.BlocksFingerprint(fp2), gc.Equals, true)
+	c.Assert(bl.BlocksUserID("spammer"), gc.Equals, true)
+	c.Assert(st.MethodCount("Delete"), gc.Equals, 2)
+
+	// Unchanged lists are not fetched or applied again.
+	c.Assert(u.Update(feed), gc.IsNil)
+	c.Assert(fs.served, gc.Equals, 1)
+	c.Assert(st.MethodCount("Delete"), gc.Equals, 2)
+
+	// Removed entries are no longer blocked, and only newly blocked keys
+	// are deleted.
+	fs.list = fp2 + "\n"
+	fs.sig = s.sign(c, fs.list)
+	c.Assert(u.Update(feed), gc.IsNil)
+	c.Assert(bl.BlocksFingerprint(fp1), gc.Equals, false)
+	c.Assert(bl.BlocksFingerprint(fp2), gc.Equals, true)
+	c.Assert(bl.BlocksUserID("spammer"), gc.Equals, false)
+	c.Assert(st.MethodCount("Delete"), gc.Equals, 2)
+}
+
+func (s *BlocklistSuite) TestSetFeeds(c *gc.C) {
+	list := fp1 + "\n"
+	fs := &feedServer{list: list, sig: s.sign(c, list)}
+	srv := httptest.NewTLSServer(fs)
+	defer srv.Close()
+
+	st := mock.NewStorage()
+	bl := openpgp.NewBlocklist()
+	feed := &Feed{Name: "pool", URL: srv.URL + "/list", Keyring: xopenpgp.EntityList{s.signer}}
+	u, err := New(bl, st, []*Feed{feed}, HTTPClient(srv.Client()))
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.Update(feed), gc.IsNil)
+	c.Assert(fs.served, gc.Equals, 1)
+
+	// A feed reconfigured with the same URL is not applied again unless
+	// it has changed.
+	same := &Feed{Name: "pool", URL: srv.URL + "/list", Keyring: xopenpgp.EntityList{s.signer}}
+	c.Assert(u.SetFeeds([]*Feed{same}), gc.IsNil)
+	c.Assert(u.Update(same), gc.IsNil)
+	c.Assert(fs.served, gc.Equals, 1)
+	c.Assert(bl.BlocksFingerprint(fp1), gc.Equals, true)
+
+	err = u.SetFeeds([]*Feed{{Name: "pool", URL: "http://example.com/list", Keyring: xopenpgp.EntityList{s.signer}}})
+	c.Assert(err, gc.ErrorMatches, `blocklist feed "pool" must be fetched over https`)
+
+	// The entries of removed feeds are no longer blocked, even if the feed
+	// was being fetched.
+	c.Assert(u.SetFeeds(nil), gc.IsNil)
+	c.Assert(bl.BlocksFingerprint(fp1), gc.Equals, false)
+	fs.list = fp2 + "\n"
+	fs.sig = s.sign(c, fs.list)
+	c.Assert(u.Update(same), gc.IsNil)
+	c.Assert(bl.BlocksFingerprint(fp2), gc.Equals, false)
+}
+
+func (s *BlocklistSuite) TestBadSignature(c *gc.C) {
+	list := fp1 + "\n"
+	fs := &feedServer{list: list, sig: s.sign(c, list)}
+	srv := httptest.NewTLSServer(fs)
+	defer srv.Close()
+
+	bl := openpgp.NewBlocklist()
+	feed := &Feed{Name: "pool", URL: srv.URL + "/list", Keyring: xopenpgp.EntityList{s.signer}}
+	u, err := New(bl, mock.NewStorage(), []*Feed{feed}, HTTPClient(srv.Client()))
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.Update(feed), gc.IsNil)
+
+	// A list which does not match its signature is not applied.
+	fs.list = fp2 + "\n"
+	err = u.Update(feed)
+	c.Assert(err, gc.ErrorMatches, "invalid signature.*")
+	c.Assert(bl.BlocksFingerprint(fp1), gc.Equals, true)
+	c.Assert(bl.BlocksFingerprint(fp2), gc.Equals, false)
+
+	// Nor is a list signed by an untrusted key.
+	other, err := xopenpgp.NewEntity("other", "", "other@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	var sig bytes.Buffer
+	c.Assert(xopenpgp.ArmoredDetachSign(&sig, other, strings.NewReader(fs.list), nil), gc.IsNil)
+	fs.sig = sig.String()
+	err = u.Update(feed)
+	c.Assert(err, gc.ErrorMatches, "invalid signature.*")
+	c.Assert(bl.BlocksFingerprint(fp2), gc.Equals, false)
+}
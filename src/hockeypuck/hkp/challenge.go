@@ -0,0 +1,307 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/locale"
+	"hockeypuck/hkp/storage"
+)
+
+// ErrChallengeFailed is returned when a key submission does not meet the
+// submission challenge.
+var ErrChallengeFailed = fmt.Errorf("submission challenge not met")
+
+func IsChallengeFailed(err error) bool {
+	return errors.Is(err, ErrChallengeFailed)
+}
+
+// Challenge is an anti-abuse challenge which key submissions must meet, to
+// slow down automated flooding of junk keys.
+type Challenge interface {
+	// Verify returns nil if the submission request meets the challenge,
+	// and otherwise an error wrapping ErrChallengeFailed.
+	Verify(r *http.Request) error
+	// Describe sets headers telling the client of a refused submission how
+	// to meet the challenge.
+	Describe(h http.Header)
+}
+
+const (
+	// hashcashHeader carries the proof of work stamp of a submission.
+	hashcashHeader = "X-Hashcash"
+	// hashcashChallengeHeader tells clients the bits and resource a stamp
+	// must have, separated by a colon.
+	hashcashChallengeHeader = "X-Hashcash-Challenge"
+)
+
+// HashcashChallenge requires submissions to carry a hashcash version 1 stamp
+// in an X-Hashcash header, proving work in proportion to the number of bits
+// required. Stamps are for the keyserver's hostname as the resource, and
+// may each be spent once.
+type HashcashChallenge struct {
+	bits     int
+	resource string
+	maxAge   time.Duration
+	clock    storage.Clock
+
+	mu        sync.Mutex
+	spent     map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewHashcashChallenge returns a challenge requiring stamps of at least the
+// given number of bits for resource, dated no more than maxAge from now.
+func NewHashcashChallenge(bits int, resource string, maxAge time.Duration) *HashcashChallenge {
+	return &HashcashChallenge{
+		bits:     bits,
+		resource: resource,
+		maxAge:   maxAge,
+		clock:    storage.SystemClock,
+		spent:    map[string]time.Time{},
+	}
+}
+
+// Verify implements Challenge.
+func (c *HashcashChallenge) Verify(r *http.Request) error {
+	stamp := strings.TrimSpace(r.Header.Get(hashcashHeader))
+	if stamp == "" {
+		return errors.Wrap(ErrChallengeFailed, "missing hashcash stamp")
+	}
+	// ver:bits:date:resource:ext:rand:counter
+	fields := strings.Split(stamp, ":")
+	if len(fields) != 7 || fields[0] != "1" {
+		return errors.Wrapf(ErrChallengeFailed, "malformed hashcash stamp %q", stamp)
+	}
+	claimed, err := strconv.Atoi(fields[1])
+	if err != nil || claimed < c.bits {
+		return errors.Wrapf(ErrChallengeFailed, "hashcash stamp %q claims fewer than %d bits", stamp, c.bits)
+	}
+	date, err := parseHashcashDate(fields[2])
+	if err != nil {
+		return errors.Wrapf(ErrChallengeFailed, "malformed hashcash stamp date %q", fields[2])
+	}
+	now := c.clock.Now()
+	if date.Before(now.Add(-c.maxAge)) || date.After(now.Add(c.maxAge)) {
+		return errors.Wrapf(ErrChallengeFailed, "hashcash stamp %q has expired", stamp)
+	}
+	if !strings.EqualFold(fields[3], c.resource) {
+		return errors.Wrapf(ErrChallengeFailed, "hashcash stamp %q is not for %s", stamp, c.resource)
+	}
+	if leadingZeroBits(sha1.Sum([]byte(stamp))) < c.bits {
+		return errors.Wrapf(ErrChallengeFailed, "hashcash stamp %q has fewer than %d bits", stamp, c.bits)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastPrune) > c.maxAge {
+		for s, expires := range c.spent {
+			if now.After(expires) {
+				delete(c.spent, s)
+			}
+		}
+		c.lastPrune = now
+	}
+	if _, ok := c.spent[stamp]; ok {
+		return errors.Wrapf(ErrChallengeFailed, "hashcash stamp %q has been spent", stamp)
+	}
+	c.spent[stamp] = date.Add(c.maxAge)
+	return nil
+}
+
+// Describe implements Challenge.
+func (c *HashcashChallenge) Describe(h http.Header) {
+	h.Set(hashcashChallengeHeader, strconv.Itoa(c.bits)+":"+c.resource)
+}
+
+// parseHashcashDate parses the date of a stamp, given as YYMMDD[hhmm[ss]]
+// in UTC.
+func parseHashcashDate(s string) (time.Time, error) {
+	switch len(s) {
+	case 6:
+		return time.Parse("060102", s)
+	case 10:
+		return time.Parse("0601021504", s)
+	case 12:
+		return time.Parse("060102150405", s)
+	}
+	return time.Time{}, errors.Errorf("invalid length %d", len(s))
+}
+
+func leadingZeroBits(sum [sha1.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// captchaTimeout limits the time taken to verify a CAPTCHA response.
+const captchaTimeout = 10 * time.Second
+
+// CaptchaChallenge requires submissions to carry a CAPTCHA response in a
+// form field, which is verified by a siteverify API of the kind offered by
+// hCaptcha, reCAPTCHA and Turnstile. The submission form must include the
+// provider's widget.
+type CaptchaChallenge struct {
+	verifyURL string
+	secret    string
+	field     string
+	client    *http.Client
+	clientIP  func(*http.Request) net.IP
+}
+
+// NewCaptchaChallenge returns a challenge verifying the response in the
+// given form field with the siteverify API at verifyURL, using the site's
+// secret. The address of the client, found by clientIP as for the ClientIP
+// option, or else RemoteIP, is given to the API.
+func NewCaptchaChallenge(verifyURL, secret, field string, clientIP func(*http.Request) net.IP) *CaptchaChallenge {
+	if clientIP == nil {
+		clientIP = RemoteIP
+	}
+	return &CaptchaChallenge{
+		verifyURL: verifyURL,
+		secret:    secret,
+		field:     field,
+		client:    &http.Client{Timeout: captchaTimeout},
+		clientIP:  clientIP,
+	}
+}
+
+// Verify implements Challenge.
+func (c *CaptchaChallenge) Verify(r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return errors.Wrapf(ErrChallengeFailed, "malformed submission: %v", err)
+	}
+	response := r.Form.Get(c.field)
+	if response == "" {
+		return errors.Wrap(ErrChallengeFailed, "missing CAPTCHA response")
+	}
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {response},
+	}
+	if ip := c.clientIP(r); ip != nil {
+		form.Set("remoteip", ip.String())
+	}
+	resp, err := c.client.PostForm(c.verifyURL, form)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify CAPTCHA response")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to verify CAPTCHA response: HTTP %d", resp.StatusCode)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify CAPTCHA response")
+	}
+	if !result.Success {
+		return errors.Wrapf(ErrChallengeFailed, "CAPTCHA response rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// Describe implements Challenge.
+func (c *CaptchaChallenge) Describe(h http.Header) {}
+
+// SubmissionChallenge requires key submissions to meet a challenge, unless
+// they present one of the bypass tokens. It applies to every route which
+// stores a submitted key: /pks/add, /pks/replace, /pks/revoke and
+// /vks/v1/upload.
+func SubmissionChallenge(c Challenge, bypassTokens []string) HandlerOption {
+	return func(h *Handler) error {
+		h.challenge = c
+		h.challengeBypass = bypassTokens
+		return nil
+	}
+}
+
+// verifyChallenge returns nil if a key submission meets the challenge, or
+// is not challenged, and otherwise an error. If the challenge is not met,
+// the headers telling the client how to meet it are set.
+func (h *Handler) verifyChallenge(w http.ResponseWriter, r *http.Request) error {
+	if h.challenge == nil || bypassesChallenge(r, h.challengeBypass) {
+		return nil
+	}
+	err := h.challenge.Verify(r)
+	if IsChallengeFailed(err) {
+		h.challenge.Describe(w.Header())
+	}
+	return err
+}
+
+// meetsChallenge returns whether a key submission to an HKP route meets the
+// challenge, responding with an error if it does not.
+func (h *Handler) meetsChallenge(w http.ResponseWriter, r *http.Request) bool {
+	err := h.verifyChallenge(w, r)
+	if IsChallengeFailed(err) {
+		httpPolicyError(w, http.StatusForbidden, err, locale.MessageChallengeFailed)
+		return false
+	} else if err != nil {
+		httpError(w, http.StatusServiceUnavailable, errors.WithStack(err))
+		return false
+	}
+	return true
+}
+
+// bypassesChallenge returns whether a request presents one of the tokens
+// exempting submissions from the challenge, as a bearer token or in HTTP
+// basic authentication. Clients which cannot meet a challenge, such as gpg
+// --send-keys, may give a token as the user info of the keyserver URL.
+func bypassesChallenge(r *http.Request, tokens []string) bool {
+	var presented []string
+	if user, pass, ok := r.BasicAuth(); ok {
+		presented = append(presented, user, pass)
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		presented = append(presented, strings.TrimSpace(auth[len("Bearer "):]))
+	}
+	for _, p := range presented {
+		if p == "" {
+			continue
+		}
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare([]byte(p), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package dane generates the OPENPGPKEY DNS resource records of RFC 7929
+// for keys with verified addresses in a domain, so that they can be
+// published in a DNSSEC-signed zone.
+package dane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+// scanBatch is the number of verified addresses read at a time.
+const scanBatch = 1000
+
+// Record is an OPENPGPKEY resource record publishing the key of an address.
+type Record struct {
+	// Name is the fully qualified owner name of the record.
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint"`
+	// Data is the transferable public key, with only the user IDs having
+	// the address.
+	Data []byte `json:"data"`
+}
+
+// OwnerName returns the fully qualified owner name of the OPENPGPKEY record
+// of an address, the hex-encoded SHA2-256 digest of its local part truncated
+// to 28 octets, under _openpgpkey in its domain, RFC 7929 section 3.
+// Addresses are verified in lower case, so the lower-cased local part is
+// hashed.
+func OwnerName(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at <= 0 || at == len(addr)-1 {
+		return "", errors.Errorf("invalid address %q", addr)
+	}
+	digest := sha256.Sum256([]byte(strings.ToLower(addr[:at])))
+	return hex.EncodeToString(digest[:28]) + "._openpgpkey." + strings.ToLower(addr[at+1:]) + ".", nil
+}
+
+// Records returns the records of the keys with addresses in domain verified
+// by this keyserver, written with the given policy, ordered by name. An
+// address verified on more than one key has a record for each.
+func Records(st storage.Storage, domain string, policy ...openpgp.PolicyOption) ([]*Record, error) {
+	vs, ok := st.(storage.VerificationStore)
+	if !ok {
+		return nil, errors.New("storage does not record verified addresses")
+	}
+	domain = strings.ToLower(domain)
+	addrs, err := verifiedAddresses(vs, domain)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	var rfps []string
+	for rfp := range addrs {
+		rfps = append(rfps, rfp)
+	}
+	sort.Strings(rfps)
+	keys, err := st.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var records []*Record
+	for _, key := range keys {
+		for _, addr := range addrs[key.RFingerprint] {
+			name, err := OwnerName(addr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			addr := addr
+			kw := openpgp.NewKeyWriter(append(policy[:len(policy):len(policy)],
+				openpgp.MatchedUserIDs(func(uid *openpgp.UserID) bool {
+					return storage.UserIDAddress(uid.Keywords) == addr
+				}))...)
+			var buf bytes.Buffer
+			err = kw.Write(&buf, key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to write key %s", key.Fingerprint())
+			}
+			records = append(records, &Record{
+				Name:        name,
+				Address:     addr,
+				Fingerprint: key.Fingerprint(),
+				Data:        buf.Bytes(),
+			})
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// verifiedAddresses returns the addresses in domain verified by this
+// keyserver, by the RFingerprint of the key they were verified on.
+func verifiedAddresses(vs storage.VerificationStore, domain string) (map[string][]string, error) {
+	result := map[string][]string{}
+	seen := map[storage.VerifiedAddress]bool{}
+	var since time.Time
+	for {
+		addrs, err := vs.VerifiedSince(since, scanBatch)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, va := range addrs {
+			if !strings.HasSuffix(va.Address, "@"+domain) {
+				continue
+			}
+			// Batches overlap at the time they start.
+			k := storage.VerifiedAddress{RFingerprint: va.RFingerprint, Address: va.Address}
+			if !seen[k] {
+				seen[k] = true
+				result[va.RFingerprint] = append(result[va.RFingerprint], va.Address)
+			}
+		}
+		if len(addrs) < scanBatch {
+			return result, nil
+		}
+		next := addrs[len(addrs)-1].Verified
+		if !next.After(since) {
+			return result, nil
+		}
+		since = next
+	}
+}
+
+// WriteZone writes records in zone file format with the given TTL in
+// seconds, or the zone's default TTL if zero. Each record is preceded by a
+// comment with the fingerprint of its key; addresses are left out, as
+// they may contain characters which are not safe in a zone file.
+func WriteZone(w io.Writer, records []*Record, ttl int) error {
+	for _, r := range records {
+		var err error
+		if ttl > 0 {
+			_, err = fmt.Fprintf(w, "; %s\n%s %d IN OPENPGPKEY %s\n",
+				r.Fingerprint, r.Name, ttl, base64.StdEncoding.EncodeToString(r.Data))
+		} else {
+			_, err = fmt.Fprintf(w, "; %s\n%s IN OPENPGPKEY %s\n",
+				r.Fingerprint, r.Name, base64.StdEncoding.EncodeToString(r.Data))
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package dane
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type DANESuite struct{}
+
+var _ = gc.Suite(&DANESuite{})
+
+func (s *DANESuite) TestOwnerName(c *gc.C) {
+	// Example from RFC 7929 section 3.
+	name, err := OwnerName("Hugh@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(name, gc.Equals, "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com.")
+
+	for _, addr := range []string{"", "hugh", "@example.com", "hugh@"} {
+		_, err := OwnerName(addr)
+		c.Assert(err, gc.NotNil, gc.Commentf("%q", addr))
+	}
+}
+
+func (s *DANESuite) TestRecords(c *gc.C) {
+	const rfp = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	verified := time.Unix(1600000000, 0)
+	st := mock.NewStorage(
+		mock.VerifiedSince(func(t time.Time, limit int) ([]storage.VerifiedAddress, error) {
+			return []storage.VerifiedAddress{
+				{RFingerprint: rfp, Address: "alice@example.com", Verified: verified},
+				{RFingerprint: rfp, Address: "alice@example.org", Verified: verified},
+			}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			c.Assert(rfps, gc.DeepEquals, []string{rfp})
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	records, err := Records(st, "Example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 1)
+	c.Assert(records[0].Address, gc.Equals, "alice@example.com")
+	c.Assert(records[0].Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	name, err := OwnerName("alice@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(records[0].Name, gc.Equals, name)
+	keys := openpgp.MustReadKeys(bytes.NewBuffer(records[0].Data))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+
+	var buf bytes.Buffer
+	c.Assert(WriteZone(&buf, records, 3600), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, strings.Join([]string{
+		"; 10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		name + " 3600 IN OPENPGPKEY " + base64.StdEncoding.EncodeToString(records[0].Data),
+		"",
+	}, "\n"))
+
+	records, err = Records(st, "example.net")
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 0)
+}
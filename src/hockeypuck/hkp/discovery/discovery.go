@@ -0,0 +1,216 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package discovery resolves the keyserver addresses used in peer and
+// upstream configuration into the base URLs to contact, following the DNS
+// SRV conventions GnuPG uses for hkp and hkps. This allows a keyserver to be
+// configured by its bare domain name.
+package discovery
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	// DefaultHKPPort is the port of an hkp keyserver without an SRV record.
+	DefaultHKPPort = 11371
+	// DefaultHKPSPort is the port of an hkps keyserver without an SRV record.
+	DefaultHKPSPort = 443
+)
+
+// LookupSRVFunc looks up SRV records, with the signature of net.LookupSRV.
+type LookupSRVFunc func(service, proto, name string) (string, []*net.SRV, error)
+
+// Resolver resolves keyserver addresses into candidate base URLs.
+type Resolver struct {
+	lookupSRV LookupSRVFunc
+}
+
+type Option func(*Resolver)
+
+// LookupSRV sets the function used to look up SRV records.
+func LookupSRV(f LookupSRVFunc) Option {
+	return func(r *Resolver) { r.lookupSRV = f }
+}
+
+// NewResolver returns a Resolver which looks up SRV records in the DNS.
+func NewResolver(options ...Option) *Resolver {
+	r := &Resolver{lookupSRV: net.LookupSRV}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// Resolve returns the base URLs at which the keyserver addr may be reached,
+// in the order in which they should be tried.
+//
+// An http or https URL, and an address with an explicit port or IP address,
+// are used as given; an address without a scheme is assumed to be hkp. An
+// hkps:// domain is resolved with its _hkps._tcp SRV records and an hkp://
+// domain with its _hkp._tcp SRV records. A bare domain is resolved with its
+// _hkps._tcp records, then its _hkp._tcp records. In all cases the domain
+// itself, at the default port of its scheme, is tried last.
+func (r *Resolver) Resolve(addr string) ([]string, error) {
+	scheme, host, port, path, err := splitAddr(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if scheme == "http" || scheme == "https" {
+		return []string{baseURL(scheme, host, port, path)}, nil
+	}
+	if port != "" || net.ParseIP(host) != nil {
+		return []string{baseURL(httpScheme(scheme), host, defaultPort(scheme, port), path)}, nil
+	}
+
+	var bases []string
+	add := func(base string) {
+		for _, b := range bases {
+			if b == base {
+				return
+			}
+		}
+		bases = append(bases, base)
+	}
+	if scheme == "" || scheme == "hkps" {
+		for _, target := range r.lookup("hkps", host) {
+			add(baseURL("https", target.host, target.port, path))
+		}
+	}
+	if scheme == "" || scheme == "hkp" {
+		for _, target := range r.lookup("hkp", host) {
+			add(baseURL("http", target.host, target.port, path))
+		}
+	}
+	add(baseURL(httpScheme(scheme), host, defaultPort(scheme, ""), path))
+	return bases, nil
+}
+
+// Do sends the request returned by newRequest for each base URL of the
+// keyserver addr in turn, until one of them is answered. The request must
+// be created anew for each base URL, so that its body may be sent again.
+func (r *Resolver) Do(client *http.Client, addr string, newRequest func(base string) (*http.Request, error)) (*http.Response, error) {
+	bases, err := r.Resolve(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, base := range bases {
+		var req *http.Request
+		req, err = newRequest(base)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		log.Debugf("cannot reach %q at %q: %v", addr, base, err)
+	}
+	return nil, errors.WithStack(err)
+}
+
+type target struct {
+	host string
+	port string
+}
+
+func (r *Resolver) lookup(service, domain string) []target {
+	_, srvs, err := r.lookupSRV(service, "tcp", domain)
+	if err != nil {
+		log.Debugf("no _%s._tcp SRV records for %q: %v", service, domain, err)
+		return nil
+	}
+	// net.LookupSRV already orders records by priority, randomized by weight
+	// within each priority; a stable sort keeps that order.
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+	var targets []target
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			// A target of "." means the service is not available.
+			continue
+		}
+		targets = append(targets, target{host: host, port: strconv.Itoa(int(srv.Port))})
+	}
+	return targets
+}
+
+func splitAddr(addr string) (scheme, host, port, path string, err error) {
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "", "", "", "", errors.WithStack(err)
+		}
+		scheme = strings.ToLower(u.Scheme)
+		switch scheme {
+		case "hkp", "hkps", "http", "https":
+		default:
+			return "", "", "", "", errors.Errorf("unsupported scheme in keyserver address %q", addr)
+		}
+		host, port, path = u.Hostname(), u.Port(), strings.TrimSuffix(u.Path, "/")
+	} else {
+		host = addr
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			host, port = h, p
+		}
+	}
+	if host == "" {
+		return "", "", "", "", errors.Errorf("missing host in keyserver address %q", addr)
+	}
+	return scheme, host, port, path, nil
+}
+
+func httpScheme(scheme string) string {
+	if scheme == "hkps" {
+		return "https"
+	}
+	return "http"
+}
+
+func defaultPort(scheme, port string) string {
+	if port != "" {
+		return port
+	}
+	if scheme == "hkps" {
+		return strconv.Itoa(DefaultHKPSPort)
+	}
+	return strconv.Itoa(DefaultHKPPort)
+}
+
+func baseURL(scheme, host, port, path string) string {
+	implicit := port == "" ||
+		(scheme == "https" && port == "443") ||
+		(scheme == "http" && port == "80")
+	if !implicit {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host + path
+}
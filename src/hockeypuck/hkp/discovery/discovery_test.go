@@ -0,0 +1,149 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	stdtesting "testing"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type DiscoverySuite struct{}
+
+var _ = gc.Suite(&DiscoverySuite{})
+
+// fakeSRV returns a lookup function answering from records, keyed by
+// "_service._proto.name".
+func fakeSRV(records map[string][]*net.SRV) LookupSRVFunc {
+	return func(service, proto, name string) (string, []*net.SRV, error) {
+		srvs, ok := records["_"+service+"._"+proto+"."+name]
+		if !ok {
+			return "", nil, errors.New("no such host")
+		}
+		return "", srvs, nil
+	}
+}
+
+func (s *DiscoverySuite) TestResolve(c *gc.C) {
+	r := NewResolver(LookupSRV(fakeSRV(map[string][]*net.SRV{
+		"_hkps._tcp.example.org": {
+			{Target: "backup.example.org.", Port: 443, Priority: 20},
+			{Target: "keys.example.org.", Port: 443, Priority: 10},
+		},
+		"_hkp._tcp.example.org": {
+			{Target: "keys.example.org.", Port: 11371, Priority: 10},
+		},
+		"_hkps._tcp.example.net": {
+			{Target: ".", Port: 0},
+		},
+		"_hkp._tcp.example.net": {
+			{Target: "pool.example.net.", Port: 80},
+		},
+	})))
+	for _, t := range []struct {
+		addr  string
+		bases []string
+	}{{
+		"example.org", []string{
+			"https://keys.example.org",
+			"https://backup.example.org",
+			"http://keys.example.org:11371",
+			"http://example.org:11371",
+		},
+	}, {
+		"hkps://example.org", []string{
+			"https://keys.example.org",
+			"https://backup.example.org",
+			"https://example.org",
+		},
+	}, {
+		"hkp://example.org", []string{
+			"http://keys.example.org:11371",
+			"http://example.org:11371",
+		},
+	}, {
+		"example.net", []string{
+			"http://pool.example.net",
+			"http://example.net:11371",
+		},
+	}, {
+		"hkps://example.com/", []string{"https://example.com"},
+	}, {
+		"example.org:11372", []string{"http://example.org:11372"},
+	}, {
+		"192.0.2.1", []string{"http://192.0.2.1:11371"},
+	}, {
+		"[2001:db8::1]:11371", []string{"http://[2001:db8::1]:11371"},
+	}, {
+		"https://example.org/keys/", []string{"https://example.org/keys"},
+	}, {
+		"http://example.org:8080", []string{"http://example.org:8080"},
+	}} {
+		bases, err := r.Resolve(t.addr)
+		c.Assert(err, gc.IsNil, gc.Commentf("%s", t.addr))
+		c.Check(bases, gc.DeepEquals, t.bases, gc.Commentf("%s", t.addr))
+	}
+
+	_, err := r.Resolve("ldap://example.org")
+	c.Assert(err, gc.NotNil)
+	_, err = r.Resolve("hkps://")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *DiscoverySuite) TestDoFallback(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, gc.Equals, "/pks/lookup")
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, gc.IsNil)
+	// A listener closed at once, so that connections to it are refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	_, closedPort, err := net.SplitHostPort(l.Addr().String())
+	c.Assert(err, gc.IsNil)
+	l.Close()
+
+	p1, err := strconv.Atoi(closedPort)
+	c.Assert(err, gc.IsNil)
+	p2, err := strconv.Atoi(port)
+	c.Assert(err, gc.IsNil)
+	r := NewResolver(LookupSRV(fakeSRV(map[string][]*net.SRV{
+		"_hkp._tcp.example.org": {
+			{Target: "127.0.0.1.", Port: uint16(p1), Priority: 10},
+			{Target: "127.0.0.1.", Port: uint16(p2), Priority: 20},
+		},
+	})))
+	var tried []string
+	resp, err := r.Do(http.DefaultClient, "hkp://example.org", func(base string) (*http.Request, error) {
+		tried = append(tried, base)
+		return http.NewRequest("GET", base+"/pks/lookup", nil)
+	})
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(tried, gc.HasLen, 2)
+	c.Assert(tried[1], gc.Equals, "http://127.0.0.1:"+port)
+}
@@ -0,0 +1,331 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+// Dry run actions, describing what an add would do with a submitted key.
+const (
+	DryRunInsert    = "insert"
+	DryRunUpdate    = "update"
+	DryRunUnchanged = "unchanged"
+	DryRunRefused   = "refused"
+)
+
+// Dry run packet statuses.
+const (
+	// The packet would be added to the stored key.
+	PacketAdded = "added"
+	// The packet is already part of the stored key.
+	PacketPresent = "present"
+	// The packet would not be stored.
+	PacketStripped = "stripped"
+)
+
+// DryRunPacket describes what an add would do with a submitted packet.
+type DryRunPacket struct {
+	Tag    uint8  `json:"tag"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Served is whether the packet would be included in lookups of the key.
+	Served bool `json:"served"`
+	// Reason explains why the packet would not be stored or served.
+	Reason string `json:"reason,omitempty"`
+}
+
+// DryRunKey describes what an add would do with a submitted key.
+type DryRunKey struct {
+	Fingerprint    string         `json:"fingerprint"`
+	Action         string         `json:"action"`
+	Reason         string         `json:"reason,omitempty"`
+	PreviousDigest string         `json:"previousDigest,omitempty"`
+	Digest         string         `json:"digest,omitempty"`
+	Packets        []DryRunPacket `json:"packets"`
+	// Warnings lints the submitted key for content which would be stored
+	// but which Hockeypuck does not understand.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type DryRunResponse struct {
+	Keys []DryRunKey `json:"keys"`
+}
+
+// DryRun responds to a submission in the same form as Add with a report of
+// what the server would do with each key, without changing storage: which
+// packets would be stored or stripped and why, which would be served, and the
+// resulting digest.
+func (h *Handler) DryRun(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	add, err := ParseAdd(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	armorBlock, err := openpgp.DecodeArmor(bytes.NewBufferString(add.Keytext), h.keyReaderOptions...)
+	if err != nil {
+		readError(w, errors.WithStack(err))
+		return
+	}
+	body, err := ioutil.ReadAll(armorBlock.Body)
+	if err != nil {
+		readError(w, errors.WithStack(err))
+		return
+	}
+
+	// Read the submission as given, and as the key reader policy admits it.
+	submitted, err := openpgp.NewKeyReader(bytes.NewBuffer(body)).Read()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	admitted, err := openpgp.NewKeyReader(bytes.NewBuffer(body), h.keyReaderOptions...).Read()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	admittedByFp := map[string]*openpgp.PrimaryKey{}
+	for _, key := range admitted {
+		admittedByFp[key.Fingerprint()] = key
+	}
+
+	var result DryRunResponse
+	for _, key := range submitted {
+		report, err := h.dryRunKey(key, admittedByFp[key.Fingerprint()])
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		result.Keys = append(result.Keys, *report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(&result)
+}
+
+func (h *Handler) dryRunKey(submitted, admitted *openpgp.PrimaryKey) (*DryRunKey, error) {
+	report := &DryRunKey{
+		Fingerprint: submitted.QualifiedFingerprint(),
+		Warnings:    openpgp.CriticalSubpacketWarnings(submitted),
+	}
+	if admitted == nil {
+		report.Action = DryRunRefused
+		report.Reason = "key is blacklisted or exceeds the maximum key length"
+		for _, p := range submitted.Packets() {
+			report.Packets = append(report.Packets, dryRunPacket(p, PacketStripped, report.Reason))
+		}
+		return report, nil
+	}
+
+	// Packets are identified by their UUID, which is derived from their
+	// contents and those of their parents.
+	admittedCount := map[string]int{}
+	for _, p := range admitted.Packets() {
+		admittedCount[p.UUID]++
+	}
+	err := openpgp.DropDuplicates(admitted)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var lastKey *openpgp.PrimaryKey
+	lastKeys, err := h.storage.FetchKeys([]string{admitted.RFingerprint})
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range lastKeys {
+		if key.RFingerprint == admitted.RFingerprint {
+			lastKey = key
+		}
+	}
+	stored := map[string]bool{}
+	if lastKey != nil {
+		report.PreviousDigest = lastKey.MD5
+		for _, p := range lastKey.Packets() {
+			stored[p.UUID] = true
+		}
+	}
+	// Determine what would be served before the upsert merges into lastKey.
+	served, err := h.dryRunServed(admitted, lastKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	options := append([]storage.UpsertOption{storage.DryRun()}, h.upsertOptions...)
+	var violation *LimitViolation
+	if h.limits != nil {
+		options = append(options, h.checkLimits(&violation))
+	}
+	change, err := storage.UpsertKey(h.storage, admitted, options...)
+	if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) || IsLimitExceeded(err) {
+		report.Action = DryRunRefused
+		report.Reason = err.Error()
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	} else if violation != nil {
+		report.Reason = fmt.Sprintf("exceeds limits enforced after %s: %s",
+			violation.EnforceAfter.UTC().Format(time.RFC3339), violation)
+	}
+	switch change := change.(type) {
+	case storage.KeyAdded:
+		report.Action = DryRunInsert
+		report.Digest = change.Digest
+	case storage.KeyReplaced:
+		report.Action = DryRunUpdate
+		report.Digest = change.NewDigest
+	case storage.KeyNotChanged:
+		report.Action = DryRunUnchanged
+		report.Digest = change.Digest
+	}
+
+	seen := map[string]bool{}
+	for _, p := range submitted.Packets() {
+		var pr DryRunPacket
+		switch {
+		case admittedCount[p.UUID] == 0:
+			pr = dryRunPacket(p, PacketStripped, "exceeds the maximum packet length")
+		case seen[p.UUID]:
+			pr = dryRunPacket(p, PacketStripped, "duplicate packet")
+		case report.Action == DryRunRefused:
+			pr = dryRunPacket(p, PacketStripped, report.Reason)
+		case stored[p.UUID]:
+			pr = dryRunPacket(p, PacketPresent, "")
+		default:
+			pr = dryRunPacket(p, PacketAdded, "")
+		}
+		seen[p.UUID] = true
+		if pr.Status != PacketStripped {
+			pr.Served, pr.Reason = served(p)
+		}
+		report.Packets = append(report.Packets, pr)
+	}
+	return report, nil
+}
+
+// dryRunServed returns a function reporting whether a packet of key would be
+// served once merged with lastKey, if any, and if not, why.
+func (h *Handler) dryRunServed(key, lastKey *openpgp.PrimaryKey) (func(*openpgp.Packet) (bool, string), error) {
+	// Resolve a copy of the key as it would be stored, as lookups do.
+	resolved, err := dryRunMerged(key, lastKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = openpgp.ValidSelfSigned(resolved, h.selfSignedOnly)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	valid := map[string]bool{}
+	for _, p := range resolved.Packets() {
+		valid[p.UUID] = true
+	}
+	filtered, err := h.keyWriter(&Lookup{}).Filter([]*openpgp.PrimaryKey{resolved})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	policy := map[string]bool{}
+	for _, key := range filtered {
+		for _, p := range key.Packets() {
+			policy[p.UUID] = true
+		}
+	}
+	return func(p *openpgp.Packet) (bool, string) {
+		switch {
+		case !valid[p.UUID]:
+			return false, "no valid self-signature"
+		case !policy[p.UUID]:
+			return false, "excluded by serve policy"
+		}
+		return true, ""
+	}, nil
+}
+
+// dryRunMerged returns a copy of key merged with lastKey, if any, leaving
+// both unmodified.
+func dryRunMerged(key, lastKey *openpgp.PrimaryKey) (*openpgp.PrimaryKey, error) {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if lastKey != nil {
+		err = openpgp.WritePackets(&buf, lastKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	keys, err := openpgp.NewKeyReader(&buf).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("failed to read merged key")
+	}
+	result := keys[0]
+	for _, other := range keys[1:] {
+		err = openpgp.Merge(result, other)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
+func dryRunPacket(p *openpgp.Packet, status, reason string) DryRunPacket {
+	return DryRunPacket{
+		Tag:    p.Tag,
+		Type:   packetTypeName(p),
+		Status: status,
+		Reason: reason,
+	}
+}
+
+func packetTypeName(p *openpgp.Packet) string {
+	if !p.Parsed {
+		if p.Malformed {
+			return "malformed"
+		}
+		return "unrecognized"
+	}
+	switch p.Tag {
+	case 2:
+		return "signature"
+	case 6:
+		return "public key"
+	case 13:
+		return "user ID"
+	case 14:
+		return "public subkey"
+	case 17:
+		return "user attribute"
+	}
+	return "unrecognized"
+}
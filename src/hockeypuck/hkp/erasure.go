@@ -0,0 +1,83 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+// ErasureResponse acknowledges an erasure request filed for moderation.
+type ErasureResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Erasure files a request for the user IDs containing an email address, or
+// a whole key, to be erased. Requests are queued for the operator, and take
+// effect once approved.
+func (h *Handler) Erasure(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	es, ok := h.storage.(storage.ErasureStore)
+	if !ok {
+		httpError(w, http.StatusNotFound, errors.New("erasure requests not supported"))
+		return
+	}
+	erasure, err := ParseErasure(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	req := storage.ErasureRequest{
+		Address:     erasure.Address,
+		Fingerprint: erasure.Fingerprint,
+		Reason:      erasure.Reason,
+		Contact:     erasure.Contact,
+		Status:      storage.ErasurePending,
+		Filed:       h.clock.Now(),
+	}
+	err = req.Validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	req.ID, err = h.ids.NewID()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	err = es.FileErasure(req)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":          req.ID,
+		"address":     req.Address,
+		"fingerprint": req.Fingerprint,
+	}).Info("erasure request filed")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&ErasureResponse{ID: req.ID, Status: string(req.Status)})
+}
@@ -19,26 +19,33 @@ package hkp
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
-	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 	xopenpgp "golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/analytics"
+	"hockeypuck/hkp/locale"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
+	"hockeypuck/tracing"
 )
 
 const (
@@ -47,13 +54,106 @@ const (
 	fingerprintKeyIDLen = 40
 )
 
+// continuationHeader is set on segmented key responses to the continuation
+// parameter of the next segment.
+const continuationHeader = "X-HKP-Continuation"
+
+// Headers identifying the subkey by which a key ID lookup found a key, and
+// the state of its binding to the primary key.
+const (
+	matchedSubKeyHeader = "X-HKP-Matched-Subkey"
+	subKeyBindingHeader = "X-HKP-Subkey-Binding"
+)
+
+// Headers of an index response giving the total number of keys matched by
+// the search, and the offset of the next page of them if there is one.
+const (
+	totalResultsHeader = "X-HKP-Total-Results"
+	nextOffsetHeader   = "X-HKP-Next-Offset"
+)
+
+// maxSignerLookups limits the distinct issuers of third-party certifications
+// looked up to resolve their signers for a single request.
+const maxSignerLookups = 100
+
+// maxSearchResults limits the keys matched by a search provider, as the
+// storage backends limit keyword matches, and the keys listed on a page of
+// an index.
+const maxSearchResults = 100
+
 var errKeywordSearchNotAvailable = errors.New("keyword search is not available")
 
+var errKeywordMatchNotAvailable = storage.ErrKeywordMatchNotAvailable
+
+var errFilterSearchNotAvailable = errors.New("search is required to filter keys by their properties")
+
+// Policies for key ID lookups matching more than one key.
+const (
+	// AmbiguousKeyIDsAll serves all matching keys, flagging the ambiguity
+	// in machine-readable and JSON index output.
+	AmbiguousKeyIDsAll = "all"
+	// AmbiguousKeyIDsReject refuses to serve keys for an ambiguous key ID,
+	// so that clients must look them up by fingerprint. Index output lists
+	// all matching keys, as with AmbiguousKeyIDsAll.
+	AmbiguousKeyIDsReject = "reject"
+)
+
 func httpError(w http.ResponseWriter, statusCode int, err error) {
 	if statusCode != http.StatusNotFound {
 		log.Errorf("HTTP %d: %+v", statusCode, err)
 	}
-	http.Error(w, http.StatusText(statusCode), statusCode)
+	loc := responseLocale(w)
+	setContentLanguage(w, loc)
+	http.Error(w, loc.StatusText(statusCode), statusCode)
+}
+
+// readError responds to a failure to read submitted key material, which is
+// either malformed or exceeds the key reader's limits.
+func readError(w http.ResponseWriter, err error) {
+	if openpgp.IsTooLarge(err) {
+		httpError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	httpError(w, http.StatusBadRequest, err)
+}
+
+// httpPolicyError is like httpError, but also explains to the client which
+// policy refused the request.
+func httpPolicyError(w http.ResponseWriter, statusCode int, err error, message string, args ...interface{}) {
+	log.Errorf("HTTP %d: %+v", statusCode, err)
+	loc := responseLocale(w)
+	setContentLanguage(w, loc)
+	http.Error(w, loc.StatusText(statusCode)+": "+loc.Message(message, args...), statusCode)
+}
+
+// localizedResponseWriter carries the locale negotiated for a request to the
+// code formatting its response.
+type localizedResponseWriter struct {
+	http.ResponseWriter
+	locale *locale.Locale
+}
+
+// localize negotiates the locale of each request to handle from its
+// Accept-Language header.
+func localize(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		loc := locale.Negotiate(r.Header.Get("Accept-Language"))
+		handle(&localizedResponseWriter{ResponseWriter: w, locale: loc}, r, ps)
+	}
+}
+
+// responseLocale returns the locale in which to format human-facing text in a
+// response.
+func responseLocale(w http.ResponseWriter) *locale.Locale {
+	if lw, ok := w.(*localizedResponseWriter); ok {
+		return lw.locale
+	}
+	return locale.Default
+}
+
+func setContentLanguage(w http.ResponseWriter, loc *locale.Locale) {
+	w.Header().Set("Content-Language", loc.Tag)
+	w.Header().Add("Vary", "Accept-Language")
 }
 
 type Handler struct {
@@ -65,11 +165,75 @@ type Handler struct {
 	statsTemplate *template.Template
 	statsFunc     func() (interface{}, error)
 
-	selfSignedOnly  bool
-	fingerprintOnly bool
+	selfSignedOnly        bool
+	fingerprintOnly       bool
+	rejectAmbiguousKeyIDs bool
+	resolveSigners        bool
+
+	// defaultMatch combines the words of keyword searches which do not
+	// select how.
+	defaultMatch storage.KeywordMatch
+
+	upsertOptions []storage.UpsertOption
+
+	verifier Verifier
+
+	// hostname identifies this keyserver in verified address exports,
+	// signed by verificationSigner. Exports signed by verificationPeers are
+	// imported, attributed to the hostname verificationPeerNames gives for
+	// the fingerprint of the signer.
+	hostname              string
+	verificationSigner    *xopenpgp.Entity
+	verificationPeers     xopenpgp.EntityList
+	verificationPeerNames map[string]string
+	tokens                *storage.Tokens
+	verificationSender    VerificationSender
+	wkdDomains            map[string]bool
+
+	// pushPeers maps the fingerprints of keys in pushKeyring to the trusted
+	// keyservers they belong to.
+	pushPeers   map[string]*PushPeer
+	pushKeyring xopenpgp.EntityList
+	pushSeen    *replayCache
+
+	// requestSeen remembers the signatures on replace and delete requests
+	// received within maxRequestClockSkew.
+	requestSeen *replayCache
+
+	maxServeLength int
+	maxAddLength   int
+
+	limits *SoftLimits
+
+	challenge       Challenge
+	challengeBypass []string
+
+	submissionFunc func(source string, kc storage.KeyChange, err error)
+
+	localKeys sks.LocalKeys
+
+	analytics *analytics.Analytics
+
+	contentSecurityPolicy string
+
+	attestor *Attestor
+
+	accessTracker *storage.AccessTracker
+	hotList       *storage.HotList
+	fpFilter      *storage.FingerprintFilter
+
+	searchProvider storage.SearchProvider
+
+	exposedMetadata map[string]bool
 
 	keyReaderOptions []openpgp.KeyReaderOption
 	keyWriterOptions []openpgp.KeyWriterOption
+	servePolicy      []openpgp.PolicyOption
+	attestedOnly     bool
+
+	clock    storage.Clock
+	ids      storage.IDGenerator
+	clientIP func(*http.Request) net.IP
 }
 
 type HandlerOption func(h *Handler) error
@@ -98,17 +262,7 @@ func VIndexTemplate(path string, extra ...string) HandlerOption {
 
 func StatsTemplate(path string, extra ...string) HandlerOption {
 	return func(h *Handler) error {
-		t := template.New(filepath.Base(path)).Funcs(template.FuncMap{
-			"url": func(u *url.URL) template.URL {
-				return template.URL(u.String())
-			},
-			"day": func(t time.Time) string {
-				return t.Format("2006-01-02")
-			},
-			"hour": func(t time.Time) string {
-				return t.Format("2006-01-02 15")
-			},
-		})
+		t := template.New(filepath.Base(path)).Funcs(templateFuncs(locale.Default))
 		var err error
 		if len(extra) > 0 {
 			t, err = t.ParseFiles(append([]string{path}, extra...)...)
@@ -144,6 +298,211 @@ func FingerprintOnly(fingerprintOnly bool) HandlerOption {
 	}
 }
 
+// DefaultMatch sets how the words of keyword searches are combined when a
+// lookup does not select it with the match parameter, as named by the values
+// of that parameter.
+func DefaultMatch(match string) HandlerOption {
+	return func(h *Handler) error {
+		m, ok := storage.ParseKeywordMatch(match)
+		if !ok {
+			return errors.Errorf("invalid default match %q", match)
+		}
+		h.defaultMatch = m
+		return nil
+	}
+}
+
+// AmbiguousKeyIDs sets the policy for key ID lookups matching more than one
+// key, which may be a key crafted to collide with another's key ID.
+func AmbiguousKeyIDs(policy string) HandlerOption {
+	return func(h *Handler) error {
+		switch policy {
+		case "", AmbiguousKeyIDsAll:
+			h.rejectAmbiguousKeyIDs = false
+		case AmbiguousKeyIDsReject:
+			h.rejectAmbiguousKeyIDs = true
+		default:
+			return errors.Errorf("invalid ambiguous key ID policy %q", policy)
+		}
+		return nil
+	}
+}
+
+// ResolveSigners identifies the signers of third-party certifications in JSON
+// output, where their keys are in storage and the certifications verify.
+func ResolveSigners(resolveSigners bool) HandlerOption {
+	return func(h *Handler) error {
+		h.resolveSigners = resolveSigners
+		return nil
+	}
+}
+
+// PinnedKeys prevents key submissions from changing the stored version of
+// the given keys. Pinned keys may only be changed by signed replace or delete
+// requests.
+func PinnedKeys(fps []string) HandlerOption {
+	return func(h *Handler) error {
+		h.upsertOptions = append(h.upsertOptions, storage.Pinned(fps))
+		return nil
+	}
+}
+
+// UpsertOptions sets the policy applied when merging submitted keys into
+// storage.
+func UpsertOptions(opts ...storage.UpsertOption) HandlerOption {
+	return func(h *Handler) error {
+		h.upsertOptions = append(h.upsertOptions, opts...)
+		return nil
+	}
+}
+
+// AttestedCertificationsOnly omits the third-party certifications which the
+// owner of a key has not approved in an attestation key signature from the
+// keys served and indexed.
+func AttestedCertificationsOnly() HandlerOption {
+	return func(h *Handler) error {
+		h.attestedOnly = true
+		h.servePolicy = append(h.servePolicy, openpgp.OmitUnattestedCertifications())
+		return nil
+	}
+}
+
+// Clock sets the clock used for the times recorded and checked by the
+// handler, including those of keys it stores.
+func Clock(clock storage.Clock) HandlerOption {
+	return func(h *Handler) error {
+		h.clock = clock
+		return nil
+	}
+}
+
+// IDs sets the generator of the IDs of erasure requests filed with the
+// handler.
+func IDs(ids storage.IDGenerator) HandlerOption {
+	return func(h *Handler) error {
+		h.ids = ids
+		return nil
+	}
+}
+
+// ClientIP sets how the address of the client making a request is found,
+// such as from the X-Forwarded-For header of requests from trusted reverse
+// proxies. By default it is the remote address of the connection.
+func ClientIP(f func(*http.Request) net.IP) HandlerOption {
+	return func(h *Handler) error {
+		h.clientIP = f
+		return nil
+	}
+}
+
+// RemoteIP returns the remote address of the connection on which a request
+// was received.
+func RemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// UserIDVerifier sets the source of user ID verification state reported in
+// machine-readable and JSON index results.
+func UserIDVerifier(v Verifier) HandlerOption {
+	return func(h *Handler) error {
+		h.verifier = v
+		return nil
+	}
+}
+
+// MaxServeLength sets the length of key material above which a key is served
+// in segments. Clients retrieve each following segment by repeating the
+// request with the continuation parameter given in the response.
+func MaxServeLength(n int) HandlerOption {
+	return func(h *Handler) error {
+		h.maxServeLength = n
+		return nil
+	}
+}
+
+// MaxAddLength limits the length of a key submission request to /pks/add,
+// /pks/replace, /pks/revoke or /vks/v1/upload. Longer requests are refused
+// with 413 Request Entity Too Large before they are parsed.
+func MaxAddLength(n int) HandlerOption {
+	return func(h *Handler) error {
+		h.maxAddLength = n
+		return nil
+	}
+}
+
+// SubmissionFunc sets a function called with the outcome of each key
+// submitted to this handler, for per-source statistics.
+func SubmissionFunc(f func(source string, kc storage.KeyChange, err error)) HandlerOption {
+	return func(h *Handler) error {
+		h.submissionFunc = f
+		return nil
+	}
+}
+
+// LocalOnly prevents the given keys from being served in response to
+// hashqueries, which are only made by recon partners.
+func LocalOnly(lk sks.LocalKeys) HandlerOption {
+	return func(h *Handler) error {
+		h.localKeys = lk
+		return nil
+	}
+}
+
+// SearchAnalytics records aggregate statistics of lookups.
+func SearchAnalytics(a *analytics.Analytics) HandlerOption {
+	return func(h *Handler) error {
+		h.analytics = a
+		return nil
+	}
+}
+
+// ContentSecurityPolicy sets the Content-Security-Policy header sent with
+// lookup responses, which may render attacker-controlled key material.
+func ContentSecurityPolicy(policy string) HandlerOption {
+	return func(h *Handler) error {
+		h.contentSecurityPolicy = policy
+		return nil
+	}
+}
+
+// Attestations publishes signed attestations of the server's state at
+// /pks/attestation.
+func Attestations(a *Attestor) HandlerOption {
+	return func(h *Handler) error {
+		h.attestor = a
+		return nil
+	}
+}
+
+// AccessTracking records the keys fetched by lookups with the given tracker.
+func AccessTracking(t *storage.AccessTracker) HandlerOption {
+	return func(h *Handler) error {
+		h.accessTracker = t
+		return nil
+	}
+}
+
+// HotKeys counts the keys fetched by lookups in l.
+func HotKeys(l *storage.HotList) HandlerOption {
+	return func(h *Handler) error {
+		h.hotList = l
+		return nil
+	}
+}
+
+// FingerprintFilter answers lookups by fingerprint for keys which f reports
+// as not stored without querying storage.
+func FingerprintFilter(f *storage.FingerprintFilter) HandlerOption {
+	return func(h *Handler) error {
+		h.fpFilter = f
+		return nil
+	}
+}
+
 func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
 	return func(h *Handler) error {
 		h.keyReaderOptions = opts
@@ -158,9 +517,48 @@ func KeyWriterOptions(opts []openpgp.KeyWriterOption) HandlerOption {
 	}
 }
 
-func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
+// SearchProvider performs keyword searches with an external search index
+// rather than the storage backend.
+func SearchProvider(sp storage.SearchProvider) HandlerOption {
+	return func(h *Handler) error {
+		h.searchProvider = sp
+		return nil
+	}
+}
+
+// ExposeMetadata includes key metadata in the given namespaces in JSON
+// output, if supported by storage.
+func ExposeMetadata(namespaces []string) HandlerOption {
+	return func(h *Handler) error {
+		if len(namespaces) == 0 {
+			return nil
+		}
+		if _, ok := h.storage.(storage.MetadataStore); !ok {
+			return errors.New("storage does not support key metadata")
+		}
+		h.exposedMetadata = map[string]bool{}
+		for _, ns := range namespaces {
+			h.exposedMetadata[ns] = true
+		}
+		return nil
+	}
+}
+
+// ServePolicy applies a policy to the packets of keys served.
+func ServePolicy(opts ...openpgp.PolicyOption) HandlerOption {
+	return func(h *Handler) error {
+		h.servePolicy = append(h.servePolicy, opts...)
+		return nil
+	}
+}
+
+func NewHandler(st storage.Storage, options ...HandlerOption) (*Handler, error) {
 	h := &Handler{
-		storage: storage,
+		storage:     st,
+		clock:       storage.SystemClock,
+		ids:         storage.RandomIDs,
+		clientIP:    RemoteIP,
+		requestSeen: newReplayCache(),
 	}
 	for _, option := range options {
 		err := option(h)
@@ -168,23 +566,47 @@ func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, er
 			return nil, errors.WithStack(err)
 		}
 	}
+	h.upsertOptions = append(h.upsertOptions, storage.UpsertClock(h.clock))
 	return h, nil
 }
 
 func (h *Handler) Register(r *httprouter.Router) {
-	r.GET("/pks/lookup", h.Lookup)
-	r.POST("/pks/add", h.Add)
-	r.POST("/pks/replace", h.Replace)
-	r.POST("/pks/delete", h.Delete)
-	r.POST("/pks/hashquery", h.HashQuery)
+	r.GET("/pks/lookup", localize(h.Lookup))
+	r.HEAD("/pks/lookup", localize(h.LookupHead))
+	r.POST("/pks/add", localize(h.Add))
+	r.POST("/pks/dryrun", localize(h.DryRun))
+	r.POST("/pks/replace", localize(h.Replace))
+	r.POST("/pks/delete", localize(h.Delete))
+	r.DELETE("/pks/delete", localize(h.Delete))
+	r.POST("/pks/revoke", localize(h.Revoke))
+	r.POST("/pks/hashquery", localize(h.HashQuery))
+	r.POST("/pks/erasure", localize(h.Erasure))
+	r.GET("/pks/attestation", localize(h.Attestation))
+	r.GET("/key/:fpr", localize(h.KeyByFingerprint))
+	r.GET("/email/:addr", localize(h.KeyByEmail))
+	r.GET("/pks/verified", localize(h.ExportVerified))
+	r.POST("/pks/verified", localize(h.ImportVerified))
+	r.GET("/pks/verify", localize(h.VerifyForm))
+	r.POST("/pks/verify", localize(h.Verify))
+	r.POST("/pks/push", localize(h.Push))
+	r.GET("/.well-known/openpgpkey/*path", localize(h.WKD))
+	r.GET("/vks/v1/by-fingerprint/:fpr", localize(h.VKSByFingerprint))
+	r.GET("/vks/v1/by-keyid/:keyid", localize(h.VKSByKeyID))
+	r.GET("/vks/v1/by-email/:addr", localize(h.VKSByEmail))
+	r.POST("/vks/v1/upload", localize(h.VKSUpload))
+	r.POST("/vks/v1/request-verify", localize(h.VKSRequestVerify))
 }
 
 func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	l, err := ParseLookup(r)
+	l, err := h.parseLookup(r)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, err)
 		return
 	}
+	if h.analytics != nil {
+		h.analytics.Record(string(l.Op), l.Search)
+	}
+	h.setSecurityHeaders(w)
 	switch l.Op {
 	case OperationGet, OperationHGet:
 		h.get(w, l)
@@ -200,6 +622,107 @@ func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 	}
 }
 
+// parseLookup parses a lookup request, combining the words of a keyword
+// search by the default match if it does not select one.
+func (h *Handler) parseLookup(r *http.Request) (*Lookup, error) {
+	l, err := ParseLookup(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Form.Get("match") == "" && h.defaultMatch != "" {
+		l.Match = h.defaultMatch
+	}
+	return l, nil
+}
+
+// LookupHead responds to a HEAD request with the status and headers of the
+// response to the same GET request. Keys to be served are looked up for
+// their validators and segments, and index lookups for their totals, but
+// nothing is rendered, so the length of the body is left out. Other
+// operations are not supported.
+func (h *Handler) LookupHead(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	l, err := h.parseLookup(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.setSecurityHeaders(w)
+	var ok bool
+	switch l.Op {
+	case OperationGet, OperationHGet:
+		_, ok = h.getHeaders(w, l)
+	case OperationIndex, OperationVIndex:
+		_, ok = h.indexHeaders(w, l)
+	default:
+		w.Header().Set("Allow", "GET")
+		httpError(w, http.StatusMethodNotAllowed, errors.Errorf("operation not supported by HEAD: %v", l.Op))
+		return
+	}
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// notModified sets the validators of a response serving keys, and responds
+// with 304 Not Modified if the lookup's preconditions show that the client
+// already has them. The modification time is read only from storage which
+// can do so without fetching the keys again.
+func (h *Handler) notModified(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) bool {
+	digests := make([]string, len(keys))
+	for i, key := range keys {
+		digests[i] = key.MD5
+	}
+	etag := keyringsETag(digests)
+	w.Header().Set("ETag", etag)
+
+	var lastModified time.Time
+	if mtr, ok := h.storage.(storage.ModTimeReader); ok {
+		rfps := make([]string, len(keys))
+		for i, key := range keys {
+			rfps[i] = key.RFingerprint
+		}
+		mtimes, err := mtr.ModTimes(rfps)
+		if err != nil {
+			log.Warningf("failed to read key modification times: %v", err)
+		}
+		for _, mtime := range mtimes {
+			if mtime.After(lastModified) {
+				lastModified = mtime
+			}
+		}
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if !l.Conditions.NotModified(etag, lastModified) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// keyringsETag returns an entity tag derived from the digests of a set of
+// keys. A single key is identified by its own digest.
+func keyringsETag(digests []string) string {
+	if len(digests) == 1 {
+		return `"` + digests[0] + `"`
+	}
+	sort.Strings(digests)
+	h := md5.New()
+	for _, digest := range digests {
+		h.Write([]byte(digest))
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+func (h *Handler) setSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if h.contentSecurityPolicy != "" {
+		w.Header().Set("Content-Security-Policy", h.contentSecurityPolicy)
+	}
+}
+
 func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	hq, err := ParseHashQuery(r)
 	if err != nil {
@@ -218,7 +741,16 @@ func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter
 			log.Errorf("error fetching hashquery key %q", digest)
 			continue
 		}
-		result = append(result, keys...)
+		for _, key := range keys {
+			if !h.localKeys.Contains(key.Fingerprint()) {
+				result = append(result, key)
+			}
+		}
+	}
+
+	if hq.SizesOnly {
+		h.hashQuerySizes(w, result)
+		return
 	}
 
 	w.Header().Set("Content-Type", "pgp/keys")
@@ -262,73 +794,404 @@ func writeHashqueryKey(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
 	return nil
 }
 
-func (h *Handler) resolve(l *Lookup) ([]string, error) {
-	if l.Op == OperationHGet {
-		return h.storage.MatchMD5([]string{l.Search})
+// hashQuerySizes writes the digest and serialized length of each key in a
+// hashquery result, using the same framing as a regular hashquery response.
+func (h *Handler) hashQuerySizes(w http.ResponseWriter, keys []*openpgp.PrimaryKey) {
+	w.Header().Set("Content-Type", "sks/hashquery-sizes")
+
+	err := recon.WriteInt(w, len(keys))
+	if err != nil {
+		log.Errorf("error writing hashquery sizes count: %v", err)
+		return
 	}
-	if strings.HasPrefix(l.Search, "0x") {
-		keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
-		switch len(keyID) {
-		case shortKeyIDLen, longKeyIDLen, fingerprintKeyIDLen:
-			return h.storage.Resolve([]string{keyID})
+	for _, key := range keys {
+		err = writeHashquerySize(w, key)
+		if err != nil {
+			log.Errorf("error writing hashquery size %q: %v", key.RFingerprint, err)
+			return
 		}
 	}
-	if h.fingerprintOnly {
-		return nil, errKeywordSearchNotAvailable
+
+	_, err = w.Write([]byte{0x0d, 0x0a})
+	if err != nil {
+		log.Errorf("error writing hashquery terminator: %v", err)
 	}
-	return h.storage.MatchKeyword([]string{l.Search})
 }
 
-func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
-	rfps, err := h.resolve(l)
+func writeHashquerySize(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
+	digest, err := hex.DecodeString(key.MD5)
 	if err != nil {
-		return nil, err
+		return errors.Wrapf(err, "invalid digest %q", key.MD5)
 	}
-	keys, err := h.storage.FetchKeys(rfps)
+	var buf bytes.Buffer
+	err = openpgp.WritePackets(&buf, key)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
-	for _, key := range keys {
-		if err := openpgp.ValidSelfSigned(key, h.selfSignedOnly); err != nil {
-			return nil, errors.WithStack(err)
-		}
-		log.WithFields(log.Fields{
-			"fp":     key.Fingerprint(),
-			"length": key.Length,
-			"op":     l.Op,
-		}).Info("lookup")
+	err = recon.WriteInt(w, len(digest))
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	return keys, nil
+	_, err = w.Write(digest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(recon.WriteInt(w, buf.Len()))
 }
 
-func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
-	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
-		return
-	} else if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
-		return
+// resolve returns the reversed fingerprints of the keys matching a lookup.
+func (h *Handler) resolve(l *Lookup) ([]string, error) {
+	span := traceStorage(l, "storage.Resolve")
+	rfps, err := h.resolveLookup(l)
+	span.SetAttributes(tracing.Int("keys", len(rfps)))
+	span.SetError(err)
+	span.Finish()
+	return rfps, err
+}
+
+func (h *Handler) resolveLookup(l *Lookup) ([]string, error) {
+	if l.Op == OperationHGet {
+		return h.storage.MatchMD5([]string{l.Search})
 	}
-	if len(keys) == 0 {
-		httpError(w, http.StatusNotFound, errors.New("not found"))
-		return
+	if keyID, ok := lookupKeyID(l); ok {
+		if len(keyID) == fingerprintKeyIDLen && h.fpFilter != nil && !h.fpFilter.MayContain(keyID) {
+			return nil, nil
+		}
+		return h.storage.Resolve([]string{keyID})
+	}
+	if h.fingerprintOnly {
+		return nil, errKeywordSearchNotAvailable
+	}
+	if l.Match != "" && l.Match != storage.MatchAllWords {
+		matcher, ok := h.storage.(storage.KeywordMatcher)
+		if !ok {
+			return nil, errKeywordMatchNotAvailable
+		}
+		return matcher.MatchKeywords([]string{l.Search}, l.Match)
+	}
+	if h.searchProvider != nil {
+		rfps, err := h.searchProvider.Search(l.Search, maxSearchResults)
+		if err == nil {
+			return rfps, nil
+		}
+		log.Warningf("search provider failed, falling back to storage: %v", err)
+	}
+	return h.storage.MatchKeyword([]string{l.Search})
+}
+
+// traceStorage starts a span timing a storage query made for a lookup. The
+// span is nil if tracing is disabled.
+func traceStorage(l *Lookup, name string) *tracing.Span {
+	_, span := tracing.Start(l.ctx, name, tracing.KindInternal, tracing.String("hkp.op", string(l.Op)))
+	return span
+}
+
+// lookupKeyID returns the reversed key ID or fingerprint searched for by a
+// lookup, if it is a key ID lookup.
+func lookupKeyID(l *Lookup) (string, bool) {
+	if l.Op == OperationHGet || !strings.HasPrefix(l.Search, "0x") {
+		return "", false
 	}
+	keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
+	switch len(keyID) {
+	case shortKeyIDLen, longKeyIDLen, fingerprintKeyIDLen:
+		return keyID, true
+	}
+	return "", false
+}
 
-	// Drop malformed packets, since these break GPG imports.
-	for _, key := range keys {
-		var others []*openpgp.Packet
-		for _, other := range key.Others {
-			if other.Malformed {
-				continue
+// lookupMatch returns whether a key found in storage for a lookup is
+// confirmed to match it: exactly, if it is an exact lookup, by an address in
+// the domain searched for, and by the lookup's filter.
+func lookupMatch(l *Lookup, key *openpgp.PrimaryKey) bool {
+	if l.Domain != "" {
+		// Domain searches are always exact.
+		if !inDomain(key, l.Domain) {
+			return false
+		}
+	} else if l.Exact && !exactMatch(l, key) {
+		return false
+	}
+	return l.Filter.Match(key)
+}
+
+// inDomain returns whether a key has a user ID with an email address in a
+// domain.
+func inDomain(key *openpgp.PrimaryKey, domain string) bool {
+	for _, uid := range key.UserIDs {
+		if strings.HasSuffix(storage.UserIDAddress(uid.Keywords), "@"+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// exactMatch returns whether a key matches an exact lookup. Key IDs and
+// fingerprints must be those of the primary key or a subkey in full, rather
+// than a prefix of the reversed fingerprint as storage resolves them, and a
+// keyword search must be the whole of a user ID or its address, ignoring
+// case.
+func exactMatch(l *Lookup, key *openpgp.PrimaryKey) bool {
+	if l.Op == OperationHGet {
+		return strings.EqualFold(key.MD5, l.Search)
+	}
+	if keyID, ok := lookupKeyID(l); ok {
+		id := openpgp.Reverse(keyID)
+		if strings.HasSuffix(key.Fingerprint(), id) {
+			return true
+		}
+		for _, subKey := range key.SubKeys {
+			if strings.HasSuffix(subKey.Fingerprint(), id) {
+				return true
 			}
-			others = append(others, other)
 		}
-		key.Others = others
+		return false
 	}
+	search := strings.ToLower(strings.TrimSpace(l.Search))
+	for _, uid := range key.UserIDs {
+		if strings.ToLower(uid.Keywords) == search {
+			return true
+		}
+		if addr := storage.UserIDAddress(uid.Keywords); addr != "" && addr == strings.Trim(search, "<>") {
+			return true
+		}
+	}
+	return false
+}
 
-	w.Header().Set("Content-Type", "text/plain")
-	err = openpgp.WriteArmoredPackets(w, keys, h.keyWriterOptions...)
+// matchedSubKey returns the subkey of key by which a key ID lookup found it,
+// or nil if it was found otherwise.
+func matchedSubKey(l *Lookup, key *openpgp.PrimaryKey) *openpgp.SubKey {
+	keyID, ok := lookupKeyID(l)
+	if !ok {
+		return nil
+	}
+	return openpgp.MatchSubKey(key, keyID)
+}
+
+// isKeyIDSearch returns whether a lookup is for a short or long key ID.
+func isKeyIDSearch(l *Lookup) bool {
+	if l.Op == OperationHGet || !strings.HasPrefix(l.Search, "0x") {
+		return false
+	}
+	n := len(l.Search) - 2
+	return n == shortKeyIDLen || n == longKeyIDLen
+}
+
+// isAmbiguous returns whether a key ID lookup matched more than one key.
+func isAmbiguous(l *Lookup, keys []*openpgp.PrimaryKey) bool {
+	return isKeyIDSearch(l) && len(keys) > 1
+}
+
+// keys returns the keys matching a lookup, in the order it asks for.
+func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := h.resolve(l)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := h.fetchKeys(l, rfps)
+	if err != nil {
+		return nil, err
+	}
+	h.orderKeys(l, keys)
+	return keys, nil
+}
+
+// orderKeys sorts keys into the order a lookup asks for, other than by
+// relevance, which is the order in which storage found them. Keys are
+// ordered by modification time only with storage which can read it.
+func (h *Handler) orderKeys(l *Lookup, keys []*openpgp.PrimaryKey) {
+	switch l.Order {
+	case storage.OrderCreated:
+		sort.SliceStable(keys, func(i, j int) bool {
+			return keys[i].Creation.After(keys[j].Creation)
+		})
+	case storage.OrderModified:
+		mtr, ok := h.storage.(storage.ModTimeReader)
+		if !ok {
+			return
+		}
+		rfps := make([]string, len(keys))
+		for i, key := range keys {
+			rfps[i] = key.RFingerprint
+		}
+		mtimes, err := mtr.ModTimes(rfps)
+		if err != nil {
+			log.Warningf("failed to read key modification times: %v", err)
+			return
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return mtimes[keys[i].RFingerprint].After(mtimes[keys[j].RFingerprint])
+		})
+	}
+}
+
+// keywordPager returns the storage which pages through the matches of an
+// index lookup, if it does.
+func (h *Handler) keywordPager(l *Lookup) (storage.KeywordPager, bool) {
+	if _, isKeyID := lookupKeyID(l); isKeyID || h.fingerprintOnly || h.searchProvider != nil {
+		return nil, false
+	}
+	pager, ok := h.storage.(storage.KeywordPager)
+	return pager, ok
+}
+
+// pageLimit returns the number of keys listed on a page of an index.
+func pageLimit(l *Lookup) int {
+	if l.Limit == 0 || l.Limit > maxSearchResults {
+		return maxSearchResults
+	}
+	return l.Limit
+}
+
+// pageBounds returns the bounds of the page of n matches selected by a
+// lookup.
+func pageBounds(l *Lookup, n int) (start, end int) {
+	if l.Offset >= n {
+		return n, n
+	}
+	end = l.Offset + pageLimit(l)
+	if end > n {
+		end = n
+	}
+	return l.Offset, end
+}
+
+// indexKeys returns the page of keys listed by an index lookup, and the
+// total number of keys matched. Keyword searches are paged and ordered by
+// storage if it can. Otherwise, and for exact matches, the first matches of
+// a search are paged once they are known, and fetched in full first if they
+// are to be put in another order.
+func (h *Handler) indexKeys(l *Lookup) ([]*openpgp.PrimaryKey, int, error) {
+	if l.Filter != nil {
+		return h.filteredKeys(l)
+	}
+	if pager, ok := h.keywordPager(l); ok && !l.Exact {
+		span := traceStorage(l, "storage.MatchKeywordPage")
+		rfps, total, err := pager.MatchKeywordPage(l.Search, l.Match, l.Order, pageLimit(l), l.Offset)
+		span.SetAttributes(tracing.Int("keys", len(rfps)), tracing.Int("total", total))
+		span.SetError(err)
+		span.Finish()
+		if err != nil || len(rfps) == 0 {
+			return nil, total, err
+		}
+		keys, err := h.fetchKeys(l, rfps)
+		return keys, total, err
+	}
+	if l.Exact || l.Order != storage.OrderRelevance {
+		keys, err := h.keys(l)
+		if err != nil {
+			return nil, 0, err
+		}
+		start, end := pageBounds(l, len(keys))
+		return keys[start:end], len(keys), nil
+	}
+	rfps, err := h.resolve(l)
+	if err != nil {
+		return nil, 0, err
+	}
+	start, end := pageBounds(l, len(rfps))
+	if start == end {
+		return nil, len(rfps), nil
+	}
+	keys, err := h.fetchKeys(l, rfps[start:end])
+	return keys, len(rfps), err
+}
+
+// filteredKeys returns the page of keys listed by an index lookup which
+// selects keys by their properties, and the total number selected. Storage
+// which can search by key properties pages through them; otherwise the
+// filter is applied to the first matches of the search, which is required.
+func (h *Handler) filteredKeys(l *Lookup) ([]*openpgp.PrimaryKey, int, error) {
+	_, isKeyID := lookupKeyID(l)
+	if h.fingerprintOnly && !isKeyID {
+		return nil, 0, errKeywordSearchNotAvailable
+	}
+	if kf, ok := h.storage.(storage.KeyFilterer); ok && !isKeyID && !l.Exact && h.searchProvider == nil {
+		span := traceStorage(l, "storage.MatchFiltered")
+		rfps, total, err := kf.MatchFiltered(l.Search, l.Match, l.Filter, l.Order, pageLimit(l), l.Offset)
+		span.SetAttributes(tracing.Int("keys", len(rfps)), tracing.Int("total", total))
+		span.SetError(err)
+		span.Finish()
+		if err == nil {
+			if len(rfps) == 0 {
+				return nil, total, nil
+			}
+			keys, err := h.fetchKeys(l, rfps)
+			return keys, total, err
+		} else if errors.Cause(err) != storage.ErrFilterNotAvailable {
+			return nil, 0, err
+		}
+	}
+	if l.Search == "" {
+		return nil, 0, errFilterSearchNotAvailable
+	}
+	keys, err := h.keys(l)
+	if err != nil {
+		return nil, 0, err
+	}
+	start, end := pageBounds(l, len(keys))
+	return keys[start:end], len(keys), nil
+}
+
+func (h *Handler) fetchKeys(l *Lookup, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	span := traceStorage(l, "storage.FetchKeys")
+	keys, err := h.storage.FetchKeys(rfps)
+	span.SetAttributes(tracing.Int("keys", len(keys)))
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Keys are kept in the order in which they were found.
+	pos := make(map[string]int, len(rfps))
+	for i := len(rfps) - 1; i >= 0; i-- {
+		pos[rfps[i]] = i
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return pos[keys[i].RFingerprint] < pos[keys[j].RFingerprint]
+	})
+	if l.Exact || l.Domain != "" || l.Filter != nil {
+		var matched []*openpgp.PrimaryKey
+		for _, key := range keys {
+			if lookupMatch(l, key) {
+				matched = append(matched, key)
+			}
+		}
+		keys = matched
+	}
+	if h.accessTracker != nil {
+		h.accessTracker.Record(rfps)
+	}
+	if h.hotList != nil {
+		h.hotList.Record(rfps)
+	}
+	if isKeyIDSearch(l) {
+		// Keys matching the same key ID are always given in the same
+		// order, whatever order storage returns them in.
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Fingerprint() < keys[j].Fingerprint()
+		})
+	}
+	for _, key := range keys {
+		if err := openpgp.ValidSelfSigned(key, h.selfSignedOnly); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{
+			"fp":     key.Fingerprint(),
+			"length": key.Length,
+			"op":     l.Op,
+		}).Info("lookup")
+	}
+	return keys, nil
+}
+
+func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
+	keys, ok := h.getHeaders(w, l)
+	if !ok {
+		return
+	}
+	err := h.keyWriter(l).WriteArmored(w, keys, h.keyWriterOptions...)
 	if err != nil {
 		log.Errorf("get %q: error writing armored keys: %v", l.Search, err)
 	}
@@ -340,24 +1203,109 @@ func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
 	}
 }
 
-func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
+// getHeaders looks up the keys to be served for a get request and sets the
+// headers of the response serving them, shared by GET and HEAD. If there is
+// nothing to serve, an error response is written and ok is false.
+func (h *Handler) getHeaders(w http.ResponseWriter, l *Lookup) (_ []*openpgp.PrimaryKey, ok bool) {
+	keys, ok := h.servedKeys(w, l, nil)
+	if !ok {
+		return nil, false
+	}
+	if len(keys) == 1 {
+		if subKey := matchedSubKey(l, keys[0]); subKey != nil {
+			w.Header().Set(matchedSubKeyHeader, strings.ToUpper(subKey.Fingerprint()))
+			w.Header().Set(subKeyBindingHeader, subKey.BindingStatus(keys[0]))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	return keys, true
+}
+
+// keyWriter returns a KeyWriter applying the serve policy and the options of
+// the request.
+func (h *Handler) keyWriter(l *Lookup) *openpgp.KeyWriter {
+	// Always drop malformed packets, since these break GPG imports.
+	policy := append([]openpgp.PolicyOption{openpgp.DropMalformed()}, h.servePolicy...)
+	if l.Options[OptionPrimaryOnly] {
+		policy = append(policy, openpgp.Minimal())
+	}
+	if keyID, ok := lookupKeyID(l); ok && l.Options[OptionSubKeyOnly] {
+		policy = append(policy, openpgp.MatchedSubKey(keyID))
+	}
+	return openpgp.NewKeyWriter(policy...)
+}
+
+// servedKeys looks up the keys to be served for a get request, keeping only
+// those accepted by match if it is not nil, and splits them for output. If
+// there is nothing to serve, an error response is written and ok is false.
+func (h *Handler) servedKeys(w http.ResponseWriter, l *Lookup, match func(*openpgp.PrimaryKey) bool) (_ []*openpgp.PrimaryKey, ok bool) {
 	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
+	if err == errKeywordSearchNotAvailable || err == errKeywordMatchNotAvailable {
 		httpError(w, http.StatusBadRequest, errors.WithStack(err))
-		return
+		return nil, false
 	} else if err != nil {
 		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
-		return
+		return nil, false
+	}
+	if match != nil {
+		var matched []*openpgp.PrimaryKey
+		for _, key := range keys {
+			if match(key) {
+				matched = append(matched, key)
+			}
+		}
+		keys = matched
 	}
 	if len(keys) == 0 {
 		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return nil, false
+	}
+	if h.rejectAmbiguousKeyIDs && isAmbiguous(l, keys) {
+		httpPolicyError(w, http.StatusConflict, errors.Errorf("key ID %q matches %d keys", l.Search, len(keys)),
+			locale.MessageAmbiguousKeyID, l.Search, len(keys))
+		return nil, false
+	}
+	if l.Conditions != nil && h.notModified(w, l, keys) {
+		return nil, false
+	}
+
+	if h.maxServeLength > 0 && len(keys) == 1 {
+		segments := openpgp.SplitKey(keys[0], h.maxServeLength)
+		if l.Continuation >= len(segments) {
+			httpError(w, http.StatusNotFound, errors.New("not found"))
+			return nil, false
+		}
+		keys = segments[l.Continuation : l.Continuation+1]
+		if next := l.Continuation + 1; next < len(segments) {
+			w.Header().Set(continuationHeader, strconv.Itoa(next))
+		}
+	} else if l.Continuation > 0 {
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return nil, false
+	}
+	return keys, true
+}
+
+func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
+	keys, ok := h.indexHeaders(w, l)
+	if !ok {
 		return
 	}
+	var err error
+	if h.attestedOnly {
+		// Keys stored before certifications were stripped may still have
+		// them.
+		keys, err = openpgp.NewKeyWriter(openpgp.OmitUnattestedCertifications()).Filter(keys)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+	}
 
 	if l.Options[OptionMachineReadable] {
-		f = mrFormat
+		f = &MRFormat{verifier: h.verifier}
 	} else if l.Options[OptionJSON] || f == nil {
-		f = jsonFormat
+		f = h.jsonFormat()
 	}
 
 	err = f.Write(w, l, keys)
@@ -367,6 +1315,141 @@ func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
 	}
 }
 
+// indexHeaders looks up the page of keys listed by an index request and sets
+// the headers of the response listing them, shared by GET and HEAD. If there
+// is nothing to list, an error response is written and ok is false.
+func (h *Handler) indexHeaders(w http.ResponseWriter, l *Lookup) (_ []*openpgp.PrimaryKey, ok bool) {
+	keys, total, err := h.indexKeys(l)
+	if err == errKeywordSearchNotAvailable || err == errKeywordMatchNotAvailable || err == errFilterSearchNotAvailable {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return nil, false
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return nil, false
+	}
+	w.Header().Set(totalResultsHeader, strconv.Itoa(total))
+	if next := l.Offset + pageLimit(l); next < total {
+		w.Header().Set(nextOffsetHeader, strconv.Itoa(next))
+	}
+	if len(keys) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return nil, false
+	}
+	return keys, true
+}
+
+func (h *Handler) jsonFormat() *JSONFormat {
+	f := &JSONFormat{verifier: h.verifier}
+	if len(h.exposedMetadata) > 0 {
+		f.metadata = h.metadata
+	}
+	if h.resolveSigners {
+		f.signers = h.signers
+	}
+	return f
+}
+
+// signers returns the fingerprints of the signers of the third-party user ID
+// certifications on keys, where the signer's key is in storage and the
+// certification verifies with it.
+func (h *Handler) signers(keys []*openpgp.PrimaryKey) map[*openpgp.Signature]string {
+	result := map[*openpgp.Signature]string{}
+	candidates := map[string][]*openpgp.PrimaryKey{}
+	for _, key := range keys {
+		for _, uid := range key.UserIDs {
+			_, others := uid.SigInfo(key)
+			for _, sig := range others {
+				// Prefer the issuer fingerprint, which unlike the key ID
+				// cannot be made to collide with another key's.
+				id := openpgp.IssuerID(sig)
+				signers, ok := candidates[id]
+				if !ok {
+					if len(candidates) >= maxSignerLookups {
+						continue
+					}
+					var err error
+					signers, err = h.signerKeys(id)
+					if err != nil {
+						log.Warningf("failed to look up signer %q: %v", openpgp.Reverse(id), err)
+					}
+					candidates[id] = signers
+				}
+				for _, signer := range signers {
+					if openpgp.VerifyUserIDCertification(signer, key, uid, sig) == nil {
+						result[sig] = signer.Fingerprint()
+						break
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (h *Handler) signerKeys(rkeyID string) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := h.storage.Resolve([]string{rkeyID})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(rfps) == 0 {
+		return nil, nil
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return keys, nil
+}
+
+// storedKeys returns the stored versions of keys. Keys which are not stored
+// are left out.
+func (h *Handler) storedKeys(keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, error) {
+	var rfps []string
+	wanted := map[string]bool{}
+	for _, key := range keys {
+		rfps = append(rfps, key.RFingerprint)
+		wanted[key.RFingerprint] = true
+	}
+	stored, err := h.storage.FetchKeys(rfps)
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, errors.WithStack(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range stored {
+		if wanted[key.RFingerprint] {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// metadata returns the exposed metadata of keys, by RFingerprint. Metadata is
+// omitted if it cannot be read, rather than failing the lookup.
+func (h *Handler) metadata(keys []*openpgp.PrimaryKey) map[string]map[string]string {
+	var rfps []string
+	for _, key := range keys {
+		rfps = append(rfps, key.RFingerprint)
+	}
+	all, err := h.storage.(storage.MetadataStore).Metadata(rfps)
+	if err != nil {
+		log.Warningf("failed to read key metadata: %v", err)
+		return nil
+	}
+	result := map[string]map[string]string{}
+	for rfp, metadata := range all {
+		for name, value := range metadata {
+			if !h.exposedMetadata[storage.MetadataNamespace(name)] {
+				continue
+			}
+			if result[rfp] == nil {
+				result[rfp] = map[string]string{}
+			}
+			result[rfp][name] = value
+		}
+	}
+	return result
+}
+
 func (h *Handler) indexJSON(w http.ResponseWriter, keys []*openpgp.PrimaryKey) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -377,13 +1460,6 @@ func (h *Handler) indexJSON(w http.ResponseWriter, keys []*openpgp.PrimaryKey) {
 	}
 }
 
-func mrTimeString(t time.Time) string {
-	if t.IsZero() {
-		return ""
-	}
-	return fmt.Sprintf("%d", t.Unix())
-}
-
 type StatsResponse struct {
 	Info  interface{}
 	Stats *sks.Stats
@@ -402,8 +1478,10 @@ func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
 	}
 
 	if h.statsTemplate != nil && !(l.Options[OptionJSON] || l.Options[OptionMachineReadable]) {
-		err = h.statsTemplate.Execute(w, data)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = executeLocalized(w, h.statsTemplate, data)
 	} else {
+		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(data)
 	}
 	if err != nil {
@@ -417,36 +1495,65 @@ type AddResponse struct {
 	Ignored  []string `json:"ignored"`
 }
 
+// limitSubmission limits the length of the body of a key submission
+// request to MaxAddLength, if set.
+func (h *Handler) limitSubmission(w http.ResponseWriter, r *http.Request) {
+	if h.maxAddLength > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(h.maxAddLength))
+	}
+}
+
+// submissionError responds to a key submission request which could not be
+// parsed.
+func submissionError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, http.StatusRequestEntityTooLarge, errors.WithStack(err))
+	} else {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+	}
+}
+
 func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.limitSubmission(w, r)
 	add, err := ParseAdd(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		submissionError(w, err)
+		return
+	}
+	if !h.meetsChallenge(w, r) {
+		return
+	}
+	if add.Replace {
+		h.replace(w, add.Keytext, add.Keysig)
 		return
 	}
 
 	// Check and decode the armor
-	armorBlock, err := armor.Decode(bytes.NewBufferString(add.Keytext))
+	armorBlock, err := openpgp.DecodeArmor(strings.NewReader(add.Keytext), h.keyReaderOptions...)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		readError(w, errors.WithStack(err))
 		return
 	}
 
 	var result AddResponse
+	_, span := tracing.Start(r.Context(), "openpgp.ReadKeys", tracing.KindInternal)
 	kr := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...)
 	keys, err := kr.Read()
+	span.SetAttributes(tracing.Int("keys", len(keys)))
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		readError(w, errors.WithStack(err))
 		return
 	}
 	for _, key := range keys {
-		err := openpgp.DropDuplicates(key)
-		if err != nil {
-			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
-			return
-		}
-
-		change, err := storage.UpsertKey(h.storage, key)
-		if err != nil {
+		change, err := h.addKey(key)
+		if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) || IsLimitExceeded(err) {
+			log.Warningf("add: %v", err)
+			result.Ignored = append(result.Ignored, key.QualifiedFingerprint())
+			continue
+		} else if err != nil {
 			if errors.Is(err, storage.ErrKeyNotFound) {
 				httpError(w, http.StatusNotFound, errors.WithStack(err))
 			} else {
@@ -476,23 +1583,82 @@ func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 	enc.Encode(&result)
 }
 
+// addKey merges a key submitted directly by a client into storage.
+func (h *Handler) addKey(key *openpgp.PrimaryKey) (storage.KeyChange, error) {
+	err := openpgp.DropDuplicates(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	upsertOptions := append(h.upsertOptions[:len(h.upsertOptions):len(h.upsertOptions)],
+		storage.Provenance(storage.ProvenanceDirect))
+	var violation *LimitViolation
+	if h.limits != nil {
+		upsertOptions = append(upsertOptions, h.checkLimits(&violation))
+	}
+	change, err := storage.UpsertKey(h.storage, key, upsertOptions...)
+	h.recordSubmission(change, err)
+	if err == nil && violation != nil {
+		h.warnLimits(violation)
+	}
+	return change, err
+}
+
+func (h *Handler) recordSubmission(kc storage.KeyChange, err error) {
+	if h.submissionFunc != nil {
+		h.submissionFunc(sks.SourceDirect, kc, err)
+	}
+}
+
 func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.limitSubmission(w, r)
 	replace, err := ParseReplace(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		submissionError(w, err)
 		return
 	}
-
-	signingFp, err := h.checkSignature(replace.Keytext, replace.Keysig)
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
+	if !h.meetsChallenge(w, r) {
 		return
 	}
+	h.replace(w, replace.Keytext, replace.Keysig)
+}
+
+// maxRequestClockSkew is how far the creation time of the signature on a
+// replace or delete request may be from the time the request is received.
+// Signatures made within it are remembered so that they cannot be replayed.
+const maxRequestClockSkew = 5 * time.Minute
+
+// checkRequestSignature returns an error unless the verified signature rs
+// on a request was made within maxRequestClockSkew and has not been
+// received before.
+func (h *Handler) checkRequestSignature(rs *openpgp.RequestSignature) error {
+	now := h.clock.Now()
+	if d := now.Sub(rs.Created); d > maxRequestClockSkew || d < -maxRequestClockSkew {
+		return errors.Errorf("request signed at %s is outside the accepted window", rs.Created.Format(time.RFC3339))
+	}
+	if !h.requestSeen.check(rs.Digest, now, rs.Created.Add(2*maxRequestClockSkew)) {
+		return errors.New("request already received")
+	}
+	return nil
+}
 
+// replacement is a key in a replace request, with its stored version if
+// there is one.
+type replacement struct {
+	key, stored *openpgp.PrimaryKey
+}
+
+// replace replaces the stored versions of the keys in keytext which made
+// the detached signature keysig over their replace statements. Packets not
+// present in the new versions are dropped, so that a key owner may shed
+// flooded certifications or user IDs they no longer use, but revocations
+// are always kept. The signature is verified with the stored version, which
+// carries any revocations of its subkeys; a key which is not stored yet has
+// nothing to replace, vouches for itself, and is added as on add.
+func (h *Handler) replace(w http.ResponseWriter, keytext, keysig string) {
 	// Check and decode the armor
-	armorBlock, err := armor.Decode(bytes.NewBufferString(replace.Keytext))
+	armorBlock, err := openpgp.DecodeArmor(bytes.NewBufferString(keytext), h.keyReaderOptions...)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		readError(w, errors.WithStack(err))
 		return
 	}
 
@@ -500,20 +1666,57 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	kr := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...)
 	keys, err := kr.Read()
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		readError(w, errors.WithStack(err))
 		return
 	}
+	var replacements []replacement
+	var rs *openpgp.RequestSignature
+	var sigErr error
 	for _, key := range keys {
-		if signingFp != key.Fingerprint() {
-			continue
-		}
-		err := openpgp.DropDuplicates(key)
+		stored, err := h.storedKeys([]*openpgp.PrimaryKey{key})
 		if err != nil {
 			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
 			return
 		}
-		change, err := storage.ReplaceKey(h.storage, key)
+		r := replacement{key: key}
+		signer := key
+		if len(stored) > 0 {
+			r.stored, signer = stored[0], stored[0]
+		}
+		keyRS, err := openpgp.VerifyReplacement(signer, keytext, bytes.NewBufferString(keysig))
 		if err != nil {
+			sigErr = err
+			continue
+		}
+		rs = keyRS
+		replacements = append(replacements, r)
+	}
+	if rs == nil {
+		if sigErr == nil {
+			sigErr = errors.New("no keys in keytext")
+		}
+		httpError(w, http.StatusBadRequest, errors.Wrap(sigErr, "invalid signature"))
+		return
+	}
+	err = h.checkRequestSignature(rs)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errors.WithStack(err))
+		return
+	}
+
+	for _, r := range replacements {
+		key := r.key
+		var change storage.KeyChange
+		if r.stored == nil {
+			change, err = h.addKey(key)
+		} else {
+			change, err = h.replaceKey(key, r.stored)
+		}
+		if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) || IsLimitExceeded(err) {
+			log.Warningf("replace: %v", err)
+			result.Ignored = append(result.Ignored, key.QualifiedFingerprint())
+			continue
+		} else if err != nil {
 			if errors.Is(err, storage.ErrKeyNotFound) {
 				httpError(w, http.StatusNotFound, errors.WithStack(err))
 			} else {
@@ -535,7 +1738,7 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	log.WithFields(log.Fields{
 		"inserted": result.Inserted,
 		"updated":  result.Updated,
-	}).Info("add")
+	}).Info("replace")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -543,6 +1746,147 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	enc.Encode(&result)
 }
 
+// replaceKey replaces stored with key, keeping the revocations of stored.
+func (h *Handler) replaceKey(key, stored *openpgp.PrimaryKey) (storage.KeyChange, error) {
+	err := openpgp.MergeRevocations(key, stored)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = openpgp.DropDuplicates(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	change, err := storage.ReplaceKey(h.storage, key, storage.Provenance(storage.ProvenanceDirect))
+	h.recordSubmission(change, err)
+	return change, err
+}
+
+// Revoke merges bare key revocation certificates into the stored keys which
+// issued them, so that a key may be revoked without resubmitting it in full.
+func (h *Handler) Revoke(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.limitSubmission(w, r)
+	revoke, err := ParseRevoke(r)
+	if err != nil {
+		submissionError(w, err)
+		return
+	}
+	if !h.meetsChallenge(w, r) {
+		return
+	}
+
+	// Check and decode the armor
+	armorBlock, err := openpgp.DecodeArmor(bytes.NewBufferString(revoke.Keytext), h.keyReaderOptions...)
+	if err != nil {
+		readError(w, errors.WithStack(err))
+		return
+	}
+
+	var certs []*packet.OpaquePacket
+	or := packet.NewOpaqueReader(armorBlock.Body)
+	for {
+		op, err := or.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			readError(w, errors.WithStack(err))
+			return
+		}
+		if op.Tag != 2 { //packet.PacketTypeSignature
+			httpError(w, http.StatusBadRequest, errors.Errorf("expected revocation certificate, got packet type %d", op.Tag))
+			return
+		}
+		certs = append(certs, op)
+	}
+	if len(certs) == 0 {
+		httpError(w, http.StatusBadRequest, errors.New("missing revocation certificate"))
+		return
+	}
+
+	var result AddResponse
+	for _, cert := range certs {
+		key, err := h.revocationKey(cert)
+		if err != nil {
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				httpError(w, http.StatusNotFound, errors.WithStack(err))
+			} else {
+				httpError(w, http.StatusBadRequest, errors.WithStack(err))
+			}
+			return
+		}
+
+		change, err := storage.UpsertKey(h.storage, key, append(h.upsertOptions[:len(h.upsertOptions):len(h.upsertOptions)],
+			storage.Provenance(storage.ProvenanceDirect))...)
+		h.recordSubmission(change, err)
+		if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) {
+			log.Warningf("revoke: %v", err)
+			result.Ignored = append(result.Ignored, key.QualifiedFingerprint())
+			continue
+		} else if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+
+		fp := key.QualifiedFingerprint()
+		switch change.(type) {
+		case storage.KeyReplaced:
+			result.Updated = append(result.Updated, fp)
+		default:
+			result.Ignored = append(result.Ignored, fp)
+		}
+	}
+	log.WithFields(log.Fields{
+		"updated": result.Updated,
+	}).Info("revoke")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(&result)
+}
+
+// revocationKey returns the stored key revoked by cert, reduced to its primary
+// key and the revocation certificate.
+func (h *Handler) revocationKey(cert *packet.OpaquePacket) (*openpgp.PrimaryKey, error) {
+	sig, err := openpgp.ParseSignature(cert, time.Time{}, "", "")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid revocation certificate")
+	}
+	id := sig.RIssuerKeyID
+	if sig.IssuerFingerprint != "" {
+		id = openpgp.Reverse(sig.IssuerFingerprint)
+	}
+	if id == "" {
+		return nil, errors.New("revocation certificate has no issuer")
+	}
+	keys, err := h.signerKeys(id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrapf(storage.ErrKeyNotFound, "issuer 0x%s", openpgp.Reverse(id))
+	}
+	// A key ID may match more than one key; the revocation is valid for at
+	// most one of them.
+	for _, key := range keys {
+		rkey, rerr := openpgp.RevocationKey(key, cert)
+		if rerr == nil {
+			return rkey, nil
+		}
+		err = rerr
+	}
+	return nil, errors.WithStack(err)
+}
+
+// Delete removes a key at the request of its owner, or of a revoker it
+// designates, made with a detached signature over the delete statement for
+// the key, given the keytext, as returned by openpgp.RequestStatement. Keytext
+// names the key which signed the request, and the key to delete is named by
+// fingerprint if it is not that key. The signature is verified with the
+// stored versions of both, so that a submitted copy cannot leave out the
+// revocation of the subkey which made it. As for replace, the signature
+// must be recent and is only accepted once. A deleted key is blocked if
+// storage supports it, so that peers which still have it do not send it
+// back.
 func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	del, err := ParseDelete(r)
 	if err != nil {
@@ -550,13 +1894,62 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		return
 	}
 
-	signingFp, err := h.checkSignature(del.Keytext, del.Keysig)
+	signers, err := openpgp.ReadArmorKeys(bytes.NewBufferString(del.Keytext), h.keyReaderOptions...)
+	if err != nil {
+		readError(w, errors.WithStack(err))
+		return
+	}
+	if len(signers) == 0 {
+		httpError(w, http.StatusBadRequest, errors.New("no keys in keytext"))
+		return
+	}
+	signers, err = h.storedKeys(signers)
 	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	if len(signers) == 0 {
+		httpError(w, http.StatusNotFound, errors.Wrap(storage.ErrKeyNotFound, "no stored keys in keytext"))
+		return
+	}
+
+	// Designated revokers may only delete a key named explicitly, as it
+	// is not the key they signed with.
+	targets, revokers := signers, []*openpgp.PrimaryKey(nil)
+	if del.Fingerprint != "" {
+		targets, err = h.storage.FetchKeys([]string{openpgp.Reverse(del.Fingerprint)})
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		if len(targets) == 0 {
+			httpError(w, http.StatusNotFound, errors.Wrapf(storage.ErrKeyNotFound, "key 0x%s", del.Fingerprint))
+			return
+		}
+		revokers = signers
+	}
+	var key *openpgp.PrimaryKey
+	var rs *openpgp.RequestSignature
+	for _, target := range targets {
+		rs, err = openpgp.VerifyDeletion(target, revokers, del.Keytext, bytes.NewBufferString(del.Keysig))
+		if err == nil {
+			key = target
+			break
+		}
+	}
+	if key == nil {
 		httpError(w, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
 		return
 	}
+	err = h.checkRequestSignature(rs)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errors.WithStack(err))
+		return
+	}
+	signer := rs.Signer
 
-	change, err := storage.DeleteKey(h.storage, signingFp)
+	fp := key.Fingerprint()
+	change, err := storage.DeleteKey(h.storage, fp)
 	if err != nil {
 		if errors.Is(err, storage.ErrKeyNotFound) {
 			httpError(w, http.StatusNotFound, errors.WithStack(err))
@@ -565,24 +1958,17 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		}
 		return
 	}
+	if blocker, ok := h.storage.(storage.Blocker); ok {
+		err = blocker.Block(fp, fmt.Sprintf("deleted at the request of 0x%s", signer.Fingerprint()))
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to block deleted key"))
+			return
+		}
+	}
 
 	log.WithFields(log.Fields{
 		"change":  change,
-		"deleted": []string{signingFp},
+		"deleted": []string{fp},
+		"signer":  signer.Fingerprint(),
 	}).Info("delete")
-
-	return
-}
-
-func (h *Handler) checkSignature(keytext, keysig string) (string, error) {
-	keyring, err := xopenpgp.ReadArmoredKeyRing(bytes.NewBufferString(keytext))
-	if err != nil {
-		return "", errors.Wrap(err, "invalid or unsupported keytext")
-	}
-	signingKey, err := xopenpgp.CheckArmoredDetachedSignature(
-		keyring, bytes.NewBufferString(keytext), bytes.NewBufferString(keysig), nil)
-	if err != nil {
-		return "", errors.Wrap(err, "invalid signature")
-	}
-	return hex.EncodeToString(signingKey.PrimaryKey.Fingerprint[:]), nil
 }
@@ -19,20 +19,34 @@ package hkp
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
 	stdtesting "testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 	gc "gopkg.in/check.v1"
 
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/jsonhkp"
 	"hockeypuck/openpgp"
 	"hockeypuck/testing"
 
+	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
 )
 
@@ -140,6 +154,74 @@ func (s *HandlerSuite) TestGetKeyword(c *gc.C) {
 	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
 }
 
+func (s *HandlerSuite) TestGetKeywordMatchNotAvailable(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&match=phrase&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
+
+	// The default match is how every storage searches.
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&match=all&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestExact(c *gc.C) {
+	tk := testKeyDefault
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) { return []string{tk.rfp}, nil }),
+		mock.MatchKeyword(func([]string) ([]string, error) { return []string{tk.rfp}, nil }),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, t := range []struct {
+		query  string
+		status int
+	}{
+		{"search=alice", http.StatusOK},
+		{"search=alice&exact=on", http.StatusNotFound},
+		{"search=alice+%3Calice%40example.com%3E&exact=on", http.StatusOK},
+		{"search=ALICE%40example.com&exact=on", http.StatusOK},
+		{"search=%3Calice%40example.com%3E&exact=on", http.StatusOK},
+		{"search=0x" + tk.sid + "&exact=on", http.StatusOK},
+		{"fingerprint=" + tk.fp, http.StatusOK},
+		{"fingerprint=0x" + strings.ToUpper(tk.fp), http.StatusOK},
+		{"fingerprint=" + key.SubKeys[0].Fingerprint(), http.StatusOK},
+		// Storage resolves only a prefix of the reversed fingerprint.
+		{"fingerprint=" + strings.Repeat("0", 32) + tk.sid, http.StatusNotFound},
+		{"fingerprint=" + tk.sid, http.StatusBadRequest},
+		{"fingerprint=alice", http.StatusBadRequest},
+	} {
+		comment := gc.Commentf("%s", t.query)
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&" + t.query)
+		c.Assert(err, gc.IsNil, comment)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, t.status, comment)
+	}
+	// Fingerprint lookups never fall back to a keyword search.
+	c.Assert(st.MethodCount("MatchKeyword"), gc.Equals, 5)
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr&fingerprint=" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(strings.Contains(string(doc), "pub:"+strings.ToUpper(tk.fp)+":"), gc.Equals, true, gc.Commentf("%s", doc))
+}
+
 func (s *HandlerSuite) TestGetMD5(c *gc.C) {
 	// fake MD5, this is a mock
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=hget&search=f49fba8f60c4957725dd97faa4b94647")
@@ -213,6 +295,67 @@ func (s *HandlerSuite) TestMissingSearch(c *gc.C) {
 	}
 }
 
+func (s *HandlerSuite) TestLocalizedError(c *gc.C) {
+	for _, test := range []struct {
+		acceptLanguage, contentLanguage, body string
+	}{
+		{"", "en", "Bad Request\n"},
+		{"de-DE, en;q=0.8", "de", "Ungültige Anfrage\n"},
+		{"ja", "en", "Bad Request\n"},
+	} {
+		req, err := http.NewRequest("GET", s.srv.URL+"/pks/lookup?op=explode", nil)
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+		c.Assert(res.Header.Get("Content-Language"), gc.Equals, test.contentLanguage)
+		c.Assert(res.Header.Get("Vary"), gc.Equals, "Accept-Language")
+		c.Assert(string(body), gc.Equals, test.body)
+	}
+}
+
+func (s *HandlerSuite) TestStats(c *gc.C) {
+	tmpl := filepath.Join(c.MkDir(), "stats.html.tmpl")
+	err := ioutil.WriteFile(tmpl, []byte(`<p>Total number of keys: {{ .Total }}</p>`), 0644)
+	c.Assert(err, gc.IsNil)
+	statsFunc := func() (interface{}, error) {
+		return map[string]interface{}{"Total": 42}, nil
+	}
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, StatsFunc(statsFunc), StatsTemplate(tmpl))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, t := range []struct {
+		query, contentType, body string
+	}{
+		{"op=stats", "text/html; charset=utf-8", "<p>Total number of keys: 42</p>"},
+		{"op=stats&options=json", "application/json", `{"Total":42}` + "\n"},
+		{"op=stats&options=mr", "application/json", `{"Total":42}` + "\n"},
+	} {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + t.query)
+		c.Assert(err, gc.IsNil)
+		doc, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Content-Type"), gc.Equals, t.contentType)
+		c.Assert(string(doc), gc.Equals, t.body)
+	}
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=stats")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
 func (s *HandlerSuite) TestAdd(c *gc.C) {
 	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
 	c.Assert(err, gc.IsNil)
@@ -231,6 +374,517 @@ func (s *HandlerSuite) TestAdd(c *gc.C) {
 	c.Assert(addRes.Ignored, gc.HasLen, 1)
 }
 
+func (s *HandlerSuite) TestAddTooLarge(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, KeyReaderOptions([]openpgp.KeyReaderOption{
+		openpgp.MaxArmorLen(len(keytext) / 2),
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddBodyTooLarge(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, MaxAddLength(len(keytext)/2))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+
+	body, err := json.Marshal(&VKSUploadRequest{Keytext: string(keytext)})
+	c.Assert(err, gc.IsNil)
+	res, err = http.Post(srv.URL+"/vks/v1/upload", "application/json", bytes.NewReader(body))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddChallenge(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	challenge := NewHashcashChallenge(8, "keys.example.org", time.Hour)
+	challenge.clock = storage.ClockFunc(func() time.Time { return now })
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, SubmissionChallenge(challenge, []string{"s3cret"}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	mint := func(resource string) string {
+		for i := 0; ; i++ {
+			stamp := fmt.Sprintf("1:8:2403011200:%s::c2FsdA==:%x", resource, i)
+			if leadingZeroBits(sha1.Sum([]byte(stamp))) >= 8 {
+				return stamp
+			}
+		}
+	}
+	add := func(header, value string) *http.Response {
+		req, err := http.NewRequest("POST", srv.URL+"/pks/add", strings.NewReader(url.Values{
+			"keytext": []string{string(keytext)},
+		}.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	res := add("", "")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(res.Header.Get("X-Hashcash-Challenge"), gc.Equals, "8:keys.example.org")
+
+	res = add("X-Hashcash", mint("keys.example.net"))
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+
+	stamp := mint("keys.example.org")
+	res = add("X-Hashcash", stamp)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	// Stamps may only be spent once.
+	res = add("X-Hashcash", stamp)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+
+	now = now.Add(2 * time.Hour)
+	res = add("X-Hashcash", mint("keys.example.org"))
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+
+	res = add("Authorization", "Bearer s3cret")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	res = add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("s3cret:")))
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	res = add("Authorization", "Bearer wrong")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+
+	// Uploads through the VKS API are challenged alike.
+	upload := func(header, value string) *http.Response {
+		body, err := json.Marshal(&VKSUploadRequest{Keytext: string(keytext)})
+		c.Assert(err, gc.IsNil)
+		req, err := http.NewRequest("POST", srv.URL+"/vks/v1/upload", bytes.NewReader(body))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+	res = upload("", "")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(res.Header.Get("X-Hashcash-Challenge"), gc.Equals, "8:keys.example.org")
+	res = upload("Authorization", "Bearer s3cret")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestRevoke(c *gc.C) {
+	var updated *openpgp.PrimaryKey
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01", "f261e60a854033c7ea8470883122fb519958b4d2"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return append(openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")),
+				openpgp.MustReadArmorKeys(testing.MustInput("test-key.asc"))...), nil
+		}),
+		mock.Update(func(key *openpgp.PrimaryKey, _ string, _ string) error {
+			updated = key
+			return nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	revoke := func(file string) *http.Response {
+		keytext, err := ioutil.ReadAll(testing.MustInput(file))
+		c.Assert(err, gc.IsNil)
+		res, err := http.PostForm(srv.URL+"/pks/revoke", url.Values{
+			"keytext": []string{string(keytext)},
+		})
+		c.Assert(err, gc.IsNil)
+		return res
+	}
+
+	res := revoke("test-key-revoke.asc")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var revokeRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&revokeRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(revokeRes.Updated, gc.DeepEquals, []string{"rsa3072/2d4b859915bf2213880748ae7c330458a06e162f"})
+	c.Assert(updated, gc.NotNil)
+	c.Assert(updated.Fingerprint(), gc.Equals, "2d4b859915bf2213880748ae7c330458a06e162f")
+	selfSigs, _ := updated.SigInfo()
+	_, revoked := selfSigs.RevokedSince()
+	c.Assert(revoked, gc.Equals, true)
+	// The rest of the stored key is retained.
+	c.Assert(updated.UserIDs, gc.HasLen, 1)
+	c.Assert(updated.SubKeys, gc.HasLen, 1)
+
+	// A full key is not a revocation certificate.
+	res = revoke("test-key.asc")
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	// A revocation certificate issued by another key.
+	res = revoke("revok_cert.asc")
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+// fetchStored returns a FetchKeys function which serves the keys in files
+// by reversed fingerprint.
+func fetchStored(files ...string) func([]string) ([]*openpgp.PrimaryKey, error) {
+	var stored []*openpgp.PrimaryKey
+	for _, file := range files {
+		stored = append(stored, openpgp.MustReadArmorKeys(testing.MustInput(file))...)
+	}
+	return func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+		var keys []*openpgp.PrimaryKey
+		for _, rfp := range rfps {
+			for _, key := range stored {
+				if key.RFingerprint == rfp {
+					keys = append(keys, key)
+				}
+			}
+		}
+		return keys, nil
+	}
+}
+
+// requestTime is the time at which the signatures on the replace and delete
+// requests in the test data were made.
+var requestTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (s *HandlerSuite) TestReplace(c *gc.C) {
+	const (
+		replaceFp = "7157e3d0ed874d14ab5def7cc0633f0e04fd5b19"
+		subkeyFp  = "9a5906c769dd666fc46b900254d9afc07392375e"
+	)
+	fetch := fetchStored("replace_orig.asc", "revoked_subkey.asc")
+	var replaced, inserted []*openpgp.PrimaryKey
+	st := mock.NewStorage(
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) { return fetch(rfps) }),
+		mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+			replaced = append(replaced, key)
+			return "decafbad", nil
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, int, error) {
+			inserted = append(inserted, keys...)
+			return len(keys), 0, nil
+		}),
+	)
+	clock := mock.NewClock(requestTime.Add(time.Minute))
+	r := httprouter.New()
+	handler, err := NewHandler(st, Clock(clock))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	post := func(path, file, sigFile string, extra url.Values) *http.Response {
+		form := url.Values{"keytext": {testing.MustInputString(file)}}
+		if sigFile != "" {
+			form.Set("keysig", testing.MustInputString(sigFile))
+		}
+		for k, v := range extra {
+			form[k] = v
+		}
+		res, err := http.PostForm(srv.URL+path, form)
+		c.Assert(err, gc.IsNil)
+		return res
+	}
+
+	// A signed submission replaces the key when asked to. replace.asc
+	// drops the "forgetme" user ID and the subkey of the stored key.
+	res := post("/pks/add", "replace.asc", "", url.Values{"replace": {"true"}})
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	res = post("/pks/add", "replace.asc", "replace.asc.asc", url.Values{"replace": {"true"}})
+	var addRes AddResponse
+	c.Assert(json.NewDecoder(res.Body).Decode(&addRes), gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(addRes.Updated, gc.DeepEquals, []string{"rsa2048/" + replaceFp})
+	c.Assert(replaced, gc.HasLen, 1)
+	c.Assert(replaced[0].UserIDs, gc.HasLen, 1)
+	c.Assert(replaced[0].UserIDs[0].Keywords, gc.Equals, "somename")
+	c.Assert(replaced[0].SubKeys, gc.HasLen, 0)
+
+	// The same request is not accepted twice.
+	res = post("/pks/replace", "replace.asc", "replace.asc.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(replaced, gc.HasLen, 1)
+
+	// A signature requesting deletion does not replace.
+	res = post("/pks/replace", "replace.asc", "replace.delete.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(replaced, gc.HasLen, 1)
+
+	// A key which is not stored is added as on add.
+	res = post("/pks/replace", "replace_notselfsig.asc", "replace_notselfsig.asc.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(replaced, gc.HasLen, 1)
+	c.Assert(inserted, gc.HasLen, 1)
+	c.Assert(inserted[0].Fingerprint(), gc.Equals, "275982f0e210a4d919ac167386bf8444e38ff4f2")
+
+	// The stored key has revoked the subkey which signed this copy of it.
+	res = post("/pks/replace", "revoked_subkey_orig.asc", "revoked_subkey_orig.asc.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(replaced, gc.HasLen, 1)
+
+	// Requests signed too long ago are refused.
+	clock.Advance(10 * time.Minute)
+	res = post("/pks/replace", "revoked_subkey_orig.asc", "revoked_subkey_orig.primary.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(replaced, gc.HasLen, 1)
+	clock.Set(requestTime.Add(time.Minute))
+
+	// The primary key may still sign, but the replacement keeps the
+	// revocation of the subkey which it leaves out.
+	res = post("/pks/replace", "revoked_subkey_orig.asc", "revoked_subkey_orig.primary.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(replaced, gc.HasLen, 2)
+	c.Assert(replaced[1].Fingerprint(), gc.Equals, subkeyFp)
+	c.Assert(replaced[1].SubKeys, gc.HasLen, 1)
+	c.Assert(replaced[1].SubKeys[0].BindingStatus(replaced[1]), gc.Not(gc.Equals), openpgp.BindingValid)
+
+	// A revoked key may not replace itself.
+	fetch = fetchStored("replace_revoked.asc")
+	handler.requestSeen = newReplayCache()
+	res = post("/pks/replace", "replace.asc", "replace.asc.asc", nil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(replaced, gc.HasLen, 2)
+}
+
+func (s *HandlerSuite) TestDelete(c *gc.C) {
+	const targetFp = "862740d4a9b2b2c718304e6ee9e97063541261e0"
+	var deleted, blocked []string
+	st := mock.NewStorage(
+		mock.FetchKeys(fetchStored("delete_target.asc", "delete_revoker.asc", "revoked_subkey.asc")),
+		mock.Delete(func(fp string) (string, error) {
+			deleted = append(deleted, fp)
+			return "", nil
+		}),
+		mock.Block(func(fp, _ string) error {
+			blocked = append(blocked, fp)
+			return nil
+		}),
+	)
+	clock := mock.NewClock(requestTime.Add(time.Minute))
+	r := httprouter.New()
+	handler, err := NewHandler(st, Clock(clock))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	del := func(method, file, sigFile, fp string) int {
+		form := url.Values{
+			"keytext": {testing.MustInputString(file)},
+			"keysig":  {testing.MustInputString(sigFile)},
+		}
+		if fp != "" {
+			form.Set("fingerprint", fp)
+		}
+		req, err := http.NewRequest(method, srv.URL+"/pks/delete", strings.NewReader(form.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Requests signed too long ago are refused.
+	clock.Advance(10 * time.Minute)
+	c.Assert(del("POST", "delete_target.asc", "delete_target.asc.asc", ""), gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 0)
+	clock.Set(requestTime.Add(time.Minute))
+
+	// The owner deletes their own key, which is then blocked.
+	c.Assert(del("POST", "delete_target.asc", "delete_target.asc.asc", ""), gc.Equals, http.StatusOK)
+	c.Assert(deleted, gc.DeepEquals, []string{targetFp})
+	c.Assert(blocked, gc.DeepEquals, []string{targetFp})
+
+	// The same request is not accepted twice.
+	c.Assert(del("POST", "delete_target.asc", "delete_target.asc.asc", ""), gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 1)
+
+	// The designated revoker deletes it by fingerprint.
+	c.Assert(del("DELETE", "delete_revoker.asc", "delete_revoker.asc.asc", targetFp), gc.Equals, http.StatusOK)
+	c.Assert(deleted, gc.DeepEquals, []string{targetFp, targetFp})
+
+	// Without naming the target, the revoker's statement does not match
+	// the key it would delete, its own.
+	c.Assert(del("DELETE", "delete_revoker.asc", "delete_revoker.asc.asc", ""), gc.Equals, http.StatusBadRequest)
+	c.Assert(deleted, gc.HasLen, 2)
+
+	// A signature over other keytext is refused.
+	c.Assert(del("POST", "delete_revoker.asc", "delete_target.asc.asc", ""), gc.Equals, http.StatusBadRequest)
+	c.Assert(del("POST", "delete_target.asc", "delete_revoker.asc.asc", targetFp), gc.Equals, http.StatusBadRequest)
+	c.Assert(deleted, gc.HasLen, 2)
+
+	// The stored key has revoked the subkey which signed the request,
+	// which the submitted copy leaves out.
+	c.Assert(del("POST", "revoked_subkey_orig.asc", "revoked_subkey_orig.delete.asc", ""), gc.Equals, http.StatusBadRequest)
+	c.Assert(deleted, gc.HasLen, 2)
+
+	// A signature requesting replacement does not delete.
+	c.Assert(del("POST", "revoked_subkey_orig.asc", "revoked_subkey_orig.primary.asc", ""), gc.Equals, http.StatusBadRequest)
+	c.Assert(deleted, gc.HasLen, 2)
+
+	// Keys which are not stored cannot sign requests.
+	c.Assert(del("POST", "replace.asc", "replace.delete.asc", ""), gc.Equals, http.StatusNotFound)
+	c.Assert(deleted, gc.HasLen, 2)
+}
+
+func (s *HandlerSuite) TestErasure(c *gc.C) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var filed []storage.ErasureRequest
+	st := mock.NewStorage(mock.FileErasure(func(req storage.ErasureRequest) error {
+		filed = append(filed, req)
+		return nil
+	}))
+	r := httprouter.New()
+	handler, err := NewHandler(st, Clock(mock.NewClock(now)), IDs(mock.NewIDs("erasure")))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL+"/pks/erasure", url.Values{
+		"address": {"Alice@Example.com"},
+		"reason":  {"no longer mine"},
+		"contact": {"alice@example.org"},
+	})
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusAccepted)
+	var erasureRes ErasureResponse
+	err = json.NewDecoder(res.Body).Decode(&erasureRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(erasureRes, gc.Equals, ErasureResponse{ID: "erasure1", Status: "pending"})
+	c.Assert(filed, gc.DeepEquals, []storage.ErasureRequest{{
+		ID:      "erasure1",
+		Address: "alice@example.com",
+		Reason:  "no longer mine",
+		Contact: "alice@example.org",
+		Status:  storage.ErasurePending,
+		Filed:   now,
+	}})
+
+	for _, form := range []url.Values{
+		{"contact": {"alice@example.org"}},
+		{"address": {"alice@example.com"}},
+		{"fingerprint": {"0x1234"}, "contact": {"alice@example.org"}},
+	} {
+		res, err := http.PostForm(srv.URL+"/pks/erasure", form)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%v", form))
+	}
+	c.Assert(filed, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) dryRun(c *gc.C, file string) *DryRunResponse {
+	keytext, err := ioutil.ReadAll(testing.MustInput(file))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(s.srv.URL+"/pks/dryrun", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var dryRunRes DryRunResponse
+	err = json.NewDecoder(res.Body).Decode(&dryRunRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+	return &dryRunRes
+}
+
+func (s *HandlerSuite) TestDryRunUnchanged(c *gc.C) {
+	result := s.dryRun(c, "alice_unsigned.asc")
+	c.Assert(result.Keys, gc.HasLen, 1)
+	key := result.Keys[0]
+	c.Assert(key.Action, gc.Equals, DryRunUnchanged)
+	c.Assert(key.Digest, gc.Equals, key.PreviousDigest)
+	c.Assert(key.Packets, gc.Not(gc.HasLen), 0)
+	for _, p := range key.Packets {
+		c.Assert(p.Status, gc.Equals, PacketPresent)
+		c.Assert(p.Served, gc.Equals, true)
+	}
+}
+
+func (s *HandlerSuite) TestDryRunInsert(c *gc.C) {
+	result := s.dryRun(c, "uat.asc")
+	c.Assert(result.Keys, gc.HasLen, 1)
+	key := result.Keys[0]
+	c.Assert(key.Action, gc.Equals, DryRunInsert)
+	c.Assert(key.PreviousDigest, gc.Equals, "")
+	c.Assert(key.Digest, gc.Not(gc.Equals), "")
+	var uats int
+	for _, p := range key.Packets {
+		c.Assert(p.Status, gc.Equals, PacketAdded)
+		if p.Type == "user attribute" {
+			uats++
+		}
+	}
+	c.Assert(uats, gc.Not(gc.Equals), 0)
+}
+
+func (s *HandlerSuite) TestDryRunWarnings(c *gc.C) {
+	result := s.dryRun(c, "critical_notation.asc")
+	c.Assert(result.Keys, gc.HasLen, 1)
+	c.Assert(result.Keys[0].Warnings, gc.HasLen, 1)
+	c.Assert(result.Keys[0].Warnings[0], gc.Matches, ".*unknown critical subpacket type 20")
+
+	result = s.dryRun(c, "uat.asc")
+	c.Assert(result.Keys[0].Warnings, gc.HasLen, 0)
+}
+
 func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
 	tk := testKeyBadSigs
 
@@ -246,3 +900,1694 @@ func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
 	c.Assert(keys[0].ShortID(), gc.Equals, tk.sid)
 	c.Assert(len(keys[0].Others), gc.Equals, 0)
 }
+
+func (s *HandlerSuite) TestHashQuerySizes(c *gc.C) {
+	tk := testKeyDefault
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+	var keyBuf bytes.Buffer
+	err := openpgp.WritePackets(&keyBuf, key)
+	c.Assert(err, gc.IsNil)
+
+	var req bytes.Buffer
+	digest := make([]byte, 16)
+	c.Assert(recon.WriteInt(&req, 1), gc.IsNil)
+	c.Assert(recon.WriteInt(&req, len(digest)), gc.IsNil)
+	req.Write(digest)
+
+	res, err := http.Post(s.srv.URL+"/pks/hashquery?sizes=on", "sks/hashquery", &req)
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "sks/hashquery-sizes")
+
+	body := bytes.NewBuffer(doc)
+	n, err := recon.ReadInt(body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	digestLen, err := recon.ReadInt(body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fmt.Sprintf("%x", body.Next(digestLen)), gc.Equals, key.MD5)
+	size, err := recon.ReadInt(body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(size, gc.Equals, keyBuf.Len())
+	c.Assert(body.Bytes(), gc.DeepEquals, []byte{0x0d, 0x0a})
+
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestAddPinned(c *gc.C) {
+	tk := testKeyDefault
+	st := mock.NewStorage(
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, PinnedKeys([]string{tk.fp}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput(tk.file))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+	doc, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+
+	var addRes AddResponse
+	err = json.Unmarshal(doc, &addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Inserted, gc.HasLen, 0)
+	c.Assert(addRes.Updated, gc.HasLen, 0)
+	c.Assert(addRes.Ignored, gc.HasLen, 1)
+	c.Assert(st.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestGetPrimaryOnly(c *gc.C) {
+	tk := testKeyDefault
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&options=primary&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].ShortID(), gc.Equals, tk.sid)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.HasLen, 0)
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+}
+
+type testVerifier map[string]time.Time
+
+func (v testVerifier) VerifiedAt(key *openpgp.PrimaryKey, uid *openpgp.UserID) (time.Time, error) {
+	return v[uid.Keywords], nil
+}
+
+func (s *HandlerSuite) TestIndexVerified(c *gc.C) {
+	tk := testKeyDefault
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, UserIDVerifier(testVerifier{
+		"alice <alice@example.com>": time.Unix(1600000000, 0),
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=vindex&options=mr&search=0x" + tk.sid)
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(string(doc), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945:::1600000000
+`)
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=vindex&options=json&search=0x" + tk.sid)
+	c.Assert(err, gc.IsNil)
+	doc, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	var result []*jsonhkp.PrimaryKey
+	err = json.Unmarshal(doc, &result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0].UserIDs, gc.HasLen, 1)
+	c.Assert(result[0].UserIDs[0].Verified, gc.Equals, "2020-09-13T12:26:40Z")
+}
+
+func (s *HandlerSuite) TestExposeMetadata(c *gc.C) {
+	tk := testKeyDefault
+	storage := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) { return []string{tk.rfp}, nil }),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+		mock.Metadata(func(rfps []string) (map[string]map[string]string, error) {
+			return map[string]map[string]string{
+				tk.rfp: {"hr/employee-id": "1234", "internal/quarantine-reason": "spam"},
+			}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage, ExposeMetadata([]string{"hr"}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var keys []jsonhkp.PrimaryKey
+	err = json.NewDecoder(res.Body).Decode(&keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Metadata, gc.DeepEquals, map[string]string{"hr/employee-id": "1234"})
+
+	// Not exposed by default.
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=index&options=json&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	keys = nil
+	err = json.NewDecoder(res.Body).Decode(&keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].Metadata, gc.IsNil)
+}
+
+func (s *HandlerSuite) TestAmbiguousKeyID(c *gc.C) {
+	newServer := func(options ...HandlerOption) *httptest.Server {
+		storage := mock.NewStorage(
+			mock.Resolve(func([]string) ([]string, error) {
+				return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01", "bd1d2a44ad26397fada207187bf98ce7eee97218"}, nil
+			}),
+			// Storage may return keys in any order.
+			mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+				return append(openpgp.MustReadArmorKeys(testing.MustInput("uat.asc")),
+					openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))...), nil
+			}),
+		)
+		r := httprouter.New()
+		handler, err := NewHandler(storage, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		return httptest.NewServer(r)
+	}
+	srv := newServer()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(res.Body)
+	c.Assert(keys, gc.HasLen, 2)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(keys[1].Fingerprint(), gc.Equals, "81279eee7ec89fb781702adaf79362da44a2d1db")
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	lines := strings.Split(string(body), "\n")
+	c.Assert(lines[0], gc.Equals, "info:1:2")
+	c.Assert(lines[1], gc.Equals, "ambiguous:23E0DCCA:2")
+	c.Assert(lines[2], gc.Matches, "pub:361BC1F023E0DCCA:.*")
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	var wireKeys []jsonhkp.PrimaryKey
+	err = json.NewDecoder(res.Body).Decode(&wireKeys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(wireKeys, gc.HasLen, 2)
+	for _, wireKey := range wireKeys {
+		c.Assert(wireKey.AmbiguousKeyID, gc.Equals, true)
+	}
+
+	// Searches other than by key ID are not ambiguous.
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=alice")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	body, err = ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(body), gc.Not(gc.Matches), "(?s).*ambiguous:.*")
+
+	rejecting := newServer(AmbiguousKeyIDs(AmbiguousKeyIDsReject))
+	defer rejecting.Close()
+	res, err = http.Get(rejecting.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusConflict)
+	c.Assert(string(body), gc.Equals, "Conflict: Key ID 0x23e0dcca matches 2 keys. Search by fingerprint instead.\n")
+	res, err = http.Head(rejecting.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusConflict)
+	res, err = http.Get(rejecting.URL + "/pks/lookup?op=index&options=mr&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	_, err = NewHandler(mock.NewStorage(), AmbiguousKeyIDs("first"))
+	c.Assert(err, gc.ErrorMatches, ".*invalid ambiguous key ID policy.*")
+}
+
+func (s *HandlerSuite) TestResolveSigners(c *gc.C) {
+	byRFP := map[string]*openpgp.PrimaryKey{}
+	for _, name := range []string{"e68e311d.asc", "uat.asc"} {
+		for _, key := range openpgp.MustReadArmorKeys(testing.MustInput(name)) {
+			byRFP[key.RFingerprint] = key
+		}
+	}
+	storage := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			var result []string
+			for rfp := range byRFP {
+				if strings.HasPrefix(rfp, keys[0]) {
+					result = append(result, rfp)
+				}
+			}
+			return result, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			var result []*openpgp.PrimaryKey
+			for _, rfp := range rfps {
+				if key, ok := byRFP[rfp]; ok {
+					result = append(result, key)
+				}
+			}
+			return result, nil
+		}),
+	)
+	index := func(options ...HandlerOption) []jsonhkp.PrimaryKey {
+		r := httprouter.New()
+		handler, err := NewHandler(storage, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0xe68e311d")
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var wireKeys []jsonhkp.PrimaryKey
+		err = json.NewDecoder(res.Body).Decode(&wireKeys)
+		c.Assert(err, gc.IsNil)
+		c.Assert(wireKeys, gc.HasLen, 1)
+		return wireKeys
+	}
+
+	signers := map[string]int{}
+	for _, uid := range index(ResolveSigners(true))[0].UserIDs {
+		for _, sig := range uid.Signatures {
+			signers[sig.SignerFingerprint]++
+		}
+	}
+	c.Assert(signers["81279eee7ec89fb781702adaf79362da44a2d1db"] > 0, gc.Equals, true)
+
+	for _, uid := range index()[0].UserIDs {
+		for _, sig := range uid.Signatures {
+			c.Assert(sig.SignerFingerprint, gc.Equals, "")
+		}
+	}
+}
+
+func (s *HandlerSuite) TestAttestedCertificationsOnly(c *gc.C) {
+	storage := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{"anything"}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("attested.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage, AttestedCertificationsOnly())
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=vindex&options=json&search=0xc899d74e18bfcdd3")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var wireKeys []jsonhkp.PrimaryKey
+	err = json.NewDecoder(res.Body).Decode(&wireKeys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(wireKeys, gc.HasLen, 1)
+	var issuers []string
+	for _, sig := range wireKeys[0].UserIDs[0].Signatures {
+		issuers = append(issuers, sig.IssuerKeyID)
+	}
+	c.Assert(issuers, gc.HasLen, 3)
+	c.Assert(strings.Join(issuers, " "), gc.Not(gc.Matches), ".*b1fa17c27b69bafa.*")
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=0xc899d74e18bfcdd3")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(res.Body)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 3)
+}
+
+// testKeywordPager is storage which pages through keyword matches.
+type testKeywordPager struct {
+	*mock.Storage
+	total  int
+	pages  [][]int
+	orders []storage.ResultOrder
+}
+
+func (p *testKeywordPager) MatchKeywordPage(search string, match storage.KeywordMatch, order storage.ResultOrder, limit, offset int) ([]string, int, error) {
+	p.pages = append(p.pages, []int{limit, offset})
+	p.orders = append(p.orders, order)
+	if offset >= p.total {
+		return nil, p.total, nil
+	}
+	return []string{testKeyDefault.rfp}, p.total, nil
+}
+
+func (s *HandlerSuite) TestIndexPage(c *gc.C) {
+	newServer := func(st storage.Storage) *httptest.Server {
+		r := httprouter.New()
+		handler, err := NewHandler(st)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		return httptest.NewServer(r)
+	}
+	get := func(srv *httptest.Server, query string) *http.Response {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=alice" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	// Storage which cannot page returns its first matches, which are paged
+	// here.
+	var fetched []string
+	st := mock.NewStorage(
+		mock.MatchKeyword(func([]string) ([]string, error) {
+			return []string{"a", "b", "c"}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			fetched = append(fetched, rfps...)
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+	)
+	srv := newServer(st)
+	defer srv.Close()
+	res := get(srv, "&limit=1&offset=1")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "3")
+	c.Assert(res.Header.Get("X-HKP-Next-Offset"), gc.Equals, "2")
+	c.Assert(fetched, gc.DeepEquals, []string{"b"})
+
+	res = get(srv, "&limit=1&offset=3")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "3")
+
+	pager := &testKeywordPager{Storage: s.storage, total: 250}
+	srv = newServer(pager)
+	defer srv.Close()
+	res = get(srv, "&offset=100")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "250")
+	c.Assert(res.Header.Get("X-HKP-Next-Offset"), gc.Equals, "200")
+	// Pages are no larger than the default.
+	res = get(srv, "&limit=1000")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(pager.pages, gc.DeepEquals, [][]int{{100, 100}, {100, 0}})
+
+	// Key ID lookups are not paged by storage.
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&search=0x" + testKeyDefault.sid)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(pager.pages, gc.HasLen, 2)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "1")
+
+	for _, query := range []string{"&limit=0", "&limit=x", "&offset=-1"} {
+		res = get(srv, query)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%s", query))
+	}
+}
+
+// testKeyFilterer is storage which selects keys by their properties.
+type testKeyFilterer struct {
+	*mock.Storage
+	rfps     []string
+	searches []string
+	filters  []*storage.KeyFilter
+}
+
+func (f *testKeyFilterer) MatchFiltered(search string, match storage.KeywordMatch, filter *storage.KeyFilter, order storage.ResultOrder, limit, offset int) ([]string, int, error) {
+	f.searches = append(f.searches, search)
+	f.filters = append(f.filters, filter)
+	return f.rfps, len(f.rfps), nil
+}
+
+func (s *HandlerSuite) TestIndexFilter(c *gc.C) {
+	// Each of these keys has a user ID with the word "test".
+	eccKeys := openpgp.MustReadArmorKeys(testing.MustInput("ecc_keys.asc"))
+	var rfps []string
+	for _, key := range eccKeys {
+		rfps = append(rfps, key.RFingerprint)
+	}
+	st := mock.NewStorage(
+		mock.MatchKeyword(func([]string) ([]string, error) {
+			return rfps, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("ecc_keys.asc")), nil
+		}),
+	)
+	newServer := func(st storage.Storage) *httptest.Server {
+		r := httprouter.New()
+		handler, err := NewHandler(st)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		return httptest.NewServer(r)
+	}
+	get := func(srv *httptest.Server, query string) *http.Response {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	// Storage which cannot select keys by their properties filters the
+	// matches of a search.
+	srv := newServer(st)
+	defer srv.Close()
+	for _, t := range []struct {
+		query  string
+		status int
+		total  string
+	}{
+		{"&search=test&algo=ecdsa", http.StatusOK, "5"},
+		{"&search=test&minbits=1000", http.StatusOK, "1"},
+		{"&search=test&created_before=2019-08-31T18:23:00Z", http.StatusOK, "2"},
+		{"&search=test&flags=sign,encrypt", http.StatusOK, "6"},
+		{"&search=test&flags=authenticate", http.StatusNotFound, "0"},
+		{"&algo=ecdsa", http.StatusBadRequest, ""},
+	} {
+		res := get(srv, t.query)
+		c.Assert(res.StatusCode, gc.Equals, t.status, gc.Commentf("%s", t.query))
+		c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, t.total, gc.Commentf("%s", t.query))
+	}
+
+	// Storage which can is asked for the keys, which are confirmed here.
+	kf := &testKeyFilterer{Storage: st, rfps: rfps}
+	srv = newServer(kf)
+	defer srv.Close()
+	res := get(srv, "&algo=ecdsa&flags=encrypt")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(kf.searches, gc.DeepEquals, []string{""})
+	c.Assert(kf.filters[0], gc.DeepEquals, &storage.KeyFilter{Algorithm: "ecdsa", Flags: openpgp.KeyFlagEncrypt})
+	res = get(srv, "&search=test&flags=authenticate")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	c.Assert(kf.searches, gc.DeepEquals, []string{"", "test"})
+}
+
+func (s *HandlerSuite) TestDomainSearch(c *gc.C) {
+	var searches []string
+	st := mock.NewStorage(
+		mock.MatchKeyword(func(search []string) ([]string, error) {
+			searches = append(searches, search...)
+			return []string{"a", "b"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+			return append(keys, openpgp.MustReadArmorKeys(testing.MustInput("tails.asc"))...), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Storage finds keys by the domain as a keyword, and only those with
+	// an address in the domain are listed.
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=domain:example.com")
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(searches, gc.DeepEquals, []string{"example.com"})
+	c.Assert(string(body), gc.Matches, `(?s)info:1:1\n.*uid:alice <alice@example.com>:.*`)
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=domain:mail.example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+// testKeywordMatcher is storage which combines the words of keyword
+// searches as asked, except by matching substrings.
+type testKeywordMatcher struct {
+	*mock.Storage
+	matches []storage.KeywordMatch
+}
+
+func (m *testKeywordMatcher) MatchKeywords(search []string, match storage.KeywordMatch) ([]string, error) {
+	m.matches = append(m.matches, match)
+	if match == storage.MatchSubstring {
+		return nil, storage.ErrKeywordMatchNotAvailable
+	}
+	return []string{testKeyDefault.rfp}, nil
+}
+
+func (s *HandlerSuite) TestDefaultMatch(c *gc.C) {
+	_, err := NewHandler(s.storage, DefaultMatch("some"))
+	c.Assert(err, gc.ErrorMatches, `invalid default match "some"`)
+
+	m := &testKeywordMatcher{Storage: s.storage}
+	r := httprouter.New()
+	handler, err := NewHandler(m, DefaultMatch("fuzzy"))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, t := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"&match=phrase", http.StatusOK},
+		{"&match=substring", http.StatusBadRequest},
+	} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=alice" + t.query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, t.status, gc.Commentf("%s", t.query))
+	}
+	c.Assert(m.matches, gc.DeepEquals, []storage.KeywordMatch{storage.MatchFuzzy, storage.MatchPhrase, storage.MatchSubstring})
+}
+
+func (s *HandlerSuite) TestOrder(c *gc.C) {
+	alice := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	tails := openpgp.MustReadArmorKeys(testing.MustInput("tails.asc"))[0]
+	c.Assert(alice.Creation.After(tails.Creation), gc.Equals, true)
+	st := mock.NewStorage(
+		mock.MatchKeyword(func([]string) ([]string, error) {
+			return []string{tails.RFingerprint, alice.RFingerprint}, nil
+		}),
+		// Keys are fetched in a different order from that in which they
+		// were found.
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{alice, tails}, nil
+		}),
+		mock.ModTimes(func([]string) (map[string]time.Time, error) {
+			return map[string]time.Time{
+				alice.RFingerprint: time.Unix(1500000000, 0),
+				tails.RFingerprint: time.Unix(1600000000, 0),
+			}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, t := range []struct {
+		query string
+		first *openpgp.PrimaryKey
+	}{
+		{"", tails},
+		{"&order=relevance", tails},
+		{"&order=created", alice},
+		{"&order=mtime", tails},
+		{"&order=created&limit=1&offset=1", tails},
+	} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=developers" + t.query)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		lines := strings.Split(string(body), "\n")
+		c.Assert(lines[1], gc.Matches, "pub:"+strings.ToUpper(t.first.KeyID())+":.*", gc.Commentf("%s", t.query))
+	}
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&search=developers&order=size")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	// Storage which pages through matches orders them too.
+	pager := &testKeywordPager{Storage: s.storage, total: 1}
+	r = httprouter.New()
+	handler, err = NewHandler(pager)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv = httptest.NewServer(r)
+	defer srv.Close()
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&search=alice&order=mtime")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(pager.orders, gc.DeepEquals, []storage.ResultOrder{storage.OrderModified})
+}
+
+type testSearchProvider struct {
+	queries []string
+	err     error
+}
+
+func (sp *testSearchProvider) Index([]*openpgp.PrimaryKey) error { return nil }
+func (sp *testSearchProvider) RemoveDigests([]string) error      { return nil }
+func (sp *testSearchProvider) Search(query string, limit int) ([]string, error) {
+	sp.queries = append(sp.queries, query)
+	if sp.err != nil {
+		return nil, sp.err
+	}
+	return []string{testKeyDefault.rfp}, nil
+}
+
+func (s *HandlerSuite) TestSearchProvider(c *gc.C) {
+	sp := &testSearchProvider{}
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, SearchProvider(sp))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(sp.queries, gc.DeepEquals, []string{"alice"})
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
+
+	// Key IDs are resolved by storage.
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.sid)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(sp.queries, gc.HasLen, 1)
+
+	// Storage is searched if the search provider fails.
+	sp.err = errors.New("unavailable")
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestContentSecurityPolicy(c *gc.C) {
+	tk := testKeyDefault
+	policy := "default-src 'none'"
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, ContentSecurityPolicy(policy))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&search=0x" + tk.sid)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Security-Policy"), gc.Equals, policy)
+	c.Assert(res.Header.Get("X-Content-Type-Options"), gc.Equals, "nosniff")
+
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=index&search=0x" + tk.sid)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.Header.Get("Content-Security-Policy"), gc.Equals, "")
+}
+
+func (s *HandlerSuite) TestSafeURL(c *gc.C) {
+	for _, testCase := range []struct {
+		in, out string
+	}{
+		{"https://example.com/photo.jpg", "https://example.com/photo.jpg"},
+		{"data:image/jpeg;base64,AAAA", "data:image/jpeg;base64,AAAA"},
+		{"data:text/html;base64,AAAA", "about:invalid#zGotmplZ"},
+		{"javascript:alert(1)", "about:invalid#zGotmplZ"},
+	} {
+		u, err := url.Parse(testCase.in)
+		c.Assert(err, gc.IsNil)
+		c.Check(string(safeURL(u)), gc.Equals, testCase.out, gc.Commentf("%s", testCase.in))
+	}
+	c.Check(string(safeURL(nil)), gc.Equals, "about:invalid#zGotmplZ")
+}
+
+func (s *HandlerSuite) TestShortKeyURL(c *gc.C) {
+	tk := testKeyDefault
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+		c.Assert(err, gc.IsNil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		doc, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		return res, doc
+	}
+
+	res, doc := get("/key/"+strings.ToUpper(tk.fp), "")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/pgp-keys")
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(doc))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, key.RFingerprint)
+
+	res, doc = get("/key/0x"+tk.fp, "application/octet-stream")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/octet-stream")
+	keys = openpgp.MustReadKeys(bytes.NewBuffer(doc))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, key.RFingerprint)
+
+	res, doc = get("/key/"+tk.fp, "application/json;q=0.9, */*;q=0.1")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var result []*jsonhkp.PrimaryKey
+	c.Assert(json.Unmarshal(doc, &result), gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0].Fingerprint, gc.Equals, tk.fp)
+
+	res, _ = get("/key/"+tk.sid, "")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestShortEmailURL(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/email/Alice@Example.com")
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(openpgp.MustReadArmorKeys(bytes.NewBuffer(doc)), gc.HasLen, 1)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 1)
+
+	// The keyword search may match loosely, but only keys with the address
+	// are served.
+	res, err = http.Get(s.srv.URL + "/email/bob@example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	res, err = http.Get(s.srv.URL + "/email/alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestAttestation(c *gc.C) {
+	signer, err := xopenpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	attestor, err := NewAttestor(signer, func() (*Attestation, error) {
+		return &Attestation{Hostname: "keys.example.com", NumKeys: 42, Peers: []string{"peer1"}}, nil
+	})
+	c.Assert(err, gc.IsNil)
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Attestations(attestor))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/attestation")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusServiceUnavailable)
+
+	c.Assert(attestor.Refresh(), gc.IsNil)
+	res, err = http.Get(srv.URL + "/pks/attestation")
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	block, _ := clearsign.Decode(doc)
+	c.Assert(block, gc.NotNil)
+	_, err = xopenpgp.CheckDetachedSignature(xopenpgp.EntityList{signer},
+		bytes.NewBuffer(block.Bytes), block.ArmoredSignature.Body, nil)
+	c.Assert(err, gc.IsNil)
+	var att Attestation
+	c.Assert(json.Unmarshal(block.Plaintext, &att), gc.IsNil)
+	c.Assert(att.NumKeys, gc.Equals, 42)
+	c.Assert(att.Peers, gc.DeepEquals, []string{"peer1"})
+
+	res, err = http.Get(s.srv.URL + "/pks/attestation")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestVerifiedAddresses(c *gc.C) {
+	signer, err := xopenpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	verified := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	var imported []storage.VerifiedAddress
+	st := mock.NewStorage(
+		mock.VerifiedSince(func(t time.Time, limit int) ([]storage.VerifiedAddress, error) {
+			return []storage.VerifiedAddress{{
+				RFingerprint: testKeyDefault.rfp, Address: "alice@example.com", Verified: verified,
+			}, {
+				RFingerprint: testKeyDefault.rfp, Address: "bob@example.com", Verified: verified,
+			}, {
+				RFingerprint: testKeyBadSigs.rfp, Address: "alice@example.com", Verified: verified,
+			}}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+		mock.SetVerified(func(addrs []storage.VerifiedAddress) error {
+			imported = addrs
+			return nil
+		}),
+	)
+
+	r := httprouter.New()
+	handler, err := NewHandler(st, VerifiedAddressExport(signer, "keys.example.com"),
+		VerifiedAddressPeer("keys.example.com", xopenpgp.EntityList{signer}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/verified?since=2020-01-01T00:00:00Z")
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(st.MethodCount("VerifiedSince"), gc.Equals, 1)
+
+	block, _ := clearsign.Decode(doc)
+	c.Assert(block, gc.NotNil)
+	var export VerificationExport
+	c.Assert(json.Unmarshal(block.Plaintext, &export), gc.IsNil)
+	c.Assert(export.Issuer, gc.Equals, "keys.example.com")
+	c.Assert(export.More, gc.Equals, false)
+	c.Assert(export.Addresses, gc.HasLen, 3)
+	c.Assert(export.Addresses[0], gc.Equals, ExportedAddress{
+		Address:     "alice@example.com",
+		Fingerprint: testKeyDefault.fp,
+		Verified:    "2020-09-13T12:26:40Z",
+	})
+
+	// Only addresses in user IDs of stored keys are imported.
+	res, err = http.Post(srv.URL+"/pks/verified", "text/plain", bytes.NewBuffer(doc))
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", body))
+	var resp VerificationImportResponse
+	c.Assert(json.Unmarshal(body, &resp), gc.IsNil)
+	c.Assert(resp, gc.Equals, VerificationImportResponse{Imported: 1, Ignored: 2})
+	c.Assert(imported, gc.DeepEquals, []storage.VerifiedAddress{{
+		RFingerprint: testKeyDefault.rfp,
+		Address:      "alice@example.com",
+		Verified:     verified,
+		Source:       "keys.example.com",
+	}})
+
+	// Exports signed by other keys are refused.
+	other, err := xopenpgp.NewEntity("other", "", "other@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, other.PrivateKey, nil)
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(block.Plaintext)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Close(), gc.IsNil)
+	res, err = http.Post(srv.URL+"/pks/verified", "text/plain", &buf)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(st.MethodCount("SetVerified"), gc.Equals, 1)
+
+	// Exports issued by another keyserver, or by none, are refused even
+	// when signed by the peer, so that the addresses cannot be attributed
+	// to another source, nor to this keyserver.
+	sign := func(issuer string) *bytes.Buffer {
+		export.Issuer = issuer
+		plaintext, err := json.Marshal(&export)
+		c.Assert(err, gc.IsNil)
+		var buf bytes.Buffer
+		w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+		c.Assert(err, gc.IsNil)
+		_, err = w.Write(plaintext)
+		c.Assert(err, gc.IsNil)
+		c.Assert(w.Close(), gc.IsNil)
+		return &buf
+	}
+	for _, issuer := range []string{"other.example.com", ""} {
+		res, err = http.Post(srv.URL+"/pks/verified", "text/plain", sign(issuer))
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden, gc.Commentf("issuer %q", issuer))
+	}
+	c.Assert(st.MethodCount("SetVerified"), gc.Equals, 1)
+
+	// Addresses imported from keys without a configured peer are
+	// attributed to the signer's fingerprint, whatever the issuer.
+	handler, err = NewHandler(st, VerifiedAddressImport(xopenpgp.EntityList{signer}))
+	c.Assert(err, gc.IsNil)
+	r = httprouter.New()
+	handler.Register(r)
+	importSrv := httptest.NewServer(r)
+	defer importSrv.Close()
+	res, err = http.Post(importSrv.URL+"/pks/verified", "text/plain", sign("keys.example.com"))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(imported, gc.HasLen, 1)
+	c.Assert(imported[0].Source, gc.Equals, hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+	res, err = http.Post(importSrv.URL+"/pks/verified", "text/plain", sign(""))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+
+	// Not configured.
+	res, err = http.Get(s.srv.URL + "/pks/verified")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestVerify(c *gc.C) {
+	var verified []storage.VerifiedAddress
+	consumed := map[string]bool{}
+	st := mock.NewStorage(
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+		mock.ConsumeToken(func(id string, now time.Time) (bool, error) {
+			if consumed[id] {
+				return false, nil
+			}
+			consumed[id] = true
+			return true, nil
+		}),
+		mock.SetVerified(func(addrs []storage.VerifiedAddress) error {
+			verified = append(verified, addrs...)
+			return nil
+		}),
+	)
+	tokens, err := storage.NewTokens(st, bytes.Repeat([]byte("k"), 32))
+	c.Assert(err, gc.IsNil)
+
+	r := httprouter.New()
+	handler, err := NewHandler(st, VerificationTokens(tokens))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	token, err := tokens.Issue(storage.TokenVerify, "alice@example.com", testKeyDefault.fp, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/verify", url.Values{"token": {token}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(verified, gc.HasLen, 1)
+	c.Assert(verified[0].RFingerprint, gc.Equals, testKeyDefault.rfp)
+	c.Assert(verified[0].Address, gc.Equals, "alice@example.com")
+	c.Assert(verified[0].Source, gc.Equals, "")
+
+	// Replayed.
+	res, err = http.PostForm(srv.URL+"/pks/verify", url.Values{"token": {token}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusConflict)
+
+	// Address no longer on the key.
+	token, err = tokens.Issue(storage.TokenVerify, "bob@example.com", testKeyDefault.fp, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/verify", url.Values{"token": {token}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	res, err = http.PostForm(srv.URL+"/pks/verify", url.Values{"token": {"bogus"}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(verified, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestVKSLookup(c *gc.C) {
+	tk := testKeyDefault
+	for _, path := range []string{
+		"/vks/v1/by-fingerprint/" + strings.ToUpper(tk.fp),
+		"/vks/v1/by-keyid/" + strings.ToUpper(tk.fp[24:]),
+		"/vks/v1/by-email/alice%40example.com",
+	} {
+		res, err := http.Get(s.srv.URL + path)
+		c.Assert(err, gc.IsNil)
+		doc, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", path))
+		c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/pgp-keys")
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(doc))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].Fingerprint(), gc.Equals, tk.fp)
+	}
+
+	for path, status := range map[string]int{
+		"/vks/v1/by-email/bob%40example.com": http.StatusNotFound,
+		"/vks/v1/by-email/alice":             http.StatusBadRequest,
+		"/vks/v1/by-fingerprint/0x" + tk.fp:  http.StatusBadRequest,
+		"/vks/v1/by-keyid/" + tk.sid:         http.StatusBadRequest,
+	} {
+		res, err := http.Get(s.srv.URL + path)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, status, gc.Commentf("%s", path))
+	}
+}
+
+type testVerificationSender struct {
+	addresses []string
+	tokens    []string
+}
+
+func (t *testVerificationSender) SendVerification(address, fingerprint, token string) error {
+	t.addresses = append(t.addresses, address)
+	t.tokens = append(t.tokens, token)
+	return nil
+}
+
+func (s *HandlerSuite) TestVKSUpload(c *gc.C) {
+	var verified []storage.VerifiedAddress
+	var sources []string
+	st := mock.NewStorage(
+		mock.InsertToken(func(issued storage.IssuedToken) error {
+			sources = append(sources, issued.Source)
+			return nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+		mock.VerifiedAddresses(func(rfp string) ([]storage.VerifiedAddress, error) {
+			return verified, nil
+		}),
+		mock.ConsumeToken(func(id string, now time.Time) (bool, error) {
+			return true, nil
+		}),
+		mock.SetVerified(func(addrs []storage.VerifiedAddress) error {
+			verified = append(verified, addrs...)
+			return nil
+		}),
+	)
+	tokens, err := storage.NewTokens(st, bytes.Repeat([]byte("k"), 32))
+	c.Assert(err, gc.IsNil)
+	sender := &testVerificationSender{}
+
+	r := httprouter.New()
+	handler, err := NewHandler(st, VerificationTokens(tokens), VerificationMail(sender),
+		ClientIP(func(*http.Request) net.IP { return net.ParseIP("192.0.2.7") }))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	post := func(target string, req interface{}) (int, *VKSUploadResponse) {
+		body, err := json.Marshal(req)
+		c.Assert(err, gc.IsNil)
+		res, err := http.Post(target, "application/json", bytes.NewReader(body))
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+		var resp VKSUploadResponse
+		if res.StatusCode == http.StatusOK {
+			c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+		}
+		return res.StatusCode, &resp
+	}
+
+	keytext, err := ioutil.ReadAll(testing.MustInput(testKeyDefault.file))
+	c.Assert(err, gc.IsNil)
+	status, resp := post(srv.URL+"/vks/v1/upload", &VKSUploadRequest{Keytext: string(keytext)})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(resp.KeyFingerprint, gc.Equals, strings.ToUpper(testKeyDefault.fp))
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": VKSUnpublished})
+	c.Assert(resp.Token, gc.Not(gc.Equals), "")
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 1)
+
+	// Verification is only requested for unverified addresses on the key.
+	status, resp = post(srv.URL+"/vks/v1/request-verify", &VKSVerifyRequest{
+		Token:     resp.Token,
+		Addresses: []string{"Alice@example.com", "bob@example.com"},
+	})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": VKSPending})
+	c.Assert(sender.addresses, gc.DeepEquals, []string{"alice@example.com"})
+	// The token is limited by the address of the client found by ClientIP,
+	// not that of the connection.
+	_, err = tokens.Issue(storage.TokenVerify, "alice@example.com", testKeyDefault.fp, "192.0.2.7")
+	c.Assert(err, gc.IsNil)
+	c.Assert(sources, gc.HasLen, 2)
+	c.Assert(sources[0], gc.Equals, sources[1])
+
+	res, err := http.Get(srv.URL + "/pks/verify?token=" + sender.tokens[0])
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(verified, gc.HasLen, 0)
+	res, err = http.PostForm(srv.URL+"/pks/verify", url.Values{"token": {sender.tokens[0]}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(verified, gc.HasLen, 1)
+
+	status, resp = post(srv.URL+"/vks/v1/upload", &VKSUploadRequest{Keytext: string(keytext)})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": VKSPublished})
+	status, _ = post(srv.URL+"/vks/v1/request-verify", &VKSVerifyRequest{
+		Token:     resp.Token,
+		Addresses: []string{"alice@example.com"},
+	})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(sender.addresses, gc.HasLen, 1)
+
+	status, _ = post(srv.URL+"/vks/v1/request-verify", &VKSVerifyRequest{Token: "bogus"})
+	c.Assert(status, gc.Equals, http.StatusBadRequest)
+	status, _ = post(srv.URL+"/vks/v1/upload", &VKSUploadRequest{Keytext: "bogus"})
+	c.Assert(status, gc.Equals, http.StatusBadRequest)
+
+	// Without verification configured, keys are uploaded without a token.
+	status, resp = post(s.srv.URL+"/vks/v1/upload", &VKSUploadRequest{Keytext: string(keytext)})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(resp.Token, gc.Equals, "")
+	status, _ = post(s.srv.URL+"/vks/v1/request-verify", &VKSVerifyRequest{Token: "bogus"})
+	c.Assert(status, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestWKDHash(c *gc.C) {
+	// Example from draft-koch-openpgp-webkey-service section 3.1.
+	c.Assert(wkdHash("Joe.Doe"), gc.Equals, "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+}
+
+func (s *HandlerSuite) TestWKD(c *gc.C) {
+	va := storage.VerifiedAddress{
+		RFingerprint: testKeyDefault.rfp, Address: "alice@example.com", Verified: time.Unix(1600000000, 0),
+	}
+	verified := []storage.VerifiedAddress{va}
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{testKeyDefault.fp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+		mock.VerifiedAddresses(func(rfp string) ([]storage.VerifiedAddress, error) {
+			return verified, nil
+		}),
+		mock.VerifiedSince(func(t time.Time, limit int) ([]storage.VerifiedAddress, error) {
+			return verified, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, WKDDomains([]string{"Example.com"}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(host, path string) (int, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		c.Assert(err, gc.IsNil)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		doc, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		return res.StatusCode, doc
+	}
+
+	hash := wkdHash("alice")
+	for _, req := range []struct{ host, path string }{
+		{"example.com", "/.well-known/openpgpkey/hu/" + hash + "?l=Alice"},
+		{"example.com:443", "/.well-known/openpgpkey/hu/" + hash},
+		{"openpgpkey.example.com", "/.well-known/openpgpkey/example.com/hu/" + hash},
+	} {
+		status, doc := get(req.host, req.path)
+		c.Assert(status, gc.Equals, http.StatusOK, gc.Commentf("%s%s", req.host, req.path))
+		keys := openpgp.MustReadKeys(bytes.NewBuffer(doc))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].Fingerprint(), gc.Equals, testKeyDefault.fp)
+		c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+		c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "alice <alice@example.com>")
+	}
+	status, _ := get("openpgpkey.example.com", "/.well-known/openpgpkey/example.com/policy")
+	c.Assert(status, gc.Equals, http.StatusOK)
+
+	for _, req := range []struct{ host, path string }{
+		{"example.org", "/.well-known/openpgpkey/hu/" + hash},
+		{"example.com", "/.well-known/openpgpkey/hu/" + hash + "?l=bob"},
+		{"example.com", "/.well-known/openpgpkey/hu/" + wkdHash("bob")},
+		{"example.com", "/.well-known/openpgpkey/hu/bogus"},
+	} {
+		status, _ := get(req.host, req.path)
+		c.Assert(status, gc.Equals, http.StatusNotFound, gc.Commentf("%s%s", req.host, req.path))
+	}
+
+	// Keys are not served for addresses which have not been verified.
+	verified = nil
+	status, _ = get("example.com", "/.well-known/openpgpkey/hu/"+hash+"?l=alice")
+	c.Assert(status, gc.Equals, http.StatusNotFound)
+
+	// Nor by a keyserver without domains configured.
+	res, err := http.Get(s.srv.URL + "/.well-known/openpgpkey/hu/" + hash + "?l=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestHeadGet(c *gc.C) {
+	tk := testKeyDefault
+	mtime := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{tk.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+		mock.ModTimes(func(rfps []string) (map[string]time.Time, error) {
+			return map[string]time.Time{tk.rfp: mtime}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// The response to HEAD has the headers of that to GET, but no body.
+	for _, op := range []string{"get", "index", "index&options=mr"} {
+		url := srv.URL + "/pks/lookup?op=" + op + "&search=0x" + tk.fp
+		res, err := http.Get(url)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+		head, err := http.Head(url)
+		c.Assert(err, gc.IsNil)
+		head.Body.Close()
+		c.Assert(head.StatusCode, gc.Equals, http.StatusOK)
+		for _, h := range []string{"ETag", "Last-Modified", "X-HKP-Total-Results", "X-Content-Type-Options"} {
+			c.Assert(head.Header.Get(h), gc.Equals, res.Header.Get(h))
+		}
+	}
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+	res, err := http.Head(srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "text/plain")
+	c.Assert(res.Header.Get("ETag"), gc.Equals, `"`+key.MD5+`"`)
+	c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Sun, 13 Sep 2020 12:26:40 GMT")
+
+	// Conditional requests are answered as for GET.
+	req, err := http.NewRequest("HEAD", srv.URL+"/pks/lookup?op=get&search=0x"+tk.fp, nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("If-None-Match", `"`+key.MD5+`"`)
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+
+	// Errors are localized as for GET.
+	req, err = http.NewRequest("HEAD", srv.URL+"/pks/lookup?op=get", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Accept-Language", "de")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(res.Header.Get("Content-Language"), gc.Equals, "de")
+
+	// Other operations are only served by GET.
+	res, err = http.Head(srv.URL + "/pks/lookup?op=stats")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusMethodNotAllowed)
+	c.Assert(res.Header.Get("Allow"), gc.Equals, "GET")
+}
+
+func (s *HandlerSuite) TestGetConditional(c *gc.C) {
+	tk := testKeyDefault
+	mtime := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{tk.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+		mock.ModTimes(func(rfps []string) (map[string]time.Time, error) {
+			return map[string]time.Time{tk.rfp: mtime}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(header, value string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+"/pks/lookup?op=get&search=0x"+tk.fp, nil)
+		c.Assert(err, gc.IsNil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		return res, body
+	}
+
+	res, body := get("", "")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, gc.Equals, `"`+key.MD5+`"`)
+	c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Sun, 13 Sep 2020 12:26:40 GMT")
+	c.Assert(body, gc.Not(gc.HasLen), 0)
+
+	for _, t := range []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", "Sun, 13 Sep 2020 12:26:40 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Sun, 13 Sep 2020 12:26:39 GMT", http.StatusOK},
+		{"If-Modified-Since", "not a date", http.StatusOK},
+	} {
+		comment := gc.Commentf("%s: %s", t.header, t.value)
+		res, body = get(t.header, t.value)
+		c.Assert(res.StatusCode, gc.Equals, t.status, comment)
+		c.Assert(res.Header.Get("ETag"), gc.Equals, etag, comment)
+		if t.status == http.StatusNotModified {
+			c.Assert(body, gc.HasLen, 0, comment)
+		}
+	}
+
+	// Short URLs are not conditional.
+	res, err = http.Get(srv.URL + "/key/" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), gc.Equals, "")
+}
+
+func (s *HandlerSuite) TestGetContinuation(c *gc.C) {
+	tk := testKeyDefault
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, MaxServeLength(1))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, []*openpgp.PrimaryKey) {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp + query)
+		c.Assert(err, gc.IsNil)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		if res.StatusCode != http.StatusOK {
+			return res, nil
+		}
+		return res, openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	}
+
+	res, keys := get("")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Continuation"), gc.Equals, "1")
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.Not(gc.HasLen), 0)
+
+	res, keys = get("&continuation=1")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Continuation"), gc.Equals, "")
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.HasLen, 0)
+
+	res, _ = get("&continuation=2")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func signPush(c *gc.C, signer *xopenpgp.Entity, push *Push) []byte {
+	doc, err := json.Marshal(push)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(doc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Close(), gc.IsNil)
+	return buf.Bytes()
+}
+
+func (s *HandlerSuite) TestPush(c *gc.C) {
+	signer, err := xopenpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	var submissions []string
+	st := mock.NewStorage(
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return nil, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st,
+		PushPeers(&PushPeer{Name: "peer", Keyring: xopenpgp.EntityList{signer}}),
+		SubmissionFunc(func(source string, kc storage.KeyChange, err error) {
+			submissions = append(submissions, source)
+		}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Keys changed on the pushing keyserver are inserted.
+	sender := mock.NewStorage(
+		mock.MatchMD5(func(md5s []string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+	)
+	pusher, err := NewPusher(sender, signer, "keys.example.com", []string{srv.URL})
+	c.Assert(err, gc.IsNil)
+	pusher.keyChanged(storage.KeyAdded{ID: "decafbad", Digest: "cafebabe"})
+	pusher.Flush()
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 1)
+	c.Assert(submissions, gc.DeepEquals, []string{"push:peer"})
+
+	post := func(body []byte) int {
+		res, err := http.Post(srv.URL+"/pks/push", "text/plain", bytes.NewReader(body))
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	// Pushes may not be replayed.
+	body := signPush(c, signer, &Push{Version: PushVersion, Time: now})
+	c.Assert(post(body), gc.Equals, http.StatusOK)
+	c.Assert(post(body), gc.Equals, http.StatusForbidden)
+
+	// Nor sent long ago.
+	stale := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	c.Assert(post(signPush(c, signer, &Push{Version: PushVersion, Time: stale})), gc.Equals, http.StatusForbidden)
+
+	// The peer may not delete keys.
+	c.Assert(post(signPush(c, signer, &Push{Version: PushVersion, Time: now,
+		Deleted: []string{testKeyDefault.fp}})), gc.Equals, http.StatusForbidden)
+	c.Assert(st.MethodCount("Delete"), gc.Equals, 0)
+
+	// Pushes signed by other keys are refused.
+	other, err := xopenpgp.NewEntity("other", "", "other@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048})
+	c.Assert(err, gc.IsNil)
+	c.Assert(post(signPush(c, other, &Push{Version: PushVersion, Time: now})), gc.Equals, http.StatusForbidden)
+
+	// Not configured.
+	res, err := http.Post(s.srv.URL+"/pks/push", "text/plain", bytes.NewReader(body))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestSubKeyLookup(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{testKeyBadSigs.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyBadSigs.file)), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, []*openpgp.PrimaryKey) {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&" + query)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		keys, err := openpgp.ReadArmorKeys(res.Body)
+		c.Assert(err, gc.IsNil)
+		c.Assert(keys, gc.HasLen, 1)
+		return res, keys
+	}
+
+	// Lookups by subkey ID identify the subkey matched.
+	res, keys := get("search=0xD6166803B9817A82")
+	c.Assert(res.Header.Get("X-HKP-Matched-Subkey"), gc.Matches, ".*D6166803B9817A82")
+	c.Assert(res.Header.Get("X-HKP-Subkey-Binding"), gc.Equals, "valid")
+	c.Assert(keys[0].SubKeys, gc.HasLen, 2)
+
+	// Only the matching subkey is served if requested.
+	res, keys = get("search=0xD6166803B9817A82&options=subkey")
+	c.Assert(keys[0].SubKeys, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys[0].Fingerprint(), gc.Matches, ".*d6166803b9817a82")
+
+	// Lookups by the primary key ID are unaffected.
+	res, keys = get("search=0x" + testKeyBadSigs.sid + "&options=subkey")
+	c.Assert(res.Header.Get("X-HKP-Matched-Subkey"), gc.Equals, "")
+	c.Assert(keys[0].SubKeys, gc.HasLen, 2)
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0xD6166803B9817A82")
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	var wireKeys []*jsonhkp.PrimaryKey
+	c.Assert(json.Unmarshal(doc, &wireKeys), gc.IsNil)
+	c.Assert(wireKeys, gc.HasLen, 1)
+	c.Assert(wireKeys[0].MatchedSubKey, gc.NotNil)
+	c.Assert(wireKeys[0].MatchedSubKey.Fingerprint, gc.Matches, ".*d6166803b9817a82")
+	c.Assert(wireKeys[0].MatchedSubKey.Binding, gc.Equals, "valid")
+}
+
+type ownerNotification struct {
+	addrs     []string
+	violation *LimitViolation
+}
+
+type testOwnerNotifier struct {
+	sent []ownerNotification
+}
+
+func (n *testOwnerNotifier) NotifyOwner(addrs []string, v *LimitViolation) error {
+	n.sent = append(n.sent, ownerNotification{addrs: addrs, violation: v})
+	return nil
+}
+
+func (s *HandlerSuite) TestAddSoftLimits(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	alice := openpgp.MustReadArmorKeys(bytes.NewBuffer(keytext))[0]
+
+	add := func(limits *SoftLimits) (*mock.Storage, *AddResponse, map[string]string) {
+		metadata := map[string]string{}
+		st := mock.NewStorage(
+			mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+				return nil, storage.ErrKeyNotFound
+			}),
+			mock.Metadata(func(rfps []string) (map[string]map[string]string, error) {
+				return map[string]map[string]string{alice.RFingerprint: metadata}, nil
+			}),
+			mock.SetMetadata(func(rfp, name, value string) error {
+				c.Assert(rfp, gc.Equals, alice.RFingerprint)
+				metadata[name] = value
+				return nil
+			}),
+			mock.VerifiedAddresses(func(rfp string) ([]storage.VerifiedAddress, error) {
+				return []storage.VerifiedAddress{{RFingerprint: rfp, Address: "alice@example.com"}}, nil
+			}),
+		)
+		r := httprouter.New()
+		handler, err := NewHandler(st, Limits(limits))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{string(keytext)},
+		})
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var addRes AddResponse
+		c.Assert(json.NewDecoder(res.Body).Decode(&addRes), gc.IsNil)
+		return st, &addRes, metadata
+	}
+
+	// Keys exceeding the limits are refused.
+	st, addRes, _ := add(&SoftLimits{MaxSignatures: 1, Mode: LimitsReject})
+	c.Assert(addRes.Ignored, gc.HasLen, 1)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+
+	// Keys within the limits are accepted.
+	st, addRes, _ = add(&SoftLimits{MaxSignatures: 100, Mode: LimitsReject})
+	c.Assert(addRes.Inserted, gc.HasLen, 1)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 1)
+
+	// Until enforced, keys exceeding the limits are accepted, and their
+	// owners notified.
+	notifier := &testOwnerNotifier{}
+	enforceAfter := time.Now().Add(30 * 24 * time.Hour)
+	st, addRes, metadata := add(&SoftLimits{MaxSignatures: 1, Mode: LimitsWarn, EnforceAfter: enforceAfter, Notifier: notifier})
+	c.Assert(addRes.Inserted, gc.HasLen, 1)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 1)
+	c.Assert(metadata[limitViolationMetadata], gc.Matches, "[0-9]+ signatures exceeds 1")
+	c.Assert(metadata[limitNotifiedMetadata], gc.Not(gc.Equals), "")
+	c.Assert(notifier.sent, gc.HasLen, 1)
+	c.Assert(notifier.sent[0].addrs, gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(notifier.sent[0].violation.Fingerprint, gc.Equals, alice.Fingerprint())
+	c.Assert(notifier.sent[0].violation.EnforceAfter.Equal(enforceAfter), gc.Equals, true)
+
+	// After the enforcement date, they are refused.
+	st, addRes, _ = add(&SoftLimits{MaxSignatures: 1, Mode: LimitsWarn, EnforceAfter: time.Now().Add(-time.Hour), Notifier: notifier})
+	c.Assert(addRes.Ignored, gc.HasLen, 1)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(notifier.sent, gc.HasLen, 1)
+
+	_, err = NewHandler(mock.NewStorage(), Limits(&SoftLimits{Mode: LimitsWarn}))
+	c.Assert(err, gc.NotNil)
+}
@@ -0,0 +1,69 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Marshal returns the canonical JSON serialization of v, for storing key
+// documents. Object members are sorted by name at every level, there is no
+// insignificant whitespace and HTML characters are not escaped, so documents
+// with the same content serialize to the same bytes, however they were
+// produced and even after a round trip through a store which reorders
+// members, such as PostgreSQL's JSONB.
+func Marshal(v interface{}) ([]byte, error) {
+	doc, err := encode(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Decode into generic values, whose object members encoding/json
+	// writes in sorted order, rather than in struct field order.
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var generic interface{}
+	err = dec.Decode(&generic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	doc, err = encode(generic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return doc, nil
+}
+
+// Canonicalize returns the canonical serialization of the JSON document doc.
+func Canonicalize(doc []byte) ([]byte, error) {
+	return Marshal(json.RawMessage(doc))
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	// Encode terminates each value with a newline.
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,121 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"bytes"
+	"encoding/json"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type CanonicalSuite struct{}
+
+var _ = gc.Suite(&CanonicalSuite{})
+
+func (s *CanonicalSuite) TestMarshal(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	doc, err := Marshal(NewPrimaryKey(key))
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.HasPrefix(doc, []byte(`{"algorithm":{"code":1,"name":"rsa"},"bitLength":`)), gc.Equals, true, gc.Commentf("%s", doc))
+	c.Assert(bytes.Contains(doc, []byte("\n")), gc.Equals, false)
+	c.Assert(bytes.Contains(doc, []byte("<alice@example.com>")), gc.Equals, true)
+
+	// The document survives a round trip unchanged.
+	var pk PrimaryKey
+	err = json.Unmarshal(doc, &pk)
+	c.Assert(err, gc.IsNil)
+	doc2, err := Marshal(&pk)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(doc2), gc.Equals, string(doc))
+
+	canonical, err := Canonicalize(doc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(canonical), gc.Equals, string(doc))
+}
+
+func (s *CanonicalSuite) TestCanonicalize(c *gc.C) {
+	// Members reordered and whitespace added, as by JSONB normalization or
+	// a pretty-printer.
+	doc, err := Canonicalize([]byte(`{
+		"md5": "abc",
+		"length": 1.50,
+		"b": [ {"y": true, "x": null} ],
+		"a": "<&>"
+	}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(doc), gc.Equals, `{"a":"<&>","b":[{"x":null,"y":true}],"length":1.50,"md5":"abc"}`)
+}
+
+func (s *CanonicalSuite) TestProvenance(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	doc, err := Marshal(NewPrimaryKey(key))
+	c.Assert(err, gc.IsNil)
+
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	openpgp.SetProvenance(key, "recon", seen)
+	sig := key.UserIDs[0].Signatures[0]
+	sig.Provenance = openpgp.Provenance{FirstSeen: seen.Add(time.Hour), Source: "direct"}
+
+	// Provenance is only included when recorded for storage.
+	served, err := Marshal(NewPrimaryKey(key))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(served), gc.Equals, string(doc))
+	pk := NewPrimaryKey(key)
+	pk.RecordProvenance(key)
+	stored, err := Marshal(pk)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(stored, []byte(`"firstSeen":"2020-01-02T03:04:05Z"`)), gc.Equals, true)
+
+	var storedPK PrimaryKey
+	err = json.Unmarshal(stored, &storedPK)
+	c.Assert(err, gc.IsNil)
+	read := openpgp.MustReadKeys(storedPK.Reader())[0]
+	storedPK.RestoreProvenance(read)
+	for _, pkt := range read.Packets() {
+		if pkt.UUID == sig.UUID {
+			c.Assert(pkt.Provenance, gc.DeepEquals, sig.Provenance)
+		} else {
+			c.Assert(pkt.Provenance, gc.DeepEquals, openpgp.Provenance{FirstSeen: seen, Source: "recon"})
+		}
+	}
+}
+
+func (s *CanonicalSuite) TestEncryptionFeatures(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("seipdv2.asc"))[0]
+	pk := NewPrimaryKey(key)
+	c.Assert(pk.Encryption, gc.DeepEquals, &EncryptionFeatures{
+		SEIPDv1:          true,
+		SEIPDv2:          true,
+		AEADCiphersuites: []string{"AES256/OCB", "AES256/GCM", "AES128/OCB"},
+	})
+	sig := pk.UserIDs[0].Signatures[0]
+	c.Assert(sig.Features, gc.DeepEquals, []string{"seipdv1", "seipdv2"})
+	c.Assert(sig.AEADCiphersuites, gc.DeepEquals, []string{"AES256/OCB", "AES256/GCM", "AES128/OCB"})
+
+	doc, err := Marshal(pk)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(doc, []byte(`"encryption":{"aeadCiphersuites":["AES256/OCB","AES256/GCM","AES128/OCB"],"seipdv1":true,"seipdv2":true}`)), gc.Equals, true, gc.Commentf("%s", doc))
+}
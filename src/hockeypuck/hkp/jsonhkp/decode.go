@@ -0,0 +1,179 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// DecodePackets reads the packets of a key from its document read from r,
+// one packet at a time, leaving out the members which describe them. Only
+// the fingerprint and packet members of the returned PrimaryKey are set,
+// which is enough for Reader and RestoreProvenance. Unlike decoding the
+// whole document, no more of the document is held in memory than the
+// packet being read, so that reading a key flooded with signatures takes
+// little more memory than its packets.
+func DecodePackets(r io.Reader) (*PrimaryKey, error) {
+	dec := json.NewDecoder(r)
+	pk := &PrimaryKey{PublicKey: &PublicKey{}}
+	err := decodeObject(dec, func(name string) error {
+		switch name {
+		case "fingerprint":
+			return dec.Decode(&pk.Fingerprint)
+		case "subKeys":
+			return decodeArray(dec, func() error {
+				sk := &SubKey{PublicKey: &PublicKey{}}
+				pk.SubKeys = append(pk.SubKeys, sk)
+				return decodeObject(dec, func(name string) error {
+					return decodePacketMember(dec, name, &sk.Packet, &sk.Signatures, &sk.Unsupported)
+				})
+			})
+		case "userIDs":
+			return decodeArray(dec, func() error {
+				uid := &UserID{}
+				pk.UserIDs = append(pk.UserIDs, uid)
+				return decodeObject(dec, func(name string) error {
+					return decodePacketMember(dec, name, &uid.Packet, &uid.Signatures, &uid.Unsupported)
+				})
+			})
+		case "userAttrs":
+			return decodeArray(dec, func() error {
+				uat := &UserAttribute{}
+				pk.UserAttrs = append(pk.UserAttrs, uat)
+				return decodeObject(dec, func(name string) error {
+					return decodePacketMember(dec, name, &uat.Packet, &uat.Signatures, &uat.Unsupported)
+				})
+			})
+		}
+		return decodePacketMember(dec, name, &pk.Packet, &pk.Signatures, &pk.Unsupported)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pk, nil
+}
+
+// decodePacketMember decodes the member name of an object which carries
+// packets, or skips it if it carries none.
+func decodePacketMember(dec *json.Decoder, name string, packet **Packet, sigs *[]*Signature, unsupported *[]*Packet) error {
+	switch name {
+	case "packet":
+		return dec.Decode(packet)
+	case "signatures":
+		return decodeArray(dec, func() error {
+			var sig Signature
+			err := dec.Decode(&sig)
+			if err != nil {
+				return err
+			}
+			*sigs = append(*sigs, &Signature{Packet: sig.Packet})
+			return nil
+		})
+	case "unsupported":
+		return decodeArray(dec, func() error {
+			var p Packet
+			err := dec.Decode(&p)
+			if err != nil {
+				return err
+			}
+			*unsupported = append(*unsupported, &p)
+			return nil
+		})
+	}
+	return skipValue(dec)
+}
+
+// decodeObject reads an object from dec, calling member with the name of
+// each member, which must consume its value.
+func decodeObject(dec *json.Decoder, member func(name string) error) error {
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, ok := tok.(string)
+		if !ok {
+			return errors.Errorf("expected member name, got %v", tok)
+		}
+		err = member(name)
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray reads an array from dec, or null, calling elem for each
+// element, which must consume it.
+func decodeArray(dec *json.Decoder, elem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return errors.Errorf("expected array, got %v", tok)
+	}
+	for dec.More() {
+		err = elem()
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// skipValue reads past the next value of dec, token by token.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return errors.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
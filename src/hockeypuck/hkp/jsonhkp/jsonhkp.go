@@ -18,9 +18,33 @@
 // Package jsonhkp defines an arbitrary, Hockeypuck-specific, JSON-friendly
 // document model for representation of OpenPGP key material. Intended to be
 // used by front-end Javascript as well as server-side HTML template developers.
+//
+// The document is also served to programs by /pks/lookup with op=index or
+// op=vindex and options=json, as an array of PrimaryKey objects. Times are
+// RFC 3339 strings in UTC, and members which are false or empty are omitted.
+// Each key object has:
+//
+//	fingerprint, longKeyID, shortKeyID  hex identifiers of the key
+//	algorithm                           {"name": ..., "code": ...}
+//	bitLength                           size of the key in bits
+//	creation                            creation time of the key
+//	expires                             when the key expires, if it does
+//	revoked                             true if the key has been revoked
+//	userIDs                             user IDs, each with keywords (the
+//	                                    user ID itself), revoked, verified
+//	                                    (time the address was verified) and
+//	                                    signatures
+//	subKeys                             subkeys, each with the public key
+//	                                    members above and the expires and
+//	                                    revoked state of its binding
+//	userAttrs                           user attributes such as photos
+//
+// The raw packets of the key are given base64-encoded in the packet members
+// of each object, from which consumers may verify the rest.
 package jsonhkp
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -36,6 +60,10 @@ type Packet struct {
 	Tag    uint8  `json:"tag"`
 	Data   []byte `json:"data"`
 	Parsed bool   `json:"parsed"`
+
+	// Provenance of the packet, recorded only in stored documents.
+	FirstSeen string `json:"firstSeen,omitempty"`
+	Source    string `json:"source,omitempty"`
 }
 
 func NewPacket(from *openpgp.Packet) *Packet {
@@ -107,6 +135,79 @@ type PrimaryKey struct {
 	SubKeys   []*SubKey        `json:"subKeys,omitempty"`
 	UserIDs   []*UserID        `json:"userIDs,omitempty"`
 	UserAttrs []*UserAttribute `json:"userAttrs,omitempty"`
+
+	PreferredKeyserver string `json:"preferredKeyserver,omitempty"`
+
+	// Revoked is set if the key has been revoked by a valid self-signature.
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Expires is the time at which the key expires, as given by its key
+	// packet or its self-signatures, or empty if it does not.
+	Expires string `json:"expires,omitempty"`
+
+	// Encryption are the encryption capabilities advertised by the key's
+	// latest self-certification, if any.
+	Encryption *EncryptionFeatures `json:"encryption,omitempty"`
+
+	// Metadata attached to the key by the keyserver operator, if exposed.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// AmbiguousKeyID is set on each key found by a key ID lookup that
+	// matched more than one key.
+	AmbiguousKeyID bool `json:"ambiguousKeyID,omitempty"`
+
+	// MatchedSubKey is set on a key found by the key ID of one of its
+	// subkeys.
+	MatchedSubKey *MatchedSubKey `json:"matchedSubKey,omitempty"`
+}
+
+// EncryptionFeatures are the encryption capabilities advertised by a key,
+// such as support for SEIPDv2 with the AEAD ciphersuites of RFC 9580.
+type EncryptionFeatures struct {
+	SEIPDv1          bool     `json:"seipdv1,omitempty"`
+	SEIPDv2          bool     `json:"seipdv2,omitempty"`
+	AEADCiphersuites []string `json:"aeadCiphersuites,omitempty"`
+}
+
+func newEncryptionFeatures(from *openpgp.EncryptionFeatures) *EncryptionFeatures {
+	if from == nil {
+		return nil
+	}
+	return &EncryptionFeatures{
+		SEIPDv1:          from.SEIPDv1,
+		SEIPDv2:          from.SEIPDv2,
+		AEADCiphersuites: aeadCiphersuiteNames(from.AEADCiphersuites),
+	}
+}
+
+func aeadCiphersuiteNames(from []openpgp.AEADCiphersuite) []string {
+	var result []string
+	for _, cs := range from {
+		result = append(result, cs.String())
+	}
+	return result
+}
+
+// featureNames returns the names of the flags set in a features subpacket.
+func featureNames(flags []byte) []string {
+	if len(flags) == 0 {
+		return nil
+	}
+	var result []string
+	if flags[0]&openpgp.FeatureSEIPDv1 != 0 {
+		result = append(result, "seipdv1")
+	}
+	if flags[0]&openpgp.FeatureSEIPDv2 != 0 {
+		result = append(result, "seipdv2")
+	}
+	return result
+}
+
+// MatchedSubKey identifies the subkey by which a key was found, and the
+// state of its binding to the primary key.
+type MatchedSubKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Binding     string `json:"binding"`
 }
 
 func NewPrimaryKeys(froms []*openpgp.PrimaryKey) []*PrimaryKey {
@@ -122,12 +223,23 @@ func NewPrimaryKey(from *openpgp.PrimaryKey) *PrimaryKey {
 		PublicKey: newPublicKey(&from.PublicKey),
 		MD5:       from.MD5,
 		Length:    from.Length,
+
+		PreferredKeyserver: openpgp.PreferredKeyserver(from),
+		Encryption:         newEncryptionFeatures(openpgp.KeyEncryptionFeatures(from)),
+		Expires:            formatTime(from.ExpiresAt()),
 	}
+	selfsigs, _ := from.SigInfo()
+	_, to.Revoked = selfsigs.RevokedSince()
 	for _, fromSubKey := range from.SubKeys {
-		to.SubKeys = append(to.SubKeys, NewSubKey(fromSubKey))
+		subKey := NewSubKey(fromSubKey)
+		subKey.setStatus(from, fromSubKey)
+		to.SubKeys = append(to.SubKeys, subKey)
 	}
 	for _, fromUid := range from.UserIDs {
-		to.UserIDs = append(to.UserIDs, NewUserID(fromUid))
+		uid := NewUserID(fromUid)
+		uidSelfSigs, _ := fromUid.SigInfo(from)
+		_, uid.Revoked = uidSelfSigs.RevokedSince()
+		to.UserIDs = append(to.UserIDs, uid)
 	}
 	for _, fromUat := range from.UserAttributes {
 		to.UserAttrs = append(to.UserAttrs, NewUserAttribute(fromUat))
@@ -148,16 +260,47 @@ func (pk *PrimaryKey) Serialize(w io.Writer) error {
 
 type SubKey struct {
 	*PublicKey
+
+	// Revoked is set if the subkey's binding has been revoked.
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Expires is the time at which the subkey's binding expires, or empty
+	// if it does not.
+	Expires string `json:"expires,omitempty"`
 }
 
 func NewSubKey(from *openpgp.SubKey) *SubKey {
 	return &SubKey{
-		newPublicKey(&from.PublicKey),
+		PublicKey: newPublicKey(&from.PublicKey),
+	}
+}
+
+// setStatus sets the revocation and expiration of the subkey from its
+// binding to pubkey.
+func (sk *SubKey) setStatus(pubkey *openpgp.PrimaryKey, from *openpgp.SubKey) {
+	selfsigs, _ := from.SigInfo(pubkey)
+	_, sk.Revoked = selfsigs.RevokedSince()
+	if !from.Expiration.IsZero() {
+		sk.Expires = formatTime(from.Expiration)
+	} else if t, ok := selfsigs.ExpiresAt(); ok {
+		sk.Expires = formatTime(t)
 	}
 }
 
+// formatTime formats t for a document, or returns the empty string if t is
+// zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
 type UserID struct {
 	Keywords    string       `json:"keywords"`
+	Verified    string       `json:"verified,omitempty"`
+	Revoked     bool         `json:"revoked,omitempty"`
+	Homograph   bool         `json:"homograph,omitempty"`
 	Packet      *Packet      `json:"packet,omitempty"`
 	Signatures  []*Signature `json:"signatures,omitempty"`
 	Unsupported []*Packet    `json:"unsupported,omitempty"`
@@ -165,8 +308,9 @@ type UserID struct {
 
 func NewUserID(from *openpgp.UserID) *UserID {
 	to := &UserID{
-		Keywords: from.Keywords,
-		Packet:   NewPacket(&from.Packet),
+		Keywords:  from.Keywords,
+		Homograph: openpgp.MixedScript(from.Keywords),
+		Packet:    NewPacket(&from.Packet),
 	}
 	for _, fromSig := range from.Signatures {
 		to.Signatures = append(to.Signatures, NewSignature(fromSig))
@@ -226,6 +370,20 @@ type Signature struct {
 	Expiration   string  `json:"expiration,omitempty"`
 	NeverExpires bool    `json:"neverExpires,omitempty"`
 	Packet       *Packet `json:"packet,omitempty"`
+
+	PreferredKeyserver string `json:"preferredKeyserver,omitempty"`
+
+	IssuerFingerprint string `json:"issuerFingerprint,omitempty"`
+
+	Features         []string `json:"features,omitempty"`
+	AEADCiphersuites []string `json:"aeadCiphersuites,omitempty"`
+
+	// SignerFingerprint is the fingerprint of the key that made a third-party
+	// certification, if that key is known to the keyserver and the
+	// certification was verified with it.
+	SignerFingerprint string `json:"signerFingerprint,omitempty"`
+
+	Embedded []*Signature `json:"embedded,omitempty"`
 }
 
 func NewSignature(from *openpgp.Signature) *Signature {
@@ -234,6 +392,14 @@ func NewSignature(from *openpgp.Signature) *Signature {
 		SigType:     from.SigType,
 		IssuerKeyID: from.IssuerKeyID(),
 		Primary:     from.Primary,
+
+		PreferredKeyserver: from.PreferredKeyserver,
+		IssuerFingerprint:  from.IssuerFingerprint,
+		Features:           featureNames(from.Features),
+		AEADCiphersuites:   aeadCiphersuiteNames(from.AEADCiphersuites),
+	}
+	for _, embedded := range from.Embedded {
+		to.Embedded = append(to.Embedded, NewSignature(embedded))
 	}
 
 	switch to.SigType {
@@ -255,6 +421,63 @@ func NewSignature(from *openpgp.Signature) *Signature {
 	return to
 }
 
+// RecordProvenance copies the provenance of the packets of from, which pk
+// represents, into pk for storage. NewPrimaryKey omits provenance, so that
+// it is not served to clients.
+func (pk *PrimaryKey) RecordProvenance(from *openpgp.PrimaryKey) {
+	provenance := map[string]openpgp.Provenance{}
+	for _, pkt := range from.Packets() {
+		if !pkt.Provenance.IsZero() {
+			provenance[string(pkt.Packet)] = pkt.Provenance
+		}
+	}
+	if len(provenance) == 0 {
+		return
+	}
+	for _, pkt := range pk.packets() {
+		if pv, ok := provenance[string(pkt.Data)]; ok {
+			if !pv.FirstSeen.IsZero() {
+				pkt.FirstSeen = pv.FirstSeen.UTC().Format(time.RFC3339)
+			}
+			pkt.Source = pv.Source
+		}
+	}
+}
+
+// RestoreProvenance sets the provenance of the packets of to, read from the
+// stored document pk, to that recorded in pk.
+func (pk *PrimaryKey) RestoreProvenance(to *openpgp.PrimaryKey) {
+	provenance := map[string]openpgp.Provenance{}
+	for _, pkt := range pk.packets() {
+		if pkt.FirstSeen == "" && pkt.Source == "" {
+			continue
+		}
+		pv := openpgp.Provenance{Source: pkt.Source}
+		if t, err := time.Parse(time.RFC3339, pkt.FirstSeen); err == nil {
+			pv.FirstSeen = t
+		}
+		provenance[string(pkt.Data)] = pv
+	}
+	if len(provenance) == 0 {
+		return
+	}
+	for _, pkt := range to.Packets() {
+		if pv, ok := provenance[string(pkt.Packet)]; ok {
+			pkt.Provenance = pv
+		}
+	}
+}
+
+// Reader returns a reader over the key's packets, without first copying them
+// into a single buffer.
+func (pk *PrimaryKey) Reader() io.Reader {
+	var readers []io.Reader
+	for _, pkt := range pk.packets() {
+		readers = append(readers, bytes.NewReader(pkt.Data))
+	}
+	return io.MultiReader(readers...)
+}
+
 func (pk *PrimaryKey) Bytes() []byte {
 	var buf []byte
 	for _, pkt := range pk.packets() {
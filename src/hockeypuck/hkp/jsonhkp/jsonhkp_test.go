@@ -0,0 +1,102 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type JSONHKPSuite struct{}
+
+var _ = gc.Suite(&JSONHKPSuite{})
+
+func newKey(c *gc.C, name string) *PrimaryKey {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput(name))
+	c.Assert(keys, gc.HasLen, 1)
+	return NewPrimaryKey(keys[0])
+}
+
+func (s *JSONHKPSuite) TestRevoked(c *gc.C) {
+	key := newKey(c, "test-key-revoked.asc")
+	c.Assert(key.Revoked, gc.Equals, true)
+	c.Assert(key.Expires, gc.Equals, "2023-01-23T13:22:53Z")
+
+	key = newKey(c, "lp1195901.asc")
+	c.Assert(key.Revoked, gc.Equals, false)
+	c.Assert(key.Expires, gc.Equals, "")
+	revoked := map[string]bool{}
+	for _, uid := range key.UserIDs {
+		revoked[uid.Keywords] = uid.Revoked
+	}
+	c.Assert(revoked["Phil Pennock <pdp@spodhuis.demon.nl>"], gc.Equals, true)
+	c.Assert(revoked["Phil Pennock <pdp@exim.org>"], gc.Equals, false)
+}
+
+func (s *JSONHKPSuite) TestExpires(c *gc.C) {
+	key := newKey(c, "tails.asc")
+	c.Assert(key.Expires, gc.Equals, "2015-02-05T09:04:59Z")
+
+	// Version 3 keys carry their expiration in the key packet.
+	key = newKey(c, "0xd46b7c827be290fe4d1f9291b1ebc61a.asc")
+	c.Assert(key.Expires, gc.Equals, key.Expiration)
+	c.Assert(key.Expires, gc.Not(gc.Equals), "")
+
+	key = newKey(c, "alice_signed.asc")
+	c.Assert(key.Expires, gc.Equals, "")
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	c.Assert(key.SubKeys[0].Revoked, gc.Equals, false)
+	c.Assert(key.SubKeys[0].Expires, gc.Equals, "")
+}
+
+func (s *JSONHKPSuite) TestDecodePackets(c *gc.C) {
+	for _, name := range []string{"alice_signed.asc", "uat.asc", "lp1195901.asc", "0xd46b7c827be290fe4d1f9291b1ebc61a.asc"} {
+		key := openpgp.MustReadArmorKeys(testing.MustInput(name))[0]
+		openpgp.SetProvenance(key, "recon", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+		pk := NewPrimaryKey(key)
+		pk.RecordProvenance(key)
+		doc, err := Marshal(pk)
+		c.Assert(err, gc.IsNil)
+
+		// The members of the document are sorted by name, not in the
+		// order of the packets they carry.
+		var whole PrimaryKey
+		c.Assert(json.Unmarshal(doc, &whole), gc.IsNil)
+		decoded, err := DecodePackets(bytes.NewReader(doc))
+		c.Assert(err, gc.IsNil, gc.Commentf("%s", name))
+		c.Assert(decoded.Fingerprint, gc.Equals, key.Fingerprint())
+		c.Assert(decoded.Bytes(), gc.DeepEquals, whole.Bytes(), gc.Commentf("%s", name))
+
+		read := openpgp.MustReadKeys(decoded.Reader())[0]
+		decoded.RestoreProvenance(read)
+		for _, pkt := range read.Packets() {
+			c.Assert(pkt.Provenance.Source, gc.Equals, "recon")
+		}
+	}
+
+	_, err := DecodePackets(bytes.NewReader([]byte(`{"packet": [}`)))
+	c.Assert(err, gc.NotNil)
+	_, err = DecodePackets(bytes.NewReader([]byte(`[]`)))
+	c.Assert(err, gc.NotNil)
+}
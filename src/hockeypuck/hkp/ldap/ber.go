@@ -0,0 +1,192 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The subset of the Basic Encoding Rules used by LDAP, RFC 4511 section
+// 5.1: single-octet tags and definite lengths only.
+
+// Universal tags.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+)
+
+// element is a BER-encoded value.
+type element struct {
+	tag  byte
+	body []byte
+}
+
+// constructed returns whether the element contains other elements.
+func (e element) constructed() bool {
+	return e.tag&0x20 != 0
+}
+
+// readElement reads a single element from r, refusing bodies longer than
+// maxLen.
+func readElement(r *bufio.Reader, maxLen int) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	n, err := readLength(r)
+	if err != nil {
+		return element{}, err
+	}
+	if n > maxLen {
+		return element{}, errors.Errorf("message length %d exceeds limit %d", n, maxLen)
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return element{}, err
+	}
+	return element{tag: tag, body: body}, nil
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b&0x80 == 0 {
+		return int(b), nil
+	}
+	octets := int(b & 0x7f)
+	if octets == 0 || octets > 4 {
+		return 0, errors.Errorf("unsupported length encoding %#x", b)
+	}
+	var n int
+	for i := 0; i < octets; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | int(b)
+	}
+	if n < 0 {
+		return 0, errors.New("invalid length")
+	}
+	return n, nil
+}
+
+// children parses the contents of a constructed element.
+func (e element) children() ([]element, error) {
+	var result []element
+	buf := e.body
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, errors.New("truncated element")
+		}
+		tag := buf[0]
+		n, octets := int(buf[1]), 1
+		if buf[1]&0x80 != 0 {
+			octets = 1 + int(buf[1]&0x7f)
+			if octets == 1 || octets > 5 || len(buf) < 1+octets {
+				return nil, errors.New("invalid length")
+			}
+			n = 0
+			for _, b := range buf[2 : 1+octets] {
+				n = n<<8 | int(b)
+			}
+		}
+		start := 1 + octets
+		if n < 0 || n > len(buf)-start {
+			return nil, errors.New("truncated element")
+		}
+		result = append(result, element{tag: tag, body: buf[start : start+n]})
+		buf = buf[start+n:]
+	}
+	return result, nil
+}
+
+// int returns the value of an INTEGER or ENUMERATED element.
+func (e element) int() (int, error) {
+	if len(e.body) == 0 || len(e.body) > 4 {
+		return 0, errors.Errorf("invalid integer length %d", len(e.body))
+	}
+	n := int(int8(e.body[0]))
+	for _, b := range e.body[1:] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+// bool returns the value of a BOOLEAN element.
+func (e element) bool() bool {
+	return len(e.body) > 0 && e.body[0] != 0
+}
+
+// encode returns the encoding of an element with the given contents.
+func encode(tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	buf := append(make([]byte, 0, n+6), tag)
+	switch {
+	case n < 0x80:
+		buf = append(buf, byte(n))
+	case n <= 0xff:
+		buf = append(buf, 0x81, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x82, byte(n>>8), byte(n))
+	case n <= 0xffffff:
+		buf = append(buf, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeInt(tag byte, n int) []byte {
+	var body []byte
+	for {
+		body = append([]byte{byte(n)}, body...)
+		if (n >= -0x80 && n < 0x80) || len(body) == 4 {
+			break
+		}
+		n >>= 8
+	}
+	return encode(tag, body)
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0})
+}
@@ -0,0 +1,191 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+// Attributes of the PGP LDAP schema served, as read by PGP and by GnuPG's
+// dirmngr, together with the gpg attributes GnuPG uses to find keys by
+// fingerprint and address.
+const (
+	attrObjectClass    = "objectclass"
+	attrCertID         = "pgpcertid"
+	attrKeyID          = "pgpkeyid"
+	attrSubKeyID       = "pgpsubkeyid"
+	attrUserID         = "pgpuserid"
+	attrKey            = "pgpkey"
+	attrKeyType        = "pgpkeytype"
+	attrKeySize        = "pgpkeysize"
+	attrKeyCreateTime  = "pgpkeycreatetime"
+	attrKeyExpireTime  = "pgpkeyexpiretime"
+	attrRevoked        = "pgprevoked"
+	attrDisabled       = "pgpdisabled"
+	attrFingerprint    = "gpgfingerprint"
+	attrSubFingerprint = "gpgsubfingerprint"
+	attrMailbox        = "gpgmailbox"
+
+	attrNamingContexts   = "namingcontexts"
+	attrBaseKeySpaceDN   = "pgpbasekeyspacedn"
+	attrSoftware         = "pgpsoftware"
+	attrVersion          = "pgpversion"
+	attrSupportedVersion = "supportedldapversion"
+)
+
+// attrNames are the names attributes are returned by, in the case of the
+// schema.
+var attrNames = map[string]string{
+	attrObjectClass:      "objectClass",
+	attrCertID:           "pgpCertID",
+	attrKeyID:            "pgpKeyID",
+	attrSubKeyID:         "pgpSubKeyID",
+	attrUserID:           "pgpUserID",
+	attrKey:              "pgpKey",
+	attrKeyType:          "pgpKeyType",
+	attrKeySize:          "pgpKeySize",
+	attrKeyCreateTime:    "pgpKeyCreateTime",
+	attrKeyExpireTime:    "pgpKeyExpireTime",
+	attrRevoked:          "pgpRevoked",
+	attrDisabled:         "pgpDisabled",
+	attrFingerprint:      "gpgFingerprint",
+	attrSubFingerprint:   "gpgSubFingerprint",
+	attrMailbox:          "gpgMailbox",
+	attrNamingContexts:   "namingContexts",
+	attrBaseKeySpaceDN:   "pgpBaseKeySpaceDN",
+	attrSoftware:         "pgpSoftware",
+	attrVersion:          "pgpVersion",
+	attrSupportedVersion: "supportedLDAPVersion",
+}
+
+// entryOrder is the order in which the attributes of an entry are returned.
+var entryOrder = []string{
+	attrObjectClass, attrNamingContexts, attrSupportedVersion, attrBaseKeySpaceDN, attrSoftware, attrVersion,
+	attrCertID, attrKeyID, attrFingerprint, attrSubKeyID, attrSubFingerprint, attrUserID, attrMailbox,
+	attrKeyType, attrKeySize, attrKeyCreateTime, attrKeyExpireTime, attrRevoked, attrDisabled, attrKey,
+}
+
+// entry is a directory entry, with attribute values keyed by lower-cased
+// name.
+type entry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// ldapTime formats a time as an LDAP GeneralizedTime.
+func ldapTime(t time.Time) string {
+	return t.UTC().Format("20060102150405Z")
+}
+
+// keyType returns the pgpKeyType of a key, in which PGP distinguishes RSA
+// keys from DSA keys with ElGamal subkeys.
+func keyType(key *openpgp.PrimaryKey) string {
+	switch name := openpgp.AlgorithmName(key.Algorithm); name {
+	case "rsa":
+		return "RSA"
+	case "dsa", "elg":
+		return "DSS/DH"
+	default:
+		return strings.ToUpper(name)
+	}
+}
+
+// keyEntry returns the entry of a key in the key space, with the key
+// armored in pgpKey as written under the serve policy.
+func (s *Server) keyEntry(key *openpgp.PrimaryKey) (*entry, error) {
+	var buf bytes.Buffer
+	err := s.keyWriter.WriteArmored(&buf, []*openpgp.PrimaryKey{key}, s.keyWriterOptions...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to write key %s", key.Fingerprint())
+	}
+
+	keyID := strings.ToUpper(key.KeyID())
+	attrs := map[string][]string{
+		attrObjectClass:   {"pgpKeyInfo"},
+		attrCertID:        {keyID},
+		attrKeyID:         {keyID[len(keyID)-8:]},
+		attrFingerprint:   {strings.ToUpper(key.Fingerprint())},
+		attrKeyType:       {keyType(key)},
+		attrKeySize:       {fmt.Sprintf("%05d", key.BitLen)},
+		attrKeyCreateTime: {ldapTime(key.Creation)},
+		attrDisabled:      {"0"},
+		attrKey:           {buf.String()},
+	}
+
+	selfsigs, _ := key.SigInfo()
+	if _, revoked := selfsigs.RevokedSince(); revoked {
+		attrs[attrRevoked] = []string{"1"}
+	} else {
+		attrs[attrRevoked] = []string{"0"}
+	}
+	if t := key.ExpiresAt(); !t.IsZero() {
+		attrs[attrKeyExpireTime] = []string{ldapTime(t)}
+	}
+	for _, subkey := range key.SubKeys {
+		attrs[attrSubKeyID] = append(attrs[attrSubKeyID], strings.ToUpper(subkey.KeyID()))
+		attrs[attrSubFingerprint] = append(attrs[attrSubFingerprint], strings.ToUpper(subkey.Fingerprint()))
+	}
+	for _, uid := range key.UserIDs {
+		attrs[attrUserID] = append(attrs[attrUserID], uid.Keywords)
+		if addr := storage.UserIDAddress(uid.Keywords); addr != "" {
+			attrs[attrMailbox] = append(attrs[attrMailbox], addr)
+		}
+	}
+	return &entry{
+		dn:    attrNames[attrCertID] + "=" + keyID + "," + s.keySpaceDN(),
+		attrs: attrs,
+	}, nil
+}
+
+// encode returns the SearchResultEntry of the entry for a search
+// requesting the given attributes, all of them if none are given.
+func (e *entry) encode(attrs []string, typesOnly bool) []byte {
+	requested := map[string]bool{}
+	for _, attr := range attrs {
+		requested[strings.ToLower(attr)] = true
+	}
+	all := len(requested) == 0 || requested["*"]
+
+	var partials [][]byte
+	for _, name := range entryOrder {
+		values, ok := e.attrs[name]
+		if !ok || (!all && !requested[name]) {
+			continue
+		}
+		var encoded [][]byte
+		if !typesOnly {
+			for _, v := range values {
+				encoded = append(encoded, encodeString(tagOctetString, v))
+			}
+		}
+		partials = append(partials, encode(tagSequence,
+			encodeString(tagOctetString, attrNames[name]),
+			encode(tagSet, encoded...)))
+	}
+	return encode(opSearchResultEntry,
+		encodeString(tagOctetString, e.dn),
+		encode(tagSequence, partials...))
+}
@@ -0,0 +1,273 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// Filter choices, RFC 4511 section 4.5.1.
+const (
+	filterAnd        = 0xa0
+	filterOr         = 0xa1
+	filterNot        = 0xa2
+	filterEquality   = 0xa3
+	filterSubstrings = 0xa4
+	filterGreater    = 0xa5
+	filterLess       = 0xa6
+	filterPresent    = 0x87
+	filterApprox     = 0xa8
+)
+
+// Substring choices.
+const (
+	substringInitial = 0x80
+	substringAny     = 0x81
+	substringFinal   = 0x82
+)
+
+// maxFilterDepth limits the nesting of filters a client may send.
+const maxFilterDepth = 16
+
+// filter is a parsed search filter. Attribute names and values are
+// lower-cased, as all the attributes served are matched without regard to
+// case.
+type filter struct {
+	op       byte
+	children []*filter
+	attr     string
+	value    string
+	// Substrings of a substrings filter; initial and final are empty if
+	// the value may begin or end with anything.
+	initial, final string
+	any            []string
+}
+
+func parseFilter(e element, depth int) (*filter, error) {
+	if depth > maxFilterDepth {
+		return nil, errors.New("filter nested too deeply")
+	}
+	f := &filter{op: e.tag}
+	switch e.tag {
+	case filterAnd, filterOr, filterNot:
+		children, err := e.children()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if e.tag == filterNot && len(children) != 1 {
+			return nil, errors.New("invalid not filter")
+		}
+		for _, child := range children {
+			cf, err := parseFilter(child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			f.children = append(f.children, cf)
+		}
+	case filterEquality, filterGreater, filterLess, filterApprox:
+		children, err := e.children()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(children) != 2 {
+			return nil, errors.New("invalid attribute value assertion")
+		}
+		f.attr, f.value = lower(children[0].body), lower(children[1].body)
+	case filterSubstrings:
+		children, err := e.children()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(children) != 2 {
+			return nil, errors.New("invalid substrings filter")
+		}
+		f.attr = lower(children[0].body)
+		subs, err := children[1].children()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, sub := range subs {
+			switch sub.tag {
+			case substringInitial:
+				f.initial = lower(sub.body)
+			case substringAny:
+				f.any = append(f.any, lower(sub.body))
+			case substringFinal:
+				f.final = lower(sub.body)
+			default:
+				return nil, errors.Errorf("invalid substring choice %#x", sub.tag)
+			}
+		}
+	case filterPresent:
+		f.attr = lower(e.body)
+	default:
+		// Extensible matches are not supported, and match nothing.
+	}
+	return f, nil
+}
+
+func lower(b []byte) string {
+	return strings.ToLower(string(b))
+}
+
+// match returns whether an entry with the given attributes, keyed by
+// lower-cased name, matches the filter.
+func (f *filter) match(attrs map[string][]string) bool {
+	switch f.op {
+	case filterAnd:
+		for _, child := range f.children {
+			if !child.match(attrs) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range f.children {
+			if child.match(attrs) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !f.children[0].match(attrs)
+	case filterPresent:
+		return len(attrs[f.attr]) > 0
+	}
+	for _, v := range attrs[f.attr] {
+		v = strings.ToLower(v)
+		switch f.op {
+		case filterEquality, filterApprox:
+			if v == f.value {
+				return true
+			}
+		case filterGreater:
+			if v >= f.value {
+				return true
+			}
+		case filterLess:
+			if v <= f.value {
+				return true
+			}
+		case filterSubstrings:
+			if f.matchSubstrings(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *filter) matchSubstrings(v string) bool {
+	if !strings.HasPrefix(v, f.initial) {
+		return false
+	}
+	v = v[len(f.initial):]
+	for _, sub := range f.any {
+		i := strings.Index(v, sub)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(sub):]
+	}
+	return strings.HasSuffix(v, f.final)
+}
+
+// query is a lookup in storage which finds the candidate entries of a
+// filter.
+type query struct {
+	// keyIDs are reversed key IDs or fingerprints to resolve.
+	keyIDs []string
+	// keywords are searched for in user IDs.
+	keywords []string
+}
+
+// query returns the storage lookups which find every key the filter may
+// match, or false if the filter does not narrow the search enough to be
+// answered from storage. Matches are then confirmed with match.
+func (f *filter) query() (*query, bool) {
+	switch f.op {
+	case filterAnd:
+		// Any restricted term will do, as the rest are checked by match.
+		for _, child := range f.children {
+			if q, ok := child.query(); ok {
+				return q, true
+			}
+		}
+		return nil, false
+	case filterOr:
+		if len(f.children) == 0 {
+			return nil, false
+		}
+		result := &query{}
+		for _, child := range f.children {
+			q, ok := child.query()
+			if !ok {
+				return nil, false
+			}
+			result.keyIDs = append(result.keyIDs, q.keyIDs...)
+			result.keywords = append(result.keywords, q.keywords...)
+		}
+		return result, true
+	case filterEquality, filterApprox:
+		switch f.attr {
+		case attrCertID, attrKeyID, attrSubKeyID, attrFingerprint, attrSubFingerprint:
+			if !isHex(f.value) {
+				return nil, false
+			}
+			return &query{keyIDs: []string{openpgp.Reverse(f.value)}}, true
+		case attrUserID, attrMailbox:
+			return &query{keywords: []string{f.value}}, true
+		}
+	case filterSubstrings:
+		if f.attr != attrUserID && f.attr != attrMailbox {
+			return nil, false
+		}
+		// Storage finds user IDs by their words, so the longest substring
+		// is searched for, stripped of the brackets around an address.
+		var longest string
+		for _, s := range append([]string{f.initial, f.final}, f.any...) {
+			s = strings.Trim(s, "<> ")
+			if len(s) > len(longest) {
+				longest = s
+			}
+		}
+		if longest == "" {
+			return nil, false
+		}
+		return &query{keywords: []string{longest}}, true
+	}
+	return nil, false
+}
+
+func isHex(s string) bool {
+	switch len(s) {
+	case 8, 16, 40, 64:
+	default:
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
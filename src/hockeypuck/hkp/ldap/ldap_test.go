@@ -0,0 +1,315 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LDAPSuite struct {
+	storage *mock.Storage
+	ln      net.Listener
+	conn    net.Conn
+	r       *bufio.Reader
+	id      int
+}
+
+var _ = gc.Suite(&LDAPSuite{})
+
+const (
+	aliceFP  = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	aliceRFP = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+)
+
+func (s *LDAPSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			for _, k := range keys {
+				if strings.HasPrefix(aliceRFP, k) {
+					return []string{aliceRFP}, nil
+				}
+			}
+			return nil, nil
+		}),
+		mock.MatchKeyword(func(search []string) ([]string, error) {
+			for _, k := range search {
+				if strings.Contains("alice <alice@example.com>", k) {
+					return []string{aliceRFP}, nil
+				}
+			}
+			return nil, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	var err error
+	s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	go New(s.storage, BaseDN("dc=example,dc=com"), Software("Hockeypuck", "2.1")).Serve(s.ln)
+	s.conn, err = net.Dial("tcp", s.ln.Addr().String())
+	c.Assert(err, gc.IsNil)
+	s.r = bufio.NewReader(s.conn)
+}
+
+func (s *LDAPSuite) TearDownTest(c *gc.C) {
+	s.conn.Close()
+	s.ln.Close()
+}
+
+// request sends an operation and returns the operations of the responses,
+// up to the one with the given tag.
+func (s *LDAPSuite) request(c *gc.C, op []byte, last byte) []element {
+	s.id++
+	_, err := s.conn.Write(encode(tagSequence, encodeInt(tagInteger, s.id), op))
+	c.Assert(err, gc.IsNil)
+	var result []element
+	for {
+		msg, err := readElement(s.r, 1<<20)
+		c.Assert(err, gc.IsNil)
+		parts, err := msg.children()
+		c.Assert(err, gc.IsNil)
+		c.Assert(parts, gc.HasLen, 2)
+		id, err := parts[0].int()
+		c.Assert(err, gc.IsNil)
+		c.Assert(id, gc.Equals, s.id)
+		result = append(result, parts[1])
+		if parts[1].tag == last {
+			return result
+		}
+	}
+}
+
+func resultCode(c *gc.C, op element) int {
+	parts, err := op.children()
+	c.Assert(err, gc.IsNil)
+	code, err := parts[0].int()
+	c.Assert(err, gc.IsNil)
+	return code
+}
+
+func searchRequest(base string, scope int, f []byte, attrs ...string) []byte {
+	var encodedAttrs [][]byte
+	for _, attr := range attrs {
+		encodedAttrs = append(encodedAttrs, encodeString(tagOctetString, attr))
+	}
+	return encode(opSearchRequest,
+		encodeString(tagOctetString, base),
+		encodeInt(tagEnumerated, scope),
+		encodeInt(tagEnumerated, 0),
+		encodeInt(tagInteger, 0),
+		encodeInt(tagInteger, 0),
+		encodeBool(false),
+		f,
+		encode(tagSequence, encodedAttrs...))
+}
+
+func present(attr string) []byte {
+	return encodeString(filterPresent, attr)
+}
+
+func equal(attr, value string) []byte {
+	return encode(filterEquality, encodeString(tagOctetString, attr), encodeString(tagOctetString, value))
+}
+
+func contains(attr, value string) []byte {
+	return encode(filterSubstrings, encodeString(tagOctetString, attr),
+		encode(tagSequence, encodeString(substringAny, value)))
+}
+
+// entryAttrs returns the DN and attributes of a SearchResultEntry.
+func entryAttrs(c *gc.C, op element) (string, map[string][]string) {
+	c.Assert(op.tag, gc.Equals, byte(opSearchResultEntry))
+	parts, err := op.children()
+	c.Assert(err, gc.IsNil)
+	partials, err := parts[1].children()
+	c.Assert(err, gc.IsNil)
+	attrs := map[string][]string{}
+	for _, partial := range partials {
+		tv, err := partial.children()
+		c.Assert(err, gc.IsNil)
+		values, err := tv[1].children()
+		c.Assert(err, gc.IsNil)
+		name := string(tv[0].body)
+		attrs[name] = []string{}
+		for _, v := range values {
+			attrs[name] = append(attrs[name], string(v.body))
+		}
+	}
+	return string(parts[0].body), attrs
+}
+
+func (s *LDAPSuite) TestEncoding(c *gc.C) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 20, 1<<31 - 1} {
+		e := element{tag: tagInteger, body: encodeInt(tagInteger, n)[2:]}
+		v, err := e.int()
+		c.Assert(err, gc.IsNil)
+		c.Assert(v, gc.Equals, n)
+	}
+	for _, n := range []int{0, 127, 128, 255, 256, 70000} {
+		msg := encode(tagSequence, encodeString(tagOctetString, strings.Repeat("x", n)))
+		e, err := readElement(bufio.NewReader(bytes.NewReader(msg)), 1<<20)
+		c.Assert(err, gc.IsNil)
+		children, err := e.children()
+		c.Assert(err, gc.IsNil)
+		c.Assert(children, gc.HasLen, 1)
+		c.Assert(children[0].body, gc.HasLen, n)
+	}
+	_, err := readElement(bufio.NewReader(bytes.NewReader(encodeString(tagOctetString, "xx"))), 1)
+	c.Assert(err, gc.NotNil)
+	_, err = element{tag: tagSequence, body: []byte{tagOctetString, 5, 'x'}}.children()
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *LDAPSuite) TestFilter(c *gc.C) {
+	attrs := map[string][]string{
+		attrUserID:  {"alice <alice@example.com>"},
+		attrRevoked: {"0"},
+		attrCertID:  {"361BC1F023E0DCCA"},
+	}
+	for _, t := range []struct {
+		filter []byte
+		match  bool
+		query  *query
+	}{{
+		filter: equal("pgpCertID", "361bc1f023e0dcca"),
+		match:  true,
+		query:  &query{keyIDs: []string{"accd0e320f1cb163"}},
+	}, {
+		filter: encode(filterAnd, contains("pgpUserID", "<alice@example.com>"),
+			encode(filterNot, encode(filterOr, equal("pgpRevoked", "1"), equal("pgpDisabled", "1")))),
+		match: true,
+		query: &query{keywords: []string{"alice@example.com"}},
+	}, {
+		filter: encode(filterOr, equal("pgpKeyID", "23E0DCCA"), contains("pgpUserID", "bob")),
+		match:  false,
+		query:  &query{keyIDs: []string{"accd0e32"}, keywords: []string{"bob"}},
+	}, {
+		filter: encode(filterSubstrings, encodeString(tagOctetString, "pgpUserID"),
+			encode(tagSequence, encodeString(substringInitial, "ALICE"), encodeString(substringFinal, ".com>"))),
+		match: true,
+		query: &query{keywords: []string{"alice"}},
+	}, {
+		filter: present("pgpUserID"),
+		match:  true,
+	}, {
+		filter: encode(filterOr, equal("pgpCertID", "361bc1f023e0dcca"), present("pgpUserID")),
+		match:  true,
+	}, {
+		filter: equal("pgpCertID", "alice"),
+		match:  false,
+	}} {
+		e, err := readElement(bufio.NewReader(bytes.NewReader(t.filter)), 1<<20)
+		c.Assert(err, gc.IsNil)
+		f, err := parseFilter(e, 0)
+		c.Assert(err, gc.IsNil)
+		c.Assert(f.match(attrs), gc.Equals, t.match)
+		q, ok := f.query()
+		c.Assert(ok, gc.Equals, t.query != nil)
+		if ok {
+			c.Assert(q, gc.DeepEquals, t.query)
+		}
+	}
+
+	deep := present("pgpUserID")
+	for i := 0; i <= maxFilterDepth; i++ {
+		deep = encode(filterNot, deep)
+	}
+	e, err := readElement(bufio.NewReader(bytes.NewReader(deep)), 1<<20)
+	c.Assert(err, gc.IsNil)
+	_, err = parseFilter(e, 0)
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *LDAPSuite) TestSearch(c *gc.C) {
+	resp := s.request(c, encode(opBindRequest, encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, ""), encodeString(0x80, "")), opBindResponse)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultSuccess)
+
+	// GnuPG finds the key space through the root DSE and server info.
+	resp = s.request(c, searchRequest("", scopeBase, present("objectClass"), "namingContexts"), opSearchResultDone)
+	c.Assert(resp, gc.HasLen, 2)
+	_, attrs := entryAttrs(c, resp[0])
+	c.Assert(attrs, gc.DeepEquals, map[string][]string{"namingContexts": {"dc=example,dc=com"}})
+
+	resp = s.request(c, searchRequest("cn=pgpServerInfo, dc=example, dc=com", scopeBase, present("objectClass"),
+		"pgpBaseKeySpaceDN", "pgpSoftware", "pgpVersion"), opSearchResultDone)
+	c.Assert(resp, gc.HasLen, 2)
+	_, attrs = entryAttrs(c, resp[0])
+	c.Assert(attrs, gc.DeepEquals, map[string][]string{
+		"pgpBaseKeySpaceDN": {"ou=PGP Keys,dc=example,dc=com"},
+		"pgpSoftware":       {"Hockeypuck"},
+		"pgpVersion":        {"2.1"},
+	})
+
+	for _, f := range [][]byte{
+		equal("pgpCertID", "361BC1F023E0DCCA"),
+		equal("gpgFingerprint", strings.ToUpper(aliceFP)),
+		encode(filterAnd, contains("pgpUserID", "<alice@example.com>"),
+			encode(filterNot, encode(filterOr, equal("pgpRevoked", "1"), equal("pgpDisabled", "1")))),
+	} {
+		resp = s.request(c, searchRequest("ou=PGP Keys,dc=example,dc=com", 2, f), opSearchResultDone)
+		c.Assert(resp, gc.HasLen, 2)
+		c.Assert(resultCode(c, resp[1]), gc.Equals, resultSuccess)
+		dn, attrs := entryAttrs(c, resp[0])
+		c.Assert(dn, gc.Equals, "pgpCertID=361BC1F023E0DCCA,ou=PGP Keys,dc=example,dc=com")
+		c.Assert(attrs["pgpUserID"], gc.DeepEquals, []string{"alice <alice@example.com>"})
+		c.Assert(attrs["pgpKeyID"], gc.DeepEquals, []string{"23E0DCCA"})
+		c.Assert(attrs["pgpRevoked"], gc.DeepEquals, []string{"0"})
+		keys := openpgp.MustReadArmorKeys(bytes.NewBufferString(attrs["pgpKey"][0]))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].Fingerprint(), gc.Equals, aliceFP)
+	}
+
+	resp = s.request(c, searchRequest("ou=PGP Keys,dc=example,dc=com", 2, contains("pgpUserID", "alice"),
+		"pgpCertID"), opSearchResultDone)
+	c.Assert(resp, gc.HasLen, 2)
+	_, attrs = entryAttrs(c, resp[0])
+	c.Assert(attrs, gc.DeepEquals, map[string][]string{"pgpCertID": {"361BC1F023E0DCCA"}})
+
+	resp = s.request(c, searchRequest("ou=PGP Keys,dc=example,dc=com", 2, equal("pgpCertID", "0000000000000000")),
+		opSearchResultDone)
+	c.Assert(resp, gc.HasLen, 1)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultSuccess)
+
+	// The whole key space cannot be listed.
+	resp = s.request(c, searchRequest("ou=PGP Keys,dc=example,dc=com", 2, present("pgpCertID")), opSearchResultDone)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultUnwillingToPerform)
+
+	resp = s.request(c, searchRequest("dc=example,dc=org", 2, present("pgpCertID")), opSearchResultDone)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultNoSuchObject)
+
+	resp = s.request(c, encode(opDelRequest), opDelResponse)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultUnwillingToPerform)
+
+	resp = s.request(c, encode(opBindRequest, encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, "cn=admin"), encodeString(0x80, "secret")), opBindResponse)
+	c.Assert(resultCode(c, resp[0]), gc.Equals, resultInvalidCredentials)
+}
@@ -0,0 +1,431 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package ldap serves keys over LDAP, for clients which look up keys in a
+// directory rather than by HKP, such as PGP and GnuPG with an ldap://
+// keyserver. The directory is read-only and follows the de-facto PGP LDAP
+// schema: the root DSE names the base DN, under which cn=pgpServerInfo
+// gives the DN of the key space, in which each key is a pgpKeyInfo entry.
+package ldap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Protocol operations, RFC 4511 section 4.2.
+const (
+	opBindRequest       = 0x60
+	opBindResponse      = 0x61
+	opUnbindRequest     = 0x42
+	opSearchRequest     = 0x63
+	opSearchResultEntry = 0x64
+	opSearchResultDone  = 0x65
+	opModifyRequest     = 0x66
+	opModifyResponse    = 0x67
+	opAddRequest        = 0x68
+	opAddResponse       = 0x69
+	opDelRequest        = 0x4a
+	opDelResponse       = 0x6b
+	opModifyDNRequest   = 0x6c
+	opModifyDNResponse  = 0x6d
+	opCompareRequest    = 0x6e
+	opCompareResponse   = 0x6f
+	opAbandonRequest    = 0x50
+	opExtendedRequest   = 0x77
+	opExtendedResponse  = 0x78
+)
+
+// Result codes, RFC 4511 appendix A.
+const (
+	resultSuccess                = 0
+	resultOperationsError        = 1
+	resultProtocolError          = 2
+	resultSizeLimitExceeded      = 4
+	resultAuthMethodNotSupported = 7
+	resultNoSuchObject           = 32
+	resultInvalidCredentials     = 49
+	resultUnwillingToPerform     = 53
+)
+
+// scopeBase is the search scope of a single entry.
+const scopeBase = 0
+
+// writeResponses maps the update operations refused by the read-only
+// directory to their responses.
+var writeResponses = map[byte]byte{
+	opModifyRequest:   opModifyResponse,
+	opAddRequest:      opAddResponse,
+	opDelRequest:      opDelResponse,
+	opModifyDNRequest: opModifyDNResponse,
+	opCompareRequest:  opCompareResponse,
+}
+
+const (
+	// DefaultBaseDN is the base DN of the directory if none is configured.
+	DefaultBaseDN = "o=hockeypuck"
+
+	// DefaultMaxResults is the maximum number of entries returned by a
+	// search if none is configured.
+	DefaultMaxResults = 100
+
+	// DefaultIdleTimeout is how long a connection may be idle before it is
+	// closed, if no timeout is configured.
+	DefaultIdleTimeout = 2 * time.Minute
+
+	// maxMessageLen limits the size of requests, which are all small.
+	maxMessageLen = 64 * 1024
+)
+
+// Server answers LDAP searches for keys in storage.
+type Server struct {
+	storage          storage.Storage
+	baseDN           string
+	software         string
+	version          string
+	maxResults       int
+	idleTimeout      time.Duration
+	keyWriter        *openpgp.KeyWriter
+	keyWriterOptions []openpgp.KeyWriterOption
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// BaseDN sets the base DN of the directory, named in the root DSE. Keys are
+// served under ou=PGP Keys in it.
+func BaseDN(dn string) Option {
+	return func(s *Server) { s.baseDN = dn }
+}
+
+// Software sets the software name and version reported in the server info
+// entry.
+func Software(name, version string) Option {
+	return func(s *Server) { s.software, s.version = name, version }
+}
+
+// MaxResults limits the number of entries returned by a search.
+func MaxResults(n int) Option {
+	return func(s *Server) { s.maxResults = n }
+}
+
+// IdleTimeout sets how long a connection may be idle before it is closed.
+func IdleTimeout(d time.Duration) Option {
+	return func(s *Server) { s.idleTimeout = d }
+}
+
+// ServePolicy sets the policy applied to keys served, as for HKP.
+func ServePolicy(policy ...openpgp.PolicyOption) Option {
+	return func(s *Server) {
+		s.keyWriter = openpgp.NewKeyWriter(append([]openpgp.PolicyOption{openpgp.DropMalformed()}, policy...)...)
+	}
+}
+
+// KeyWriterOptions sets the armor headers of keys served.
+func KeyWriterOptions(options []openpgp.KeyWriterOption) Option {
+	return func(s *Server) { s.keyWriterOptions = options }
+}
+
+// New returns a Server answering searches from st.
+func New(st storage.Storage, options ...Option) *Server {
+	s := &Server{
+		storage:     st,
+		baseDN:      DefaultBaseDN,
+		software:    "Hockeypuck",
+		maxResults:  DefaultMaxResults,
+		idleTimeout: DefaultIdleTimeout,
+		keyWriter:   openpgp.NewKeyWriter(openpgp.DropMalformed()),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// keySpaceDN returns the DN under which keys are served.
+func (s *Server) keySpaceDN() string {
+	return "ou=PGP Keys," + s.baseDN
+}
+
+// serverInfoDN returns the DN of the entry describing the key space.
+func (s *Server) serverInfoDN() string {
+	return "cn=pgpServerInfo," + s.baseDN
+}
+
+// Serve accepts connections on ln until it is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		msg, err := readElement(r, maxMessageLen)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Debugf("ldap %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		parts, err := msg.children()
+		if err != nil || msg.tag != tagSequence || len(parts) < 2 {
+			log.Debugf("ldap %s: invalid message", conn.RemoteAddr())
+			return
+		}
+		id, err := parts[0].int()
+		if err != nil {
+			log.Debugf("ldap %s: invalid message ID: %v", conn.RemoteAddr(), err)
+			return
+		}
+		c := &session{conn: conn, id: id, timeout: s.idleTimeout}
+		op := parts[1]
+		switch op.tag {
+		case opBindRequest:
+			err = c.respond(s.bind(op))
+		case opSearchRequest:
+			err = s.search(c, op)
+		case opUnbindRequest:
+			return
+		case opAbandonRequest:
+			// Searches are answered in full before the next request is
+			// read, so there is nothing to abandon.
+		case opExtendedRequest:
+			err = c.respond(result(opExtendedResponse, resultProtocolError, "", "extended operations are not supported"))
+		default:
+			resp, ok := writeResponses[op.tag]
+			if !ok {
+				log.Debugf("ldap %s: unknown operation %#x", conn.RemoteAddr(), op.tag)
+				return
+			}
+			err = c.respond(result(resp, resultUnwillingToPerform, "", "the directory is read-only"))
+		}
+		if err != nil {
+			log.Debugf("ldap %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// session writes the responses to a request.
+type session struct {
+	conn    net.Conn
+	id      int
+	timeout time.Duration
+}
+
+func (c *session) respond(op []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(encode(tagSequence, encodeInt(tagInteger, c.id), op))
+	return errors.WithStack(err)
+}
+
+// result returns an operation response with the given result.
+func result(op byte, code int, matchedDN, message string) []byte {
+	return encode(op,
+		encodeInt(tagEnumerated, code),
+		encodeString(tagOctetString, matchedDN),
+		encodeString(tagOctetString, message))
+}
+
+// bind accepts anonymous and unauthenticated binds only; there is nothing
+// in the directory to authenticate for.
+func (s *Server) bind(op element) []byte {
+	parts, err := op.children()
+	if err != nil || len(parts) != 3 {
+		return result(opBindResponse, resultProtocolError, "", "invalid bind request")
+	}
+	switch {
+	case parts[2].tag != 0x80:
+		return result(opBindResponse, resultAuthMethodNotSupported, "", "SASL is not supported")
+	case len(parts[2].body) > 0:
+		return result(opBindResponse, resultInvalidCredentials, "", "only anonymous binds are supported")
+	}
+	return result(opBindResponse, resultSuccess, "", "")
+}
+
+// search answers a search request. Entries are written as they are found,
+// followed by the result.
+func (s *Server) search(c *session, op element) error {
+	parts, err := op.children()
+	if err != nil || len(parts) != 8 {
+		return c.respond(result(opSearchResultDone, resultProtocolError, "", "invalid search request"))
+	}
+	scope, err := parts[1].int()
+	if err != nil {
+		return c.respond(result(opSearchResultDone, resultProtocolError, "", "invalid scope"))
+	}
+	sizeLimit, err := parts[3].int()
+	if err != nil {
+		return c.respond(result(opSearchResultDone, resultProtocolError, "", "invalid size limit"))
+	}
+	typesOnly := parts[5].bool()
+	f, err := parseFilter(parts[6], 0)
+	if err != nil {
+		return c.respond(result(opSearchResultDone, resultProtocolError, "", err.Error()))
+	}
+	attrElements, err := parts[7].children()
+	if err != nil {
+		return c.respond(result(opSearchResultDone, resultProtocolError, "", "invalid attribute list"))
+	}
+	var attrs []string
+	for _, attr := range attrElements {
+		attrs = append(attrs, string(attr.body))
+	}
+
+	base := normalizeDN(string(parts[0].body))
+	switch {
+	case base == "" && scope == scopeBase:
+		return s.searchEntry(c, f, attrs, typesOnly, &entry{attrs: map[string][]string{
+			attrObjectClass:      {"top"},
+			attrNamingContexts:   {s.baseDN},
+			attrSupportedVersion: {"3"},
+		}})
+	case (base == normalizeDN(s.serverInfoDN()) || base == "cn=pgpserverinfo") && scope == scopeBase:
+		info := map[string][]string{
+			attrObjectClass:    {"pgpServerInfo"},
+			attrBaseKeySpaceDN: {s.keySpaceDN()},
+			attrSoftware:       {s.software},
+		}
+		if s.version != "" {
+			info[attrVersion] = []string{s.version}
+		}
+		return s.searchEntry(c, f, attrs, typesOnly, &entry{dn: s.serverInfoDN(), attrs: info})
+	case base == normalizeDN(s.keySpaceDN()) || base == normalizeDN(s.baseDN):
+		return s.searchKeys(c, f, attrs, typesOnly, sizeLimit)
+	}
+	return c.respond(result(opSearchResultDone, resultNoSuchObject, s.baseDN, "no such object"))
+}
+
+// normalizeDN lower-cases a DN and removes spaces around its components,
+// so that DNs can be compared.
+func normalizeDN(dn string) string {
+	rdns := strings.Split(strings.ToLower(dn), ",")
+	for i := range rdns {
+		rdns[i] = strings.TrimSpace(rdns[i])
+		if eq := strings.Index(rdns[i], "="); eq >= 0 {
+			rdns[i] = strings.TrimSpace(rdns[i][:eq]) + "=" + strings.TrimSpace(rdns[i][eq+1:])
+		}
+	}
+	return strings.Join(rdns, ",")
+}
+
+func (s *Server) searchEntry(c *session, f *filter, attrs []string, typesOnly bool, e *entry) error {
+	if f.match(e.attrs) {
+		err := c.respond(e.encode(attrs, typesOnly))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return c.respond(result(opSearchResultDone, resultSuccess, "", ""))
+}
+
+func (s *Server) searchKeys(c *session, f *filter, attrs []string, typesOnly bool, sizeLimit int) error {
+	q, ok := f.query()
+	if !ok {
+		return c.respond(result(opSearchResultDone, resultUnwillingToPerform, "",
+			"searches must be for a key ID, fingerprint or user ID"))
+	}
+	rfps, err := s.resolve(q)
+	if err != nil {
+		log.Errorf("ldap search failed: %v", err)
+		return c.respond(result(opSearchResultDone, resultOperationsError, "", "search failed"))
+	}
+	var keys []*openpgp.PrimaryKey
+	if len(rfps) > 0 {
+		keys, err = s.storage.FetchKeys(rfps)
+		if err != nil {
+			log.Errorf("ldap search failed: %v", err)
+			return c.respond(result(opSearchResultDone, resultOperationsError, "", "search failed"))
+		}
+	}
+
+	limit := s.maxResults
+	if sizeLimit > 0 && (limit <= 0 || sizeLimit < limit) {
+		limit = sizeLimit
+	}
+	var n int
+	for _, key := range keys {
+		e, err := s.keyEntry(key)
+		if err != nil {
+			log.Errorf("ldap search: %v", err)
+			continue
+		}
+		if !f.match(e.attrs) {
+			continue
+		}
+		if limit > 0 && n == limit {
+			return c.respond(result(opSearchResultDone, resultSizeLimitExceeded, "", ""))
+		}
+		log.WithFields(log.Fields{
+			"fp":     key.Fingerprint(),
+			"length": key.Length,
+			"op":     "ldap",
+		}).Info("lookup")
+		err = c.respond(e.encode(attrs, typesOnly))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n++
+	}
+	return c.respond(result(opSearchResultDone, resultSuccess, "", ""))
+}
+
+// resolve returns the RFingerprints of the keys found by a query, without
+// duplicates.
+func (s *Server) resolve(q *query) ([]string, error) {
+	var rfps []string
+	if len(q.keyIDs) > 0 {
+		found, err := s.storage.Resolve(q.keyIDs)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rfps = append(rfps, found...)
+	}
+	if len(q.keywords) > 0 {
+		found, err := s.storage.MatchKeyword(q.keywords)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rfps = append(rfps, found...)
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, rfp := range rfps {
+		if !seen[rfp] {
+			seen[rfp] = true
+			result = append(result, rfp)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,247 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Enforcement modes for soft limits.
+const (
+	// LimitsReject refuses keys exceeding the limits.
+	LimitsReject = "reject"
+
+	// LimitsWarn accepts keys exceeding the limits until the enforcement
+	// date, recording the violation and notifying the key's owner, and
+	// refuses them after it.
+	LimitsWarn = "warn"
+)
+
+// ErrLimitExceeded is returned when a submitted key exceeds enforced soft
+// limits.
+var ErrLimitExceeded = fmt.Errorf("key exceeds policy limits")
+
+func IsLimitExceeded(err error) bool {
+	return errors.Is(err, ErrLimitExceeded)
+}
+
+// Key metadata recording that a key was accepted in violation of soft
+// limits, and when its owner was notified.
+const (
+	limitViolationMetadata = "policy/limit-violation"
+	limitNotifiedMetadata  = "policy/limit-notified"
+)
+
+// SoftLimits are policy limits on the size of submitted keys, which may be
+// phased in by warning owners of keys that exceed them before they are
+// enforced. Limits apply to keys as they would be stored, after merging
+// submissions with the stored version.
+type SoftLimits struct {
+	// MaxKeyLength limits the total length of a key's packets. Zero is
+	// unlimited.
+	MaxKeyLength int
+	// MaxSignatures limits the number of signatures on a key. Zero is
+	// unlimited.
+	MaxSignatures int
+
+	// Mode is LimitsReject or LimitsWarn.
+	Mode string
+	// EnforceAfter is when LimitsWarn becomes LimitsReject.
+	EnforceAfter time.Time
+
+	// Notifier notifies the owners of keys accepted in violation of the
+	// limits, at the addresses verified on their keys. Owners are notified
+	// once for each key.
+	Notifier OwnerNotifier
+}
+
+// LimitViolation describes how a key exceeds soft limits.
+type LimitViolation struct {
+	Fingerprint string
+	// Limits describes each limit exceeded.
+	Limits []string
+	// EnforceAfter is when the limits will be enforced, or zero if they
+	// already are.
+	EnforceAfter time.Time
+}
+
+func (v *LimitViolation) String() string {
+	return strings.Join(v.Limits, "; ")
+}
+
+// OwnerNotifier notifies the owner of a key of a limit violation.
+type OwnerNotifier interface {
+	NotifyOwner(addrs []string, v *LimitViolation) error
+}
+
+// Check returns how key exceeds the limits, or nil if it does not.
+func (l *SoftLimits) Check(key *openpgp.PrimaryKey) *LimitViolation {
+	var length, sigs int
+	for _, pkt := range key.Packets() {
+		length += len(pkt.Packet)
+		if pkt.Tag == 2 { //packet.PacketTypeSignature
+			sigs++
+		}
+	}
+	var limits []string
+	if l.MaxKeyLength > 0 && length > l.MaxKeyLength {
+		limits = append(limits, fmt.Sprintf("length %d exceeds %d", length, l.MaxKeyLength))
+	}
+	if l.MaxSignatures > 0 && sigs > l.MaxSignatures {
+		limits = append(limits, fmt.Sprintf("%d signatures exceeds %d", sigs, l.MaxSignatures))
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return &LimitViolation{Fingerprint: key.Fingerprint(), Limits: limits}
+}
+
+// Enforced returns whether keys exceeding the limits are refused at the
+// given time.
+func (l *SoftLimits) Enforced(now time.Time) bool {
+	return l.Mode != LimitsWarn || !now.Before(l.EnforceAfter)
+}
+
+// Limits applies soft limits to keys submitted with op=add.
+func Limits(l *SoftLimits) HandlerOption {
+	return func(h *Handler) error {
+		switch l.Mode {
+		case LimitsReject:
+		case LimitsWarn:
+			if l.EnforceAfter.IsZero() {
+				return errors.New("warn mode limits require an enforcement date")
+			}
+		default:
+			return errors.Errorf("invalid limit enforcement mode %q", l.Mode)
+		}
+		h.limits = l
+		return nil
+	}
+}
+
+// checkLimits returns an UpsertOption refusing keys which exceed enforced
+// limits. Violations of limits which are not yet enforced are stored in
+// *violation.
+func (h *Handler) checkLimits(violation **LimitViolation) storage.UpsertOption {
+	return storage.Check(func(key *openpgp.PrimaryKey) error {
+		v := h.limits.Check(key)
+		if v == nil {
+			return nil
+		}
+		if h.limits.Enforced(h.clock.Now()) {
+			return errors.Wrapf(ErrLimitExceeded, "key 0x%s refused: %s", key.KeyID(), v)
+		}
+		v.EnforceAfter = h.limits.EnforceAfter
+		*violation = v
+		return nil
+	})
+}
+
+// warnLimits records that a key was accepted in violation of the limits,
+// and notifies its owner if they have not already been notified.
+func (h *Handler) warnLimits(v *LimitViolation) {
+	log.WithFields(log.Fields{
+		"fp":      v.Fingerprint,
+		"limits":  v.Limits,
+		"enforce": v.EnforceAfter.Format(time.RFC3339),
+	}).Warn("key accepted in violation of limits")
+	ms, ok := h.storage.(storage.MetadataStore)
+	if !ok {
+		return
+	}
+	rfp := openpgp.Reverse(v.Fingerprint)
+	err := ms.SetMetadata(rfp, limitViolationMetadata, v.String())
+	if err != nil {
+		log.Errorf("failed to record limit violation on key %s: %v", v.Fingerprint, err)
+		return
+	}
+	vs, ok := h.verificationStore()
+	if !ok || h.limits.Notifier == nil {
+		return
+	}
+	md, err := ms.Metadata([]string{rfp})
+	if err != nil {
+		log.Errorf("failed to read metadata of key %s: %v", v.Fingerprint, err)
+		return
+	} else if md[rfp][limitNotifiedMetadata] != "" {
+		return
+	}
+	verified, err := vs.VerifiedAddresses(rfp)
+	if err != nil {
+		log.Errorf("failed to read verified addresses of key %s: %v", v.Fingerprint, err)
+		return
+	}
+	var addrs []string
+	for _, va := range verified {
+		addrs = append(addrs, va.Address)
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	err = h.limits.Notifier.NotifyOwner(addrs, v)
+	if err != nil {
+		log.Errorf("failed to notify owner of key %s of limit violation: %v", v.Fingerprint, err)
+		return
+	}
+	err = ms.SetMetadata(rfp, limitNotifiedMetadata, h.clock.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Errorf("failed to record limit notification on key %s: %v", v.Fingerprint, err)
+	}
+}
+
+// EmailOwnerNotifier notifies key owners of limit violations by email
+// through an SMTP server.
+type EmailOwnerNotifier struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	Auth smtp.Auth
+	From string
+	// Hostname identifies the keyserver in the message.
+	Hostname string
+
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (e *EmailOwnerNotifier) NotifyOwner(addrs []string, v *LimitViolation) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(addrs, ", "))
+	fmt.Fprintf(&buf, "Subject: Your OpenPGP key %s exceeds the limits of %s\r\n", v.Fingerprint, e.Hostname)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Your key %s was accepted by %s, but it exceeds the limits\r\n", v.Fingerprint, e.Hostname)
+	fmt.Fprintf(&buf, "on keys this keyserver will accept: %s.\r\n\r\n", v)
+	fmt.Fprintf(&buf, "After %s, updates to keys exceeding these limits will be\r\n", v.EnforceAfter.UTC().Format("2 January 2006"))
+	buf.WriteString("refused. Please reduce the size of your key, for example by removing\r\n")
+	buf.WriteString("unneeded signatures, user IDs or subkeys, before then.\r\n")
+	sendMail := e.sendMail
+	if sendMail == nil {
+		sendMail = smtp.SendMail
+	}
+	return errors.WithStack(sendMail(e.Addr, e.Auth, e.From, addrs, buf.Bytes()))
+}
@@ -0,0 +1,107 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package locale
+
+var english = &Locale{
+	Tag:        "en",
+	DateFormat: "2006-01-02",
+	HourFormat: "2006-01-02 15",
+	TimeFormat: "2006-01-02 15:04:05 MST",
+	Messages: map[string]string{
+		MessageAmbiguousKeyID:  "Key ID %s matches %d keys. Search by fingerprint instead.",
+		MessageChallengeFailed: "Key submissions must meet an anti-abuse challenge. Submit the key through the web form, or ask the operator for a submission token.",
+
+		MessageJustNow:    "just now",
+		MessageAgoMinute:  "1 minute ago",
+		MessageAgoMinutes: "%d minutes ago",
+		MessageAgoHour:    "1 hour ago",
+		MessageAgoHours:   "%d hours ago",
+		MessageAgoDay:     "1 day ago",
+		MessageAgoDays:    "%d days ago",
+		MessageAgoMonth:   "1 month ago",
+		MessageAgoMonths:  "%d months ago",
+		MessageAgoYear:    "1 year ago",
+		MessageAgoYears:   "%d years ago",
+	},
+}
+
+var german = &Locale{
+	Tag:        "de",
+	DateFormat: "02.01.2006",
+	HourFormat: "02.01.2006 15 Uhr",
+	TimeFormat: "02.01.2006 15:04:05 MST",
+	Messages: map[string]string{
+		MessageAmbiguousKeyID:  "Die Schlüssel-ID %s passt auf %d Schlüssel. Suchen Sie stattdessen nach dem Fingerabdruck.",
+		MessageChallengeFailed: "Schlüssel müssen zum Schutz vor Missbrauch eine Prüfung bestehen. Laden Sie den Schlüssel über das Webformular hoch oder bitten Sie den Betreiber um ein Token.",
+
+		MessageJustNow:    "gerade eben",
+		MessageAgoMinute:  "vor 1 Minute",
+		MessageAgoMinutes: "vor %d Minuten",
+		MessageAgoHour:    "vor 1 Stunde",
+		MessageAgoHours:   "vor %d Stunden",
+		MessageAgoDay:     "vor 1 Tag",
+		MessageAgoDays:    "vor %d Tagen",
+		MessageAgoMonth:   "vor 1 Monat",
+		MessageAgoMonths:  "vor %d Monaten",
+		MessageAgoYear:    "vor 1 Jahr",
+		MessageAgoYears:   "vor %d Jahren",
+
+		StatusMessage(400): "Ungültige Anfrage",
+		StatusMessage(403): "Verboten",
+		StatusMessage(404): "Nicht gefunden",
+		StatusMessage(409): "Konflikt",
+		StatusMessage(413): "Anfrage zu groß",
+		StatusMessage(429): "Zu viele Anfragen",
+		StatusMessage(500): "Interner Serverfehler",
+		StatusMessage(502): "Fehlerhaftes Gateway",
+		StatusMessage(503): "Dienst nicht verfügbar",
+	},
+}
+
+var french = &Locale{
+	Tag:        "fr",
+	DateFormat: "02/01/2006",
+	HourFormat: "02/01/2006 15h",
+	TimeFormat: "02/01/2006 15:04:05 MST",
+	Messages: map[string]string{
+		MessageAmbiguousKeyID:  "L'identifiant de clé %s correspond à %d clés. Recherchez plutôt par empreinte.",
+		MessageChallengeFailed: "Les clés soumises doivent réussir une vérification anti-abus. Soumettez la clé par le formulaire web, ou demandez un jeton à l'opérateur.",
+
+		MessageJustNow:    "à l'instant",
+		MessageAgoMinute:  "il y a 1 minute",
+		MessageAgoMinutes: "il y a %d minutes",
+		MessageAgoHour:    "il y a 1 heure",
+		MessageAgoHours:   "il y a %d heures",
+		MessageAgoDay:     "il y a 1 jour",
+		MessageAgoDays:    "il y a %d jours",
+		MessageAgoMonth:   "il y a 1 mois",
+		MessageAgoMonths:  "il y a %d mois",
+		MessageAgoYear:    "il y a 1 an",
+		MessageAgoYears:   "il y a %d ans",
+
+		StatusMessage(400): "Requête invalide",
+		StatusMessage(403): "Interdit",
+		StatusMessage(404): "Introuvable",
+		StatusMessage(409): "Conflit",
+		StatusMessage(413): "Requête trop volumineuse",
+		StatusMessage(429): "Trop de requêtes",
+		StatusMessage(500): "Erreur interne du serveur",
+		StatusMessage(502): "Mauvaise passerelle",
+		StatusMessage(503): "Service indisponible",
+	},
+}
@@ -0,0 +1,235 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package locale formats the human-facing parts of responses, such as dates,
+// relative ages and policy messages, in the language preferred by the client.
+package locale
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message identifiers. Messages are fmt format strings; the arguments each
+// takes are noted alongside.
+const (
+	// MessageAmbiguousKeyID explains that a key ID search was refused
+	// because it matched more than one key. Arguments: key ID, number of
+	// keys.
+	MessageAmbiguousKeyID = "ambiguous-key-id"
+
+	// MessageChallengeFailed explains that a key submission was refused
+	// because it did not meet the anti-abuse challenge. No arguments.
+	MessageChallengeFailed = "challenge-failed"
+
+	// MessageJustNow, and the MessageAgo* messages, describe the age of a
+	// timestamp. The plural forms take the number of units.
+	MessageJustNow    = "just-now"
+	MessageAgoMinute  = "ago-minute"
+	MessageAgoMinutes = "ago-minutes"
+	MessageAgoHour    = "ago-hour"
+	MessageAgoHours   = "ago-hours"
+	MessageAgoDay     = "ago-day"
+	MessageAgoDays    = "ago-days"
+	MessageAgoMonth   = "ago-month"
+	MessageAgoMonths  = "ago-months"
+	MessageAgoYear    = "ago-year"
+	MessageAgoYears   = "ago-years"
+)
+
+// StatusMessage returns the identifier of the message describing an HTTP
+// status code. Status codes without a translation are described by
+// http.StatusText.
+func StatusMessage(code int) string {
+	return "status-" + strconv.Itoa(code)
+}
+
+// Locale formats text for one language.
+type Locale struct {
+	// Tag is the lower-case language tag of the locale, such as "en" or
+	// "pt-br", as sent in the Content-Language header.
+	Tag string
+
+	// DateFormat, HourFormat and TimeFormat are time layouts for a day, an
+	// hour and an instant respectively.
+	DateFormat string
+	HourFormat string
+	TimeFormat string
+
+	// Messages maps message identifiers to format strings. Messages missing
+	// from a locale are taken from Default.
+	Messages map[string]string
+}
+
+var (
+	mu      sync.RWMutex
+	locales = map[string]*Locale{}
+)
+
+// Default is the locale used when the client expresses no preference that
+// can be met.
+var Default = english
+
+func init() {
+	for _, l := range []*Locale{english, german, french} {
+		Register(l)
+	}
+}
+
+// Register makes a locale available for negotiation, replacing any locale
+// already registered with the same tag.
+func Register(l *Locale) {
+	mu.Lock()
+	defer mu.Unlock()
+	locales[strings.ToLower(l.Tag)] = l
+}
+
+// Lookup returns the locale registered for a language tag, or for its primary
+// language if there is none for the tag itself.
+func Lookup(tag string) (*Locale, bool) {
+	tag = strings.ToLower(tag)
+	mu.RLock()
+	defer mu.RUnlock()
+	if l, ok := locales[tag]; ok {
+		return l, true
+	}
+	if i := strings.Index(tag, "-"); i > 0 {
+		if l, ok := locales[tag[:i]]; ok {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// Negotiate returns the registered locale most preferred by an
+// Accept-Language header value, or Default.
+func Negotiate(acceptLanguage string) *Locale {
+	type candidate struct {
+		tag string
+		q   float64
+	}
+	var candidates []candidate
+	for _, field := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(field, ";")
+		tag := strings.TrimSpace(params[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{tag: tag, q: q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if c.tag == "*" {
+			return Default
+		}
+		if l, ok := Lookup(c.tag); ok {
+			return l
+		}
+	}
+	return Default
+}
+
+// Message formats the message identified by id with args.
+func (l *Locale) Message(id string, args ...interface{}) string {
+	format, ok := l.Messages[id]
+	if !ok {
+		format, ok = Default.Messages[id]
+	}
+	if !ok {
+		return id
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// StatusText describes an HTTP status code.
+func (l *Locale) StatusText(code int) string {
+	id := StatusMessage(code)
+	if _, ok := l.Messages[id]; ok {
+		return l.Message(id)
+	}
+	return http.StatusText(code)
+}
+
+// Date formats the day of t.
+func (l *Locale) Date(t time.Time) string {
+	return t.UTC().Format(l.DateFormat)
+}
+
+// Hour formats the hour of t.
+func (l *Locale) Hour(t time.Time) string {
+	return t.UTC().Format(l.HourFormat)
+}
+
+// Time formats t to the second.
+func (l *Locale) Time(t time.Time) string {
+	return t.UTC().Format(l.TimeFormat)
+}
+
+// Age describes how long before now t was, to the largest whole unit.
+// Timestamps in the future are formatted with Time.
+func (l *Locale) Age(t, now time.Time) string {
+	d := now.Sub(t)
+	if d < 0 {
+		return l.Time(t)
+	}
+	const (
+		day   = 24 * time.Hour
+		month = 30 * day
+		year  = 365 * day
+	)
+	units := []struct {
+		d              time.Duration
+		single, plural string
+	}{
+		{year, MessageAgoYear, MessageAgoYears},
+		{month, MessageAgoMonth, MessageAgoMonths},
+		{day, MessageAgoDay, MessageAgoDays},
+		{time.Hour, MessageAgoHour, MessageAgoHours},
+		{time.Minute, MessageAgoMinute, MessageAgoMinutes},
+	}
+	for _, unit := range units {
+		n := int(d / unit.d)
+		switch {
+		case n == 1:
+			return l.Message(unit.single)
+		case n > 1:
+			return l.Message(unit.plural, n)
+		}
+	}
+	return l.Message(MessageJustNow)
+}
@@ -0,0 +1,99 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package locale
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type LocaleSuite struct{}
+
+var _ = gc.Suite(&LocaleSuite{})
+
+func (s *LocaleSuite) TestNegotiate(c *gc.C) {
+	for _, test := range []struct {
+		header, tag string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"de-AT", "de"},
+		{"FR-ca, en;q=0.5", "fr"},
+		{"en;q=0.5, fr;q=0.8", "fr"},
+		{"ja, de;q=0.3", "de"},
+		{"ja, *;q=0.5, de;q=0.3", "en"},
+		{"de;q=0, fr;q=invalid", "en"},
+		{"xx", "en"},
+	} {
+		c.Check(Negotiate(test.header).Tag, gc.Equals, test.tag, gc.Commentf("%q", test.header))
+	}
+}
+
+func (s *LocaleSuite) TestRegister(c *gc.C) {
+	pt := &Locale{
+		Tag:        "pt-BR",
+		DateFormat: "02/01/2006",
+		Messages:   map[string]string{MessageJustNow: "agora"},
+	}
+	Register(pt)
+	defer func() {
+		mu.Lock()
+		delete(locales, "pt-br")
+		mu.Unlock()
+	}()
+	c.Assert(Negotiate("pt-br"), gc.Equals, pt)
+	c.Assert(pt.Message(MessageJustNow), gc.Equals, "agora")
+	// Untranslated messages fall back to the default locale.
+	c.Assert(pt.Message(MessageAgoDays, 2), gc.Equals, "2 days ago")
+	c.Assert(pt.Message("no-such-message"), gc.Equals, "no-such-message")
+}
+
+func (s *LocaleSuite) TestFormat(c *gc.C) {
+	t := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+	c.Assert(english.Date(t), gc.Equals, "2020-03-14")
+	c.Assert(english.Hour(t), gc.Equals, "2020-03-14 15")
+	c.Assert(german.Date(t), gc.Equals, "14.03.2020")
+	c.Assert(french.Time(t), gc.Equals, "14/03/2020 15:09:26 UTC")
+
+	c.Assert(english.StatusText(http.StatusNotFound), gc.Equals, "Not Found")
+	c.Assert(german.StatusText(http.StatusNotFound), gc.Equals, "Nicht gefunden")
+	c.Assert(german.StatusText(http.StatusTeapot), gc.Equals, "I'm a teapot")
+}
+
+func (s *LocaleSuite) TestAge(c *gc.C) {
+	now := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+	for _, test := range []struct {
+		d      time.Duration
+		en, fr string
+	}{
+		{10 * time.Second, "just now", "à l'instant"},
+		{time.Minute, "1 minute ago", "il y a 1 minute"},
+		{3 * time.Hour, "3 hours ago", "il y a 3 heures"},
+		{49 * time.Hour, "2 days ago", "il y a 2 jours"},
+		{400 * 24 * time.Hour, "1 year ago", "il y a 1 an"},
+	} {
+		c.Check(english.Age(now.Add(-test.d), now), gc.Equals, test.en)
+		c.Check(french.Age(now.Add(-test.d), now), gc.Equals, test.fr)
+	}
+	c.Assert(english.Age(now.Add(time.Hour), now), gc.Equals, "2020-03-14 16:09:26 UTC")
+}
@@ -0,0 +1,211 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package mrhkp renders the machine-readable key index output described in
+// section 5.2 of the HKP draft (draft-shaw-openpgp-hkp-00), as returned for
+// index and vindex lookups with options=mr and read by gpg --search-keys.
+package mrhkp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// Flags of key and user ID records.
+const (
+	FlagRevoked  = "r"
+	FlagDisabled = "d"
+	FlagExpired  = "e"
+)
+
+// Index renders keys as a machine-readable index.
+type Index struct {
+	// Fingerprint renders the full fingerprint of each key rather than its
+	// 64-bit key ID.
+	Fingerprint bool
+
+	// AlgorithmNames renders the public key algorithm of each key by name,
+	// as in "rsa" or "eddsa", rather than by its numeric ID. Clients such
+	// as gpg expect numeric IDs, so this is only suitable for output read
+	// by people.
+	AlgorithmNames bool
+
+	// Ambiguous, if set, is the key ID searched for, which matched more than
+	// one key. It is rendered in an "ambiguous" record, which is not part of
+	// the HKP draft; clients ignore records of unknown type, but should warn
+	// that they must choose a key by fingerprint.
+	Ambiguous string
+
+	// Disabled, if set, reports whether a key is disabled on this server.
+	Disabled func(key *openpgp.PrimaryKey) bool
+
+	// VerifiedAt, if set, returns the time at which a user ID was verified
+	// on a key, or the zero time if it has not been. The verification time
+	// follows the flags of verified user IDs, which is not part of the HKP
+	// draft.
+	VerifiedAt func(key *openpgp.PrimaryKey, uid *openpgp.UserID) time.Time
+
+	// Now returns the current time, against which expiration is checked.
+	// If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Write renders keys to w.
+func (ix *Index) Write(w io.Writer, keys []*openpgp.PrimaryKey) error {
+	bw := bufio.NewWriter(w)
+	ix.writeInfo(bw, len(keys))
+	for _, key := range keys {
+		ix.writeKey(bw, key)
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// WriteInfo renders the records which begin an index of n keys to w.
+func (ix *Index) WriteInfo(w io.Writer, n int) error {
+	bw := bufio.NewWriter(w)
+	ix.writeInfo(bw, n)
+	return errors.WithStack(bw.Flush())
+}
+
+func (ix *Index) writeInfo(w io.Writer, n int) {
+	fmt.Fprintf(w, "info:1:%d\n", n)
+	if ix.Ambiguous != "" {
+		fmt.Fprintf(w, "ambiguous:%s:%d\n", strings.ToUpper(ix.Ambiguous), n)
+	}
+}
+
+// WriteKey renders the records of a single key to w. Together with
+// WriteInfo, it may be used to render an index incrementally.
+func (ix *Index) WriteKey(w io.Writer, key *openpgp.PrimaryKey) error {
+	bw := bufio.NewWriter(w)
+	ix.writeKey(bw, key)
+	return errors.WithStack(bw.Flush())
+}
+
+func (ix *Index) now() time.Time {
+	if ix.Now != nil {
+		return ix.Now()
+	}
+	return time.Now()
+}
+
+func (ix *Index) writeKey(w io.Writer, key *openpgp.PrimaryKey) {
+	var keyID string
+	if ix.Fingerprint {
+		keyID = key.Fingerprint()
+	} else {
+		keyID = key.KeyID()
+	}
+
+	var algorithm string
+	if ix.AlgorithmNames {
+		algorithm = openpgp.AlgorithmName(key.Algorithm)
+	} else {
+		algorithm = fmt.Sprintf("%d", key.Algorithm)
+	}
+
+	selfsigs, _ := key.SigInfo()
+	_, revoked := selfsigs.RevokedSince()
+	expiresAt := key.ExpiresAt()
+	disabled := ix.Disabled != nil && ix.Disabled(key)
+
+	fmt.Fprintf(w, "pub:%s:%s:%d:%s:%s:%s\n", strings.ToUpper(keyID), algorithm, key.BitLen,
+		Time(key.Creation), Time(expiresAt), ix.flags(revoked, disabled, expiresAt))
+
+	for _, uid := range key.UserIDs {
+		ix.writeUserID(w, key, uid)
+	}
+}
+
+func (ix *Index) writeUserID(w io.Writer, key *openpgp.PrimaryKey, uid *openpgp.UserID) {
+	selfsigs, _ := uid.SigInfo(key)
+	_, revoked := selfsigs.RevokedSince()
+	if !revoked && len(selfsigs.Certifications) == 0 {
+		// User IDs without a self-signature are not bound to the key.
+		return
+	}
+
+	// The user ID is described by its most recent self-signature which has
+	// not expired, or if all have, by its most recent self-signature.
+	// Revocation cancels all self-signatures.
+	var createdAt, expiresAt time.Time
+	now := ix.now()
+	for i, checkSig := range selfsigs.Certifications {
+		sig := checkSig.Signature
+		if i == 0 || sig.Expiration.IsZero() || sig.Expiration.After(now) {
+			createdAt, expiresAt = sig.Creation, sig.Expiration
+		}
+		if expiresAt.IsZero() || expiresAt.After(now) {
+			break
+		}
+	}
+
+	fmt.Fprintf(w, "uid:%s:%s:%s:%s", Escape(uid.Keywords), Time(createdAt), Time(expiresAt),
+		ix.flags(revoked, false, expiresAt))
+	if ix.VerifiedAt != nil {
+		if t := ix.VerifiedAt(key, uid); !t.IsZero() {
+			fmt.Fprintf(w, ":%s", Time(t))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func (ix *Index) flags(revoked, disabled bool, expiresAt time.Time) string {
+	var flags string
+	if revoked {
+		flags += FlagRevoked
+	}
+	if disabled {
+		flags += FlagDisabled
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(ix.now()) {
+		flags += FlagExpired
+	}
+	return flags
+}
+
+// Time renders t as seconds since the epoch, or as the empty string if t is
+// the zero time.
+func Time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+// Escape %-escapes s for use as a field of a record: the field separator
+// ':', the escape character '%', and all bytes which are not printable 7-bit
+// ASCII, including control characters which would break the record.
+func Escape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ':' || c == '%' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
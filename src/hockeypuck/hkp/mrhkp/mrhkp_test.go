@@ -0,0 +1,197 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mrhkp
+
+import (
+	"bytes"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type MRSuite struct{}
+
+var _ = gc.Suite(&MRSuite{})
+
+var testNow = time.Unix(1700000000, 0)
+
+func render(c *gc.C, ix *Index, name string) string {
+	if ix.Now == nil {
+		ix.Now = func() time.Time { return testNow }
+	}
+	keys := openpgp.MustReadArmorKeys(testing.MustInput(name))
+	var buf bytes.Buffer
+	c.Assert(ix.Write(&buf, keys), gc.IsNil)
+	return buf.String()
+}
+
+func (s *MRSuite) TestEscape(c *gc.C) {
+	for _, t := range []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"alice <alice@example.com>", "alice <alice@example.com>"},
+		{"alice: the first <alice@example.com>", "alice%3A the first <alice@example.com>"},
+		{"100% alice", "100%25 alice"},
+		{"alice %3a", "alice %253a"},
+		{"alice\nuid:mallory", "alice%0Auid%3Amallory"},
+		{"alice\r\t\x00\x7f", "alice%0D%09%00%7F"},
+		{"Jürgen", "J%C3%BCrgen"},
+		{"~!@#$^&*()_+{}|\"<>?`-=[]\\;',./", "~!@#$^&*()_+{}|\"<>?`-=[]\\;',./"},
+	} {
+		c.Assert(Escape(t.in), gc.Equals, t.out, gc.Commentf("%q", t.in))
+	}
+}
+
+func (s *MRSuite) TestTime(c *gc.C) {
+	c.Assert(Time(time.Time{}), gc.Equals, "")
+	c.Assert(Time(time.Unix(1345589945, 0)), gc.Equals, "1345589945")
+}
+
+func (s *MRSuite) TestKey(c *gc.C) {
+	c.Assert(render(c, &Index{}, "alice_signed.asc"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+}
+
+func (s *MRSuite) TestOptions(c *gc.C) {
+	c.Assert(render(c, &Index{Fingerprint: true}, "alice_signed.asc"), gc.Equals, `info:1:1
+pub:10FE8CF1B483F7525039AA2A361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+	c.Assert(render(c, &Index{AlgorithmNames: true}, "alice_signed.asc"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:rsa:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+	c.Assert(render(c, &Index{Ambiguous: "23e0dcca"}, "alice_signed.asc"), gc.Equals, `info:1:1
+ambiguous:23E0DCCA:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+	disabled := func(*openpgp.PrimaryKey) bool { return true }
+	c.Assert(render(c, &Index{Disabled: disabled}, "alice_signed.asc"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::d
+uid:alice <alice@example.com>:1345589945::
+`)
+	verifiedAt := func(_ *openpgp.PrimaryKey, uid *openpgp.UserID) time.Time {
+		return time.Unix(1600000000, 0)
+	}
+	c.Assert(render(c, &Index{VerifiedAt: verifiedAt}, "alice_signed.asc"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945:::1600000000
+`)
+}
+
+func (s *MRSuite) TestMultipleKeys(c *gc.C) {
+	c.Assert(render(c, &Index{AlgorithmNames: true}, "ecc_keys.asc"), gc.Equals, `info:1:6
+pub:1FE766DEAAF0FA1B:eddsa:263:1567275709::
+uid:Test Curve 25519 <test.curve.25519@example.com>:1567275709::
+pub:D7F00B118F8C50F8:ecdsa:515:1567275765::
+uid:Test Brainpool P-256 <test.brainpool.p-256@example.com>:1567275765::
+pub:CCECE4390AD824FD:ecdsa:771:1567275793::
+uid:Test Brainpool P-384 <test.brainpool.p-384@example.com>:1567275793::
+pub:6D23521968BE3000:ecdsa:1027:1567275825::
+uid:Test Brainpool P-512 <test.brainpool.p-512@example.com>:1567275825::
+pub:CB7F70189CD29C52:ecdsa:515:1567275855::
+uid:Test secp256k1 <test.secp256k1@example.com>:1567275855::
+pub:321203D239490F0A:ecdsa:515:1567276805::
+uid:Test NIST P-256 <test.nist.p-256@example.com>:1567276805::
+`)
+	var buf bytes.Buffer
+	c.Assert((&Index{}).Write(&buf, nil), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "info:1:0\n")
+}
+
+func (s *MRSuite) TestRevoked(c *gc.C) {
+	c.Assert(render(c, &Index{}, "test-key-revoked.asc"), gc.Equals, `info:1:1
+pub:7C330458A06E162F:1:3072:1611408173:1674480173:re
+uid:test@example.org:1611408173:1674480173:e
+`)
+	// A revoked user ID has no valid self-signature.
+	c.Assert(render(c, &Index{}, "lp1195901.asc"), gc.Equals, `info:1:1
+pub:403043153903637F:17:1024:1080579310::
+uid:Phil Pennock <pdp@exim.org>:1275701226::
+uid:Phil Pennock <pdp@spodhuis.org>:1242089864::
+uid:Phil Pennock <pdp@spodhuis.demon.nl>:::r
+uid:Phil Pennock <phil.pennock@globnix.org>:1372297839::
+uid:Phil Pennock <phil.pennock@spodhuis.org>:1372297854::
+`)
+}
+
+func (s *MRSuite) TestExpired(c *gc.C) {
+	c.Assert(render(c, &Index{}, "tails.asc"), gc.Equals, `info:1:1
+pub:1202821CBE2CD9C1:1:4096:1286443764:1423127099:e
+uid:Tails developers (signing key) <tails@boum.org>:1346144754:1423127099:e
+uid:T(A)ILS developers (signing key) <amnesia@boum.org>:1346144754:1423127099:e
+`)
+	// The expiration is reported whether or not it has passed.
+	before := func() time.Time { return time.Unix(1400000000, 0) }
+	c.Assert(render(c, &Index{Now: before}, "tails.asc"), gc.Equals, `info:1:1
+pub:1202821CBE2CD9C1:1:4096:1286443764:1423127099:
+uid:Tails developers (signing key) <tails@boum.org>:1346144754:1423127099:
+uid:T(A)ILS developers (signing key) <amnesia@boum.org>:1346144754:1423127099:
+`)
+	// Version 3 keys carry their expiration in the key packet.
+	c.Assert(render(c, &Index{}, "0xd46b7c827be290fe4d1f9291b1ebc61a.asc"), gc.Equals, `info:1:1
+pub:0760DF64B3D82239:1:2048:835985426:844625426:e
+`)
+}
+
+func (s *MRSuite) TestUnboundUserIDs(c *gc.C) {
+	c.Assert(render(c, &Index{}, "badselfsig.asc"), gc.Equals, `info:1:1
+pub:F79362DA44A2D1DB:17:3072:1330967119::
+uid:Casey Marshall <casey.marshall@gazzang.com>:1332383618::
+uid:Casey Marshall <casey.marshall@gmail.com>:1352175146::
+`)
+}
+
+func (s *MRSuite) TestEscapedUserID(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	keys[0].UserIDs[0].Keywords = "alice: 100% <alice@example.com>\nuid:mallory"
+	var buf bytes.Buffer
+	c.Assert((&Index{}).Write(&buf, keys), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice%3A 100%25 <alice@example.com>%0Auid%3Amallory:1345589945::
+`)
+}
+
+func (s *MRSuite) TestWriteKey(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	var buf bytes.Buffer
+	c.Assert((&Index{}).WriteKey(&buf, keys[0]), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, `pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+}
+
+func (s *MRSuite) TestWriteInfo(c *gc.C) {
+	var buf bytes.Buffer
+	c.Assert((&Index{}).WriteInfo(&buf, 3), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "info:1:3\n")
+	buf.Reset()
+	c.Assert((&Index{Ambiguous: "23e0dcca"}).WriteInfo(&buf, 2), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "info:1:2\nambiguous:23E0DCCA:2\n")
+}
@@ -74,12 +74,14 @@ type Sender struct {
 	pksStorage Storage
 	smtpAuth   smtp.Auth
 	lastStatus []Status
+	keyWriter  *openpgp.KeyWriter
 
 	t tomb.Tomb
 }
 
-// Initialize from command line switches if fields not set.
-func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config) (*Sender, error) {
+// Initialize from command line switches if fields not set. Keys are sent
+// with the given serve policy applied.
+func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config, policy ...openpgp.PolicyOption) (*Sender, error) {
 	if config == nil {
 		return nil, errors.New("PKS mail synchronization not configured")
 	}
@@ -88,6 +90,7 @@ func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config) (
 		config:     config,
 		hkpStorage: hkpStorage,
 		pksStorage: pksStorage,
+		keyWriter:  openpgp.NewKeyWriter(policy...),
 	}
 
 	var err error
@@ -153,7 +156,10 @@ func (sender *Sender) SendKeys(status Status) error {
 func (sender *Sender) SendKey(addr string, key *openpgp.PrimaryKey) error {
 	var msg bytes.Buffer
 	msg.WriteString("Subject: ADD\n\n")
-	openpgp.WriteArmoredPackets(&msg, []*openpgp.PrimaryKey{key})
+	err := sender.keyWriter.WriteArmored(&msg, []*openpgp.PrimaryKey{key})
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	return smtp.SendMail(sender.config.SMTP.Host, sender.smtpAuth,
 		sender.config.From, []string{addr}, msg.Bytes())
 }
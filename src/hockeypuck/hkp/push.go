@@ -0,0 +1,475 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+
+	"hockeypuck/hkp/discovery"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// PushVersion is the version of the push format written by this keyserver.
+const PushVersion = 1
+
+const (
+	DefaultPushInterval = 5 * time.Second
+
+	// maxPushLen limits the size of a push request.
+	maxPushLen = 32 << 20
+
+	// maxPushKeys limits the number of keys sent in a single push.
+	maxPushKeys = 100
+
+	// maxPushClockSkew is how far the time of a push may be from the time
+	// it is received. Pushes outside this window are refused, and those
+	// within it are remembered so that they cannot be replayed.
+	maxPushClockSkew = 5 * time.Minute
+)
+
+// Push is a batch of key changes sent by one keyserver to another under the
+// same administration, so that they propagate without waiting for recon. It
+// is sent clearsigned by the pushing keyserver's key.
+type Push struct {
+	Version int `json:"version"`
+	// Issuer is the hostname of the pushing keyserver.
+	Issuer string `json:"issuer"`
+	// Time is when the push was sent.
+	Time string `json:"time"`
+	// Keys are armored keys to be merged into storage.
+	Keys []string `json:"keys,omitempty"`
+	// Deleted are the fingerprints of keys to be deleted.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// PushResponse reports the outcome of a push.
+type PushResponse struct {
+	AddResponse
+	Deleted []string `json:"deleted"`
+}
+
+// PushPeer is a keyserver trusted to push key changes to this one.
+type PushPeer struct {
+	// Name identifies the peer in logs and submission statistics.
+	Name string
+	// Keyring contains the keys the peer signs pushes with.
+	Keyring xopenpgp.EntityList
+	// AllowDelete permits the peer to delete keys.
+	AllowDelete bool
+	// UpsertOptions is the policy applied when merging keys pushed by the
+	// peer, in place of the policy applied to anonymous submissions.
+	UpsertOptions []storage.UpsertOption
+}
+
+// PushPeers accepts pushes signed by the given peers.
+func PushPeers(peers ...*PushPeer) HandlerOption {
+	return func(h *Handler) error {
+		if h.pushPeers == nil {
+			h.pushPeers = map[string]*PushPeer{}
+			h.pushSeen = newReplayCache()
+		}
+		for _, peer := range peers {
+			if len(peer.Keyring) == 0 {
+				return errors.Errorf("push peer %q has no keys", peer.Name)
+			}
+			for _, e := range peer.Keyring {
+				fp := hex.EncodeToString(e.PrimaryKey.Fingerprint[:])
+				h.pushPeers[fp] = peer
+				h.pushKeyring = append(h.pushKeyring, e)
+			}
+		}
+		return nil
+	}
+}
+
+// replayCache remembers signed pushes and requests received within their
+// clock skew window, so that they are not accepted twice.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: map[string]time.Time{}}
+}
+
+// check returns whether the message with the given digest has not been seen
+// before now, and remembers it until expires.
+func (r *replayCache) check(digest string, now, expires time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, t := range r.seen {
+		if now.After(t) {
+			delete(r.seen, k)
+		}
+	}
+	if _, ok := r.seen[digest]; ok {
+		return false
+	}
+	r.seen[digest] = expires
+	return true
+}
+
+// Push applies the key changes in a push from a trusted keyserver.
+func (h *Handler) Push(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if len(h.pushPeers) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("push not configured"))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPushLen))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, errors.WithStack(err))
+		return
+	}
+	block, _ := clearsign.Decode(body)
+	if block == nil {
+		httpError(w, http.StatusBadRequest, errors.New("expected a clearsigned push"))
+		return
+	}
+	signer, err := xopenpgp.CheckDetachedSignature(h.pushKeyring,
+		bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errors.Wrap(err, "push not signed by a trusted keyserver"))
+		return
+	}
+	peer := h.pushPeers[hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])]
+
+	var push Push
+	err = json.Unmarshal(block.Plaintext, &push)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if push.Version != PushVersion {
+		httpError(w, http.StatusBadRequest, errors.Errorf("unsupported push version %d", push.Version))
+		return
+	}
+	sent, err := time.Parse(time.RFC3339, push.Time)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if d := h.clock.Now().Sub(sent); d > maxPushClockSkew || d < -maxPushClockSkew {
+		httpError(w, http.StatusForbidden, errors.Errorf("push sent at %s is outside the accepted window", push.Time))
+		return
+	}
+	digest := sha256.Sum256(block.Bytes)
+	if !h.pushSeen.check(hex.EncodeToString(digest[:]), h.clock.Now(), sent.Add(2*maxPushClockSkew)) {
+		httpError(w, http.StatusForbidden, errors.New("push already received"))
+		return
+	}
+	if len(push.Deleted) > 0 && !peer.AllowDelete {
+		httpError(w, http.StatusForbidden, errors.Errorf("push peer %q may not delete keys", peer.Name))
+		return
+	}
+
+	var result PushResponse
+	source := sks.SourcePush(peer.Name)
+	for _, keytext := range push.Keys {
+		armorBlock, err := openpgp.DecodeArmor(strings.NewReader(keytext), h.keyReaderOptions...)
+		if err != nil {
+			readError(w, errors.WithStack(err))
+			return
+		}
+		keys, err := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...).Read()
+		if err != nil {
+			readError(w, errors.WithStack(err))
+			return
+		}
+		for _, key := range keys {
+			err := openpgp.DropDuplicates(key)
+			if err != nil {
+				httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+				return
+			}
+			change, err := storage.UpsertKey(h.storage, key, append(peer.UpsertOptions[:len(peer.UpsertOptions):len(peer.UpsertOptions)],
+				storage.Provenance(storage.ProvenancePush))...)
+			if h.submissionFunc != nil {
+				h.submissionFunc(source, change, err)
+			}
+			if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) {
+				log.Warningf("push: %v", err)
+				result.Ignored = append(result.Ignored, key.QualifiedFingerprint())
+				continue
+			} else if err != nil {
+				httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+				return
+			}
+			fp := key.QualifiedFingerprint()
+			switch change.(type) {
+			case storage.KeyAdded:
+				result.Inserted = append(result.Inserted, fp)
+			case storage.KeyReplaced:
+				result.Updated = append(result.Updated, fp)
+			case storage.KeyNotChanged:
+				result.Ignored = append(result.Ignored, fp)
+			}
+		}
+	}
+	for _, fp := range push.Deleted {
+		fp = strings.ToLower(fp)
+		if _, err := hex.DecodeString(fp); err != nil || len(fp) < 40 {
+			httpError(w, http.StatusBadRequest, errors.Errorf("invalid fingerprint %q", fp))
+			return
+		}
+		_, err := storage.DeleteKey(h.storage, fp)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to delete key"))
+			return
+		}
+		result.Deleted = append(result.Deleted, fp)
+	}
+	log.WithFields(log.Fields{
+		"peer":     peer.Name,
+		"issuer":   push.Issuer,
+		"inserted": result.Inserted,
+		"updated":  result.Updated,
+		"deleted":  result.Deleted,
+	}).Info("push")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
+
+// Pusher pushes keys added or updated in storage to other keyservers which
+// trust this one. Keys are pushed in batches at each interval. A push which
+// fails is not retried; the keys still reach the other keyservers through
+// recon.
+type Pusher struct {
+	st       storage.Storage
+	signer   *xopenpgp.Entity
+	hostname string
+	targets  []string
+	client   *http.Client
+	resolver *discovery.Resolver
+	interval time.Duration
+	local    sks.LocalKeys
+
+	mu       sync.Mutex
+	pending  map[string]bool
+	listener storage.ListenerID
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type PusherOption func(*Pusher)
+
+// PushInterval sets how often pending keys are pushed.
+func PushInterval(d time.Duration) PusherOption {
+	return func(p *Pusher) {
+		if d > 0 {
+			p.interval = d
+		}
+	}
+}
+
+// PushHTTPClient sets the client used to send pushes.
+func PushHTTPClient(c *http.Client) PusherOption {
+	return func(p *Pusher) { p.client = c }
+}
+
+// PushResolver sets the resolver used to find the base URLs of targets.
+func PushResolver(r *discovery.Resolver) PusherOption {
+	return func(p *Pusher) { p.resolver = r }
+}
+
+// PushLocalOnly prevents local-only keys from being pushed.
+func PushLocalOnly(lk sks.LocalKeys) PusherOption {
+	return func(p *Pusher) { p.local = lk }
+}
+
+// NewPusher returns a Pusher sending the keys changed in st to the
+// keyservers at the given addresses, signed by signer and attributed to
+// hostname.
+func NewPusher(st storage.Storage, signer *xopenpgp.Entity, hostname string, targets []string, options ...PusherOption) (*Pusher, error) {
+	if signer.PrivateKey == nil || signer.PrivateKey.Encrypted {
+		return nil, errors.New("push key must be an unencrypted private key")
+	}
+	p := &Pusher{
+		st:       st,
+		signer:   signer,
+		hostname: hostname,
+		targets:  targets,
+		client:   http.DefaultClient,
+		resolver: discovery.NewResolver(),
+		interval: DefaultPushInterval,
+		pending:  map[string]bool{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p, nil
+}
+
+func (p *Pusher) keyChanged(kc storage.KeyChange) error {
+	if p.local.Excludes(kc) {
+		return nil
+	}
+	p.mu.Lock()
+	for _, digest := range kc.InsertDigests() {
+		p.pending[digest] = true
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Start pushes changed keys in the background until Stop is called.
+func (p *Pusher) Start() {
+	p.listener = p.st.Subscribe(p.keyChanged)
+	go p.run()
+}
+
+// Stop stops pushing keys, after pushing those still pending.
+func (p *Pusher) Stop() {
+	p.st.Unsubscribe(p.listener)
+	close(p.stop)
+	<-p.done
+}
+
+func (p *Pusher) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			p.Flush()
+			return
+		case <-ticker.C:
+			p.Flush()
+		}
+	}
+}
+
+// Flush pushes the keys changed since the last flush.
+func (p *Pusher) Flush() {
+	p.mu.Lock()
+	digests := make([]string, 0, len(p.pending))
+	for digest := range p.pending {
+		digests = append(digests, digest)
+	}
+	p.pending = map[string]bool{}
+	p.mu.Unlock()
+
+	for len(digests) > 0 {
+		n := len(digests)
+		if n > maxPushKeys {
+			n = maxPushKeys
+		}
+		err := p.push(digests[:n])
+		if err != nil {
+			log.Errorf("failed to push keys: %v", err)
+		}
+		digests = digests[n:]
+	}
+}
+
+func (p *Pusher) push(digests []string) error {
+	rfps, err := p.st.MatchMD5(digests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	keys, err := p.st.FetchKeys(rfps)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	push := &Push{
+		Version: PushVersion,
+		Issuer:  p.hostname,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, key := range keys {
+		var buf bytes.Buffer
+		err = openpgp.WriteArmoredPackets(&buf, []*openpgp.PrimaryKey{key})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		push.Keys = append(push.Keys, buf.String())
+	}
+	doc, err := json.Marshal(push)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var signed bytes.Buffer
+	cw, err := clearsign.Encode(&signed, p.signer.PrivateKey, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = cw.Write(doc)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, target := range p.targets {
+		err := p.send(target, signed.Bytes())
+		if err != nil {
+			log.Errorf("failed to push %d keys to %q: %v", len(keys), target, err)
+			continue
+		}
+		log.Debugf("pushed %d keys to %q", len(keys), target)
+	}
+	return nil
+}
+
+func (p *Pusher) send(target string, body []byte) error {
+	resp, err := p.resolver.Do(p.client, target, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", base+"/pks/push", bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		return req, nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
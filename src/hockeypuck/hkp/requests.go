@@ -19,15 +19,22 @@ package hkp
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/pkg/errors"
 
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
 )
 
 // Operation enumerates the supported HKP operations (op parameter) in the request.
@@ -58,6 +65,14 @@ const (
 	OptionMachineReadable = Option("mr")
 	OptionJSON            = Option("json")
 	OptionNotModifiable   = Option("nm")
+
+	// OptionPrimaryOnly limits keys returned by op=get to the primary key,
+	// its user IDs and their self-signatures.
+	OptionPrimaryOnly = Option("primary")
+
+	// OptionSubKeyOnly limits keys returned by op=get for a key ID found on
+	// a subkey to the primary key, its user IDs and the matching subkey.
+	OptionSubKeyOnly = Option("subkey")
 )
 
 type OptionSet map[Option]bool
@@ -81,6 +96,80 @@ type Lookup struct {
 	Fingerprint bool
 	Exact       bool
 	Hash        bool
+
+	// Continuation selects a segment of a key too large to be served whole.
+	Continuation int
+
+	// Match selects how the words of a keyword search are combined.
+	Match storage.KeywordMatch
+
+	// Order selects the order in which the keys matching a search are
+	// served or listed.
+	Order storage.ResultOrder
+
+	// Limit and Offset select a page of the keys matched by a keyword
+	// search for op=index or op=vindex. A zero Limit selects the default
+	// page size.
+	Limit  int
+	Offset int
+
+	// Domain is the email domain of a search of the form
+	// domain:example.com, which finds the keys with an address in the
+	// domain. Search is then the domain itself, which is a keyword of such
+	// keys.
+	Domain string
+
+	// Filter selects the keys listed by op=index or op=vindex by their
+	// properties, or is nil if all keys matching the search are listed.
+	Filter *storage.KeyFilter
+
+	// Conditions are the preconditions of a conditional op=get request,
+	// under which keys which have not changed are not served again. They
+	// are nil for lookups which do not take part in HTTP caching.
+	Conditions *Conditions
+
+	// ctx is the context of the request, which carries its trace.
+	ctx context.Context
+}
+
+// Conditions are the preconditions of a conditional GET request, RFC 7232.
+type Conditions struct {
+	IfNoneMatch     string
+	IfModifiedSince time.Time
+}
+
+// ParseConditions returns the preconditions of a request.
+func ParseConditions(req *http.Request) *Conditions {
+	c := &Conditions{IfNoneMatch: req.Header.Get("If-None-Match")}
+	if t, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		c.IfModifiedSince = t
+	}
+	return c
+}
+
+// NotModified returns whether a representation with the given entity tag
+// and modification time satisfies the preconditions, so that it need not be
+// sent again. If-Modified-Since is ignored if If-None-Match is given, and
+// either is ignored if the corresponding validator is unknown.
+func (c *Conditions) NotModified(etag string, lastModified time.Time) bool {
+	if c.IfNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(c.IfNoneMatch, ",") {
+			// If-None-Match uses the weak comparison function.
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if c.IfModifiedSince.IsZero() || lastModified.IsZero() {
+		return false
+	}
+	// HTTP dates have a resolution of a second.
+	return !lastModified.Truncate(time.Second).After(c.IfModifiedSince)
 }
 
 func ParseLookup(req *http.Request) (*Lookup, error) {
@@ -89,7 +178,7 @@ func ParseLookup(req *http.Request) (*Lookup, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	var l Lookup
+	l := Lookup{ctx: req.Context()}
 	var ok bool
 	// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.1.2
 	l.Op, ok = ParseOperation(req.Form.Get("op"))
@@ -97,28 +186,182 @@ func ParseLookup(req *http.Request) (*Lookup, error) {
 		return nil, errors.Errorf("invalid operation %q", req.Form.Get("op"))
 	}
 
-	if l.Op != OperationStats {
+	// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.2.3
+	l.Exact = req.Form.Get("exact") == "on"
+
+	// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.2.2. As a Hockeypuck
+	// extension, a full fingerprint may be given instead of "on", to look
+	// up the key with that primary or subkey fingerprint exactly, without
+	// falling back to a keyword search.
+	switch fp := strings.ToLower(req.Form.Get("fingerprint")); fp {
+	case "on":
+		l.Fingerprint = true
+	case "", "off":
+	default:
+		fp = strings.TrimPrefix(fp, "0x")
+		if !isFingerprint(fp) {
+			return nil, errors.Errorf("invalid fingerprint %q", req.Form.Get("fingerprint"))
+		}
+		l.Fingerprint = true
+		l.Search = "0x" + fp
+		l.Exact = true
+	}
+
+	// Not in draft spec, Hockeypuck extension
+	if l.Op == OperationIndex || l.Op == OperationVIndex {
+		l.Filter, err = parseKeyFilter(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.Op != OperationStats && l.Search == "" {
 		// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.1.1
 		l.Search = req.Form.Get("search")
-		if l.Search == "" {
+		// An index of keys with given properties may list them all.
+		if l.Search == "" && l.Filter == nil {
 			return nil, errors.Errorf("missing required parameter: search")
 		}
 	}
 
-	l.Options = ParseOptionSet(req.Form.Get("options"))
+	// Not in draft spec, Hockeypuck extension
+	if strings.HasPrefix(strings.ToLower(l.Search), domainSearchPrefix) {
+		domain := strings.ToLower(strings.TrimSpace(l.Search[len(domainSearchPrefix):]))
+		if !isDomain(domain) {
+			return nil, errors.Errorf("invalid domain %q", domain)
+		}
+		l.Domain, l.Search = domain, domain
+	}
 
-	// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.2.2
-	l.Fingerprint = req.Form.Get("fingerprint") == "on"
+	l.Options = ParseOptionSet(req.Form.Get("options"))
 
 	// Not in draft spec, SKS convention
 	l.Hash = req.Form.Get("hash") == "on"
 
-	// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.2.3
-	l.Exact = req.Form.Get("exact") == "on"
+	// Not in draft spec, Hockeypuck extension
+	l.Match, ok = storage.ParseKeywordMatch(req.Form.Get("match"))
+	if !ok {
+		return nil, errors.Errorf("invalid match %q", req.Form.Get("match"))
+	}
+
+	// Not in draft spec, Hockeypuck extension
+	l.Order, ok = storage.ParseResultOrder(req.Form.Get("order"))
+	if !ok {
+		return nil, errors.Errorf("invalid order %q", req.Form.Get("order"))
+	}
+
+	// Not in draft spec, Hockeypuck extension
+	if cont := req.Form.Get("continuation"); cont != "" {
+		l.Continuation, err = strconv.Atoi(cont)
+		if err != nil || l.Continuation < 0 {
+			return nil, errors.Errorf("invalid continuation %q", cont)
+		}
+	}
+
+	if l.Op == OperationGet || l.Op == OperationHGet {
+		l.Conditions = ParseConditions(req)
+	}
+
+	// Not in draft spec, Hockeypuck extension
+	if limit := req.Form.Get("limit"); limit != "" {
+		l.Limit, err = strconv.Atoi(limit)
+		if err != nil || l.Limit < 1 {
+			return nil, errors.Errorf("invalid limit %q", limit)
+		}
+	}
+	if offset := req.Form.Get("offset"); offset != "" {
+		l.Offset, err = strconv.Atoi(offset)
+		if err != nil || l.Offset < 0 {
+			return nil, errors.Errorf("invalid offset %q", offset)
+		}
+	}
 
 	return &l, nil
 }
 
+// parseKeyFilter parses the parameters selecting keys by their properties,
+// returning nil if none are given.
+func parseKeyFilter(req *http.Request) (*storage.KeyFilter, error) {
+	var f storage.KeyFilter
+	if algo := strings.ToLower(req.Form.Get("algo")); algo != "" {
+		if openpgp.AlgorithmCodes(algo) == nil {
+			return nil, errors.Errorf("invalid algo %q", algo)
+		}
+		f.Algorithm = algo
+	}
+	if minBits := req.Form.Get("minbits"); minBits != "" {
+		n, err := strconv.Atoi(minBits)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid minbits %q", minBits)
+		}
+		f.MinBits = n
+	}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"created_after", &f.CreatedAfter},
+		{"created_before", &f.CreatedBefore},
+	} {
+		v := req.Form.Get(param.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+		}
+		if err != nil {
+			return nil, errors.Errorf("invalid %s %q", param.name, v)
+		}
+		*param.t = t
+	}
+	if flags := req.Form.Get("flags"); flags != "" {
+		var err error
+		f.Flags, err = openpgp.ParseKeyFlags(flags)
+		if err != nil {
+			return nil, errors.Errorf("invalid flags %q", flags)
+		}
+	}
+	if f.IsZero() {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// domainSearchPrefix introduces a search for the keys with an address in an
+// email domain.
+const domainSearchPrefix = "domain:"
+
+// isDomain returns whether s is a lower-cased domain name, of letters,
+// digits and hyphens in labels separated by dots.
+func isDomain(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, r := range label {
+			if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isFingerprint returns whether s is a full version 4 fingerprint in
+// lower-case hex.
+func isFingerprint(s string) bool {
+	if len(s) != fingerprintKeyIDLen {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
 // Add represents a valid /pks/add request content, parameters and options.
 type Add struct {
 	Keytext string
@@ -144,7 +387,12 @@ func ParseAdd(req *http.Request) (*Add, error) {
 		return nil, errors.Errorf("missing required parameter: keytext")
 	}
 	add.Keysig = req.Form.Get("keysig")
+	// A replacement must be signed by the key replaced; a signature alone
+	// does not replace a key.
 	add.Replace, _ = strconv.ParseBool(req.Form.Get("replace"))
+	if add.Replace && add.Keysig == "" {
+		return nil, errors.Errorf("missing required parameter: keysig")
+	}
 
 	add.Options = ParseOptionSet(req.Form.Get("options"))
 
@@ -181,37 +429,130 @@ func ParseReplace(req *http.Request) (*Replace, error) {
 	return &replace, nil
 }
 
-// Delete represents a valid /pks/delete request content, parameters and options.
-type Delete struct {
+// Revoke represents a valid /pks/revoke request content, parameters and options.
+type Revoke struct {
 	Keytext string
-	Keysig  string
 }
 
-func ParseDelete(req *http.Request) (*Delete, error) {
+func ParseRevoke(req *http.Request) (*Revoke, error) {
 	if req.Method != "POST" {
 		return nil, errors.Errorf("invalid HTTP method: %s", req.Method)
 	}
 
-	var del Delete
+	var revoke Revoke
+	// Parse the URL query parameters
 	err := req.ParseForm()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	del.Keytext = req.Form.Get("keytext")
+	revoke.Keytext = req.Form.Get("keytext")
+	if revoke.Keytext == "" {
+		return nil, errors.Errorf("missing required parameter: keytext")
+	}
+
+	return &revoke, nil
+}
+
+// Delete represents a valid /pks/delete request content, parameters and options.
+type Delete struct {
+	Keytext string
+	Keysig  string
+	// Fingerprint is the key to delete, if it is not the key which signed
+	// the request, in lower-case hex.
+	Fingerprint string
+}
+
+// maxDeleteFormLength limits the form body of a DELETE request, as net/http
+// limits that of a POST.
+const maxDeleteFormLength = 10 << 20
+
+// ParseDelete parses a POST or DELETE request to /pks/delete. net/http only
+// parses the form body of a POST, so that of a DELETE is read here.
+func ParseDelete(req *http.Request) (*Delete, error) {
+	var form url.Values
+	switch req.Method {
+	case http.MethodPost:
+		err := req.ParseForm()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		form = req.Form
+	case http.MethodDelete:
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDeleteFormLength))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		form, err = url.ParseQuery(string(body))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for k, vs := range req.URL.Query() {
+			form[k] = append(form[k], vs...)
+		}
+	default:
+		return nil, errors.Errorf("invalid HTTP method: %s", req.Method)
+	}
+
+	var del Delete
+	del.Keytext = form.Get("keytext")
 	if del.Keytext == "" {
 		return nil, errors.Errorf("missing required parameter: keytext")
 	}
-	del.Keysig = req.Form.Get("keysig")
+	del.Keysig = form.Get("keysig")
 	if del.Keysig == "" {
-		return nil, errors.Errorf("missing required parameter: keytext")
+		return nil, errors.Errorf("missing required parameter: keysig")
+	}
+	if fp := form.Get("fingerprint"); fp != "" {
+		del.Fingerprint = strings.TrimPrefix(strings.ToLower(fp), "0x")
+		if !isFingerprint(del.Fingerprint) {
+			return nil, errors.Errorf("invalid fingerprint %q", fp)
+		}
 	}
 
 	return &del, nil
 }
 
+// Erasure represents a valid /pks/erasure request content and parameters.
+type Erasure struct {
+	Address     string
+	Fingerprint string
+	Reason      string
+	Contact     string
+}
+
+func ParseErasure(req *http.Request) (*Erasure, error) {
+	if req.Method != "POST" {
+		return nil, errors.Errorf("invalid HTTP method: %s", req.Method)
+	}
+
+	var erasure Erasure
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	erasure.Address = req.Form.Get("address")
+	erasure.Fingerprint = req.Form.Get("fingerprint")
+	if erasure.Address == "" && erasure.Fingerprint == "" {
+		return nil, errors.Errorf("missing required parameter: address or fingerprint")
+	}
+	erasure.Reason = req.Form.Get("reason")
+	erasure.Contact = req.Form.Get("contact")
+	if erasure.Contact == "" {
+		return nil, errors.Errorf("missing required parameter: contact")
+	}
+
+	return &erasure, nil
+}
+
 type HashQuery struct {
 	Digests []string
+
+	// SizesOnly requests that only the digest and serialized length of each
+	// matching key be returned, rather than the key material itself. Peers
+	// may use this to plan request batching before fetching full keys.
+	SizesOnly bool
 }
 
 func ParseHashQuery(req *http.Request) (*HashQuery, error) {
@@ -228,6 +569,10 @@ func ParseHashQuery(req *http.Request) (*HashQuery, error) {
 
 	var hq HashQuery
 
+	// Not part of the SKS protocol; the body is reserved for digests so
+	// modifiers are taken from the URL query.
+	hq.SizesOnly = req.URL.Query().Get("sizes") == "on"
+
 	// Parse hashquery POST data
 	n, err := recon.ReadInt(r)
 	if err != nil {
@@ -21,8 +21,12 @@ import (
 	"bytes"
 	"net/http"
 	"net/url"
+	"time"
 
 	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
 )
 
 /*
@@ -67,6 +71,23 @@ func (s *RequestsSuite) TestGetFp(c *gc.C) {
 	c.Assert(lookup.Exact, gc.Equals, true)
 }
 
+func (s *RequestsSuite) TestGetByFingerprint(c *gc.C) {
+	testUrl, err := url.Parse("/pks/lookup?op=get&fingerprint=0x10FE8CF1B483F7525039AA2A361BC1F023E0DCCA")
+	c.Assert(err, gc.IsNil)
+	lookup, err := ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.IsNil)
+	c.Assert(lookup.Search, gc.Equals, "0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(lookup.Fingerprint, gc.Equals, true)
+	c.Assert(lookup.Exact, gc.Equals, true)
+
+	for _, fp := range []string{"0xdecafbad", "alice", "10fe8cf1b483f7525039aa2a361bc1f023e0dccx"} {
+		testUrl, err = url.Parse("/pks/lookup?op=get&search=alice&fingerprint=" + fp)
+		c.Assert(err, gc.IsNil)
+		_, err = ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+		c.Assert(err, gc.NotNil, gc.Commentf("%s", fp))
+	}
+}
+
 func (s *RequestsSuite) TestIndex(c *gc.C) {
 	// op=index
 	testUrl, err := url.Parse("/pks/lookup?op=index&search=sharin") // as in, foo
@@ -115,6 +136,76 @@ func (s *RequestsSuite) TestNoSuchOp(c *gc.C) {
 	c.Assert(err, gc.NotNil)
 }
 
+func (s *RequestsSuite) TestMatch(c *gc.C) {
+	for _, t := range []struct {
+		query string
+		match storage.KeywordMatch
+	}{
+		{"", storage.MatchAllWords},
+		{"&match=all", storage.MatchAllWords},
+		{"&match=any", storage.MatchAnyWord},
+		{"&match=Phrase", storage.MatchPhrase},
+		{"&match=substring", storage.MatchSubstring},
+		{"&match=fuzzy", storage.MatchFuzzy},
+	} {
+		testUrl, err := url.Parse("/pks/lookup?op=index&search=casey+marshall" + t.query)
+		c.Assert(err, gc.IsNil)
+		lookup, err := ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+		c.Assert(err, gc.IsNil)
+		c.Assert(lookup.Match, gc.Equals, t.match)
+	}
+
+	testUrl, err := url.Parse("/pks/lookup?op=index&search=casey&match=some")
+	c.Assert(err, gc.IsNil)
+	_, err = ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.ErrorMatches, `invalid match "some"`)
+}
+
+func (s *RequestsSuite) TestKeyFilter(c *gc.C) {
+	testUrl, err := url.Parse("/pks/lookup?op=index&algo=EdDSA&minbits=256&created_after=2019-01-01&created_before=2020-01-01T12:00:00Z&flags=sign,encrypt")
+	c.Assert(err, gc.IsNil)
+	lookup, err := ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.IsNil)
+	c.Assert(lookup.Search, gc.Equals, "")
+	c.Assert(lookup.Filter, gc.DeepEquals, &storage.KeyFilter{
+		Algorithm:     "eddsa",
+		MinBits:       256,
+		CreatedAfter:  time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		CreatedBefore: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Flags:         openpgp.KeyFlagSign | openpgp.KeyFlagEncrypt,
+	})
+
+	for _, query := range []string{
+		"op=index&search=alice&algo=rot13",
+		"op=index&search=alice&minbits=-1",
+		"op=index&search=alice&created_after=yesterday",
+		"op=index&search=alice&flags=teleport",
+		// Keys are only listed by their properties.
+		"op=get&algo=rsa",
+	} {
+		testUrl, err := url.Parse("/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		_, err = ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+		c.Assert(err, gc.NotNil, gc.Commentf("%s", query))
+	}
+}
+
+func (s *RequestsSuite) TestDomainSearch(c *gc.C) {
+	testUrl, err := url.Parse("/pks/lookup?op=index&search=Domain:Example.COM")
+	c.Assert(err, gc.IsNil)
+	lookup, err := ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.IsNil)
+	c.Assert(lookup.Domain, gc.Equals, "example.com")
+	c.Assert(lookup.Search, gc.Equals, "example.com")
+
+	for _, search := range []string{"domain:", "domain:example..com", "domain:alice@example.com", "domain:example.com%20org"} {
+		testUrl, err := url.Parse("/pks/lookup?op=index&search=" + search)
+		c.Assert(err, gc.IsNil)
+		_, err = ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+		c.Assert(err, gc.NotNil, gc.Commentf("%s", search))
+	}
+}
+
 func (s *RequestsSuite) TestAdd(c *gc.C) {
 	// adding a key
 	testUrl, err := url.Parse("/pks/add")
@@ -158,3 +249,39 @@ func (s *RequestsSuite) TestAddMissingKey(c *gc.C) {
 	// error without keytext
 	c.Assert(err, gc.NotNil)
 }
+
+func (s *RequestsSuite) TestDelete(c *gc.C) {
+	// net/http does not parse the body of a DELETE, so ParseDelete does.
+	form := url.Values{
+		"keytext":     {"mi llave"},
+		"keysig":      {"mi firma"},
+		"fingerprint": {"0x87A8BEFC82A690D87256652F891B0448290C2992"},
+	}
+	req, err := http.NewRequest("DELETE", "/pks/delete", bytes.NewBufferString(form.Encode()))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	del, err := ParseDelete(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(del.Keytext, gc.Equals, "mi llave")
+	c.Assert(del.Keysig, gc.Equals, "mi firma")
+	c.Assert(del.Fingerprint, gc.Equals, "87a8befc82a690d87256652f891b0448290c2992")
+
+	form.Set("fingerprint", "891b0448290c2992")
+	req, err = http.NewRequest("POST", "/pks/delete", bytes.NewBufferString(form.Encode()))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = ParseDelete(req)
+	c.Assert(err, gc.ErrorMatches, "invalid fingerprint.*")
+
+	form.Del("keysig")
+	req, err = http.NewRequest("POST", "/pks/delete", bytes.NewBufferString(form.Encode()))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = ParseDelete(req)
+	c.Assert(err, gc.ErrorMatches, "missing required parameter: keysig")
+
+	req, err = http.NewRequest("GET", "/pks/delete?"+form.Encode(), nil)
+	c.Assert(err, gc.IsNil)
+	_, err = ParseDelete(req)
+	c.Assert(err, gc.NotNil)
+}
@@ -0,0 +1,80 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultReplicas is the default number of points each shard is given on the
+// hash ring. More points spread keys more evenly among shards.
+const DefaultReplicas = 100
+
+// Ring assigns key fingerprints to shards by consistent hashing, so that
+// adding or removing a shard only moves the keys assigned to it.
+//
+// Shards are identified by name; every router fronting the same shards must
+// use the same names for them, in order to agree on where keys are placed.
+type Ring struct {
+	points []uint64
+	shards map[uint64]string
+}
+
+// NewRing returns a hash ring over the given shards, with replicas points on
+// the ring for each.
+func NewRing(shards []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{shards: map[uint64]string{}}
+	for _, shard := range shards {
+		for i := 0; i < replicas; i++ {
+			point := ringHash(shard + "#" + strconv.Itoa(i))
+			if _, ok := r.shards[point]; ok {
+				continue
+			}
+			r.shards[point] = shard
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Shard returns the shard that the key with the given fingerprint is assigned
+// to, or an empty string if the ring has no shards.
+func (r *Ring) Shard(fingerprint string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(strings.ToLower(fingerprint))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i]]
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
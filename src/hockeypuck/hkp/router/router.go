@@ -0,0 +1,728 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package router provides an HKP front end for a cluster of Hockeypuck
+// servers, each storing a shard of the keys. Keys are assigned to shards by
+// consistent hashing of their fingerprints: lookups and submissions of a key
+// are routed to its shard, and searches are fanned out to every shard with
+// the results merged.
+//
+// Requests between keyservers, for hash queries, pushes and verified
+// address exports, and verification of email addresses by token, are not
+// routed: each shard is a keyserver of its own for these, reached directly.
+// Erasure requests are routed only by fingerprint, since filing a request
+// by address with every shard would have it moderated on each.
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"hockeypuck/hkp"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Router routes HKP requests to the shards of a cluster.
+type Router struct {
+	shards   []string
+	ring     *Ring
+	replicas int
+	client   *http.Client
+}
+
+// Option modifies the behavior of a Router.
+type Option func(*Router)
+
+// Replicas sets the number of points each shard is given on the hash ring.
+// All routers in front of the same shards must use the same value.
+func Replicas(n int) Option {
+	return func(rt *Router) { rt.replicas = n }
+}
+
+// HTTPClient sets the client used to make requests to the shards.
+func HTTPClient(c *http.Client) Option {
+	return func(rt *Router) { rt.client = c }
+}
+
+// New returns a Router over the shards with the given base URLs.
+func New(shards []string, options ...Option) (*Router, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards configured")
+	}
+	rt := &Router{
+		replicas: DefaultReplicas,
+		client:   &http.Client{Timeout: defaultTimeout},
+	}
+	for _, shard := range shards {
+		u, err := url.Parse(shard)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid shard URL %q", shard)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf("invalid shard URL %q", shard)
+		}
+		rt.shards = append(rt.shards, strings.TrimSuffix(shard, "/"))
+	}
+	for _, option := range options {
+		option(rt)
+	}
+	rt.ring = NewRing(rt.shards, rt.replicas)
+	return rt, nil
+}
+
+// Shard returns the base URL of the shard that the key with the given
+// fingerprint is assigned to.
+func (rt *Router) Shard(fingerprint string) string {
+	return rt.ring.Shard(fingerprint)
+}
+
+func (rt *Router) Register(r *httprouter.Router) {
+	r.GET("/pks/lookup", rt.Lookup)
+	r.HEAD("/pks/lookup", rt.LookupHead)
+	r.POST("/pks/add", rt.Add)
+	r.POST("/pks/dryrun", rt.DryRun)
+	r.POST("/pks/replace", rt.ForwardSigned)
+	r.POST("/pks/delete", rt.ForwardDelete)
+	r.DELETE("/pks/delete", rt.ForwardDelete)
+	r.POST("/pks/revoke", rt.Revoke)
+	r.POST("/pks/erasure", rt.Erasure)
+	r.GET("/key/:fpr", rt.KeyByFingerprint)
+	r.GET("/email/:addr", rt.KeyByEmail)
+	r.GET("/vks/v1/by-fingerprint/:fpr", rt.VKSByFingerprint)
+	r.GET("/vks/v1/by-keyid/:keyid", rt.VKSSearch)
+	r.GET("/vks/v1/by-email/:addr", rt.VKSSearch)
+	r.POST("/vks/v1/upload", rt.VKSUpload)
+	r.POST("/vks/v1/request-verify", rt.VKSRequestVerify)
+	r.GET("/.well-known/openpgpkey/*path", rt.WKD)
+}
+
+func httpError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode != http.StatusNotFound {
+		log.Errorf("HTTP %d: %+v", statusCode, err)
+	}
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+// fingerprint returns the fingerprint given as a search, if it is one.
+func fingerprint(search string) (string, bool) {
+	s := strings.TrimPrefix(strings.ToLower(search), "0x")
+	if len(s) != 40 && len(s) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// Lookup routes lookups of a key by fingerprint to its shard. Other lookups
+// are fanned out to all shards: keys and machine-readable indexes are merged,
+// and otherwise the first successful response is given.
+func (rt *Router) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	l, err := hkp.ParseLookup(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	merge := rt.first
+	switch {
+	case l.Op == hkp.OperationGet || l.Op == hkp.OperationHGet:
+		merge = rt.mergeKeys
+	case (l.Op == hkp.OperationIndex || l.Op == hkp.OperationVIndex) && l.Options[hkp.OptionMachineReadable]:
+		merge = func(w http.ResponseWriter, responses []*shardResponse) {
+			rt.mergeIndex(w, l, responses)
+		}
+	}
+	if fp, ok := fingerprint(l.Search); ok && l.Op != hkp.OperationStats {
+		rt.proxyKey(w, http.MethodGet, fp, r.URL.RequestURI(), merge)
+		return
+	}
+	merge(w, rt.fanOut(http.MethodGet, r.URL.RequestURI()))
+}
+
+// LookupHead routes HEAD lookups as Lookup does. Since there are no keys to
+// merge, the response to a fanned out lookup is that of the first shard
+// which found any, with the total results of an index summed over the
+// shards.
+func (rt *Router) LookupHead(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	l, err := hkp.ParseLookup(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if fp, ok := fingerprint(l.Search); ok && l.Op != hkp.OperationStats {
+		rt.proxyKey(w, http.MethodHead, fp, r.URL.RequestURI(), rt.mergeHead)
+		return
+	}
+	rt.mergeHead(w, rt.fanOut(http.MethodHead, r.URL.RequestURI()))
+}
+
+// KeyByFingerprint routes a short URL lookup of a key by fingerprint to its
+// shard.
+func (rt *Router) KeyByFingerprint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fp, ok := fingerprint(ps.ByName("fpr"))
+	if !ok {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid fingerprint %q", ps.ByName("fpr")))
+		return
+	}
+	rt.proxyKey(w, http.MethodGet, fp, r.URL.RequestURI(), rt.mergeKeys)
+}
+
+// KeyByEmail fans out a short URL lookup of keys by email address to all
+// shards.
+func (rt *Router) KeyByEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rt.mergeKeys(w, rt.fanOut(http.MethodGet, r.URL.RequestURI()))
+}
+
+// relayedHeaders are the headers copied from the response of a shard.
+var relayedHeaders = []string{
+	"Content-Type", "Content-Disposition", "Retry-After",
+	"X-HKP-Matched-Subkey", "X-HKP-Subkey-Binding", "X-HKP-Total-Results", "X-HKP-Next-Offset",
+}
+
+// proxyKey routes a lookup of a key by fingerprint to its shard. Keys are
+// assigned to shards by the fingerprints of their primary keys, but the
+// fingerprint may be that of a subkey, so if the shard does not have the
+// key, the lookup is fanned out to the other shards and their responses
+// merged by merge.
+func (rt *Router) proxyKey(w http.ResponseWriter, method string, fp string, uri string, merge func(http.ResponseWriter, []*shardResponse)) {
+	shard := rt.Shard(fp)
+	req, err := http.NewRequest(method, shard+uri, nil)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	resp, err := rt.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		var others []string
+		for _, other := range rt.shards {
+			if other != shard {
+				others = append(others, other)
+			}
+		}
+		responses := rt.fanOutTo(others, func(shard string) (*http.Request, error) {
+			return http.NewRequest(method, shard+uri, nil)
+		})
+		merge(w, append(responses, &shardResponse{shard: shard, status: http.StatusNotFound}))
+		return
+	}
+	rt.relay(w, shard, resp, err)
+}
+
+// relay copies the response to a request made to a shard.
+func (rt *Router) relay(w http.ResponseWriter, shard string, resp *http.Response, err error) {
+	if err != nil {
+		httpError(w, http.StatusBadGateway, errors.WithStack(err))
+		return
+	}
+	defer resp.Body.Close()
+	for _, name := range relayedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		log.Errorf("error copying response from shard %s: %v", shard, err)
+	}
+}
+
+type shardResponse struct {
+	shard  string
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// ok returns whether the shard responded successfully, with or without
+// results.
+func (sr *shardResponse) ok() bool {
+	return sr.err == nil && (sr.status == http.StatusOK || sr.status == http.StatusNotFound)
+}
+
+// fanOut makes a request with the given method to all shards concurrently.
+func (rt *Router) fanOut(method string, uri string) []*shardResponse {
+	return rt.fanOutTo(rt.shards, func(shard string) (*http.Request, error) {
+		return http.NewRequest(method, shard+uri, nil)
+	})
+}
+
+// fanOutTo makes the request given by newRequest to each of shards
+// concurrently.
+func (rt *Router) fanOutTo(shards []string, newRequest func(shard string) (*http.Request, error)) []*shardResponse {
+	responses := make([]*shardResponse, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			sr := &shardResponse{shard: shard}
+			responses[i] = sr
+			req, err := newRequest(shard)
+			if err != nil {
+				sr.err = errors.WithStack(err)
+				return
+			}
+			resp, err := rt.client.Do(req)
+			if err != nil {
+				sr.err = errors.WithStack(err)
+				return
+			}
+			defer resp.Body.Close()
+			sr.status, sr.header = resp.StatusCode, resp.Header
+			sr.body, sr.err = ioutil.ReadAll(resp.Body)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, sr := range responses {
+		if !sr.ok() {
+			log.Warningf("shard %s failed: status=%d err=%v", sr.shard, sr.status, sr.err)
+		}
+	}
+	return responses
+}
+
+// failed writes an error response if no shard responded successfully.
+func failed(w http.ResponseWriter, responses []*shardResponse) bool {
+	for _, sr := range responses {
+		if sr.ok() {
+			return false
+		}
+	}
+	httpError(w, http.StatusBadGateway, errors.New("no shard responded successfully"))
+	return true
+}
+
+func (rt *Router) mergeKeys(w http.ResponseWriter, responses []*shardResponse) {
+	if failed(w, responses) {
+		return
+	}
+	var keys []*openpgp.PrimaryKey
+	for _, sr := range responses {
+		if sr.err != nil || sr.status != http.StatusOK {
+			continue
+		}
+		shardKeys, err := openpgp.ReadArmorKeys(bytes.NewBuffer(sr.body))
+		if err != nil {
+			log.Warningf("invalid keys from shard %s: %v", sr.shard, err)
+			continue
+		}
+		keys = append(keys, shardKeys...)
+	}
+	if len(keys) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	err := openpgp.WriteArmoredPackets(w, keys)
+	if err != nil {
+		log.Errorf("error writing armored keys: %v", err)
+	}
+	w.Write([]byte("\n"))
+}
+
+func (rt *Router) mergeIndex(w http.ResponseWriter, l *hkp.Lookup, responses []*shardResponse) {
+	if failed(w, responses) {
+		return
+	}
+	var keys []string
+	for _, sr := range responses {
+		if sr.err != nil || sr.status != http.StatusOK {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewBuffer(sr.body))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" || strings.HasPrefix(line, "info:") || strings.HasPrefix(line, "ambiguous:") {
+				continue
+			}
+			// Each key is a pub line, followed by its uid lines.
+			if strings.HasPrefix(line, "pub:") {
+				keys = append(keys, "")
+			} else if len(keys) == 0 {
+				continue
+			}
+			keys[len(keys)-1] += line + "\n"
+		}
+	}
+	if len(keys) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "info:1:%d\n", len(keys))
+	// Keys matching a key ID may be on different shards, so whether it is
+	// ambiguous is only known once their results are merged.
+	if search := strings.TrimPrefix(l.Search, "0x"); search != l.Search && (len(search) == 8 || len(search) == 16) && len(keys) > 1 {
+		fmt.Fprintf(w, "ambiguous:%s:%d\n", strings.ToUpper(search), len(keys))
+	}
+	for _, key := range keys {
+		w.Write([]byte(key))
+	}
+}
+
+// first gives the first successful response from a shard.
+func (rt *Router) first(w http.ResponseWriter, responses []*shardResponse) {
+	if failed(w, responses) {
+		return
+	}
+	for _, sr := range responses {
+		if sr.ok() && sr.status == http.StatusOK {
+			w.Header().Set("Content-Type", sr.header.Get("Content-Type"))
+			w.Write(sr.body)
+			return
+		}
+	}
+	httpError(w, http.StatusNotFound, errors.New("not found"))
+}
+
+// mergeHead gives the status and headers of the first shard which found
+// anything for a HEAD lookup, with the total results summed over the shards.
+func (rt *Router) mergeHead(w http.ResponseWriter, responses []*shardResponse) {
+	if failed(w, responses) {
+		return
+	}
+	var found *shardResponse
+	total, counted := 0, false
+	for _, sr := range responses {
+		if !sr.ok() {
+			continue
+		}
+		if n, err := strconv.Atoi(sr.header.Get("X-HKP-Total-Results")); err == nil {
+			total += n
+			counted = true
+		}
+		if found == nil && sr.status == http.StatusOK {
+			found = sr
+		}
+	}
+	if counted {
+		w.Header().Set("X-HKP-Total-Results", strconv.Itoa(total))
+	}
+	if found == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	for _, name := range relayedHeaders {
+		if v := found.header.Get(name); v != "" && name != "X-HKP-Total-Results" && name != "X-HKP-Next-Offset" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// found gives the response of the shard which found what a request
+// concerned: the first successful response, or else the first response
+// other than 404 Not Found, or else 404 Not Found.
+func (rt *Router) found(w http.ResponseWriter, responses []*shardResponse) {
+	var found *shardResponse
+	for _, sr := range responses {
+		if sr.err != nil || sr.status == http.StatusNotFound {
+			continue
+		}
+		if found == nil || sr.status < 300 && found.status >= 300 {
+			found = sr
+		}
+	}
+	if found == nil {
+		if !failed(w, responses) {
+			httpError(w, http.StatusNotFound, errors.New("not found"))
+		}
+		return
+	}
+	for _, name := range relayedHeaders {
+		if v := found.header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(found.status)
+	w.Write(found.body)
+}
+
+// splitKeys splits the keys in a submission by the shard they are assigned
+// to, armoring those of each shard as a separate submission.
+func (rt *Router) splitKeys(keytext string) (map[string]string, error) {
+	block, err := armor.Decode(bytes.NewBufferString(keytext))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := openpgp.NewKeyReader(block.Body).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	byShard := map[string][]*openpgp.PrimaryKey{}
+	for _, key := range keys {
+		shard := rt.Shard(key.Fingerprint())
+		byShard[shard] = append(byShard[shard], key)
+	}
+	result := map[string]string{}
+	for shard, keys := range byShard {
+		var buf bytes.Buffer
+		err = openpgp.WriteArmoredPackets(&buf, keys)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result[shard] = buf.String()
+	}
+	return result, nil
+}
+
+// submit posts the keys in a submission to their shards, decoding each
+// shard's JSON response with merge.
+func (rt *Router) submit(w http.ResponseWriter, r *http.Request, merge func(*json.Decoder) error) bool {
+	add, err := hkp.ParseAdd(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return false
+	}
+	if add.Keysig != "" {
+		httpError(w, http.StatusBadRequest, errors.New("signed submissions are not supported by the router"))
+		return false
+	}
+	submissions, err := rt.splitKeys(add.Keytext)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return false
+	}
+	for shard, keytext := range submissions {
+		form := url.Values{}
+		for name, values := range r.PostForm {
+			form[name] = values
+		}
+		form.Set("keytext", keytext)
+		resp, err := rt.client.PostForm(shard+r.URL.Path, form)
+		if err != nil {
+			httpError(w, http.StatusBadGateway, errors.WithStack(err))
+			return false
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			httpError(w, http.StatusBadGateway, errors.Errorf("shard %s responded with status %d", shard, resp.StatusCode))
+			return false
+		}
+		err = merge(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			httpError(w, http.StatusBadGateway, errors.Wrapf(err, "invalid response from shard %s", shard))
+			return false
+		}
+	}
+	return true
+}
+
+// Add submits each key to its shard.
+func (rt *Router) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var result hkp.AddResponse
+	ok := rt.submit(w, r, func(dec *json.Decoder) error {
+		var resp hkp.AddResponse
+		err := dec.Decode(&resp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		result.Inserted = append(result.Inserted, resp.Inserted...)
+		result.Updated = append(result.Updated, resp.Updated...)
+		result.Ignored = append(result.Ignored, resp.Ignored...)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// DryRun submits each key to its shard as a dry run.
+func (rt *Router) DryRun(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var result hkp.DryRunResponse
+	ok := rt.submit(w, r, func(dec *json.Decoder) error {
+		var resp hkp.DryRunResponse
+		err := dec.Decode(&resp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		result.Keys = append(result.Keys, resp.Keys...)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// ForwardSigned forwards a signed replace request unchanged to the shard of
+// the key it concerns.
+func (rt *Router) ForwardSigned(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	submissions, err := rt.splitKeys(r.PostForm.Get("keytext"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if len(submissions) != 1 {
+		httpError(w, http.StatusBadRequest, errors.New("request must concern keys of a single shard"))
+		return
+	}
+	for shard := range submissions {
+		rt.forward(w, shard+r.URL.Path, r.PostForm)
+	}
+}
+
+// ForwardDelete forwards a signed delete request to the shard of the key
+// deleted: the key named by fingerprint, or else the key which signed it.
+func (rt *Router) ForwardDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	del, err := hkp.ParseDelete(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	form := url.Values{"keytext": {del.Keytext}, "keysig": {del.Keysig}}
+	if del.Fingerprint != "" {
+		form.Set("fingerprint", del.Fingerprint)
+		rt.forward(w, rt.Shard(del.Fingerprint)+r.URL.Path, form)
+		return
+	}
+	submissions, err := rt.splitKeys(del.Keytext)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if len(submissions) != 1 {
+		httpError(w, http.StatusBadRequest, errors.New("request must concern keys of a single shard"))
+		return
+	}
+	for shard := range submissions {
+		rt.forward(w, shard+r.URL.Path, form)
+	}
+}
+
+// Revoke posts revocation certificates to every shard, since a certificate
+// may name its issuer by key ID alone, and gives the response of the shard
+// storing the key revoked. Certificates revoking keys on different shards
+// must be submitted separately.
+func (rt *Router) Revoke(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	body := r.PostForm.Encode()
+	rt.found(w, rt.fanOutTo(rt.shards, func(shard string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, shard+r.URL.Path, strings.NewReader(body))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}))
+}
+
+// Erasure forwards an erasure request for a key to its shard. Requests for
+// an address alone are refused, as the address may be on keys in any shard.
+func (rt *Router) Erasure(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	erasure, err := hkp.ParseErasure(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	fp, ok := fingerprint(erasure.Fingerprint)
+	if !ok {
+		httpError(w, http.StatusBadRequest, errors.New("erasure requests must name the fingerprint of the key"))
+		return
+	}
+	rt.forward(w, rt.Shard(fp)+r.URL.Path, r.PostForm)
+}
+
+// WKD fans out a Web Key Directory request to all shards, with the host of
+// the request, which names the domain in the direct method. The keys found
+// are concatenated, as WKD serves them unarmored.
+func (rt *Router) WKD(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	responses := rt.fanOutTo(rt.shards, func(shard string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, shard+r.URL.RequestURI(), nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.Host = r.Host
+		return req, nil
+	})
+	if failed(w, responses) {
+		return
+	}
+	var keys []byte
+	var found *shardResponse
+	for _, sr := range responses {
+		if sr.ok() && sr.status == http.StatusOK {
+			if found == nil {
+				found = sr
+			}
+			keys = append(keys, sr.body...)
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if found == nil {
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	w.Header().Set("Content-Type", found.header.Get("Content-Type"))
+	if strings.HasSuffix(r.URL.Path, "/policy") {
+		// The policy of each shard is the same.
+		keys = found.body
+	}
+	w.Write(keys)
+}
+
+// forward posts a form to a shard and relays its response.
+func (rt *Router) forward(w http.ResponseWriter, target string, form url.Values) {
+	resp, err := rt.client.PostForm(target, form)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, errors.WithStack(err))
+		return
+	}
+	defer resp.Body.Close()
+	if v := resp.Header.Get("Content-Type"); v != "" {
+		w.Header().Set("Content-Type", v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,367 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type RouterSuite struct {
+	shards []*fakeShard
+	srv    *httptest.Server
+	rt     *Router
+}
+
+var _ = gc.Suite(&RouterSuite{})
+
+// fakeShard serves the keys it is given.
+type fakeShard struct {
+	*httptest.Server
+	keys     []*openpgp.PrimaryKey
+	requests []string
+}
+
+func newFakeShard() *fakeShard {
+	fs := &fakeShard{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.serve))
+	return fs
+}
+
+func (fs *fakeShard) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	fs.requests = append(fs.requests, r.Method+" "+r.URL.Path)
+	switch r.URL.Path {
+	case "/pks/lookup":
+		var matched []*openpgp.PrimaryKey
+		search := strings.TrimPrefix(strings.ToLower(r.Form.Get("search")), "0x")
+		for _, key := range fs.keys {
+			for _, uid := range key.UserIDs {
+				if strings.Contains(strings.ToLower(uid.Keywords), search) || key.Fingerprint() == search {
+					matched = append(matched, key)
+					break
+				}
+			}
+			for _, subKey := range key.SubKeys {
+				if subKey.Fingerprint() == search && (len(matched) == 0 || matched[len(matched)-1] != key) {
+					matched = append(matched, key)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Form.Get("options") == "mr" {
+			fmt.Fprintf(w, "info:1:%d\n", len(matched))
+			for _, key := range matched {
+				fmt.Fprintf(w, "pub:%s:1:2048:0::\n", key.Fingerprint())
+				fmt.Fprintf(w, "uid:%s:0::\n", url.PathEscape(key.UserIDs[0].Keywords))
+			}
+			return
+		}
+		openpgp.WriteArmoredPackets(w, matched)
+	case "/pks/add":
+		keys := openpgp.MustReadArmorKeys(bytes.NewBufferString(r.Form.Get("keytext")))
+		var resp hkp.AddResponse
+		for _, key := range keys {
+			fs.keys = append(fs.keys, key)
+			resp.Inserted = append(resp.Inserted, key.QualifiedFingerprint())
+		}
+		json.NewEncoder(w).Encode(&resp)
+	case "/vks/v1/upload":
+		var req hkp.VKSUploadRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		key := openpgp.MustReadArmorKeys(bytes.NewBufferString(req.Keytext))[0]
+		fs.keys = append(fs.keys, key)
+		tokens, _ := storage.NewTokens(nil, bytes.Repeat([]byte("k"), 32))
+		token, _ := tokens.UploadToken(key.Fingerprint())
+		json.NewEncoder(w).Encode(&hkp.VKSUploadResponse{KeyFingerprint: key.Fingerprint(), Token: token})
+	case "/pks/erasure":
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&hkp.ErasureResponse{ID: "1", Status: "pending"})
+	case "/vks/v1/request-verify":
+		json.NewEncoder(w).Encode(&hkp.VKSUploadResponse{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *RouterSuite) SetUpTest(c *gc.C) {
+	var urls []string
+	s.shards = nil
+	for i := 0; i < 3; i++ {
+		fs := newFakeShard()
+		s.shards = append(s.shards, fs)
+		urls = append(urls, fs.URL)
+	}
+	var err error
+	s.rt, err = New(urls)
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	s.rt.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *RouterSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+	for _, fs := range s.shards {
+		fs.Close()
+	}
+}
+
+func (s *RouterSuite) shard(c *gc.C, fp string) *fakeShard {
+	shard := s.rt.Shard(fp)
+	for _, fs := range s.shards {
+		if fs.URL == shard {
+			return fs
+		}
+	}
+	c.Fatalf("no shard for %s", fp)
+	return nil
+}
+
+func (s *RouterSuite) add(c *gc.C, names ...string) hkp.AddResponse {
+	var keys []*openpgp.PrimaryKey
+	for _, name := range names {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	var buf bytes.Buffer
+	err := openpgp.WriteArmoredPackets(&buf, keys)
+	c.Assert(err, gc.IsNil)
+	resp, err := http.PostForm(s.srv.URL+"/pks/add", url.Values{"keytext": {buf.String()}})
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var result hkp.AddResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, gc.IsNil)
+	return result
+}
+
+func (s *RouterSuite) TestRing(c *gc.C) {
+	shards := []string{"a", "b", "c", "d"}
+	ring := NewRing(shards, 0)
+	counts := map[string]int{}
+	moved := 0
+	smaller := NewRing(shards[:3], 0)
+	for i := 0; i < 4000; i++ {
+		fp := fmt.Sprintf("%040x", i)
+		shard := ring.Shard(fp)
+		counts[shard]++
+		c.Assert(ring.Shard(strings.ToUpper(fp)), gc.Equals, shard)
+		// Removing a shard only moves the keys assigned to it.
+		if shard != "d" {
+			c.Assert(smaller.Shard(fp), gc.Equals, shard)
+		} else {
+			moved++
+		}
+	}
+	for _, shard := range shards {
+		c.Assert(counts[shard] > 500, gc.Equals, true, gc.Commentf("shard %s has %d keys", shard, counts[shard]))
+	}
+	c.Assert(moved, gc.Equals, counts["d"])
+	c.Assert(NewRing(nil, 0).Shard("00"), gc.Equals, "")
+}
+
+func (s *RouterSuite) TestAddRoutesByFingerprint(c *gc.C) {
+	result := s.add(c, "alice_signed.asc", "uat.asc", "e68e311d.asc")
+	c.Assert(result.Inserted, gc.HasLen, 3)
+	for _, fs := range s.shards {
+		for _, key := range fs.keys {
+			c.Assert(s.shard(c, key.Fingerprint()), gc.Equals, fs)
+		}
+	}
+}
+
+func (s *RouterSuite) TestLookupByFingerprint(c *gc.C) {
+	s.add(c, "alice_signed.asc", "uat.asc", "e68e311d.asc")
+	for _, fs := range s.shards {
+		fs.requests = nil
+	}
+
+	fp := "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	resp, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x" + fp)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(resp.Body)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, fp)
+
+	// Only the key's shard was asked for it.
+	for _, fs := range s.shards {
+		if fs == s.shard(c, fp) {
+			c.Assert(fs.requests, gc.DeepEquals, []string{"GET /pks/lookup"})
+		} else {
+			c.Assert(fs.requests, gc.HasLen, 0)
+		}
+	}
+}
+
+func (s *RouterSuite) TestLookupBySubKeyFingerprint(c *gc.C) {
+	s.add(c, "alice_signed.asc", "uat.asc", "e68e311d.asc")
+
+	// Find a subkey assigned to a shard other than its key's.
+	var key *openpgp.PrimaryKey
+	var subKey *openpgp.SubKey
+	for _, fs := range s.shards {
+		for _, k := range fs.keys {
+			for _, sk := range k.SubKeys {
+				if s.shard(c, sk.Fingerprint()) != fs {
+					key, subKey = k, sk
+				}
+			}
+		}
+	}
+	c.Assert(subKey, gc.NotNil)
+	for _, fs := range s.shards {
+		fs.requests = nil
+	}
+
+	resp, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x" + subKey.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(resp.Body)
+	resp.Body.Close()
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, key.Fingerprint())
+	// The subkey's shard was asked first, then the others.
+	for _, fs := range s.shards {
+		c.Assert(fs.requests, gc.DeepEquals, []string{"GET /pks/lookup"})
+	}
+
+	resp, err = http.Head(s.srv.URL + "/pks/lookup?op=get&search=0x" + subKey.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	resp, err = http.Head(s.srv.URL + "/pks/lookup?op=get&search=0x" + strings.Repeat("0", 40))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *RouterSuite) TestErasureRoutesByFingerprint(c *gc.C) {
+	fp := "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	resp, err := http.PostForm(s.srv.URL+"/pks/erasure", url.Values{
+		"fingerprint": {fp}, "contact": {"alice@example.com"}})
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusAccepted)
+	for _, fs := range s.shards {
+		if fs == s.shard(c, fp) {
+			c.Assert(fs.requests, gc.DeepEquals, []string{"POST /pks/erasure"})
+		} else {
+			c.Assert(fs.requests, gc.HasLen, 0)
+		}
+	}
+
+	resp, err = http.PostForm(s.srv.URL+"/pks/erasure", url.Values{
+		"address": {"alice@example.com"}, "contact": {"alice@example.com"}})
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *RouterSuite) TestSearchFansOut(c *gc.C) {
+	s.add(c, "alice_signed.asc", "uat.asc", "e68e311d.asc")
+
+	resp, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=casey")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(resp.Body)
+	c.Assert(keys, gc.HasLen, 2)
+
+	resp, err = http.Get(s.srv.URL + "/pks/lookup?op=index&options=mr&search=casey")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	c.Assert(lines, gc.HasLen, 5)
+	c.Assert(lines[0], gc.Equals, "info:1:2")
+
+	resp, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=nobody")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *RouterSuite) TestVKSRoutesByFingerprint(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	post := func(path string, req interface{}) *http.Response {
+		body, err := json.Marshal(req)
+		c.Assert(err, gc.IsNil)
+		resp, err := http.Post(s.srv.URL+path, "application/json", bytes.NewReader(body))
+		c.Assert(err, gc.IsNil)
+		return resp
+	}
+
+	resp := post("/vks/v1/upload", &hkp.VKSUploadRequest{Keytext: string(keytext)})
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var upload hkp.VKSUploadResponse
+	c.Assert(json.NewDecoder(resp.Body).Decode(&upload), gc.IsNil)
+
+	resp = post("/vks/v1/request-verify", &hkp.VKSVerifyRequest{Token: upload.Token})
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	fp := "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	for _, fs := range s.shards {
+		if fs == s.shard(c, fp) {
+			c.Assert(fs.requests, gc.DeepEquals, []string{"POST /vks/v1/upload", "POST /vks/v1/request-verify"})
+		} else {
+			c.Assert(fs.requests, gc.HasLen, 0)
+		}
+	}
+
+	resp = post("/vks/v1/request-verify", &hkp.VKSVerifyRequest{Token: "bogus"})
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *RouterSuite) TestShardUnavailable(c *gc.C) {
+	for _, fs := range s.shards {
+		fs.Close()
+	}
+	resp, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=casey")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadGateway)
+}
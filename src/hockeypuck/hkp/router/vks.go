@@ -0,0 +1,138 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/storage"
+)
+
+// maxVKSRequestLen limits the size of a VKS request forwarded to a shard.
+const maxVKSRequestLen = 8 << 20
+
+// VKSByFingerprint routes a VKS lookup of a key by fingerprint to its shard,
+// as KeyByFingerprint does.
+func (rt *Router) VKSByFingerprint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fp, ok := fingerprint(ps.ByName("fpr"))
+	if !ok {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid fingerprint %q", ps.ByName("fpr")))
+		return
+	}
+	rt.proxyKey(w, http.MethodGet, fp, r.URL.RequestURI(), rt.mergeKeys)
+}
+
+// VKSSearch fans out a VKS lookup of keys by key ID or email address to all
+// shards.
+func (rt *Router) VKSSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rt.mergeKeys(w, rt.fanOut(http.MethodGet, r.URL.RequestURI()))
+}
+
+// VKSUpload forwards a VKS upload to the shard of the key uploaded.
+func (rt *Router) VKSUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxVKSRequestLen))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, errors.WithStack(err))
+		return
+	}
+	var req hkp.VKSUploadRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	submissions, err := rt.splitKeys(req.Keytext)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if len(submissions) != 1 {
+		httpError(w, http.StatusBadRequest, errors.New("expected a single key"))
+		return
+	}
+	for shard := range submissions {
+		rt.forwardJSON(w, shard+r.URL.Path, body)
+	}
+}
+
+// VKSRequestVerify forwards a VKS verification request to the shard which
+// issued its upload token. The token is signed by the shard, and is only
+// read here to find the fingerprint of the key it identifies.
+func (rt *Router) VKSRequestVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxVKSRequestLen))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, errors.WithStack(err))
+		return
+	}
+	var req hkp.VKSVerifyRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	fp, ok := uploadTokenFingerprint(req.Token)
+	if !ok {
+		httpError(w, http.StatusBadRequest, errors.WithStack(storage.ErrInvalidToken))
+		return
+	}
+	rt.forwardJSON(w, rt.Shard(fp)+r.URL.Path, body)
+}
+
+// uploadTokenFingerprint returns the fingerprint claimed by an upload token,
+// without checking its signature.
+func uploadTokenFingerprint(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	var claims storage.TokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Action != storage.TokenUpload {
+		return "", false
+	}
+	return fingerprint(claims.Fingerprint)
+}
+
+// forwardJSON posts a JSON request body to a shard, copying its response.
+func (rt *Router) forwardJSON(w http.ResponseWriter, url string, body []byte) {
+	resp, err := rt.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		httpError(w, http.StatusBadGateway, errors.WithStack(err))
+		return
+	}
+	defer resp.Body.Close()
+	if v := resp.Header.Get("Content-Type"); v != "" {
+		w.Header().Set("Content-Type", v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,135 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// keyEncoding enumerates the representations in which a short URL may serve
+// keys, chosen by the request's Accept header.
+type keyEncoding int
+
+const (
+	encodingArmored keyEncoding = iota
+	encodingBinary
+	encodingJSON
+)
+
+// negotiateKeyEncoding returns the first key representation acceptable to the
+// client. Armored keys are served if nothing more specific is requested.
+func negotiateKeyEncoding(accept string) keyEncoding {
+	for _, field := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return encodingJSON
+		case "application/octet-stream":
+			return encodingBinary
+		case "application/pgp-keys", "text/plain", "*/*":
+			return encodingArmored
+		}
+	}
+	return encodingArmored
+}
+
+// KeyByFingerprint serves the key with the given fingerprint at
+// /key/<fingerprint>, a stable short alias for op=get suitable for linking.
+func (h *Handler) KeyByFingerprint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fp := strings.ToLower(strings.TrimPrefix(ps.ByName("fpr"), "0x"))
+	if _, err := hex.DecodeString(fp); err != nil || len(fp) != fingerprintKeyIDLen {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid fingerprint %q", ps.ByName("fpr")))
+		return
+	}
+	l := &Lookup{Op: OperationGet, Search: "0x" + fp, Options: OptionSet{}}
+	h.serveShort(w, r, l, nil)
+}
+
+// KeyByEmail serves the keys having a user ID with the given email address at
+// /email/<address>, a stable short alias for op=get suitable for linking.
+func (h *Handler) KeyByEmail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	addr := strings.ToLower(ps.ByName("addr"))
+	if at := strings.Index(addr, "@"); at <= 0 || at == len(addr)-1 {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid email address %q", ps.ByName("addr")))
+		return
+	}
+	l := &Lookup{Op: OperationGet, Search: addr, Options: OptionSet{}}
+	h.serveShort(w, r, l, func(key *openpgp.PrimaryKey) bool {
+		for _, uid := range key.UserIDs {
+			keywords := strings.ToLower(uid.Keywords)
+			if keywords == addr || strings.Contains(keywords, "<"+addr+">") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (h *Handler) serveShort(w http.ResponseWriter, r *http.Request, l *Lookup, match func(*openpgp.PrimaryKey) bool) {
+	if h.analytics != nil {
+		h.analytics.Record(string(l.Op), l.Search)
+	}
+	h.setSecurityHeaders(w)
+	w.Header().Set("Vary", "Accept")
+
+	keys, ok := h.servedKeys(w, l, match)
+	if !ok {
+		return
+	}
+
+	kw := h.keyWriter(l)
+	var err error
+	switch negotiateKeyEncoding(r.Header.Get("Accept")) {
+	case encodingJSON:
+		keys, err = kw.Filter(keys)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		err = h.jsonFormat().Write(w, l, keys)
+	case encodingBinary:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for _, key := range keys {
+			err = kw.Write(w, key)
+			if err != nil {
+				break
+			}
+		}
+	default:
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		err = kw.WriteArmored(w, keys, h.keyWriterOptions...)
+		if err == nil {
+			_, err = w.Write([]byte("\n"))
+		}
+	}
+	if err != nil {
+		log.Errorf("get %q: error writing keys: %v", l.Search, err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+)
+
+// DefaultBatchSize is the default number of elements written to a prefix
+// tree in each batch by a BatchInserter.
+const DefaultBatchSize = 5000
+
+// BatchInserter groups insertions into a prefix tree into batches, where the
+// prefix tree supports them, so that bulk loads do not write every tree node
+// as it changes. Insertions may not be written until Flush is called.
+type BatchInserter struct {
+	ptree recon.PrefixTree
+	size  int
+	n     int
+}
+
+// NewBatchInserter returns a BatchInserter writing batches of up to size
+// elements to ptree.
+func NewBatchInserter(ptree recon.PrefixTree, size int) *BatchInserter {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return &BatchInserter{ptree: ptree, size: size}
+}
+
+// Insert adds an element to the prefix tree.
+func (b *BatchInserter) Insert(z *cf.Zp) error {
+	bt, ok := b.ptree.(recon.BatchPrefixTree)
+	if !ok {
+		return errors.WithStack(b.ptree.Insert(z))
+	}
+	if b.n == 0 {
+		bt.BeginBatch()
+	}
+	err := b.ptree.Insert(z)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b.n++
+	if b.n >= b.size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush writes the pending insertions to the prefix tree.
+func (b *BatchInserter) Flush() error {
+	bt, ok := b.ptree.(recon.BatchPrefixTree)
+	if !ok || b.n == 0 {
+		return nil
+	}
+	b.n = 0
+	return errors.WithStack(bt.CommitBatch())
+}
@@ -0,0 +1,65 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"strings"
+
+	"hockeypuck/hkp/storage"
+)
+
+// LocalKeys identifies keys which are stored and served by this server, but
+// are never added to the recon prefix tree. Such keys are neither gossiped to
+// recon partners nor included in dumps.
+//
+// Keys are matched by their full fingerprint, as a long key ID may be shared
+// by another key.
+type LocalKeys map[string]bool
+
+// NewLocalKeys returns a LocalKeys set containing the given fingerprints.
+func NewLocalKeys(fps []string) LocalKeys {
+	lk := LocalKeys{}
+	for _, fp := range fps {
+		lk[strings.ToLower(fp)] = true
+	}
+	return lk
+}
+
+// Contains returns whether the key with the given fingerprint is local-only.
+func (lk LocalKeys) Contains(fp string) bool {
+	return lk[strings.ToLower(fp)]
+}
+
+// Excludes returns whether the given key change concerns a local-only key,
+// and so must not be applied to the prefix tree.
+func (lk LocalKeys) Excludes(kc storage.KeyChange) bool {
+	if len(lk) == 0 {
+		return false
+	}
+	switch kc := kc.(type) {
+	case storage.KeyAdded:
+		return lk.Contains(kc.ID)
+	case storage.KeyReplaced:
+		return lk.Contains(kc.NewID)
+	case storage.KeyNotChanged:
+		return lk.Contains(kc.ID)
+	case storage.KeyRemoved:
+		return lk.Contains(kc.ID)
+	}
+	return false
+}
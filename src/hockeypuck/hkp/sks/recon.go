@@ -19,6 +19,7 @@ package sks
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/golang-lru"
@@ -36,9 +38,12 @@ import (
 	cf "hockeypuck/conflux"
 	"hockeypuck/conflux/recon"
 	"hockeypuck/conflux/recon/leveldb"
+	"hockeypuck/hkp/alert"
+	"hockeypuck/hkp/discovery"
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
+	"hockeypuck/tracing"
 )
 
 const (
@@ -48,6 +53,8 @@ const (
 	maxRequestChunkSize    = 100
 	minRequestChunkSize    = 1
 	seenCacheSize          = 16384
+	maxRecoveryAge         = 24 * time.Hour
+	recoveryBatchSize      = 1000
 )
 
 type keyRecoveryCounter map[string]int
@@ -55,12 +62,22 @@ type keyRecoveryCounter map[string]int
 type Peer struct {
 	peer             *recon.Peer
 	storage          storage.Storage
-	settings         *recon.Settings
 	ptree            recon.PrefixTree
 	http             *http.Client
+	resolver         *discovery.Resolver
 	keyReaderOptions []openpgp.KeyReaderOption
+	upsertOptions    []storage.UpsertOption
+	localKeys        LocalKeys
 	userAgent        string
 
+	// recovery, if set, persists the keys pending recovery from peers.
+	recovery storage.RecoveryStore
+
+	alerts *alert.Alerter
+	// divergence is the number of keys missing from this keyserver found
+	// in a recon session at which an alert is raised.
+	divergence int
+
 	// Adaptive request size
 	requestChunkSize int
 	slowStart        bool
@@ -70,6 +87,9 @@ type Peer struct {
 	path  string
 	stats *Stats
 
+	// listener is the subscription updating the prefix tree with key changes.
+	listener storage.ListenerID
+
 	t tomb.Tomb
 }
 
@@ -84,7 +104,51 @@ func NewPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
 	return leveldb.New(s.PTreeConfig, path)
 }
 
-func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.KeyReaderOption, userAgent string) (*Peer, error) {
+// PeerOption modifies the behavior of a Peer.
+type PeerOption func(*Peer)
+
+// UpsertOptions sets the options used when merging keys received by recon.
+func UpsertOptions(opts ...storage.UpsertOption) PeerOption {
+	return func(p *Peer) {
+		p.upsertOptions = append(p.upsertOptions, opts...)
+	}
+}
+
+// LocalOnly excludes the given keys from the prefix tree, so that they are
+// never offered to recon partners.
+func LocalOnly(lk LocalKeys) PeerOption {
+	return func(p *Peer) {
+		p.localKeys = lk
+	}
+}
+
+// RecoveryQueue persists the keys pending recovery from recon partners in
+// rs, so that recovery interrupted by a restart resumes when the peer is
+// started again.
+func RecoveryQueue(rs storage.RecoveryStore) PeerOption {
+	return func(p *Peer) {
+		p.recovery = rs
+	}
+}
+
+// Alerts raises alerts for refused updates to pinned keys, and for recon
+// sessions which find at least divergence keys missing from this keyserver.
+// Divergence alerts are disabled if divergence is zero.
+func Alerts(a *alert.Alerter, divergence int) PeerOption {
+	return func(p *Peer) {
+		p.alerts = a
+		p.divergence = divergence
+	}
+}
+
+// Discovery sets the resolver used to find the HTTP addresses of peers.
+func Discovery(r *discovery.Resolver) PeerOption {
+	return func(p *Peer) {
+		p.resolver = r
+	}
+}
+
+func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.KeyReaderOption, userAgent string, options ...PeerOption) (*Peer, error) {
 	if s == nil {
 		s = recon.DefaultSettings()
 	}
@@ -105,13 +169,13 @@ func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.
 
 	peer := recon.NewPeer(s, ptree)
 	sksPeer := &Peer{
-		peer:     peer,
-		storage:  st,
-		settings: s,
-		ptree:    ptree,
+		peer:    peer,
+		storage: st,
+		ptree:   ptree,
 		http: &http.Client{
 			Timeout: httpClientTimeout * time.Second,
 		},
+		resolver:         discovery.NewResolver(),
 		requestChunkSize: minRequestChunkSize,
 		slowStart:        true,
 		seenCache:        cache,
@@ -119,8 +183,11 @@ func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.
 		userAgent:        userAgent,
 		path:             path,
 	}
+	for _, option := range options {
+		option(sksPeer)
+	}
 	sksPeer.readStats()
-	st.Subscribe(sksPeer.updateDigests)
+	sksPeer.listener = st.Subscribe(sksPeer.updateDigests)
 	return sksPeer, nil
 }
 
@@ -133,7 +200,7 @@ func (p *Peer) logAddr(label string, addr net.Addr) *log.Entry {
 }
 
 func (p *Peer) logFields(label string, fields log.Fields) *log.Entry {
-	fields["label"] = fmt.Sprintf("%s %s", label, p.settings.ReconAddr)
+	fields["label"] = fmt.Sprintf("%s %s", label, p.peer.Settings().ReconAddr)
 	return log.WithFields(fields)
 }
 
@@ -186,28 +253,101 @@ func (r *Peer) Stats() *Stats {
 	return r.stats.clone()
 }
 
+// Partners returns the configured recon partners, by name.
+func (r *Peer) Partners() recon.PartnerMap {
+	result := recon.PartnerMap{}
+	for name, partner := range r.peer.Settings().Partners {
+		result[name] = partner
+	}
+	return result
+}
+
+// SetPartners changes the recon partners, and the networks from which other
+// peers may connect, without interrupting sessions in progress.
+func (r *Peer) SetPartners(partners recon.PartnerMap, allowCIDRs []string) error {
+	return r.peer.SetPartners(partners, allowCIDRs)
+}
+
+// ReconWith reconciles with the named partner now.
+func (r *Peer) ReconWith(name string) error {
+	partner, ok := r.peer.Settings().Partners[name]
+	if !ok {
+		return errors.Errorf("unknown recon partner %q", name)
+	}
+	addr, err := partner.ReconNet.Resolve(partner.ReconAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return r.peer.ReconWith(addr)
+}
+
+// RecordSubmission records the outcome of a key submission received from
+// outside of recon, in the source statistics.
+func (r *Peer) RecordSubmission(source string, kc storage.KeyChange, err error) {
+	r.updateSource(source, kc, err)
+}
+
+func (r *Peer) updateSource(source string, kc storage.KeyChange, err error) {
+	r.stats.UpdateSource(source, kc, err)
+	if storage.IsPinned(err) {
+		r.alerts.Raise(alert.Alert{
+			Severity:  alert.Warning,
+			Condition: alert.PinnedKey,
+			Subject:   err.Error(),
+			Summary:   fmt.Sprintf("refused update to pinned key from %s", source),
+			Details:   map[string]string{"source": source, "error": err.Error()},
+		})
+	}
+}
+
+// sourceHost returns the host of a recon peer address, so that statistics
+// are not split over the peer's ephemeral ports.
+func sourceHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func (r *Peer) Start() {
 	r.t.Go(r.handleRecovery)
 	r.t.Go(r.pruneStats)
 	r.peer.Start()
 }
 
-func (r *Peer) Stop() {
-	r.log(RECON).Info("recon processing: stopping")
-	r.t.Kill(nil)
-	err := r.t.Wait()
+// WarmUp reads the root of the prefix tree and its children, so that the
+// first recon session after a restart need not wait for them to be read
+// from disk.
+func (r *Peer) WarmUp() error {
+	root, err := r.ptree.Root()
 	if err != nil {
-		r.log(RECON).Errorf("%+v", err)
+		return errors.WithStack(err)
 	}
-	r.log(RECON).Info("recon processing: stopped")
+	_, err = root.Children()
+	return errors.WithStack(err)
+}
 
+func (r *Peer) Stop() {
+	// The recon peer is stopped first, so that the keys found by a session
+	// in progress are still recovered.
 	r.log(RECON).Info("recon peer: stopping")
-	err = errors.WithStack(r.peer.Stop())
+	err := errors.WithStack(r.peer.Stop())
 	if err != nil {
 		r.log(RECON).Errorf("%+v", err)
 	}
 	r.log(RECON).Info("recon peer: stopped")
 
+	r.log(RECON).Info("recon processing: stopping")
+	r.t.Kill(nil)
+	err = r.t.Wait()
+	if err != nil {
+		r.log(RECON).Errorf("%+v", err)
+	}
+	r.log(RECON).Info("recon processing: stopped")
+
+	// Stop following key changes before the prefix tree they update is closed.
+	r.storage.Unsubscribe(r.listener)
 	err = r.ptree.Close()
 	if err != nil {
 		r.log(RECON).Errorf("error closing prefix tree: %+v", err)
@@ -227,7 +367,17 @@ func DigestZp(digest string, zp *cf.Zp) error {
 	return nil
 }
 
+// ZpDigest returns the hex digest of a recon element; the inverse of
+// DigestZp.
+func ZpDigest(zp *cf.Zp) string {
+	zb := recon.PadSksElement(zp.Bytes())
+	return hex.EncodeToString(zb[:len(zb)-1])
+}
+
 func (r *Peer) updateDigests(change storage.KeyChange) error {
+	if r.localKeys.Excludes(change) {
+		return nil
+	}
 	r.stats.Update(change)
 	for _, digest := range change.InsertDigests() {
 		toInsert := make([]cf.Zp, 1)
@@ -249,11 +399,13 @@ func (r *Peer) updateDigests(change storage.KeyChange) error {
 }
 
 func (r *Peer) handleRecovery() error {
+	r.resumeRecovery()
 	for {
 		select {
 		case <-r.t.Dying():
 			return nil
 		case rcvr := <-r.peer.RecoverChan:
+			r.checkDivergence(rcvr)
 			func() {
 				defer close(rcvr.Done)
 				if err := r.requestRecovered(rcvr); err != nil {
@@ -264,6 +416,24 @@ func (r *Peer) handleRecovery() error {
 	}
 }
 
+func (r *Peer) checkDivergence(rcvr *recon.Recover) {
+	if r.divergence <= 0 || len(rcvr.RemoteElements) < r.divergence {
+		return
+	}
+	host := sourceHost(rcvr.RemoteAddr)
+	r.alerts.Raise(alert.Alert{
+		Severity:  alert.Warning,
+		Condition: alert.ReconDivergence,
+		Subject:   host,
+		Summary:   fmt.Sprintf("recon partner %s has %d keys missing from this keyserver", host, len(rcvr.RemoteElements)),
+		Details: map[string]string{
+			"partner":   host,
+			"missing":   fmt.Sprint(len(rcvr.RemoteElements)),
+			"threshold": fmt.Sprint(r.divergence),
+		},
+	})
+}
+
 func (r *Peer) unseenRemoteElements(rcvr *recon.Recover) []cf.Zp {
 	unseenElements := make([]cf.Zp, 0)
 	for _, v := range rcvr.RemoteElements {
@@ -279,8 +449,131 @@ func (r *Peer) unseenRemoteElements(rcvr *recon.Recover) []cf.Zp {
 	return unseenElements
 }
 
-func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
+// resumeRecovery requests the keys left in the recovery queue when the peer
+// was last stopped. Keys which cannot be recovered remain queued until they
+// expire.
+func (r *Peer) resumeRecovery() {
+	if r.recovery == nil {
+		return
+	}
+	start := time.Now()
+	n, err := r.recovery.ExpireRecovery(start.Add(-maxRecoveryAge))
+	if err != nil {
+		r.log(RECON).Errorf("failed to expire recovery queue: %v", err)
+		return
+	} else if n > 0 {
+		r.log(RECON).Infof("expired %d keys from recovery queue", n)
+	}
+	for {
+		select {
+		case <-r.t.Dying():
+			return
+		default:
+		}
+		pending, err := r.recovery.PendingRecoveries(start, recoveryBatchSize)
+		if err != nil {
+			r.log(RECON).Errorf("failed to read recovery queue: %v", err)
+			return
+		} else if len(pending) == 0 {
+			return
+		}
+		r.log(RECON).Infof("resuming recovery of %d queued keys", len(pending))
+		for _, rcvr := range queuedRecovers(pending) {
+			err = r.requestRecovered(rcvr)
+			if err != nil {
+				// Stop rather than read the same failed keys again; they
+				// are retried on the next restart, or rediscovered by recon.
+				r.logAddr(RECON, rcvr.RemoteAddr).Errorf("resumed recovery completed with errors: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// queuedRecovers groups queued keys into a Recover for each peer they are to
+// be recovered from.
+func queuedRecovers(pending []storage.PendingRecovery) []*recon.Recover {
+	var result []*recon.Recover
+	byAddr := map[string]*recon.Recover{}
+	for _, item := range pending {
+		rcvr, ok := byAddr[item.HKPAddr]
+		if !ok {
+			host, portStr, err := net.SplitHostPort(item.HKPAddr)
+			if err != nil {
+				log.Warningf("ignoring queued recovery from invalid address %q", item.HKPAddr)
+				continue
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				log.Warningf("ignoring queued recovery from invalid address %q", item.HKPAddr)
+				continue
+			}
+			rcvr = &recon.Recover{
+				RemoteAddr:   &net.TCPAddr{IP: net.ParseIP(host)},
+				RemoteConfig: &recon.Config{HTTPPort: port},
+			}
+			byAddr[item.HKPAddr] = rcvr
+			result = append(result, rcvr)
+		}
+		var zp cf.Zp
+		err := DigestZp(item.Digest, &zp)
+		if err != nil {
+			log.Warningf("ignoring queued recovery of invalid digest %q", item.Digest)
+			continue
+		}
+		rcvr.RemoteElements = append(rcvr.RemoteElements, zp)
+	}
+	return result
+}
+
+// queueRecovery records items as pending recovery from the peer rcvr.
+func (r *Peer) queueRecovery(rcvr *recon.Recover, items []cf.Zp) {
+	if r.recovery == nil || len(items) == 0 {
+		return
+	}
+	hkpAddr, err := rcvr.HkpAddr()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	pending := make([]storage.PendingRecovery, len(items))
+	for i := range items {
+		pending[i] = storage.PendingRecovery{
+			Digest:  ZpDigest(&items[i]),
+			HKPAddr: hkpAddr,
+			Queued:  now,
+		}
+	}
+	err = r.recovery.QueueRecovery(pending)
+	if err != nil {
+		r.logAddr(RECON, rcvr.RemoteAddr).Errorf("failed to queue recovery: %v", err)
+	}
+}
+
+// dequeueRecovery removes items from the recovery queue once recovered.
+func (r *Peer) dequeueRecovery(rcvr *recon.Recover, items []cf.Zp) {
+	if r.recovery == nil {
+		return
+	}
+	digests := make([]string, len(items))
+	for i := range items {
+		digests[i] = ZpDigest(&items[i])
+	}
+	err := r.recovery.DequeueRecovery(digests)
+	if err != nil {
+		r.logAddr(RECON, rcvr.RemoteAddr).Errorf("failed to dequeue recovery: %v", err)
+	}
+}
+
+func (r *Peer) requestRecovered(rcvr *recon.Recover) (_err error) {
 	items := r.unseenRemoteElements(rcvr)
+	ctx, span := tracing.Start(rcvr.Context, "recon.recover", tracing.KindInternal,
+		tracing.Int("recon.elements", len(items)))
+	defer func() {
+		span.SetError(_err)
+		span.Finish()
+	}()
+	r.queueRecovery(rcvr, items)
 	errCount := 0
 	// Chunk requests to keep the hashquery message size and peer load reasonable.
 	// Using additive increase, multiplicative decrease (AIMD) to adapt chunk size,
@@ -293,7 +586,7 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 		}
 		chunk := items[:chunksize]
 
-		err := r.requestChunk(rcvr, chunk)
+		err := r.requestChunk(ctx, rcvr, chunk)
 		if err == nil || chunksize <= minRequestChunkSize {
 			// Advance chunk window if successful or already at minimum size.
 			// (If it failed, we will retry with a smaller chunk size.)
@@ -320,6 +613,7 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 			for _, v := range chunk {
 				r.seenCache.Add(v.FullKeyHash(), nil)
 			}
+			r.dequeueRecovery(rcvr, chunk)
 		}
 
 	}
@@ -329,7 +623,13 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 	return nil
 }
 
-func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
+func (r *Peer) requestChunk(ctx context.Context, rcvr *recon.Recover, chunk []cf.Zp) (_err error) {
+	ctx, span := tracing.Start(ctx, "sks.hashquery", tracing.KindClient,
+		tracing.Int("recon.elements", len(chunk)))
+	defer func() {
+		span.SetError(_err)
+		span.Finish()
+	}()
 	var remoteAddr string
 	remoteAddr, err := rcvr.HkpAddr()
 	if err != nil {
@@ -357,16 +657,18 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		}
 	}
 
-	url := fmt.Sprintf("http://%s/pks/hashquery", remoteAddr)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(hqBuf.Bytes()))
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	req.Header.Set("Content-type", "sks/hashquery")
-	if r.userAgent != "" {
-		req.Header.Set("User-agent", r.userAgent)
-	}
-	resp, err := r.http.Do(req)
+	resp, err := r.resolver.Do(r.http, remoteAddr, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", base+"/pks/hashquery", bytes.NewReader(hqBuf.Bytes()))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.Header.Set("Content-type", "sks/hashquery")
+		tracing.Inject(ctx, req.Header)
+		if r.userAgent != "" {
+			req.Header.Set("User-agent", r.userAgent)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return errors.Wrap(err, "failed to query hashes")
 	}
@@ -411,7 +713,7 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		}
 		r.logAddr(RECON, rcvr.RemoteAddr).Debugf("key# %d: %d bytes", i+1, keyLen)
 		// Merge locally
-		res, err := r.upsertKeys(rcvr, keyBuf.Bytes())
+		res, err := r.upsertKeys(ctx, rcvr, keyBuf.Bytes())
 		if err != nil {
 			r.logAddr(RECON, rcvr.RemoteAddr).Errorf("cannot upsert: %v", err)
 			continue
@@ -435,9 +737,13 @@ func (r *upsertResult) add(r2 *upsertResult) {
 	r.unchanged += r2.unchanged
 }
 
-func (r *Peer) upsertKeys(rcvr *recon.Recover, buf []byte) (*upsertResult, error) {
+func (r *Peer) upsertKeys(ctx context.Context, rcvr *recon.Recover, buf []byte) (*upsertResult, error) {
+	_, span := tracing.Start(ctx, "openpgp.ReadKeys", tracing.KindInternal)
 	kr := openpgp.NewKeyReader(bytes.NewBuffer(buf), r.keyReaderOptions...)
 	keys, err := kr.Read()
+	span.SetAttributes(tracing.Int("keys", len(keys)))
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -447,8 +753,14 @@ func (r *Peer) upsertKeys(rcvr *recon.Recover, buf []byte) (*upsertResult, error
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		keyChange, err := storage.UpsertKey(r.storage, key)
-		if err != nil {
+		keyChange, err := storage.UpsertKey(r.storage, key, append(r.upsertOptions[:len(r.upsertOptions):len(r.upsertOptions)],
+			storage.Provenance(storage.ProvenanceRecon))...)
+		r.updateSource(SourceRecon(sourceHost(rcvr.RemoteAddr)), keyChange, err)
+		if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) {
+			r.logAddr(RECON, rcvr.RemoteAddr).Debug(err)
+			result.unchanged++
+			continue
+		} else if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		r.logAddr(RECON, rcvr.RemoteAddr).Debug(keyChange)
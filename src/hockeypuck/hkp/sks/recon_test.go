@@ -18,12 +18,21 @@
 package sks
 
 import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	gc "gopkg.in/check.v1"
 
+	cf "hockeypuck/conflux"
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/alert"
 	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
 )
@@ -67,3 +76,214 @@ func (s *SksSuite) TestPeerStats(c *gc.C) {
 	c.Assert(s.peer.stats.Daily[thisDay].Inserted, gc.Equals, 1)
 	c.Assert(s.peer.stats.Daily[thisDay].Updated, gc.Equals, 1)
 }
+
+func (s *SksSuite) TestSourceStats(c *gc.C) {
+	s.peer.RecordSubmission(SourceDirect, storage.KeyAdded{Digest: "decafbad"}, nil)
+	s.peer.RecordSubmission(SourceDirect, storage.KeyNotChanged{Digest: "decafbad"}, nil)
+	s.peer.RecordSubmission(SourceRecon("192.0.2.1"), storage.KeyReplaced{NewDigest: "cafebabe"}, nil)
+	s.peer.RecordSubmission(SourceRecon("192.0.2.1"), nil, storage.ErrKeyPinned)
+	s.peer.stats.AddSource(SourceAdmin, SourceStat{Accepted: 3, Merged: 2, Rejected: 1})
+
+	fn := filepath.Join(c.MkDir(), "stats")
+	c.Assert(s.peer.stats.WriteFile(fn), gc.IsNil)
+	stats := NewStats()
+	c.Assert(stats.ReadFile(fn), gc.IsNil)
+	c.Assert(stats.Sources, gc.DeepEquals, SourceStatMap{
+		SourceDirect:             {Accepted: 1},
+		SourceRecon("192.0.2.1"): {Merged: 1, Rejected: 1},
+		SourceAdmin:              {Accepted: 3, Merged: 2, Rejected: 1},
+	})
+}
+
+func (s *SksSuite) TestLocalOnly(c *gc.C) {
+	const fp = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	lk := NewLocalKeys([]string{"10FE8CF1B483F7525039AA2A361BC1F023E0DCCA"})
+	c.Assert(lk.Contains(fp), gc.Equals, true)
+	c.Assert(lk.Contains("361bc1f023e0dcca"), gc.Equals, false)
+	// Another key with the same long key ID is not local-only.
+	c.Assert(lk.Contains("ffffffffffffffffffffffff361bc1f023e0dcca"), gc.Equals, false)
+	c.Assert(lk.Excludes(storage.KeyAdded{ID: fp, Digest: "decafbad"}), gc.Equals, true)
+	c.Assert(lk.Excludes(storage.KeyReplaced{OldID: fp, NewID: fp, NewDigest: "decafbad"}), gc.Equals, true)
+	c.Assert(lk.Excludes(storage.KeyAdded{ID: "ffffffffffffffffffffffff361bc1f023e0dcca", Digest: "decafbad"}), gc.Equals, false)
+	c.Assert(LocalKeys(nil).Excludes(storage.KeyAdded{ID: fp}), gc.Equals, false)
+
+	peer, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), nil, "", LocalOnly(lk))
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.updateDigests(storage.KeyAdded{ID: fp, Digest: "decafbad"}), gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 0)
+	c.Assert(peer.updateDigests(storage.KeyAdded{ID: "ffffffffffffffffffffffff361bc1f023e0dcca", Digest: "decafbad"}), gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 1)
+	c.Assert(peer.ptree.Close(), gc.IsNil)
+}
+
+func (s *SksSuite) TestWarmUp(c *gc.C) {
+	c.Assert(s.peer.updateDigests(storage.KeyAdded{Digest: "decafbad"}), gc.IsNil)
+	c.Assert(s.peer.WarmUp(), gc.IsNil)
+	c.Assert(s.peer.ptree.Close(), gc.IsNil)
+}
+
+func (s *SksSuite) TestZpDigest(c *gc.C) {
+	for _, digest := range []string{
+		"00000000000000000000000000000001",
+		"b0d2c2aaaa3eb2a19e3bc53b0f69f5d0",
+		"ffffffffffffffffffffffffffffff00",
+	} {
+		var zp cf.Zp
+		c.Assert(DigestZp(digest, &zp), gc.IsNil)
+		c.Check(ZpDigest(&zp), gc.Equals, digest)
+	}
+}
+
+// hashqueryServer returns a server answering hashqueries with no keys, and
+// the number of digests it has been asked for.
+func hashqueryServer(c *gc.C) (*httptest.Server, *int) {
+	var requested int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := recon.ReadInt(r.Body)
+		c.Check(err, gc.IsNil)
+		requested += n
+		var buf bytes.Buffer
+		recon.WriteInt(&buf, 0)
+		buf.WriteString("\r\n")
+		w.Write(buf.Bytes())
+	}))
+	return srv, &requested
+}
+
+func (s *SksSuite) TestRecoveryQueued(c *gc.C) {
+	srv, requested := hashqueryServer(c)
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, gc.IsNil)
+	httpPort, err := strconv.Atoi(port)
+	c.Assert(err, gc.IsNil)
+
+	var queued []storage.PendingRecovery
+	var dequeued []string
+	st := mock.NewStorage(
+		mock.QueueRecovery(func(items []storage.PendingRecovery) error {
+			queued = append(queued, items...)
+			return nil
+		}),
+		mock.DequeueRecovery(func(digests []string) error {
+			dequeued = append(dequeued, digests...)
+			return nil
+		}),
+	)
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings(), nil, "", RecoveryQueue(st))
+	c.Assert(err, gc.IsNil)
+
+	digests := []string{"b0d2c2aaaa3eb2a19e3bc53b0f69f5d0", "00000000000000000000000000000001"}
+	rcvr := &recon.Recover{
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11370},
+		RemoteConfig: &recon.Config{HTTPPort: httpPort},
+	}
+	for _, digest := range digests {
+		var zp cf.Zp
+		c.Assert(DigestZp(digest, &zp), gc.IsNil)
+		rcvr.RemoteElements = append(rcvr.RemoteElements, zp)
+	}
+	c.Assert(peer.requestRecovered(rcvr), gc.IsNil)
+	c.Assert(*requested, gc.Equals, 2)
+	c.Assert(queued, gc.HasLen, 2)
+	for i, item := range queued {
+		c.Check(item.Digest, gc.Equals, digests[i])
+		c.Check(item.HKPAddr, gc.Equals, srv.Listener.Addr().String())
+	}
+	c.Assert(dequeued, gc.DeepEquals, digests)
+}
+
+func (s *SksSuite) TestResumeRecovery(c *gc.C) {
+	srv, requested := hashqueryServer(c)
+	defer srv.Close()
+
+	pending := []storage.PendingRecovery{
+		{Digest: "b0d2c2aaaa3eb2a19e3bc53b0f69f5d0", HKPAddr: srv.Listener.Addr().String()},
+		{Digest: "00000000000000000000000000000001", HKPAddr: srv.Listener.Addr().String()},
+	}
+	var dequeued []string
+	st := mock.NewStorage(
+		mock.PendingRecoveries(func(before time.Time, limit int) ([]storage.PendingRecovery, error) {
+			var result []storage.PendingRecovery
+			for _, item := range pending {
+				if !contains(dequeued, item.Digest) {
+					result = append(result, item)
+				}
+			}
+			return result, nil
+		}),
+		mock.DequeueRecovery(func(digests []string) error {
+			dequeued = append(dequeued, digests...)
+			return nil
+		}),
+	)
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings(), nil, "", RecoveryQueue(st))
+	c.Assert(err, gc.IsNil)
+
+	peer.resumeRecovery()
+	c.Assert(*requested, gc.Equals, 2)
+	c.Assert(dequeued, gc.HasLen, 2)
+	c.Assert(st.MethodCount("ExpireRecovery"), gc.Equals, 1)
+	c.Assert(st.MethodCount("PendingRecoveries"), gc.Equals, 2)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SksSuite) TestBatchInserter(c *gc.C) {
+	ptree, err := NewPrefixTree(c.MkDir(), recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+	defer ptree.Close()
+
+	batch := NewBatchInserter(ptree, 3)
+	for i := 1; i <= 4; i++ {
+		c.Assert(batch.Insert(cf.Zi(cf.P_SKS, i*65537)), gc.IsNil)
+	}
+	c.Assert(batch.n, gc.Equals, 1)
+	c.Assert(batch.Flush(), gc.IsNil)
+	c.Assert(batch.n, gc.Equals, 0)
+	root, err := ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.Size(), gc.Equals, 4)
+}
+
+type alertRecorder struct {
+	alerts []*alert.Alert
+}
+
+func (r *alertRecorder) Notify(a *alert.Alert) error {
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func (s *SksSuite) TestAlerts(c *gc.C) {
+	var rec alertRecorder
+	alerts := alert.New(alert.To(&rec, alert.Info))
+	peer, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), nil, "", Alerts(alerts, 2))
+	c.Assert(err, gc.IsNil)
+
+	rcvr := &recon.Recover{
+		RemoteAddr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370},
+		RemoteElements: make([]cf.Zp, 1),
+	}
+	peer.checkDivergence(rcvr)
+	rcvr.RemoteElements = make([]cf.Zp, 2)
+	peer.checkDivergence(rcvr)
+	peer.RecordSubmission(SourceDirect, nil, errors.Wrap(storage.ErrKeyPinned, "update to key 0xdecafbad refused"))
+	peer.RecordSubmission(SourceDirect, nil, storage.ErrKeyNotFound)
+	alerts.Start()
+	alerts.Stop()
+
+	c.Assert(rec.alerts, gc.HasLen, 2)
+	c.Assert(rec.alerts[0].Condition, gc.Equals, alert.ReconDivergence)
+	c.Assert(rec.alerts[0].Subject, gc.Equals, "192.0.2.1")
+	c.Assert(rec.alerts[1].Condition, gc.Equals, alert.PinnedKey)
+	c.Assert(peer.stats.Sources[SourceDirect].Rejected, gc.Equals, 2)
+}
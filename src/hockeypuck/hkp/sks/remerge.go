@@ -0,0 +1,124 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/discovery"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Remerger rebuilds stored keys from the copies held by recon partners.
+type Remerger struct {
+	storage          storage.Storage
+	settings         *recon.Settings
+	keyReaderOptions []openpgp.KeyReaderOption
+	userAgent        string
+	http             *http.Client
+	resolver         *discovery.Resolver
+}
+
+func NewRemerger(st storage.Storage, s *recon.Settings, opts []openpgp.KeyReaderOption, userAgent string) *Remerger {
+	return &Remerger{
+		storage:          st,
+		settings:         s,
+		keyReaderOptions: opts,
+		userAgent:        userAgent,
+		http: &http.Client{
+			Timeout: httpClientTimeout * time.Second,
+		},
+		resolver: discovery.NewResolver(),
+	}
+}
+
+// Remerge fetches the key with the given fingerprint from every configured
+// partner, merges the copies received and replaces the stored key with the
+// result. The stored key is not itself merged, so that locally corrupted or
+// over-stripped key material is discarded.
+func (r *Remerger) Remerge(fp string) (storage.KeyChange, error) {
+	fp = strings.ToLower(fp)
+	var merged *openpgp.PrimaryKey
+	for name, partner := range r.settings.Partners {
+		key, err := r.fetch(partner.HTTPAddr, fp)
+		if err != nil {
+			log.Warningf("remerge: cannot fetch key %s from %s: %v", fp, name, err)
+			continue
+		}
+		if merged == nil {
+			merged = key
+			continue
+		}
+		err = openpgp.Merge(merged, key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if merged == nil {
+		return nil, errors.Wrapf(storage.ErrKeyNotFound, "key %s not found on any partner", fp)
+	}
+	return storage.ReplaceKey(r.storage, merged, storage.Provenance(storage.ProvenanceRecon))
+}
+
+func (r *Remerger) fetch(httpAddr string, fp string) (*openpgp.PrimaryKey, error) {
+	query := url.Values{
+		"op":      []string{"get"},
+		"options": []string{"mr"},
+		"search":  []string{"0x" + fp},
+	}.Encode()
+	resp, err := r.resolver.Do(r.http, httpAddr, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", base+"/pks/lookup?"+query, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if r.userAgent != "" {
+			req.Header.Set("User-agent", r.userAgent)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("error response from %q: %v", httpAddr, resp.Status)
+	}
+	keys, err := openpgp.ReadArmorKeys(resp.Body, r.keyReaderOptions...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range keys {
+		if key.Fingerprint() != fp {
+			continue
+		}
+		err = openpgp.DropDuplicates(key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return key, nil
+	}
+	return nil, errors.WithStack(storage.ErrKeyNotFound)
+}
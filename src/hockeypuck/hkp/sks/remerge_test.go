@@ -0,0 +1,69 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func (s *SksSuite) TestRemerge(c *gc.C) {
+	const fp = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	settings := recon.DefaultSettings()
+	settings.Partners = recon.PartnerMap{}
+	for _, file := range []string{"alice_unsigned.asc", "alice_signed.asc"} {
+		file := file
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Check(r.URL.Query().Get("search"), gc.Equals, "0x"+fp)
+			f := testing.MustInput(file)
+			defer f.Close()
+			io.Copy(w, f)
+		}))
+		defer srv.Close()
+		settings.Partners[file] = recon.Partner{HTTPAddr: strings.TrimPrefix(srv.URL, "http://")}
+	}
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	settings.Partners["unreachable"] = recon.Partner{HTTPAddr: strings.TrimPrefix(unreachable.URL, "http://")}
+	defer unreachable.Close()
+
+	var replaced *openpgp.PrimaryKey
+	st := mock.NewStorage(mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+		replaced = key
+		return "decafbad", nil
+	}))
+	change, err := NewRemerger(st, settings, nil, "").Remerge(fp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(change, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(replaced, gc.NotNil)
+	signed := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	c.Assert(replaced.MD5, gc.Equals, signed.MD5)
+
+	settings.Partners = recon.PartnerMap{}
+	_, err = NewRemerger(st, settings, nil, "").Remerge(fp)
+	c.Assert(storage.IsNotFound(err), gc.Equals, true)
+}
@@ -72,18 +72,60 @@ func (m LoadStatMap) update(t time.Time, kc storage.KeyChange) {
 	}
 }
 
+// Source classes of key submissions.
+const (
+	SourceDirect = "direct"
+	SourceAdmin  = "admin"
+	SourcePKS    = "pks"
+)
+
+// SourceRecon returns the source class of keys received by recon from the
+// given peer.
+func SourceRecon(peer string) string {
+	return "recon:" + peer
+}
+
+// SourcePush returns the source class of keys pushed by the given trusted
+// keyserver.
+func SourcePush(peer string) string {
+	return "push:" + peer
+}
+
+// SourceStat counts the outcomes of key submissions from a single source.
+type SourceStat struct {
+	// Accepted counts keys which were new to this server.
+	Accepted int
+	// Merged counts keys which updated a stored key.
+	Merged int
+	// Rejected counts keys which could not be stored.
+	Rejected int
+}
+
+type SourceStatMap map[string]*SourceStat
+
+func (m SourceStatMap) get(source string) *SourceStat {
+	ss, ok := m[source]
+	if !ok {
+		ss = &SourceStat{}
+		m[source] = ss
+	}
+	return ss
+}
+
 type Stats struct {
 	Total int
 
-	mu     sync.Mutex
-	Hourly LoadStatMap
-	Daily  LoadStatMap
+	mu      sync.Mutex
+	Hourly  LoadStatMap
+	Daily   LoadStatMap
+	Sources SourceStatMap
 }
 
 func NewStats() *Stats {
 	return &Stats{
-		Hourly: LoadStatMap{},
-		Daily:  LoadStatMap{},
+		Hourly:  LoadStatMap{},
+		Daily:   LoadStatMap{},
+		Sources: SourceStatMap{},
 	}
 }
 
@@ -92,6 +134,7 @@ func (s *Stats) reset() {
 	s.Total = 0
 	s.Hourly = LoadStatMap{}
 	s.Daily = LoadStatMap{}
+	s.Sources = SourceStatMap{}
 }
 
 func (s *Stats) prune() {
@@ -124,6 +167,36 @@ func (s *Stats) Update(kc storage.KeyChange) {
 	}
 }
 
+// UpdateSource records the outcome of a key submission from the given source.
+func (s *Stats) UpdateSource(source string, kc storage.KeyChange, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := s.Sources.get(source)
+	if err != nil {
+		ss.Rejected++
+		return
+	}
+	switch kc.(type) {
+	case storage.KeyAdded:
+		ss.Accepted++
+	case storage.KeyReplaced:
+		ss.Merged++
+	}
+}
+
+// AddSource adds the outcomes of a batch of key submissions from the given
+// source.
+func (s *Stats) AddSource(source string, stat SourceStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := s.Sources.get(source)
+	ss.Accepted += stat.Accepted
+	ss.Merged += stat.Merged
+	ss.Rejected += stat.Rejected
+}
+
 func (s *Stats) clone() *Stats {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -136,6 +209,10 @@ func (s *Stats) clone() *Stats {
 	for k, v := range s.Daily {
 		clone.Daily[k] = v
 	}
+	for k, v := range s.Sources {
+		ss := *v
+		clone.Sources[k] = &ss
+	}
 	return clone
 }
 
@@ -155,6 +232,9 @@ func (s *Stats) ReadFile(path string) error {
 	if err := json.NewDecoder(f).Decode(s); err != nil {
 		return errors.Wrapf(err, "cannot decode stats")
 	}
+	if s.Sources == nil {
+		s.Sources = SourceStatMap{}
+	}
 	return nil
 }
 
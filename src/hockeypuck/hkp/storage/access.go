@@ -0,0 +1,149 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	DefaultAccessBatchSize     = 1000
+	DefaultAccessFlushInterval = time.Minute
+)
+
+// AccessTracker accumulates key accesses in memory and records them in
+// storage in batches, so that lookups do not wait on a write.
+type AccessTracker struct {
+	r         Retainer
+	batchSize int
+	interval  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAccessTracker returns an AccessTracker that flushes accesses to r every
+// interval, or sooner once batchSize distinct keys have been accessed.
+func NewAccessTracker(r Retainer, batchSize int, interval time.Duration) *AccessTracker {
+	if batchSize <= 0 {
+		batchSize = DefaultAccessBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultAccessFlushInterval
+	}
+	return &AccessTracker{
+		r:         r,
+		batchSize: batchSize,
+		interval:  interval,
+		pending:   map[string]int{},
+		full:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Record notes that the keys with the given RFingerprints were accessed.
+func (a *AccessTracker) Record(rfps []string) {
+	a.mu.Lock()
+	for _, rfp := range rfps {
+		a.pending[rfp]++
+	}
+	full := len(a.pending) >= a.batchSize
+	a.mu.Unlock()
+	if full {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pending returns the number of accesses of each key not yet flushed.
+func (a *AccessTracker) Pending() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make(map[string]int, len(a.pending))
+	for rfp, n := range a.pending {
+		result[rfp] = n
+	}
+	return result
+}
+
+// Flush writes all accumulated accesses to storage.
+func (a *AccessTracker) Flush() error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = map[string]int{}
+	a.mu.Unlock()
+
+	rfps := make([]string, 0, len(pending))
+	for rfp := range pending {
+		rfps = append(rfps, rfp)
+	}
+	sort.Strings(rfps)
+	for len(rfps) > 0 {
+		n := len(rfps)
+		if n > a.batchSize {
+			n = a.batchSize
+		}
+		err := a.r.Accessed(rfps[:n])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rfps = rfps[n:]
+	}
+	return nil
+}
+
+// Start flushes accesses in the background until Stop is called.
+func (a *AccessTracker) Start() {
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			case <-a.full:
+			}
+			err := a.Flush()
+			if err != nil {
+				log.Warningf("failed to record key accesses: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop stops background flushing, and flushes any remaining accesses.
+func (a *AccessTracker) Stop() error {
+	close(a.stop)
+	<-a.done
+	return a.Flush()
+}
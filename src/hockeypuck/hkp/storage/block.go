@@ -0,0 +1,64 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrKeyBlocked is returned when adding or updating a key which has been
+// blocked by the operator.
+var ErrKeyBlocked = fmt.Errorf("key is blocked")
+
+func IsBlocked(err error) bool {
+	return errors.Is(err, ErrKeyBlocked)
+}
+
+// BlockedKey is a key fingerprint blocked by the operator.
+type BlockedKey struct {
+	Fingerprint string
+	Reason      string
+	Blocked     time.Time
+}
+
+// Blocker is implemented by storage backends which can permanently refuse
+// specific keys, such as in response to a court order or abuse, however
+// often they are submitted or offered by peers. Blocked keys are refused by
+// Insert and Update, as well as by UpsertKey before they are merged.
+type Blocker interface {
+	// Block deletes the key with the given fingerprint, if stored, and
+	// refuses it from now on. The reason is recorded for the operator.
+	//
+	// No key change is notified, so that the key's digest remains in the
+	// reconciliation prefix tree and peers that still have the key do not
+	// send it back.
+	Block(fp, reason string) error
+
+	// Unblock stops refusing the key with the given fingerprint.
+	Unblock(fp string) error
+
+	// IsBlocked returns whether the key with the given fingerprint is
+	// blocked.
+	IsBlocked(fp string) (bool, error)
+
+	// BlockedKeys returns all blocked keys.
+	BlockedKeys() ([]BlockedKey, error)
+}
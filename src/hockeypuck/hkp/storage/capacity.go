@@ -0,0 +1,187 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// CapacityReport describes the space used by stored keys, so that operators
+// can plan retention and partitioning.
+type CapacityReport struct {
+	Generated time.Time `json:"generated"`
+
+	// Relations are the tables and indexes of the storage backend, largest
+	// first.
+	Relations []RelationSize `json:"relations"`
+
+	// Keys is the number of keys stored, and KeywordEntries the number of
+	// entries for them in the keyword index.
+	Keys           int64 `json:"keys"`
+	KeywordEntries int64 `json:"keywordEntries"`
+
+	// LargestKeys are the keys with the largest stored documents, largest
+	// first, and MostKeywords those with the most keyword index entries.
+	LargestKeys  []KeySize `json:"largestKeys"`
+	MostKeywords []KeySize `json:"mostKeywords"`
+
+	// DuplicateHeavy are those of LargestKeys with duplicated or repeated
+	// packets, most first. It is filled in by Capacity.
+	DuplicateHeavy []KeySize `json:"duplicateHeavy"`
+
+	// Growth is the number of keys stored first in each month, oldest
+	// first.
+	Growth []GrowthPeriod `json:"growth"`
+}
+
+// RelationSize is the size of a table or index.
+type RelationSize struct {
+	Name string `json:"name"`
+	// Table is the table of an index, or empty for a table.
+	Table string `json:"table,omitempty"`
+	// Bytes is the size on disk, including any out-of-line storage.
+	Bytes int64 `json:"bytes"`
+	// Rows is the estimated number of rows or index entries.
+	Rows int64 `json:"rows"`
+}
+
+// KeySize describes the size of a stored key.
+type KeySize struct {
+	RFingerprint string `json:"rfingerprint"`
+	// Bytes is the stored size of the key document.
+	Bytes int64 `json:"bytes"`
+	// Keywords is the number of keyword index entries for the key.
+	Keywords int `json:"keywords"`
+
+	// Packets is the number of packets in the key, Duplicates the number
+	// which are identical to another, and Recertifications the number of
+	// third-party certifications repeating an earlier one by the same
+	// issuer on the same user ID or user attribute. They are counted only
+	// by Capacity, for the largest keys.
+	Packets          int `json:"packets,omitempty"`
+	Duplicates       int `json:"duplicates,omitempty"`
+	Recertifications int `json:"recertifications,omitempty"`
+}
+
+// GrowthPeriod is the number of keys first stored in a period.
+type GrowthPeriod struct {
+	Start time.Time `json:"start"`
+	Added int64     `json:"added"`
+}
+
+// CapacityReporter is implemented by storage backends which can report the
+// space used by stored keys.
+type CapacityReporter interface {
+	// CapacityReport reports the sizes of tables and indexes, the top
+	// largest keys and those with the most keyword entries, and the
+	// monthly growth in the number of keys.
+	CapacityReport(top int) (*CapacityReport, error)
+}
+
+// Capacity returns the capacity report of st, which must implement
+// CapacityReporter, counting the packets of its largest keys to find those
+// which are duplicate-heavy.
+func Capacity(st Storage, top int) (*CapacityReport, error) {
+	cr, ok := st.(CapacityReporter)
+	if !ok {
+		return nil, errors.New("storage does not report capacity")
+	}
+	report, err := cr.CapacityReport(top)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	report.DuplicateHeavy = nil
+	for i := range report.LargestKeys {
+		size := &report.LargestKeys[i]
+		keys, err := st.FetchKeys([]string{size.RFingerprint})
+		if err != nil && !IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		key, err := firstMatch(keys, size.RFingerprint)
+		if err != nil {
+			// Removed since the report was made.
+			continue
+		}
+		size.Packets, size.Duplicates, size.Recertifications = CountRepeats(key)
+		if size.Duplicates+size.Recertifications > 0 {
+			report.DuplicateHeavy = append(report.DuplicateHeavy, *size)
+		}
+	}
+	sort.SliceStable(report.DuplicateHeavy, func(i, j int) bool {
+		a, b := report.DuplicateHeavy[i], report.DuplicateHeavy[j]
+		return a.Duplicates+a.Recertifications > b.Duplicates+b.Recertifications
+	})
+	return report, nil
+}
+
+// CountRepeats returns the number of packets in key, the number of them
+// which are identical to another, and the number of third-party
+// certifications repeating an earlier one by the same issuer on the same
+// user ID or user attribute.
+func CountRepeats(key *openpgp.PrimaryKey) (packets, duplicates, recertifications int) {
+	seen := map[string]bool{}
+	for _, pkt := range key.Packets() {
+		packets++
+		if seen[string(pkt.Packet)] {
+			duplicates++
+		}
+		seen[string(pkt.Packet)] = true
+	}
+	count := func(sigs []*openpgp.Signature) {
+		issuers := map[string]bool{}
+		for _, sig := range sigs {
+			if strings.HasPrefix(key.UUID, sig.RIssuerKeyID) {
+				continue
+			}
+			if issuers[sig.RIssuerKeyID] {
+				recertifications++
+			}
+			issuers[sig.RIssuerKeyID] = true
+		}
+	}
+	for _, uid := range key.UserIDs {
+		count(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		count(uat.Signatures)
+	}
+	return packets, duplicates, recertifications
+}
+
+// GrowthRate returns the mean number of keys added per month over the last
+// months periods of the report.
+func (r *CapacityReport) GrowthRate(months int) float64 {
+	periods := r.Growth
+	if months > 0 && len(periods) > months {
+		periods = periods[len(periods)-months:]
+	}
+	if len(periods) == 0 {
+		return 0
+	}
+	var added int64
+	for _, p := range periods {
+		added += p.Added
+	}
+	return float64(added) / float64(len(periods))
+}
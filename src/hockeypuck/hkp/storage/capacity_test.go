@@ -0,0 +1,63 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type CapacitySuite struct{}
+
+var _ = gc.Suite(&CapacitySuite{})
+
+func (*CapacitySuite) TestCountRepeats(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("e68e311d.asc"))[0]
+	packets, duplicates, recertifications := storage.CountRepeats(key)
+	c.Assert(packets, gc.Equals, len(key.Packets()))
+	c.Assert(duplicates, gc.Equals, 0)
+	c.Assert(recertifications, gc.Equals, 0)
+
+	// Repeat the third-party certification of the first user ID.
+	uid := key.UserIDs[0]
+	_, others := uid.SigInfo(key)
+	c.Assert(others, gc.HasLen, 1)
+	uid.Signatures = append(uid.Signatures, others[0])
+	packets2, duplicates, recertifications := storage.CountRepeats(key)
+	c.Assert(packets2, gc.Equals, packets+1)
+	c.Assert(duplicates, gc.Equals, 1)
+	c.Assert(recertifications, gc.Equals, 1)
+}
+
+func (*CapacitySuite) TestGrowthRate(c *gc.C) {
+	month := func(m time.Month) time.Time { return time.Date(2024, m, 1, 0, 0, 0, 0, time.UTC) }
+	report := &storage.CapacityReport{Growth: []storage.GrowthPeriod{
+		{Start: month(1), Added: 100},
+		{Start: month(2), Added: 10},
+		{Start: month(3), Added: 20},
+	}}
+	c.Assert(report.GrowthRate(2), gc.Equals, float64(15))
+	c.Assert(report.GrowthRate(0), gc.Equals, float64(130)/3)
+	c.Assert(report.GrowthRate(12), gc.Equals, float64(130)/3)
+	c.Assert((&storage.CapacityReport{}).GrowthRate(12), gc.Equals, float64(0))
+}
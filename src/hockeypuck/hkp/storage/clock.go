@@ -0,0 +1,71 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Clock provides the current time to storage and policy code, so that the
+// handling of modification times, expiration and retention can be tested
+// deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the Clock used by default, which reads the system time in
+// UTC.
+var SystemClock Clock = ClockFunc(func() time.Time {
+	return time.Now().UTC()
+})
+
+// IDGenerator generates unique identifiers, such as the IDs of tokens.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// IDFunc adapts a function to an IDGenerator.
+type IDFunc func() (string, error)
+
+// NewID returns f().
+func (f IDFunc) NewID() (string, error) {
+	return f()
+}
+
+// RandomIDs is the IDGenerator used by default, which generates random
+// 128-bit identifiers, hex-encoded.
+var RandomIDs IDGenerator = IDFunc(func() (string, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(id[:]), nil
+})
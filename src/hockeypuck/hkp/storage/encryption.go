@@ -0,0 +1,209 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionKeySize is the size in bytes of each encryption key.
+const EncryptionKeySize = 32
+
+// EncryptionKeys encrypts the key material kept in storage, for deployments
+// in which the database is not trusted with it. Documents are sealed with
+// AES-256-GCM, and keywords are replaced by tokens derived from them with
+// HMAC-SHA256, which can still be matched by searches for whole words.
+//
+// Several keys may be held so that they can be rotated: data is always
+// encrypted with the current key, and can be decrypted with any of them.
+type EncryptionKeys struct {
+	current string
+	keys    map[string]*encryptionKey
+	ids     []string
+}
+
+type encryptionKey struct {
+	aead     cipher.AEAD
+	tokenKey []byte
+}
+
+// newEncryptionKey derives separate keys for encrypting documents and
+// deriving keyword tokens from a master key.
+func newEncryptionKey(master []byte) (*encryptionKey, error) {
+	if len(master) != EncryptionKeySize {
+		return nil, errors.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(master))
+	}
+	block, err := aes.NewCipher(deriveKey(master, "hockeypuck document encryption"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &encryptionKey{
+		aead:     aead,
+		tokenKey: deriveKey(master, "hockeypuck keyword tokens"),
+	}, nil
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// ParseEncryptionKeys reads encryption keys, one per line, each given as an
+// identifier followed by the base64 encoding of the key. The first key is
+// the current key. Blank lines and lines beginning with '#' are ignored.
+func ParseEncryptionKeys(r io.Reader) (*EncryptionKeys, error) {
+	ek := &EncryptionKeys{keys: map[string]*encryptionKey{}}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("line %d: expected key identifier and key", line)
+		}
+		id := fields[0]
+		if _, ok := ek.keys[id]; ok {
+			return nil, errors.Errorf("line %d: duplicate key identifier %q", line, id)
+		}
+		master, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid key", line)
+		}
+		key, err := newEncryptionKey(master)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if ek.current == "" {
+			ek.current = id
+		}
+		ek.keys[id] = key
+		ek.ids = append(ek.ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ek.current == "" {
+		return nil, errors.New("no encryption keys")
+	}
+	return ek, nil
+}
+
+// LoadEncryptionKeys reads encryption keys from a file, in the format read
+// by ParseEncryptionKeys.
+func LoadEncryptionKeys(path string) (*EncryptionKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	return ParseEncryptionKeys(f)
+}
+
+// FetchEncryptionKeys runs a command, such as a key management service
+// client, which writes encryption keys to its standard output in the format
+// read by ParseEncryptionKeys.
+func FetchEncryptionKeys(command []string) (*EncryptionKeys, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty encryption key command")
+	}
+	var stderr bytes.Buffer
+	c := exec.Command(command[0], command[1:]...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "encryption key command failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return ParseEncryptionKeys(bytes.NewReader(out))
+}
+
+// Current returns the identifier of the key with which data is encrypted.
+func (ek *EncryptionKeys) Current() string {
+	return ek.current
+}
+
+// IDs returns the identifiers of all keys, current key first.
+func (ek *EncryptionKeys) IDs() []string {
+	return ek.ids
+}
+
+// Seal encrypts plaintext with the current key, authenticating it together
+// with additional data, such as the identity of the record it is stored
+// in. It returns the identifier of the key used.
+func (ek *EncryptionKeys) Seal(plaintext, additionalData []byte) (string, []byte, error) {
+	aead := ek.keys[ek.current].aead
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	return ek.current, aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts ciphertext sealed with the identified key and the same
+// additional data.
+func (ek *EncryptionKeys) Open(id string, ciphertext, additionalData []byte) ([]byte, error) {
+	key, ok := ek.keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown encryption key %q", id)
+	}
+	n := key.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := key.aead.Open(nil, ciphertext[:n], ciphertext[n:], additionalData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decrypt with key %q", id)
+	}
+	return plaintext, nil
+}
+
+// KeywordToken returns the token stored in place of a keyword when it is
+// indexed with the identified key. Equal keywords have equal tokens, so
+// that tokens can be searched for, but keywords cannot be recovered from
+// them without the key.
+func (ek *EncryptionKeys) KeywordToken(id, keyword string) string {
+	key, ok := ek.keys[id]
+	if !ok {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key.tokenKey)
+	mac.Write([]byte(keyword))
+	// Tokens begin with a letter so that they are parsed as single words.
+	return "k" + hex.EncodeToString(mac.Sum(nil)[:12])
+}
@@ -0,0 +1,96 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+type EncryptionSuite struct{}
+
+var _ = gc.Suite(&EncryptionSuite{})
+
+var (
+	testKey1 = "one " + strings.Repeat("A", 43) + "=\n"
+	testKey2 = "two " + strings.Repeat("B", 43) + "=\n"
+)
+
+func (*EncryptionSuite) TestParseEncryptionKeys(c *gc.C) {
+	ek, err := storage.ParseEncryptionKeys(strings.NewReader("# rotated\n" + testKey2 + "\n" + testKey1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ek.Current(), gc.Equals, "two")
+	c.Assert(ek.IDs(), gc.DeepEquals, []string{"two", "one"})
+
+	for _, bad := range []string{
+		"",
+		"one\n",
+		"one c2hvcnQ=\n",
+		"one !!!\n",
+		testKey1 + testKey1,
+	} {
+		_, err := storage.ParseEncryptionKeys(strings.NewReader(bad))
+		c.Assert(err, gc.NotNil, gc.Commentf("%q", bad))
+	}
+}
+
+func (*EncryptionSuite) TestSealOpen(c *gc.C) {
+	old, err := storage.ParseEncryptionKeys(strings.NewReader(testKey1))
+	c.Assert(err, gc.IsNil)
+	id, sealed, err := old.Seal([]byte("secret"), []byte("rfp1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(id, gc.Equals, "one")
+	c.Assert(strings.Contains(string(sealed), "secret"), gc.Equals, false)
+
+	// Data sealed with a rotated key can still be opened.
+	ek, err := storage.ParseEncryptionKeys(strings.NewReader(testKey2 + testKey1))
+	c.Assert(err, gc.IsNil)
+	plaintext, err := ek.Open(id, sealed, []byte("rfp1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(plaintext), gc.Equals, "secret")
+
+	// Sealed data is bound to its additional data and key.
+	_, err = ek.Open(id, sealed, []byte("rfp2"))
+	c.Assert(err, gc.NotNil)
+	_, err = ek.Open("two", sealed, []byte("rfp1"))
+	c.Assert(err, gc.NotNil)
+	_, err = ek.Open("three", sealed, []byte("rfp1"))
+	c.Assert(err, gc.NotNil)
+}
+
+func (*EncryptionSuite) TestKeywordToken(c *gc.C) {
+	ek, err := storage.ParseEncryptionKeys(strings.NewReader(testKey1 + testKey2))
+	c.Assert(err, gc.IsNil)
+	token := ek.KeywordToken("one", "alice")
+	c.Assert(token, gc.Matches, "k[0-9a-f]{24}")
+	c.Assert(ek.KeywordToken("one", "alice"), gc.Equals, token)
+	c.Assert(ek.KeywordToken("one", "bob"), gc.Not(gc.Equals), token)
+	c.Assert(ek.KeywordToken("two", "alice"), gc.Not(gc.Equals), token)
+}
+
+func (*EncryptionSuite) TestFetchEncryptionKeys(c *gc.C) {
+	ek, err := storage.FetchEncryptionKeys([]string{"echo", strings.TrimSpace(testKey1)})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ek.Current(), gc.Equals, "one")
+
+	_, err = storage.FetchEncryptionKeys([]string{"false"})
+	c.Assert(err, gc.NotNil)
+}
@@ -0,0 +1,188 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// ErrErasureNotFound is returned when deciding an erasure request which has
+// not been filed, or has already been decided.
+var ErrErasureNotFound = fmt.Errorf("erasure request not found")
+
+// ErasureStatus is the state of an erasure request in the moderation queue.
+type ErasureStatus string
+
+const (
+	// ErasurePending requests await a decision by the operator.
+	ErasurePending ErasureStatus = "pending"
+	// ErasureApproved requests have been applied, and continue to suppress
+	// the keys or user IDs they name.
+	ErasureApproved ErasureStatus = "approved"
+	// ErasureRejected requests have no effect.
+	ErasureRejected ErasureStatus = "rejected"
+)
+
+// ParseErasureStatus returns the ErasureStatus with the given name.
+func ParseErasureStatus(s string) (ErasureStatus, error) {
+	switch status := ErasureStatus(s); status {
+	case ErasurePending, ErasureApproved, ErasureRejected:
+		return status, nil
+	}
+	return "", errors.Errorf("invalid erasure status %q", s)
+}
+
+// ErasureRequest asks for the user IDs containing an email address, or a
+// whole key, to be erased from the keyserver, such as under the right to
+// erasure of the GDPR.
+type ErasureRequest struct {
+	ID string
+	// Address is the lower-cased email address whose user IDs are erased,
+	// if the request names one.
+	Address string
+	// Fingerprint is the lower-cased fingerprint of the key erased, if the
+	// request names one.
+	Fingerprint string
+	// Reason is given by the requester for the operator.
+	Reason string
+	// Contact is how the requester may be reached about the request.
+	Contact string
+	Status  ErasureStatus
+	Filed   time.Time
+	// Decided is when the request was approved or rejected, or the zero
+	// time while it is pending.
+	Decided time.Time
+}
+
+// Validate checks that the request names exactly one address or key, and
+// normalizes them.
+func (r *ErasureRequest) Validate() error {
+	r.Address = strings.ToLower(strings.TrimSpace(r.Address))
+	r.Fingerprint = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(r.Fingerprint)), "0x")
+	switch {
+	case r.Address != "" && r.Fingerprint != "":
+		return errors.New("an erasure request names an address or a key, not both")
+	case r.Address != "":
+		if openpgp.UserIDAddress(r.Address) != r.Address {
+			return errors.Errorf("invalid address %q", r.Address)
+		}
+	case r.Fingerprint != "":
+		if len(r.Fingerprint) != 40 && len(r.Fingerprint) != 64 || strings.Trim(r.Fingerprint, "0123456789abcdef") != "" {
+			return errors.Errorf("invalid fingerprint %q", r.Fingerprint)
+		}
+	default:
+		return errors.New("an erasure request must name an address or a key")
+	}
+	return nil
+}
+
+// ErasureStore is implemented by storage backends which hold a queue of
+// erasure requests for the operator to moderate.
+type ErasureStore interface {
+	// FileErasure adds a pending erasure request.
+	FileErasure(req ErasureRequest) error
+
+	// ErasureRequests returns the requests with the given status, oldest
+	// first.
+	ErasureRequests(status ErasureStatus) ([]ErasureRequest, error)
+
+	// DecideErasure approves or rejects the pending request with the given
+	// ID, returning it as decided, or ErrErasureNotFound if there is no
+	// such pending request.
+	DecideErasure(id string, status ErasureStatus, decided time.Time) (*ErasureRequest, error)
+
+	// AddressKeys returns the RFingerprints of the stored keys, whatever
+	// their state, which may have user IDs containing the given address.
+	// Matches must be confirmed against the keys.
+	AddressKeys(address string) ([]string, error)
+}
+
+// Suppressions returns the fingerprints and addresses erased by the
+// approved requests in es.
+func Suppressions(es ErasureStore) (fps, addrs []string, err error) {
+	reqs, err := es.ErasureRequests(ErasureApproved)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	for _, req := range reqs {
+		if req.Fingerprint != "" {
+			fps = append(fps, req.Fingerprint)
+		} else {
+			addrs = append(addrs, req.Address)
+		}
+	}
+	return fps, addrs, nil
+}
+
+// ApplyErasure erases what an approved request names from storage,
+// returning the number of keys changed. A key is blocked, or deleted if
+// storage cannot block keys. User IDs containing an address are removed from
+// every key which has them, along with their signatures.
+func ApplyErasure(st Storage, req *ErasureRequest) (int, error) {
+	reason := "erasure request " + req.ID
+	if req.Fingerprint != "" {
+		if b, ok := st.(Blocker); ok {
+			return 1, errors.WithStack(b.Block(req.Fingerprint, reason))
+		}
+		_, err := DeleteKey(st, req.Fingerprint)
+		if errors.Is(err, ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 1, errors.WithStack(err)
+	}
+
+	es, ok := st.(ErasureStore)
+	if !ok {
+		return 0, errors.New("storage does not support erasure requests")
+	}
+	rfps, err := es.AddressKeys(req.Address)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(rfps) == 0 {
+		return 0, nil
+	}
+	keys, err := st.FetchKeys(rfps)
+	if err != nil && !IsNotFound(err) {
+		return 0, errors.WithStack(err)
+	}
+	var n int
+	for _, key := range keys {
+		erased, err := openpgp.EraseUserIDs(key, func(uid *openpgp.UserID) bool {
+			return openpgp.UserIDAddress(uid.Keywords) == req.Address
+		})
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		if erased == 0 {
+			continue
+		}
+		_, err = ReplaceKey(st, key)
+		if err != nil {
+			return n, errors.Wrapf(err, "failed to erase %q from key 0x%s", req.Address, key.KeyID())
+		}
+		n++
+	}
+	return n, nil
+}
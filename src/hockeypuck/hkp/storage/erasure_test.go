@@ -0,0 +1,114 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type ErasureSuite struct{}
+
+var _ = gc.Suite(&ErasureSuite{})
+
+func (*ErasureSuite) TestValidate(c *gc.C) {
+	req := storage.ErasureRequest{Address: " Alice@Example.COM "}
+	c.Assert(req.Validate(), gc.IsNil)
+	c.Assert(req.Address, gc.Equals, "alice@example.com")
+
+	req = storage.ErasureRequest{Fingerprint: "0x81279EEE7EC89FB781702ADAF79362DA44A2D1DB"}
+	c.Assert(req.Validate(), gc.IsNil)
+	c.Assert(req.Fingerprint, gc.Equals, "81279eee7ec89fb781702adaf79362da44a2d1db")
+
+	for _, req := range []storage.ErasureRequest{
+		{},
+		{Address: "alice"},
+		{Fingerprint: "81279eee"},
+		{Address: "alice@example.com", Fingerprint: "81279eee7ec89fb781702adaf79362da44a2d1db"},
+	} {
+		c.Assert(req.Validate(), gc.NotNil, gc.Commentf("%+v", req))
+	}
+}
+
+func (*ErasureSuite) TestSuppressions(c *gc.C) {
+	st := mock.NewStorage(mock.ErasureRequests(func(status storage.ErasureStatus) ([]storage.ErasureRequest, error) {
+		c.Assert(status, gc.Equals, storage.ErasureApproved)
+		return []storage.ErasureRequest{
+			{ID: "1", Address: "alice@example.com"},
+			{ID: "2", Fingerprint: "81279eee7ec89fb781702adaf79362da44a2d1db"},
+		}, nil
+	}))
+	fps, addrs, err := storage.Suppressions(st)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fps, gc.DeepEquals, []string{"81279eee7ec89fb781702adaf79362da44a2d1db"})
+	c.Assert(addrs, gc.DeepEquals, []string{"alice@example.com"})
+}
+
+func (*ErasureSuite) TestApplyFingerprint(c *gc.C) {
+	var blocked, reason string
+	st := mock.NewStorage(mock.Block(func(fp, r string) error {
+		blocked, reason = fp, r
+		return nil
+	}))
+	n, err := storage.ApplyErasure(st, &storage.ErasureRequest{
+		ID:          "1",
+		Fingerprint: "81279eee7ec89fb781702adaf79362da44a2d1db",
+		Status:      storage.ErasureApproved,
+		Decided:     time.Now(),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(blocked, gc.Equals, "81279eee7ec89fb781702adaf79362da44a2d1db")
+	c.Assert(reason, gc.Equals, "erasure request 1")
+}
+
+func (*ErasureSuite) TestApplyAddress(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))[0]
+	var replaced *openpgp.PrimaryKey
+	st := mock.NewStorage(
+		mock.AddressKeys(func(address string) ([]string, error) {
+			c.Assert(address, gc.Equals, "casey.marshall@gmail.com")
+			return []string{key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+		mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+			replaced = key
+			return "", nil
+		}),
+	)
+	n, err := storage.ApplyErasure(st, &storage.ErasureRequest{ID: "1", Address: "casey.marshall@gmail.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(replaced, gc.NotNil)
+	c.Assert(replaced.UserIDs, gc.HasLen, 1)
+	c.Assert(replaced.UserIDs[0].Keywords, gc.Equals, "Casey Marshall <casey.marshall@gazzang.com>")
+
+	// Keys found by their words which lack the address are left alone.
+	n, err = storage.ApplyErasure(st, &storage.ErasureRequest{ID: "2", Address: "casey.marshall@gmail.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(st.MethodCount("Replace"), gc.Equals, 1)
+}
@@ -0,0 +1,95 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// ErrFilterNotAvailable is returned by a KeyFilterer which cannot apply a
+// filter, such as to encrypted documents or on capabilities it does not
+// record.
+var ErrFilterNotAvailable = errors.New("key filter is not available")
+
+// KeyFilter selects keys by the properties of their primary key and, for
+// capabilities, of their subkeys. Zero fields select any key.
+type KeyFilter struct {
+	// Algorithm is the name of the primary key's algorithm, as given by
+	// openpgp.AlgorithmName.
+	Algorithm string
+	// MinBits is the least length of the primary key in bits.
+	MinBits int
+	// CreatedAfter and CreatedBefore bound the primary key's creation time.
+	CreatedAfter, CreatedBefore time.Time
+	// Flags are the capabilities the key must have, as key flags.
+	Flags byte
+}
+
+// IsZero returns whether the filter selects any key.
+func (f *KeyFilter) IsZero() bool {
+	return f == nil || *f == KeyFilter{}
+}
+
+// Match returns whether a key is selected by the filter.
+func (f *KeyFilter) Match(key *openpgp.PrimaryKey) bool {
+	if f.IsZero() {
+		return true
+	}
+	if f.Algorithm != "" && openpgp.AlgorithmName(key.Algorithm) != f.Algorithm {
+		return false
+	}
+	if key.BitLen < f.MinBits {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !key.Creation.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !key.Creation.Before(f.CreatedBefore) {
+		return false
+	}
+	if f.Flags != 0 {
+		// Either encryption flag will do, as implementations do not
+		// distinguish them.
+		caps := openpgp.KeyCapabilities(key)
+		if caps&openpgp.KeyFlagEncrypt != 0 {
+			caps |= openpgp.KeyFlagEncrypt
+		}
+		if caps&f.Flags != f.Flags {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyFilterer is implemented by storage backends which can search for keys
+// by their properties, whether or not they also match a keyword search.
+type KeyFilterer interface {
+	// MatchFiltered returns up to limit of the RFingerprint IDs of the keys
+	// selected by filter, after skipping the first offset of them, in the
+	// given order made stable, and the total number of them. If search is
+	// not empty, keys must also match it as a keyword search, combining its
+	// words as selected by match; otherwise OrderRelevance orders them as
+	// OrderModified does. Storage which cannot select keys by every
+	// property in the filter returns ErrFilterNotAvailable, as totals and
+	// pages would otherwise count keys the filter does not select.
+	MatchFiltered(search string, match KeywordMatch, filter *KeyFilter, order ResultOrder, limit, offset int) ([]string, int, error)
+}
@@ -0,0 +1,204 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// FloodAction is the treatment of keys flooded with third-party
+// certifications.
+type FloodAction string
+
+const (
+	// FloodStrip drops the certifications which cannot be verified with a
+	// signer's key held in storage.
+	FloodStrip FloodAction = "strip"
+	// FloodCap keeps only the most recent certifications on each user ID
+	// and user attribute.
+	FloodCap FloodAction = "cap"
+	// FloodQuarantine stores flooded keys unchanged, in KeyStateQuarantined,
+	// so that they are withheld from lookups until reviewed.
+	FloodQuarantine FloodAction = "quarantine"
+)
+
+// ParseFloodAction returns the FloodAction with the given name.
+func ParseFloodAction(s string) (FloodAction, error) {
+	switch action := FloodAction(s); action {
+	case FloodStrip, FloodCap, FloodQuarantine:
+		return action, nil
+	}
+	return "", errors.Errorf("invalid flood action %q", s)
+}
+
+// FloodPolicy detects keys flooded with third-party certifications, and
+// determines what is done with them.
+type FloodPolicy struct {
+	// Threshold is the number of third-party certifications on a single
+	// user ID or user attribute above which a key is flooded.
+	Threshold int
+
+	Action FloodAction
+
+	// MaxCertifications is the number of certifications kept on each user
+	// ID or user attribute by FloodCap, or by FloodStrip of those which
+	// verify. For FloodCap it defaults to Threshold; for FloodStrip, zero
+	// keeps all which verify.
+	MaxCertifications int
+}
+
+// Flooding applies policy to keys as UpsertKey would store them. Keys are
+// quarantined only if storage implements KeyStateStore; otherwise they are
+// capped instead.
+func Flooding(policy FloodPolicy) UpsertOption {
+	return func(opts *upsertOptions) {
+		opts.flooding = &policy
+	}
+}
+
+const (
+	// maxFloodSigners limits the distinct issuers looked up when stripping
+	// the certifications of a flooded key. Certifications by further issuers
+	// are treated as unverifiable.
+	maxFloodSigners = 1000
+	// floodSignerBatch is the number of issuers resolved at once.
+	floodSignerBatch = 100
+)
+
+// apply applies the policy to key, which is modified in place. It returns
+// whether the key should be quarantined once stored.
+func (policy *FloodPolicy) apply(storage Storage, key *openpgp.PrimaryKey) (bool, error) {
+	if policy == nil || policy.Threshold <= 0 {
+		return false, nil
+	}
+	most := openpgp.MostCertifications(key)
+	if most <= policy.Threshold {
+		return false, nil
+	}
+	fields := log.Fields{"fp": key.Fingerprint(), "certifications": most, "action": policy.Action}
+	log.WithFields(fields).Warn("key flooded with certifications")
+
+	action := policy.Action
+	if _, ok := storage.(KeyStateStore); !ok && action == FloodQuarantine {
+		action = FloodCap
+	}
+	switch action {
+	case FloodQuarantine:
+		return true, nil
+	case FloodStrip:
+		signers, err := floodSigners(storage, key)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		_, err = openpgp.StripUnverifiedCertifications(key, signers)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if policy.MaxCertifications > 0 {
+			_, err = openpgp.TruncateCertifications(key, policy.MaxCertifications)
+		}
+		return false, errors.WithStack(err)
+	default:
+		max := policy.MaxCertifications
+		if max <= 0 {
+			max = policy.Threshold
+		}
+		_, err := openpgp.TruncateCertifications(key, max)
+		return false, errors.WithStack(err)
+	}
+}
+
+// floodSigners looks up the stored keys of the issuers of the third-party
+// certifications on key, returning a function which finds the candidate
+// signers of each certification.
+func floodSigners(storage Storage, key *openpgp.PrimaryKey) (func(*openpgp.Signature) []*openpgp.PrimaryKey, error) {
+	seen := map[string]bool{}
+	var ids []string
+	collect := func(sigs []*openpgp.Signature) {
+		for _, sig := range sigs {
+			id := openpgp.IssuerID(sig)
+			if seen[id] || len(ids) >= maxFloodSigners || strings.HasPrefix(key.UUID, sig.RIssuerKeyID) {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, uid := range key.UserIDs {
+		collect(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		collect(uat.Signatures)
+	}
+
+	// Signers are indexed by their reversed key ID, which prefixes both
+	// forms of issuer ID.
+	byKeyID := map[string][]*openpgp.PrimaryKey{}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > floodSignerBatch {
+			n = floodSignerBatch
+		}
+		rfps, err := storage.Resolve(ids[:n])
+		if err != nil && !IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		ids = ids[n:]
+		if len(rfps) == 0 {
+			continue
+		}
+		signers, err := storage.FetchKeys(rfps)
+		if err != nil && !IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		for _, signer := range signers {
+			if len(signer.RFingerprint) < 16 {
+				continue
+			}
+			rkeyID := signer.RFingerprint[:16]
+			byKeyID[rkeyID] = append(byKeyID[rkeyID], signer)
+		}
+	}
+	return func(sig *openpgp.Signature) []*openpgp.PrimaryKey {
+		id := openpgp.IssuerID(sig)
+		if len(id) < 16 {
+			return nil
+		}
+		var result []*openpgp.PrimaryKey
+		for _, signer := range byKeyID[id[:16]] {
+			if strings.HasPrefix(signer.RFingerprint, id) {
+				result = append(result, signer)
+			}
+		}
+		return result
+	}, nil
+}
+
+func quarantineKey(storage Storage, key *openpgp.PrimaryKey) error {
+	err := storage.(KeyStateStore).SetKeyState(key.RFingerprint, KeyStateQuarantined)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.WithFields(log.Fields{"fp": key.Fingerprint()}).Warn("quarantined flooded key")
+	return nil
+}
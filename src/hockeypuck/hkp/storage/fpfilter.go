@@ -0,0 +1,384 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// FingerprintScanner is implemented by storage backends which can list the
+// RFingerprints of all the primary keys and subkeys they hold.
+type FingerprintScanner interface {
+	// ScanFingerprints calls f with the RFingerprint of each stored primary
+	// key and subkey, stopping at the first error.
+	ScanFingerprints(f func(rfp string) error) error
+}
+
+const (
+	DefaultFingerprintFilterCapacity = 10000000
+	DefaultFingerprintFilterInterval = time.Hour
+
+	// fingerprintFilterFalsePositives is the rate at which the filter
+	// reports a fingerprint which is not stored as possibly stored.
+	fingerprintFilterFalsePositives = 0.01
+
+	fingerprintFilterQueueLen = 1000
+	// Digests of added keys are looked up again at this interval until
+	// they are found, as keys may be notified before they are committed.
+	fingerprintFilterRetryInterval = time.Second
+	fingerprintFilterMaxRetries    = 60
+)
+
+// FingerprintFilter is a bloom filter of the fingerprints of the primary
+// keys and subkeys in storage. Lookups of fingerprints which it reports as
+// not stored need not query storage, so that lookups for keys which do not
+// exist, such as from typos and scanners, cost no database round-trips.
+//
+// The filter is built in the background, and rebuilt periodically so that
+// deleted keys are eventually forgotten. Keys added in between are added
+// to it as they are notified; until the filter is built, and while added
+// keys remain to be added to it, it reports every fingerprint as possibly
+// stored.
+//
+// Only the key changes notified to this server are added between rebuilds.
+// Keys added by other servers sharing the same storage are reported as not
+// stored until the next rebuild, unless their changes are notified here too.
+// The filter is discarded and rebuilt at once when changes may have been
+// missed, and when an added key cannot be found within
+// fingerprintFilterMaxRetries lookups.
+type FingerprintFilter struct {
+	st       Storage
+	scanner  FingerprintScanner
+	capacity int
+	interval time.Duration
+
+	mu    sync.RWMutex
+	bloom *bloomFilter
+
+	// pending counts the key changes not yet applied to the filter.
+	pending int32
+	skipped uint64
+
+	listener ListenerID
+	changes  chan KeyChange
+	stale    chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewFingerprintFilter returns a filter of the fingerprints in st, sized
+// for at least capacity fingerprints and rebuilt every interval.
+func NewFingerprintFilter(st Storage, scanner FingerprintScanner, capacity int, interval time.Duration) *FingerprintFilter {
+	if capacity <= 0 {
+		capacity = DefaultFingerprintFilterCapacity
+	}
+	if interval <= 0 {
+		interval = DefaultFingerprintFilterInterval
+	}
+	return &FingerprintFilter{
+		st:       st,
+		scanner:  scanner,
+		capacity: capacity,
+		interval: interval,
+		changes:  make(chan KeyChange, fingerprintFilterQueueLen),
+		stale:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// MayContain returns whether a primary key or subkey with the given
+// RFingerprint may be stored. If it returns false, it is not.
+func (f *FingerprintFilter) MayContain(rfp string) bool {
+	if atomic.LoadInt32(&f.pending) > 0 {
+		return true
+	}
+	f.mu.RLock()
+	bloom := f.bloom
+	f.mu.RUnlock()
+	if bloom == nil || bloom.mayContain(rfp) {
+		return true
+	}
+	atomic.AddUint64(&f.skipped, 1)
+	return false
+}
+
+// Skipped returns the number of lookups found not to be stored by the
+// filter since it was created.
+func (f *FingerprintFilter) Skipped() uint64 {
+	return atomic.LoadUint64(&f.skipped)
+}
+
+// Notify queues a key change to be applied to the filter. If the queue is
+// full, or changes have been missed, the filter is discarded and rebuilt,
+// as it would no longer report all stored keys.
+func (f *FingerprintFilter) Notify(kc KeyChange) error {
+	if _, ok := kc.(ChangesMissed); ok {
+		f.discard("key changes missed")
+		return nil
+	}
+	if len(kc.InsertDigests()) == 0 && len(kc.RemoveDigests()) == 0 {
+		return nil
+	}
+	atomic.AddInt32(&f.pending, 1)
+	select {
+	case <-f.stop:
+		atomic.AddInt32(&f.pending, -1)
+	case f.changes <- kc:
+	default:
+		atomic.AddInt32(&f.pending, -1)
+		f.discard("queue full")
+	}
+	return nil
+}
+
+// discard discards the filter, so that every fingerprint may be stored
+// until it is rebuilt, and has it rebuilt.
+func (f *FingerprintFilter) discard(reason string) {
+	log.Warningf("fingerprint filter discarded until rebuilt: %s", reason)
+	f.mu.Lock()
+	f.bloom = nil
+	f.mu.Unlock()
+	select {
+	case f.stale <- struct{}{}:
+	default:
+	}
+}
+
+// Start subscribes to key changes in storage, and builds the filter in the
+// background until Stop is called.
+func (f *FingerprintFilter) Start() {
+	f.listener = f.st.Subscribe(f.Notify)
+	go f.run()
+}
+
+// Stop stops maintaining the filter.
+func (f *FingerprintFilter) Stop() {
+	f.st.Unsubscribe(f.listener)
+	close(f.stop)
+	<-f.done
+}
+
+func (f *FingerprintFilter) run() {
+	defer close(f.done)
+	// unresolved holds the digests of added keys not yet found in storage,
+	// with the number of times they have been looked up.
+	unresolved := map[string]int{}
+	rebuild := time.NewTimer(0)
+	defer rebuild.Stop()
+	retry := time.NewTicker(fingerprintFilterRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-rebuild.C:
+			// Changes queued meanwhile are applied to the new filter.
+			err := f.rebuild()
+			if err != nil {
+				select {
+				case <-f.stop:
+					return
+				default:
+				}
+				log.Errorf("failed to build fingerprint filter: %v", err)
+			}
+			rebuild.Reset(f.interval)
+		case <-f.stale:
+			if !rebuild.Stop() {
+				<-rebuild.C
+			}
+			rebuild.Reset(0)
+		case kc := <-f.changes:
+			// Keys replaced or removed before they were found need not
+			// be found.
+			for _, digest := range kc.RemoveDigests() {
+				if _, ok := unresolved[digest]; ok {
+					delete(unresolved, digest)
+					atomic.AddInt32(&f.pending, -1)
+				}
+			}
+			for _, digest := range kc.InsertDigests() {
+				if _, ok := unresolved[digest]; !ok {
+					unresolved[digest] = 0
+					atomic.AddInt32(&f.pending, 1)
+				}
+			}
+			atomic.AddInt32(&f.pending, -1)
+			f.resolve(unresolved)
+		case <-retry.C:
+			if len(unresolved) > 0 {
+				f.resolve(unresolved)
+			}
+		}
+	}
+}
+
+// resolve adds the keys with the given digests to the filter, and removes
+// those found, or looked up too many times, from unresolved.
+func (f *FingerprintFilter) resolve(unresolved map[string]int) {
+	digests := make([]string, 0, len(unresolved))
+	for digest := range unresolved {
+		digests = append(digests, digest)
+	}
+	keys, err := f.fetchDigests(digests)
+	if err != nil {
+		log.Warningf("failed to update fingerprint filter: %v", err)
+	}
+	f.mu.RLock()
+	bloom := f.bloom
+	f.mu.RUnlock()
+	for _, key := range keys {
+		if bloom != nil {
+			bloom.add(key.RFingerprint)
+			for _, subKey := range key.SubKeys {
+				bloom.add(subKey.RFingerprint)
+			}
+		}
+		if _, ok := unresolved[key.MD5]; ok {
+			delete(unresolved, key.MD5)
+			atomic.AddInt32(&f.pending, -1)
+		}
+	}
+	for digest, tries := range unresolved {
+		if tries+1 >= fingerprintFilterMaxRetries {
+			// The change which replaced or removed the key may have
+			// been missed, as may others, so the filter is rebuilt
+			// rather than left without the key.
+			delete(unresolved, digest)
+			atomic.AddInt32(&f.pending, -1)
+			f.discard("added key " + digest + " not found")
+		} else {
+			unresolved[digest] = tries + 1
+		}
+	}
+}
+
+func (f *FingerprintFilter) fetchDigests(digests []string) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := f.st.MatchMD5(digests)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := f.st.FetchKeys(rfps)
+	return keys, errors.WithStack(err)
+}
+
+// rebuild replaces the filter with one built from all the fingerprints in
+// storage. It is sized for the number of fingerprints last found, so that
+// the rate of false positives remains low as storage grows.
+func (f *FingerprintFilter) rebuild() error {
+	start := time.Now()
+	n := f.capacity
+	f.mu.RLock()
+	if f.bloom != nil && f.bloom.count()*5/4 > n {
+		n = f.bloom.count() * 5 / 4
+	}
+	f.mu.RUnlock()
+	bloom := newBloomFilter(n, fingerprintFilterFalsePositives)
+	err := f.scanner.ScanFingerprints(func(rfp string) error {
+		select {
+		case <-f.stop:
+			return errors.New("stopped")
+		default:
+		}
+		bloom.add(rfp)
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.mu.Lock()
+	f.bloom = bloom
+	f.mu.Unlock()
+	log.Infof("fingerprint filter of %d fingerprints built in %v", bloom.count(), time.Since(start))
+	return nil
+}
+
+// bloomFilter is a bloom filter of strings which is safe for concurrent use.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+	n      int64
+}
+
+// newBloomFilter returns a bloom filter sized so that, holding n strings,
+// it reports strings it does not hold with the given probability.
+func newBloomFilter(n int, falsePositives float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(falsePositives) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+// locations returns the two hashes of s from which the bits representing it
+// are derived.
+func (b *bloomFilter) locations(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	h1 := h.Sum64()
+	h = fnv.New64()
+	h.Write([]byte(s))
+	return h1, h.Sum64() | 1
+}
+
+func (b *bloomFilter) add(s string) {
+	h1, h2 := b.locations(s)
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		word, mask := &b.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.AddInt64(&b.n, 1)
+}
+
+func (b *bloomFilter) mayContain(s string) bool {
+	h1, h2 := b.locations(s)
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		if atomic.LoadUint64(&b.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// count returns the number of strings added.
+func (b *bloomFilter) count() int {
+	return int(atomic.LoadInt64(&b.n))
+}
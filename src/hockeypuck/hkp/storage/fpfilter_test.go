@@ -0,0 +1,126 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type FingerprintFilterSuite struct{}
+
+var _ = gc.Suite(&FingerprintFilterSuite{})
+
+type scannerFunc func(f func(string) error) error
+
+func (sf scannerFunc) ScanFingerprints(f func(string) error) error { return sf(f) }
+
+func waitFor(c *gc.C, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("timed out")
+}
+
+func (*FingerprintFilterSuite) TestFilter(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	var stored []string
+	for i := 0; i < 1000; i++ {
+		stored = append(stored, fmt.Sprintf("%040x", i))
+	}
+	var added int32
+	st := mock.NewStorage(
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			if atomic.LoadInt32(&added) == 1 && digests[0] == key.MD5 {
+				return []string{key.RFingerprint}, nil
+			}
+			return nil, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if len(rfps) > 0 {
+				return []*openpgp.PrimaryKey{key}, nil
+			}
+			return nil, nil
+		}),
+	)
+	scanner := scannerFunc(func(f func(string) error) error {
+		for _, rfp := range stored {
+			err := f(rfp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	filter := storage.NewFingerprintFilter(st, scanner, 1000, time.Hour)
+
+	// Everything may be stored until the filter is built.
+	c.Assert(filter.MayContain(key.RFingerprint), gc.Equals, true)
+	filter.Start()
+	defer filter.Stop()
+	waitFor(c, func() bool { return !filter.MayContain(key.RFingerprint) })
+	for _, rfp := range stored {
+		c.Assert(filter.MayContain(rfp), gc.Equals, true)
+	}
+	var falsePositives int
+	for i := 1000; i < 11000; i++ {
+		if filter.MayContain(fmt.Sprintf("%040x", i)) {
+			falsePositives++
+		}
+	}
+	c.Assert(falsePositives < 200, gc.Equals, true, gc.Commentf("%d false positives", falsePositives))
+	c.Assert(filter.Skipped() > 0, gc.Equals, true)
+
+	// Keys notified before they can be found are looked up again, and
+	// everything may be stored meanwhile.
+	st.Notify(storage.KeyAdded{ID: key.Fingerprint(), Digest: key.MD5})
+	waitFor(c, func() bool { return filter.MayContain(key.RFingerprint) })
+	c.Assert(filter.MayContain(fmt.Sprintf("%040x", 20000)), gc.Equals, true)
+	atomic.StoreInt32(&added, 1)
+	waitFor(c, func() bool { return !filter.MayContain(fmt.Sprintf("%040x", 20000)) })
+	c.Assert(filter.MayContain(key.RFingerprint), gc.Equals, true)
+	for _, subKey := range key.SubKeys {
+		c.Assert(filter.MayContain(subKey.RFingerprint), gc.Equals, true)
+	}
+
+	// Keys whose changes were missed are found once the filter is rebuilt,
+	// which it is at once.
+	var absent string
+	for i := 1000; absent == ""; i++ {
+		if rfp := fmt.Sprintf("%040x", i); !filter.MayContain(rfp) {
+			absent = rfp
+		}
+	}
+	missed := fmt.Sprintf("%040x", 30000)
+	stored = append(stored, missed)
+	st.Notify(storage.ChangesMissed{})
+	c.Assert(filter.MayContain(absent), gc.Equals, true)
+	waitFor(c, func() bool { return !filter.MayContain(absent) })
+	c.Assert(filter.MayContain(missed), gc.Equals, true)
+}
@@ -0,0 +1,122 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	DefaultIndexWorkers   = 2
+	DefaultIndexBatchSize = 100
+	DefaultIndexInterval  = 5 * time.Second
+)
+
+// Indexer is implemented by storage backends which can defer indexing keys
+// for keyword search until after they are stored.
+type Indexer interface {
+	// IndexQueued indexes up to limit keys queued for indexing, returning
+	// the number of keys taken from the queue. It is safe to call
+	// concurrently.
+	IndexQueued(limit int) (int, error)
+
+	// IndexPending returns the number of keys queued for indexing.
+	IndexPending() (int, error)
+}
+
+// IndexWorkers index queued keys in the background, so that storing a key
+// does not wait on indexing it, and indexing failures do not prevent keys
+// from being stored.
+type IndexWorkers struct {
+	ix        Indexer
+	workers   int
+	batchSize int
+	interval  time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewIndexWorkers returns IndexWorkers which each index batches of batchSize
+// keys from ix for as long as keys are queued, and then check the queue again
+// every interval.
+func NewIndexWorkers(ix Indexer, workers, batchSize int, interval time.Duration) *IndexWorkers {
+	if workers <= 0 {
+		workers = DefaultIndexWorkers
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultIndexBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultIndexInterval
+	}
+	return &IndexWorkers{
+		ix:        ix,
+		workers:   workers,
+		batchSize: batchSize,
+		interval:  interval,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start starts indexing in the background until Stop is called.
+func (w *IndexWorkers) Start() {
+	for i := 0; i < w.workers; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+}
+
+func (w *IndexWorkers) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		// Keep indexing while the queue supplies full batches.
+		for {
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+			n, err := w.ix.IndexQueued(w.batchSize)
+			if err != nil {
+				log.Warningf("failed to index queued keys: %v", err)
+				break
+			}
+			if n < w.batchSize {
+				break
+			}
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops background indexing, waiting for batches in progress to finish.
+// Keys remaining in the queue are indexed when indexing is next started.
+func (w *IndexWorkers) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
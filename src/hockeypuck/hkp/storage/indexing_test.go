@@ -0,0 +1,150 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type IndexingSuite struct{}
+
+var _ = gc.Suite(&IndexingSuite{})
+
+func (*IndexingSuite) TestIndexWorkers(c *gc.C) {
+	queued := 250
+	var batches []int
+	drained := make(chan struct{})
+	st := mock.NewStorage(mock.IndexQueued(func(limit int) (int, error) {
+		n := queued
+		if n > limit {
+			n = limit
+		}
+		queued -= n
+		batches = append(batches, n)
+		if n > 0 && queued == 0 {
+			close(drained)
+		}
+		return n, nil
+	}))
+	w := storage.NewIndexWorkers(st, 1, 100, time.Hour)
+	w.Start()
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for queue to drain")
+	}
+	w.Stop()
+	c.Assert(batches, gc.DeepEquals, []int{100, 100, 50})
+}
+
+func (*IndexingSuite) TestIndexWorkersRetry(c *gc.C) {
+	var calls int
+	indexed := make(chan struct{})
+	st := mock.NewStorage(mock.IndexQueued(func(limit int) (int, error) {
+		calls++
+		switch calls {
+		case 1:
+			return 0, errors.New("index failed")
+		case 2:
+			close(indexed)
+			return 1, nil
+		}
+		return 0, nil
+	}))
+	w := storage.NewIndexWorkers(st, 1, 100, 10*time.Millisecond)
+	w.Start()
+	select {
+	case <-indexed:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for retry")
+	}
+	w.Stop()
+	c.Assert(calls >= 2, gc.Equals, true)
+}
+
+type testSearchProvider struct {
+	indexed chan []*openpgp.PrimaryKey
+	removed []string
+}
+
+func (sp *testSearchProvider) Index(keys []*openpgp.PrimaryKey) error {
+	sp.indexed <- keys
+	return nil
+}
+
+func (sp *testSearchProvider) RemoveDigests(digests []string) error {
+	sp.removed = append(sp.removed, digests...)
+	return nil
+}
+
+func (sp *testSearchProvider) Search(string, int) ([]string, error) { return nil, nil }
+
+func (*IndexingSuite) TestSearchFeeder(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	st := mock.NewStorage(
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			c.Assert(digests, gc.DeepEquals, []string{key.MD5})
+			return []string{key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	sp := &testSearchProvider{indexed: make(chan []*openpgp.PrimaryKey, 1)}
+	f := storage.NewSearchFeeder(st, sp)
+	f.Start()
+	defer f.Stop()
+
+	st.Notify(storage.KeyReplaced{OldDigest: "old", NewDigest: key.MD5})
+	select {
+	case keys := <-sp.indexed:
+		c.Assert(keys, gc.DeepEquals, []*openpgp.PrimaryKey{key})
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for key to be indexed")
+	}
+	c.Assert(sp.removed, gc.DeepEquals, []string{"old"})
+}
+
+func (*IndexingSuite) TestSearchFeederStopApplies(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	st := mock.NewStorage(
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			return []string{key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	sp := &testSearchProvider{indexed: make(chan []*openpgp.PrimaryKey, 3)}
+	f := storage.NewSearchFeeder(st, sp)
+	f.Start()
+	for i := 0; i < 3; i++ {
+		st.Notify(storage.KeyAdded{ID: key.Fingerprint(), Digest: key.MD5})
+	}
+	// Changes queued when the feeder is stopped are still applied.
+	f.Stop()
+	c.Assert(sp.indexed, gc.HasLen, 3)
+}
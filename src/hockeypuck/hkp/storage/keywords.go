@@ -0,0 +1,76 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"hockeypuck/openpgp"
+)
+
+// Keywords returns a slice of searchable tokens
+// extracted from the UserID packets keywords string of
+// the given key.
+func Keywords(key *openpgp.PrimaryKey) []string {
+	m := make(map[string]bool)
+	for _, uid := range key.UserIDs {
+		for _, k := range UserIDKeywords(uid.Keywords) {
+			m[k] = true
+		}
+	}
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+// UserIDKeywords returns the searchable tokens of a user ID in the order
+// they appear: the words of the name, followed by the email address and its
+// user name and domain. Unlike Keywords, tokens may be repeated, so that
+// phrases in the user ID can be matched.
+func UserIDKeywords(uid string) []string {
+	var result []string
+	s := strings.ToLower(uid)
+	lbr, rbr := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if lbr != -1 {
+		fields := strings.FieldsFunc(s[:lbr], func(r rune) bool {
+			if !utf8.ValidRune(r) {
+				return true
+			}
+			if unicode.IsLetter(r) || unicode.IsNumber(r) || r == '-' {
+				return false
+			}
+			return true
+		})
+		result = append(result, fields...)
+	}
+	if lbr != -1 && rbr > lbr {
+		email := s[lbr+1 : rbr]
+		result = append(result, email)
+
+		parts := strings.SplitN(email, "@", 2)
+		if len(parts) > 1 {
+			username, domain := parts[0], parts[1]
+			result = append(result, username, domain)
+		}
+	}
+	return result
+}
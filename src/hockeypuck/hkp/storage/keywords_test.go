@@ -0,0 +1,50 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+type KeywordsSuite struct{}
+
+var _ = gc.Suite(&KeywordsSuite{})
+
+func (s *KeywordsSuite) TestUserIDKeywords(c *gc.C) {
+	c.Assert(storage.UserIDKeywords("Casey Marshall (work) <Casey.Marshall@Example.com>"), gc.DeepEquals, []string{
+		"casey", "marshall", "work", "casey.marshall@example.com", "casey.marshall", "example.com",
+	})
+	c.Assert(storage.UserIDKeywords("no email here"), gc.HasLen, 0)
+}
+
+func (s *KeywordsSuite) TestParseKeywordMatch(c *gc.C) {
+	for in, out := range map[string]storage.KeywordMatch{
+		"":       storage.MatchAllWords,
+		"all":    storage.MatchAllWords,
+		"ANY":    storage.MatchAnyWord,
+		"phrase": storage.MatchPhrase,
+	} {
+		m, ok := storage.ParseKeywordMatch(in)
+		c.Assert(ok, gc.Equals, true, gc.Commentf("%q", in))
+		c.Assert(m, gc.Equals, out)
+	}
+	_, ok := storage.ParseKeywordMatch("some")
+	c.Assert(ok, gc.Equals, false)
+}
@@ -0,0 +1,153 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "hockeypuck/logrus"
+)
+
+// ListenerID identifies a key change callback registered with Subscribe.
+type ListenerID uint64
+
+// ListenerStats counts the key change notifications delivered to a listener.
+type ListenerStats struct {
+	ID ListenerID
+
+	// Delivered is the number of notifications the listener accepted.
+	Delivered uint64
+	// Failed is the number of notifications the listener returned an error for.
+	Failed uint64
+
+	LastError     string
+	LastErrorTime time.Time
+}
+
+type listener struct {
+	id      ListenerID
+	f       func(KeyChange) error
+	removed int32
+
+	delivered uint64
+	failed    uint64
+
+	mu            sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// Listeners is a set of key change callbacks, for storage backends to embed
+// in order to implement Subscribe, Unsubscribe, Notify and ListenerStats.
+// Listeners may be added and removed while notifications are delivered,
+// including from within a callback.
+//
+// The zero value is an empty set, ready to use.
+type Listeners struct {
+	mu        sync.Mutex
+	lastID    ListenerID
+	listeners []*listener
+
+	// notifyMu serializes deliveries, so that each listener sees changes in
+	// the order they were made.
+	notifyMu sync.Mutex
+}
+
+// Subscribe registers a key change callback function, returning an ID with
+// which it may be unsubscribed.
+func (l *Listeners) Subscribe(f func(KeyChange) error) ListenerID {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID++
+	l.listeners = append(l.listeners, &listener{id: l.lastID, f: f})
+	return l.lastID
+}
+
+// Unsubscribe removes a key change callback function. It is not called with
+// any notification delivered after Unsubscribe returns, although one already
+// being delivered may complete. Unsubscribe returns false if there was no
+// such listener.
+func (l *Listeners) Unsubscribe(id ListenerID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ln := range l.listeners {
+		if ln.id == id {
+			atomic.StoreInt32(&ln.removed, 1)
+			l.listeners = append(l.listeners[:i:i], l.listeners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Notify invokes all registered callbacks with a key change notification.
+// Every listener is called even if some fail; the first error is returned.
+func (l *Listeners) Notify(change KeyChange) error {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	log.Debugf("%v", change)
+
+	l.mu.Lock()
+	listeners := l.listeners
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, ln := range listeners {
+		if atomic.LoadInt32(&ln.removed) != 0 {
+			continue
+		}
+		err := ln.f(change)
+		if err != nil {
+			atomic.AddUint64(&ln.failed, 1)
+			ln.mu.Lock()
+			ln.lastError, ln.lastErrorTime = err.Error(), time.Now()
+			ln.mu.Unlock()
+			log.Debugf("listener %d failed to handle %v: %v", ln.id, change, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		atomic.AddUint64(&ln.delivered, 1)
+	}
+	return firstErr
+}
+
+// ListenerStats returns delivery counts for each registered listener, in
+// the order they were subscribed.
+func (l *Listeners) ListenerStats() []ListenerStats {
+	l.mu.Lock()
+	listeners := l.listeners
+	l.mu.Unlock()
+
+	result := make([]ListenerStats, len(listeners))
+	for i, ln := range listeners {
+		ln.mu.Lock()
+		result[i] = ListenerStats{
+			ID:            ln.id,
+			Delivered:     atomic.LoadUint64(&ln.delivered),
+			Failed:        atomic.LoadUint64(&ln.failed),
+			LastError:     ln.lastError,
+			LastErrorTime: ln.lastErrorTime,
+		}
+		ln.mu.Unlock()
+	}
+	return result
+}
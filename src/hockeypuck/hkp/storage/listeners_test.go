@@ -0,0 +1,100 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+type ListenersSuite struct{}
+
+var _ = gc.Suite(&ListenersSuite{})
+
+func (s *ListenersSuite) TestUnsubscribe(c *gc.C) {
+	var l storage.Listeners
+	var a, b int
+	idA := l.Subscribe(func(storage.KeyChange) error { a++; return nil })
+	idB := l.Subscribe(func(storage.KeyChange) error { b++; return nil })
+	c.Assert(idA, gc.Not(gc.Equals), idB)
+
+	c.Assert(l.Notify(storage.KeyAdded{Digest: "one"}), gc.IsNil)
+	c.Assert(l.Unsubscribe(idA), gc.Equals, true)
+	c.Assert(l.Unsubscribe(idA), gc.Equals, false)
+	c.Assert(l.Notify(storage.KeyAdded{Digest: "two"}), gc.IsNil)
+	c.Assert(a, gc.Equals, 1)
+	c.Assert(b, gc.Equals, 2)
+}
+
+func (s *ListenersSuite) TestUnsubscribeDuringNotify(c *gc.C) {
+	var l storage.Listeners
+	var id storage.ListenerID
+	var first, second int
+	id = l.Subscribe(func(storage.KeyChange) error {
+		first++
+		l.Unsubscribe(id)
+		return nil
+	})
+	var secondID storage.ListenerID
+	l.Subscribe(func(storage.KeyChange) error {
+		second++
+		// Removing a listener not yet called in this delivery skips it.
+		l.Unsubscribe(secondID)
+		return nil
+	})
+	secondID = l.Subscribe(func(storage.KeyChange) error {
+		c.Error("unsubscribed listener was called")
+		return nil
+	})
+
+	l.Notify(storage.KeyAdded{Digest: "one"})
+	l.Notify(storage.KeyAdded{Digest: "two"})
+	c.Assert(first, gc.Equals, 1)
+	c.Assert(second, gc.Equals, 2)
+}
+
+func (s *ListenersSuite) TestStats(c *gc.C) {
+	var l storage.Listeners
+	ok := l.Subscribe(func(storage.KeyChange) error { return nil })
+	failing := l.Subscribe(func(kc storage.KeyChange) error {
+		if kc.InsertDigests()[0] == "bad" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	c.Assert(l.Notify(storage.KeyAdded{Digest: "good"}), gc.IsNil)
+	err := l.Notify(storage.KeyAdded{Digest: "bad"})
+	c.Assert(err, gc.ErrorMatches, "boom")
+
+	stats := l.ListenerStats()
+	c.Assert(stats, gc.HasLen, 2)
+	c.Assert(stats[0].ID, gc.Equals, ok)
+	c.Assert(stats[0].Delivered, gc.Equals, uint64(2))
+	c.Assert(stats[0].Failed, gc.Equals, uint64(0))
+	c.Assert(stats[1].ID, gc.Equals, failing)
+	c.Assert(stats[1].Delivered, gc.Equals, uint64(1))
+	c.Assert(stats[1].Failed, gc.Equals, uint64(1))
+	c.Assert(stats[1].LastError, gc.Equals, "boom")
+	c.Assert(stats[1].LastErrorTime.IsZero(), gc.Equals, false)
+
+	l.Unsubscribe(failing)
+	c.Assert(l.ListenerStats(), gc.HasLen, 1)
+}
@@ -0,0 +1,70 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Metadata names are a namespace and a name within it, separated by a slash,
+// such as "hr/employee-id".
+var metadataNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*/[a-z0-9][a-z0-9._-]*$`)
+
+const (
+	maxMetadataNameLen  = 128
+	maxMetadataValueLen = 4096
+)
+
+// MetadataStore is implemented by storage backends which can attach
+// deployment-specific metadata to stored keys. Metadata is not part of the
+// key material: it does not change the key's digest and is never
+// reconciled with peers.
+type MetadataStore interface {
+	// Metadata returns the metadata attached to the keys with the given
+	// RFingerprints, by RFingerprint and then by name. Keys without
+	// metadata are omitted.
+	Metadata(rfps []string) (map[string]map[string]string, error)
+
+	// SetMetadata attaches a named value to the key with the given
+	// RFingerprint, replacing any previous value. An empty value removes
+	// the name from the key.
+	SetMetadata(rfp, name, value string) error
+}
+
+// ValidateMetadata returns an error if name or value may not be stored as
+// key metadata.
+func ValidateMetadata(name, value string) error {
+	if len(name) > maxMetadataNameLen || !metadataNameRe.MatchString(name) {
+		return errors.Errorf("invalid metadata name %q, expected namespace/name", name)
+	}
+	if len(value) > maxMetadataValueLen {
+		return errors.Errorf("metadata value for %q exceeds %d bytes", name, maxMetadataValueLen)
+	}
+	return nil
+}
+
+// MetadataNamespace returns the namespace of a metadata name.
+func MetadataNamespace(name string) string {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"hockeypuck/hkp/storage"
+)
+
+// Clock is a storage.Clock which only moves when told to.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var _ storage.Clock = (*Clock)(nil)
+
+// NewClock returns a Clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set sets the time of the clock.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// IDs is a storage.IDGenerator of sequentially numbered IDs.
+type IDs struct {
+	mu     sync.Mutex
+	prefix string
+	n      int
+}
+
+var _ storage.IDGenerator = (*IDs)(nil)
+
+// NewIDs returns IDs generating prefix1, prefix2 and so on.
+func NewIDs(prefix string) *IDs {
+	return &IDs{prefix: prefix}
+}
+
+func (g *IDs) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("%s%d", g.prefix, g.n), nil
+}
@@ -53,11 +53,39 @@ type resolverFunc func([]string) ([]string, error)
 type modifiedSinceFunc func(time.Time) ([]string, error)
 type fetchKeysFunc func([]string) ([]*openpgp.PrimaryKey, error)
 type fetchKeyringsFunc func([]string) ([]*storage.Keyring, error)
+type modTimesFunc func([]string) (map[string]time.Time, error)
 type insertFunc func([]*openpgp.PrimaryKey) (int, int, error)
 type replaceFunc func(*openpgp.PrimaryKey) (string, error)
 type updateFunc func(*openpgp.PrimaryKey, string, string) error
 type deleteFunc func(string) (string, error)
 type renotifyAllFunc func() error
+type accessedFunc func([]string) error
+type notAccessedSinceFunc func(time.Time, string, int) ([]string, error)
+type tombstoneFunc func(string) error
+type tombstonedFunc func(string) (bool, error)
+type blockFunc func(string, string) error
+type isBlockedFunc func(string) (bool, error)
+type setKeyStateFunc func(string, storage.KeyState) error
+type indexQueuedFunc func(int) (int, error)
+type indexPendingFunc func() (int, error)
+type metadataFunc func([]string) (map[string]map[string]string, error)
+type setMetadataFunc func(string, string, string) error
+type verifiedAddressesFunc func(string) ([]storage.VerifiedAddress, error)
+type verifiedSinceFunc func(time.Time, int) ([]storage.VerifiedAddress, error)
+type setVerifiedFunc func([]storage.VerifiedAddress) error
+type countVerifiedKeysFunc func(string) (int, error)
+type insertTokenFunc func(storage.IssuedToken) error
+type countTokensFunc func(string, string, time.Time) (int, int, error)
+type consumeTokenFunc func(string, time.Time) (bool, error)
+type expireTokensFunc func(time.Time) (int, error)
+type queueRecoveryFunc func([]storage.PendingRecovery) error
+type pendingRecoveriesFunc func(time.Time, int) ([]storage.PendingRecovery, error)
+type dequeueRecoveryFunc func([]string) error
+type expireRecoveryFunc func(time.Time) (int, error)
+type fileErasureFunc func(storage.ErasureRequest) error
+type erasureRequestsFunc func(storage.ErasureStatus) ([]storage.ErasureRequest, error)
+type decideErasureFunc func(string, storage.ErasureStatus, time.Time) (*storage.ErasureRequest, error)
+type addressKeysFunc func(string) ([]string, error)
 
 type Storage struct {
 	Recorder
@@ -68,13 +96,50 @@ type Storage struct {
 	modifiedSince modifiedSinceFunc
 	fetchKeys     fetchKeysFunc
 	fetchKeyrings fetchKeyringsFunc
+	modTimes      modTimesFunc
 	insert        insertFunc
 	replace       replaceFunc
 	update        updateFunc
 	delete        deleteFunc
 	renotifyAll   renotifyAllFunc
 
-	notified []func(storage.KeyChange) error
+	accessed         accessedFunc
+	notAccessedSince notAccessedSinceFunc
+	tombstone        tombstoneFunc
+	tombstoned       tombstonedFunc
+
+	block     blockFunc
+	isBlocked isBlockedFunc
+
+	setKeyState setKeyStateFunc
+
+	indexQueued  indexQueuedFunc
+	indexPending indexPendingFunc
+
+	metadata    metadataFunc
+	setMetadata setMetadataFunc
+
+	verifiedAddresses verifiedAddressesFunc
+	verifiedSince     verifiedSinceFunc
+	setVerified       setVerifiedFunc
+	countVerifiedKeys countVerifiedKeysFunc
+
+	insertToken  insertTokenFunc
+	countTokens  countTokensFunc
+	consumeToken consumeTokenFunc
+	expireTokens expireTokensFunc
+
+	queueRecovery     queueRecoveryFunc
+	pendingRecoveries pendingRecoveriesFunc
+	dequeueRecovery   dequeueRecoveryFunc
+	expireRecovery    expireRecoveryFunc
+
+	fileErasure     fileErasureFunc
+	erasureRequests erasureRequestsFunc
+	decideErasure   decideErasureFunc
+	addressKeys     addressKeysFunc
+
+	storage.Listeners
 }
 
 type Option func(*Storage)
@@ -92,10 +157,55 @@ func FetchKeys(f fetchKeysFunc) Option { return func(m *Storage) { m.fetchKeys =
 func FetchKeyrings(f fetchKeyringsFunc) Option {
 	return func(m *Storage) { m.fetchKeyrings = f }
 }
+func ModTimes(f modTimesFunc) Option       { return func(m *Storage) { m.modTimes = f } }
 func Insert(f insertFunc) Option           { return func(m *Storage) { m.insert = f } }
 func Replace(f replaceFunc) Option         { return func(m *Storage) { m.replace = f } }
 func Update(f updateFunc) Option           { return func(m *Storage) { m.update = f } }
+func Delete(f deleteFunc) Option           { return func(m *Storage) { m.delete = f } }
 func RenotifyAll(f renotifyAllFunc) Option { return func(m *Storage) { m.renotifyAll = f } }
+func Accessed(f accessedFunc) Option       { return func(m *Storage) { m.accessed = f } }
+func NotAccessedSince(f notAccessedSinceFunc) Option {
+	return func(m *Storage) { m.notAccessedSince = f }
+}
+func Tombstone(f tombstoneFunc) Option   { return func(m *Storage) { m.tombstone = f } }
+func Tombstoned(f tombstonedFunc) Option { return func(m *Storage) { m.tombstoned = f } }
+func Block(f blockFunc) Option           { return func(m *Storage) { m.block = f } }
+func IsBlocked(f isBlockedFunc) Option   { return func(m *Storage) { m.isBlocked = f } }
+func SetKeyState(f setKeyStateFunc) Option {
+	return func(m *Storage) { m.setKeyState = f }
+}
+func IndexQueued(f indexQueuedFunc) Option {
+	return func(m *Storage) { m.indexQueued = f }
+}
+func IndexPending(f indexPendingFunc) Option {
+	return func(m *Storage) { m.indexPending = f }
+}
+func Metadata(f metadataFunc) Option       { return func(m *Storage) { m.metadata = f } }
+func SetMetadata(f setMetadataFunc) Option { return func(m *Storage) { m.setMetadata = f } }
+func VerifiedAddresses(f verifiedAddressesFunc) Option {
+	return func(m *Storage) { m.verifiedAddresses = f }
+}
+func VerifiedSince(f verifiedSinceFunc) Option { return func(m *Storage) { m.verifiedSince = f } }
+func SetVerified(f setVerifiedFunc) Option     { return func(m *Storage) { m.setVerified = f } }
+func CountVerifiedKeys(f countVerifiedKeysFunc) Option {
+	return func(m *Storage) { m.countVerifiedKeys = f }
+}
+func InsertToken(f insertTokenFunc) Option     { return func(m *Storage) { m.insertToken = f } }
+func CountTokens(f countTokensFunc) Option     { return func(m *Storage) { m.countTokens = f } }
+func ConsumeToken(f consumeTokenFunc) Option   { return func(m *Storage) { m.consumeToken = f } }
+func ExpireTokens(f expireTokensFunc) Option   { return func(m *Storage) { m.expireTokens = f } }
+func QueueRecovery(f queueRecoveryFunc) Option { return func(m *Storage) { m.queueRecovery = f } }
+func PendingRecoveries(f pendingRecoveriesFunc) Option {
+	return func(m *Storage) { m.pendingRecoveries = f }
+}
+func DequeueRecovery(f dequeueRecoveryFunc) Option { return func(m *Storage) { m.dequeueRecovery = f } }
+func ExpireRecovery(f expireRecoveryFunc) Option   { return func(m *Storage) { m.expireRecovery = f } }
+func FileErasure(f fileErasureFunc) Option         { return func(m *Storage) { m.fileErasure = f } }
+func ErasureRequests(f erasureRequestsFunc) Option {
+	return func(m *Storage) { m.erasureRequests = f }
+}
+func DecideErasure(f decideErasureFunc) Option { return func(m *Storage) { m.decideErasure = f } }
+func AddressKeys(f addressKeysFunc) Option     { return func(m *Storage) { m.addressKeys = f } }
 
 func NewStorage(options ...Option) *Storage {
 	m := &Storage{}
@@ -154,6 +264,13 @@ func (m *Storage) FetchKeyrings(s []string) ([]*storage.Keyring, error) {
 	}
 	return nil, nil
 }
+func (m *Storage) ModTimes(s []string) (map[string]time.Time, error) {
+	m.record("ModTimes", s)
+	if m.modTimes != nil {
+		return m.modTimes(s)
+	}
+	return nil, nil
+}
 func (m *Storage) Insert(keys []*openpgp.PrimaryKey) (int, int, error) {
 	m.record("Insert", keys)
 	if m.insert != nil {
@@ -182,18 +299,6 @@ func (m *Storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string)
 	}
 	return nil
 }
-func (m *Storage) Subscribe(f func(storage.KeyChange) error) {
-	m.notified = append(m.notified, f)
-}
-func (m *Storage) Notify(change storage.KeyChange) error {
-	for _, cb := range m.notified {
-		err := cb(change)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
 func (m *Storage) RenotifyAll() error {
 	m.record("RenotifyAll")
 	if m.renotifyAll != nil {
@@ -201,3 +306,208 @@ func (m *Storage) RenotifyAll() error {
 	}
 	return nil
 }
+func (m *Storage) Accessed(rfps []string) error {
+	m.record("Accessed", rfps)
+	if m.accessed != nil {
+		return m.accessed(rfps)
+	}
+	return nil
+}
+func (m *Storage) NotAccessedSince(t time.Time, after string, limit int) ([]string, error) {
+	m.record("NotAccessedSince", t, after, limit)
+	if m.notAccessedSince != nil {
+		return m.notAccessedSince(t, after, limit)
+	}
+	return nil, nil
+}
+func (m *Storage) Tombstone(fp string) error {
+	m.record("Tombstone", fp)
+	if m.tombstone != nil {
+		return m.tombstone(fp)
+	}
+	return nil
+}
+func (m *Storage) Tombstoned(rfp string) (bool, error) {
+	m.record("Tombstoned", rfp)
+	if m.tombstoned != nil {
+		return m.tombstoned(rfp)
+	}
+	return false, nil
+}
+func (m *Storage) Block(fp, reason string) error {
+	m.record("Block", fp, reason)
+	if m.block != nil {
+		return m.block(fp, reason)
+	}
+	return nil
+}
+func (m *Storage) Unblock(fp string) error {
+	m.record("Unblock", fp)
+	return nil
+}
+func (m *Storage) IsBlocked(fp string) (bool, error) {
+	m.record("IsBlocked", fp)
+	if m.isBlocked != nil {
+		return m.isBlocked(fp)
+	}
+	return false, nil
+}
+func (m *Storage) BlockedKeys() ([]storage.BlockedKey, error) {
+	m.record("BlockedKeys")
+	return nil, nil
+}
+func (m *Storage) SetKeyState(rfp string, state storage.KeyState) error {
+	m.record("SetKeyState", rfp, state)
+	if m.setKeyState != nil {
+		return m.setKeyState(rfp, state)
+	}
+	return nil
+}
+func (m *Storage) KeyState(rfp string) (storage.KeyState, error) {
+	m.record("KeyState", rfp)
+	return storage.KeyStateNormal, nil
+}
+func (m *Storage) KeysInState(state storage.KeyState, after string, limit int) ([]string, error) {
+	m.record("KeysInState", state, after, limit)
+	return nil, nil
+}
+func (m *Storage) IndexQueued(limit int) (int, error) {
+	m.record("IndexQueued", limit)
+	if m.indexQueued != nil {
+		return m.indexQueued(limit)
+	}
+	return 0, nil
+}
+func (m *Storage) IndexPending() (int, error) {
+	m.record("IndexPending")
+	if m.indexPending != nil {
+		return m.indexPending()
+	}
+	return 0, nil
+}
+func (m *Storage) Metadata(rfps []string) (map[string]map[string]string, error) {
+	m.record("Metadata", rfps)
+	if m.metadata != nil {
+		return m.metadata(rfps)
+	}
+	return nil, nil
+}
+func (m *Storage) SetMetadata(rfp, name, value string) error {
+	m.record("SetMetadata", rfp, name, value)
+	if m.setMetadata != nil {
+		return m.setMetadata(rfp, name, value)
+	}
+	return nil
+}
+func (m *Storage) VerifiedAddresses(rfp string) ([]storage.VerifiedAddress, error) {
+	m.record("VerifiedAddresses", rfp)
+	if m.verifiedAddresses != nil {
+		return m.verifiedAddresses(rfp)
+	}
+	return nil, nil
+}
+func (m *Storage) VerifiedSince(t time.Time, limit int) ([]storage.VerifiedAddress, error) {
+	m.record("VerifiedSince", t, limit)
+	if m.verifiedSince != nil {
+		return m.verifiedSince(t, limit)
+	}
+	return nil, nil
+}
+func (m *Storage) SetVerified(addrs []storage.VerifiedAddress) error {
+	m.record("SetVerified", addrs)
+	if m.setVerified != nil {
+		return m.setVerified(addrs)
+	}
+	return nil
+}
+func (m *Storage) CountVerifiedKeys(domain string) (int, error) {
+	m.record("CountVerifiedKeys", domain)
+	if m.countVerifiedKeys != nil {
+		return m.countVerifiedKeys(domain)
+	}
+	return 0, nil
+}
+func (m *Storage) InsertToken(t storage.IssuedToken) error {
+	m.record("InsertToken", t)
+	if m.insertToken != nil {
+		return m.insertToken(t)
+	}
+	return nil
+}
+func (m *Storage) CountTokens(address, source string, since time.Time) (int, int, error) {
+	m.record("CountTokens", address, source, since)
+	if m.countTokens != nil {
+		return m.countTokens(address, source, since)
+	}
+	return 0, 0, nil
+}
+func (m *Storage) ConsumeToken(id string, now time.Time) (bool, error) {
+	m.record("ConsumeToken", id, now)
+	if m.consumeToken != nil {
+		return m.consumeToken(id, now)
+	}
+	return true, nil
+}
+func (m *Storage) ExpireTokens(now time.Time) (int, error) {
+	m.record("ExpireTokens", now)
+	if m.expireTokens != nil {
+		return m.expireTokens(now)
+	}
+	return 0, nil
+}
+func (m *Storage) QueueRecovery(items []storage.PendingRecovery) error {
+	m.record("QueueRecovery", items)
+	if m.queueRecovery != nil {
+		return m.queueRecovery(items)
+	}
+	return nil
+}
+func (m *Storage) PendingRecoveries(before time.Time, limit int) ([]storage.PendingRecovery, error) {
+	m.record("PendingRecoveries", before, limit)
+	if m.pendingRecoveries != nil {
+		return m.pendingRecoveries(before, limit)
+	}
+	return nil, nil
+}
+func (m *Storage) DequeueRecovery(digests []string) error {
+	m.record("DequeueRecovery", digests)
+	if m.dequeueRecovery != nil {
+		return m.dequeueRecovery(digests)
+	}
+	return nil
+}
+func (m *Storage) ExpireRecovery(before time.Time) (int, error) {
+	m.record("ExpireRecovery", before)
+	if m.expireRecovery != nil {
+		return m.expireRecovery(before)
+	}
+	return 0, nil
+}
+func (m *Storage) FileErasure(req storage.ErasureRequest) error {
+	m.record("FileErasure", req)
+	if m.fileErasure != nil {
+		return m.fileErasure(req)
+	}
+	return nil
+}
+func (m *Storage) ErasureRequests(status storage.ErasureStatus) ([]storage.ErasureRequest, error) {
+	m.record("ErasureRequests", status)
+	if m.erasureRequests != nil {
+		return m.erasureRequests(status)
+	}
+	return nil, nil
+}
+func (m *Storage) DecideErasure(id string, status storage.ErasureStatus, decided time.Time) (*storage.ErasureRequest, error) {
+	m.record("DecideErasure", id, status, decided)
+	if m.decideErasure != nil {
+		return m.decideErasure(id, status, decided)
+	}
+	return nil, storage.ErrErasureNotFound
+}
+func (m *Storage) AddressKeys(address string) ([]string, error) {
+	m.record("AddressKeys", address)
+	if m.addressKeys != nil {
+		return m.addressKeys(address)
+	}
+	return nil, nil
+}
@@ -0,0 +1,51 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import "time"
+
+// PendingRecovery is a key digest which a recon peer has and this keyserver
+// lacks, queued for recovery from the peer.
+type PendingRecovery struct {
+	Digest string
+	// HKPAddr is the host:port of the HKP service of the peer to recover
+	// the key from.
+	HKPAddr string
+	Queued  time.Time
+}
+
+// RecoveryStore is implemented by storage backends which persist the queue
+// of keys pending recovery from recon peers, so that recovery interrupted by
+// a restart can be resumed without waiting for the differences to be found
+// again by recon.
+type RecoveryStore interface {
+	// QueueRecovery adds digests to the queue. Digests already queued keep
+	// their place.
+	QueueRecovery(items []PendingRecovery) error
+
+	// PendingRecoveries returns up to limit queued digests, queued at or
+	// before the given time, oldest first.
+	PendingRecoveries(before time.Time, limit int) ([]PendingRecovery, error)
+
+	// DequeueRecovery removes digests from the queue.
+	DequeueRecovery(digests []string) error
+
+	// ExpireRecovery removes digests queued before the given time, returning
+	// the number removed.
+	ExpireRecovery(before time.Time) (int, error)
+}
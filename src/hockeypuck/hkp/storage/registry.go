@@ -0,0 +1,149 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// Config is the configuration passed to storage drivers. Drivers ignore the
+// settings they do not support.
+type Config struct {
+	// KeyReaderOptions is the policy applied when reading stored keys.
+	KeyReaderOptions []openpgp.KeyReaderOption
+	// DeferIndexing queues keys for keyword indexing by an Indexer rather
+	// than indexing them as they are stored.
+	DeferIndexing bool
+	// BulkBatchSize is the number of keys copied in each transaction when
+	// loading keys in bulk. Zero is the driver's default.
+	BulkBatchSize int
+	// InsertBatchSize is the number of keys added in each transaction when
+	// there are too few to load in bulk. Zero is the driver's default.
+	InsertBatchSize int
+
+	// Limits on the pool of connections to a database server, which are
+	// the driver's defaults if zero.
+	MaxConns        int
+	MaxIdleConns    int
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	// StatementTimeout aborts database statements which run for longer.
+	StatementTimeout time.Duration
+	// HealthCheckPeriod is how often idle database connections are checked.
+	HealthCheckPeriod time.Duration
+
+	// Encryption, if set, encrypts the key material held in storage. Drivers
+	// which support it implement Reencrypter.
+	Encryption *EncryptionKeys
+
+	// TrigramSearch indexes user IDs so that keyword searches may match
+	// substrings of them and similar words, with MatchSubstring and
+	// MatchFuzzy. Drivers without such an index ignore it.
+	TrigramSearch bool
+
+	// SharedNotifications publishes key changes to the other servers
+	// sharing a database, and notifies listeners of the changes they
+	// publish. Drivers for storage which is not shared ignore it.
+	SharedNotifications bool
+}
+
+// Factory opens storage at the data source dsn.
+type Factory func(dsn string, config *Config) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Factory{}
+)
+
+// Register makes a storage driver available by the given name, which also
+// selects it as the URL scheme of a data source. Drivers usually register
+// themselves when their package is initialized, so that a driver is compiled
+// in by importing its package. Register panics if a driver is registered
+// twice with the same name.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, ok := drivers[name]; ok {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the names of the registered storage drivers, sorted.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dial opens storage at the data source dsn. The driver is selected by the
+// URL scheme of dsn if a driver is registered for it, and is otherwise the
+// named driver.
+func Dial(driver, dsn string, config *Config) (Storage, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	driversMu.RLock()
+	factory, ok := drivers[dsnScheme(dsn)]
+	if !ok {
+		factory, ok = drivers[driver]
+	}
+	driversMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("storage driver %q not supported", driver)
+	}
+	return factory(dsn, config)
+}
+
+func dsnScheme(dsn string) string {
+	i := strings.Index(dsn, "://")
+	if i <= 0 {
+		return ""
+	}
+	return strings.ToLower(dsn[:i])
+}
+
+// DSNPath returns the path of a data source given either as a path, or as a
+// URL such as leveldb:///var/lib/hockeypuck/keys. Drivers storing keys in
+// local files use it to accept both forms.
+func DSNPath(dsn string) string {
+	if dsnScheme(dsn) == "" {
+		return dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	return u.Host + u.Path
+}
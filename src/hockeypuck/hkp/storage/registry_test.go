@@ -0,0 +1,68 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+type RegistrySuite struct{}
+
+var _ = gc.Suite(&RegistrySuite{})
+
+func (*RegistrySuite) TestDial(c *gc.C) {
+	var dsns []string
+	factory := func(name string) storage.Factory {
+		return func(dsn string, config *storage.Config) (storage.Storage, error) {
+			c.Assert(config, gc.NotNil)
+			dsns = append(dsns, name+" "+dsn)
+			return mock.NewStorage(), nil
+		}
+	}
+	storage.Register("test-a", factory("test-a"))
+	storage.Register("test-b", factory("test-b"))
+	c.Assert(storage.Drivers(), gc.DeepEquals, []string{"test-a", "test-b"})
+	c.Assert(func() { storage.Register("test-a", factory("test-a")) }, gc.PanicMatches, ".*called twice.*")
+
+	_, err := storage.Dial("test-a", "host=localhost", nil)
+	c.Assert(err, gc.IsNil)
+	// The URL scheme selects the driver.
+	_, err = storage.Dial("test-a", "test-b://localhost/keys", nil)
+	c.Assert(err, gc.IsNil)
+	// Unregistered schemes are passed to the named driver.
+	_, err = storage.Dial("test-a", "other://localhost/keys", &storage.Config{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(dsns, gc.DeepEquals, []string{
+		"test-a host=localhost",
+		"test-b test-b://localhost/keys",
+		"test-a other://localhost/keys",
+	})
+
+	_, err = storage.Dial("test-c", "/var/lib/keys", nil)
+	c.Assert(err, gc.ErrorMatches, `storage driver "test-c" not supported`)
+}
+
+func (*RegistrySuite) TestDSNPath(c *gc.C) {
+	c.Assert(storage.DSNPath("/var/lib/keys"), gc.Equals, "/var/lib/keys")
+	c.Assert(storage.DSNPath("keys"), gc.Equals, "keys")
+	c.Assert(storage.DSNPath("leveldb:///var/lib/keys"), gc.Equals, "/var/lib/keys")
+	c.Assert(storage.DSNPath("leveldb://keys/db"), gc.Equals, "keys/db")
+}
@@ -0,0 +1,113 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// ErrKeyTombstoned is returned when adding a key that was removed by the
+// retention policy.
+var ErrKeyTombstoned = fmt.Errorf("key has been removed")
+
+func IsTombstoned(err error) bool {
+	return errors.Is(err, ErrKeyTombstoned)
+}
+
+// Retainer is implemented by storage backends that support a retention
+// policy for stale keys.
+type Retainer interface {
+	// Accessed records that the keys with the given RFingerprints were
+	// fetched.
+	Accessed(rfps []string) error
+
+	// NotAccessedSince returns up to limit RFingerprints of keys that have
+	// not been fetched since the given time, in RFingerprint order after the
+	// given RFingerprint.
+	NotAccessedSince(t time.Time, after string, limit int) ([]string, error)
+
+	// Tombstone deletes the key with the given fingerprint, and records it
+	// so that it is not added again.
+	//
+	// Like Delete, KeyRemoved is notified so that the key's digest leaves
+	// the reconciliation prefix tree. Peers that still have the key will
+	// offer it back, and UpsertKey refuses it with ErrKeyTombstoned.
+	Tombstone(fp string) error
+
+	// Tombstoned returns whether the key with the given RFingerprint has
+	// been tombstoned.
+	Tombstoned(rfp string) (bool, error)
+}
+
+// RetentionPolicy selects stale keys for removal.
+type RetentionPolicy struct {
+	// Keys which have been revoked or expired for at least this long...
+	InactiveFor time.Duration
+	// ...and have not been fetched for at least this long are removed.
+	UnusedFor time.Duration
+	// Clock provides the current time. If nil, SystemClock is used.
+	Clock Clock
+}
+
+const retentionBatchSize = 1000
+
+// ApplyRetention tombstones all keys in storage selected by the policy,
+// returning the number of keys removed.
+func ApplyRetention(st Storage, policy RetentionPolicy) (int, error) {
+	r, ok := st.(Retainer)
+	if !ok {
+		return 0, errors.New("storage does not support retention")
+	}
+	clock := policy.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+	var n int
+	var after string
+	for {
+		rfps, err := r.NotAccessedSince(now.Add(-policy.UnusedFor), after, retentionBatchSize)
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		if len(rfps) == 0 {
+			return n, nil
+		}
+		after = rfps[len(rfps)-1]
+		keys, err := st.FetchKeys(rfps)
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		for _, key := range keys {
+			since, ok := openpgp.InactiveSince(key)
+			if !ok || now.Sub(since) < policy.InactiveFor {
+				continue
+			}
+			err = r.Tombstone(key.Fingerprint())
+			if err != nil {
+				return n, errors.WithStack(err)
+			}
+			n++
+		}
+	}
+}
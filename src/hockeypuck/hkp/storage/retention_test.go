@@ -0,0 +1,146 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+type RetentionSuite struct{}
+
+var _ = gc.Suite(&RetentionSuite{})
+
+func (*RetentionSuite) TestApplyRetention(c *gc.C) {
+	alice := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	expired := openpgp.MustReadArmorKeys(testing.MustInput("test-key.asc"))[0]
+	keys := map[string]*openpgp.PrimaryKey{
+		alice.RFingerprint:   alice,
+		expired.RFingerprint: expired,
+	}
+
+	var tombstoned []string
+	st := mock.NewStorage(
+		mock.NotAccessedSince(func(t time.Time, after string, limit int) ([]string, error) {
+			if after != "" {
+				return nil, nil
+			}
+			return []string{alice.RFingerprint, expired.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			var result []*openpgp.PrimaryKey
+			for _, rfp := range rfps {
+				result = append(result, keys[rfp])
+			}
+			return result, nil
+		}),
+		mock.Tombstone(func(fp string) error {
+			tombstoned = append(tombstoned, fp)
+			return nil
+		}),
+	)
+	n, err := storage.ApplyRetention(st, storage.RetentionPolicy{
+		InactiveFor: 24 * time.Hour,
+		UnusedFor:   24 * time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(tombstoned, gc.DeepEquals, []string{expired.Fingerprint()})
+	c.Assert(st.MethodCount("NotAccessedSince"), gc.Equals, 2)
+}
+
+func (*RetentionSuite) TestApplyRetentionClock(c *gc.C) {
+	// test-key.asc expires at 2023-01-23 13:22:53 UTC.
+	expired := openpgp.MustReadArmorKeys(testing.MustInput("test-key.asc"))[0]
+	clock := mock.NewClock(time.Date(2023, time.January, 24, 0, 0, 0, 0, time.UTC))
+
+	var since []time.Time
+	var tombstoned []string
+	st := mock.NewStorage(
+		mock.NotAccessedSince(func(t time.Time, after string, limit int) ([]string, error) {
+			since = append(since, t)
+			if after != "" {
+				return nil, nil
+			}
+			return []string{expired.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{expired}, nil
+		}),
+		mock.Tombstone(func(fp string) error {
+			tombstoned = append(tombstoned, fp)
+			return nil
+		}),
+	)
+	policy := storage.RetentionPolicy{
+		InactiveFor: 24 * time.Hour,
+		UnusedFor:   7 * 24 * time.Hour,
+		Clock:       clock,
+	}
+
+	// Expired for less than a day.
+	n, err := storage.ApplyRetention(st, policy)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(since[0], gc.Equals, clock.Now().Add(-policy.UnusedFor))
+
+	clock.Advance(24 * time.Hour)
+	n, err = storage.ApplyRetention(st, policy)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(tombstoned, gc.DeepEquals, []string{expired.Fingerprint()})
+}
+
+func (*RetentionSuite) TestUpsertTombstoned(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) { return nil, nil }),
+		mock.Tombstoned(func(string) (bool, error) { return true, nil }),
+	)
+	_, err := storage.UpsertKey(st, key)
+	c.Assert(storage.IsTombstoned(err), gc.Equals, true)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (*RetentionSuite) TestAccessTracker(c *gc.C) {
+	var batches [][]string
+	st := mock.NewStorage(mock.Accessed(func(rfps []string) error {
+		batches = append(batches, append([]string(nil), rfps...))
+		return nil
+	}))
+	t := storage.NewAccessTracker(st, 2, time.Hour)
+	t.Record([]string{"c", "a"})
+	t.Record([]string{"a", "b"})
+	c.Assert(t.Pending(), gc.DeepEquals, map[string]int{"a": 2, "b": 1, "c": 1})
+	c.Assert(st.MethodCount("Accessed"), gc.Equals, 0)
+
+	c.Assert(t.Flush(), gc.IsNil)
+	c.Assert(batches, gc.DeepEquals, [][]string{{"a", "b"}, {"c"}})
+	c.Assert(t.Pending(), gc.HasLen, 0)
+
+	t.Start()
+	t.Record([]string{"d"})
+	c.Assert(t.Stop(), gc.IsNil)
+	c.Assert(batches[len(batches)-1], gc.DeepEquals, []string{"d"})
+}
@@ -0,0 +1,145 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// SearchProvider is an external search index, used for keyword searches in
+// place of the storage backend's own MatchKeyword.
+type SearchProvider interface {
+	// Index adds keys to the search index, or updates them if present.
+	Index(keys []*openpgp.PrimaryKey) error
+
+	// RemoveDigests removes the keys with the given digests from the search
+	// index.
+	RemoveDigests(digests []string) error
+
+	// Search returns up to limit RFingerprints of keys matching the query,
+	// most relevant first.
+	Search(query string, limit int) ([]string, error)
+}
+
+const searchFeedQueueLen = 1000
+
+// SearchFeeder keeps a SearchProvider up to date with the keys in storage,
+// following key change notifications in the background.
+type SearchFeeder struct {
+	st Storage
+	sp SearchProvider
+
+	listener ListenerID
+	changes  chan KeyChange
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSearchFeeder returns a SearchFeeder updating sp with changes to st.
+// Changes are only followed once the feeder is started.
+func NewSearchFeeder(st Storage, sp SearchProvider) *SearchFeeder {
+	return &SearchFeeder{
+		st:      st,
+		sp:      sp,
+		changes: make(chan KeyChange, searchFeedQueueLen),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Notify queues a key change to be applied to the search index. It does not
+// wait for the index to be updated, so that storage is not held up by the
+// search provider. Changes are dropped if the queue is full; the index can be
+// rebuilt with a storage RenotifyAll.
+func (f *SearchFeeder) Notify(kc KeyChange) error {
+	select {
+	case <-f.stop:
+	case f.changes <- kc:
+	default:
+		log.Warningf("search index queue full, dropped: %v", kc)
+	}
+	return nil
+}
+
+// Start subscribes to key changes in storage, and applies them to the search
+// index in the background until Stop is called.
+func (f *SearchFeeder) Start() {
+	f.listener = f.st.Subscribe(f.Notify)
+	go func() {
+		defer close(f.done)
+		for {
+			select {
+			case <-f.stop:
+				// Changes already queued are applied before stopping.
+				for {
+					select {
+					case kc := <-f.changes:
+						f.applyLogged(kc)
+					default:
+						return
+					}
+				}
+			case kc := <-f.changes:
+				f.applyLogged(kc)
+			}
+		}
+	}()
+}
+
+// Stop stops updating the search index, once the changes already queued
+// have been applied.
+func (f *SearchFeeder) Stop() {
+	f.st.Unsubscribe(f.listener)
+	close(f.stop)
+	<-f.done
+}
+
+func (f *SearchFeeder) applyLogged(kc KeyChange) {
+	err := f.apply(kc)
+	if err != nil {
+		log.Warningf("failed to update search index: %v", err)
+	}
+}
+
+func (f *SearchFeeder) apply(kc KeyChange) error {
+	if digests := kc.RemoveDigests(); len(digests) > 0 {
+		err := f.sp.RemoveDigests(digests)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	digests := kc.InsertDigests()
+	if len(digests) == 0 {
+		return nil
+	}
+	rfps, err := f.st.MatchMD5(digests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	keys, err := f.st.FetchKeys(rfps)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return errors.WithStack(f.sp.Index(keys))
+}
@@ -0,0 +1,97 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// KeyState marks a stored key for special treatment by lookups, usually
+// as the outcome of moderation.
+type KeyState string
+
+const (
+	// KeyStateNormal is the state of keys which have not been marked.
+	KeyStateNormal KeyState = ""
+	// KeyStateHidden keys are found by key ID or fingerprint, but not by
+	// keyword searches.
+	KeyStateHidden KeyState = "hidden"
+	// KeyStateSpam keys are user ID spam. Like hidden keys, they are not
+	// found by keyword searches.
+	KeyStateSpam KeyState = "spam"
+	// KeyStateQuarantined keys are withheld from all lookups while they are
+	// reviewed. Updates to them are refused as if they were tombstoned,
+	// although their owner may replace them.
+	KeyStateQuarantined KeyState = "quarantined"
+	// KeyStateBanned keys are withheld from all lookups, and may not be
+	// restored even by their owner.
+	KeyStateBanned KeyState = "banned"
+)
+
+var keyStates = map[KeyState]bool{
+	KeyStateNormal:      true,
+	KeyStateHidden:      true,
+	KeyStateSpam:        true,
+	KeyStateQuarantined: true,
+	KeyStateBanned:      true,
+}
+
+// ParseKeyState returns the KeyState with the given name, which is empty
+// or "normal" for KeyStateNormal.
+func ParseKeyState(s string) (KeyState, error) {
+	if s == "normal" {
+		return KeyStateNormal, nil
+	}
+	if !keyStates[KeyState(s)] {
+		return "", errors.Errorf("invalid key state %q", s)
+	}
+	return KeyState(s), nil
+}
+
+func (s KeyState) String() string {
+	if s == KeyStateNormal {
+		return "normal"
+	}
+	return string(s)
+}
+
+// Served returns whether keys in the state are returned by lookups.
+func (s KeyState) Served() bool {
+	return s != KeyStateQuarantined && s != KeyStateBanned
+}
+
+// Searchable returns whether keys in the state are found by keyword
+// searches.
+func (s KeyState) Searchable() bool {
+	return s == KeyStateNormal
+}
+
+// KeyStateStore is implemented by storage backends which can mark keys with
+// a KeyState. Resolve, MatchKeyword and FetchKeys apply the state of keys.
+type KeyStateStore interface {
+	// SetKeyState sets the state of the key with the given RFingerprint.
+	SetKeyState(rfp string, state KeyState) error
+
+	// KeyState returns the state of the key with the given RFingerprint,
+	// whether or not it is served.
+	KeyState(rfp string) (KeyState, error)
+
+	// KeysInState returns up to limit RFingerprints of keys in the given
+	// state, in RFingerprint order after the given RFingerprint.
+	KeysInState(state KeyState, after string, limit int) ([]string, error)
+}
@@ -0,0 +1,59 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+type KeyStateSuite struct{}
+
+var _ = gc.Suite(&KeyStateSuite{})
+
+func (*KeyStateSuite) TestParseKeyState(c *gc.C) {
+	for _, s := range []string{"", "normal"} {
+		state, err := storage.ParseKeyState(s)
+		c.Assert(err, gc.IsNil)
+		c.Assert(state, gc.Equals, storage.KeyStateNormal)
+	}
+	state, err := storage.ParseKeyState("quarantined")
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, gc.Equals, storage.KeyStateQuarantined)
+	c.Assert(state.String(), gc.Equals, "quarantined")
+	_, err = storage.ParseKeyState("deleted")
+	c.Assert(err, gc.ErrorMatches, `invalid key state "deleted"`)
+}
+
+func (*KeyStateSuite) TestKeyStateLookups(c *gc.C) {
+	for _, t := range []struct {
+		state      storage.KeyState
+		served     bool
+		searchable bool
+	}{
+		{storage.KeyStateNormal, true, true},
+		{storage.KeyStateHidden, true, false},
+		{storage.KeyStateSpam, true, false},
+		{storage.KeyStateQuarantined, false, false},
+		{storage.KeyStateBanned, false, false},
+	} {
+		c.Assert(t.state.Served(), gc.Equals, t.served, gc.Commentf("%s", t.state))
+		c.Assert(t.state.Searchable(), gc.Equals, t.searchable, gc.Commentf("%s", t.state))
+	}
+}
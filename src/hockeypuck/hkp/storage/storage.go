@@ -20,6 +20,9 @@ package storage
 import (
 	"fmt"
 	"io"
+	"net"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -33,6 +36,38 @@ func IsNotFound(err error) bool {
 	return errors.Is(err, ErrKeyNotFound)
 }
 
+// ErrKeyPinned is returned when an unauthenticated update would change the
+// stored contents of a pinned key.
+var ErrKeyPinned = fmt.Errorf("key is pinned")
+
+func IsPinned(err error) bool {
+	return errors.Is(err, ErrKeyPinned)
+}
+
+// ErrUpdateConflict is returned by Update when the stored key no longer has
+// the digest it was merged with, because it was changed concurrently.
+var ErrUpdateConflict = fmt.Errorf("key changed concurrently")
+
+func IsUpdateConflict(err error) bool {
+	return errors.Is(err, ErrUpdateConflict)
+}
+
+// maxUpdateConflicts is the number of times a key update is merged again
+// after a concurrent change, before the conflict is returned.
+const maxUpdateConflicts = 3
+
+// RetryUpdateConflicts calls f, which fetches, merges and updates a key,
+// again if its update conflicts with a concurrent change, so that the
+// changes merged by neither are lost.
+func RetryUpdateConflicts(f func() (KeyChange, error)) (KeyChange, error) {
+	for attempt := 0; ; attempt++ {
+		kc, err := f()
+		if !IsUpdateConflict(err) || attempt == maxUpdateConflicts {
+			return kc, err
+		}
+	}
+}
+
 type Keyring struct {
 	*openpgp.PrimaryKey
 
@@ -59,7 +94,8 @@ type Queryer interface {
 
 	// Resolve returns the matching RFingerprint IDs for the given public key IDs.
 	// Key IDs are typically short (8 hex digits), long (16 digits) or full (40 digits).
-	// Matches are made against key IDs and subkey IDs.
+	// Matches are made against key IDs and subkey IDs. All keys matching each
+	// key ID are returned, in RFingerprint order.
 	Resolve([]string) ([]string, error)
 
 	// MatchKeyword returns the matching RFingerprint IDs for the given keyword search.
@@ -95,13 +131,142 @@ type Inserter interface {
 	Insert([]*openpgp.PrimaryKey) (int, int, error)
 }
 
+// KeywordMatch selects how the words of a keyword search are combined.
+type KeywordMatch string
+
+const (
+	// MatchAllWords matches keys with all of the words searched for, in any
+	// order. This is how MatchKeyword searches.
+	MatchAllWords KeywordMatch = "all"
+	// MatchAnyWord matches keys with any of the words searched for.
+	MatchAnyWord KeywordMatch = "any"
+	// MatchPhrase matches keys with a user ID containing the words searched
+	// for, adjacent and in order.
+	MatchPhrase KeywordMatch = "phrase"
+	// MatchSubstring matches keys with a user ID containing the search,
+	// ignoring case, such as part of a surname.
+	MatchSubstring KeywordMatch = "substring"
+	// MatchFuzzy matches keys with a user ID containing words similar to
+	// those searched for, such as a misspelled name.
+	MatchFuzzy KeywordMatch = "fuzzy"
+)
+
+// ErrKeywordMatchNotAvailable is returned by a KeywordMatcher which cannot
+// combine the words of a search as asked, such as by matching substrings
+// where no index supports it.
+var ErrKeywordMatchNotAvailable = errors.New("keyword match is not available")
+
+// ParseKeywordMatch returns the KeywordMatch named by s, which defaults to
+// MatchAllWords if empty.
+func ParseKeywordMatch(s string) (KeywordMatch, bool) {
+	switch m := KeywordMatch(strings.ToLower(s)); m {
+	case "":
+		return MatchAllWords, true
+	case MatchAllWords, MatchAnyWord, MatchPhrase, MatchSubstring, MatchFuzzy:
+		return m, true
+	}
+	return "", false
+}
+
+// ResultOrder selects the order in which the keys matching a search are
+// returned.
+type ResultOrder string
+
+const (
+	// OrderRelevance orders keys by how well they match a keyword search,
+	// most recently modified first among equal matches.
+	OrderRelevance ResultOrder = "relevance"
+	// OrderModified orders keys by when they were last modified, most
+	// recent first.
+	OrderModified ResultOrder = "mtime"
+	// OrderCreated orders keys by the creation time of their primary key,
+	// newest first.
+	OrderCreated ResultOrder = "created"
+)
+
+// ParseResultOrder returns the ResultOrder named by s, which defaults to
+// OrderRelevance if empty.
+func ParseResultOrder(s string) (ResultOrder, bool) {
+	switch o := ResultOrder(strings.ToLower(s)); o {
+	case "":
+		return OrderRelevance, true
+	case OrderRelevance, OrderModified, OrderCreated:
+		return o, true
+	}
+	return "", false
+}
+
+// KeywordMatcher is implemented by storage backends which can combine the
+// words of a keyword search other than as MatchKeyword does.
+type KeywordMatcher interface {
+	// MatchKeywords returns the matching RFingerprint IDs for each keyword
+	// search, combining its words as selected by match, in OrderRelevance
+	// if storage can rank them.
+	MatchKeywords(search []string, match KeywordMatch) ([]string, error)
+}
+
+// KeywordPager is implemented by storage backends which can page through
+// all the keys matching a keyword search, rather than only the first
+// matches returned by MatchKeyword.
+type KeywordPager interface {
+	// MatchKeywordPage returns up to limit of the RFingerprint IDs matching
+	// a keyword search, combining its words as selected by match, after
+	// skipping the first offset of them. Matches are in the given order,
+	// made stable so that successive pages do not overlap. The total number
+	// of matches is also returned.
+	MatchKeywordPage(search string, match KeywordMatch, order ResultOrder, limit, offset int) ([]string, int, error)
+}
+
+// ModTimeReader is implemented by storage backends which can read when keys
+// were last modified without fetching them.
+type ModTimeReader interface {
+	// ModTimes returns the time at which each of the keys with the given
+	// RFingerprint IDs was last modified, by RFingerprint.
+	ModTimes([]string) (map[string]time.Time, error)
+}
+
+// BulkLoader is implemented by storage backends which can defer the
+// maintenance of indexes while a large number of keys are inserted, such as
+// when loading a keydump.
+type BulkLoader interface {
+	// DeferIndexes drops indexes which are not needed to insert keys.
+	DeferIndexes() error
+
+	// RestoreIndexes recreates the indexes dropped by DeferIndexes.
+	RestoreIndexes() error
+}
+
+// PoolStats describes the use of a storage backend's pool of connections.
+type PoolStats struct {
+	// MaxConns is the limit on open connections, or zero if unlimited.
+	MaxConns int
+	// InUse is the number of connections in use.
+	InUse int
+}
+
+// Pooled is implemented by storage backends which hold a pool of
+// connections to a database server.
+type Pooled interface {
+	PoolStats() PoolStats
+}
+
+// Reencrypter is implemented by storage backends which encrypt the key
+// material they hold with EncryptionKeys.
+type Reencrypter interface {
+	// Reencrypt encrypts up to limit keys which are not encrypted with the
+	// current key, and returns the number encrypted. Keys are re-encrypted
+	// until none remain, so that a rotated key may be retired.
+	Reencrypt(limit int) (int, error)
+}
+
 // Updater defines the storage API for writing key material.
 type Updater interface {
 	Inserter
 
 	// Update updates the stored PrimaryKey with the given contents, if the current
 	// contents of the key in storage matches the given digest. If it does not
-	// match, the update should be retried again later.
+	// match, ErrUpdateConflict is returned and the update should be merged
+	// with the stored key again.
 	Update(pubkey *openpgp.PrimaryKey, priorID string, priorMD5 string) error
 
 	// Replace unconditionally replaces any existing Primary key with the given
@@ -111,22 +276,33 @@ type Updater interface {
 
 type Deleter interface {
 	// Delete unconditionally deletes any existing Primary key with the given
-	// fingerprint.
+	// fingerprint. Backends which implement Retainer may keep the deleted
+	// key, so that it is reported as tombstoned rather than added again.
 	Delete(fp string) (string, error)
 }
 
 type Notifier interface {
-	// Subscribe registers a key change callback function.
-	Subscribe(func(KeyChange) error)
+	// Subscribe registers a key change callback function, returning an ID
+	// with which it may be unsubscribed.
+	Subscribe(func(KeyChange) error) ListenerID
+
+	// Unsubscribe removes a key change callback function, returning false if
+	// it was not registered.
+	Unsubscribe(id ListenerID) bool
 
 	// Notify invokes all registered callbacks with a key change notification.
 	Notify(change KeyChange) error
 
+	// ListenerStats returns delivery counts for each registered callback.
+	ListenerStats() []ListenerStats
+
 	// RenotifyAll() invokes all registered callbacks with KeyAdded notifications
 	// for each key in the Storage.
 	RenotifyAll() error
 }
 
+// KeyChange is a change to stored keys, notified to listeners. The IDs of
+// the keys changed are their full fingerprints.
 type KeyChange interface {
 	InsertDigests() []string
 	RemoveDigests() []string
@@ -198,9 +374,26 @@ func (ka KeyRemoved) String() string {
 	return fmt.Sprintf("key 0x%s with hash %s removed", ka.ID, ka.Digest)
 }
 
+// ChangesMissed is notified when key changes may have been missed, such as
+// while the changes published by other servers sharing storage could not
+// be received. Listeners which maintain state from the changes notified
+// should rebuild it from storage.
+type ChangesMissed struct{}
+
+func (ChangesMissed) InsertDigests() []string { return nil }
+
+func (ChangesMissed) RemoveDigests() []string { return nil }
+
+func (ChangesMissed) String() string {
+	return "key changes missed"
+}
+
 type InsertError struct {
 	Duplicates []*openpgp.PrimaryKey
 	Errors     []error
+	// Failed are the keys which were not stored because of Errors, if the
+	// storage can tell which keys failed.
+	Failed []*openpgp.PrimaryKey
 }
 
 func (err InsertError) Error() string {
@@ -224,7 +417,157 @@ func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKe
 	return nil, ErrKeyNotFound
 }
 
-func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err error) {
+type upsertOptions struct {
+	pinned map[string]bool
+
+	// hostnames of this keyserver, when honoring preferred keyservers
+	hostnames map[string]bool
+
+	dryRun bool
+
+	check func(*openpgp.PrimaryKey) error
+
+	flooding *FloodPolicy
+
+	source string
+
+	clock Clock
+}
+
+// UpsertOption modifies how UpsertKey merges key material into storage.
+type UpsertOption func(*upsertOptions)
+
+// Pinned prevents UpsertKey from changing the stored version of any of the
+// given keys, identified by fingerprint. Pinned keys may still be added if
+// not already stored, and may be replaced or deleted by their owner.
+func Pinned(fps []string) UpsertOption {
+	return func(opts *upsertOptions) {
+		if opts.pinned == nil {
+			opts.pinned = map[string]bool{}
+		}
+		for _, fp := range fps {
+			opts.pinned[strings.ToLower(fp)] = true
+		}
+	}
+}
+
+// HonorPreferredKeyserver prevents UpsertKey from changing the stored version
+// of a key whose owner has designated a preferred keyserver other than this
+// one, known by the given hostnames. Such keys are treated as pinned.
+func HonorPreferredKeyserver(hostnames []string) UpsertOption {
+	return func(opts *upsertOptions) {
+		if opts.hostnames == nil {
+			opts.hostnames = map[string]bool{}
+		}
+		for _, hostname := range hostnames {
+			opts.hostnames[strings.ToLower(hostname)] = true
+		}
+	}
+}
+
+// keyserverHost returns the hostname of a preferred keyserver URI, which may
+// be given with or without a scheme and port.
+func keyserverHost(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		return strings.ToLower(u.Hostname())
+	}
+	host := strings.SplitN(uri, "/", 2)[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// maintainedElsewhere returns the preferred keyserver of key, if it is not
+// this keyserver.
+// DryRun makes UpsertKey determine the change it would make to storage,
+// including any refusal, without making it.
+func DryRun() UpsertOption {
+	return func(opts *upsertOptions) {
+		opts.dryRun = true
+	}
+}
+
+// Check makes UpsertKey call f with each key as it would be stored, after
+// merging it with any stored version, before storing it. The key is refused
+// if f returns an error. Keys which would not change are not checked.
+func Check(f func(*openpgp.PrimaryKey) error) UpsertOption {
+	return func(opts *upsertOptions) {
+		opts.check = f
+	}
+}
+
+// Classes of source recorded as the provenance of stored packets.
+const (
+	// ProvenanceDirect packets were submitted to this keyserver.
+	ProvenanceDirect = "direct"
+	// ProvenanceRecon packets were recovered from a recon partner.
+	ProvenanceRecon = "recon"
+	// ProvenancePush packets were pushed by a trusted keyserver.
+	ProvenancePush = "push"
+	// ProvenanceImport packets were loaded by the operator.
+	ProvenanceImport = "import"
+)
+
+// Provenance makes UpsertKey record the packets it adds to storage as first
+// seen now, from the given class of source.
+func Provenance(source string) UpsertOption {
+	return func(opts *upsertOptions) {
+		opts.source = source
+	}
+}
+
+// UpsertClock sets the clock used by UpsertKey and ReplaceKey to record
+// when packets were first seen.
+func UpsertClock(clock Clock) UpsertOption {
+	return func(opts *upsertOptions) {
+		opts.clock = clock
+	}
+}
+
+func (opts *upsertOptions) now() time.Time {
+	if opts.clock == nil {
+		return SystemClock.Now()
+	}
+	return opts.clock.Now()
+}
+
+func (opts *upsertOptions) maintainedElsewhere(key *openpgp.PrimaryKey) (string, bool) {
+	if len(opts.hostnames) == 0 {
+		return "", false
+	}
+	preferred := openpgp.PreferredKeyserver(key)
+	if preferred == "" || opts.hostnames[keyserverHost(preferred)] {
+		return "", false
+	}
+	return preferred, true
+}
+
+func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey, options ...UpsertOption) (KeyChange, error) {
+	var opts upsertOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	if opts.source != "" && !opts.dryRun {
+		openpgp.SetProvenance(pubkey, opts.source, opts.now())
+	}
+
+	return RetryUpdateConflicts(func() (KeyChange, error) {
+		return upsertKey(storage, pubkey, &opts)
+	})
+}
+
+func upsertKey(storage Storage, pubkey *openpgp.PrimaryKey, opts *upsertOptions) (kc KeyChange, err error) {
+	if b, ok := storage.(Blocker); ok {
+		blocked, err := b.IsBlocked(pubkey.Fingerprint())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if blocked {
+			return nil, errors.Wrapf(ErrKeyBlocked, "key 0x%s refused", pubkey.KeyID())
+		}
+	}
+
 	var lastKey *openpgp.PrimaryKey
 	lastKeys, err := storage.FetchKeys([]string{pubkey.RFingerprint})
 	if err == nil {
@@ -232,11 +575,37 @@ func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err e
 		lastKey, err = firstMatch(lastKeys, pubkey.RFingerprint)
 	}
 	if IsNotFound(err) {
-		_, _, err = storage.Insert([]*openpgp.PrimaryKey{pubkey})
+		if r, ok := storage.(Retainer); ok {
+			tombstoned, err := r.Tombstoned(pubkey.RFingerprint)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			} else if tombstoned {
+				return nil, errors.Wrapf(ErrKeyTombstoned, "key 0x%s refused", pubkey.KeyID())
+			}
+		}
+		quarantine, err := opts.flooding.apply(storage, pubkey)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		return KeyAdded{ID: pubkey.KeyID(), Digest: pubkey.MD5}, nil
+		if opts.check != nil {
+			err = opts.check(pubkey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !opts.dryRun {
+			_, _, err = storage.Insert([]*openpgp.PrimaryKey{pubkey})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if quarantine {
+				err = quarantineKey(storage, pubkey)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		}
+		return KeyAdded{ID: pubkey.Fingerprint(), Digest: pubkey.MD5}, nil
 	} else if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -244,31 +613,83 @@ func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err e
 	if pubkey.UUID != lastKey.UUID {
 		return nil, errors.Errorf("upsert key %q lookup failed, found mismatch %q", pubkey.UUID, lastKey.UUID)
 	}
-	lastID := lastKey.KeyID()
+	lastID := lastKey.Fingerprint()
 	lastMD5 := lastKey.MD5
+	preferred, elsewhere := opts.maintainedElsewhere(lastKey)
 	err = openpgp.Merge(lastKey, pubkey)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	if lastMD5 != lastKey.MD5 {
-		err = storage.Update(lastKey, lastID, lastMD5)
+		if opts.pinned[lastKey.Fingerprint()] {
+			return nil, errors.Wrapf(ErrKeyPinned, "update to key 0x%s refused", lastID)
+		} else if elsewhere {
+			return nil, errors.Wrapf(ErrKeyPinned, "update to key 0x%s refused, maintained at %q", lastID, preferred)
+		}
+		quarantine, err := opts.flooding.apply(storage, lastKey)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		return KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.KeyID(), NewDigest: lastKey.MD5}, nil
+		if lastMD5 == lastKey.MD5 {
+			// Only certifications dropped by the flooding policy were new.
+			return KeyNotChanged{ID: lastID, Digest: lastMD5}, nil
+		}
+		if opts.check != nil {
+			err = opts.check(lastKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !opts.dryRun {
+			err = storage.Update(lastKey, lastID, lastMD5)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if quarantine {
+				err = quarantineKey(storage, lastKey)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		}
+		return KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.Fingerprint(), NewDigest: lastKey.MD5}, nil
 	}
 	return KeyNotChanged{ID: lastID, Digest: lastMD5}, nil
 }
 
-func ReplaceKey(storage Storage, pubkey *openpgp.PrimaryKey) (KeyChange, error) {
+// ReplaceKey replaces the stored version of a key with pubkey. Of the
+// options, only Provenance applies: packets which were already stored keep
+// their provenance, and the rest are recorded as first seen now.
+func ReplaceKey(storage Storage, pubkey *openpgp.PrimaryKey, options ...UpsertOption) (KeyChange, error) {
+	var opts upsertOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.source != "" {
+		lastKeys, err := storage.FetchKeys([]string{pubkey.RFingerprint})
+		if err != nil && !IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		if lastKey, err := firstMatch(lastKeys, pubkey.RFingerprint); err == nil {
+			provenance := map[string]openpgp.Provenance{}
+			for _, pkt := range lastKey.Packets() {
+				provenance[string(pkt.Packet)] = pkt.Provenance
+			}
+			for _, pkt := range pubkey.Packets() {
+				pkt.Provenance = provenance[string(pkt.Packet)]
+			}
+		}
+		openpgp.SetProvenance(pubkey, opts.source, opts.now())
+	}
+
 	lastMD5, err := storage.Replace(pubkey)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	if lastMD5 != "" {
-		return KeyReplaced{OldID: pubkey.KeyID(), OldDigest: lastMD5, NewID: pubkey.KeyID(), NewDigest: pubkey.MD5}, nil
+		return KeyReplaced{OldID: pubkey.Fingerprint(), OldDigest: lastMD5, NewID: pubkey.Fingerprint(), NewDigest: pubkey.MD5}, nil
 	}
-	return KeyAdded{ID: pubkey.KeyID(), Digest: pubkey.MD5}, nil
+	return KeyAdded{ID: pubkey.Fingerprint(), Digest: pubkey.MD5}, nil
 }
 
 func DeleteKey(storage Storage, fp string) (KeyChange, error) {
@@ -278,3 +699,18 @@ func DeleteKey(storage Storage, fp string) (KeyChange, error) {
 	}
 	return KeyRemoved{ID: fp, Digest: lastMD5}, nil
 }
+
+// ReindexKey stores the key with the given fingerprint again as it is, so
+// that the documents and keywords storage derives from it are rebuilt.
+func ReindexKey(storage Storage, fp string) error {
+	rfp := openpgp.Reverse(fp)
+	keys, err := storage.FetchKeys([]string{rfp})
+	if err != nil && !IsNotFound(err) {
+		return errors.WithStack(err)
+	}
+	key, err := firstMatch(keys, rfp)
+	if err != nil {
+		return errors.Wrapf(err, "fp=%q", fp)
+	}
+	return errors.WithStack(storage.Update(key, key.Fingerprint(), key.MD5))
+}
@@ -0,0 +1,237 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type UpsertSuite struct{}
+
+var _ = gc.Suite(&UpsertSuite{})
+
+func (*UpsertSuite) TestHonorPreferredKeyserver(c *gc.C) {
+	st := mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return openpgp.MustReadArmorKeys(testing.MustInput("carol_prefks.asc")), nil
+	}))
+	update := openpgp.MustReadArmorKeys(testing.MustInput("carol_prefks_uid.asc"))[0]
+
+	_, err := storage.UpsertKey(st, update, storage.HonorPreferredKeyserver([]string{"other.example.com"}))
+	c.Assert(storage.IsPinned(err), gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(st.MethodCount("Update"), gc.Equals, 0)
+
+	for _, hostname := range []string{"keys.example.com", "KEYS.example.com"} {
+		kc, err := storage.UpsertKey(st, update, storage.HonorPreferredKeyserver([]string{hostname}))
+		c.Assert(err, gc.IsNil)
+		c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	}
+
+	kc, err := storage.UpsertKey(st, update)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(st.MethodCount("Update"), gc.Equals, 3)
+}
+
+func (*UpsertSuite) TestCheck(c *gc.C) {
+	st := mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return openpgp.MustReadArmorKeys(testing.MustInput("carol_prefks.asc")), nil
+	}))
+	update := openpgp.MustReadArmorKeys(testing.MustInput("carol_prefks_uid.asc"))[0]
+
+	var checked *openpgp.PrimaryKey
+	refuse := errors.New("refused")
+	_, err := storage.UpsertKey(st, update, storage.Check(func(key *openpgp.PrimaryKey) error {
+		checked = key
+		return refuse
+	}))
+	c.Assert(err, gc.Equals, refuse)
+	c.Assert(st.MethodCount("Update"), gc.Equals, 0)
+	// The merged key is checked.
+	c.Assert(checked, gc.NotNil)
+	c.Assert(len(checked.UserIDs) > 1, gc.Equals, true)
+
+	kc, err := storage.UpsertKey(st, update, storage.Check(func(*openpgp.PrimaryKey) error { return nil }))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(st.MethodCount("Update"), gc.Equals, 1)
+}
+
+func (*UpsertSuite) TestUpdateConflict(c *gc.C) {
+	var conflicts int
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")), nil
+		}),
+		mock.Update(func(*openpgp.PrimaryKey, string, string) error {
+			if conflicts > 0 {
+				conflicts--
+				return errors.WithStack(storage.ErrUpdateConflict)
+			}
+			return nil
+		}),
+	)
+	update := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+
+	// The key is fetched and merged again after a concurrent change.
+	conflicts = 1
+	kc, err := storage.UpsertKey(st, update)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 2)
+	c.Assert(st.MethodCount("Update"), gc.Equals, 2)
+
+	// Persistent conflicts are returned.
+	conflicts = 100
+	_, err = storage.UpsertKey(st, update)
+	c.Assert(storage.IsUpdateConflict(err), gc.Equals, true, gc.Commentf("%v", err))
+}
+
+func (*UpsertSuite) TestProvenance(c *gc.C) {
+	stored := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	openpgp.SetProvenance(stored, storage.ProvenanceImport, seen)
+	nstored := len(stored.Packets())
+	var updated *openpgp.PrimaryKey
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{stored}, nil
+		}),
+		mock.Update(func(key *openpgp.PrimaryKey, _, _ string) error {
+			updated = key
+			return nil
+		}),
+	)
+	update := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	_, err := storage.UpsertKey(st, update, storage.Provenance(storage.ProvenanceRecon))
+	c.Assert(err, gc.IsNil)
+	c.Assert(updated, gc.NotNil)
+	sources := map[string]int{}
+	for _, pkt := range updated.Packets() {
+		sources[pkt.Provenance.Source]++
+	}
+	c.Assert(sources, gc.DeepEquals, map[string]int{
+		storage.ProvenanceImport: nstored,
+		storage.ProvenanceRecon:  1,
+	})
+}
+
+func (*UpsertSuite) TestValidateMetadata(c *gc.C) {
+	c.Assert(storage.ValidateMetadata("hr/employee-id", "1234"), gc.IsNil)
+	c.Assert(storage.ValidateMetadata("hr/employee-id", ""), gc.IsNil)
+	c.Assert(storage.ValidateMetadata("employee-id", "1234"), gc.NotNil)
+	c.Assert(storage.ValidateMetadata("HR/Employee", "1234"), gc.NotNil)
+	c.Assert(storage.ValidateMetadata("hr/employee/id", "1234"), gc.NotNil)
+	c.Assert(storage.ValidateMetadata("hr/employee-id", strings.Repeat("x", 5000)), gc.NotNil)
+	c.Assert(storage.MetadataNamespace("hr/employee-id"), gc.Equals, "hr")
+}
+
+func (*UpsertSuite) TestBlocked(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	var blocked []string
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")), nil
+		}),
+		mock.IsBlocked(func(fp string) (bool, error) {
+			blocked = append(blocked, fp)
+			return true, nil
+		}),
+	)
+	_, err := storage.UpsertKey(st, key)
+	c.Assert(storage.IsBlocked(err), gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(blocked, gc.DeepEquals, []string{key.Fingerprint()})
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 0)
+	c.Assert(st.MethodCount("Update"), gc.Equals, 0)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (*UpsertSuite) TestFlooding(c *gc.C) {
+	// weasel.asc has user IDs with hundreds of third-party certifications.
+	const mostCerts = 588
+	upsert := func(policy storage.FloodPolicy) (*openpgp.PrimaryKey, *mock.Storage, []storage.KeyState) {
+		key := openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0]
+		c.Assert(openpgp.MostCertifications(key), gc.Equals, mostCerts)
+		var inserted *openpgp.PrimaryKey
+		var states []storage.KeyState
+		st := mock.NewStorage(
+			mock.Insert(func(keys []*openpgp.PrimaryKey) (int, int, error) {
+				inserted = keys[0]
+				return 1, 0, nil
+			}),
+			mock.SetKeyState(func(rfp string, state storage.KeyState) error {
+				c.Check(rfp, gc.Equals, key.RFingerprint)
+				states = append(states, state)
+				return nil
+			}),
+		)
+		_, err := storage.UpsertKey(st, key, storage.Flooding(policy))
+		c.Assert(err, gc.IsNil)
+		c.Assert(inserted, gc.NotNil)
+		return inserted, st, states
+	}
+
+	key, _, states := upsert(storage.FloodPolicy{Threshold: mostCerts, Action: storage.FloodCap})
+	c.Assert(openpgp.MostCertifications(key), gc.Equals, mostCerts)
+	c.Assert(states, gc.HasLen, 0)
+
+	key, _, states = upsert(storage.FloodPolicy{Threshold: 100, Action: storage.FloodCap})
+	c.Assert(openpgp.MostCertifications(key), gc.Equals, 100)
+	c.Assert(states, gc.HasLen, 0)
+
+	key, _, _ = upsert(storage.FloodPolicy{Threshold: 100, Action: storage.FloodCap, MaxCertifications: 10})
+	c.Assert(openpgp.MostCertifications(key), gc.Equals, 10)
+
+	// None of the signers are in storage, so none of the certifications
+	// can be verified.
+	key, st, states := upsert(storage.FloodPolicy{Threshold: 100, Action: storage.FloodStrip})
+	c.Assert(openpgp.MostCertifications(key), gc.Equals, 0)
+	c.Assert(st.MethodCount("Resolve") > 1, gc.Equals, true)
+	c.Assert(states, gc.HasLen, 0)
+
+	key, _, states = upsert(storage.FloodPolicy{Threshold: 100, Action: storage.FloodQuarantine})
+	c.Assert(openpgp.MostCertifications(key), gc.Equals, mostCerts)
+	c.Assert(states, gc.DeepEquals, []storage.KeyState{storage.KeyStateQuarantined})
+
+	// Certifications dropped by the policy do not change the stored key.
+	stored := openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0]
+	_, err := openpgp.TruncateCertifications(stored, 100)
+	c.Assert(err, gc.IsNil)
+	st = mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return []*openpgp.PrimaryKey{stored}, nil
+	}))
+	kc, err := storage.UpsertKey(st, openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0],
+		storage.Flooding(storage.FloodPolicy{Threshold: 100, Action: storage.FloodCap}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyNotChanged{})
+	c.Assert(st.MethodCount("Update"), gc.Equals, 0)
+
+	_, err = storage.ParseFloodAction("delete")
+	c.Assert(err, gc.ErrorMatches, `invalid flood action "delete"`)
+}
@@ -0,0 +1,399 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	DefaultTokenTTL             = 24 * time.Hour
+	DefaultTokenRateWindow      = time.Hour
+	DefaultTokenMaxPerAddress   = 3
+	DefaultTokenMaxPerSource    = 20
+	DefaultTokenCleanupInterval = 10 * time.Minute
+
+	// MinTokenSecretLen is the minimum length of the secret key with which
+	// tokens are signed.
+	MinTokenSecretLen = 32
+)
+
+// TokenAction is the operation a token authorizes.
+type TokenAction string
+
+const (
+	// TokenVerify authorizes marking an address as verified on a key.
+	TokenVerify TokenAction = "verify"
+	// TokenUnpublish authorizes withdrawing an address from a key.
+	TokenUnpublish TokenAction = "unpublish"
+	// TokenUpload identifies a key submitted by a client, which may then
+	// request verification of the addresses on it.
+	TokenUpload TokenAction = "upload"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenUsed    = errors.New("token already used")
+	ErrRateLimited  = errors.New("too many tokens requested")
+)
+
+// IssuedToken records a token which has been issued and not yet redeemed.
+type IssuedToken struct {
+	ID string
+	// Address is the lower-cased email address the token was sent to.
+	Address string
+	// Source identifies the client which requested the token. It is a keyed
+	// hash of the client address rather than the address itself.
+	Source  string
+	Issued  time.Time
+	Expires time.Time
+}
+
+// TokenStore is implemented by storage backends which record issued
+// verification tokens.
+type TokenStore interface {
+	// InsertToken records an issued token.
+	InsertToken(t IssuedToken) error
+
+	// CountTokens returns the number of tokens issued at or after since to
+	// address, and to source.
+	CountTokens(address, source string, since time.Time) (byAddress, bySource int, err error)
+
+	// ConsumeToken marks the token with the given ID as used, returning
+	// false if there is no such token, it was already used, or it expired
+	// before now. It is safe to call concurrently; a token is consumed at
+	// most once. Used tokens are still counted by CountTokens.
+	ConsumeToken(id string, now time.Time) (bool, error)
+
+	// ExpireTokens removes tokens which expired before the given time,
+	// returning the number removed. Used tokens are treated as having
+	// expired when they were issued.
+	ExpireTokens(before time.Time) (int, error)
+}
+
+// TokenClaims are the contents of a token. A token is only valid for the
+// action, address and key it was issued for.
+type TokenClaims struct {
+	ID          string      `json:"id"`
+	Action      TokenAction `json:"action"`
+	Address     string      `json:"address"`
+	Fingerprint string      `json:"fingerprint"`
+	Expires     int64       `json:"expires"`
+}
+
+// Tokens issues and redeems single-use tokens proving control of an email
+// address. Tokens are signed with a secret key, so that they cannot be
+// forged, and recorded in storage when issued, so that each can be redeemed
+// only once. The number of tokens issued to an address or client is limited,
+// so that requesting tokens cannot be used to flood a mailbox.
+type Tokens struct {
+	ts     TokenStore
+	secret []byte
+
+	ttl           time.Duration
+	window        time.Duration
+	maxPerAddress int
+	maxPerSource  int
+	clean         time.Duration
+	clock         Clock
+	ids           IDGenerator
+
+	issueMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// TokenOption configures Tokens.
+type TokenOption func(*Tokens)
+
+// TokenTTL sets how long tokens remain valid after they are issued.
+func TokenTTL(d time.Duration) TokenOption {
+	return func(t *Tokens) {
+		if d > 0 {
+			t.ttl = d
+		}
+	}
+}
+
+// TokenRateLimit limits the tokens issued within each window to
+// perAddress for each address, and perSource for each client. A limit
+// less than or equal to zero leaves the default.
+func TokenRateLimit(window time.Duration, perAddress, perSource int) TokenOption {
+	return func(t *Tokens) {
+		if window > 0 {
+			t.window = window
+		}
+		if perAddress > 0 {
+			t.maxPerAddress = perAddress
+		}
+		if perSource > 0 {
+			t.maxPerSource = perSource
+		}
+	}
+}
+
+// TokenCleanupInterval sets how often expired tokens are removed from
+// storage.
+func TokenCleanupInterval(d time.Duration) TokenOption {
+	return func(t *Tokens) {
+		if d > 0 {
+			t.clean = d
+		}
+	}
+}
+
+// TokenClock sets the clock used to obtain the current time.
+func TokenClock(clock Clock) TokenOption {
+	return func(t *Tokens) { t.clock = clock }
+}
+
+// TokenIDs sets the generator of token IDs.
+func TokenIDs(ids IDGenerator) TokenOption {
+	return func(t *Tokens) { t.ids = ids }
+}
+
+// NewTokens returns Tokens signed with secret and recorded in ts.
+func NewTokens(ts TokenStore, secret []byte, options ...TokenOption) (*Tokens, error) {
+	if len(secret) < MinTokenSecretLen {
+		return nil, errors.Errorf("token secret must be at least %d bytes", MinTokenSecretLen)
+	}
+	t := &Tokens{
+		ts:            ts,
+		secret:        append([]byte(nil), secret...),
+		ttl:           DefaultTokenTTL,
+		window:        DefaultTokenRateWindow,
+		maxPerAddress: DefaultTokenMaxPerAddress,
+		maxPerSource:  DefaultTokenMaxPerSource,
+		clean:         DefaultTokenCleanupInterval,
+		clock:         SystemClock,
+		ids:           RandomIDs,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, o := range options {
+		o(t)
+	}
+	return t, nil
+}
+
+func (t *Tokens) mac(purpose string, data []byte) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// sourceIPv6PrefixLen is the length of the prefix by which IPv6 clients are
+// counted, as a client is usually given a whole /64.
+const sourceIPv6PrefixLen = 64
+
+// source returns the pseudonym under which tokens issued to the client at
+// remoteAddr are counted. The port of the address, which changes with each
+// connection, is ignored, and IPv6 clients are counted by their /64 prefix.
+func (t *Tokens) source(remoteAddr string) string {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			host = ip4.String()
+		} else {
+			host = ip.Mask(net.CIDRMask(sourceIPv6PrefixLen, 8*net.IPv6len)).String()
+		}
+	}
+	return hex.EncodeToString(t.mac("source", []byte(host)))[:32]
+}
+
+// Issue returns a token authorizing action on address in a user ID of the
+// key with the given fingerprint, requested by the client at remoteAddr,
+// which may include a port.
+// It returns ErrRateLimited if too many tokens have recently been issued to
+// the address or client.
+func (t *Tokens) Issue(action TokenAction, address, fingerprint, remoteAddr string) (string, error) {
+	address = strings.ToLower(address)
+	if address == "" || fingerprint == "" {
+		return "", errors.New("token requires an address and fingerprint")
+	}
+	id, err := t.ids.NewID()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	now := t.clock.Now()
+	issued := IssuedToken{
+		ID:      id,
+		Address: address,
+		Source:  t.source(remoteAddr),
+		Issued:  now,
+		Expires: now.Add(t.ttl),
+	}
+
+	// Serialize issuance, so that concurrent requests cannot each pass the
+	// rate limit before any is recorded.
+	t.issueMu.Lock()
+	defer t.issueMu.Unlock()
+	byAddress, bySource, err := t.ts.CountTokens(issued.Address, issued.Source, now.Add(-t.window))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if byAddress >= t.maxPerAddress || bySource >= t.maxPerSource {
+		return "", errors.WithStack(ErrRateLimited)
+	}
+	err = t.ts.InsertToken(issued)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return t.sign(&TokenClaims{
+		ID:          issued.ID,
+		Action:      action,
+		Address:     address,
+		Fingerprint: strings.ToLower(fingerprint),
+		Expires:     issued.Expires.Unix(),
+	})
+}
+
+// UploadToken returns a token identifying the key with the given
+// fingerprint to the client which submitted it. Unlike the tokens returned
+// by Issue, upload tokens are not recorded in storage, and may be used
+// repeatedly until they expire.
+func (t *Tokens) UploadToken(fingerprint string) (string, error) {
+	if fingerprint == "" {
+		return "", errors.New("token requires a fingerprint")
+	}
+	return t.sign(&TokenClaims{
+		Action:      TokenUpload,
+		Fingerprint: strings.ToLower(fingerprint),
+		Expires:     t.clock.Now().Add(t.ttl).Unix(),
+	})
+}
+
+// CheckUploadToken returns the fingerprint of the key identified by an
+// upload token issued by t.
+func (t *Tokens) CheckUploadToken(token string) (string, error) {
+	claims, err := t.parse(token, TokenUpload)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return claims.Fingerprint, nil
+}
+
+func (t *Tokens) sign(claims *TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(t.mac("token", payload)), nil
+}
+
+// parse returns the claims of a token signed by t for action, if it has not
+// expired.
+func (t *Tokens) parse(token string, action TokenAction) (*TokenClaims, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.WithStack(ErrInvalidToken)
+	}
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.WithStack(ErrInvalidToken)
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, t.mac("token", payload)) {
+		return nil, errors.WithStack(ErrInvalidToken)
+	}
+	var claims TokenClaims
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&claims)
+	if err != nil || claims.Action != action {
+		return nil, errors.WithStack(ErrInvalidToken)
+	}
+	if !t.clock.Now().Before(time.Unix(claims.Expires, 0)) {
+		return nil, errors.WithStack(ErrTokenExpired)
+	}
+	return &claims, nil
+}
+
+// Redeem checks that token was issued by t for action, and consumes it so
+// that it cannot be redeemed again.
+func (t *Tokens) Redeem(token string, action TokenAction) (*TokenClaims, error) {
+	claims, err := t.parse(token, action)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ok, err := t.ts.ConsumeToken(claims.ID, t.clock.Now())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !ok {
+		return nil, errors.WithStack(ErrTokenUsed)
+	}
+	return claims, nil
+}
+
+// Start removes expired tokens from storage in the background until Stop is
+// called.
+func (t *Tokens) Start() {
+	go t.run()
+}
+
+func (t *Tokens) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.clean)
+	defer ticker.Stop()
+	for {
+		// Tokens are kept for the rate limit window after they are used or
+		// expire, so that they are still counted.
+		n, err := t.ts.ExpireTokens(t.clock.Now().Add(-t.window))
+		if err != nil {
+			log.Warningf("failed to remove expired tokens: %v", err)
+		} else if n > 0 {
+			log.Debugf("removed %d expired tokens", n)
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops removing expired tokens, waiting for removal in progress to
+// finish.
+func (t *Tokens) Stop() {
+	close(t.stop)
+	<-t.done
+}
@@ -0,0 +1,267 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+// memTokens is a TokenStore held in memory.
+type memTokens struct {
+	mu     sync.Mutex
+	tokens map[string]storage.IssuedToken
+}
+
+func (m *memTokens) InsertToken(t storage.IssuedToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.ID] = t
+	return nil
+}
+
+func (m *memTokens) CountTokens(address, source string, since time.Time) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var byAddress, bySource int
+	for _, t := range m.tokens {
+		if t.Issued.Before(since) {
+			continue
+		}
+		if t.Address == address {
+			byAddress++
+		}
+		if t.Source == source {
+			bySource++
+		}
+	}
+	return byAddress, bySource, nil
+}
+
+func (m *memTokens) ConsumeToken(id string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || !t.Expires.After(now) {
+		return false, nil
+	}
+	t.Expires = t.Issued
+	m.tokens[id] = t
+	return true, nil
+}
+
+func (m *memTokens) ExpireTokens(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, t := range m.tokens {
+		if t.Expires.Before(before) {
+			delete(m.tokens, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type TokensSuite struct {
+	store  *memTokens
+	now    time.Time
+	tokens *storage.Tokens
+}
+
+var _ = gc.Suite(&TokensSuite{})
+
+const testFP = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+
+func (s *TokensSuite) SetUpTest(c *gc.C) {
+	s.store = &memTokens{tokens: map[string]storage.IssuedToken{}}
+	s.now = time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	var err error
+	s.tokens, err = storage.NewTokens(s.store, bytes.Repeat([]byte("k"), 32),
+		storage.TokenTTL(time.Hour),
+		storage.TokenRateLimit(time.Hour, 2, 3),
+		storage.TokenClock(storage.ClockFunc(func() time.Time { return s.now })))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *TokensSuite) TestRedeem(c *gc.C) {
+	token, err := s.tokens.Issue(storage.TokenVerify, "Alice@Example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+
+	claims, err := s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(err, gc.IsNil)
+	c.Assert(claims.Address, gc.Equals, "alice@example.com")
+	c.Assert(claims.Fingerprint, gc.Equals, testFP)
+	c.Assert(claims.Action, gc.Equals, storage.TokenVerify)
+
+	// Tokens are single-use.
+	_, err = s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrTokenUsed)
+}
+
+func (s *TokensSuite) TestInvalid(c *gc.C) {
+	token, err := s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+
+	// Tokens are bound to their action.
+	_, err = s.tokens.Redeem(token, storage.TokenUnpublish)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrInvalidToken)
+
+	// Tokens signed with another secret are refused.
+	other, err := storage.NewTokens(s.store, bytes.Repeat([]byte("x"), 32))
+	c.Assert(err, gc.IsNil)
+	_, err = other.Redeem(token, storage.TokenVerify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrInvalidToken)
+
+	// Tampered tokens are refused.
+	parts := strings.Split(token, ".")
+	for _, bad := range []string{"", "x", parts[0], parts[1] + "." + parts[0], parts[0] + "x." + parts[1]} {
+		_, err = s.tokens.Redeem(bad, storage.TokenVerify)
+		c.Assert(errors.Cause(err), gc.Equals, storage.ErrInvalidToken, gc.Commentf("%q", bad))
+	}
+
+	// The token was not consumed by failed attempts.
+	_, err = s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(err, gc.IsNil)
+
+	_, err = storage.NewTokens(s.store, []byte("short"))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *TokensSuite) TestExpired(c *gc.C) {
+	token, err := s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	s.now = s.now.Add(time.Hour)
+	_, err = s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrTokenExpired)
+}
+
+func (s *TokensSuite) TestUploadToken(c *gc.C) {
+	token, err := s.tokens.UploadToken(strings.ToUpper(testFP))
+	c.Assert(err, gc.IsNil)
+
+	// Upload tokens may be used repeatedly, and are not recorded.
+	for i := 0; i < 2; i++ {
+		fp, err := s.tokens.CheckUploadToken(token)
+		c.Assert(err, gc.IsNil)
+		c.Assert(fp, gc.Equals, testFP)
+	}
+	c.Assert(s.store.tokens, gc.HasLen, 0)
+
+	// Upload tokens are not verification tokens, nor the reverse.
+	_, err = s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrInvalidToken)
+	verify, err := s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	_, err = s.tokens.CheckUploadToken(verify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrInvalidToken)
+
+	s.now = s.now.Add(time.Hour)
+	_, err = s.tokens.CheckUploadToken(token)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrTokenExpired)
+}
+
+func (s *TokensSuite) TestRateLimit(c *gc.C) {
+	for i := 0; i < 2; i++ {
+		_, err := s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+		c.Assert(err, gc.IsNil)
+	}
+	_, err := s.tokens.Issue(storage.TokenVerify, "ALICE@example.com", testFP, "192.0.2.2")
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrRateLimited)
+
+	// Limited by client across addresses, whichever port it connects from.
+	_, err = s.tokens.Issue(storage.TokenVerify, "bob@example.com", testFP, "192.0.2.1:40001")
+	c.Assert(err, gc.IsNil)
+	_, err = s.tokens.Issue(storage.TokenVerify, "carol@example.com", testFP, "192.0.2.1:40002")
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrRateLimited)
+
+	// IPv6 clients are limited by their /64 prefix.
+	for i, addr := range []string{"dave", "erin", "frank"} {
+		_, err = s.tokens.Issue(storage.TokenVerify, addr+"@example.com", testFP, fmt.Sprintf("[2001:db8::%d]:4000%d", i+1, i))
+		c.Assert(err, gc.IsNil)
+	}
+	_, err = s.tokens.Issue(storage.TokenVerify, "grace@example.com", testFP, "[2001:db8::4]:40003")
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrRateLimited)
+	_, err = s.tokens.Issue(storage.TokenVerify, "grace@example.com", testFP, "[2001:db8:0:1::1]:40003")
+	c.Assert(err, gc.IsNil)
+
+	// Client addresses are not stored.
+	for _, t := range s.store.tokens {
+		c.Assert(strings.Contains(t.Source, "192.0.2"), gc.Equals, false)
+	}
+
+	// Limits apply within the rate window.
+	s.now = s.now.Add(time.Hour + time.Second)
+	_, err = s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *TokensSuite) TestCleanup(c *gc.C) {
+	token, err := s.tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	_, err = s.tokens.Redeem(token, storage.TokenVerify)
+	c.Assert(err, gc.IsNil)
+	_, err = s.tokens.Issue(storage.TokenVerify, "bob@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+
+	// Used tokens are kept for the rate window.
+	s.tokens.Start()
+	s.tokens.Stop()
+	c.Assert(s.store.tokens, gc.HasLen, 2)
+
+	s.now = s.now.Add(2*time.Hour + time.Second)
+	tokens, err := storage.NewTokens(s.store, bytes.Repeat([]byte("k"), 32),
+		storage.TokenTTL(time.Hour),
+		storage.TokenRateLimit(time.Hour, 2, 3),
+		storage.TokenClock(storage.ClockFunc(func() time.Time { return s.now })))
+	c.Assert(err, gc.IsNil)
+	tokens.Start()
+	tokens.Stop()
+	c.Assert(s.store.tokens, gc.HasLen, 0)
+}
+
+func (s *TokensSuite) TestInjectedClockAndIDs(c *gc.C) {
+	clock := mock.NewClock(s.now)
+	tokens, err := storage.NewTokens(s.store, bytes.Repeat([]byte("k"), 32),
+		storage.TokenTTL(time.Hour),
+		storage.TokenClock(clock),
+		storage.TokenIDs(mock.NewIDs("token")))
+	c.Assert(err, gc.IsNil)
+
+	first, err := tokens.Issue(storage.TokenVerify, "alice@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	clock.Advance(time.Minute)
+	_, err = tokens.Issue(storage.TokenVerify, "bob@example.com", testFP, "192.0.2.1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.store.tokens["token1"].Issued, gc.Equals, s.now)
+	c.Assert(s.store.tokens["token1"].Expires, gc.Equals, s.now.Add(time.Hour))
+	c.Assert(s.store.tokens["token2"].Issued, gc.Equals, s.now.Add(time.Minute))
+
+	clock.Set(s.now.Add(time.Hour))
+	_, err = tokens.Redeem(first, storage.TokenVerify)
+	c.Assert(errors.Cause(err), gc.Equals, storage.ErrTokenExpired)
+}
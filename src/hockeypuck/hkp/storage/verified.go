@@ -0,0 +1,65 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"time"
+
+	"hockeypuck/openpgp"
+)
+
+// VerifiedAddress records that the owner of a key proved control of an email
+// address in one of its user IDs.
+type VerifiedAddress struct {
+	RFingerprint string
+	// Address is the lower-cased email address.
+	Address  string
+	Verified time.Time
+	// Source is the hostname of the keyserver which verified the address,
+	// or empty if it was verified by this one.
+	Source string
+}
+
+// VerificationStore is implemented by storage backends which record verified
+// email addresses. Like metadata, verification state is not part of the key
+// material and is not reconciled with peers; it may instead be exchanged with
+// trusted keyservers.
+type VerificationStore interface {
+	// VerifiedAddresses returns the addresses verified on the key with the
+	// given RFingerprint.
+	VerifiedAddresses(rfp string) ([]VerifiedAddress, error)
+
+	// VerifiedSince returns the addresses verified by this keyserver at or
+	// after the given time, ordered by verification time, up to limit.
+	VerifiedSince(t time.Time, limit int) ([]VerifiedAddress, error)
+
+	// SetVerified records verified addresses, keeping the most recent
+	// verification of each address on each key. Addresses on keys which are
+	// not stored are ignored.
+	SetVerified(addrs []VerifiedAddress) error
+
+	// CountVerifiedKeys returns the number of keys with at least one
+	// address verified in the given domain, by any keyserver.
+	CountVerifiedKeys(domain string) (int, error)
+}
+
+// UserIDAddress returns the lower-cased email address in a user ID, or an
+// empty string if it has none.
+func UserIDAddress(uid string) string {
+	return openpgp.UserIDAddress(uid)
+}
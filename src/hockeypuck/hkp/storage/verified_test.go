@@ -0,0 +1,44 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+type VerifiedSuite struct{}
+
+var _ = gc.Suite(&VerifiedSuite{})
+
+func (*VerifiedSuite) TestUserIDAddress(c *gc.C) {
+	for uid, addr := range map[string]string{
+		"Alice <Alice@Example.com>":      "alice@example.com",
+		"bob@example.com":                "bob@example.com",
+		" carol@example.com ":            "carol@example.com",
+		"Dave (work) <dave@example.com>": "dave@example.com",
+		"Eve":                            "",
+		"Mallory <mallory>":              "",
+		"<@example.com>":                 "",
+		"Trent <trent@>":                 "",
+		"two words@example.com":          "",
+	} {
+		c.Check(storage.UserIDAddress(uid), gc.Equals, addr, gc.Commentf("%q", uid))
+	}
+}
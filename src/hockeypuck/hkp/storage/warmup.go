@@ -0,0 +1,178 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultHotListSize = 10000
+
+// Warmer is implemented by storage backends which can prepare themselves
+// to serve requests at full speed, for example by opening connections and
+// preparing statements, before the first requests arrive.
+type Warmer interface {
+	Warm() error
+}
+
+// HotList counts how often keys are fetched, so that the most frequently
+// fetched keys can be saved when the server stops and warmed when it
+// starts again.
+type HotList struct {
+	size int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewHotList returns a HotList which remembers about size of the most
+// frequently fetched keys.
+func NewHotList(size int) *HotList {
+	if size <= 0 {
+		size = DefaultHotListSize
+	}
+	return &HotList{
+		size:   size,
+		counts: map[string]int{},
+	}
+}
+
+// Record notes that the keys with the given RFingerprints were fetched.
+func (h *HotList) Record(rfps []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, rfp := range rfps {
+		h.counts[rfp]++
+	}
+	if len(h.counts) > 2*h.size {
+		h.prune()
+	}
+}
+
+// prune forgets all but the hottest keys, and halves the counts of those
+// kept so that keys which have cooled off are eventually displaced.
+func (h *HotList) prune() {
+	counts := map[string]int{}
+	for _, rfp := range h.top(h.size) {
+		counts[rfp] = (h.counts[rfp] + 1) / 2
+	}
+	h.counts = counts
+}
+
+// Top returns the RFingerprints of at most n of the most frequently
+// fetched keys, hottest first.
+func (h *HotList) Top(n int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.top(n)
+}
+
+func (h *HotList) top(n int) []string {
+	rfps := make([]string, 0, len(h.counts))
+	for rfp := range h.counts {
+		rfps = append(rfps, rfp)
+	}
+	sort.Slice(rfps, func(i, j int) bool {
+		ci, cj := h.counts[rfps[i]], h.counts[rfps[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return rfps[i] < rfps[j]
+	})
+	if n >= 0 && len(rfps) > n {
+		rfps = rfps[:n]
+	}
+	return rfps
+}
+
+// Save writes the RFingerprints of the hottest keys to path, one per line,
+// hottest first. The file is replaced atomically.
+func (h *HotList) Save(path string) error {
+	rfps := h.Top(h.size)
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	for _, rfp := range rfps {
+		w.WriteString(rfp)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), path))
+}
+
+// LoadHotList reads the RFingerprints saved by HotList.Save, hottest
+// first. It returns none if the file does not exist.
+func LoadHotList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var rfps []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rfp := strings.TrimSpace(scanner.Text())
+		if rfp != "" {
+			rfps = append(rfps, rfp)
+		}
+	}
+	return rfps, errors.WithStack(scanner.Err())
+}
+
+const warmBatchSize = 100
+
+// WarmKeys fetches the keys with the given RFingerprints and discards them,
+// so that the caches filled when keys are read from storage hold them
+// before clients ask for them. It returns the number of keys found.
+func WarmKeys(st Storage, rfps []string) (int, error) {
+	var n int
+	for len(rfps) > 0 {
+		batch := rfps
+		if len(batch) > warmBatchSize {
+			batch = batch[:warmBatchSize]
+		}
+		rfps = rfps[len(batch):]
+		keys, err := st.FetchKeys(batch)
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		n += len(keys)
+	}
+	return n, nil
+}
@@ -0,0 +1,91 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+)
+
+type WarmUpSuite struct{}
+
+var _ = gc.Suite(&WarmUpSuite{})
+
+func (*WarmUpSuite) TestHotListTop(c *gc.C) {
+	h := storage.NewHotList(10)
+	h.Record([]string{"aa", "bb", "cc"})
+	h.Record([]string{"bb", "cc"})
+	h.Record([]string{"cc"})
+	c.Assert(h.Top(10), gc.DeepEquals, []string{"cc", "bb", "aa"})
+	c.Assert(h.Top(2), gc.DeepEquals, []string{"cc", "bb"})
+}
+
+func (*WarmUpSuite) TestHotListBounded(c *gc.C) {
+	h := storage.NewHotList(2)
+	for i := 0; i < 10; i++ {
+		h.Record([]string{"hot"})
+	}
+	for i := 0; i < 10; i++ {
+		h.Record([]string{fmt.Sprintf("cold%d", i)})
+	}
+	top := h.Top(-1)
+	c.Assert(len(top) <= 4, gc.Equals, true)
+	c.Assert(top[0], gc.Equals, "hot")
+}
+
+func (*WarmUpSuite) TestHotListSaveLoad(c *gc.C) {
+	dir, err := ioutil.TempDir("", "hotlist")
+	c.Assert(err, gc.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hotkeys")
+
+	rfps, err := storage.LoadHotList(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	h := storage.NewHotList(10)
+	h.Record([]string{"aa", "bb", "bb"})
+	c.Assert(h.Save(path), gc.IsNil)
+	rfps, err = storage.LoadHotList(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"bb", "aa"})
+}
+
+func (*WarmUpSuite) TestWarmKeys(c *gc.C) {
+	var rfps []string
+	for i := 0; i < 250; i++ {
+		rfps = append(rfps, fmt.Sprintf("%040x", i))
+	}
+	st := mock.NewStorage(
+		mock.FetchKeys(func(batch []string) ([]*openpgp.PrimaryKey, error) {
+			return make([]*openpgp.PrimaryKey, len(batch)/2), nil
+		}),
+	)
+	n, err := storage.WarmKeys(st, rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 125)
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 3)
+}
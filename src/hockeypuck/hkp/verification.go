@@ -0,0 +1,529 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// VerificationExportVersion is the version of the verified address export
+// format written by this keyserver.
+const VerificationExportVersion = 1
+
+const (
+	// maxExportedAddresses limits the addresses in a single export. Clients
+	// continue from the verification time of the last address received.
+	maxExportedAddresses = 10000
+
+	// maxVerificationImportLen limits the size of an import request.
+	maxVerificationImportLen = 16 << 20
+
+	// maxVerificationClockSkew is how far in the future an imported
+	// verification time may be.
+	maxVerificationClockSkew = time.Hour
+)
+
+// VerificationExport is the document in which a keyserver shares the email
+// addresses it has verified with the keyservers that trust it. It is
+// published clearsigned by the exporting keyserver's key.
+type VerificationExport struct {
+	Version int `json:"version"`
+	// Issuer is the hostname of the exporting keyserver.
+	Issuer string `json:"issuer"`
+	// Time is when the export was produced.
+	Time      string            `json:"time"`
+	Addresses []ExportedAddress `json:"addresses"`
+	// More is set if the export was truncated, and more addresses were
+	// verified at or after the verification time of the last one.
+	More bool `json:"more,omitempty"`
+}
+
+// ExportedAddress is an email address verified on a key.
+type ExportedAddress struct {
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint"`
+	Verified    string `json:"verified"`
+}
+
+// VerificationImportResponse reports the outcome of an import.
+type VerificationImportResponse struct {
+	Imported int `json:"imported"`
+	Ignored  int `json:"ignored"`
+}
+
+// StorageVerifier reports the verification state of user IDs recorded in
+// storage.
+type StorageVerifier struct {
+	vs storage.VerificationStore
+}
+
+// NewStorageVerifier returns a Verifier reporting the addresses verified in
+// vs.
+func NewStorageVerifier(vs storage.VerificationStore) *StorageVerifier {
+	return &StorageVerifier{vs: vs}
+}
+
+// VerifiedAt implements Verifier.
+func (v *StorageVerifier) VerifiedAt(key *openpgp.PrimaryKey, uid *openpgp.UserID) (time.Time, error) {
+	addr := storage.UserIDAddress(uid.Keywords)
+	if addr == "" {
+		return time.Time{}, nil
+	}
+	addrs, err := v.vs.VerifiedAddresses(key.RFingerprint)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	for _, va := range addrs {
+		if va.Address == addr {
+			return va.Verified, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// VerifiedAddressExport publishes the addresses verified by this keyserver,
+// signed by signer and attributed to the keyserver's hostname.
+func VerifiedAddressExport(signer *xopenpgp.Entity, hostname string) HandlerOption {
+	return func(h *Handler) error {
+		if signer.PrivateKey == nil || signer.PrivateKey.Encrypted {
+			return errors.New("verification export key must be an unencrypted private key")
+		}
+		h.verificationSigner = signer
+		h.hostname = hostname
+		return nil
+	}
+}
+
+// VerifiedAddressImport accepts the addresses verified by the keyservers whose
+// keys are in trusted. Imported addresses are attributed to the fingerprint
+// of the key which signed the export.
+func VerifiedAddressImport(trusted xopenpgp.EntityList) HandlerOption {
+	return func(h *Handler) error {
+		h.verificationPeers = append(h.verificationPeers, trusted...)
+		return nil
+	}
+}
+
+// VerifiedAddressPeer accepts the addresses verified by the keyserver with
+// the given hostname, whose keys are in keyring. Its exports must be issued
+// by hostname, to which imported addresses are attributed.
+func VerifiedAddressPeer(hostname string, keyring xopenpgp.EntityList) HandlerOption {
+	return func(h *Handler) error {
+		if hostname == "" {
+			return errors.New("verification peer has no hostname")
+		}
+		if len(keyring) == 0 {
+			return errors.Errorf("verification peer %q has no keys", hostname)
+		}
+		if h.verificationPeerNames == nil {
+			h.verificationPeerNames = map[string]string{}
+		}
+		for _, e := range keyring {
+			h.verificationPeerNames[hex.EncodeToString(e.PrimaryKey.Fingerprint[:])] = hostname
+			h.verificationPeers = append(h.verificationPeers, e)
+		}
+		return nil
+	}
+}
+
+func (h *Handler) verificationStore() (storage.VerificationStore, bool) {
+	vs, ok := h.storage.(storage.VerificationStore)
+	return vs, ok
+}
+
+// ExportVerified serves a signed export of the addresses verified by this
+// keyserver at or after the time given by the since parameter, in RFC 3339
+// format.
+func (h *Handler) ExportVerified(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	vs, ok := h.verificationStore()
+	if !ok || h.verificationSigner == nil {
+		httpError(w, http.StatusNotFound, errors.New("verification export not configured"))
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, errors.Wrapf(err, "invalid since %q", s))
+			return
+		}
+	}
+	addrs, err := vs.VerifiedSince(since, maxExportedAddresses+1)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	export := &VerificationExport{
+		Version:   VerificationExportVersion,
+		Issuer:    h.hostname,
+		Time:      h.clock.Now().Format(time.RFC3339),
+		Addresses: []ExportedAddress{},
+	}
+	if len(addrs) > maxExportedAddresses {
+		addrs = addrs[:maxExportedAddresses]
+		export.More = true
+	}
+	for _, va := range addrs {
+		export.Addresses = append(export.Addresses, ExportedAddress{
+			Address:     va.Address,
+			Fingerprint: openpgp.Reverse(va.RFingerprint),
+			Verified:    va.Verified.UTC().Format(time.RFC3339),
+		})
+	}
+	doc, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	var buf bytes.Buffer
+	cw, err := clearsign.Encode(&buf, h.verificationSigner.PrivateKey, nil)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	_, err = cw.Write(doc)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// ImportVerified records the addresses in a signed export from a trusted
+// keyserver. Addresses are only imported for stored keys having a user ID
+// with the address.
+func (h *Handler) ImportVerified(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	vs, ok := h.verificationStore()
+	if !ok || len(h.verificationPeers) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("verification import not configured"))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxVerificationImportLen))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, errors.WithStack(err))
+		return
+	}
+	block, _ := clearsign.Decode(body)
+	if block == nil {
+		httpError(w, http.StatusBadRequest, errors.New("expected a clearsigned verification export"))
+		return
+	}
+	signer, err := xopenpgp.CheckDetachedSignature(h.verificationPeers,
+		bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errors.Wrap(err, "export not signed by a trusted keyserver"))
+		return
+	}
+	var export VerificationExport
+	err = json.Unmarshal(block.Plaintext, &export)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if export.Version != VerificationExportVersion {
+		httpError(w, http.StatusBadRequest, errors.Errorf("unsupported export version %d", export.Version))
+		return
+	}
+	source, err := h.verificationSource(signer, export.Issuer)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errors.WithStack(err))
+		return
+	}
+
+	addrs, ignored, err := h.importableAddresses(&export, source)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	err = vs.SetVerified(addrs)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"issuer":   export.Issuer,
+		"source":   source,
+		"imported": len(addrs),
+		"ignored":  ignored,
+	}).Info("import verified addresses")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&VerificationImportResponse{Imported: len(addrs), Ignored: ignored})
+}
+
+// verificationSource returns the source to which addresses imported from an
+// export by issuer, signed by signer, are attributed: the hostname of the
+// peer signer belongs to, or else its fingerprint. The source is never
+// empty, which would attribute the addresses to this keyserver. Exports
+// without an issuer, or issued by a keyserver other than the peer, are
+// refused.
+func (h *Handler) verificationSource(signer *xopenpgp.Entity, issuer string) (string, error) {
+	if issuer == "" {
+		return "", errors.New("export has no issuer")
+	}
+	fp := hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])
+	hostname, ok := h.verificationPeerNames[fp]
+	if !ok {
+		return fp, nil
+	}
+	if !strings.EqualFold(issuer, hostname) {
+		return "", errors.Errorf("export issued by %q signed by a key of %q", issuer, hostname)
+	}
+	return hostname, nil
+}
+
+// importableAddresses returns the addresses in export which are present on
+// stored keys, attributed to source, and the number of addresses which are
+// not.
+func (h *Handler) importableAddresses(export *VerificationExport, source string) ([]storage.VerifiedAddress, int, error) {
+	var candidates []storage.VerifiedAddress
+	var rfps []string
+	seen := map[string]bool{}
+	latest := h.clock.Now().Add(maxVerificationClockSkew)
+	for _, ea := range export.Addresses {
+		fp := strings.ToLower(ea.Fingerprint)
+		verified, err := time.Parse(time.RFC3339, ea.Verified)
+		if _, herr := hex.DecodeString(fp); herr != nil || len(fp) < 40 || err != nil || verified.After(latest) {
+			continue
+		}
+		rfp := openpgp.Reverse(fp)
+		candidates = append(candidates, storage.VerifiedAddress{
+			RFingerprint: rfp,
+			Address:      strings.ToLower(ea.Address),
+			Verified:     verified,
+			Source:       source,
+		})
+		if !seen[rfp] {
+			seen[rfp] = true
+			rfps = append(rfps, rfp)
+		}
+	}
+
+	addresses, err := h.keyAddresses(rfps)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	var result []storage.VerifiedAddress
+	for _, va := range candidates {
+		if addresses[va.RFingerprint][va.Address] {
+			result = append(result, va)
+		}
+	}
+	return result, len(export.Addresses) - len(result), nil
+}
+
+// keyAddresses returns the addresses in the user IDs of each stored key
+// with the given RFingerprints.
+func (h *Handler) keyAddresses(rfps []string) (map[string]map[string]bool, error) {
+	addresses := map[string]map[string]bool{}
+	for len(rfps) > 0 {
+		n := len(rfps)
+		if n > maxSearchResults {
+			n = maxSearchResults
+		}
+		keys, err := h.storage.FetchKeys(rfps[:n])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, key := range keys {
+			addresses[key.RFingerprint] = map[string]bool{}
+			for _, uid := range key.UserIDs {
+				if addr := storage.UserIDAddress(uid.Keywords); addr != "" {
+					addresses[key.RFingerprint][addr] = true
+				}
+			}
+		}
+		rfps = rfps[n:]
+	}
+	return addresses, nil
+}
+
+// VerificationTokens accepts tokens issued by t as proof of control of an
+// email address.
+func VerificationTokens(t *storage.Tokens) HandlerOption {
+	return func(h *Handler) error {
+		h.tokens = t
+		return nil
+	}
+}
+
+// VerificationSender delivers verification tokens to the addresses they were
+// issued for.
+type VerificationSender interface {
+	SendVerification(address, fingerprint, token string) error
+}
+
+// VerificationMail sends verification tokens requested through the VKS API
+// with s.
+func VerificationMail(s VerificationSender) HandlerOption {
+	return func(h *Handler) error {
+		h.verificationSender = s
+		return nil
+	}
+}
+
+// EmailVerificationSender sends verification tokens by email through an SMTP
+// server, as a link to the confirmation form at /pks/verify.
+type EmailVerificationSender struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	Auth smtp.Auth
+	From string
+	// Hostname is the public hostname of the keyserver, at which the
+	// confirmation form is linked.
+	Hostname string
+
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (e *EmailVerificationSender) SendVerification(address, fingerprint, token string) error {
+	link := (&url.URL{
+		Scheme:   "https",
+		Host:     e.Hostname,
+		Path:     "/pks/verify",
+		RawQuery: url.Values{"token": {token}}.Encode(),
+	}).String()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", address)
+	fmt.Fprintf(&buf, "Subject: Verify %s for your key on %s\r\n", address, e.Hostname)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Verification of the address %s on the OpenPGP key\r\n", address)
+	fmt.Fprintf(&buf, "%s was requested at %s.\r\n\r\n", strings.ToUpper(fingerprint), e.Hostname)
+	buf.WriteString("To confirm that this is your key, follow the link below:\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", link)
+	buf.WriteString("If you did not request this, you may ignore this message.\r\n")
+	sendMail := e.sendMail
+	if sendMail == nil {
+		sendMail = smtp.SendMail
+	}
+	return errors.WithStack(sendMail(e.Addr, e.Auth, e.From, []string{address}, buf.Bytes()))
+}
+
+var verifyFormTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Verify email address</title></head>
+<body>
+<form method="post" action="/pks/verify">
+<input type="hidden" name="token" value="{{.}}">
+<p>Confirm that this is your key and address.</p>
+<input type="submit" value="Confirm">
+</form>
+</body>
+</html>
+`))
+
+// VerifyForm serves a form redeeming the verification token given as the
+// token parameter, linked to from verification emails. Following the link
+// does not itself redeem the token.
+func (h *Handler) VerifyForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.tokens == nil {
+		httpError(w, http.StatusNotFound, errors.New("address verification not configured"))
+		return
+	}
+	h.setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := verifyFormTemplate.Execute(w, r.URL.Query().Get("token"))
+	if err != nil {
+		log.Errorf("verify form: %v", err)
+	}
+}
+
+// VerifyResponse reports the address verified by a token.
+type VerifyResponse struct {
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Verify redeems a verification token, given as the token form parameter,
+// recording the address it was issued for as verified on its key. Tokens are
+// only redeemed by POST, so that following a link does not consume them.
+func (h *Handler) Verify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	vs, ok := h.verificationStore()
+	if !ok || h.tokens == nil {
+		httpError(w, http.StatusNotFound, errors.New("address verification not configured"))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	claims, err := h.tokens.Redeem(r.Form.Get("token"), storage.TokenVerify)
+	if err != nil {
+		switch errors.Cause(err) {
+		case storage.ErrTokenExpired:
+			httpError(w, http.StatusGone, err)
+		case storage.ErrTokenUsed:
+			httpError(w, http.StatusConflict, err)
+		case storage.ErrInvalidToken:
+			httpError(w, http.StatusBadRequest, err)
+		default:
+			httpError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	// The key may have changed since the token was issued.
+	va := storage.VerifiedAddress{
+		RFingerprint: openpgp.Reverse(claims.Fingerprint),
+		Address:      claims.Address,
+		Verified:     h.clock.Now(),
+	}
+	addresses, err := h.keyAddresses([]string{va.RFingerprint})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	if !addresses[va.RFingerprint][va.Address] {
+		httpError(w, http.StatusNotFound, errors.Errorf("no key %s with address %q", claims.Fingerprint, claims.Address))
+		return
+	}
+	err = vs.SetVerified([]storage.VerifiedAddress{va})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&VerifyResponse{Address: claims.Address, Fingerprint: claims.Fingerprint})
+}
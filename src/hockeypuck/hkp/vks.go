@@ -0,0 +1,329 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// maxVKSRequestLen limits the size of a VKS verification request, and of an
+// upload if MaxAddLength is not set.
+const maxVKSRequestLen = 8 << 20
+
+// Address statuses reported by the VKS API. Hockeypuck serves all the user
+// IDs of a key, so the status of an address describes whether it has been
+// verified rather than whether it is served.
+const (
+	VKSPublished   = "published"
+	VKSUnpublished = "unpublished"
+	VKSPending     = "pending"
+	VKSRevoked     = "revoked"
+)
+
+// VKSUploadRequest is the body of a request to /vks/v1/upload.
+type VKSUploadRequest struct {
+	Keytext string `json:"keytext"`
+}
+
+// VKSVerifyRequest is the body of a request to /vks/v1/request-verify.
+type VKSVerifyRequest struct {
+	Token     string   `json:"token"`
+	Addresses []string `json:"addresses"`
+	Locale    []string `json:"locale,omitempty"`
+}
+
+// VKSUploadResponse describes an uploaded key and the status of the
+// addresses on it.
+type VKSUploadResponse struct {
+	KeyFingerprint string            `json:"key_fpr"`
+	Status         map[string]string `json:"status"`
+	// Token identifies the upload in requests for verification. It is only
+	// issued if address verification is configured.
+	Token string `json:"token,omitempty"`
+}
+
+type vksError struct {
+	Error string `json:"error"`
+}
+
+// vksJSONError responds with an error in the form of the VKS API.
+func vksJSONError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode < 500 {
+		log.Infof("HTTP %d: %v", statusCode, err)
+	} else {
+		log.Errorf("HTTP %d: %+v", statusCode, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(&vksError{Error: errors.Cause(err).Error()})
+}
+
+// VKSByFingerprint serves the key with the given fingerprint at
+// /vks/v1/by-fingerprint/<FINGERPRINT>, as the Verifying Keyserver API of
+// keys.openpgp.org does.
+func (h *Handler) VKSByFingerprint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fp := strings.ToLower(ps.ByName("fpr"))
+	if _, err := hex.DecodeString(fp); err != nil || (len(fp) != fingerprintKeyIDLen && len(fp) != 64) {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid fingerprint %q", ps.ByName("fpr")))
+		return
+	}
+	h.serveVKS(w, &Lookup{Op: OperationGet, Search: "0x" + fp, Options: OptionSet{}}, nil)
+}
+
+// VKSByKeyID serves the key with the given 64-bit key ID at
+// /vks/v1/by-keyid/<KEY-ID>.
+func (h *Handler) VKSByKeyID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keyID := strings.ToLower(ps.ByName("keyid"))
+	if _, err := hex.DecodeString(keyID); err != nil || len(keyID) != 16 {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid key ID %q", ps.ByName("keyid")))
+		return
+	}
+	h.serveVKS(w, &Lookup{Op: OperationGet, Search: "0x" + keyID, Options: OptionSet{}}, nil)
+}
+
+// VKSByEmail serves the keys having a user ID with the given email address
+// at /vks/v1/by-email/<address>.
+func (h *Handler) VKSByEmail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	addr := storage.UserIDAddress(ps.ByName("addr"))
+	if addr == "" {
+		httpError(w, http.StatusBadRequest, errors.Errorf("invalid email address %q", ps.ByName("addr")))
+		return
+	}
+	h.serveVKS(w, &Lookup{Op: OperationGet, Search: addr, Options: OptionSet{}}, func(key *openpgp.PrimaryKey) bool {
+		for _, uid := range key.UserIDs {
+			if storage.UserIDAddress(uid.Keywords) == addr {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (h *Handler) serveVKS(w http.ResponseWriter, l *Lookup, match func(*openpgp.PrimaryKey) bool) {
+	if h.analytics != nil {
+		h.analytics.Record(string(l.Op), l.Search)
+	}
+	h.setSecurityHeaders(w)
+	keys, ok := h.servedKeys(w, l, match)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	err := h.keyWriter(l).WriteArmored(w, keys, h.keyWriterOptions...)
+	if err == nil {
+		_, err = w.Write([]byte("\n"))
+	}
+	if err != nil {
+		log.Errorf("vks %q: error writing keys: %v", l.Search, err)
+	}
+}
+
+// VKSUpload stores a single key submitted to /vks/v1/upload, responding with
+// the status of the addresses on it and, if address verification is
+// configured, a token with which their verification may be requested.
+func (h *Handler) VKSUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req VKSUploadRequest
+	h.limitSubmission(w, r)
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVKSRequestLen)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		vksJSONError(w, http.StatusRequestEntityTooLarge, errors.Wrap(err, "invalid upload request"))
+		return
+	} else if err != nil {
+		vksJSONError(w, http.StatusBadRequest, errors.Wrap(err, "invalid upload request"))
+		return
+	}
+	err = h.verifyChallenge(w, r)
+	if IsChallengeFailed(err) {
+		vksJSONError(w, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		vksJSONError(w, http.StatusServiceUnavailable, errors.WithStack(err))
+		return
+	}
+	armorBlock, err := openpgp.DecodeArmor(bytes.NewBufferString(req.Keytext), h.keyReaderOptions...)
+	if err != nil {
+		vksJSONError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	keys, err := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...).Read()
+	if err != nil {
+		vksJSONError(w, http.StatusBadRequest, errors.WithStack(err))
+		return
+	} else if len(keys) != 1 {
+		vksJSONError(w, http.StatusBadRequest, errors.Errorf("expected a single key, got %d", len(keys)))
+		return
+	}
+	key := keys[0]
+
+	change, err := h.addKey(key)
+	if storage.IsPinned(err) || storage.IsTombstoned(err) || storage.IsBlocked(err) || openpgp.IsTooLarge(err) || IsLimitExceeded(err) {
+		vksJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"fp":     key.QualifiedFingerprint(),
+		"change": change,
+	}).Info("vks upload")
+
+	resp, err := h.vksStatus(key, nil)
+	if err != nil {
+		vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	if h.tokens != nil {
+		resp.Token, err = h.tokens.UploadToken(key.Fingerprint())
+		if err != nil {
+			vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// VKSRequestVerify sends verification tokens to the addresses given in a
+// request to /vks/v1/request-verify, which must be unverified addresses on
+// the key identified by the upload token.
+func (h *Handler) VKSRequestVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, ok := h.verificationStore(); !ok || h.tokens == nil || h.verificationSender == nil {
+		vksJSONError(w, http.StatusNotFound, errors.New("address verification not configured"))
+		return
+	}
+	var req VKSVerifyRequest
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxVKSRequestLen))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		vksJSONError(w, http.StatusBadRequest, errors.Wrap(err, "invalid verification request"))
+		return
+	}
+	fp, err := h.tokens.CheckUploadToken(req.Token)
+	if err != nil {
+		vksJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	keys, err := h.storage.FetchKeys([]string{openpgp.Reverse(fp)})
+	if err != nil && !storage.IsNotFound(err) {
+		vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	} else if len(keys) == 0 {
+		vksJSONError(w, http.StatusNotFound, errors.Errorf("key %s not found", fp))
+		return
+	}
+	key := keys[0]
+
+	resp, err := h.vksStatus(key, nil)
+	if err != nil {
+		vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	// Tokens are limited by the address of the client, behind any trusted
+	// proxies.
+	var clientSource string
+	if ip := h.clientIP(r); ip != nil {
+		clientSource = ip.String()
+	}
+	pending := map[string]bool{}
+	for _, addr := range req.Addresses {
+		addr = strings.ToLower(addr)
+		if resp.Status[addr] != VKSUnpublished || pending[addr] {
+			continue
+		}
+		token, err := h.tokens.Issue(storage.TokenVerify, addr, fp, clientSource)
+		if errors.Is(err, storage.ErrRateLimited) {
+			vksJSONError(w, http.StatusTooManyRequests, err)
+			return
+		} else if err != nil {
+			vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		err = h.verificationSender.SendVerification(addr, fp, token)
+		if err != nil {
+			vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		pending[addr] = true
+	}
+	resp, err = h.vksStatus(key, pending)
+	if err != nil {
+		vksJSONError(w, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	resp.Token = req.Token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// vksStatus reports the status of each address in the user IDs of key.
+// Addresses in pending have just been sent verification tokens.
+func (h *Handler) vksStatus(key *openpgp.PrimaryKey, pending map[string]bool) (*VKSUploadResponse, error) {
+	verified := map[string]bool{}
+	if vs, ok := h.verificationStore(); ok {
+		addrs, err := vs.VerifiedAddresses(key.RFingerprint)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, va := range addrs {
+			verified[va.Address] = true
+		}
+	}
+	resp := &VKSUploadResponse{
+		KeyFingerprint: strings.ToUpper(key.Fingerprint()),
+		Status:         map[string]string{},
+	}
+	for _, uid := range key.UserIDs {
+		addr := storage.UserIDAddress(uid.Keywords)
+		if addr == "" {
+			continue
+		}
+		selfSigs, _ := uid.SigInfo(key)
+		_, revoked := selfSigs.RevokedSince()
+		if _, ok := resp.Status[addr]; ok && revoked {
+			// Another user ID with the address is not revoked.
+			continue
+		}
+		switch {
+		case revoked:
+			resp.Status[addr] = VKSRevoked
+		case verified[addr]:
+			resp.Status[addr] = VKSPublished
+		case pending[addr]:
+			resp.Status[addr] = VKSPending
+		default:
+			resp.Status[addr] = VKSUnpublished
+		}
+	}
+	return resp, nil
+}
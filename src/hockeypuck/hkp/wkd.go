@@ -0,0 +1,206 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// wkdScanBatch is the number of verified addresses read at a time when
+// searching for the address of a WKD request without a local part.
+const wkdScanBatch = 1000
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// wkdHash returns the hashed local part of an address in a Web Key
+// Directory URL, the z-base-32 encoded SHA-1 digest of the lower-cased
+// local part, draft-koch-openpgp-webkey-service section 3.1.
+func wkdHash(local string) string {
+	digest := sha1.Sum([]byte(strings.ToLower(local)))
+	var sb strings.Builder
+	var acc, bits uint
+	for _, b := range digest {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(acc<<(5-bits))&0x1f])
+	}
+	return sb.String()
+}
+
+// WKDDomains serves the Web Key Directory of the given domains, publishing
+// the keys with verified addresses in them.
+func WKDDomains(domains []string) HandlerOption {
+	return func(h *Handler) error {
+		h.wkdDomains = map[string]bool{}
+		for _, domain := range domains {
+			h.wkdDomains[strings.ToLower(domain)] = true
+		}
+		return nil
+	}
+}
+
+// WKD serves the Web Key Directory of the configured domains under
+// /.well-known/openpgpkey/, by both the direct method, in which the domain
+// is the host of the request, and the advanced method, in which it is given
+// in the path and the keyserver is reached as openpgpkey.<domain>. Only keys
+// on which the requested address has been verified are served, with only
+// the user IDs having the address.
+func (h *Handler) WKD(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	vs, ok := h.verificationStore()
+	if !ok || len(h.wkdDomains) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("web key directory not configured"))
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := strings.Split(strings.TrimPrefix(ps.ByName("path"), "/"), "/")
+	var domain string
+	if len(parts) == 3 || (len(parts) == 2 && parts[1] == "policy") {
+		// Advanced method.
+		domain, parts = strings.ToLower(parts[0]), parts[1:]
+	} else {
+		domain = strings.ToLower(r.Host)
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+	}
+	if !h.wkdDomains[domain] {
+		httpError(w, http.StatusNotFound, errors.Errorf("web key directory not served for %q", domain))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "policy":
+		w.Header().Set("Content-Type", "text/plain")
+		return
+	case len(parts) == 2 && parts[0] == "hu" && len(parts[1]) == 32:
+	default:
+		httpError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	hash := strings.ToLower(parts[1])
+
+	var addr string
+	if local := r.URL.Query().Get("l"); local != "" {
+		if wkdHash(local) != hash {
+			httpError(w, http.StatusNotFound, errors.Errorf("local part %q does not match %q", local, hash))
+			return
+		}
+		addr = strings.ToLower(local) + "@" + domain
+	} else {
+		var err error
+		addr, err = wkdVerifiedAddress(vs, domain, hash)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		} else if addr == "" {
+			httpError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+	}
+
+	l := &Lookup{Op: OperationGet, Search: addr, Options: OptionSet{}}
+	keys, ok := h.servedKeys(w, l, func(key *openpgp.PrimaryKey) bool {
+		return hasUserIDAddress(key, addr) && isVerified(vs, key, addr)
+	})
+	if !ok {
+		return
+	}
+	policy := append([]openpgp.PolicyOption{openpgp.DropMalformed()}, h.servePolicy...)
+	kw := openpgp.NewKeyWriter(append(policy, openpgp.MatchedUserIDs(func(uid *openpgp.UserID) bool {
+		return storage.UserIDAddress(uid.Keywords) == addr
+	}))...)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, key := range keys {
+		err := kw.Write(w, key)
+		if err != nil {
+			log.Errorf("wkd %q: error writing keys: %v", addr, err)
+			return
+		}
+	}
+}
+
+func hasUserIDAddress(key *openpgp.PrimaryKey, addr string) bool {
+	for _, uid := range key.UserIDs {
+		if storage.UserIDAddress(uid.Keywords) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func isVerified(vs storage.VerificationStore, key *openpgp.PrimaryKey, addr string) bool {
+	addrs, err := vs.VerifiedAddresses(key.RFingerprint)
+	if err != nil {
+		log.Errorf("failed to read verified addresses of key %s: %v", key.Fingerprint(), err)
+		return false
+	}
+	for _, va := range addrs {
+		if va.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// wkdVerifiedAddress returns the address in domain verified by this
+// keyserver whose local part has the given hash, for clients which do not
+// give the local part in their request. Addresses verified by other
+// keyservers are only found by the local part.
+func wkdVerifiedAddress(vs storage.VerificationStore, domain, hash string) (string, error) {
+	var since time.Time
+	for {
+		addrs, err := vs.VerifiedSince(since, wkdScanBatch)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		for _, va := range addrs {
+			at := strings.LastIndex(va.Address, "@")
+			if at > 0 && va.Address[at+1:] == domain && wkdHash(va.Address[:at]) == hash {
+				return va.Address, nil
+			}
+		}
+		if len(addrs) < wkdScanBatch {
+			return "", nil
+		}
+		// Addresses are returned at or after since, so the scan ends if a
+		// whole batch was verified at the same time.
+		next := addrs[len(addrs)-1].Verified
+		if !next.After(since) {
+			return "", nil
+		}
+		since = next
+	}
+}
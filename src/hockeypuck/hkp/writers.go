@@ -19,16 +19,19 @@ package hkp
 
 import (
 	"encoding/json"
-	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/locale"
+	"hockeypuck/hkp/mrhkp"
+	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
 )
 
@@ -36,13 +39,75 @@ type IndexFormat interface {
 	Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error
 }
 
-type JSONFormat struct{}
+// Verifier reports the verification state of user IDs. A user ID is verified
+// once its owner has proven control of the email address it contains.
+type Verifier interface {
+	// VerifiedAt returns the time at which the user ID was verified on the
+	// given key, or the zero time if it has not been verified.
+	VerifiedAt(key *openpgp.PrimaryKey, uid *openpgp.UserID) (time.Time, error)
+}
+
+func verifiedAt(v Verifier, key *openpgp.PrimaryKey, uid *openpgp.UserID) time.Time {
+	if v == nil {
+		return time.Time{}
+	}
+	t, err := v.VerifiedAt(key, uid)
+	if err != nil {
+		log.Errorf("cannot determine verification of %q on key %s: %v", uid.Keywords, key.Fingerprint(), err)
+		return time.Time{}
+	}
+	return t
+}
 
-var jsonFormat = &JSONFormat{}
+type JSONFormat struct {
+	verifier Verifier
+	metadata func([]*openpgp.PrimaryKey) map[string]map[string]string
+	signers  func([]*openpgp.PrimaryKey) map[*openpgp.Signature]string
+}
 
-func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.PrimaryKey) error {
+func (f *JSONFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "application/json")
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
+	if isAmbiguous(l, keys) {
+		for _, wireKey := range wireKeys {
+			wireKey.AmbiguousKeyID = true
+		}
+	}
+	for i, key := range keys {
+		if subKey := matchedSubKey(l, key); subKey != nil {
+			wireKeys[i].MatchedSubKey = &jsonhkp.MatchedSubKey{
+				Fingerprint: subKey.Fingerprint(),
+				Binding:     subKey.BindingStatus(key),
+			}
+		}
+	}
+	if f.metadata != nil {
+		metadata := f.metadata(keys)
+		for i, key := range keys {
+			wireKeys[i].Metadata = metadata[key.RFingerprint]
+		}
+	}
+	if f.signers != nil {
+		signers := f.signers(keys)
+		for i, key := range keys {
+			for j, uid := range key.UserIDs {
+				for k, sig := range uid.Signatures {
+					if fp, ok := signers[sig]; ok {
+						wireKeys[i].UserIDs[j].Signatures[k].SignerFingerprint = fp
+					}
+				}
+			}
+		}
+	}
+	if f.verifier != nil {
+		for i, key := range keys {
+			for j, uid := range key.UserIDs {
+				if t := verifiedAt(f.verifier, key, uid); !t.IsZero() {
+					wireKeys[i].UserIDs[j].Verified = t.UTC().Format(time.RFC3339)
+				}
+			}
+		}
+	}
 	out, err := json.MarshalIndent(wireKeys, "", "\t")
 	if err != nil {
 		return errors.WithStack(err)
@@ -51,58 +116,75 @@ func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.Prima
 	return errors.WithStack(err)
 }
 
-type MRFormat struct{}
-
-var mrFormat = &MRFormat{}
+type MRFormat struct {
+	verifier Verifier
+}
 
-func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
+func (f *MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/plain")
-
-	fmt.Fprintf(w, "info:1:%d\n", len(keys))
-	for _, key := range keys {
-		selfsigs, _ := key.SigInfo()
-		if !selfsigs.Valid() {
-			continue
-		}
-
-		var keyID string
-		if l.Fingerprint {
-			keyID = key.Fingerprint()
-		} else {
-			keyID = key.KeyID()
+	ix := &mrhkp.Index{Fingerprint: l.Fingerprint}
+	if isAmbiguous(l, keys) {
+		ix.Ambiguous = l.Search[2:]
+	}
+	if f.verifier != nil {
+		ix.VerifiedAt = func(key *openpgp.PrimaryKey, uid *openpgp.UserID) time.Time {
+			return verifiedAt(f.verifier, key, uid)
 		}
-		keyID = strings.ToUpper(keyID)
+	}
+	return ix.Write(w, keys)
+}
 
-		expiresAt, _ := selfsigs.ExpiresAt()
+type HTMLFormat struct {
+	t *template.Template
+}
 
-		fmt.Fprintf(w, "pub:%s:%d:%d:%d:%s:\n", keyID, key.Algorithm, key.BitLen,
-			key.Creation.Unix(), mrTimeString(expiresAt))
+// templateFuncs returns the functions available to HTML templates, formatting
+// human-facing text for loc. Templates render attacker-controlled key
+// material, so these must not mark content as safe unless it has been
+// checked.
+func templateFuncs(loc *locale.Locale) template.FuncMap {
+	return template.FuncMap{
+		"url":  safeURL,
+		"day":  loc.Date,
+		"hour": loc.Hour,
+		"time": loc.Time,
+		"age": func(t time.Time) string {
+			return loc.Age(t, time.Now())
+		},
+		"msg": loc.Message,
+	}
+}
 
-		for _, uid := range key.UserIDs {
-			selfsigs, _ := uid.SigInfo(key)
-			validSince, ok := selfsigs.ValidSince()
-			if !ok {
-				continue
-			}
-			expiresAt, _ := selfsigs.ExpiresAt()
-			fmt.Fprintf(w, "uid:%s:%d:%s:\n", strings.Replace(uid.Keywords, ":", "%3a", -1),
-				validSince.Unix(), mrTimeString(expiresAt))
-		}
+// executeLocalized renders t to w, formatting human-facing text in the locale
+// negotiated for the response.
+func executeLocalized(w http.ResponseWriter, t *template.Template, data interface{}) error {
+	loc := responseLocale(w)
+	lt, err := t.Clone()
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	return nil
+	lt.Funcs(templateFuncs(loc))
+	setContentLanguage(w, loc)
+	return errors.WithStack(lt.Execute(w, data))
 }
 
-type HTMLFormat struct {
-	t *template.Template
+// safeURL allows a URL to be rendered into a template without further
+// filtering, if it is a web link or an inline image. Any other URL is
+// replaced with a harmless one.
+func safeURL(u *url.URL) template.URL {
+	switch {
+	case u == nil:
+	case u.Scheme == "http", u.Scheme == "https":
+		return template.URL(u.String())
+	case u.Scheme == "data" && strings.HasPrefix(u.Opaque, "image/"):
+		return template.URL(u.String())
+	}
+	return template.URL("about:invalid#zGotmplZ")
 }
 
 func NewHTMLFormat(path string, extra []string) (*HTMLFormat, error) {
 	f := &HTMLFormat{
-		t: template.New(filepath.Base(path)).Funcs(template.FuncMap{
-			"url": func(u *url.URL) template.URL {
-				return template.URL(u.String())
-			},
-		}),
+		t: template.New(filepath.Base(path)).Funcs(templateFuncs(locale.Default)),
 	}
 	var err error
 	if len(extra) > 0 {
@@ -119,8 +201,8 @@ func NewHTMLFormat(path string, extra []string) (*HTMLFormat, error) {
 func (f *HTMLFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/html")
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
-	return errors.WithStack(f.t.Execute(w, struct {
+	return executeLocalized(w, f.t, struct {
 		Keys  []*jsonhkp.PrimaryKey
 		Query *Lookup
-	}{wireKeys, l}))
+	}{wireKeys, l})
 }
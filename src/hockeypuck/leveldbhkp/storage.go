@@ -0,0 +1,525 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package leveldbhkp provides HKP storage in an embedded LevelDB database,
+// with an inverted index of user ID keywords for searches. It needs no
+// external services, so that a standalone keyserver can be run from a single
+// binary.
+package leveldbhkp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+const (
+	maxInsertErrors = 100
+	maxResults      = 100
+)
+
+// Keys are stored under the following prefixes. Index entries other than
+// md5Prefix end with a separator and the rfingerprint of the key they refer
+// to, so that a prefix scan finds all keys for an entry.
+const (
+	// rfingerprint -> record
+	keyPrefix = "k:"
+	// md5 -> rfingerprint
+	md5Prefix = "m:"
+	// subkey rfingerprint, rfingerprint -> ""
+	subKeyPrefix = "s:"
+	// keyword, rfingerprint -> ""
+	keywordPrefix = "w:"
+	// modification time, rfingerprint -> ""
+	mtimePrefix = "t:"
+
+	sep = "\x00"
+)
+
+// record is the stored form of a key.
+type record struct {
+	MD5      string
+	CTime    time.Time
+	MTime    time.Time
+	SubKeys  []string
+	Keywords []string
+	Packets  []byte
+}
+
+type storage struct {
+	db *leveldb.DB
+
+	// wmu serializes changes to keys, which read the stored record to find
+	// the index entries to be replaced.
+	wmu sync.Mutex
+
+	// clock provides the creation and modification times of keys.
+	clock hkpstorage.Clock
+
+	hkpstorage.Listeners
+}
+
+var _ hkpstorage.Storage = (*storage)(nil)
+
+// Option modifies LevelDB storage.
+type Option func(*storage)
+
+// Clock sets the clock providing the creation and modification times of
+// keys.
+func Clock(clock hkpstorage.Clock) Option {
+	return func(st *storage) { st.clock = clock }
+}
+
+// Open returns storage in the LevelDB database at path, which is created if
+// it does not exist.
+func Open(path string, options ...Option) (hkpstorage.Storage, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+	st := &storage{db: db, clock: hkpstorage.SystemClock}
+	for _, option := range options {
+		option(st)
+	}
+	return st, nil
+}
+
+func init() {
+	// The data source is the directory of the database.
+	hkpstorage.Register("leveldb", func(dsn string, _ *hkpstorage.Config) (hkpstorage.Storage, error) {
+		return Open(hkpstorage.DSNPath(dsn))
+	})
+}
+
+func (st *storage) Close() error {
+	return errors.WithStack(st.db.Close())
+}
+
+func (st *storage) getRecord(rfp string) (*record, error) {
+	data, err := st.db.Get([]byte(keyPrefix+rfp), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, hkpstorage.ErrKeyNotFound
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var rec record
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&rec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid record for rfp=%q", rfp)
+	}
+	return &rec, nil
+}
+
+// refs returns the rfingerprints at the end of the keys under prefix.
+func (st *storage) refs(prefix string, limit int) ([]string, error) {
+	it := st.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer it.Release()
+	var result []string
+	for it.Next() {
+		result = append(result, ref(it))
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result, errors.WithStack(it.Error())
+}
+
+func ref(it iterator.Iterator) string {
+	k := string(it.Key())
+	return k[strings.LastIndex(k, sep)+1:]
+}
+
+func mtimeKey(t time.Time, rfp string) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(t.UnixNano()))
+	return []byte(mtimePrefix + string(buf[:]) + sep + rfp)
+}
+
+func (st *storage) MatchMD5(md5s []string) ([]string, error) {
+	var result []string
+	for _, md5 := range md5s {
+		rfp, err := st.db.Get([]byte(md5Prefix+strings.ToLower(md5)), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, string(rfp))
+	}
+	return result, nil
+}
+
+// Resolve returns all keys matching each key ID, by their own fingerprint or
+// that of a subkey, in rfingerprint order.
+func (st *storage) Resolve(keyids []string) ([]string, error) {
+	var result []string
+	for _, keyid := range keyids {
+		keyid = strings.ToLower(keyid)
+		_, err := hex.DecodeString(keyid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key ID %q", keyid)
+		}
+		matches := map[string]bool{}
+		it := st.db.NewIterator(util.BytesPrefix([]byte(keyPrefix+keyid)), nil)
+		for it.Next() {
+			matches[string(it.Key()[len(keyPrefix):])] = true
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rfps, err := st.refs(subKeyPrefix+keyid, 0)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, rfp := range rfps {
+			matches[rfp] = true
+		}
+		result = append(result, sortedKeys(matches)...)
+	}
+	return result, nil
+}
+
+// MatchKeyword returns the keys matching all of the words in each search
+// term, as keywords are extracted from user IDs.
+func (st *storage) MatchKeyword(search []string) ([]string, error) {
+	var result []string
+	for _, term := range search {
+		var matches map[string]bool
+		for _, word := range strings.Fields(strings.ToLower(term)) {
+			word = strings.Trim(word, "<>")
+			rfps, err := st.refs(keywordPrefix+word+sep, 0)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			next := map[string]bool{}
+			for _, rfp := range rfps {
+				if matches == nil || matches[rfp] {
+					next[rfp] = true
+				}
+			}
+			matches = next
+		}
+		rfps := sortedKeys(matches)
+		if len(rfps) > maxResults {
+			rfps = rfps[:maxResults]
+		}
+		result = append(result, rfps...)
+	}
+	return result, nil
+}
+
+// ModifiedSince returns keys modified since the given time, most recently
+// modified first.
+func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
+	it := st.db.NewIterator(util.BytesPrefix([]byte(mtimePrefix)), nil)
+	defer it.Release()
+	// Keys modified at exactly t sort before the upper bound of its entries.
+	since := mtimeKey(t, "\xff")
+	var result []string
+	for ok := it.Last(); ok && len(result) < maxResults; ok = it.Prev() {
+		if bytes.Compare(it.Key(), since) <= 0 {
+			break
+		}
+		result = append(result, ref(it))
+	}
+	return result, errors.WithStack(it.Error())
+}
+
+func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := st.FetchKeyrings(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
+	var result []*hkpstorage.Keyring
+	for _, rfp := range rfps {
+		_, err := hex.DecodeString(rfp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
+		}
+		rfp = strings.ToLower(rfp)
+		rec, err := st.getRecord(rfp)
+		if hkpstorage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		key, err := readOneKey(rec.Packets, rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, &hkpstorage.Keyring{
+			PrimaryKey: key,
+			CTime:      rec.CTime,
+			MTime:      rec.MTime,
+		})
+	}
+	return result, nil
+}
+
+func readOneKey(data []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) != 1 {
+		return nil, errors.Errorf("expected one key for rfp=%q, found %d", rfingerprint, len(keys))
+	}
+	if keys[0].RFingerprint != rfingerprint {
+		return nil, errors.Errorf("RFingerprint mismatch: expected=%q got=%q",
+			rfingerprint, keys[0].RFingerprint)
+	}
+	return keys[0], nil
+}
+
+// put writes key to batch, replacing the index entries of prev, the key's
+// currently stored record, if any.
+func (st *storage) put(batch *leveldb.Batch, key *openpgp.PrimaryKey, prev *record) error {
+	openpgp.Sort(key)
+	var packets bytes.Buffer
+	err := openpgp.WritePackets(&packets, key)
+	if err != nil {
+		return errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+	}
+	now := st.clock.Now()
+	rec := &record{
+		MD5:      key.MD5,
+		CTime:    now,
+		MTime:    now,
+		SubKeys:  subkeys(key),
+		Keywords: hkpstorage.Keywords(key),
+		Packets:  packets.Bytes(),
+	}
+	if prev != nil {
+		rec.CTime = prev.CTime
+		st.deleteIndexes(batch, key.RFingerprint, prev)
+	}
+	var data bytes.Buffer
+	err = gob.NewEncoder(&data).Encode(rec)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	batch.Put([]byte(keyPrefix+key.RFingerprint), data.Bytes())
+	batch.Put([]byte(md5Prefix+rec.MD5), []byte(key.RFingerprint))
+	batch.Put(mtimeKey(rec.MTime, key.RFingerprint), nil)
+	for _, rsubfp := range rec.SubKeys {
+		batch.Put([]byte(subKeyPrefix+rsubfp+sep+key.RFingerprint), nil)
+	}
+	for _, keyword := range rec.Keywords {
+		batch.Put([]byte(keywordPrefix+keyword+sep+key.RFingerprint), nil)
+	}
+	return nil
+}
+
+func (st *storage) deleteIndexes(batch *leveldb.Batch, rfp string, rec *record) {
+	batch.Delete([]byte(md5Prefix + rec.MD5))
+	batch.Delete(mtimeKey(rec.MTime, rfp))
+	for _, rsubfp := range rec.SubKeys {
+		batch.Delete([]byte(subKeyPrefix + rsubfp + sep + rfp))
+	}
+	for _, keyword := range rec.Keywords {
+		batch.Delete([]byte(keywordPrefix + keyword + sep + rfp))
+	}
+}
+
+// Insert inserts keys which are not already stored, and merges those which
+// are into the stored key.
+func (st *storage) Insert(keys []*openpgp.PrimaryKey) (u, n int, retErr error) {
+	var result hkpstorage.InsertError
+	for _, key := range keys {
+		if count, max := len(result.Errors), maxInsertErrors; count > max {
+			result.Errors = append(result.Errors,
+				errors.Errorf("too many insert errors (%d > %d), bailing...", count, max))
+			return u, n, result
+		}
+
+		kc, err := st.insert(key)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		switch kc.(type) {
+		case hkpstorage.KeyAdded:
+			n++
+		case hkpstorage.KeyReplaced:
+			u++
+		case hkpstorage.KeyNotChanged:
+			result.Duplicates = append(result.Duplicates, key)
+			continue
+		}
+		st.Notify(kc)
+	}
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return u, n, result
+	}
+	return u, n, nil
+}
+
+func (st *storage) insert(key *openpgp.PrimaryKey) (hkpstorage.KeyChange, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	prev, err := st.getRecord(key.RFingerprint)
+	if hkpstorage.IsNotFound(err) {
+		var batch leveldb.Batch
+		err = st.put(&batch, key, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		err = st.db.Write(&batch, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot insert rfp=%q", key.RFingerprint)
+		}
+		return hkpstorage.KeyAdded{ID: key.Fingerprint(), Digest: key.MD5}, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	lastKey, err := readOneKey(prev.Packets, key.RFingerprint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lastID := lastKey.Fingerprint()
+	lastMD5 := lastKey.MD5
+	err = openpgp.Merge(lastKey, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if lastKey.MD5 == lastMD5 {
+		return hkpstorage.KeyNotChanged{ID: lastID, Digest: lastMD5}, nil
+	}
+	var batch leveldb.Batch
+	err = st.put(&batch, lastKey, prev)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = st.db.Write(&batch, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot update rfp=%q", key.RFingerprint)
+	}
+	return hkpstorage.KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.Fingerprint(), NewDigest: lastKey.MD5}, nil
+}
+
+func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	prev, err := st.getRecord(key.RFingerprint)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if prev.MD5 != lastMD5 {
+		return errors.Wrapf(hkpstorage.ErrUpdateConflict, "update of rfp=%q from md5=%q", key.RFingerprint, lastMD5)
+	}
+	var batch leveldb.Batch
+	err = st.put(&batch, key, prev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = st.db.Write(&batch, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	st.Notify(hkpstorage.KeyReplaced{
+		OldID:     lastID,
+		OldDigest: lastMD5,
+		NewID:     key.Fingerprint(),
+		NewDigest: key.MD5,
+	})
+	return nil
+}
+
+func (st *storage) Replace(key *openpgp.PrimaryKey) (string, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	var md5 string
+	prev, err := st.getRecord(key.RFingerprint)
+	if err == nil {
+		md5 = prev.MD5
+	} else if !hkpstorage.IsNotFound(err) {
+		return "", errors.WithStack(err)
+	}
+	var batch leveldb.Batch
+	err = st.put(&batch, key, prev)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return md5, errors.WithStack(st.db.Write(&batch, nil))
+}
+
+func (st *storage) Delete(fp string) (string, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	rfp := openpgp.Reverse(strings.ToLower(fp))
+	prev, err := st.getRecord(rfp)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	var batch leveldb.Batch
+	st.deleteIndexes(&batch, rfp, prev)
+	batch.Delete([]byte(keyPrefix + rfp))
+	return prev.MD5, errors.WithStack(st.db.Write(&batch, nil))
+}
+
+func subkeys(key *openpgp.PrimaryKey) []string {
+	var result []string
+	for _, subkey := range key.SubKeys {
+		result = append(result, subkey.RFingerprint)
+	}
+	return result
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (st *storage) RenotifyAll() error {
+	it := st.db.NewIterator(util.BytesPrefix([]byte(md5Prefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		st.Notify(hkpstorage.KeyAdded{Digest: string(it.Key()[len(md5Prefix):])})
+	}
+	return errors.WithStack(it.Error())
+}
@@ -0,0 +1,216 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldbhkp
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type StorageSuite struct {
+	path string
+	st   hkpstorage.Storage
+}
+
+var _ = gc.Suite(&StorageSuite{})
+
+func (s *StorageSuite) SetUpTest(c *gc.C) {
+	s.path = c.MkDir()
+	var err error
+	s.st, err = Open(s.path)
+	c.Assert(err, gc.IsNil)
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"alice_signed.asc", "uat.asc", "e68e311d.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	u, n, err := s.st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(u, gc.Equals, 0)
+	c.Assert(n, gc.Equals, 3)
+}
+
+func (s *StorageSuite) TearDownTest(c *gc.C) {
+	if s.st != nil {
+		s.st.Close()
+	}
+}
+
+func (s *StorageSuite) TestResolve(c *gc.C) {
+	// Key ID, fingerprint, subkey ID, and an unknown key ID.
+	rfps, err := s.st.Resolve([]string{
+		"accd0e32",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+		"9ac8abc6",
+		"deadbeef",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{
+		"accd0e320f1cb163a2aa9305257f384b1fc8ef01",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+		"bd1d2a44ad26397fada207187bf98ce7eee97218",
+	})
+}
+
+func (s *StorageSuite) TestFetchKeys(c *gc.C) {
+	rfps := []string{
+		"bd1d2a44ad26397fada207187bf98ce7eee97218",
+		"d113e86ebae6324d2fa392ff64a66194a1b6c7d8",
+	}
+	keys, err := s.st.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 2)
+	for i, key := range keys {
+		c.Assert(key.RFingerprint, gc.Equals, rfps[i])
+	}
+	c.Assert(keys[0].MD5, gc.Equals, "16283c09a091f558ca9e9257822fe7e5")
+
+	rfps, err = s.st.MatchMD5([]string{"8E433EC97018E80A3E1BC26BE0693A07"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"d113e86ebae6324d2fa392ff64a66194a1b6c7d8"})
+}
+
+func (s *StorageSuite) TestMatchKeyword(c *gc.C) {
+	rfps, err := s.st.MatchKeyword([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	rfps, err = s.st.MatchKeyword([]string{"Casey Marshall"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+
+	rfps, err = s.st.MatchKeyword([]string{"casey gmail.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"bd1d2a44ad26397fada207187bf98ce7eee97218"})
+}
+
+func (s *StorageSuite) TestModifiedSince(c *gc.C) {
+	rfps, err := s.st.ModifiedSince(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 3)
+
+	rfps, err = s.st.ModifiedSince(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *StorageSuite) TestMerge(c *gc.C) {
+	var changes []hkpstorage.KeyChange
+	s.st.Subscribe(func(kc hkpstorage.KeyChange) error {
+		changes = append(changes, kc)
+		return nil
+	})
+
+	// Inserting the same key again changes nothing.
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	_, _, err := s.st.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(hkpstorage.Duplicates(err), gc.HasLen, 1)
+	c.Assert(changes, gc.HasLen, 0)
+
+	// Certifications missing from the stored key are merged into it.
+	unsigned := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	_, err = s.st.Replace(unsigned)
+	c.Assert(err, gc.IsNil)
+	u, n, err := s.st.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u, gc.Equals, 1)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].RemoveDigests(), gc.DeepEquals, []string{unsigned.MD5})
+
+	keys, err := s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes[0].InsertDigests(), gc.DeepEquals, []string{keys[0].MD5})
+	rfps, err := s.st.MatchMD5([]string{unsigned.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *StorageSuite) TestDelete(c *gc.C) {
+	md5, err := s.st.Delete("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	c.Assert(md5, gc.Not(gc.Equals), "")
+	_, err = s.st.Delete("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+
+	rfps, err := s.st.Resolve([]string{"accd0e32"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	rfps, err = s.st.MatchKeyword([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	rfps, err = s.st.ModifiedSince(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+}
+
+func (s *StorageSuite) TestReplace(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	keys, err := s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	md5, err := s.st.Replace(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(md5, gc.Equals, keys[0].MD5)
+
+	keys, err = s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *StorageSuite) TestUpdateConflict(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	keys, err := s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	stored := keys[0].MD5
+
+	// An update merged with a version of the key no longer stored is refused.
+	err = s.st.Update(key, key.KeyID(), "0123456789abcdef0123456789abcdef")
+	c.Assert(hkpstorage.IsUpdateConflict(err), gc.Equals, true, gc.Commentf("%v", err))
+	keys, err = s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, stored)
+
+	err = s.st.Update(key, key.KeyID(), stored)
+	c.Assert(err, gc.IsNil)
+	keys, err = s.st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *StorageSuite) TestReopen(c *gc.C) {
+	c.Assert(s.st.Close(), gc.IsNil)
+	var err error
+	s.st, err = Open(s.path)
+	c.Assert(err, gc.IsNil)
+
+	var digests []string
+	s.st.Subscribe(func(kc hkpstorage.KeyChange) error {
+		digests = append(digests, kc.InsertDigests()...)
+		return nil
+	})
+	err = s.st.RenotifyAll()
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 3)
+}
@@ -0,0 +1,173 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// Attestation key signatures allow the owner of a key to approve the
+// third-party certifications on its user IDs and user attributes which may
+// be distributed with it, draft-ietf-openpgp-rfc4880bis section 5.2.3.30.
+const (
+	SigTypeAttestation = 0x16
+
+	SubpacketAttestedCertifications = 37
+)
+
+// attestedDigests returns the digests of the certifications approved by the
+// most recent valid attestation key signature among sigs, made over a user
+// ID or user attribute by verify.
+func attestedDigests(key *PrimaryKey, sigs []*Signature, verify func(*Signature) error) (map[string]bool, crypto.Hash) {
+	var latest *Signature
+	for _, sig := range sigs {
+		if sig.SigType != SigTypeAttestation || !isSelfIssued(key, sig) {
+			continue
+		}
+		if latest != nil && !sig.Creation.After(latest.Creation) {
+			continue
+		}
+		if verify(sig) != nil {
+			continue
+		}
+		latest = sig
+	}
+	if latest == nil {
+		return nil, 0
+	}
+	s, err := latest.signaturePacket()
+	if err != nil {
+		return nil, 0
+	}
+	subpackets, err := latest.Subpackets()
+	if err != nil {
+		return nil, 0
+	}
+	size := s.Hash.Size()
+	digests := map[string]bool{}
+	for _, sp := range subpackets {
+		if sp.Type != SubpacketAttestedCertifications || !sp.Hashed {
+			continue
+		}
+		for i := 0; i+size <= len(sp.Data); i += size {
+			digests[hex.EncodeToString(sp.Data[i:i+size])] = true
+		}
+	}
+	return digests, s.Hash
+}
+
+// attestationDigest returns the digest by which an attestation key signature
+// approves a certification, calculated with the given hash function as for
+// a third-party confirmation signature: over the certification packet body
+// without its unhashed subpackets.
+func attestationDigest(sig *Signature, hashFunc crypto.Hash) (string, error) {
+	if !hashFunc.Available() {
+		return "", errors.Errorf("unsupported hash function: %v", hashFunc)
+	}
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	body := op.Contents
+	// version, type, public key algorithm, hash algorithm, hashed length
+	if len(body) < 6 || body[0] != 4 {
+		return "", errors.WithStack(ErrInvalidPacketType)
+	}
+	hashedEnd := 6 + int(binary.BigEndian.Uint16(body[4:]))
+	if len(body) < hashedEnd+2 {
+		return "", errors.WithStack(errTruncatedSubpacket)
+	}
+	unhashedEnd := hashedEnd + 2 + int(binary.BigEndian.Uint16(body[hashedEnd:]))
+	if len(body) < unhashedEnd {
+		return "", errors.WithStack(errTruncatedSubpacket)
+	}
+	stripped := make([]byte, 0, hashedEnd+2+len(body)-unhashedEnd)
+	stripped = append(stripped, body[:hashedEnd]...)
+	stripped = append(stripped, 0, 0)
+	stripped = append(stripped, body[unhashedEnd:]...)
+
+	h := hashFunc.New()
+	var header [5]byte
+	header[0] = 0x88
+	binary.BigEndian.PutUint32(header[1:], uint32(len(stripped)))
+	h.Write(header[:])
+	h.Write(stripped)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// attestedSigs returns sigs without the third-party certifications not
+// approved by the latest attestation among them, and the number dropped.
+func attestedSigs(key *PrimaryKey, sigs []*Signature, verify func(*Signature) error) ([]*Signature, int) {
+	var attested map[string]bool
+	var hashFunc crypto.Hash
+	var resolved bool
+	kept := make([]*Signature, 0, len(sigs))
+	for _, sig := range sigs {
+		if isSelfIssued(key, sig) {
+			kept = append(kept, sig)
+			continue
+		}
+		if !resolved {
+			attested, hashFunc = attestedDigests(key, sigs, verify)
+			resolved = true
+		}
+		if len(attested) > 0 {
+			digest, err := attestationDigest(sig, hashFunc)
+			if err == nil && attested[digest] {
+				kept = append(kept, sig)
+			}
+		}
+	}
+	return kept, len(sigs) - len(kept)
+}
+
+// StripUnattestedCertifications drops the third-party certifications on
+// each user ID and user attribute of key which have not been approved by the
+// key's owner in an attestation key signature, returning the number
+// dropped. Self-signatures are always kept.
+func StripUnattestedCertifications(key *PrimaryKey) (int, error) {
+	var dropped int
+	for _, uid := range key.UserIDs {
+		var n int
+		uid.Signatures, n = attestedSigs(key, uid.Signatures, func(sig *Signature) error {
+			return key.checkUserIDSig(uid, sig)
+		})
+		dropped += n
+	}
+	for _, uat := range key.UserAttributes {
+		var n int
+		uat.Signatures, n = attestedSigs(key, uat.Signatures, func(sig *Signature) error {
+			return key.checkUserAttrSig(uat, sig)
+		})
+		dropped += n
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	log.WithFields(log.Fields{
+		"fp":      key.Fingerprint(),
+		"dropped": dropped,
+	}).Debug("stripped unattested certifications")
+	return dropped, errors.WithStack(key.updateMD5())
+}
@@ -0,0 +1,129 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Blocklist is a set of fingerprints and user ID patterns which may be
+// changed while keys are being read. Entries are grouped by the source they
+// came from, such as an externally maintained list, so that each source can
+// be replaced independently of the others.
+type Blocklist struct {
+	mu      sync.RWMutex
+	sources map[string]*blocklistEntries
+}
+
+type blocklistEntries struct {
+	fps  map[string]bool
+	uids []*regexp.Regexp
+}
+
+// NewBlocklist returns an empty Blocklist.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{sources: map[string]*blocklistEntries{}}
+}
+
+// Set replaces the entries from source with the given fingerprints and user
+// ID patterns. It returns the fingerprints which are newly blocked, and
+// those no longer blocked by any source.
+func (b *Blocklist) Set(source string, fps []string, uids []*regexp.Regexp) (added, removed []string) {
+	entries := &blocklistEntries{fps: map[string]bool{}, uids: uids}
+	for _, fp := range fps {
+		entries.fps[strings.ToLower(fp)] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.sources[source]
+	b.sources[source] = entries
+	for fp := range entries.fps {
+		if prev != nil && prev.fps[fp] {
+			continue
+		}
+		if !b.blockedByOthers(source, fp) {
+			added = append(added, fp)
+		}
+	}
+	if prev != nil {
+		for fp := range prev.fps {
+			if !entries.fps[fp] && !b.blockedByOthers(source, fp) {
+				removed = append(removed, fp)
+			}
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func (b *Blocklist) blockedByOthers(source, fp string) bool {
+	for name, entries := range b.sources {
+		if name != source && entries.fps[fp] {
+			return true
+		}
+	}
+	return false
+}
+
+// BlocksFingerprint returns whether the key with the given fingerprint is
+// blocked.
+func (b *Blocklist) BlocksFingerprint(fp string) bool {
+	fp = strings.ToLower(fp)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, entries := range b.sources {
+		if entries.fps[fp] {
+			return true
+		}
+	}
+	return false
+}
+
+// BlocksUserID returns whether keys with the given user ID are blocked.
+func (b *Blocklist) BlocksUserID(uid string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, entries := range b.sources {
+		for _, re := range entries.uids {
+			if re.MatchString(uid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Len returns the number of distinct fingerprints and the number of user ID
+// patterns blocked.
+func (b *Blocklist) Len() (fps int, uids int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	seen := map[string]bool{}
+	for _, entries := range b.sources {
+		for fp := range entries.fps {
+			seen[fp] = true
+		}
+		uids += len(entries.uids)
+	}
+	return len(seen), uids
+}
@@ -0,0 +1,118 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Key flags, RFC 4880 section 5.2.3.21, in the first octet of the key flags
+// subpacket.
+const (
+	KeyFlagCertify               = 0x01
+	KeyFlagSign                  = 0x02
+	KeyFlagEncryptCommunications = 0x04
+	KeyFlagEncryptStorage        = 0x08
+	KeyFlagAuthenticate          = 0x20
+
+	KeyFlagEncrypt = KeyFlagEncryptCommunications | KeyFlagEncryptStorage
+)
+
+var keyFlagNames = map[string]byte{
+	"certify":      KeyFlagCertify,
+	"sign":         KeyFlagSign,
+	"encrypt":      KeyFlagEncrypt,
+	"authenticate": KeyFlagAuthenticate,
+}
+
+// ParseKeyFlags parses a comma-separated list of capabilities: certify,
+// sign, encrypt and authenticate.
+func ParseKeyFlags(s string) (byte, error) {
+	var flags byte
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		flag, ok := keyFlagNames[name]
+		if !ok {
+			return 0, errors.Errorf("unknown capability %q", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// algorithmCodes are the public key algorithm IDs by the names given by
+// AlgorithmName.
+var algorithmCodes = map[string][]int{
+	"rsa":   {1, 2, 3},
+	"elg":   {16, 20},
+	"dsa":   {17},
+	"ecdh":  {18},
+	"ecdsa": {19},
+	"eddsa": {22},
+}
+
+// AlgorithmCodes returns the public key algorithm IDs with the given name,
+// as given by AlgorithmName, or nil if the name is unknown.
+func AlgorithmCodes(name string) []int {
+	return algorithmCodes[strings.ToLower(name)]
+}
+
+// algorithmFlags returns the capabilities of a key with no key flags, which
+// are those its algorithm allows.
+func algorithmFlags(algorithm int, primary bool) byte {
+	var flags byte
+	switch algorithm {
+	case 1:
+		flags = KeyFlagSign | KeyFlagEncrypt
+	case 2, 16, 18, 20:
+		flags = KeyFlagEncrypt
+	case 3, 17, 19, 22:
+		flags = KeyFlagSign
+	}
+	if primary && flags&KeyFlagSign != 0 {
+		flags |= KeyFlagCertify
+	}
+	return flags
+}
+
+// KeyCapabilities returns the key flags of a key and of its subkeys with a
+// valid binding combined, as given by their most recent self-signatures,
+// or allowed by their algorithms where these give none.
+func KeyCapabilities(key *PrimaryKey) byte {
+	flags := algorithmFlags(key.Algorithm, true)
+	if latest := latestSelfCertification(key); latest != nil && len(latest.KeyFlags) > 0 {
+		flags = latest.KeyFlags[0]
+	}
+	for _, subKey := range key.SubKeys {
+		if subKey.BindingStatus(key) != BindingValid {
+			continue
+		}
+		ss, _ := subKey.SigInfo(key)
+		if len(ss.Certifications) > 0 && len(ss.Certifications[0].Signature.KeyFlags) > 0 {
+			flags |= ss.Certifications[0].Signature.KeyFlags[0]
+		} else {
+			flags |= algorithmFlags(subKey.Algorithm, false)
+		}
+	}
+	return flags
+}
@@ -0,0 +1,141 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// CriticalSubpacketPolicy determines what becomes of signatures carrying
+// critical subpackets which the packet parser does not understand, RFC 4880
+// section 5.2.3.1. Such signatures cannot be parsed, and are otherwise kept
+// as unparsed packets.
+type CriticalSubpacketPolicy int
+
+const (
+	// CriticalSubpacketsRetain keeps such signatures as opaque packets,
+	// unmodified, so that they are served and merged as they were received.
+	CriticalSubpacketsRetain CriticalSubpacketPolicy = iota
+	// CriticalSubpacketsReject drops such signatures.
+	CriticalSubpacketsReject
+)
+
+var criticalSubpacketPolicies = map[string]CriticalSubpacketPolicy{
+	"":       CriticalSubpacketsRetain,
+	"retain": CriticalSubpacketsRetain,
+	"reject": CriticalSubpacketsReject,
+}
+
+// ParseCriticalSubpacketPolicy returns the CriticalSubpacketPolicy with the
+// given name, which is "retain", "reject" or empty for
+// CriticalSubpacketsRetain.
+func ParseCriticalSubpacketPolicy(s string) (CriticalSubpacketPolicy, error) {
+	policy, ok := criticalSubpacketPolicies[s]
+	if !ok {
+		return 0, errors.Errorf("invalid critical subpacket policy %q", s)
+	}
+	return policy, nil
+}
+
+// parsedSubpackets are the signature subpacket types interpreted by the
+// packet parser. A signature with any other critical subpacket fails to
+// parse.
+var parsedSubpackets = map[int]bool{
+	2:                          true, // signature creation time
+	3:                          true, // signature expiration time
+	9:                          true, // key expiration time
+	11:                         true, // preferred symmetric algorithms
+	16:                         true, // issuer
+	21:                         true, // preferred hash algorithms
+	22:                         true, // preferred compression algorithms
+	25:                         true, // primary user ID
+	27:                         true, // key flags
+	29:                         true, // reason for revocation
+	SubpacketFeatures:          true,
+	SubpacketEmbeddedSignature: true,
+}
+
+// unknownCriticalSubpackets returns the types of the critical subpackets of
+// a signature packet which the packet parser does not understand.
+func unknownCriticalSubpackets(p *Packet) ([]int, error) {
+	if p.Tag != 2 {
+		return nil, nil
+	}
+	op, err := p.opaquePacket()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	subpackets, err := parseSubpackets(op.Contents)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []int
+	for _, sp := range subpackets {
+		if sp.Critical && !parsedSubpackets[sp.Type] {
+			result = append(result, sp.Type)
+		}
+	}
+	return result, nil
+}
+
+// CriticalSubpacketWarnings lints key for signatures carrying critical
+// subpackets which the packet parser does not understand, returning a
+// description of each. Such signatures are neither verified nor interpreted.
+func CriticalSubpacketWarnings(key *PrimaryKey) []string {
+	var warnings []string
+	for _, other := range key.Others {
+		types, err := unknownCriticalSubpackets(other)
+		if err != nil {
+			continue
+		}
+		for _, t := range types {
+			warnings = append(warnings, fmt.Sprintf(
+				"signature %s has unknown critical subpacket type %d", other.UUID, t))
+		}
+	}
+	return warnings
+}
+
+// RejectUnknownCriticalSubpackets drops the signatures of key which carry
+// critical subpackets the packet parser does not understand, returning the
+// number dropped.
+func RejectUnknownCriticalSubpackets(key *PrimaryKey) (int, error) {
+	var kept []*Packet
+	var dropped int
+	for _, other := range key.Others {
+		types, err := unknownCriticalSubpackets(other)
+		if err == nil && len(types) > 0 {
+			dropped++
+			continue
+		}
+		kept = append(kept, other)
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	key.Others = kept
+	log.WithFields(log.Fields{
+		"fp":      key.Fingerprint(),
+		"dropped": dropped,
+	}).Debug("rejected signatures with unknown critical subpackets")
+	return dropped, errors.WithStack(key.updateMD5())
+}
@@ -0,0 +1,60 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"time"
+)
+
+// InactiveSince returns the time since which the key has been unusable, either
+// because the primary key was revoked or because it has expired. If the key
+// is still usable, ok is false.
+func InactiveSince(key *PrimaryKey) (_ time.Time, ok bool) {
+	ss, _ := key.SigInfo()
+	if revoked, ok := ss.RevokedSince(); ok {
+		return revoked, true
+	}
+	if !key.Expiration.IsZero() {
+		// Only version 3 keys carry their expiration in the key packet.
+		if key.Expiration.Before(now()) {
+			return key.Expiration, true
+		}
+		return zeroTime, false
+	}
+
+	// The key expires when the most recent self-certification of every user
+	// ID has expired.
+	var expiresAt time.Time
+	for _, uid := range key.UserIDs {
+		ss, _ := uid.SigInfo(key)
+		if len(ss.Certifications) == 0 {
+			continue
+		}
+		latest := ss.Certifications[0].Signature.Expiration
+		if latest.IsZero() {
+			return zeroTime, false
+		}
+		if latest.After(expiresAt) {
+			expiresAt = latest
+		}
+	}
+	if expiresAt.IsZero() || expiresAt.After(now()) {
+		return zeroTime, false
+	}
+	return expiresAt, true
+}
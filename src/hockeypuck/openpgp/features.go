@@ -0,0 +1,105 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"fmt"
+)
+
+// Feature flags, RFC 9580 section 5.2.3.32, in the first octet of the
+// features subpacket.
+const (
+	FeatureSEIPDv1 = 0x01
+	FeatureSEIPDv2 = 0x08
+)
+
+var symmetricAlgorithmNames = map[int]string{
+	7:  "AES128",
+	8:  "AES192",
+	9:  "AES256",
+	10: "Twofish",
+	11: "Camellia128",
+	12: "Camellia192",
+	13: "Camellia256",
+}
+
+var aeadModeNames = map[int]string{
+	1: "EAX",
+	2: "OCB",
+	3: "GCM",
+}
+
+// AEADCiphersuite is a combination of symmetric cipher and AEAD mode, RFC
+// 9580 section 5.2.3.15, identified by their algorithm IDs.
+type AEADCiphersuite struct {
+	Cipher int
+	Mode   int
+}
+
+// String returns the names of the cipher and mode, such as "AES256/OCB".
+func (cs AEADCiphersuite) String() string {
+	cipher, ok := symmetricAlgorithmNames[cs.Cipher]
+	if !ok {
+		cipher = fmt.Sprintf("cipher%d", cs.Cipher)
+	}
+	mode, ok := aeadModeNames[cs.Mode]
+	if !ok {
+		mode = fmt.Sprintf("mode%d", cs.Mode)
+	}
+	return cipher + "/" + mode
+}
+
+// parseAEADCiphersuites parses the body of a preferred AEAD ciphersuites
+// subpacket, a list of pairs of octets. A trailing odd octet is ignored.
+func parseAEADCiphersuites(data []byte) []AEADCiphersuite {
+	var result []AEADCiphersuite
+	for i := 0; i+1 < len(data); i += 2 {
+		result = append(result, AEADCiphersuite{Cipher: int(data[i]), Mode: int(data[i+1])})
+	}
+	return result
+}
+
+// EncryptionFeatures are the encryption capabilities advertised by the owner
+// of a key.
+type EncryptionFeatures struct {
+	// SEIPDv1 and SEIPDv2 are set if the key can receive messages in
+	// version 1 or version 2 Symmetrically Encrypted Integrity Protected
+	// Data packets.
+	SEIPDv1 bool
+	SEIPDv2 bool
+
+	// AEADCiphersuites are the preferred ciphersuites for SEIPDv2, in order
+	// of preference.
+	AEADCiphersuites []AEADCiphersuite
+}
+
+// KeyEncryptionFeatures returns the encryption capabilities stated in the
+// most recent valid self-certification of the key's user IDs, or nil if
+// it states none.
+func KeyEncryptionFeatures(key *PrimaryKey) *EncryptionFeatures {
+	latest := latestSelfCertification(key)
+	if latest == nil || (len(latest.Features) == 0 && len(latest.AEADCiphersuites) == 0) {
+		return nil
+	}
+	ef := &EncryptionFeatures{AEADCiphersuites: latest.AEADCiphersuites}
+	if len(latest.Features) > 0 {
+		ef.SEIPDv1 = latest.Features[0]&FeatureSEIPDv1 != 0
+		ef.SEIPDv2 = latest.Features[0]&FeatureSEIPDv2 != 0
+	}
+	return ef
+}
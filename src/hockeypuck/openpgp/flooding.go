@@ -0,0 +1,107 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// MostCertifications returns the greatest number of third-party
+// certifications on any one user ID or user attribute of key.
+func MostCertifications(key *PrimaryKey) int {
+	var most int
+	count := func(sigs []*Signature) {
+		var n int
+		for _, sig := range sigs {
+			if !isSelfIssued(key, sig) {
+				n++
+			}
+		}
+		if n > most {
+			most = n
+		}
+	}
+	for _, uid := range key.UserIDs {
+		count(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		count(uat.Signatures)
+	}
+	return most
+}
+
+// IssuerID returns the reversed fingerprint of the issuer of sig if the
+// signature records it, or its reversed key ID otherwise. Either is a prefix
+// of the RFingerprint of the issuer's key.
+func IssuerID(sig *Signature) string {
+	if sig.IssuerFingerprint != "" {
+		return Reverse(sig.IssuerFingerprint)
+	}
+	return sig.RIssuerKeyID
+}
+
+// StripUnverifiedCertifications drops the third-party certifications on
+// the user IDs and user attributes of key which are not verified by any of
+// the keys returned by signers for them, returning the number dropped.
+// Self-signatures are always kept.
+func StripUnverifiedCertifications(key *PrimaryKey, signers func(sig *Signature) []*PrimaryKey) (int, error) {
+	var dropped int
+	for _, uid := range key.UserIDs {
+		uid := uid
+		var n int
+		uid.Signatures, n = stripSigs(key, uid.Signatures, signers, func(signer *PrimaryKey, sig *Signature) error {
+			return VerifyUserIDCertification(signer, key, uid, sig)
+		})
+		dropped += n
+	}
+	for _, uat := range key.UserAttributes {
+		uat := uat
+		var n int
+		uat.Signatures, n = stripSigs(key, uat.Signatures, signers, func(signer *PrimaryKey, sig *Signature) error {
+			return VerifyUserAttributeCertification(signer, key, uat, sig)
+		})
+		dropped += n
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	log.WithFields(log.Fields{
+		"fp":      key.Fingerprint(),
+		"dropped": dropped,
+	}).Warn("stripped unverified certifications")
+	return dropped, errors.WithStack(key.updateMD5())
+}
+
+func stripSigs(key *PrimaryKey, sigs []*Signature, signers func(sig *Signature) []*PrimaryKey, verify func(signer *PrimaryKey, sig *Signature) error) ([]*Signature, int) {
+	kept := make([]*Signature, 0, len(sigs))
+	for _, sig := range sigs {
+		if isSelfIssued(key, sig) {
+			kept = append(kept, sig)
+			continue
+		}
+		for _, signer := range signers(sig) {
+			if verify(signer, sig) == nil {
+				kept = append(kept, sig)
+				break
+			}
+		}
+	}
+	return kept, len(sigs) - len(kept)
+}
@@ -29,8 +29,6 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
 	pgperrors "golang.org/x/crypto/openpgp/errors"
 	"golang.org/x/crypto/openpgp/packet"
 
@@ -70,37 +68,15 @@ func ArmorHeaderVersion(version string) KeyWriterOption {
 	}
 }
 
+// WritePackets writes all the packets of key to w.
 func WritePackets(w io.Writer, key *PrimaryKey) error {
-	for _, node := range key.contents() {
-		op, err := newOpaquePacket(node.packet().Packet)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		err = op.Serialize(w)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-	}
-	return nil
+	return NewKeyWriter().Write(w, key)
 }
 
+// WriteArmoredPackets writes all the packets of roots to w, in a single
+// ASCII-armored public key block.
 func WriteArmoredPackets(w io.Writer, roots []*PrimaryKey, options ...KeyWriterOption) error {
-	akwr, err := NewArmoredKeyWriter(options...)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	armw, err := armor.Encode(w, openpgp.PublicKeyType, akwr.headers)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	defer armw.Close()
-	for _, node := range roots {
-		err = WritePackets(armw, node)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-	}
-	return nil
+	return NewKeyWriter().WriteArmored(w, roots, options...)
 }
 
 type OpaqueKeyring struct {
@@ -225,7 +201,15 @@ type OpaqueKeyReader struct {
 	r            io.Reader
 	maxKeyLen    int
 	maxPacketLen int
+	maxArmorLen  int
+	maxPackets   int
+	maxUIDSigs   int
+	selfSigMode  SelfSigMode
+	attestedOnly bool
+	critical     CriticalSubpacketPolicy
 	blacklist    map[string]bool
+	blocklist    *Blocklist
+	suppressions *Suppressions
 }
 
 type KeyReaderOption func(*OpaqueKeyReader) error
@@ -255,6 +239,94 @@ func MaxPacketLen(maxPacketLen int) KeyReaderOption {
 	}
 }
 
+// MaxArmorLen limits the length of ASCII-armored key material decoded with
+// DecodeArmor. Longer input is refused with ErrKeyTooLarge.
+func MaxArmorLen(maxArmorLen int) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.maxArmorLen = maxArmorLen
+		return nil
+	}
+}
+
+// MaxPackets limits the total number of packets in a key. Keys with more
+// packets are dropped.
+func MaxPackets(maxPackets int) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.maxPackets = maxPackets
+		return nil
+	}
+}
+
+// MaxUserIDSignatures limits the number of third-party certifications on
+// each user ID or user attribute of the keys read. Keys with more are
+// truncated to the most recent, as TruncateCertifications does.
+func MaxUserIDSignatures(maxUIDSigs int) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.maxUIDSigs = maxUIDSigs
+		return nil
+	}
+}
+
+// SelfSigMode determines how the self-signatures of keys read are verified.
+type SelfSigMode int
+
+const (
+	// SelfSigsUnverified keeps self-signatures without verifying them.
+	SelfSigsUnverified SelfSigMode = iota
+	// SelfSigsPermissive drops self-signatures which fail to verify, such
+	// as forged bindings and signing subkey bindings without a valid
+	// back-signature, but keeps the packets they were made over.
+	SelfSigsPermissive
+	// SelfSigsStrict also drops the user IDs, user attributes and subkeys
+	// left without a valid self-signature.
+	SelfSigsStrict
+)
+
+var selfSigModes = map[string]SelfSigMode{
+	"":           SelfSigsUnverified,
+	"permissive": SelfSigsPermissive,
+	"strict":     SelfSigsStrict,
+}
+
+// ParseSelfSigMode returns the SelfSigMode with the given name, which is
+// "permissive", "strict" or empty for SelfSigsUnverified.
+func ParseSelfSigMode(s string) (SelfSigMode, error) {
+	mode, ok := selfSigModes[s]
+	if !ok {
+		return 0, errors.Errorf("invalid self-signature verification mode %q", s)
+	}
+	return mode, nil
+}
+
+// VerifySelfSigs verifies the self-signatures of the keys read, dropping
+// the packets which fail according to mode, as VerifySelfSignatures does.
+func VerifySelfSigs(mode SelfSigMode) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.selfSigMode = mode
+		return nil
+	}
+}
+
+// AttestedCertificationsOnly strips the third-party certifications of the
+// keys read which their owners have not approved in an attestation key
+// signature, as StripUnattestedCertifications does.
+func AttestedCertificationsOnly() KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.attestedOnly = true
+		return nil
+	}
+}
+
+// UnknownCriticalSubpackets determines what becomes of the signatures of the
+// keys read which carry critical subpackets the packet parser does not
+// understand. By default they are retained as opaque packets.
+func UnknownCriticalSubpackets(policy CriticalSubpacketPolicy) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.critical = policy
+		return nil
+	}
+}
+
 func Blacklist(blacklist []string) KeyReaderOption {
 	return func(or *OpaqueKeyReader) error {
 		for i := range blacklist {
@@ -264,6 +336,17 @@ func Blacklist(blacklist []string) KeyReaderOption {
 	}
 }
 
+// Blocklisted drops keys blocked by bl, either by fingerprint or because
+// one of their user IDs matches a blocked pattern. Unlike Blacklist, bl is
+// consulted as each key is read, so changes to it apply to readers already
+// configured with it.
+func Blocklisted(bl *Blocklist) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.blocklist = bl
+		return nil
+	}
+}
+
 func (r *OpaqueKeyReader) Read() ([]*OpaqueKeyring, error) {
 	or := packet.NewOpaqueReader(r.r)
 	var op *packet.OpaquePacket
@@ -284,6 +367,15 @@ PARSE:
 				continue
 			}
 		}
+		if op.Tag == 13 && current != nil && r.blocklist != nil && r.blocklist.BlocksUserID(string(op.Contents)) {
+			log.WithFields(log.Fields{
+				"fp": currentFingerprint,
+			}).Warn("blocklisted user ID")
+			current = nil
+			currentKeyLen = 0
+			currentFingerprint = ""
+			continue
+		}
 		switch op.Tag {
 		case 6: //packet.PacketTypePublicKey:
 			if current != nil {
@@ -306,6 +398,18 @@ PARSE:
 					continue PARSE
 				}
 			}
+			if r.blocklist != nil && r.blocklist.BlocksFingerprint(fp) {
+				log.WithFields(log.Fields{
+					"fp": fp,
+				}).Warn("blocklisted key")
+				continue PARSE
+			}
+			if r.suppressions != nil && r.suppressions.SuppressesFingerprint(fp) {
+				log.WithFields(log.Fields{
+					"fp": fp,
+				}).Warn("suppressed key")
+				continue PARSE
+			}
 			current = &OpaqueKeyring{}
 			current.setPosition(r.r)
 			currentKeyLen = 0
@@ -333,6 +437,17 @@ PARSE:
 				currentFingerprint = ""
 				continue
 			}
+			if r.maxPackets > 0 && len(current.Packets) > r.maxPackets {
+				log.WithFields(log.Fields{
+					"packets": len(current.Packets),
+					"max":     r.maxPackets,
+					"fp":      currentFingerprint,
+				}).Warn("dropped key, max packets exceeded")
+				current = nil
+				currentKeyLen = 0
+				currentFingerprint = ""
+				continue
+			}
 		}
 	}
 	if current != nil {
@@ -413,6 +528,38 @@ func (r *KeyReader) readKeys() ([]*PrimaryKey, error) {
 		if err != nil {
 			return nil, err
 		}
+		if okr.critical == CriticalSubpacketsReject {
+			_, err = RejectUnknownCriticalSubpackets(result[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if okr.selfSigMode != SelfSigsUnverified {
+			_, err = VerifySelfSignatures(result[i], okr.selfSigMode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if okr.suppressions != nil {
+			_, err = EraseUserIDs(result[i], func(uid *UserID) bool {
+				return okr.suppressions.SuppressesUserID(uid.Keywords)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if okr.attestedOnly {
+			_, err = StripUnattestedCertifications(result[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if okr.maxUIDSigs > 0 {
+			_, err = TruncateCertifications(result[i], okr.maxUIDSigs)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	return result, nil
 }
@@ -427,7 +574,7 @@ func MustReadKeys(r io.Reader, options ...KeyReaderOption) []*PrimaryKey {
 }
 
 func ReadArmorKeys(r io.Reader, options ...KeyReaderOption) ([]*PrimaryKey, error) {
-	block, err := armor.Decode(r)
+	block, err := DecodeArmor(r, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -22,9 +22,11 @@ import (
 	"crypto/md5"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"sort"
 	"strings"
 	stdtesting "testing"
+	"time"
 
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
@@ -328,6 +330,153 @@ func (s *SamplePacketSuite) TestMaxKeyLenConcat(c *gc.C) {
 	c.Assert(keys[0].ShortID(), gc.Equals, "e68e311d")
 }
 
+func (s *SamplePacketSuite) TestMaxPackets(c *gc.C) {
+	keys, err := ReadArmorKeys(testing.MustInput("weasel.asc"), MaxPackets(1000))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+	keys, err = ReadArmorKeys(testing.MustInput("weasel.asc"), MaxPackets(2000))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+}
+
+func (s *SamplePacketSuite) TestMaxUserIDSignatures(c *gc.C) {
+	full := MustInputAscKey("weasel.asc")
+	keys, err := ReadArmorKeys(testing.MustInput("weasel.asc"), MaxUserIDSignatures(10))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	c.Assert(key.MD5, gc.Not(gc.Equals), full.MD5)
+	digest, err := SksDigest(key, md5.New())
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.MD5, gc.Equals, digest)
+
+	for i, uid := range key.UserIDs {
+		var self, certs []*Signature
+		for _, sig := range uid.Signatures {
+			if isSelfIssued(key, sig) {
+				self = append(self, sig)
+			} else {
+				certs = append(certs, sig)
+			}
+		}
+		// Self-signatures are kept, with the most recent certifications.
+		c.Assert(certs, gc.HasLen, 10)
+		c.Assert(len(self)+len(certs), gc.Equals, len(uid.Signatures))
+		var oldestKept time.Time
+		for _, sig := range certs {
+			if oldestKept.IsZero() || sig.Creation.Before(oldestKept) {
+				oldestKept = sig.Creation
+			}
+		}
+		kept := map[string]bool{}
+		for _, sig := range uid.Signatures {
+			kept[sig.UUID] = true
+		}
+		for _, sig := range full.UserIDs[i].Signatures {
+			if kept[sig.UUID] {
+				continue
+			}
+			c.Assert(isSelfIssued(full, sig), gc.Equals, false)
+			c.Assert(sig.Creation.After(oldestKept), gc.Equals, false)
+		}
+	}
+}
+
+func (s *SamplePacketSuite) TestIsSelfIssued(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	self := key.UserIDs[0].Signatures[0]
+	c.Assert(isSelfIssued(key, self), gc.Equals, true)
+
+	// A signature naming no issuer is not self-issued.
+	anon := *self
+	anon.RIssuerKeyID, anon.IssuerFingerprint = "", ""
+	c.Assert(isSelfIssued(key, &anon), gc.Equals, false)
+
+	// The issuer fingerprint is preferred to the key ID where given.
+	other := MustInputAscKey("uat.asc")
+	anon.RIssuerKeyID, anon.IssuerFingerprint = self.RIssuerKeyID, other.Fingerprint()
+	c.Assert(isSelfIssued(key, &anon), gc.Equals, false)
+	anon.IssuerFingerprint = key.Fingerprint()
+	c.Assert(isSelfIssued(key, &anon), gc.Equals, true)
+}
+
+func (s *SamplePacketSuite) TestTruncateCertifications(c *gc.C) {
+	key := MustInputAscKey("uat.asc")
+	md5 := key.MD5
+	n, err := TruncateCertifications(key, 3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(key.MD5, gc.Equals, md5)
+
+	n, err = TruncateCertifications(key, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 3)
+	c.Assert(key.UserIDs[1].Signatures, gc.HasLen, 1)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+}
+
+func (s *SamplePacketSuite) TestStripUnverifiedCertifications(c *gc.C) {
+	signer := MustInputAscKey("uat.asc")
+	key := MustInputAscKey("e68e311d.asc")
+	c.Assert(MostCertifications(key), gc.Equals, 1)
+	md5 := key.MD5
+	n, err := StripUnverifiedCertifications(key, func(sig *Signature) []*PrimaryKey {
+		c.Check(strings.HasPrefix(signer.RFingerprint, IssuerID(sig)), gc.Equals, true)
+		return []*PrimaryKey{signer}
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(key.MD5, gc.Equals, md5)
+
+	// Certifications are not verified by an unrelated key, or without one.
+	other := MustInputAscKey("alice_signed.asc")
+	n, err = StripUnverifiedCertifications(key, func(*Signature) []*PrimaryKey {
+		return []*PrimaryKey{other}
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	c.Assert(MostCertifications(key), gc.Equals, 0)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+	for _, uid := range key.UserIDs {
+		c.Assert(uid.Signatures, gc.Not(gc.HasLen), 0)
+	}
+}
+
+func (s *SamplePacketSuite) TestVerifyUserAttributeCertification(c *gc.C) {
+	key := MustInputAscKey("uat.asc")
+	uat := key.UserAttributes[0]
+	c.Assert(VerifyUserAttributeCertification(key, key, uat, uat.Signatures[0]), gc.IsNil)
+	other := MustInputAscKey("e68e311d.asc")
+	c.Assert(VerifyUserAttributeCertification(other, key, uat, uat.Signatures[0]), gc.NotNil)
+}
+
+func (s *SamplePacketSuite) TestMaxArmorLen(c *gc.C) {
+	_, err := ReadArmorKeys(testing.MustInput("alice_signed.asc"), MaxArmorLen(100))
+	c.Assert(IsTooLarge(err), gc.Equals, true, gc.Commentf("%v", err))
+	keys, err := ReadArmorKeys(testing.MustInput("alice_signed.asc"), MaxArmorLen(1<<20))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+
+	armored, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	keys, err = ReadArmorKeys(bytes.NewBuffer(armored), MaxArmorLen(len(armored)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+}
+
+func (s *SamplePacketSuite) TestApplyLimits(c *gc.C) {
+	key := MustInputAscKey("weasel.asc")
+	c.Assert(ApplyLimits(key), gc.IsNil)
+	c.Assert(IsTooLarge(ApplyLimits(key, MaxPackets(1000))), gc.Equals, true)
+	c.Assert(IsTooLarge(ApplyLimits(key, MaxKeyLen(1000))), gc.Equals, true)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 561)
+
+	c.Assert(ApplyLimits(key, MaxPackets(2000), MaxUserIDSignatures(5)), gc.IsNil)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 9)
+	c.Assert(ApplyLimits(key, MaxPackets(100)), gc.IsNil)
+}
+
 func (s *SamplePacketSuite) TestBlacklist(c *gc.C) {
 	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"))
 	c.Assert(err, gc.IsNil)
@@ -337,6 +486,73 @@ func (s *SamplePacketSuite) TestBlacklist(c *gc.C) {
 	c.Assert(keys, gc.HasLen, 0)
 }
 
+func (s *SamplePacketSuite) TestBlocklisted(c *gc.C) {
+	bl := NewBlocklist()
+	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), Blocklisted(bl))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	uid := keys[0].UserIDs[0].Keywords
+
+	bl.Set("test", []string{"81279EEE7EC89FB781702ADAF79362DA44A2D1DB"}, nil)
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Blocklisted(bl))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+
+	bl.Set("test", nil, []*regexp.Regexp{regexp.MustCompile(regexp.QuoteMeta(uid))})
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Blocklisted(bl))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+
+	bl.Set("test", nil, nil)
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Blocklisted(bl))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+}
+
+func (s *SamplePacketSuite) TestSuppressed(c *gc.C) {
+	sp := NewSuppressions()
+	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), Suppressed(sp))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 2)
+	md5 := keys[0].MD5
+
+	sp.Set(nil, []string{"Casey.Marshall@gmail.com"})
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Suppressed(sp))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Casey Marshall <casey.marshall@gazzang.com>")
+	c.Assert(keys[0].MD5, gc.Not(gc.Equals), md5)
+
+	sp.Set([]string{"81279EEE7EC89FB781702ADAF79362DA44A2D1DB"}, nil)
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Suppressed(sp))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+}
+
+func (s *SamplePacketSuite) TestBlocklistSources(c *gc.C) {
+	bl := NewBlocklist()
+	added, removed := bl.Set("a", []string{"AA", "bb"}, nil)
+	c.Assert(added, gc.DeepEquals, []string{"aa", "bb"})
+	c.Assert(removed, gc.HasLen, 0)
+
+	added, removed = bl.Set("b", []string{"bb", "cc"}, nil)
+	c.Assert(added, gc.DeepEquals, []string{"cc"})
+	c.Assert(removed, gc.HasLen, 0)
+
+	// bb remains blocked by source b.
+	added, removed = bl.Set("a", []string{"dd"}, nil)
+	c.Assert(added, gc.DeepEquals, []string{"dd"})
+	c.Assert(removed, gc.DeepEquals, []string{"aa"})
+	c.Assert(bl.BlocksFingerprint("BB"), gc.Equals, true)
+	c.Assert(bl.BlocksFingerprint("aa"), gc.Equals, false)
+
+	fps, uids := bl.Len()
+	c.Assert(fps, gc.Equals, 3)
+	c.Assert(uids, gc.Equals, 0)
+}
+
 func (s *SamplePacketSuite) TestKeyLength(c *gc.C) {
 	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"))
 	c.Assert(err, gc.IsNil)
@@ -358,3 +574,47 @@ func (s *SamplePacketSuite) TestWriteArmorHeaders(c *gc.C) {
 	c.Assert(strings.Contains(b.String(), "Comment: HKP\n"), gc.Equals, true)
 	c.Assert(strings.Contains(b.String(), "Version: Hockeypuck 2.1.0\n"), gc.Equals, true)
 }
+
+func (s *SamplePacketSuite) TestKeyWriterPolicy(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 2)
+	md5 := key.MD5
+
+	keys, err := NewKeyWriter().Filter([]*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].MD5, gc.Equals, md5)
+
+	keys, err = NewKeyWriter(MaxCertifications(1)).Filter([]*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 2)
+
+	keys, err = NewKeyWriter(Minimal()).Filter([]*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.HasLen, 0)
+
+	keys, err = NewKeyWriter(RedactUserIDs()).Filter([]*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 0)
+	c.Assert(keys[0].SubKeys, gc.HasLen, len(key.SubKeys))
+
+	// The policy is applied without modifying the key.
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 2)
+	c.Assert(key.MD5, gc.Equals, md5)
+}
+
+func (s *SamplePacketSuite) TestKeyWriterStripUserAttributes(c *gc.C) {
+	key := MustInputAscKey("uat.asc")
+	c.Assert(key.UserAttributes, gc.Not(gc.HasLen), 0)
+
+	keys, err := NewKeyWriter(StripUserAttributes()).Filter([]*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+	c.Assert(keys[0].UserIDs, gc.HasLen, len(key.UserIDs))
+	c.Assert(keys[0].Length < key.Length, gc.Equals, true)
+}
@@ -0,0 +1,239 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// KeyWriter serializes keys, applying a serve-time policy to select the
+// packets written. The policy is applied while writing, so the keys
+// themselves are not modified.
+type KeyWriter struct {
+	dropMalformed       bool
+	minimal             bool
+	redactUserIDs       bool
+	stripUserAttributes bool
+	maxCertifications   int
+	attestedOnly        bool
+	subKeyID            string
+	matchUserID         func(*UserID) bool
+}
+
+// PolicyOption modifies the packets a KeyWriter selects for output.
+type PolicyOption func(*KeyWriter)
+
+// DropMalformed omits packets which could be identified but not parsed,
+// since these break some OpenPGP implementations.
+func DropMalformed() PolicyOption {
+	return func(kw *KeyWriter) { kw.dropMalformed = true }
+}
+
+// Minimal reduces keys to the primary public key, its user IDs and their
+// self-signatures.
+func Minimal() PolicyOption {
+	return func(kw *KeyWriter) { kw.minimal = true }
+}
+
+// RedactUserIDs omits all user IDs and user attributes, serving only the
+// key material needed to verify signatures and encrypt.
+func RedactUserIDs() PolicyOption {
+	return func(kw *KeyWriter) { kw.redactUserIDs = true }
+}
+
+// StripUserAttributes omits user attributes, such as photo IDs.
+func StripUserAttributes() PolicyOption {
+	return func(kw *KeyWriter) { kw.stripUserAttributes = true }
+}
+
+// MaxCertifications limits the number of third-party certifications written
+// for each user ID or user attribute. Zero is unlimited.
+func MaxCertifications(n int) PolicyOption {
+	return func(kw *KeyWriter) { kw.maxCertifications = n }
+}
+
+// OmitUnattestedCertifications omits third-party certifications which the
+// owner of the key has not approved in an attestation key signature, as
+// StripUnattestedCertifications does.
+func OmitUnattestedCertifications() PolicyOption {
+	return func(kw *KeyWriter) { kw.attestedOnly = true }
+}
+
+// MatchedSubKey limits the subkeys written to those matching the given
+// reversed key ID, for keys found by the key ID of a subkey. Clients looking
+// up an encryption subkey need only that subkey and the primary key. Keys
+// found by their own key ID are written with all their subkeys.
+func MatchedSubKey(rkeyID string) PolicyOption {
+	return func(kw *KeyWriter) { kw.subKeyID = rkeyID }
+}
+
+// MatchedUserIDs limits the user IDs written to those accepted by match, and
+// omits user attributes. Clients looking up a key by email address, as with
+// the Web Key Directory, need only the user ID with the address.
+func MatchedUserIDs(match func(*UserID) bool) PolicyOption {
+	return func(kw *KeyWriter) { kw.matchUserID = match }
+}
+
+// NewKeyWriter returns a KeyWriter applying the given policy. Without
+// options, keys are written in full.
+func NewKeyWriter(options ...PolicyOption) *KeyWriter {
+	kw := &KeyWriter{}
+	for _, option := range options {
+		option(kw)
+	}
+	return kw
+}
+
+// Write writes the packets of key selected by the policy to w.
+func (kw *KeyWriter) Write(w io.Writer, key *PrimaryKey) error {
+	pw := &packetWriter{w: w, kw: kw}
+	pw.write(&key.Packet)
+	pw.writeSigs(key, key.Signatures, false)
+	if !kw.redactUserIDs {
+		for _, uid := range key.UserIDs {
+			if kw.matchUserID != nil && !kw.matchUserID(uid) {
+				continue
+			}
+			sigs := uid.Signatures
+			if kw.attestedOnly {
+				sigs, _ = attestedSigs(key, sigs, func(sig *Signature) error {
+					return key.checkUserIDSig(uid, sig)
+				})
+			}
+			pw.write(&uid.Packet)
+			pw.writeSigs(key, sigs, true)
+			pw.writeOthers(uid.Others)
+		}
+		if !kw.stripUserAttributes && !kw.minimal && kw.matchUserID == nil {
+			for _, uat := range key.UserAttributes {
+				sigs := uat.Signatures
+				if kw.attestedOnly {
+					sigs, _ = attestedSigs(key, sigs, func(sig *Signature) error {
+						return key.checkUserAttrSig(uat, sig)
+					})
+				}
+				pw.write(&uat.Packet)
+				pw.writeSigs(key, sigs, true)
+				pw.writeOthers(uat.Others)
+			}
+		}
+	}
+	if !kw.minimal {
+		var matched *SubKey
+		if kw.subKeyID != "" {
+			matched = MatchSubKey(key, kw.subKeyID)
+		}
+		for _, subKey := range key.SubKeys {
+			if matched != nil && subKey != matched {
+				continue
+			}
+			pw.write(&subKey.Packet)
+			pw.writeSigs(key, subKey.Signatures, false)
+			pw.writeOthers(subKey.Others)
+		}
+	}
+	pw.writeOthers(key.Others)
+	return pw.err
+}
+
+// WriteArmored writes the packets of keys selected by the policy to w, in a
+// single ASCII-armored public key block.
+func (kw *KeyWriter) WriteArmored(w io.Writer, keys []*PrimaryKey, options ...KeyWriterOption) error {
+	akwr, err := NewArmoredKeyWriter(options...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	armw, err := armor.Encode(w, openpgp.PublicKeyType, akwr.headers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer armw.Close()
+	for _, key := range keys {
+		err = kw.Write(armw, key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Filter returns copies of keys reduced by the policy, for output formats
+// which are not written as packets.
+func (kw *KeyWriter) Filter(keys []*PrimaryKey) ([]*PrimaryKey, error) {
+	var buf bytes.Buffer
+	for _, key := range keys {
+		err := kw.Write(&buf, key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return NewKeyReader(&buf).Read()
+}
+
+// packetWriter writes packets until the first error.
+type packetWriter struct {
+	w   io.Writer
+	kw  *KeyWriter
+	err error
+}
+
+func (pw *packetWriter) write(p *Packet) {
+	if pw.err != nil || (pw.kw.dropMalformed && p.Malformed) {
+		return
+	}
+	op, err := newOpaquePacket(p.Packet)
+	if err != nil {
+		pw.err = errors.WithStack(err)
+		return
+	}
+	pw.err = errors.WithStack(op.Serialize(pw.w))
+}
+
+// writeSigs writes signatures over a key component. Third-party
+// certifications over user IDs and attributes are subject to the policy.
+func (pw *packetWriter) writeSigs(key *PrimaryKey, sigs []*Signature, certifications bool) {
+	var n int
+	for _, sig := range sigs {
+		if !isSelfIssued(key, sig) {
+			if pw.kw.minimal {
+				continue
+			}
+			if certifications {
+				if pw.kw.maxCertifications > 0 && n >= pw.kw.maxCertifications {
+					continue
+				}
+				n++
+			}
+		}
+		pw.write(&sig.Packet)
+	}
+}
+
+func (pw *packetWriter) writeOthers(others []*Packet) {
+	if pw.kw.minimal {
+		return
+	}
+	for _, other := range others {
+		pw.write(other)
+	}
+}
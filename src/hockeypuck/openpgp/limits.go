@@ -0,0 +1,182 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+
+	log "hockeypuck/logrus"
+)
+
+// ErrKeyTooLarge is returned when key material exceeds the limits set by
+// KeyReaderOptions.
+var ErrKeyTooLarge = fmt.Errorf("key exceeds size limits")
+
+func IsTooLarge(err error) bool {
+	return errors.Is(err, ErrKeyTooLarge)
+}
+
+// DecodeArmor decodes an ASCII-armored block from r, as armor.Decode does.
+// If MaxArmorLen is among the options, reading more armored input than it
+// allows fails with ErrKeyTooLarge.
+func DecodeArmor(r io.Reader, options ...KeyReaderOption) (*armor.Block, error) {
+	okr, err := NewOpaqueKeyReader(r, options...)
+	if err != nil {
+		return nil, err
+	}
+	if okr.maxArmorLen > 0 {
+		r = &armorLimitReader{r: r, n: okr.maxArmorLen}
+	}
+	return armor.Decode(r)
+}
+
+// armorLimitReader fails reads past the first n bytes.
+type armorLimitReader struct {
+	r io.Reader
+	n int
+}
+
+func (lr *armorLimitReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		// Anything more than the limit is too much.
+		var b [1]byte
+		n, err := lr.r.Read(b[:])
+		if n > 0 {
+			return 0, errors.Wrap(ErrKeyTooLarge, "armored key material is too long")
+		}
+		return 0, err
+	}
+	if len(p) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= n
+	return n, err
+}
+
+// ApplyLimits applies the limits set by options to a key read without them,
+// such as a key merged with a stored version: keys exceeding MaxKeyLen or
+// MaxPackets are refused with ErrKeyTooLarge, keys exceeding
+// MaxUserIDSignatures are truncated, self-signatures are verified as set
+// by VerifySelfSigs, unattested certifications are stripped as set by
+// AttestedCertificationsOnly, and signatures with unknown critical subpackets
+// are dropped as set by UnknownCriticalSubpackets. Packets longer than MaxPacketLen, which the key
+// reader drops, are not checked.
+func ApplyLimits(key *PrimaryKey, options ...KeyReaderOption) error {
+	okr, err := NewOpaqueKeyReader(nil, options...)
+	if err != nil {
+		return err
+	}
+	if okr.critical == CriticalSubpacketsReject {
+		_, err = RejectUnknownCriticalSubpackets(key)
+		if err != nil {
+			return err
+		}
+	}
+	if okr.selfSigMode != SelfSigsUnverified {
+		_, err = VerifySelfSignatures(key, okr.selfSigMode)
+		if err != nil {
+			return err
+		}
+	}
+	if okr.attestedOnly {
+		_, err = StripUnattestedCertifications(key)
+		if err != nil {
+			return err
+		}
+	}
+	if okr.maxKeyLen > 0 || okr.maxPackets > 0 {
+		var length int
+		packets := key.Packets()
+		for _, pkt := range packets {
+			length += len(pkt.Packet)
+		}
+		if okr.maxKeyLen > 0 && length > okr.maxKeyLen {
+			return errors.Wrapf(ErrKeyTooLarge, "key 0x%s length %d exceeds %d", key.KeyID(), length, okr.maxKeyLen)
+		}
+		if okr.maxPackets > 0 && len(packets) > okr.maxPackets {
+			return errors.Wrapf(ErrKeyTooLarge, "key 0x%s has %d packets, more than %d", key.KeyID(), len(packets), okr.maxPackets)
+		}
+	}
+	if okr.maxUIDSigs > 0 {
+		_, err = TruncateCertifications(key, okr.maxUIDSigs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateCertifications drops all but the max most recent third-party
+// certifications on each user ID and user attribute of key, returning the
+// number dropped. Self-signatures are always kept.
+func TruncateCertifications(key *PrimaryKey, max int) (int, error) {
+	var dropped int
+	for _, uid := range key.UserIDs {
+		var n int
+		uid.Signatures, n = truncateSigs(key, uid.Signatures, max)
+		dropped += n
+	}
+	for _, uat := range key.UserAttributes {
+		var n int
+		uat.Signatures, n = truncateSigs(key, uat.Signatures, max)
+		dropped += n
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	log.WithFields(log.Fields{
+		"fp":      key.Fingerprint(),
+		"dropped": dropped,
+		"max":     max,
+	}).Warn("truncated certifications")
+	return dropped, errors.WithStack(key.updateMD5())
+}
+
+// truncateSigs returns sigs without all but the max most recent third-party
+// certifications, in their original order, and the number dropped.
+func truncateSigs(key *PrimaryKey, sigs []*Signature, max int) ([]*Signature, int) {
+	var certs []*Signature
+	for _, sig := range sigs {
+		if !isSelfIssued(key, sig) {
+			certs = append(certs, sig)
+		}
+	}
+	if len(certs) <= max {
+		return sigs, 0
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].Creation.After(certs[j].Creation)
+	})
+	drop := map[*Signature]bool{}
+	for _, sig := range certs[max:] {
+		drop[sig] = true
+	}
+	kept := make([]*Signature, 0, len(sigs)-len(drop))
+	for _, sig := range sigs {
+		if !drop[sig] {
+			kept = append(kept, sig)
+		}
+	}
+	return kept, len(drop)
+}
@@ -0,0 +1,49 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"time"
+)
+
+// Provenance records how a packet reached the keyserver.
+type Provenance struct {
+	// FirstSeen is when the packet was first stored.
+	FirstSeen time.Time
+	// Source is the class of source the packet was first received from,
+	// such as a direct submission or recon.
+	Source string
+}
+
+// IsZero returns whether the provenance is unknown, as for packets stored
+// before provenance was recorded.
+func (p Provenance) IsZero() bool {
+	return p.FirstSeen.IsZero() && p.Source == ""
+}
+
+// SetProvenance records that the packets of key were received from the given
+// class of source at time t. Packets which already have a provenance keep
+// it, so that merging a key into its stored version records the provenance
+// of the packets it adds.
+func SetProvenance(key *PrimaryKey, source string, t time.Time) {
+	for _, pkt := range key.Packets() {
+		if pkt.Provenance.IsZero() {
+			pkt.Provenance = Provenance{FirstSeen: t.UTC(), Source: source}
+		}
+	}
+}
@@ -254,6 +254,15 @@ func (pubkey *PrimaryKey) contents() []packetNode {
 	return result
 }
 
+// Packets returns all the packets of the key, in the order they are written.
+func (pubkey *PrimaryKey) Packets() []*Packet {
+	var result []*Packet
+	for _, node := range pubkey.contents() {
+		result = append(result, node.packet())
+	}
+	return result
+}
+
 func (*PrimaryKey) removeDuplicate(parent packetNode, dup packetNode) error {
 	return errors.New("cannot remove a duplicate primary pubkey")
 }
@@ -314,7 +323,7 @@ func (pubkey *PrimaryKey) SigInfo() (*SelfSigs, []*Signature) {
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
-			Error:      pubkey.verifyPublicKeySelfSig(&pubkey.PublicKey, sig),
+			Error:      pubkey.checkKeySig(sig),
 		}
 		if checkSig.Error != nil {
 			selfSigs.Errors = append(selfSigs.Errors, checkSig)
@@ -329,6 +338,31 @@ func (pubkey *PrimaryKey) SigInfo() (*SelfSigs, []*Signature) {
 	return selfSigs, otherSigs
 }
 
+// ExpiresAt returns the time at which the key expires, or the zero time if
+// it does not. Version 3 keys carry their expiration in the key packet;
+// otherwise the key expires when the most recent self-signature of every
+// user ID has expired.
+func (pubkey *PrimaryKey) ExpiresAt() time.Time {
+	if !pubkey.Expiration.IsZero() {
+		return pubkey.Expiration
+	}
+	var expiresAt time.Time
+	for _, uid := range pubkey.UserIDs {
+		ss, _ := uid.SigInfo(pubkey)
+		if len(ss.Certifications) == 0 {
+			continue
+		}
+		latest := ss.Certifications[0].Signature.Expiration
+		if latest.IsZero() {
+			return time.Time{}
+		}
+		if latest.After(expiresAt) {
+			expiresAt = latest
+		}
+	}
+	return expiresAt
+}
+
 func (pubkey *PrimaryKey) updateMD5() error {
 	digest, err := SksDigest(pubkey, md5.New())
 	if err != nil {
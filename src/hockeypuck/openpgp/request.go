@@ -0,0 +1,236 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// DesignatedRevokers returns the fingerprints of the keys which the valid
+// self-signatures of key designate to revoke it, RFC 4880 section 5.2.3.15.
+func (pubkey *PrimaryKey) DesignatedRevokers() []string {
+	var fps []string
+	seen := map[string]bool{}
+	add := func(sig *Signature, check func() error) {
+		if len(sig.RevocationKeys) == 0 || !isSelfIssued(pubkey, sig) || check() != nil {
+			return
+		}
+		for _, fp := range sig.RevocationKeys {
+			if !seen[fp] {
+				seen[fp] = true
+				fps = append(fps, fp)
+			}
+		}
+	}
+	for _, sig := range pubkey.Signatures {
+		if sig.SigType == 0x1f { // direct key signature
+			add(sig, func() error { return pubkey.checkKeySig(sig) })
+		}
+	}
+	for _, uid := range pubkey.UserIDs {
+		for _, sig := range uid.Signatures {
+			add(sig, func() error { return pubkey.checkUserIDSig(uid, sig) })
+		}
+	}
+	return fps
+}
+
+// Actions named by the statements signed for requests.
+const (
+	RequestReplace = "replace"
+	RequestDelete  = "delete"
+)
+
+// RequestStatement returns the statement signed to request action on the
+// key with fingerprint fp, given keytext: the action and the lower case
+// fingerprint on a line of their own, followed by keytext. Binding the
+// action and the key acted upon keeps a signature made for one request from
+// being submitted for another. With GnuPG, it may be signed with
+//
+//	(printf 'replace %s\n' "$fp"; cat key.asc) | gpg -a --detach-sign
+func RequestStatement(action, fp, keytext string) []byte {
+	return []byte(action + " " + strings.ToLower(fp) + "\n" + keytext)
+}
+
+// RequestSignature is a verified signature on a request statement.
+type RequestSignature struct {
+	// Signer is the primary key on whose behalf the signature was made.
+	Signer *PrimaryKey
+
+	// Created is the creation time of the signature.
+	Created time.Time
+
+	// Digest is the SHA-256 digest of the signature packet, by which a
+	// replayed request may be recognized.
+	Digest string
+}
+
+// VerifyReplacement verifies a request to replace stored, the version of a
+// key held by the server, with the one in keytext. The armored detached
+// signature sig must be made over the RequestReplace statement for stored
+// by stored or a signing subkey bound to it. The submitted version cannot
+// be relied upon for this, as it need not carry the revocations of
+// compromised subkeys. Designated revokers may delete a key, but not
+// rewrite it.
+func VerifyReplacement(stored *PrimaryKey, keytext string, sig io.Reader) (*RequestSignature, error) {
+	rs, err := verifyRequest([]*PrimaryKey{stored},
+		RequestStatement(RequestReplace, stored.Fingerprint(), keytext), sig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "replacement of key 0x%s", stored.KeyID())
+	}
+	return rs, nil
+}
+
+// VerifyDeletion verifies a request to delete key, as stored by the server.
+// The armored detached signature sig must be made over the RequestDelete
+// statement for key, given keytext, by key itself or by a key among signers
+// which key designates as a revoker. Signatures by signing subkeys bound to
+// either are accepted.
+func VerifyDeletion(key *PrimaryKey, signers []*PrimaryKey, keytext string, sig io.Reader) (*RequestSignature, error) {
+	candidates := []*PrimaryKey{key}
+	revokers := map[string]bool{}
+	for _, fp := range key.DesignatedRevokers() {
+		revokers[fp] = true
+	}
+	for _, signer := range signers {
+		if revokers[signer.Fingerprint()] {
+			candidates = append(candidates, signer)
+		}
+	}
+	rs, err := verifyRequest(candidates,
+		RequestStatement(RequestDelete, key.Fingerprint(), keytext), sig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "deletion of key 0x%s", key.KeyID())
+	}
+	return rs, nil
+}
+
+// verifyRequest verifies the armored detached signature sig over statement
+// made by one of candidates. Revoked keys may not sign requests.
+func verifyRequest(candidates []*PrimaryKey, statement []byte, sig io.Reader) (*RequestSignature, error) {
+	block, err := armor.Decode(sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signature armor")
+	}
+	sigData, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signature armor")
+	}
+	p, err := packet.Read(bytes.NewReader(sigData))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signature")
+	}
+	s, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, errors.New("expected a detached signature")
+	}
+	if s.SigType != packet.SigTypeBinary && s.SigType != packet.SigTypeText {
+		return nil, errors.Errorf("expected a document signature, got type 0x%02x", s.SigType)
+	}
+	if !s.Hash.Available() {
+		return nil, errors.Errorf("unsupported hash function: %v", s.Hash)
+	}
+	if s.SigType == packet.SigTypeText {
+		statement = canonicalText(statement)
+	}
+
+	for _, candidate := range candidates {
+		ss, _ := candidate.SigInfo()
+		if _, revoked := ss.RevokedSince(); revoked {
+			continue
+		}
+		for _, pk := range signingKeys(candidate) {
+			if s.IssuerKeyId != nil && *s.IssuerKeyId != pk.KeyId {
+				continue
+			}
+			h := s.Hash.New()
+			h.Write(statement)
+			if pk.VerifySignature(h, s) == nil {
+				digest := sha256.Sum256(sigData)
+				return &RequestSignature{
+					Signer:  candidate,
+					Created: s.CreationTime,
+					Digest:  hex.EncodeToString(digest[:]),
+				}, nil
+			}
+		}
+	}
+	return nil, errors.New("not signed by an authorized key")
+}
+
+// signingKeys returns the primary key and bound subkeys of key which may
+// have made a signature on its behalf. A subkey must have a valid binding
+// which is neither revoked nor expired, gives it the signing flag, and
+// carries its back-signature on the primary key.
+// Version 3 keys are not supported.
+func signingKeys(key *PrimaryKey) []*packet.PublicKey {
+	var pks []*packet.PublicKey
+	pk, err := key.publicKeyPacket()
+	if err != nil {
+		return nil
+	}
+	pks = append(pks, pk)
+	for _, subkey := range key.SubKeys {
+		if subkey.BindingStatus(key) != BindingValid {
+			continue
+		}
+		ss, _ := subkey.SigInfo(key)
+		if len(ss.Certifications) == 0 || !isSigningBinding(ss.Certifications[0].Signature) {
+			continue
+		}
+		spk, err := subkey.publicKeyPacket()
+		if err != nil {
+			continue
+		}
+		pks = append(pks, spk)
+	}
+	return pks
+}
+
+// isSigningBinding returns whether the subkey binding signature sig gives
+// the subkey the signing flag and embeds its back-signature. The
+// back-signature itself is verified with the binding, which fails without
+// a valid one once the signing flag is given.
+func isSigningBinding(sig *Signature) bool {
+	if len(sig.KeyFlags) == 0 || sig.KeyFlags[0]&KeyFlagSign == 0 {
+		return false
+	}
+	for _, embedded := range sig.Embedded {
+		if embedded.SigType == 0x19 { // primary key binding signature
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalText converts the line endings of text to CRLF, as a text
+// signature is made over, RFC 4880 section 5.2.1.
+func canonicalText(text []byte) []byte {
+	text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(text, []byte("\n"), []byte("\r\n"), -1)
+}
@@ -25,6 +25,9 @@ import (
 )
 
 func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
+	if v := currentSigVerifier(); v != nil {
+		v.verifySelfSigs(key)
+	}
 	var userIDs []*UserID
 	var userAttributes []*UserAttribute
 	var subKeys []*SubKey
@@ -39,6 +42,9 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		if len(certs) > 0 {
 			uid.Signatures = certs
 			if !selfSignedOnly {
+				for _, att := range ss.Attestations {
+					uid.Signatures = append(uid.Signatures, att.Signature)
+				}
 				uid.Signatures = append(uid.Signatures, others...)
 			}
 			userIDs = append(userIDs, uid)
@@ -55,6 +61,9 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		if len(certs) > 0 {
 			uat.Signatures = certs
 			if !selfSignedOnly {
+				for _, att := range ss.Attestations {
+					uat.Signatures = append(uat.Signatures, att.Signature)
+				}
 				uat.Signatures = append(uat.Signatures, others...)
 			}
 			userAttributes = append(userAttributes, uat)
@@ -87,6 +96,31 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 	return key.updateMD5()
 }
 
+// PrimaryKeyOnly reduces key to its primary public key packet, user IDs and
+// the self-signatures over them. Subkeys, user attributes, third-party
+// certifications and unrecognized packets are removed.
+func PrimaryKeyOnly(key *PrimaryKey) error {
+	key.Signatures = selfIssued(key, key.Signatures)
+	for _, uid := range key.UserIDs {
+		uid.Signatures = selfIssued(key, uid.Signatures)
+		uid.Others = nil
+	}
+	key.UserAttributes = nil
+	key.SubKeys = nil
+	key.Others = nil
+	return key.updateMD5()
+}
+
+func selfIssued(key *PrimaryKey, sigs []*Signature) []*Signature {
+	var result []*Signature
+	for _, sig := range sigs {
+		if isSelfIssued(key, sig) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
 func DropDuplicates(key *PrimaryKey) error {
 	err := dedup(key, nil)
 	if err != nil {
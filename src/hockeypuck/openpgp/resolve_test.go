@@ -18,10 +18,12 @@
 package openpgp
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -148,6 +150,24 @@ func (s *ResolveSuite) TestKeyExpiration(c *gc.C) {
 	c.Assert(key.SubKeys[1].UUID, gc.Equals, "b416d58b79836874f1bae9cec6d402ff30597109")
 }
 
+func (s *ResolveSuite) TestInactiveSince(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	_, ok := InactiveSince(key)
+	c.Assert(ok, gc.Equals, false)
+
+	key = MustInputAscKey("test-key.asc")
+	expiry := time.Date(2023, time.January, 23, 13, 22, 53, 0, time.UTC)
+	restore := patchNow(expiry.Add(-time.Hour))
+	_, ok = InactiveSince(key)
+	restore()
+	c.Assert(ok, gc.Equals, false)
+
+	defer patchNow(expiry.Add(time.Hour))()
+	since, ok := InactiveSince(key)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(since.Equal(expiry), gc.Equals, true, gc.Commentf("%v", since))
+}
+
 // TestUnsuppIgnored tests parsing key material containing
 // packets which are not normally part of an exported public key --
 // trust packets, in this case.
@@ -290,3 +310,570 @@ func (s *ResolveSuite) TestResolveRootSignatures(c *gc.C) {
 	c.Assert(key1.Signatures, gc.HasLen, 1)
 	c.Assert(key2.Signatures, gc.HasLen, 1)
 }
+
+func (s *ResolveSuite) TestPrimaryKeyOnly(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 2)
+	c.Assert(key.SubKeys, gc.Not(gc.HasLen), 0)
+	md5 := key.MD5
+
+	err := PrimaryKeyOnly(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(key.UserIDs[0].Signatures[0].RIssuerKeyID, gc.Not(gc.Equals), "5bf04676d10aea26")
+	c.Assert(key.UserAttributes, gc.HasLen, 0)
+	c.Assert(key.SubKeys, gc.HasLen, 0)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+}
+
+func (s *ResolveSuite) TestSplitKey(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	segments := SplitKey(key, 0)
+	c.Assert(segments, gc.HasLen, 1)
+	c.Assert(segments[0], gc.Equals, key)
+
+	segments = SplitKey(key, 1)
+	c.Assert(segments, gc.HasLen, 2)
+	core, certs := segments[0], segments[1]
+	c.Assert(core.UserIDs, gc.HasLen, 1)
+	c.Assert(core.UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(core.SubKeys, gc.HasLen, len(key.SubKeys))
+	c.Assert(certs.SubKeys, gc.HasLen, 0)
+	c.Assert(certs.UserIDs, gc.HasLen, 1)
+	c.Assert(certs.UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(certs.UserIDs[0].Signatures[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+
+	// Segments reassemble into the original key.
+	err := Merge(core, certs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(core.MD5, gc.Equals, key.MD5)
+}
+
+func (s *ResolveSuite) TestPreferredKeyserver(c *gc.C) {
+	key := MustInputAscKey("carol_prefks.asc")
+	c.Assert(PreferredKeyserver(key), gc.Equals, "hkps://keys.example.com")
+
+	sig := key.UserIDs[0].Signatures[0]
+	subpackets, err := sig.Subpackets()
+	c.Assert(err, gc.IsNil)
+	var found bool
+	for _, sp := range subpackets {
+		if sp.Type == SubpacketPreferredKeyserver {
+			c.Assert(sp.Hashed, gc.Equals, true)
+			c.Assert(string(sp.Data), gc.Equals, "hkps://keys.example.com")
+			found = true
+		}
+	}
+	c.Assert(found, gc.Equals, true)
+
+	key = MustInputAscKey("alice_signed.asc")
+	c.Assert(PreferredKeyserver(key), gc.Equals, "")
+}
+
+func (s *ResolveSuite) TestEncryptionFeatures(c *gc.C) {
+	key := MustInputAscKey("seipdv2.asc")
+	sig := key.UserIDs[0].Signatures[0]
+	c.Assert(sig.Features, gc.DeepEquals, []byte{FeatureSEIPDv1 | FeatureSEIPDv2})
+	c.Assert(sig.AEADCiphersuites, gc.DeepEquals, []AEADCiphersuite{{9, 2}, {9, 3}, {7, 2}})
+	c.Assert(sig.AEADCiphersuites[0].String(), gc.Equals, "AES256/OCB")
+	c.Assert(AEADCiphersuite{Cipher: 100, Mode: 9}.String(), gc.Equals, "cipher100/mode9")
+
+	ef := KeyEncryptionFeatures(key)
+	c.Assert(ef, gc.NotNil)
+	c.Assert(ef.SEIPDv1, gc.Equals, true)
+	c.Assert(ef.SEIPDv2, gc.Equals, true)
+	c.Assert(ef.AEADCiphersuites, gc.HasLen, 3)
+
+	// Keys made before RFC 9580 advertise SEIPDv1 at most.
+	ef = KeyEncryptionFeatures(MustInputAscKey("alice_signed.asc"))
+	c.Assert(ef, gc.NotNil)
+	c.Assert(ef.SEIPDv2, gc.Equals, false)
+	c.Assert(ef.AEADCiphersuites, gc.HasLen, 0)
+
+	c.Assert(parseAEADCiphersuites([]byte{9, 2, 7}), gc.DeepEquals, []AEADCiphersuite{{9, 2}})
+}
+
+func (s *ResolveSuite) TestKeyCapabilities(c *gc.C) {
+	// The primary key certifies and signs, and the subkey encrypts.
+	key := MustInputAscKeys("ecc_keys.asc")[0]
+	c.Assert(AlgorithmName(key.Algorithm), gc.Equals, "eddsa")
+	c.Assert(latestSelfCertification(key).KeyFlags, gc.DeepEquals, []byte{KeyFlagCertify | KeyFlagSign})
+	c.Assert(KeyCapabilities(key), gc.Equals, byte(KeyFlagCertify|KeyFlagSign|KeyFlagEncrypt))
+	c.Assert(KeyCapabilities(key)&KeyFlagAuthenticate, gc.Equals, byte(0))
+
+	c.Assert(algorithmFlags(17, true), gc.Equals, byte(KeyFlagCertify|KeyFlagSign))
+	c.Assert(algorithmFlags(18, false), gc.Equals, byte(KeyFlagEncrypt))
+	c.Assert(AlgorithmCodes("RSA"), gc.DeepEquals, []int{1, 2, 3})
+	c.Assert(AlgorithmCodes("rot13"), gc.IsNil)
+
+	flags, err := ParseKeyFlags("sign, Encrypt")
+	c.Assert(err, gc.IsNil)
+	c.Assert(flags, gc.Equals, byte(KeyFlagSign|KeyFlagEncrypt))
+	_, err = ParseKeyFlags("sign,teleport")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ResolveSuite) TestVerifyDeletion(c *gc.C) {
+	// delete_target.asc designates delete_revoker.asc as its revoker in a
+	// direct key signature. Each signs a statement deleting the target.
+	target := MustInputAscKey("delete_target.asc")
+	revoker := MustInputAscKey("delete_revoker.asc")
+	c.Assert(target.DesignatedRevokers(), gc.DeepEquals, []string{revoker.Fingerprint()})
+	c.Assert(revoker.DesignatedRevokers(), gc.HasLen, 0)
+
+	rs, err := VerifyDeletion(target, nil,
+		testing.MustInputString("delete_target.asc"), testing.MustInput("delete_target.asc.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rs.Signer.Fingerprint(), gc.Equals, target.Fingerprint())
+	c.Assert(rs.Created.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)), gc.Equals, true)
+	c.Assert(rs.Digest, gc.HasLen, 64)
+
+	// The revoker may delete the target, but not the other way around.
+	rs, err = VerifyDeletion(target, []*PrimaryKey{revoker},
+		testing.MustInputString("delete_revoker.asc"), testing.MustInput("delete_revoker.asc.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rs.Signer.Fingerprint(), gc.Equals, revoker.Fingerprint())
+	_, err = VerifyDeletion(revoker, []*PrimaryKey{target},
+		testing.MustInputString("delete_target.asc"), testing.MustInput("delete_target.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// The revoker's statement names the target, so it cannot delete the
+	// revoker itself.
+	_, err = VerifyDeletion(revoker, nil,
+		testing.MustInputString("delete_revoker.asc"), testing.MustInput("delete_revoker.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// Without the revoker's key, its signature cannot be verified.
+	_, err = VerifyDeletion(target, nil,
+		testing.MustInputString("delete_revoker.asc"), testing.MustInput("delete_revoker.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// The signature must be over the statement.
+	_, err = VerifyDeletion(target, nil,
+		testing.MustInputString("delete_revoker.asc"), testing.MustInput("delete_target.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// A signature on a replace statement does not delete.
+	replace := MustInputAscKey("replace.asc")
+	_, err = VerifyDeletion(replace, nil,
+		testing.MustInputString("replace.asc"), testing.MustInput("replace.asc.asc"))
+	c.Assert(err, gc.NotNil)
+	_, err = VerifyDeletion(replace, nil,
+		testing.MustInputString("replace.asc"), testing.MustInput("replace.delete.asc"))
+	c.Assert(err, gc.IsNil)
+
+	// A revoked subkey may not sign for its key.
+	_, err = VerifyDeletion(MustInputAscKey("revoked_subkey_orig.asc"), nil,
+		testing.MustInputString("revoked_subkey_orig.asc"), testing.MustInput("revoked_subkey_orig.delete.asc"))
+	c.Assert(err, gc.IsNil)
+	_, err = VerifyDeletion(MustInputAscKey("revoked_subkey.asc"), nil,
+		testing.MustInputString("revoked_subkey_orig.asc"), testing.MustInput("revoked_subkey_orig.delete.asc"))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ResolveSuite) TestVerifyReplacement(c *gc.C) {
+	key := MustInputAscKey("replace.asc")
+	rs, err := VerifyReplacement(key, testing.MustInputString("replace.asc"), testing.MustInput("replace.asc.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rs.Signer.Fingerprint(), gc.Equals, key.Fingerprint())
+
+	// A signature on a delete statement does not replace.
+	_, err = VerifyReplacement(key, testing.MustInputString("replace.asc"), testing.MustInput("replace.delete.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// A revoked key may not sign for itself.
+	revoked := MustInputAscKey("replace_revoked.asc")
+	c.Assert(revoked.Fingerprint(), gc.Equals, key.Fingerprint())
+	_, err = VerifyReplacement(revoked, testing.MustInputString("replace.asc"), testing.MustInput("replace.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// A designated revoker may not replace the key it may delete.
+	target := MustInputAscKey("delete_target.asc")
+	_, err = VerifyReplacement(target, testing.MustInputString("delete_revoker.asc"), testing.MustInput("delete_revoker.asc.asc"))
+	c.Assert(err, gc.NotNil)
+
+	// revoked_subkey_orig.asc is signed by its signing subkey, which
+	// revoked_subkey.asc revokes. The signature is only good against the
+	// version without the revocation.
+	orig := MustInputAscKey("revoked_subkey_orig.asc")
+	_, err = VerifyReplacement(orig, testing.MustInputString("revoked_subkey_orig.asc"), testing.MustInput("revoked_subkey_orig.asc.asc"))
+	c.Assert(err, gc.IsNil)
+	stored := MustInputAscKey("revoked_subkey.asc")
+	c.Assert(stored.Fingerprint(), gc.Equals, orig.Fingerprint())
+	_, err = VerifyReplacement(stored, testing.MustInputString("revoked_subkey_orig.asc"), testing.MustInput("revoked_subkey_orig.asc.asc"))
+	c.Assert(err, gc.NotNil)
+	_, err = VerifyReplacement(stored, testing.MustInputString("revoked_subkey_orig.asc"), testing.MustInput("revoked_subkey_orig.primary.asc"))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *ResolveSuite) TestMergeRevocations(c *gc.C) {
+	// The replacement leaves out the revocation of its subkey.
+	key := MustInputAscKey("revoked_subkey_orig.asc")
+	stored := MustInputAscKey("revoked_subkey.asc")
+	c.Assert(key.SubKeys[0].BindingStatus(key), gc.Equals, BindingValid)
+	err := MergeRevocations(key, stored)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	c.Assert(key.SubKeys[0].BindingStatus(key), gc.Not(gc.Equals), BindingValid)
+
+	// User IDs left out are kept only for their revocations, and the key
+	// revocation is kept.
+	key = MustInputAscKey("replace.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	err = MergeRevocations(key, MustInputAscKey("replace_orig.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	err = MergeRevocations(key, MustInputAscKey("replace_revoked.asc"))
+	c.Assert(err, gc.IsNil)
+	ss, _ := key.SigInfo()
+	_, revoked := ss.RevokedSince()
+	c.Assert(revoked, gc.Equals, true)
+}
+
+func (s *ResolveSuite) TestStripUnattestedCertifications(c *gc.C) {
+	// The owner of attested.asc has attested the certification by
+	// 52e36fcd56d4c334, but not that by b1fa17c27b69bafa.
+	key := MustInputAscKey("attested.asc")
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 4)
+	md5 := key.MD5
+	n, err := StripUnattestedCertifications(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+	_, others := key.UserIDs[0].SigInfo(key)
+	c.Assert(others, gc.HasLen, 1)
+	c.Assert(others[0].IssuerKeyID(), gc.Equals, "52e36fcd56d4c334")
+
+	n, err = StripUnattestedCertifications(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	keys, err := ReadArmorKeys(testing.MustInput("attested.asc"), AttestedCertificationsOnly())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+
+	// Without an attestation, all third-party certifications are stripped.
+	key = MustInputAscKey("e68e311d.asc")
+	n, err = StripUnattestedCertifications(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	for _, uid := range key.UserIDs {
+		_, others := uid.SigInfo(key)
+		c.Assert(others, gc.HasLen, 0)
+	}
+
+	// Served keys are filtered without being modified.
+	key = MustInputAscKey("attested.asc")
+	var buf bytes.Buffer
+	err = NewKeyWriter(OmitUnattestedCertifications()).Write(&buf, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 4)
+	keys = MustReadKeys(&buf)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 3)
+}
+
+func (s *ResolveSuite) TestUnknownCriticalSubpackets(c *gc.C) {
+	// The certification of critical_notation.asc by b8f41cd30bf07cca
+	// carries a critical notation, which the packet parser does not
+	// understand.
+	key := MustInputAscKey("critical_notation.asc")
+	c.Assert(key.Others, gc.HasLen, 1)
+	c.Assert(key.Others[0].Malformed, gc.Equals, false)
+	warnings := CriticalSubpacketWarnings(key)
+	c.Assert(warnings, gc.HasLen, 1)
+	c.Assert(warnings[0], gc.Matches, ".*unknown critical subpacket type 20")
+
+	// Retained, the signature survives a round trip unmodified.
+	var buf bytes.Buffer
+	err := WritePackets(&buf, key)
+	c.Assert(err, gc.IsNil)
+	keys := MustReadKeys(&buf)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+	c.Assert(keys[0].Others, gc.HasLen, 1)
+	c.Assert(keys[0].Others[0].Packet, gc.DeepEquals, key.Others[0].Packet)
+
+	md5 := key.MD5
+	n, err := RejectUnknownCriticalSubpackets(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(key.Others, gc.HasLen, 0)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+	c.Assert(CriticalSubpacketWarnings(key), gc.HasLen, 0)
+
+	keys, err = ReadArmorKeys(testing.MustInput("critical_notation.asc"),
+		UnknownCriticalSubpackets(CriticalSubpacketsReject))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+	keys, err = ReadArmorKeys(testing.MustInput("critical_notation.asc"),
+		UnknownCriticalSubpackets(CriticalSubpacketsRetain))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, md5)
+
+	// Keys without such signatures are unaffected.
+	key = MustInputAscKey("alice_signed.asc")
+	c.Assert(CriticalSubpacketWarnings(key), gc.HasLen, 0)
+	n, err = RejectUnknownCriticalSubpackets(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *ResolveSuite) TestParseCriticalSubpacketPolicy(c *gc.C) {
+	for name, want := range map[string]CriticalSubpacketPolicy{
+		"":       CriticalSubpacketsRetain,
+		"retain": CriticalSubpacketsRetain,
+		"reject": CriticalSubpacketsReject,
+	} {
+		policy, err := ParseCriticalSubpacketPolicy(name)
+		c.Assert(err, gc.IsNil)
+		c.Assert(policy, gc.Equals, want)
+	}
+	_, err := ParseCriticalSubpacketPolicy("ignore")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ResolveSuite) TestIssuerFingerprint(c *gc.C) {
+	key := MustInputAscKey("carol_prefks.asc")
+	sig := key.UserIDs[0].Signatures[0]
+	c.Assert(sig.IssuerFingerprint, gc.Equals, key.Fingerprint())
+}
+
+func (s *ResolveSuite) TestEmbeddedSignature(c *gc.C) {
+	key := MustInputAscKey("e68e311d.asc")
+	var embedded []*Signature
+	for _, subkey := range key.SubKeys {
+		for _, sig := range subkey.Signatures {
+			for _, esig := range sig.Embedded {
+				// A primary key binding signature, made by the
+				// signing subkey.
+				c.Assert(esig.SigType, gc.Equals, 0x19)
+				c.Assert(esig.IssuerKeyID(), gc.Equals, subkey.KeyID())
+				embedded = append(embedded, esig)
+			}
+		}
+	}
+	c.Assert(embedded, gc.HasLen, 1)
+}
+
+func (s *ResolveSuite) TestVerifyUserIDCertification(c *gc.C) {
+	key := MustInputAscKey("e68e311d.asc")
+	signer := MustInputAscKey("uat.asc")
+	other := MustInputAscKey("alice_signed.asc")
+	uid := key.UserIDs[0]
+	_, others := uid.SigInfo(key)
+	c.Assert(others, gc.HasLen, 1)
+	c.Assert(others[0].IssuerKeyID(), gc.Equals, signer.KeyID())
+	c.Assert(VerifyUserIDCertification(signer, key, uid, others[0]), gc.IsNil)
+	c.Assert(VerifyUserIDCertification(other, key, uid, others[0]), gc.NotNil)
+}
+
+func (s *ResolveSuite) TestRevocationKey(c *gc.C) {
+	key := MustInputAscKey("test-key.asc")
+	cert := mustInputSignaturePacket(c, "test-key-revoke.asc")
+	rkey, err := RevocationKey(key, cert)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rkey.UUID, gc.Equals, key.UUID)
+	c.Assert(rkey.UserIDs, gc.HasLen, 0)
+	err = Merge(key, rkey)
+	c.Assert(err, gc.IsNil)
+	selfSigs, _ := key.SigInfo()
+	_, revoked := selfSigs.RevokedSince()
+	c.Assert(revoked, gc.Equals, true)
+
+	// Revocation certificates issued by other keys are refused.
+	_, err = RevocationKey(MustInputAscKey("revok_orig.asc"), cert)
+	c.Assert(err, gc.NotNil)
+	// So are other kinds of signature.
+	other := MustInputAscKey("revok_orig.asc")
+	_, err = RevocationKey(other, mustInputSignaturePacket(c, "revok_orig.asc"))
+	c.Assert(err, gc.NotNil)
+}
+
+// mustInputSignaturePacket returns the first signature packet in an armored
+// test data file.
+func mustInputSignaturePacket(c *gc.C, name string) *packet.OpaquePacket {
+	block, err := armor.Decode(testing.MustInput(name))
+	c.Assert(err, gc.IsNil)
+	or := packet.NewOpaqueReader(block.Body)
+	for {
+		op, err := or.Next()
+		c.Assert(err, gc.IsNil)
+		if op.Tag == 2 {
+			return op
+		}
+	}
+}
+
+func (s *ResolveSuite) TestSigVerifierCache(c *gc.C) {
+	v := NewSigVerifier(4, 1000)
+	SetSigVerifier(v)
+	defer SetSigVerifier(nil)
+
+	key := MustInputAscKey("alice_signed.asc")
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+	stats := v.Stats()
+	c.Assert(stats.Misses, gc.Not(gc.Equals), uint64(0))
+	c.Assert(stats.Size, gc.Equals, int(stats.Misses))
+
+	// The same key resubmitted is not verified again.
+	key = MustInputAscKey("alice_signed.asc")
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+	c.Assert(v.Stats().Misses, gc.Equals, stats.Misses)
+	c.Assert(v.Stats().Hits > stats.Hits, gc.Equals, true)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+
+	// Bad signatures are refused from the cache as they were when verified.
+	key = MustInputAscKey("a7400f5a_badsigs.asc")
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+	uids := len(key.UserIDs)
+	key = MustInputAscKey("a7400f5a_badsigs.asc")
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, uids)
+}
+
+func (s *ResolveSuite) TestSigVerifierCopiedSig(c *gc.C) {
+	v := NewSigVerifier(1, 1000)
+	SetSigVerifier(v)
+	defer SetSigVerifier(nil)
+
+	key := MustInputAscKey("alice_signed.asc")
+	selfSigs, _ := key.UserIDs[0].SigInfo(key)
+	c.Assert(selfSigs.Certifications, gc.Not(gc.HasLen), 0)
+	sig := selfSigs.Certifications[0].Signature
+
+	// A valid self-signature copied onto another user ID is verified
+	// afresh, as its digest covers the user ID.
+	forged := MustInputAscKey("alice_signed.asc")
+	uid := forged.UserIDs[0]
+	uid.Keywords = "Mallory <mallory@example.com>"
+	uid.Packet.Packet = append([]byte(nil), uid.Packet.Packet...)
+	uid.Packet.Packet[len(uid.Packet.Packet)-1] ^= 0x01
+	uid.UUID = scopedDigest([]string{forged.UUID}, uidTag, uid.Packet.Packet)
+	copied := *sig
+	copied.UUID = scopedDigest([]string{forged.UUID, uid.UUID}, sigTag, sig.Packet.Packet)
+	uid.Signatures = []*Signature{&copied}
+	selfSigs, _ = uid.SigInfo(forged)
+	c.Assert(selfSigs.Certifications, gc.HasLen, 0)
+	c.Assert(selfSigs.Errors, gc.HasLen, 1)
+}
+
+func (s *ResolveSuite) TestSigVerifierEviction(c *gc.C) {
+	v := NewSigVerifier(1, 2)
+	for i := 0; i < 5; i++ {
+		key := sigCacheKey{digest: strconv.Itoa(i), signer: "signer"}
+		v.verify(key, func() error { return nil })
+	}
+	c.Assert(v.Stats().Size, gc.Equals, 2)
+	calls := 0
+	v.verify(sigCacheKey{digest: "4", signer: "signer"}, func() error { calls++; return nil })
+	v.verify(sigCacheKey{digest: "0", signer: "signer"}, func() error { calls++; return nil })
+	c.Assert(calls, gc.Equals, 1)
+}
+
+func (s *ResolveSuite) TestMatchSubKey(c *gc.C) {
+	key := MustInputAscKey("rtt-140.asc")
+
+	subKey := MatchSubKey(key, Reverse("5eb3406d3df45908"))
+	c.Assert(subKey, gc.NotNil)
+	c.Assert(subKey.Fingerprint(), gc.Matches, ".*5eb3406d3df45908")
+	c.Assert(subKey.BindingStatus(key), gc.Equals, BindingValid)
+	c.Assert(MatchSubKey(key, Reverse("53bf1b0fe9577cae")).BindingStatus(key), gc.Equals, BindingRevoked)
+	c.Assert(MatchSubKey(key, Reverse("5c942bfc80df1516")).BindingStatus(key), gc.Equals, BindingExpired)
+
+	// Keys found by their own key ID, or not at all, have no matching
+	// subkey.
+	c.Assert(MatchSubKey(key, Reverse("ad1da6813ffbb33b")), gc.IsNil)
+	c.Assert(MatchSubKey(key, Reverse("deadbeef")), gc.IsNil)
+
+	var buf bytes.Buffer
+	err := NewKeyWriter(MatchedSubKey(Reverse("5eb3406d3df45908"))).Write(&buf, key)
+	c.Assert(err, gc.IsNil)
+	keys := MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, len(key.UserIDs))
+
+	buf.Reset()
+	err = NewKeyWriter(MatchedSubKey(Reverse("ad1da6813ffbb33b"))).Write(&buf, key)
+	c.Assert(err, gc.IsNil)
+	keys = MustReadKeys(&buf)
+	c.Assert(keys[0].SubKeys, gc.HasLen, len(key.SubKeys))
+}
+
+func (s *ResolveSuite) TestMatchedUserIDs(c *gc.C) {
+	key := MustInputAscKey("uat.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 2)
+	c.Assert(key.UserAttributes, gc.HasLen, 1)
+
+	var buf bytes.Buffer
+	err := NewKeyWriter(MatchedUserIDs(func(uid *UserID) bool {
+		return strings.Contains(uid.Keywords, "gmail.com")
+	})).Write(&buf, key)
+	c.Assert(err, gc.IsNil)
+	keys := MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Casey Marshall <casey.marshall@gmail.com>")
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+	c.Assert(keys[0].SubKeys, gc.HasLen, len(key.SubKeys))
+}
+
+func (s *ResolveSuite) TestVerifySelfSignatures(c *gc.C) {
+	for _, name := range []string{"alice_signed.asc", "ecc_keys.asc", "uat.asc", "weasel.asc"} {
+		for _, key := range MustInputAscKeys(name) {
+			n, err := VerifySelfSignatures(key, SelfSigsStrict)
+			c.Assert(err, gc.IsNil)
+			c.Assert(n, gc.Equals, 0, gc.Commentf("%s %s", name, key.KeyID()))
+		}
+	}
+
+	// User IDs without a valid self-signature are only dropped in strict
+	// mode.
+	key := MustInputAscKey("badselfsig.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 5)
+	n, err := VerifySelfSignatures(key, SelfSigsPermissive)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(key.UserIDs, gc.HasLen, 5)
+	keys, err := ReadArmorKeys(testing.MustInput("badselfsig.asc"), VerifySelfSigs(SelfSigsStrict))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 2)
+
+	// A self-signature grafted onto another user ID is dropped as forged.
+	forge := func() *PrimaryKey {
+		key := MustInputAscKey("alice_signed.asc")
+		uid := key.UserIDs[0]
+		uid.Keywords = "Mallory <mallory@example.com>"
+		uid.Packet.Packet = append([]byte(nil), uid.Packet.Packet...)
+		uid.Packet.Packet[len(uid.Packet.Packet)-1] ^= 0x01
+		return key
+	}
+	key = forge()
+	sigs := len(key.UserIDs[0].Signatures)
+	n, err = VerifySelfSignatures(key, SelfSigsPermissive)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, sigs-1)
+	key = forge()
+	uids := len(key.UserIDs)
+	n, err = VerifySelfSignatures(key, SelfSigsStrict)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1+sigs)
+	c.Assert(key.UserIDs, gc.HasLen, uids-1)
+}
+
+func (s *ResolveSuite) TestParseSelfSigMode(c *gc.C) {
+	for name, expect := range map[string]SelfSigMode{
+		"":           SelfSigsUnverified,
+		"permissive": SelfSigsPermissive,
+		"strict":     SelfSigsStrict,
+	} {
+		mode, err := ParseSelfSigMode(name)
+		c.Assert(err, gc.IsNil)
+		c.Assert(mode, gc.Equals, expect)
+	}
+	_, err := ParseSelfSigMode("lenient")
+	c.Assert(err, gc.ErrorMatches, `invalid self-signature verification mode "lenient"`)
+}
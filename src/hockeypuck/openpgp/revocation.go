@@ -0,0 +1,108 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// RevocationKey returns a key consisting of only the primary key packet of key
+// and the revocation certificate op, which may be merged into key to revoke
+// it. An error is returned unless op is a key revocation signature made by
+// key itself.
+func RevocationKey(key *PrimaryKey, op *packet.OpaquePacket) (*PrimaryKey, error) {
+	pkOpaque, err := key.opaquePacket()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	okr := &OpaqueKeyring{Packets: []*packet.OpaquePacket{pkOpaque, op}}
+	rkey, err := okr.Parse()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(rkey.Signatures) != 1 {
+		return nil, errors.New("invalid revocation certificate")
+	}
+	sig := rkey.Signatures[0]
+	if sig.SigType != 0x20 { // packet.SigTypeKeyRevocation
+		return nil, errors.Errorf("expected key revocation signature, got type 0x%02x", sig.SigType)
+	}
+	selfSigs, _ := rkey.SigInfo()
+	if len(selfSigs.Errors) > 0 {
+		return nil, errors.Wrap(selfSigs.Errors[0].Error, "invalid revocation signature")
+	} else if len(selfSigs.Revocations) == 0 {
+		return nil, errors.Errorf("revocation not issued by key 0x%s", key.KeyID())
+	}
+	return rkey, nil
+}
+
+// MergeRevocations merges the key, subkey, user ID and user attribute
+// revocation signatures of stored, the version of a key held by the server,
+// into key, which replaces it. A replacement may otherwise leave out the
+// revocation of a compromised subkey or a user ID its owner disowned.
+// Subkeys, user IDs and user attributes which key leaves out are kept for
+// their revocations.
+func MergeRevocations(key, stored *PrimaryKey) error {
+	revs := &PrimaryKey{PublicKey: stored.PublicKey}
+	revs.Signatures = revocations(stored.Signatures, 0x20) // packet.SigTypeKeyRevocation
+	revs.Others = nil
+	for _, subKey := range stored.SubKeys {
+		sigs := revocations(subKey.Signatures, 0x28) // packet.SigTypeSubkeyRevocation
+		if len(sigs) == 0 {
+			continue
+		}
+		revSubKey := &SubKey{PublicKey: subKey.PublicKey}
+		revSubKey.Signatures, revSubKey.Others = sigs, nil
+		revs.SubKeys = append(revs.SubKeys, revSubKey)
+	}
+	for _, uid := range stored.UserIDs {
+		sigs := revocations(uid.Signatures, 0x30) // packet.SigTypeCertificationRevocation
+		if len(sigs) == 0 {
+			continue
+		}
+		revs.UserIDs = append(revs.UserIDs, &UserID{
+			Packet:     uid.Packet,
+			Keywords:   uid.Keywords,
+			Signatures: sigs,
+		})
+	}
+	for _, uat := range stored.UserAttributes {
+		sigs := revocations(uat.Signatures, 0x30) // packet.SigTypeCertificationRevocation
+		if len(sigs) == 0 {
+			continue
+		}
+		revs.UserAttributes = append(revs.UserAttributes, &UserAttribute{
+			Packet:     uat.Packet,
+			Images:     uat.Images,
+			Signatures: sigs,
+		})
+	}
+	return errors.WithStack(Merge(key, revs))
+}
+
+// revocations returns the signatures among sigs of type sigType.
+func revocations(sigs []*Signature, sigType int) []*Signature {
+	var result []*Signature
+	for _, sig := range sigs {
+		if sig.SigType == sigType {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
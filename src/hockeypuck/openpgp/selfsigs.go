@@ -38,6 +38,7 @@ type SelfSigs struct {
 	Certifications []*CheckSig
 	Expirations    []*CheckSig
 	Primaries      []*CheckSig
+	Attestations   []*CheckSig
 	Errors         []*CheckSig
 
 	target packetNode
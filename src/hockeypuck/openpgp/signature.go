@@ -35,6 +35,33 @@ type Signature struct {
 	Creation     time.Time
 	Expiration   time.Time
 	Primary      bool
+
+	// PreferredKeyserver is the URI of the keyserver at which the signer
+	// would like the key to be maintained, if given.
+	PreferredKeyserver string
+
+	// IssuerFingerprint is the fingerprint of the signing key, if given.
+	IssuerFingerprint string
+
+	// RevocationKeys are the fingerprints of the keys designated by the
+	// signer to revoke its key, if given.
+	RevocationKeys []string
+
+	// Features are the feature flags advertised by the signer, if given.
+	Features []byte
+
+	// KeyFlags are the capabilities the signature gives the key it binds,
+	// if given.
+	KeyFlags []byte
+
+	// AEADCiphersuites are the combinations of symmetric cipher and AEAD
+	// mode the signer prefers for SEIPDv2 encryption, in order of
+	// preference, if given.
+	AEADCiphersuites []AEADCiphersuite
+
+	// Embedded are the signatures embedded in this one, such as the primary
+	// key binding signature made by a signing subkey.
+	Embedded []*Signature
 }
 
 const sigTag = "{sig}"
@@ -94,10 +121,100 @@ func ParseSignature(op *packet.OpaquePacket, keyCreationTime time.Time, pubkeyUU
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	err = sig.parseSubpackets(op.Contents, true)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	sig.Parsed = true
 	return sig, nil
 }
 
+// parseEmbeddedSignature parses the body of an embedded signature subpacket.
+func parseEmbeddedSignature(body []byte) (*Signature, error) {
+	op := &packet.OpaquePacket{Tag: 2, Contents: body}
+	var buf bytes.Buffer
+	err := op.Serialize(&buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sig := &Signature{
+		Packet: Packet{
+			Tag:    op.Tag,
+			Packet: buf.Bytes(),
+		},
+	}
+	err = sig.parse(op, time.Time{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Signatures embedded in embedded signatures are not meaningful.
+	err = sig.parseSubpackets(body, false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sig.Parsed = true
+	return sig, nil
+}
+
+// parseSubpackets extracts the signature subpackets that are not interpreted
+// by the packet parser.
+func (sig *Signature) parseSubpackets(body []byte, withEmbedded bool) error {
+	subpackets, err := parseSubpackets(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, sp := range subpackets {
+		// Issuer details and embedded signatures are self-authenticating,
+		// so are accepted from the unhashed area, as the issuer key ID is.
+		switch sp.Type {
+		case SubpacketIssuerFingerprint:
+			// A version number, followed by the fingerprint.
+			if len(sp.Data) > 1 {
+				sig.IssuerFingerprint = hex.EncodeToString(sp.Data[1:])
+			}
+		case SubpacketEmbeddedSignature:
+			if !withEmbedded {
+				continue
+			}
+			// An embedded signature that cannot be parsed is ignored,
+			// as any other unparseable packet content is.
+			esig, err := parseEmbeddedSignature(sp.Data)
+			if err == nil {
+				sig.Embedded = append(sig.Embedded, esig)
+			}
+		}
+		if !sp.Hashed {
+			continue
+		}
+		switch sp.Type {
+		case SubpacketPreferredKeyserver:
+			sig.PreferredKeyserver = string(sp.Data)
+		case SubpacketRevocationKey:
+			// A class, which always has the high bit set, and the
+			// algorithm of the revoker, followed by its fingerprint.
+			if len(sp.Data) > 2 && sp.Data[0]&0x80 != 0 {
+				sig.RevocationKeys = append(sig.RevocationKeys, hex.EncodeToString(sp.Data[2:]))
+			}
+		case SubpacketFeatures:
+			sig.Features = append([]byte(nil), sp.Data...)
+		case SubpacketKeyFlags:
+			sig.KeyFlags = append([]byte(nil), sp.Data...)
+		case SubpacketPreferredAEADCiphersuites:
+			sig.AEADCiphersuites = parseAEADCiphersuites(sp.Data)
+		}
+	}
+	return nil
+}
+
+// Subpackets returns the subpackets of the signature.
+func (sig *Signature) Subpackets() ([]Subpacket, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewBuffer(sig.Packet.Packet)).Next()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parseSubpackets(op.Contents)
+}
+
 func (sig *Signature) parse(op *packet.OpaquePacket, keyCreationTime time.Time) error {
 	p, err := op.Parse()
 	if err != nil {
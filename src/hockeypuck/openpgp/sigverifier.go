@@ -0,0 +1,218 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// SigVerifier bounds the number of signatures verified at once, and remembers
+// the outcome of each verification, so that signatures seen again when keys
+// are resubmitted or recovered through recon are not verified again.
+//
+// Outcomes are remembered by signature digest and signer fingerprint. The
+// digest of a signature covers the key and the packet it signs, so a
+// signature copied onto different material is verified afresh.
+type SigVerifier struct {
+	workers chan struct{}
+
+	mu      sync.Mutex
+	size    int
+	entries map[sigCacheKey]*list.Element
+	lru     *list.List
+
+	hits, misses uint64
+}
+
+type sigCacheKey struct {
+	digest string
+	signer string
+}
+
+type sigCacheEntry struct {
+	key sigCacheKey
+	err error
+}
+
+// SigVerifierStats reports the effectiveness of a SigVerifier's cache.
+type SigVerifierStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+// NewSigVerifier returns a SigVerifier verifying at most workers signatures
+// at once, and remembering the outcomes of at most cacheSize verifications.
+func NewSigVerifier(workers, cacheSize int) *SigVerifier {
+	if workers < 1 {
+		workers = 1
+	}
+	return &SigVerifier{
+		workers: make(chan struct{}, workers),
+		size:    cacheSize,
+		entries: map[sigCacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+var (
+	sigVerifierMu sync.RWMutex
+	sigVerifier   *SigVerifier
+)
+
+// SetSigVerifier installs v to verify all signatures checked by this package.
+// A nil v restores verifying each signature as it is checked.
+func SetSigVerifier(v *SigVerifier) {
+	sigVerifierMu.Lock()
+	defer sigVerifierMu.Unlock()
+	sigVerifier = v
+}
+
+func currentSigVerifier() *SigVerifier {
+	sigVerifierMu.RLock()
+	defer sigVerifierMu.RUnlock()
+	return sigVerifier
+}
+
+// verifySig verifies sig, made by signer, with verify, unless the outcome is
+// already known to the installed SigVerifier.
+func verifySig(sig *Signature, signer *PrimaryKey, verify func() error) error {
+	v := currentSigVerifier()
+	if v == nil || sig.UUID == "" {
+		return verify()
+	}
+	return v.verify(sigCacheKey{digest: sig.UUID, signer: signer.RFingerprint}, verify)
+}
+
+func (v *SigVerifier) verify(key sigCacheKey, verify func() error) error {
+	if err, ok := v.lookup(key); ok {
+		atomic.AddUint64(&v.hits, 1)
+		return err
+	}
+	atomic.AddUint64(&v.misses, 1)
+	v.workers <- struct{}{}
+	err := verify()
+	<-v.workers
+	v.store(key, err)
+	return err
+}
+
+func (v *SigVerifier) lookup(key sigCacheKey) (error, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	el, ok := v.entries[key]
+	if !ok {
+		return nil, false
+	}
+	v.lru.MoveToFront(el)
+	return el.Value.(*sigCacheEntry).err, true
+}
+
+func (v *SigVerifier) store(key sigCacheKey, err error) {
+	if v.size <= 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if el, ok := v.entries[key]; ok {
+		v.lru.MoveToFront(el)
+		return
+	}
+	v.entries[key] = v.lru.PushFront(&sigCacheEntry{key: key, err: err})
+	for v.lru.Len() > v.size {
+		el := v.lru.Back()
+		v.lru.Remove(el)
+		delete(v.entries, el.Value.(*sigCacheEntry).key)
+	}
+}
+
+// Stats returns the number of verifications answered from the cache and
+// performed since v was created, and the number of outcomes cached.
+func (v *SigVerifier) Stats() SigVerifierStats {
+	v.mu.Lock()
+	size := v.lru.Len()
+	v.mu.Unlock()
+	return SigVerifierStats{
+		Hits:   atomic.LoadUint64(&v.hits),
+		Misses: atomic.LoadUint64(&v.misses),
+		Size:   size,
+	}
+}
+
+// verifySelfSigs verifies all the self-signatures of key in parallel, across
+// the workers of v, so that checking them afterwards finds their outcomes
+// already cached.
+func (v *SigVerifier) verifySelfSigs(key *PrimaryKey) {
+	var checks []func()
+	for _, sig := range key.Signatures {
+		if isSelfIssued(key, sig) {
+			sig := sig
+			checks = append(checks, func() { key.checkKeySig(sig) })
+		}
+	}
+	for _, uid := range key.UserIDs {
+		for _, sig := range uid.Signatures {
+			if isSelfIssued(key, sig) {
+				uid, sig := uid, sig
+				checks = append(checks, func() { key.checkUserIDSig(uid, sig) })
+			}
+		}
+	}
+	for _, uat := range key.UserAttributes {
+		for _, sig := range uat.Signatures {
+			if isSelfIssued(key, sig) {
+				uat, sig := uat, sig
+				checks = append(checks, func() { key.checkUserAttrSig(uat, sig) })
+			}
+		}
+	}
+	for _, subKey := range key.SubKeys {
+		for _, sig := range subKey.Signatures {
+			if isSelfIssued(key, sig) {
+				subKey, sig := subKey, sig
+				checks = append(checks, func() { key.checkSubKeySig(subKey, sig) })
+			}
+		}
+	}
+	if len(checks) < 2 {
+		return
+	}
+
+	n := cap(v.workers)
+	if n > len(checks) {
+		n = len(checks)
+	}
+	ch := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range ch {
+				check()
+			}
+		}()
+	}
+	for _, check := range checks {
+		ch <- check
+	}
+	close(ch)
+	wg.Wait()
+}
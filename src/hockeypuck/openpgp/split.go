@@ -0,0 +1,143 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"strings"
+)
+
+// certification is a third-party signature along with the user ID or user
+// attribute it certifies.
+type certification struct {
+	sig *Signature
+	uid *UserID
+	uat *UserAttribute
+}
+
+// SplitKey divides key into segments which are each well-formed keys
+// containing the primary public key packet. The first segment is the
+// self-signed core of the key: its user IDs, user attributes and subkeys,
+// with only their self-signatures. Third-party certifications follow in
+// subsequent segments, batched so that each segment's packets do not exceed
+// maxLen bytes where possible. A key that fits within maxLen is returned as
+// a single segment, unchanged.
+func SplitKey(key *PrimaryKey, maxLen int) []*PrimaryKey {
+	if maxLen <= 0 || packetsLen(key.contents()) <= maxLen {
+		return []*PrimaryKey{key}
+	}
+
+	core := bareKey(key)
+	core.Signatures = selfIssued(key, key.Signatures)
+	var certs []certification
+	for _, uid := range key.UserIDs {
+		coreUID := &UserID{Packet: uid.Packet, Keywords: uid.Keywords}
+		for _, sig := range uid.Signatures {
+			if isSelfIssued(key, sig) {
+				coreUID.Signatures = append(coreUID.Signatures, sig)
+			} else {
+				certs = append(certs, certification{sig: sig, uid: uid})
+			}
+		}
+		core.UserIDs = append(core.UserIDs, coreUID)
+	}
+	for _, uat := range key.UserAttributes {
+		coreUAT := &UserAttribute{Packet: uat.Packet, Images: uat.Images}
+		for _, sig := range uat.Signatures {
+			if isSelfIssued(key, sig) {
+				coreUAT.Signatures = append(coreUAT.Signatures, sig)
+			} else {
+				certs = append(certs, certification{sig: sig, uat: uat})
+			}
+		}
+		core.UserAttributes = append(core.UserAttributes, coreUAT)
+	}
+	for _, subKey := range key.SubKeys {
+		coreSubKey := &SubKey{PublicKey: subKey.PublicKey}
+		coreSubKey.Signatures = selfIssued(key, subKey.Signatures)
+		coreSubKey.Others = nil
+		core.SubKeys = append(core.SubKeys, coreSubKey)
+	}
+	segments := []*PrimaryKey{core}
+
+	// Each certification segment repeats the primary key packet, and the
+	// user ID or attribute packets its certifications are bound to.
+	var seg *PrimaryKey
+	var segLen int
+	var segUIDs map[*UserID]*UserID
+	var segUATs map[*UserAttribute]*UserAttribute
+	for _, cert := range certs {
+		n := len(cert.sig.Packet.Packet)
+		if cert.uid != nil && segUIDs[cert.uid] == nil {
+			n += len(cert.uid.Packet.Packet)
+		} else if cert.uat != nil && segUATs[cert.uat] == nil {
+			n += len(cert.uat.Packet.Packet)
+		}
+		if seg == nil || (segLen+n > maxLen && len(seg.UserIDs)+len(seg.UserAttributes) > 0) {
+			seg = bareKey(key)
+			segLen = len(key.Packet.Packet)
+			segUIDs = map[*UserID]*UserID{}
+			segUATs = map[*UserAttribute]*UserAttribute{}
+			segments = append(segments, seg)
+		}
+		if cert.uid != nil {
+			segUID, ok := segUIDs[cert.uid]
+			if !ok {
+				segUID = &UserID{Packet: cert.uid.Packet, Keywords: cert.uid.Keywords}
+				segUIDs[cert.uid] = segUID
+				seg.UserIDs = append(seg.UserIDs, segUID)
+				segLen += len(cert.uid.Packet.Packet)
+			}
+			segUID.Signatures = append(segUID.Signatures, cert.sig)
+		} else {
+			segUAT, ok := segUATs[cert.uat]
+			if !ok {
+				segUAT = &UserAttribute{Packet: cert.uat.Packet, Images: cert.uat.Images}
+				segUATs[cert.uat] = segUAT
+				seg.UserAttributes = append(seg.UserAttributes, segUAT)
+				segLen += len(cert.uat.Packet.Packet)
+			}
+			segUAT.Signatures = append(segUAT.Signatures, cert.sig)
+		}
+		segLen += len(cert.sig.Packet.Packet)
+	}
+	return segments
+}
+
+// bareKey returns a copy of key's primary public key, without any signatures
+// or other packets attached to it.
+func bareKey(key *PrimaryKey) *PrimaryKey {
+	bare := &PrimaryKey{PublicKey: key.PublicKey}
+	bare.Signatures = nil
+	bare.Others = nil
+	return bare
+}
+
+func packetsLen(nodes []packetNode) int {
+	var n int
+	for _, node := range nodes {
+		n += len(node.packet().Packet)
+	}
+	return n
+}
+
+// isSelfIssued returns whether sig names key as its issuer. A signature
+// which names no issuer is not self-issued.
+func isSelfIssued(key *PrimaryKey, sig *Signature) bool {
+	issuer := IssuerID(sig)
+	return issuer != "" && strings.HasPrefix(key.UUID, issuer)
+}
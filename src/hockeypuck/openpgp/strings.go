@@ -17,6 +17,8 @@
 
 package openpgp
 
+import "strings"
+
 func Reverse(s string) string {
 	runes := []rune(s)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
@@ -24,3 +26,17 @@ func Reverse(s string) string {
 	}
 	return string(runes)
 }
+
+// UserIDAddress returns the lower-cased email address in a user ID, or an
+// empty string if it has none.
+func UserIDAddress(uid string) string {
+	s := strings.ToLower(strings.TrimSpace(uid))
+	lbr, rbr := strings.LastIndex(s, "<"), strings.LastIndex(s, ">")
+	if lbr != -1 && rbr > lbr {
+		s = s[lbr+1 : rbr]
+	}
+	if at := strings.Index(s, "@"); at <= 0 || at == len(s)-1 || strings.ContainsAny(s, " <>") {
+		return ""
+	}
+	return s
+}
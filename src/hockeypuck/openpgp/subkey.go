@@ -108,7 +108,7 @@ func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
-			Error:      pubkey.verifyPublicKeySelfSig(&subkey.PublicKey, sig),
+			Error:      pubkey.checkSubKeySig(subkey, sig),
 		}
 		if checkSig.Error != nil {
 			selfSigs.Errors = append(selfSigs.Errors, checkSig)
@@ -127,3 +127,44 @@ func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 	selfSigs.resolve()
 	return selfSigs, otherSigs
 }
+
+// States of a subkey's binding to its primary key.
+const (
+	BindingValid   = "valid"
+	BindingRevoked = "revoked"
+	BindingExpired = "expired"
+	// BindingInvalid is the state of a subkey without a valid binding
+	// signature.
+	BindingInvalid = "invalid"
+)
+
+// BindingStatus returns the state of the subkey's binding to pubkey.
+func (subkey *SubKey) BindingStatus(pubkey *PrimaryKey) string {
+	selfSigs, _ := subkey.SigInfo(pubkey)
+	if _, ok := selfSigs.RevokedSince(); ok {
+		return BindingRevoked
+	}
+	if expiration, ok := selfSigs.ExpiresAt(); ok && expiration.Unix() <= now().Unix() {
+		return BindingExpired
+	}
+	if _, ok := selfSigs.ValidSince(); !ok {
+		return BindingInvalid
+	}
+	return BindingValid
+}
+
+// MatchSubKey returns the subkey of key found by a lookup of the given
+// reversed key ID or fingerprint, or nil if the key was found by its own key
+// ID or does not match.
+func MatchSubKey(key *PrimaryKey, rkeyID string) *SubKey {
+	rkeyID = strings.ToLower(rkeyID)
+	if strings.HasPrefix(key.RFingerprint, rkeyID) {
+		return nil
+	}
+	for _, subKey := range key.SubKeys {
+		if strings.HasPrefix(subKey.RFingerprint, rkeyID) {
+			return subKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Signature subpacket types, RFC 4880 section 5.2.3.1, which are not
+// otherwise interpreted by the packet parser.
+const (
+	SubpacketRevocationKey             = 12
+	SubpacketPreferredKeyserver        = 24
+	SubpacketKeyFlags                  = 27
+	SubpacketFeatures                  = 30
+	SubpacketEmbeddedSignature         = 32
+	SubpacketIssuerFingerprint         = 33
+	SubpacketPreferredAEADCiphersuites = 39
+)
+
+// Subpacket is a signature subpacket, RFC 4880 section 5.2.3.1.
+type Subpacket struct {
+	Type     int
+	Critical bool
+	Hashed   bool
+	Data     []byte
+}
+
+var errTruncatedSubpacket = errors.New("truncated signature subpacket")
+
+// parseSubpackets returns the hashed and unhashed subpackets of a version 4
+// signature packet body. Other signature versions have no subpackets.
+func parseSubpackets(body []byte) ([]Subpacket, error) {
+	// version, type, public key algorithm, hash algorithm
+	if len(body) < 4 || body[0] != 4 {
+		return nil, nil
+	}
+	body = body[4:]
+
+	var result []Subpacket
+	for _, hashed := range []bool{true, false} {
+		if len(body) < 2 {
+			return nil, errors.WithStack(errTruncatedSubpacket)
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		body = body[2:]
+		if n > len(body) {
+			return nil, errors.WithStack(errTruncatedSubpacket)
+		}
+		area := body[:n]
+		body = body[n:]
+		for len(area) > 0 {
+			var sp Subpacket
+			var err error
+			sp, area, err = parseSubpacket(area)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			sp.Hashed = hashed
+			result = append(result, sp)
+		}
+	}
+	return result, nil
+}
+
+func parseSubpacket(b []byte) (Subpacket, []byte, error) {
+	var n int
+	switch {
+	case b[0] < 192:
+		n, b = int(b[0]), b[1:]
+	case b[0] < 255:
+		if len(b) < 2 {
+			return Subpacket{}, nil, errTruncatedSubpacket
+		}
+		n, b = (int(b[0])-192)<<8+int(b[1])+192, b[2:]
+	default:
+		if len(b) < 5 {
+			return Subpacket{}, nil, errTruncatedSubpacket
+		}
+		n, b = int(binary.BigEndian.Uint32(b[1:])), b[5:]
+	}
+	if n < 1 || n > len(b) {
+		return Subpacket{}, nil, errTruncatedSubpacket
+	}
+	return Subpacket{
+		Type:     int(b[0] & 0x7f),
+		Critical: b[0]&0x80 != 0,
+		Data:     b[1:n],
+	}, b[n:], nil
+}
+
+// PreferredKeyserver returns the preferred keyserver given in the most recent
+// valid self-certification of the key's user IDs, if any.
+func PreferredKeyserver(key *PrimaryKey) string {
+	latest := latestSelfCertification(key)
+	if latest == nil {
+		return ""
+	}
+	return latest.PreferredKeyserver
+}
+
+// latestSelfCertification returns the most recent valid self-certification
+// of the key's user IDs, which states the preferences of its owner.
+func latestSelfCertification(key *PrimaryKey) *Signature {
+	var latest *Signature
+	for _, uid := range key.UserIDs {
+		ss, _ := uid.SigInfo(key)
+		for _, cert := range ss.Certifications {
+			if cert.Error != nil {
+				continue
+			}
+			if latest == nil || cert.Signature.Creation.After(latest.Creation) {
+				latest = cert.Signature
+			}
+		}
+	}
+	return latest
+}
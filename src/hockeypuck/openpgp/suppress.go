@@ -0,0 +1,115 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// Suppressions is a set of key fingerprints and email addresses erased from
+// the keyserver, such as at the request of the people they identify, which
+// may be changed while keys are being read. Unlike a Blocklist, which drops
+// whole keys, an address suppresses only the user IDs which contain it.
+type Suppressions struct {
+	mu    sync.RWMutex
+	fps   map[string]bool
+	addrs map[string]bool
+}
+
+// NewSuppressions returns an empty Suppressions.
+func NewSuppressions() *Suppressions {
+	return &Suppressions{fps: map[string]bool{}, addrs: map[string]bool{}}
+}
+
+// Set replaces the suppressed fingerprints and addresses.
+func (s *Suppressions) Set(fps, addrs []string) {
+	fpSet := map[string]bool{}
+	for _, fp := range fps {
+		fpSet[strings.ToLower(fp)] = true
+	}
+	addrSet := map[string]bool{}
+	for _, addr := range addrs {
+		addrSet[strings.ToLower(addr)] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fps, s.addrs = fpSet, addrSet
+}
+
+// SuppressesFingerprint returns whether the key with the given fingerprint
+// is suppressed.
+func (s *Suppressions) SuppressesFingerprint(fp string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fps[strings.ToLower(fp)]
+}
+
+// SuppressesUserID returns whether the given user ID contains a suppressed
+// address.
+func (s *Suppressions) SuppressesUserID(uid string) bool {
+	addr := UserIDAddress(uid)
+	if addr == "" {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addrs[addr]
+}
+
+// Len returns the number of fingerprints and addresses suppressed.
+func (s *Suppressions) Len() (fps int, addrs int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.fps), len(s.addrs)
+}
+
+// EraseUserIDs removes the user IDs of key for which erase returns true,
+// along with their signatures, returning the number removed.
+func EraseUserIDs(key *PrimaryKey, erase func(*UserID) bool) (int, error) {
+	var kept []*UserID
+	for _, uid := range key.UserIDs {
+		if !erase(uid) {
+			kept = append(kept, uid)
+		}
+	}
+	n := len(key.UserIDs) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	key.UserIDs = kept
+	log.WithFields(log.Fields{
+		"fp":     key.Fingerprint(),
+		"erased": n,
+	}).Info("erased user IDs")
+	return n, errors.WithStack(key.updateMD5())
+}
+
+// Suppressed drops the keys read whose fingerprints are suppressed by s,
+// and erases the user IDs with suppressed addresses from the rest. Like
+// Blocklisted, s is consulted as each key is read.
+func Suppressed(s *Suppressions) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.suppressions = s
+		return nil
+	}
+}
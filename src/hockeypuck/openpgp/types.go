@@ -61,6 +61,10 @@ type Packet struct {
 
 	// Packet contains the raw packet bytes.
 	Packet []byte
+
+	// Provenance records when the packet was first stored, and the class of
+	// source it was received from. It is not part of the key material.
+	Provenance Provenance
 }
 
 const packetTag = "{other}"
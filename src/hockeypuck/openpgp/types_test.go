@@ -77,3 +77,22 @@ func (s *TypesSuite) TestIterOpaque(c *gc.C) {
 	c.Assert(1, gc.Equals, len(key.SubKeys[0].Signatures))
 	c.Assert(4, gc.Equals, len(hits))
 }
+
+func (s *TypesSuite) TestCleanUtf8(c *gc.C) {
+	c.Assert(cleanUtf8("Alice <alice@example.com>"), gc.Equals, "Alice <alice@example.com>")
+	c.Assert(cleanUtf8("Alice\n\x1b[31m<alice@example.com>"), gc.Equals, "Alice[31m<alice@example.com>")
+	c.Assert(cleanUtf8("Alice \xff<alice@example.com>"), gc.Equals, "Alice ?<alice@example.com>")
+	c.Assert(cleanUtf8("Alice \u202emoc.elpmaxe@ecila"), gc.Equals, "Alice moc.elpmaxe@ecila")
+	c.Assert(cleanUtf8("Ålice \u0085<ålice@example.com>"), gc.Equals, "Ålice <ålice@example.com>")
+}
+
+func (s *TypesSuite) TestMixedScript(c *gc.C) {
+	c.Assert(MixedScript("Alice <alice@example.com>"), gc.Equals, false)
+	c.Assert(MixedScript("Алиса <alisa@example.ru>"), gc.Equals, false)
+	c.Assert(MixedScript("Αλίκη <alice@example.gr>"), gc.Equals, false)
+	// Cyrillic а (U+0430) in place of Latin a
+	c.Assert(MixedScript("Alice <аlice@example.com>"), gc.Equals, true)
+	// Greek ο (U+03BF) in place of Latin o
+	c.Assert(MixedScript("Bob <bοb@example.com>"), gc.Equals, true)
+	c.Assert(MixedScript("王 <wang@example.cn>"), gc.Equals, false)
+}
@@ -132,7 +132,7 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
-			Error:      pubkey.verifyUserAttrSelfSig(uat, sig),
+			Error:      pubkey.checkUserAttrSig(uat, sig),
 		}
 		if checkSig.Error != nil {
 			selfSigs.Errors = append(selfSigs.Errors, checkSig)
@@ -149,6 +149,8 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 			if sig.Primary {
 				selfSigs.Primaries = append(selfSigs.Primaries, checkSig)
 			}
+		case SigTypeAttestation:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		}
 	}
 	selfSigs.resolve()
@@ -20,6 +20,7 @@ package openpgp
 import (
 	"bytes"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/pkg/errors"
@@ -133,13 +134,16 @@ func (uid *UserID) setUserID(u *packet.UserId) error {
 	return nil
 }
 
+// cleanUtf8 repairs invalid UTF-8 and strips control and bidirectional
+// formatting characters, which could otherwise be used to inject content into
+// logs or disguise the user ID when rendered.
 func cleanUtf8(s string) string {
 	var runes []rune
 	for _, r := range s {
 		if r == utf8.RuneError {
 			r = '?'
 		}
-		if r < 0x20 || r == 0x7f {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
 			continue
 		}
 		runes = append(runes, r)
@@ -147,6 +151,34 @@ func cleanUtf8(s string) string {
 	return string(runes)
 }
 
+// confusableScripts are scripts whose letters are commonly substituted for
+// one another in homograph attacks.
+var confusableScripts = []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek}
+
+// MixedScript returns whether any word in s contains letters from more than
+// one of the Latin, Cyrillic and Greek scripts. Such words are characteristic
+// of user IDs which impersonate another identity using lookalike characters.
+func MixedScript(s string) bool {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		script := -1
+		for _, r := range word {
+			for i, table := range confusableScripts {
+				if !unicode.Is(table, r) {
+					continue
+				}
+				if script >= 0 && script != i {
+					return true
+				}
+				script = i
+			}
+		}
+	}
+	return false
+}
+
 func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 	selfSigs := &SelfSigs{target: uid}
 	var otherSigs []*Signature
@@ -159,7 +191,7 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
-			Error:      pubkey.verifyUserIDSelfSig(uid, sig),
+			Error:      pubkey.checkUserIDSig(uid, sig),
 		}
 		if checkSig.Error != nil {
 			selfSigs.Errors = append(selfSigs.Errors, checkSig)
@@ -176,6 +208,8 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 			if sig.Primary {
 				selfSigs.Primaries = append(selfSigs.Primaries, checkSig)
 			}
+		case SigTypeAttestation:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		}
 	}
 	selfSigs.resolve()
@@ -22,9 +22,46 @@ import (
 	"hash"
 
 	"github.com/pkg/errors"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
 	"golang.org/x/crypto/openpgp/packet"
+
+	log "hockeypuck/logrus"
 )
 
+// checkKeySig verifies a self-signature made directly on the primary key.
+func (pubkey *PrimaryKey) checkKeySig(sig *Signature) error {
+	return verifySig(sig, pubkey, func() error {
+		// Revocations and direct key signatures are made over the primary
+		// key alone.
+		switch sig.SigType {
+		case 0x20, 0x1f: // packet.SigTypeKeyRevocation, direct key signature
+			return pubkey.verifyPublicKeyRevocation(sig)
+		}
+		return pubkey.verifyPublicKeySelfSig(&pubkey.PublicKey, sig)
+	})
+}
+
+// checkSubKeySig verifies a self-signature on a subkey.
+func (pubkey *PrimaryKey) checkSubKeySig(subkey *SubKey, sig *Signature) error {
+	return verifySig(sig, pubkey, func() error {
+		return pubkey.verifyPublicKeySelfSig(&subkey.PublicKey, sig)
+	})
+}
+
+// checkUserIDSig verifies a self-signature on a user ID.
+func (pubkey *PrimaryKey) checkUserIDSig(uid *UserID, sig *Signature) error {
+	return verifySig(sig, pubkey, func() error {
+		return pubkey.verifyUserIDSelfSig(uid, sig)
+	})
+}
+
+// checkUserAttrSig verifies a self-signature on a user attribute.
+func (pubkey *PrimaryKey) checkUserAttrSig(uat *UserAttribute, sig *Signature) error {
+	return verifySig(sig, pubkey, func() error {
+		return pubkey.verifyUserAttrSelfSig(uat, sig)
+	})
+}
+
 func (pubkey *PrimaryKey) verifyPublicKeySelfSig(signed *PublicKey, sig *Signature) error {
 	pkOpaque, err := pubkey.opaquePacket()
 	if err != nil {
@@ -56,6 +93,21 @@ func (pubkey *PrimaryKey) verifyPublicKeySelfSig(signed *PublicKey, sig *Signatu
 	return ErrInvalidPacketType
 }
 
+// verifyPublicKeyRevocation verifies a revocation of the primary key itself,
+// or a direct key signature, which unlike a binding signature is made over
+// the primary key alone.
+func (pubkey *PrimaryKey) verifyPublicKeyRevocation(sig *Signature) error {
+	pk, err := pubkey.PublicKey.publicKeyPacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s, err := sig.signaturePacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(pk.VerifyRevocationSignature(s))
+}
+
 func (pubkey *PrimaryKey) verifyUserIDSelfSig(uid *UserID, sig *Signature) error {
 	u, err := uid.userIDPacket()
 	if err != nil {
@@ -156,3 +208,151 @@ func (pubkey *PrimaryKey) sigSerializeUserAttribute(uat *UserAttribute, hashFunc
 	h.Write(uatOpaque.Contents)
 	return h, nil
 }
+
+// VerifyUserIDCertification verifies a certification of a user ID of key made
+// by the primary key of signer.
+func VerifyUserIDCertification(signer, key *PrimaryKey, uid *UserID, sig *Signature) error {
+	return verifySig(sig, signer, func() error {
+		return verifyUserIDCertification(signer, key, uid, sig)
+	})
+}
+
+func verifyUserIDCertification(signer, key *PrimaryKey, uid *UserID, sig *Signature) error {
+	u, err := uid.userIDPacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	signerPk, err := signer.publicKeyPacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	pk, err := key.publicKeyPacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s, err := sig.signaturePacket()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(signerPk.VerifyUserIdSignature(u.Id, pk, s))
+}
+
+// VerifyUserAttributeCertification verifies a certification of a user
+// attribute of key made by the primary key of signer.
+func VerifyUserAttributeCertification(signer, key *PrimaryKey, uat *UserAttribute, sig *Signature) error {
+	return verifySig(sig, signer, func() error {
+		signerPk, err := signer.publicKeyPacket()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		s, err := sig.signaturePacket()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		h, err := key.sigSerializeUserAttribute(uat, s.Hash)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(signerPk.VerifySignature(h, s))
+	})
+}
+
+// VerifySelfSignatures verifies the self-signatures of key, returning the
+// number of packets dropped. Self-signatures which fail to verify are
+// dropped: user ID and user attribute bindings, subkey bindings and their
+// back-signatures, and revocations. In SelfSigsStrict mode, user IDs, user
+// attributes and subkeys left without a valid self-signature are dropped
+// too. Signatures which cannot be verified, because their algorithm is not
+// supported, are kept.
+func VerifySelfSignatures(key *PrimaryKey, mode SelfSigMode) (int, error) {
+	if mode == SelfSigsUnverified {
+		return 0, nil
+	}
+	if v := currentSigVerifier(); v != nil {
+		v.verifySelfSigs(key)
+	}
+	strict := mode == SelfSigsStrict
+	var dropped int
+	verified := func(sigs []*Signature, check func(*Signature) error) ([]*Signature, bool) {
+		kept := make([]*Signature, 0, len(sigs))
+		var bound bool
+		for _, sig := range sigs {
+			if !isSelfIssued(key, sig) {
+				kept = append(kept, sig)
+				continue
+			}
+			err := check(sig)
+			if isForged(err) {
+				dropped++
+				continue
+			}
+			kept = append(kept, sig)
+			bound = bound || err == nil
+		}
+		return kept, bound
+	}
+
+	key.Signatures, _ = verified(key.Signatures, func(sig *Signature) error {
+		if sig.SigType != 0x20 { // packet.SigTypeKeyRevocation
+			return nil
+		}
+		return key.checkKeySig(sig)
+	})
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		var bound bool
+		uid.Signatures, bound = verified(uid.Signatures, func(sig *Signature) error {
+			return key.checkUserIDSig(uid, sig)
+		})
+		if strict && !bound {
+			dropped += 1 + len(uid.Signatures)
+			continue
+		}
+		userIDs = append(userIDs, uid)
+	}
+	var userAttributes []*UserAttribute
+	for _, uat := range key.UserAttributes {
+		var bound bool
+		uat.Signatures, bound = verified(uat.Signatures, func(sig *Signature) error {
+			return key.checkUserAttrSig(uat, sig)
+		})
+		if strict && !bound {
+			dropped += 1 + len(uat.Signatures)
+			continue
+		}
+		userAttributes = append(userAttributes, uat)
+	}
+	var subKeys []*SubKey
+	for _, subKey := range key.SubKeys {
+		var bound bool
+		subKey.Signatures, bound = verified(subKey.Signatures, func(sig *Signature) error {
+			return key.checkSubKeySig(subKey, sig)
+		})
+		if strict && !bound {
+			dropped += 1 + len(subKey.Signatures)
+			continue
+		}
+		subKeys = append(subKeys, subKey)
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = userAttributes
+	key.SubKeys = subKeys
+	if dropped == 0 {
+		return 0, nil
+	}
+	log.WithFields(log.Fields{
+		"fp":      key.Fingerprint(),
+		"dropped": dropped,
+	}).Warn("dropped packets failing self-signature verification")
+	return dropped, errors.WithStack(key.updateMD5())
+}
+
+// isForged returns whether err shows that a signature does not verify, or is
+// malformed, rather than that it could not be verified.
+func isForged(err error) bool {
+	switch errors.Cause(err).(type) {
+	case pgperrors.SignatureError, pgperrors.StructuralError:
+		return true
+	}
+	return false
+}
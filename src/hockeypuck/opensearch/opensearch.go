@@ -0,0 +1,240 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package opensearch provides a keyword search provider backed by an
+// OpenSearch or Elasticsearch index, queried over its REST API.
+package opensearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultIndex   = "hockeypuck"
+	DefaultTimeout = 10 * time.Second
+)
+
+// Provider is a SearchProvider using an OpenSearch index.
+type Provider struct {
+	baseURL string
+	index   string
+	client  *http.Client
+}
+
+var _ hkpstorage.SearchProvider = (*Provider)(nil)
+
+// Option modifies a Provider.
+type Option func(*Provider)
+
+// Index sets the name of the index used to store keys.
+func Index(index string) Option {
+	return func(p *Provider) { p.index = index }
+}
+
+// HTTPClient sets the client used to make requests to the search cluster.
+func HTTPClient(client *http.Client) Option {
+	return func(p *Provider) { p.client = client }
+}
+
+// New returns a Provider using the search cluster at the given URL, creating
+// its index if it does not exist.
+func New(baseURL string, options ...Option) (*Provider, error) {
+	p := &Provider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		index:   DefaultIndex,
+		client:  &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, option := range options {
+		option(p)
+	}
+	err := p.createIndex()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// keyDoc is the document indexed for each key.
+type keyDoc struct {
+	Fingerprint string   `json:"fingerprint"`
+	MD5         string   `json:"md5"`
+	UserIDs     []string `json:"uids"`
+}
+
+var indexMappings = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"fingerprint": map[string]string{"type": "keyword"},
+			"md5":         map[string]string{"type": "keyword"},
+			"uids": map[string]interface{}{
+				"type": "text",
+				"fields": map[string]interface{}{
+					"email": map[string]string{"type": "text", "analyzer": "uax_url_email"},
+				},
+			},
+		},
+	},
+}
+
+func (p *Provider) createIndex() error {
+	resp, err := p.do(http.MethodHead, p.index, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	resp, err = p.doJSON(http.MethodPut, p.index, indexMappings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(decode(resp, nil))
+}
+
+func (p *Provider) Index(keys []*openpgp.PrimaryKey) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, key := range keys {
+		action := map[string]interface{}{
+			"index": map[string]string{"_index": p.index, "_id": key.RFingerprint},
+		}
+		doc := keyDoc{Fingerprint: key.Fingerprint(), MD5: key.MD5}
+		for _, uid := range key.UserIDs {
+			doc.UserIDs = append(doc.UserIDs, uid.Keywords)
+		}
+		if err := enc.Encode(action); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := enc.Encode(&doc); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	resp, err := p.do(http.MethodPost, "_bulk", &body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	err = decode(resp, &result)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if result.Errors {
+		return errors.Errorf("failed to index %d keys", len(keys))
+	}
+	return nil
+}
+
+func (p *Provider) RemoveDigests(digests []string) error {
+	resp, err := p.doJSON(http.MethodPost, p.index+"/_delete_by_query", map[string]interface{}{
+		"query": map[string]interface{}{
+			"terms": map[string]interface{}{"md5": digests},
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(decode(resp, nil))
+}
+
+func (p *Provider) Search(query string, limit int) ([]string, error) {
+	resp, err := p.doJSON(http.MethodPost, p.index+"/_search", map[string]interface{}{
+		"size":    limit,
+		"_source": false,
+		"query": map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":     query,
+				"fields":    []string{"uids", "uids.email"},
+				"fuzziness": "AUTO",
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err = decode(resp, &result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var rfps []string
+	for _, hit := range result.Hits.Hits {
+		rfps = append(rfps, hit.ID)
+	}
+	return rfps, nil
+}
+
+// do makes a request with an optional newline-delimited JSON body, as used by
+// the bulk API.
+func (p *Provider) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.baseURL+"/"+path, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	resp, err := p.client.Do(req)
+	return resp, errors.WithStack(err)
+}
+
+func (p *Provider) doJSON(method, path string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req, err := http.NewRequest(method, p.baseURL+"/"+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	return resp, errors.WithStack(err)
+}
+
+// decode reads a JSON response into v, if not nil, or returns the error
+// reported by the search cluster.
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
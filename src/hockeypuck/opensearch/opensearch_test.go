@@ -0,0 +1,119 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package opensearch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ProviderSuite struct {
+	srv      *httptest.Server
+	requests []string
+	bodies   []string
+	response map[string]string
+}
+
+var _ = gc.Suite(&ProviderSuite{})
+
+func (s *ProviderSuite) SetUpTest(c *gc.C) {
+	s.requests, s.bodies = nil, nil
+	s.response = map[string]string{}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, key)
+		s.bodies = append(s.bodies, string(body))
+		resp, ok := s.response[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+}
+
+func (s *ProviderSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *ProviderSuite) TestCreateIndex(c *gc.C) {
+	s.response["PUT /keys"] = `{"acknowledged":true}`
+	_, err := New(s.srv.URL, Index("keys"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.requests, gc.DeepEquals, []string{"HEAD /keys", "PUT /keys"})
+
+	s.requests = nil
+	s.response["HEAD /keys"] = ""
+	_, err = New(s.srv.URL, Index("keys"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.requests, gc.DeepEquals, []string{"HEAD /keys"})
+}
+
+func (s *ProviderSuite) TestIndexAndSearch(c *gc.C) {
+	s.response["HEAD /hockeypuck"] = ""
+	s.response["POST /_bulk"] = `{"errors":false}`
+	s.response["POST /hockeypuck/_search"] = `{"hits":{"hits":[{"_id":"b"},{"_id":"a"}]}}`
+	s.response["POST /hockeypuck/_delete_by_query"] = `{"deleted":1}`
+	p, err := New(s.srv.URL)
+	c.Assert(err, gc.IsNil)
+
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	err = p.Index([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	lines := strings.Split(strings.TrimSpace(s.bodies[len(s.bodies)-1]), "\n")
+	c.Assert(lines, gc.HasLen, 2)
+	var doc keyDoc
+	err = json.Unmarshal([]byte(lines[1]), &doc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(doc.MD5, gc.Equals, key.MD5)
+	c.Assert(doc.UserIDs, gc.HasLen, len(key.UserIDs))
+	c.Assert(strings.Contains(lines[0], key.RFingerprint), gc.Equals, true)
+
+	rfps, err := p.Search("alice", 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"b", "a"})
+
+	err = p.RemoveDigests([]string{key.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.Contains(s.bodies[len(s.bodies)-1], key.MD5), gc.Equals, true)
+}
+
+func (s *ProviderSuite) TestIndexErrors(c *gc.C) {
+	s.response["HEAD /hockeypuck"] = ""
+	s.response["POST /_bulk"] = `{"errors":true}`
+	p, err := New(s.srv.URL)
+	c.Assert(err, gc.IsNil)
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	err = p.Index([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.NotNil)
+
+	_, err = p.Search("alice", 10)
+	c.Assert(err, gc.ErrorMatches, ".*404 Not Found.*")
+}
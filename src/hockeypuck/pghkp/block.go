@@ -0,0 +1,121 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+var _ hkpstorage.Blocker = (*storage)(nil)
+
+// Block implements storage.Blocker.
+func (st *storage) Block(fp, reason string) error {
+	rfp := openpgp.Reverse(fp)
+	return st.retryTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO blocked_fingerprints (rfingerprint, reason, ctime) VALUES ($1, $2, $3)
+ON CONFLICT (rfingerprint) DO UPDATE SET reason = EXCLUDED.reason`, rfp, reason, st.clock.Now())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = st.deleteTx(tx, fp)
+		if err != nil && !errors.Is(err, hkpstorage.ErrKeyNotFound) {
+			return errors.WithStack(err)
+		}
+		_, err = tx.Exec("DELETE FROM key_metadata WHERE rfingerprint = $1", rfp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tx.Exec("DELETE FROM verified_addresses WHERE rfingerprint = $1", rfp)
+		return errors.WithStack(err)
+	})
+}
+
+// Unblock implements storage.Blocker.
+func (st *storage) Unblock(fp string) error {
+	result, err := st.Exec("DELETE FROM blocked_fingerprints WHERE rfingerprint = $1", openpgp.Reverse(fp))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return errors.WithStack(hkpstorage.ErrKeyNotFound)
+	}
+	return nil
+}
+
+// IsBlocked implements storage.Blocker.
+func (st *storage) IsBlocked(fp string) (bool, error) {
+	var blocked bool
+	err := st.QueryRow("SELECT EXISTS (SELECT 1 FROM blocked_fingerprints WHERE rfingerprint = $1)",
+		openpgp.Reverse(fp)).Scan(&blocked)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return blocked, nil
+}
+
+// BlockedKeys implements storage.Blocker.
+func (st *storage) BlockedKeys() ([]hkpstorage.BlockedKey, error) {
+	rows, err := st.Query("SELECT rfingerprint, reason, ctime FROM blocked_fingerprints ORDER BY ctime")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []hkpstorage.BlockedKey
+	for rows.Next() {
+		var rfp, reason string
+		var ctime time.Time
+		err = rows.Scan(&rfp, &reason, &ctime)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, hkpstorage.BlockedKey{
+			Fingerprint: openpgp.Reverse(rfp),
+			Reason:      reason,
+			Blocked:     ctime,
+		})
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// checkBlockedTx returns storage.ErrKeyBlocked if key is blocked.
+func checkBlockedTx(tx *sql.Tx, key *openpgp.PrimaryKey) error {
+	var blocked bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM blocked_fingerprints WHERE rfingerprint = $1)",
+		key.RFingerprint).Scan(&blocked)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if blocked {
+		return errors.Wrapf(hkpstorage.ErrKeyBlocked, "key 0x%s refused", key.KeyID())
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.CapacityReporter = (*storage)(nil)
+
+// The size of a table includes its TOAST storage, in which the documents of
+// larger keys are held.
+const relationSizesSQL = `SELECT c.relname, COALESCE(t.relname, ''),
+CASE WHEN c.relkind = 'r' THEN pg_table_size(c.oid) ELSE pg_relation_size(c.oid) END AS size,
+GREATEST(c.reltuples, 0)::bigint
+FROM pg_class c
+LEFT JOIN pg_index i ON i.indexrelid = c.oid
+LEFT JOIN pg_class t ON t.oid = i.indrelid
+WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = current_schema())
+AND c.relkind IN ('r', 'i')
+ORDER BY size DESC, c.relname`
+
+// CapacityReport implements storage.CapacityReporter. Ranking the keys scans
+// the whole keys table.
+func (st *storage) CapacityReport(top int) (*hkpstorage.CapacityReport, error) {
+	report := &hkpstorage.CapacityReport{Generated: st.clock.Now()}
+
+	rows, err := st.Query(relationSizesSQL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rel hkpstorage.RelationSize
+		err = rows.Scan(&rel.Name, &rel.Table, &rel.Bytes, &rel.Rows)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		report.Relations = append(report.Relations, rel)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rows.Close()
+
+	err = st.QueryRow(`SELECT count(*), COALESCE(sum(length(keywords)), 0)
+FROM keys WHERE deleted_at IS NULL`).Scan(&report.Keys, &report.KeywordEntries)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	report.LargestKeys, err = st.keySizes("pg_column_size(doc)", top)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	report.MostKeywords, err = st.keySizes("COALESCE(length(keywords), 0)", top)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rows, err = st.Query(`SELECT date_trunc('month', ctime) AS month, count(*)
+FROM keys WHERE deleted_at IS NULL GROUP BY month ORDER BY month`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var period hkpstorage.GrowthPeriod
+		err = rows.Scan(&period.Start, &period.Added)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		period.Start = period.Start.UTC()
+		report.Growth = append(report.Growth, period)
+	}
+	return report, errors.WithStack(rows.Err())
+}
+
+// keySizes returns the sizes of the top keys ranked by the given expression.
+func (st *storage) keySizes(rank string, top int) ([]hkpstorage.KeySize, error) {
+	rows, err := st.Query(`SELECT rfingerprint, pg_column_size(doc), COALESCE(length(keywords), 0)
+FROM keys WHERE deleted_at IS NULL ORDER BY `+rank+` DESC, rfingerprint LIMIT $1`, top)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []hkpstorage.KeySize
+	for rows.Next() {
+		var size hkpstorage.KeySize
+		err = rows.Scan(&size.RFingerprint, &size.Bytes, &size.Keywords)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, size)
+	}
+	return result, errors.WithStack(rows.Err())
+}
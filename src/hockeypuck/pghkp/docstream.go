@@ -0,0 +1,99 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// smallDocSQL selects the doc column of keys whose document takes no more
+// than 1 MiB stored, and NULL for larger ones, which are read with
+// readStreamedDoc instead.
+const smallDocSQL = "CASE WHEN pg_column_size(doc) <= 1048576 THEN doc END"
+
+// docChunkSize is the number of characters of a large document read at a
+// time.
+var docChunkSize = 256 << 10
+
+// readStreamedDoc parses the key with the given fingerprint from its doc
+// column, read in chunks of docChunkSize characters and parsed as they
+// arrive, so that the document is never held in memory whole. The chunks
+// are read in one read-only transaction, so that they are all of the same
+// version of the document. Encrypted documents can only be opened whole.
+// A nil key is returned if the key is no longer stored.
+func (st *storage) readStreamedDoc(rfp string) (*openpgp.PrimaryKey, error) {
+	tx, err := st.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	var sealed bool
+	err = tx.QueryRow("SELECT doc->'encrypted' IS NOT NULL FROM keys WHERE rfingerprint = $1", rfp).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sealed {
+		var doc []byte
+		err = tx.QueryRow("SELECT doc FROM keys WHERE rfingerprint = $1", rfp).Scan(&doc)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return st.readDoc(rfp, doc)
+	}
+	key, err := readKeyDocFrom(&docReader{tx: tx, rfp: rfp})
+	return key, errors.Wrapf(err, "rfp=%q", rfp)
+}
+
+// docReader reads the doc column of a key as text, docChunkSize characters
+// at a time.
+type docReader struct {
+	tx     *sql.Tx
+	rfp    string
+	offset int
+	buf    []byte
+	done   bool
+}
+
+func (r *docReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		var chunk string
+		err := r.tx.QueryRow("SELECT substring(doc::text FROM $2 FOR $3) FROM keys WHERE rfingerprint = $1",
+			r.rfp, r.offset+1, docChunkSize).Scan(&chunk)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		r.offset += docChunkSize
+		r.done = chunk == ""
+		r.buf = []byte(chunk)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,238 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/jsonhkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+var _ hkpstorage.Reencrypter = (*storage)(nil)
+
+// Encryption encrypts the documents and keywords of stored keys with the
+// given keys. Keys stored before encryption was enabled, or encrypted with
+// a key since rotated, remain readable until Reencrypt is applied to them,
+// provided their key is still held.
+func Encryption(keys *hkpstorage.EncryptionKeys) Option {
+	return func(st *storage) { st.encryption = keys }
+}
+
+// sealedDoc is stored in the doc column in place of the JSON document of
+// an encrypted key.
+type sealedDoc struct {
+	Encrypted struct {
+		Key  string `json:"key"`
+		Data []byte `json:"data"`
+	} `json:"encrypted"`
+}
+
+// isSealedDoc returns whether doc is a sealedDoc rather than a key document,
+// which has no "encrypted" member.
+func isSealedDoc(doc []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(doc, "{ \t\r\n"), []byte(`"encrypted"`))
+}
+
+// sealDoc returns the contents of the doc column storing the given key
+// document. The document is bound to the key's fingerprint, so that it
+// cannot be substituted for the document of another key.
+func (st *storage) sealDoc(rfp string, jsonBuf []byte) (string, error) {
+	if st.encryption == nil {
+		return string(jsonBuf), nil
+	}
+	var sd sealedDoc
+	var err error
+	sd.Encrypted.Key, sd.Encrypted.Data, err = st.encryption.Seal(jsonBuf, []byte(rfp))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	buf, err := json.Marshal(&sd)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(buf), nil
+}
+
+// openDoc returns the key document stored in the doc column of the key
+// with the given fingerprint.
+func (st *storage) openDoc(rfp string, doc []byte) ([]byte, error) {
+	if !isSealedDoc(doc) {
+		return doc, nil
+	}
+	if st.encryption == nil {
+		return nil, errors.Errorf("rfp=%q is encrypted but no encryption keys are configured", rfp)
+	}
+	var sd sealedDoc
+	err := json.Unmarshal(doc, &sd)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	jsonBuf, err := st.encryption.Open(sd.Encrypted.Key, sd.Encrypted.Data, []byte(rfp))
+	if err != nil {
+		return nil, errors.Wrapf(err, "rfp=%q", rfp)
+	}
+	return jsonBuf, nil
+}
+
+// readDoc parses a key from the doc column of the key with the given
+// fingerprint.
+func (st *storage) readDoc(rfp string, doc []byte) (*openpgp.PrimaryKey, error) {
+	jsonBuf, err := st.openDoc(rfp, doc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return readKeyDoc(jsonBuf)
+}
+
+// writeDoc returns the contents of the doc column storing key.
+func (st *storage) writeDoc(key *openpgp.PrimaryKey) (string, error) {
+	jsonKey := jsonhkp.NewPrimaryKey(key)
+	jsonKey.RecordProvenance(key)
+	jsonBuf, err := jsonhkp.Marshal(jsonKey)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+	}
+	return st.sealDoc(key.RFingerprint, jsonBuf)
+}
+
+// keywordTokens replaces keywords with the tokens derived from them with
+// the current encryption key, if keywords are encrypted.
+func (st *storage) keywordTokens(keywords []string) []string {
+	if st.encryption == nil {
+		return keywords
+	}
+	id := st.encryption.Current()
+	tokens := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		tokens[i] = st.encryption.KeywordToken(id, keyword)
+	}
+	return tokens
+}
+
+// keywordOperators join the tokens of a search in a tsquery for each
+// KeywordMatch.
+var keywordOperators = map[hkpstorage.KeywordMatch]string{
+	hkpstorage.MatchAllWords: " & ",
+	hkpstorage.MatchAnyWord:  " | ",
+	hkpstorage.MatchPhrase:   " <-> ",
+}
+
+// searchWords splits a keyword search into the words which may match
+// stored keywords. As only tokens of whole keywords are stored when they are
+// encrypted, names and email addresses are matched exactly, rather than
+// parsed by the database.
+func searchWords(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		switch r {
+		case ' ', '\t', '\n', '<', '>', '(', ')', '"', ',':
+			return true
+		}
+		return false
+	})
+}
+
+// encryptedKeywordQuery returns a tsquery matching a search against the
+// tokens of encrypted keywords. Keys indexed with any of the encryption keys
+// are matched, so that searches find keys not yet re-encrypted after the
+// current key was rotated.
+func (st *storage) encryptedKeywordQuery(search string, match hkpstorage.KeywordMatch) string {
+	words := searchWords(search)
+	if len(words) == 0 {
+		return ""
+	}
+	var alternatives []string
+	for _, id := range st.encryption.IDs() {
+		tokens := make([]string, len(words))
+		for i, word := range words {
+			tokens[i] = st.encryption.KeywordToken(id, word)
+		}
+		alternatives = append(alternatives, "("+strings.Join(tokens, keywordOperators[match])+")")
+	}
+	return strings.Join(alternatives, " | ")
+}
+
+// Reencrypt implements storage.Reencrypter.
+func (st *storage) Reencrypt(limit int) (_ int, retErr error) {
+	if st.encryption == nil {
+		return 0, errors.New("no encryption keys are configured")
+	}
+	tx, err := st.Begin()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		} else {
+			retErr = errors.WithStack(tx.Commit())
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT rfingerprint, doc FROM keys
+WHERE doc->'encrypted'->>'key' IS DISTINCT FROM $1
+LIMIT $2 FOR UPDATE SKIP LOCKED`, st.encryption.Current(), limit)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	docs := map[string][]byte{}
+	for rows.Next() {
+		var rfp string
+		var doc []byte
+		err = rows.Scan(&rfp, &doc)
+		if err != nil {
+			rows.Close()
+			return 0, errors.WithStack(err)
+		}
+		docs[rfp] = doc
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for rfp, doc := range docs {
+		jsonBuf, err := st.openDoc(rfp, doc)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		key, err := readKeyDoc(jsonBuf)
+		if err != nil {
+			return 0, errors.Wrapf(err, "cannot read rfp=%q", rfp)
+		} else if key == nil {
+			return 0, errors.Errorf("no key in document of rfp=%q", rfp)
+		}
+		sealed, err := st.sealDoc(rfp, jsonBuf)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		keywords := st.keywordsTSVector(key)
+		_, err = tx.Exec("UPDATE keys SET doc = $1, keywords = to_tsvector($2) WHERE rfingerprint = $3",
+			&sealed, &keywords, rfp)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return len(docs), nil
+}
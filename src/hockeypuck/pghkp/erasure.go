@@ -0,0 +1,142 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+var _ hkpstorage.ErasureStore = (*storage)(nil)
+
+// FileErasure implements storage.ErasureStore.
+func (st *storage) FileErasure(req hkpstorage.ErasureRequest) error {
+	var rfp string
+	if req.Fingerprint != "" {
+		rfp = openpgp.Reverse(req.Fingerprint)
+	}
+	_, err := st.Exec(`INSERT INTO erasure_requests (id, address, rfingerprint, reason, contact, status, filed)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		req.ID, req.Address, rfp, req.Reason, req.Contact, string(hkpstorage.ErasurePending), req.Filed)
+	return errors.WithStack(err)
+}
+
+// ErasureRequests implements storage.ErasureStore.
+func (st *storage) ErasureRequests(status hkpstorage.ErasureStatus) ([]hkpstorage.ErasureRequest, error) {
+	rows, err := st.Query(`SELECT id, address, rfingerprint, reason, contact, status, filed, decided
+FROM erasure_requests WHERE status = $1 ORDER BY filed, id`, string(status))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []hkpstorage.ErasureRequest
+	for rows.Next() {
+		req, err := scanErasureRequest(rows)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, *req)
+	}
+	return result, errors.WithStack(rows.Err())
+}
+
+// DecideErasure implements storage.ErasureStore. Approving a request for
+// an address also forgets that it was verified on any key.
+func (st *storage) DecideErasure(id string, status hkpstorage.ErasureStatus, decided time.Time) (*hkpstorage.ErasureRequest, error) {
+	var req *hkpstorage.ErasureRequest
+	err := st.retryTx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(`UPDATE erasure_requests SET status = $1, decided = $2
+WHERE id = $3 AND status = $4
+RETURNING id, address, rfingerprint, reason, contact, status, filed, decided`,
+			string(status), decided, id, string(hkpstorage.ErasurePending))
+		var err error
+		req, err = scanErasureRequest(row)
+		if err == sql.ErrNoRows {
+			return errors.Wrapf(hkpstorage.ErrErasureNotFound, "id %q", id)
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		if status != hkpstorage.ErasureApproved || req.Address == "" {
+			return nil
+		}
+		_, err = tx.Exec("DELETE FROM verified_addresses WHERE address = $1", req.Address)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tx.Exec("DELETE FROM verification_tokens WHERE address = $1", req.Address)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// AddressKeys implements storage.ErasureStore.
+func (st *storage) AddressKeys(address string) ([]string, error) {
+	cond, _, err := st.keywordCondition(hkpstorage.MatchAllWords)
+	if err != nil {
+		return nil, err
+	}
+	term := st.keywordTerm(address, hkpstorage.MatchAllWords)
+	if term == "" {
+		return nil, nil
+	}
+	rows, err := st.Query("SELECT rfingerprint FROM keys WHERE "+cond+" AND deleted_at IS NULL ORDER BY rfingerprint", term)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, rfp)
+	}
+	return result, errors.WithStack(rows.Err())
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanErasureRequest(row rowScanner) (*hkpstorage.ErasureRequest, error) {
+	var req hkpstorage.ErasureRequest
+	var rfp, status string
+	var decided sql.NullTime
+	err := row.Scan(&req.ID, &req.Address, &rfp, &req.Reason, &req.Contact, &status, &req.Filed, &decided)
+	if err != nil {
+		return nil, err
+	}
+	if rfp != "" {
+		req.Fingerprint = openpgp.Reverse(rfp)
+	}
+	req.Status = hkpstorage.ErasureStatus(status)
+	if decided.Valid {
+		req.Decided = decided.Time
+	}
+	return &req, nil
+}
@@ -0,0 +1,50 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.FingerprintScanner = (*storage)(nil)
+
+// ScanFingerprints implements storage.FingerprintScanner. Rows are read as
+// they are received, so that all fingerprints are not held at once.
+func (st *storage) ScanFingerprints(f func(rfp string) error) error {
+	rows, err := st.Query(`SELECT rfingerprint FROM keys WHERE deleted_at IS NULL
+UNION ALL SELECT rsubfp FROM subkeys JOIN keys ON keys.rfingerprint = subkeys.rfingerprint
+WHERE deleted_at IS NULL`)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = f(rfp)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
@@ -0,0 +1,105 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+var _ hkpstorage.Indexer = (*storage)(nil)
+
+func queueIndexTx(tx *sql.Tx, rfp string) error {
+	_, err := tx.Exec(`INSERT INTO index_queue (rfingerprint, qtime) VALUES ($1, now())
+ON CONFLICT (rfingerprint) DO UPDATE SET qtime = EXCLUDED.qtime`, rfp)
+	return errors.WithStack(err)
+}
+
+func (st *storage) IndexQueued(limit int) (_ int, retErr error) {
+	tx, err := st.Begin()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		} else {
+			retErr = tx.Commit()
+		}
+	}()
+
+	// Concurrent indexers each claim a different batch of queued keys.
+	rows, err := tx.Query(`DELETE FROM index_queue WHERE rfingerprint IN (
+SELECT rfingerprint FROM index_queue ORDER BY qtime LIMIT $1 FOR UPDATE SKIP LOCKED)
+RETURNING rfingerprint`, limit)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	var rfps []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			rows.Close()
+			return 0, errors.WithStack(err)
+		}
+		rfps = append(rfps, rfp)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for _, rfp := range rfps {
+		var doc []byte
+		err = tx.QueryRow("SELECT doc FROM keys WHERE rfingerprint = $1", rfp).Scan(&doc)
+		if err == sql.ErrNoRows {
+			// Deleted since it was queued.
+			continue
+		} else if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		key, err := st.readDoc(rfp, doc)
+		if err != nil {
+			// An unreadable key cannot be indexed, but should not hold up
+			// the rest of the queue.
+			log.Warningf("cannot index rfp=%q: %v", rfp, err)
+			continue
+		}
+		keywords := st.keywordsTSVector(key)
+		_, err = tx.Exec("UPDATE keys SET keywords = to_tsvector($1) WHERE rfingerprint = $2", &keywords, rfp)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return len(rfps), nil
+}
+
+func (st *storage) IndexPending() (int, error) {
+	var n int
+	err := st.QueryRow("SELECT COUNT(*) FROM index_queue").Scan(&n)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, nil
+}
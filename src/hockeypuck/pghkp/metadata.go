@@ -0,0 +1,86 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.MetadataStore = (*storage)(nil)
+
+func (st *storage) Metadata(rfps []string) (map[string]map[string]string, error) {
+	rfps, err := hexParams("rfingerprint", rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(rfps) == 0 {
+		return nil, nil
+	}
+	result := map[string]map[string]string{}
+	err = inBatches(rfps, func(batch []string) error {
+		rows, err := st.Query("SELECT rfingerprint, name, value FROM key_metadata WHERE rfingerprint = ANY($1)", batch)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rfp, name, value string
+			err = rows.Scan(&rfp, &name, &value)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if result[rfp] == nil {
+				result[rfp] = map[string]string{}
+			}
+			result[rfp][name] = value
+		}
+		return errors.WithStack(rows.Err())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (st *storage) SetMetadata(rfp, name, value string) error {
+	err := hkpstorage.ValidateMetadata(name, value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if value == "" {
+		_, err = st.Exec("DELETE FROM key_metadata WHERE rfingerprint = $1 AND name = $2", rfp, name)
+		return errors.WithStack(err)
+	}
+	result, err := st.Exec(`INSERT INTO key_metadata (rfingerprint, name, value, mtime)
+SELECT $1::TEXT, $2::TEXT, $3::TEXT, $4::TIMESTAMPTZ WHERE EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1 AND deleted_at IS NULL)
+ON CONFLICT (rfingerprint, name) DO UPDATE SET value = EXCLUDED.value, mtime = EXCLUDED.mtime`,
+		rfp, name, value, st.clock.Now())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return errors.WithStack(hkpstorage.ErrKeyNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+// keyChangeChannel is the channel on which servers sharing a database
+// publish the key changes they make.
+const keyChangeChannel = "hockeypuck_key_changes"
+
+const (
+	// publishBatchSize is the number of key changes published in each
+	// statement when notifying of keys inserted in bulk.
+	publishBatchSize = 1000
+
+	// listenMinDelay and listenMaxDelay bound the time waited before
+	// listening again after losing the connection.
+	listenMinDelay = time.Second
+	listenMaxDelay = time.Minute
+)
+
+// Types of key change published.
+const (
+	keyChangeAdded    = "added"
+	keyChangeReplaced = "replaced"
+	keyChangeRemoved  = "removed"
+)
+
+// keyChangeMessage is the payload of a key change notification.
+type keyChangeMessage struct {
+	// Origin identifies the server which made the change, so that servers
+	// ignore the changes they publish themselves.
+	Origin    string `json:"origin"`
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	OldID     string `json:"oldID,omitempty"`
+	OldDigest string `json:"oldDigest,omitempty"`
+}
+
+// SharedNotifications publishes the key changes made by this server to the
+// other servers sharing the database, with NOTIFY, and delivers the changes
+// they publish to its listeners, so that their prefix trees and caches stay
+// consistent. Listening holds one connection from the pool.
+func SharedNotifications() Option {
+	return func(st *storage) { st.sharedNotifications = true }
+}
+
+func newOrigin() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// execer executes statements, in a transaction or not.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Notify delivers a committed key change to the listeners of this server
+// and, if notifications are shared, publishes it to the other servers
+// sharing the database.
+func (st *storage) Notify(change hkpstorage.KeyChange) error {
+	err := st.Listeners.Notify(change)
+	perr := st.publishChange(st.DB, change)
+	if perr != nil {
+		log.Warningf("failed to publish %v: %v", change, perr)
+		if err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// publishChange publishes a key change to the other servers sharing the
+// database, if notifications are shared. Published in a transaction, the
+// change is only delivered once the transaction commits, and not at all if
+// it is rolled back.
+func (st *storage) publishChange(ex execer, change hkpstorage.KeyChange) error {
+	if !st.sharedNotifications {
+		return nil
+	}
+	msg, ok := st.keyChangeMessage(change)
+	if !ok {
+		return nil
+	}
+	return st.publish(ex, []*keyChangeMessage{msg})
+}
+
+// keyChangeMessage returns the message publishing a change, or false if
+// the change is not published.
+func (st *storage) keyChangeMessage(change hkpstorage.KeyChange) (*keyChangeMessage, bool) {
+	msg := &keyChangeMessage{Origin: st.origin}
+	switch kc := change.(type) {
+	case hkpstorage.KeyAdded:
+		msg.Type, msg.ID, msg.Digest = keyChangeAdded, kc.ID, kc.Digest
+	case hkpstorage.KeyReplaced:
+		msg.Type, msg.ID, msg.Digest = keyChangeReplaced, kc.NewID, kc.NewDigest
+		msg.OldID, msg.OldDigest = kc.OldID, kc.OldDigest
+	case hkpstorage.KeyRemoved:
+		msg.Type, msg.ID, msg.Digest = keyChangeRemoved, kc.ID, kc.Digest
+	default:
+		return nil, false
+	}
+	return msg, true
+}
+
+// change returns the key change a message publishes.
+func (msg *keyChangeMessage) change() (hkpstorage.KeyChange, error) {
+	switch msg.Type {
+	case keyChangeAdded:
+		return hkpstorage.KeyAdded{ID: msg.ID, Digest: msg.Digest}, nil
+	case keyChangeReplaced:
+		return hkpstorage.KeyReplaced{OldID: msg.OldID, OldDigest: msg.OldDigest, NewID: msg.ID, NewDigest: msg.Digest}, nil
+	case keyChangeRemoved:
+		return hkpstorage.KeyRemoved{ID: msg.ID, Digest: msg.Digest}, nil
+	}
+	return nil, errors.Errorf("unknown key change type %q", msg.Type)
+}
+
+// publish notifies the other servers sharing the database of key changes.
+func (st *storage) publish(ex execer, msgs []*keyChangeMessage) error {
+	payloads := make([]string, len(msgs))
+	for i, msg := range msgs {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		payloads[i] = string(b)
+	}
+	_, err := ex.Exec("SELECT pg_notify($1, payload) FROM unnest($2::text[]) AS payload",
+		keyChangeChannel, payloads)
+	return errors.WithStack(err)
+}
+
+// startListening delivers the key changes published by other servers
+// sharing the database to the listeners of this server, until the storage
+// is closed.
+func (st *storage) startListening() {
+	if !st.sharedNotifications {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	st.listenCancel = cancel
+	st.listenDone = make(chan struct{})
+	go func() {
+		defer close(st.listenDone)
+		delay := listenMinDelay
+		for reconnect := false; ; reconnect = true {
+			start := time.Now()
+			err := st.listen(ctx, reconnect)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(start) > listenMaxDelay {
+				delay = listenMinDelay
+			}
+			log.Warningf("stopped listening for key changes, which may be missed until listening again in %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > listenMaxDelay {
+				delay = listenMaxDelay
+			}
+		}
+	}()
+}
+
+// listen delivers key changes published by other servers until the
+// connection listening for them fails or ctx is done. When listening again
+// after a failure, the listeners are notified that changes may have been
+// missed meanwhile, once no more can be.
+func (st *storage) listen(ctx context.Context, reconnect bool) error {
+	conn, err := st.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		_, err := pgConn.Exec(ctx, "LISTEN "+keyChangeChannel)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if reconnect {
+			err = st.Listeners.Notify(hkpstorage.ChangesMissed{})
+			if err != nil {
+				log.Warningf("failed to deliver missed key changes: %v", err)
+			}
+		}
+		for {
+			n, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			st.receive(n.Payload)
+		}
+	})
+}
+
+// receive delivers a key change published by another server to the
+// listeners of this server.
+func (st *storage) receive(payload string) {
+	var msg keyChangeMessage
+	err := json.Unmarshal([]byte(payload), &msg)
+	if err != nil {
+		log.Warningf("invalid key change notification %q: %v", payload, err)
+		return
+	}
+	if msg.Origin == st.origin {
+		return
+	}
+	change, err := msg.change()
+	if err != nil {
+		log.Warningf("invalid key change notification %q: %v", payload, err)
+		return
+	}
+	err = st.Listeners.Notify(change)
+	if err != nil {
+		log.Warningf("failed to deliver %v from another server: %v", change, err)
+	}
+}
+
+// stopListening stops delivering key changes published by other servers.
+func (st *storage) stopListening() {
+	if st.listenCancel != nil {
+		st.listenCancel()
+		<-st.listenDone
+		st.listenCancel = nil
+	}
+}
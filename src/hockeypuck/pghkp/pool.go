@@ -0,0 +1,153 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+var _ hkpstorage.Pooled = (*storage)(nil)
+
+// PoolConfig controls the pool of connections to the database server. Zero
+// values leave the corresponding setting at its default.
+type PoolConfig struct {
+	// MaxConns limits the number of open connections. By default it is
+	// unlimited.
+	MaxConns int
+	// MaxIdleConns limits the number of idle connections kept open.
+	MaxIdleConns int
+	// MaxConnLifetime is how long a connection may be reused.
+	MaxConnLifetime time.Duration
+	// MaxConnIdleTime is how long a connection may remain idle before it is
+	// closed.
+	MaxConnIdleTime time.Duration
+	// StatementTimeout aborts statements which run for longer.
+	StatementTimeout time.Duration
+	// HealthCheckPeriod is how often idle connections are checked, so that
+	// broken connections are discarded before they are used. By default they
+	// are not checked.
+	HealthCheckPeriod time.Duration
+}
+
+// Pool configures the pool of connections opened by Dial.
+func Pool(config PoolConfig) Option {
+	return func(st *storage) { st.pool = config }
+}
+
+// connConfig sets connection parameters required by the pool configuration.
+func (pc *PoolConfig) connConfig(config *pgx.ConnConfig) {
+	if pc.StatementTimeout > 0 {
+		config.RuntimeParams["statement_timeout"] = strconv.FormatInt(pc.StatementTimeout.Milliseconds(), 10)
+	}
+}
+
+// apply sets the limits of the pool of connections held by db.
+func (pc *PoolConfig) apply(db *sql.DB) {
+	if pc.MaxConns > 0 {
+		db.SetMaxOpenConns(pc.MaxConns)
+	}
+	if pc.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pc.MaxIdleConns)
+	}
+	if pc.MaxConnLifetime > 0 {
+		db.SetConnMaxLifetime(pc.MaxConnLifetime)
+	}
+	if pc.MaxConnIdleTime > 0 {
+		db.SetConnMaxIdleTime(pc.MaxConnIdleTime)
+	}
+}
+
+// PoolStats returns the use of the pool of database connections.
+func (st *storage) PoolStats() hkpstorage.PoolStats {
+	stats := st.Stats()
+	return hkpstorage.PoolStats{
+		MaxConns: stats.MaxOpenConnections,
+		InUse:    stats.InUse,
+	}
+}
+
+// startHealthChecks checks the idle connections in the pool periodically,
+// until Close is called.
+func (st *storage) startHealthChecks() {
+	if st.pool.HealthCheckPeriod <= 0 {
+		return
+	}
+	st.stop = make(chan struct{})
+	st.done = make(chan struct{})
+	go func() {
+		defer close(st.done)
+		ticker := time.NewTicker(st.pool.HealthCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-st.stop:
+				return
+			case <-ticker.C:
+				st.checkIdleConns()
+			}
+		}
+	}()
+}
+
+// checkIdleConns pings each of the idle connections in the pool. The pool
+// discards connections which fail.
+func (st *storage) checkIdleConns() {
+	ctx, cancel := context.WithTimeout(context.Background(), st.pool.HealthCheckPeriod)
+	defer cancel()
+	n := st.Stats().Idle
+	// Connections are held until all have been checked, so that each idle
+	// connection is checked once.
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := st.Conn(ctx)
+		if err != nil {
+			log.Warningf("database health check failed: %v", err)
+			return
+		}
+		conns = append(conns, conn)
+		err = conn.PingContext(ctx)
+		if err != nil {
+			log.Warningf("database connection failed health check: %v", err)
+		}
+	}
+}
+
+// Close stops health checks and listening for key changes, and closes the
+// database.
+func (st *storage) Close() error {
+	st.stopListening()
+	if st.stop != nil {
+		close(st.stop)
+		<-st.done
+		st.stop = nil
+	}
+	return st.DB.Close()
+}
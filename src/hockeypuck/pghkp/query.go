@@ -0,0 +1,60 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxArrayParam limits the number of values bound to a single array
+// parameter, so that very large lookups are split into several queries.
+const maxArrayParam = 1000
+
+// hexParams returns the hex strings in ids lower-cased for use as query
+// parameters. kind describes the strings in errors.
+func hexParams(kind string, ids []string) ([]string, error) {
+	result := make([]string, len(ids))
+	for i, id := range ids {
+		_, err := hex.DecodeString(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", kind, id)
+		}
+		result[i] = strings.ToLower(id)
+	}
+	return result, nil
+}
+
+// inBatches calls f with successive batches of at most maxArrayParam ids,
+// stopping at the first error.
+func inBatches(ids []string, f func(batch []string) error) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxArrayParam {
+			n = maxArrayParam
+		}
+		err := f(ids[:n])
+		if err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.RecoveryStore = (*storage)(nil)
+
+func (st *storage) QueueRecovery(items []hkpstorage.PendingRecovery) error {
+	for len(items) > 0 {
+		n := len(items)
+		if n > maxArrayParam {
+			n = maxArrayParam
+		}
+		var digests, addrs []string
+		var qtimes []time.Time
+		for _, item := range items[:n] {
+			digests = append(digests, item.Digest)
+			addrs = append(addrs, item.HKPAddr)
+			qtimes = append(qtimes, item.Queued)
+		}
+		digests, err := hexParams("digest", digests)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = st.Exec(`INSERT INTO recovery_queue (md5, hkp_addr, qtime)
+SELECT * FROM unnest($1::TEXT[], $2::TEXT[], $3::TIMESTAMPTZ[])
+ON CONFLICT (md5) DO NOTHING`, digests, addrs, qtimes)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		items = items[n:]
+	}
+	return nil
+}
+
+func (st *storage) PendingRecoveries(before time.Time, limit int) ([]hkpstorage.PendingRecovery, error) {
+	rows, err := st.Query(`SELECT md5, hkp_addr, qtime FROM recovery_queue
+WHERE qtime <= $1 ORDER BY qtime LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []hkpstorage.PendingRecovery
+	for rows.Next() {
+		var item hkpstorage.PendingRecovery
+		err = rows.Scan(&item.Digest, &item.HKPAddr, &item.Queued)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, item)
+	}
+	return result, errors.WithStack(rows.Err())
+}
+
+func (st *storage) DequeueRecovery(digests []string) error {
+	digests, err := hexParams("digest", digests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return inBatches(digests, func(batch []string) error {
+		_, err := st.Exec(`DELETE FROM recovery_queue WHERE md5 = ANY($1)`, batch)
+		return errors.WithStack(err)
+	})
+}
+
+func (st *storage) ExpireRecovery(before time.Time) (int, error) {
+	result, err := st.Exec(`DELETE FROM recovery_queue WHERE qtime < $1`, before)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,112 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+var _ hkpstorage.Retainer = (*storage)(nil)
+
+func (st *storage) Accessed(rfps []string) error {
+	rfps, err := hexParams("rfingerprint", rfps)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	now := st.clock.Now()
+	return inBatches(rfps, func(batch []string) error {
+		_, err := st.Exec("UPDATE keys SET atime = $1 WHERE rfingerprint = ANY($2)", now, batch)
+		return errors.WithStack(err)
+	})
+}
+
+func (st *storage) NotAccessedSince(t time.Time, after string, limit int) ([]string, error) {
+	rows, err := st.Query(`SELECT rfingerprint FROM keys
+WHERE COALESCE(atime, ctime) < $1 AND rfingerprint > $2 AND deleted_at IS NULL
+ORDER BY rfingerprint LIMIT $3`, t.UTC(), after, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (st *storage) Tombstone(fp string) (retErr error) {
+	tx, err := st.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var change hkpstorage.KeyChange
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+			return
+		}
+		retErr = tx.Commit()
+		if retErr == nil && change != nil {
+			st.Listeners.Notify(change)
+		}
+	}()
+	md5, err := st.deleteTx(tx, fp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tx.Exec(`INSERT INTO tombstones (rfingerprint, md5, dtime) VALUES ($1, $2, $3)
+ON CONFLICT (rfingerprint) DO UPDATE SET md5 = EXCLUDED.md5, dtime = EXCLUDED.dtime`,
+		openpgp.Reverse(fp), md5, st.clock.Now())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if md5 == "" {
+		// The digest of a deleted key has already been removed.
+		return nil
+	}
+	change = hkpstorage.KeyRemoved{ID: fp, Digest: md5}
+	return errors.WithStack(st.publishChange(tx, change))
+}
+
+func (st *storage) Tombstoned(rfp string) (bool, error) {
+	var n int
+	// Keys which have been deleted, or are withheld from lookups, are refused
+	// like tombstoned keys.
+	err := st.QueryRow(`SELECT (SELECT COUNT(*) FROM tombstones WHERE rfingerprint = $1) +
+(SELECT COUNT(*) FROM keys WHERE rfingerprint = $1 AND NOT (`+servedSQL+`))`, rfp).Scan(&n)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
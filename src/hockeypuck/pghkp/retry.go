@@ -0,0 +1,92 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// maxTxRetries is the number of times a transaction which failed due to a
+// concurrent transaction is attempted again.
+const maxTxRetries = 5
+
+// PostgreSQL error codes for failures caused by concurrent transactions.
+const (
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+	uniqueViolation      = "23505"
+)
+
+// retryable returns whether err is due to a concurrent transaction, so that
+// the transaction may succeed if attempted again.
+//
+// Unique violations are included because INSERT ... ON CONFLICT only
+// tolerates conflicts on its arbiter index: two submissions of the same key
+// racing may collide on another unique column, such as md5, instead. Once
+// the winning transaction commits, a retry finds the conflict it expects.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case serializationFailure, deadlockDetected, uniqueViolation:
+		return true
+	}
+	return false
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+// retryTx runs f in a transaction, which is committed if f succeeds and
+// rolled back if it fails. If f or the commit fail due to a concurrent
+// transaction, the transaction is attempted again, up to maxTxRetries times.
+func (st *storage) retryTx(f func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt <= maxTxRetries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("retrying transaction after concurrent update: %v", err)
+		}
+		err = st.runTx(f)
+		if !retryable(err) {
+			return err
+		}
+	}
+	return errors.Wrapf(err, "transaction failed after %d retries", maxTxRetries)
+}
+
+func (st *storage) runTx(f func(tx *sql.Tx) error) error {
+	tx, err := st.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.WithStack(tx.Commit())
+}
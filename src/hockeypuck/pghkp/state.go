@@ -0,0 +1,85 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.KeyStateStore = (*storage)(nil)
+
+// Conditions on the keys table selecting the keys returned by lookups, and
+// those found by keyword searches, according to their hkpstorage.KeyState.
+const (
+	servedSQL     = "deleted_at IS NULL AND state NOT IN ('quarantined', 'banned')"
+	searchableSQL = "deleted_at IS NULL AND state = ''"
+)
+
+// SetKeyState implements storage.KeyStateStore.
+func (st *storage) SetKeyState(rfp string, state hkpstorage.KeyState) error {
+	result, err := st.Exec("UPDATE keys SET state = $1 WHERE rfingerprint = $2 AND deleted_at IS NULL",
+		string(state), rfp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return errors.WithStack(hkpstorage.ErrKeyNotFound)
+	}
+	return nil
+}
+
+// KeyState implements storage.KeyStateStore.
+func (st *storage) KeyState(rfp string) (hkpstorage.KeyState, error) {
+	var state string
+	err := st.QueryRow("SELECT state FROM keys WHERE rfingerprint = $1 AND deleted_at IS NULL", rfp).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", errors.WithStack(hkpstorage.ErrKeyNotFound)
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hkpstorage.KeyState(state), nil
+}
+
+// KeysInState implements storage.KeyStateStore.
+func (st *storage) KeysInState(state hkpstorage.KeyState, after string, limit int) ([]string, error) {
+	rows, err := st.Query(`SELECT rfingerprint FROM keys
+WHERE state = $1 AND rfingerprint > $2 AND deleted_at IS NULL
+ORDER BY rfingerprint LIMIT $3`, string(state), after, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, rfp)
+	}
+	return result, errors.WithStack(rows.Err())
+}
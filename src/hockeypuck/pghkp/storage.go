@@ -19,17 +19,15 @@ package pghkp
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
-	"sync"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 	"github.com/pkg/errors"
 
 	"hockeypuck/hkp/jsonhkp"
@@ -47,8 +45,40 @@ type storage struct {
 	dbName  string
 	options []openpgp.KeyReaderOption
 
-	mu        sync.Mutex
-	listeners []func(hkpstorage.KeyChange) error
+	// deferIndexing queues inserted and updated keys for keyword indexing,
+	// rather than indexing them in the same transaction.
+	deferIndexing bool
+
+	// bulkBatchSize is the number of keys copied to the server in each
+	// transaction of a bulk insertion.
+	bulkBatchSize int
+
+	// insertBatchSize is the number of keys added in each transaction when
+	// there are too few to insert in bulk.
+	insertBatchSize int
+
+	// clock provides the times recorded in the database.
+	clock hkpstorage.Clock
+
+	// encryption, if set, encrypts the documents and keywords of keys.
+	encryption *hkpstorage.EncryptionKeys
+
+	// trigramSearch indexes the trigrams of user IDs, with which searches
+	// may match substrings and similar words.
+	trigramSearch bool
+
+	pool       PoolConfig
+	stop, done chan struct{}
+
+	// sharedNotifications publishes key changes to the other servers
+	// sharing the database, which are identified by origin, and delivers
+	// theirs to listeners.
+	sharedNotifications bool
+	origin              string
+	listenCancel        context.CancelFunc
+	listenDone          chan struct{}
+
+	hkpstorage.Listeners
 }
 
 var _ hkpstorage.Storage = (*storage)(nil)
@@ -67,28 +97,108 @@ rfingerprint TEXT NOT NULL,
 rsubfp TEXT NOT NULL PRIMARY KEY,
 FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint)
 )
+`,
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS atime TIMESTAMP WITH TIME ZONE
+`,
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE
+`,
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT ''
+`,
+	`CREATE TABLE IF NOT EXISTS tombstones (
+rfingerprint TEXT NOT NULL PRIMARY KEY,
+md5 TEXT NOT NULL,
+dtime TIMESTAMP WITH TIME ZONE NOT NULL
+)
+`,
+	`CREATE TABLE IF NOT EXISTS blocked_fingerprints (
+rfingerprint TEXT NOT NULL PRIMARY KEY,
+reason TEXT NOT NULL,
+ctime TIMESTAMP WITH TIME ZONE NOT NULL
+)
+`,
+	`CREATE TABLE IF NOT EXISTS key_metadata (
+rfingerprint TEXT NOT NULL,
+name TEXT NOT NULL,
+value TEXT NOT NULL,
+mtime TIMESTAMP WITH TIME ZONE NOT NULL,
+PRIMARY KEY (rfingerprint, name)
+)
+`,
+	`CREATE TABLE IF NOT EXISTS verified_addresses (
+rfingerprint TEXT NOT NULL,
+address TEXT NOT NULL,
+verified TIMESTAMP WITH TIME ZONE NOT NULL,
+source TEXT NOT NULL,
+PRIMARY KEY (rfingerprint, address)
+)
+`,
+	`CREATE TABLE IF NOT EXISTS verification_tokens (
+id TEXT NOT NULL PRIMARY KEY,
+address TEXT NOT NULL,
+source TEXT NOT NULL,
+issued TIMESTAMP WITH TIME ZONE NOT NULL,
+expires TIMESTAMP WITH TIME ZONE NOT NULL
+)
+`,
+	`CREATE TABLE IF NOT EXISTS erasure_requests (
+id TEXT NOT NULL PRIMARY KEY,
+address TEXT NOT NULL,
+rfingerprint TEXT NOT NULL,
+reason TEXT NOT NULL,
+contact TEXT NOT NULL,
+status TEXT NOT NULL,
+filed TIMESTAMP WITH TIME ZONE NOT NULL,
+decided TIMESTAMP WITH TIME ZONE
+)
+`,
+	`CREATE TABLE IF NOT EXISTS index_queue (
+rfingerprint TEXT NOT NULL PRIMARY KEY,
+qtime TIMESTAMP WITH TIME ZONE NOT NULL
+)
+`,
+	`CREATE TABLE IF NOT EXISTS recovery_queue (
+md5 TEXT NOT NULL PRIMARY KEY,
+hkp_addr TEXT NOT NULL,
+qtime TIMESTAMP WITH TIME ZONE NOT NULL
+)
 `,
 }
 
 var crIndexesSQL = []string{
 	`CREATE INDEX IF NOT EXISTS keys_rfp ON keys(rfingerprint text_pattern_ops);`,
+	`CREATE INDEX IF NOT EXISTS verification_tokens_address ON verification_tokens(address, issued);`,
+	`CREATE INDEX IF NOT EXISTS verification_tokens_source ON verification_tokens(source, issued);`,
+	`CREATE INDEX IF NOT EXISTS verification_tokens_expires ON verification_tokens(expires);`,
+	`CREATE INDEX IF NOT EXISTS recovery_queue_qtime ON recovery_queue(qtime);`,
+	`CREATE INDEX IF NOT EXISTS erasure_requests_status ON erasure_requests(status, filed);`,
+	`CREATE INDEX IF NOT EXISTS verified_addresses_local ON verified_addresses(verified) WHERE source = '';`,
 	`CREATE INDEX IF NOT EXISTS keys_ctime ON keys(ctime);`,
 	`CREATE INDEX IF NOT EXISTS keys_mtime ON keys(mtime);`,
 	`CREATE INDEX IF NOT EXISTS keys_keywords ON keys USING gin(keywords);`,
 	`CREATE INDEX IF NOT EXISTS subkeys_rfp ON subkeys(rsubfp text_pattern_ops);`,
+	`CREATE INDEX IF NOT EXISTS keys_state ON keys(state, rfingerprint) WHERE state <> '';`,
 }
 
-var drConstraintsSQL = []string{
-	`ALTER TABLE keys DROP CONSTRAINT keys_pk;`,
-	`ALTER TABLE keys DROP CONSTRAINT keys_md5;`,
-	`DROP INDEX keys_rfp;`,
-	`DROP INDEX keys_ctime;`,
-	`DROP INDEX keys_mtime;`,
-	`DROP INDEX keys_keywords;`,
+// crConstraintsSQL restores the constraints dropped by drConstraintsSQL.
+var crConstraintsSQL = []string{
+	`DO $$ BEGIN
+IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'subkeys_rfingerprint_fkey') THEN
+ALTER TABLE subkeys ADD CONSTRAINT subkeys_rfingerprint_fkey FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint);
+END IF;
+END $$;`,
+}
 
-	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_pk;`,
-	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_fk;`,
-	`DROP INDEX subkeys_rfp;`,
+// drConstraintsSQL drops the indexes and constraints which are not needed
+// to check for duplicates during bulk insertion. The unique constraints on
+// keys and subkeys remain, as the bulk insertion queries depend on them.
+var drConstraintsSQL = []string{
+	`DROP INDEX IF EXISTS keys_rfp;`,
+	`DROP INDEX IF EXISTS keys_ctime;`,
+	`DROP INDEX IF EXISTS keys_mtime;`,
+	`DROP INDEX IF EXISTS keys_keywords;`,
+	`DROP INDEX IF EXISTS keys_userids_trgm;`,
+	`DROP INDEX IF EXISTS subkeys_rfp;`,
+	`ALTER TABLE subkeys DROP CONSTRAINT IF EXISTS subkeys_rfingerprint_fkey;`,
 }
 
 var crTempTablesSQL = []string{
@@ -98,7 +208,7 @@ doc jsonb,
 ctime TIMESTAMP WITH TIME ZONE,
 mtime TIMESTAMP WITH TIME ZONE,
 md5 TEXT,
-keywords tsvector
+keywords TEXT
 )
 `,
 	`CREATE TEMPORARY TABLE IF NOT EXISTS subkeys_copyin (
@@ -133,12 +243,18 @@ var drTempTablesSQL = []string{
 `,
 }
 
+// bulkTxFilterBlockedKeys drops blocked keys from those in a call to Insert(..) before any
+// other filtering, so that they are neither inserted nor counted as duplicates.
+const bulkTxFilterBlockedKeys string = `DELETE FROM keys_copyin WHERE 
+EXISTS (SELECT 1 FROM blocked_fingerprints WHERE blocked_fingerprints.rfingerprint = keys_copyin.rfingerprint)
+`
+
 // bulkTxFilterUniqueKeys is a key-filtering quyery, between temporary tables, used for bulk insertion.
 // Among all the keys in a call to Insert(..) (usually the keys in a processed key-dump file), this
 // filter gets the unique keys, i.e., those with unique rfingerprint *and* unique md5, but *neither*
 // with rfingerprint *nor* with md5 that currently exist in the DB.
 const bulkTxFilterUniqueKeys string = `INSERT INTO keys_checked (rfingerprint, doc, ctime, mtime, md5, keywords) 
-SELECT rfingerprint, doc, ctime, mtime, md5, keywords FROM keys_copyin kcpinA WHERE 
+SELECT rfingerprint, doc, ctime, mtime, md5, to_tsvector(keywords) FROM keys_copyin kcpinA WHERE 
 rfingerprint IS NOT NULL AND doc IS NOT NULL AND ctime IS NOT NULL AND mtime IS NOT NULL AND md5 IS NOT NULL AND 
 (SELECT COUNT (*) FROM keys_copyin kcpinB WHERE kcpinB.rfingerprint = kcpinA.rfingerprint OR 
                                                 kcpinB.md5          = kcpinA.md5) = 1 AND 
@@ -162,7 +278,7 @@ const bulkTxFilterDupKeys string =
 // ===> If there are different md5 for same rfp, this query allows them into keys_checked: <===
 // ===>  ***  an intentional error of non-unique rfp, to revert to normal insertion!  ***  <===
 `INSERT INTO keys_checked (rfingerprint, doc, ctime, mtime, md5, keywords) 
-SELECT rfingerprint, doc, ctime, mtime, md5, keywords FROM keys_copyin WHERE 
+SELECT rfingerprint, doc, ctime, mtime, md5, to_tsvector(keywords) FROM keys_copyin WHERE 
 ( ctid IN 
      (SELECT ctid FROM 
         (SELECT ctid, ROW_NUMBER() OVER (PARTITION BY rfingerprint ORDER BY ctid) rfpEnum FROM keys_copyin) AS dupRfpTAB 
@@ -267,36 +383,127 @@ const bulkInsQueryKeyChange string = `SELECT md5 FROM keys_checked
 const keys_copyin_temp_table_name string = "keys_copyin"
 const subkeys_copyin_temp_table_name string = "subkeys_copyin"
 
-// keysInBunch is the maximum number of keys sent in a bunch during bulk insertion.
-// Since keys (and subkeys) are sent to the DB in prepared statements with parameters and
-// each key requires 6 parameters, 6 x keysInBunch < 65536 must hold (keysInBunch <= ~10900).
-// 64k (2-byte parameter count) is the current protocol limit for client communication,
-// of prepared statements in PostreSQL v13 (see Bind message in
-// https://www.postgresql.org/docs/current/protocol-message-formats.html).
-const keysInBunch int = 5000
-// subkeysInBunch is the maximum number of subkeys sent in a bunch (for at most
-// keysInBunch keys sent in a bunch) during bulk insertion. Each subkey requires 2
-// parameters, so less than 32k subkeys can fit in a bunch (see keysInBunch).
-const subkeysInBunch int = 32000
+// DefaultBulkBatchSize is the default number of keys copied to the server in
+// each transaction of a bulk insertion.
+const DefaultBulkBatchSize int = 10000
+// DefaultInsertBatchSize is the default number of keys added in each
+// transaction when there are too few to insert in bulk: each key is added in
+// its own transaction.
+const DefaultInsertBatchSize int = 1
+
 // minKeys2UseBulk is the minimum number of keys in a call to Insert(..) that
 // will trigger a bulk insertion. Otherwise, Insert(..) preceeds one key at a time.
 const minKeys2UseBulk int = 3500
 
-// Dial returns PostgreSQL storage connected to the given database URL.
-func Dial(url string, options []openpgp.KeyReaderOption) (hkpstorage.Storage, error) {
-	db, err := sql.Open("postgres", url)
+// Option modifies the behavior of PostgreSQL storage.
+type Option func(*storage)
+
+// DeferIndexing queues inserted and updated keys to have their search
+// keywords indexed by IndexQueued, instead of indexing them as they are
+// stored. Keys are resolvable by fingerprint immediately, and searchable once
+// indexed. Bulk inserts are still indexed as they are stored.
+func DeferIndexing() Option {
+	return func(st *storage) { st.deferIndexing = true }
+}
+
+// BulkBatchSize sets the number of keys copied to the server in each
+// transaction of a bulk insertion.
+func BulkBatchSize(n int) Option {
+	return func(st *storage) {
+		if n > 0 {
+			st.bulkBatchSize = n
+		}
+	}
+}
+
+// InsertBatchSize sets the number of keys added in each transaction when
+// there are too few to insert in bulk, such as while catching up with recon
+// peers. A key which fails to insert is rolled back alone, and reported in
+// the InsertError.
+func InsertBatchSize(n int) Option {
+	return func(st *storage) {
+		if n > 0 {
+			st.insertBatchSize = n
+		}
+	}
+}
+
+// Clock sets the clock providing the creation, modification, access and
+// deletion times recorded in the database.
+func Clock(clock hkpstorage.Clock) Option {
+	return func(st *storage) { st.clock = clock }
+}
+
+// Dial returns PostgreSQL storage connected to the given database, specified
+// as a URL or a connection string of key=value settings.
+func Dial(url string, options []openpgp.KeyReaderOption, storageOptions ...Option) (hkpstorage.Storage, error) {
+	config, err := pgx.ParseConfig(url)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return New(db, options)
+	// Options are applied again by New; only the pool configuration is
+	// needed to connect.
+	var st storage
+	for _, option := range storageOptions {
+		option(&st)
+	}
+	st.pool.connConfig(config)
+	return New(stdlib.OpenDB(*config), options, storageOptions...)
+}
+
+func init() {
+	for _, name := range []string{"postgres-jsonb", "postgres", "postgresql"} {
+		hkpstorage.Register(name, dial)
+	}
+}
+
+// dial is the factory of the "postgres-jsonb" storage driver, also selected
+// by postgres:// and postgresql:// data source URLs.
+func dial(dsn string, config *hkpstorage.Config) (hkpstorage.Storage, error) {
+	var options []Option
+	if config.DeferIndexing {
+		options = append(options, DeferIndexing())
+	}
+	if config.BulkBatchSize > 0 {
+		options = append(options, BulkBatchSize(config.BulkBatchSize))
+	}
+	if config.InsertBatchSize > 0 {
+		options = append(options, InsertBatchSize(config.InsertBatchSize))
+	}
+	options = append(options, Pool(PoolConfig{
+		MaxConns:          config.MaxConns,
+		MaxIdleConns:      config.MaxIdleConns,
+		MaxConnLifetime:   config.MaxConnLifetime,
+		MaxConnIdleTime:   config.MaxConnIdleTime,
+		StatementTimeout:  config.StatementTimeout,
+		HealthCheckPeriod: config.HealthCheckPeriod,
+	}))
+	if config.Encryption != nil {
+		options = append(options, Encryption(config.Encryption))
+	}
+	if config.TrigramSearch {
+		options = append(options, TrigramSearch())
+	}
+	if config.SharedNotifications {
+		options = append(options, SharedNotifications())
+	}
+	return Dial(dsn, config.KeyReaderOptions, options...)
 }
 
 // New returns a PostgreSQL storage implementation for an HKP service.
-func New(db *sql.DB, options []openpgp.KeyReaderOption) (hkpstorage.Storage, error) {
+func New(db *sql.DB, options []openpgp.KeyReaderOption, storageOptions ...Option) (hkpstorage.Storage, error) {
 	st := &storage{
-		DB:      db,
-		options: options,
+		DB:            db,
+		options:       options,
+		bulkBatchSize:   DefaultBulkBatchSize,
+		insertBatchSize: DefaultInsertBatchSize,
+		clock:           hkpstorage.SystemClock,
+		origin:          newOrigin(),
 	}
+	for _, option := range storageOptions {
+		option(st)
+	}
+	st.pool.apply(db)
 	err := st.createTables()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create tables")
@@ -305,6 +512,12 @@ func New(db *sql.DB, options []openpgp.KeyReaderOption) (hkpstorage.Storage, err
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create indexes")
 	}
+	err = st.createConstraints()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create constraints")
+	}
+	st.startHealthChecks()
+	st.startListening()
 	return st, nil
 }
 
@@ -325,6 +538,53 @@ func (st *storage) createIndexes() error {
 			return errors.WithStack(err)
 		}
 	}
+	if st.trigramSearch {
+		for _, crIndexSQL := range crTrigramIndexesSQL {
+			_, err := st.Exec(crIndexSQL)
+			if err != nil {
+				return errors.Wrap(err, "failed to create trigram index")
+			}
+		}
+	}
+	return nil
+}
+
+func (st *storage) createConstraints() error {
+	for _, crConstraintSQL := range crConstraintsSQL {
+		_, err := st.Exec(crConstraintSQL)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+var _ hkpstorage.BulkLoader = (*storage)(nil)
+
+// DeferIndexes drops the indexes and constraints which slow down bulk
+// insertion. They are restored by RestoreIndexes, or when the storage is
+// next opened.
+func (st *storage) DeferIndexes() error {
+	for _, drConstraintSQL := range drConstraintsSQL {
+		_, err := st.Exec(drConstraintSQL)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// RestoreIndexes recreates the indexes and constraints dropped by
+// DeferIndexes.
+func (st *storage) RestoreIndexes() error {
+	err := st.createIndexes()
+	if err != nil {
+		return errors.Wrap(err, "failed to create indexes")
+	}
+	err = st.createConstraints()
+	if err != nil {
+		return errors.Wrap(err, "failed to create constraints")
+	}
 	return nil
 }
 
@@ -338,35 +598,30 @@ type keyDoc struct {
 }
 
 func (st *storage) MatchMD5(md5s []string) ([]string, error) {
-	var md5In []string
-	for _, md5 := range md5s {
-		// Must validate to prevent SQL injection since we're appending SQL strings here.
-		_, err := hex.DecodeString(md5)
-		if err != nil {
-			return nil, errors.Wrapf(err, "invalid MD5 %q", md5)
-		}
-		md5In = append(md5In, "'"+strings.ToLower(md5)+"'")
-	}
-
-	sqlStr := fmt.Sprintf("SELECT rfingerprint FROM keys WHERE md5 IN (%s)", strings.Join(md5In, ","))
-	rows, err := st.Query(sqlStr)
+	md5s, err := hexParams("MD5", md5s)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	var result []string
-	defer rows.Close()
-	for rows.Next() {
-		var rfp string
-		err := rows.Scan(&rfp)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errors.WithStack(err)
+	err = inBatches(md5s, func(batch []string) error {
+		rows, err := st.Query(matchMD5SQL, batch)
+		if err != nil {
+			return errors.WithStack(err)
 		}
-		result = append(result, rfp)
-	}
-	err = rows.Err()
+		defer rows.Close()
+		for rows.Next() {
+			var rfp string
+			err := rows.Scan(&rfp)
+			if err != nil && err != sql.ErrNoRows {
+				return errors.WithStack(err)
+			}
+			result = append(result, rfp)
+		}
+		return errors.WithStack(rows.Err())
+	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	return result, nil
 }
@@ -377,70 +632,82 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 // currently won't match.
 func (st *storage) Resolve(keyids []string) (_ []string, retErr error) {
 	var result []string
-	sqlStr := "SELECT rfingerprint FROM keys WHERE rfingerprint LIKE $1 || '%'"
+	sqlStr := `SELECT rfingerprint FROM keys WHERE rfingerprint LIKE $1 || '%' AND ` + servedSQL + `
+UNION SELECT subkeys.rfingerprint FROM subkeys JOIN keys ON keys.rfingerprint = subkeys.rfingerprint
+WHERE rsubfp LIKE $1 || '%' AND ` + servedSQL + `
+ORDER BY rfingerprint`
 	stmt, err := st.Prepare(sqlStr)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer stmt.Close()
 
-	var subKeyIDs []string
+	// A key ID may match several keys, by their own fingerprint or that
+	// of a subkey. All of them are returned, so that the ambiguity is
+	// apparent to clients.
 	for _, keyid := range keyids {
-		keyid = strings.ToLower(keyid)
-		var rfp string
-		row := stmt.QueryRow(keyid)
-		err = row.Scan(&rfp)
-		if err == sql.ErrNoRows {
-			subKeyIDs = append(subKeyIDs, keyid)
-		} else if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		result = append(result, rfp)
-	}
-
-	if len(subKeyIDs) > 0 {
-		subKeyResult, err := st.resolveSubKeys(subKeyIDs)
+		err = func() error {
+			rows, err := stmt.Query(strings.ToLower(keyid))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var rfp string
+				err = rows.Scan(&rfp)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				result = append(result, rfp)
+			}
+			return errors.WithStack(rows.Err())
+		}()
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
-		result = append(result, subKeyResult...)
 	}
-
 	return result, nil
 }
 
-func (st *storage) resolveSubKeys(keyids []string) ([]string, error) {
-	var result []string
-	sqlStr := "SELECT rfingerprint FROM subkeys WHERE rsubfp LIKE $1 || '%'"
-	stmt, err := st.Prepare(sqlStr)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer stmt.Close()
+func (st *storage) MatchKeyword(search []string) ([]string, error) {
+	return st.MatchKeywords(search, hkpstorage.MatchAllWords)
+}
 
-	for _, keyid := range keyids {
-		keyid = strings.ToLower(keyid)
-		var rfp string
-		row := stmt.QueryRow(keyid)
-		err = row.Scan(&rfp)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errors.WithStack(err)
-		}
-		result = append(result, rfp)
-	}
+var _ hkpstorage.KeywordMatcher = (*storage)(nil)
 
-	return result, nil
+// keywordQueries are the tsquery expressions for a keyword search with each
+// KeywordMatch. Keywords are stored as plain lexemes, so that the operators
+// between them are chosen when searching.
+var keywordQueries = map[hkpstorage.KeywordMatch]string{
+	hkpstorage.MatchAllWords: "plainto_tsquery($1)",
+	hkpstorage.MatchAnyWord:  "replace(plainto_tsquery($1)::TEXT, ' & ', ' | ')::TSQUERY",
+	hkpstorage.MatchPhrase:   "phraseto_tsquery($1)",
 }
 
-func (st *storage) MatchKeyword(search []string) ([]string, error) {
+// MatchKeywords returns the keys matching each keyword search, combining its
+// words as selected by match, best matches first.
+//
+// Phrases are matched by the positions of keywords, which follow the order
+// of the words in each user ID only for keys indexed since keywords were
+// stored as plain lexemes.
+func (st *storage) MatchKeywords(search []string, match hkpstorage.KeywordMatch) ([]string, error) {
+	cond, rank, err := st.keywordCondition(match)
+	if err != nil {
+		return nil, err
+	}
 	var result []string
-	stmt, err := st.Prepare("SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) LIMIT $2")
+	stmt, err := st.Prepare("SELECT rfingerprint FROM keys WHERE " + cond + " AND " + searchableSQL +
+		st.orderBy(hkpstorage.OrderRelevance, rank) + " LIMIT $2")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer stmt.Close()
 
 	for _, term := range search {
+		term = st.keywordTerm(term, match)
+		if term == "" {
+			continue
+		}
 		err = func() error {
 			rows, err := stmt.Query(term, 100)
 			if err != nil {
@@ -468,124 +735,364 @@ func (st *storage) MatchKeyword(search []string) ([]string, error) {
 	return result, nil
 }
 
-func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
-	var result []string
-	rows, err := st.Query("SELECT rfingerprint FROM keys WHERE mtime > $1 ORDER BY mtime DESC LIMIT 100", t.UTC())
+// keywordCondition returns the condition on keys of a keyword search with
+// the given match, of the search term in $1, and the expression ranking how
+// well they match it, which is empty if matches are not ranked.
+func (st *storage) keywordCondition(match hkpstorage.KeywordMatch) (cond, rank string, _ error) {
+	if cond, ok := trigramConditions[match]; ok {
+		if !st.trigramSearch || st.encryption != nil {
+			return "", "", hkpstorage.ErrKeywordMatchNotAvailable
+		}
+		return cond, trigramRanks[match], nil
+	}
+	query, ok := keywordQueries[match]
+	if !ok {
+		return "", "", errors.Errorf("unsupported keyword match %q", match)
+	}
+	if st.encryption != nil {
+		// Searches are turned into queries of keyword tokens here, as the
+		// database cannot derive them.
+		query = "to_tsquery($1)"
+	}
+	return "keywords @@ " + query, "ts_rank(keywords, " + query + ")", nil
+}
+
+// orderBy returns the ORDER BY clause listing keys in the given order, by
+// the rank expression for OrderRelevance, with the fingerprint as a final
+// tie-breaker so that pages are stable. The creation times of encrypted
+// documents are unknown, so OrderCreated orders them as OrderRelevance.
+func (st *storage) orderBy(order hkpstorage.ResultOrder, rank string) string {
+	switch order {
+	case hkpstorage.OrderModified:
+		return " ORDER BY mtime DESC, rfingerprint"
+	case hkpstorage.OrderCreated:
+		if st.encryption == nil {
+			// Creation times are recorded in RFC 3339 format in UTC,
+			// which sorts in time order.
+			return " ORDER BY doc->>'creation' DESC, rfingerprint"
+		}
+	}
+	if rank == "" {
+		return " ORDER BY mtime DESC, rfingerprint"
+	}
+	return " ORDER BY " + rank + " DESC, mtime DESC, rfingerprint"
+}
+
+// keywordTerm returns the parameter of keywordCondition for a search, or
+// the empty string if the search cannot match anything.
+func (st *storage) keywordTerm(search string, match hkpstorage.KeywordMatch) string {
+	if _, ok := trigramConditions[match]; ok {
+		return trigramTerm(search, match)
+	}
+	if st.encryption != nil {
+		return st.encryptedKeywordQuery(search, match)
+	}
+	return search
+}
+
+// MatchKeywordPage returns a page of the keys matching a keyword search in
+// the given order, and the total number of matches.
+func (st *storage) MatchKeywordPage(search string, match hkpstorage.KeywordMatch, order hkpstorage.ResultOrder, limit, offset int) ([]string, int, error) {
+	cond, rank, err := st.keywordCondition(match)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, 0, err
+	}
+	term := st.keywordTerm(search, match)
+	if term == "" {
+		return nil, 0, nil
+	}
+	where := " FROM keys WHERE " + cond + " AND " + searchableSQL
+
+	var total int
+	err = st.QueryRow("SELECT COUNT(*)"+where, term).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if offset >= total {
+		return nil, total, nil
+	}
+
+	rows, err := st.Query("SELECT rfingerprint"+where+st.orderBy(order, rank)+" LIMIT $2 OFFSET $3", term, limit, offset)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
 	}
 	defer rows.Close()
+	var result []string
 	for rows.Next() {
 		var rfp string
 		err = rows.Scan(&rfp)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errors.WithStack(err)
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
 		}
 		result = append(result, rfp)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, 0, errors.WithStack(err)
 	}
-	return result, nil
+	return result, total, nil
 }
 
-func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
-	if len(rfps) == 0 {
-		return nil, nil
-	}
-
-	var rfpIn []string
-	for _, rfp := range rfps {
-		_, err := hex.DecodeString(rfp)
+var _ hkpstorage.KeywordPager = (*storage)(nil)
+
+// MatchFiltered returns a page of the keys selected by a filter on the
+// properties of their primary key, recorded in their documents, and by a
+// keyword search if one is given, in the given order. Capabilities are not
+// recorded, so filters on them are not available here.
+func (st *storage) MatchFiltered(search string, match hkpstorage.KeywordMatch, filter *hkpstorage.KeyFilter, order hkpstorage.ResultOrder, limit, offset int) ([]string, int, error) {
+	if st.encryption != nil || filter.Flags != 0 {
+		return nil, 0, hkpstorage.ErrFilterNotAvailable
+	}
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	var rank string
+	if search != "" {
+		var cond string
+		var err error
+		cond, rank, err = st.keywordCondition(match)
 		if err != nil {
-			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
+			return nil, 0, err
+		}
+		// keywordCondition refers to the search as $1.
+		arg(st.keywordTerm(search, match))
+		conds = append(conds, cond)
+	}
+	if filter.Algorithm != "" {
+		codes := openpgp.AlgorithmCodes(filter.Algorithm)
+		if len(codes) == 0 {
+			return nil, 0, nil
 		}
-		rfpIn = append(rfpIn, "'"+strings.ToLower(rfp)+"'")
+		conds = append(conds, "(doc->'algorithm'->>'code')::INT = ANY("+arg(codes)+")")
 	}
-	sqlStr := fmt.Sprintf("SELECT doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
-	rows, err := st.Query(sqlStr)
+	if filter.MinBits > 0 {
+		conds = append(conds, "(doc->>'bitLength')::INT >= "+arg(filter.MinBits))
+	}
+	// Creation times are recorded in RFC 3339 format in UTC, which sorts
+	// in time order.
+	if !filter.CreatedAfter.IsZero() {
+		conds = append(conds, "doc->>'creation' > "+arg(filter.CreatedAfter.UTC().Format(time.RFC3339)))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conds = append(conds, "doc->>'creation' < "+arg(filter.CreatedBefore.UTC().Format(time.RFC3339)))
+	}
+	where := " FROM keys WHERE " + strings.Join(append(conds, searchableSQL), " AND ")
+
+	var total int
+	err := st.QueryRow("SELECT COUNT(*)"+where, args...).Scan(&total)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, 0, errors.WithStack(err)
+	}
+	if offset >= total {
+		return nil, total, nil
 	}
 
-	var result []*openpgp.PrimaryKey
+	page := st.orderBy(order, rank) + " LIMIT " + arg(limit) + " OFFSET " + arg(offset)
+	rows, err := st.Query("SELECT rfingerprint"+where+page, args...)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
 	defer rows.Close()
+	var result []string
 	for rows.Next() {
-		var bufStr string
-		err = rows.Scan(&bufStr)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errors.WithStack(err)
-		}
-		var pk jsonhkp.PrimaryKey
-		err = json.Unmarshal([]byte(bufStr), &pk)
+		var rfp string
+		err = rows.Scan(&rfp)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, 0, errors.WithStack(err)
 		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return result, total, nil
+}
 
-		rfp := openpgp.Reverse(pk.Fingerprint)
-		key, err := readOneKey(pk.Bytes(), rfp)
-		if err != nil {
+var _ hkpstorage.KeyFilterer = (*storage)(nil)
+
+func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
+	var result []string
+	rows, err := st.Query("SELECT rfingerprint FROM keys WHERE mtime > $1 AND "+servedSQL+" ORDER BY mtime DESC LIMIT 100", t.UTC())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil && err != sql.ErrNoRows {
 			return nil, errors.WithStack(err)
 		}
-		result = append(result, key)
+		result = append(result, rfp)
 	}
 	err = rows.Err()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-
 	return result, nil
 }
 
-func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
-	var rfpIn []string
-	for _, rfp := range rfps {
-		_, err := hex.DecodeString(rfp)
+func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := hexParams("rfingerprint", rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result []*openpgp.PrimaryKey
+	var large []string
+	err = inBatches(rfps, func(batch []string) error {
+		rows, err := st.Query(fetchKeysSQL, batch)
 		if err != nil {
-			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
+			return errors.WithStack(err)
 		}
-		rfpIn = append(rfpIn, "'"+strings.ToLower(rfp)+"'")
+		defer rows.Close()
+		for rows.Next() {
+			var rfp string
+			var doc sql.RawBytes
+			err = rows.Scan(&rfp, &doc)
+			if err != nil && err != sql.ErrNoRows {
+				return errors.WithStack(err)
+			}
+			if doc == nil {
+				large = append(large, rfp)
+				continue
+			}
+			key, err := st.readDoc(rfp, doc)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			result = append(result, key)
+		}
+		return errors.WithStack(rows.Err())
+	})
+	if err != nil {
+		return nil, err
 	}
-	sqlStr := fmt.Sprintf("SELECT ctime, mtime, doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
-	rows, err := st.Query(sqlStr)
+	// Large documents are read once the rows are closed, so that their
+	// reads do not need a connection of their own.
+	for _, rfp := range large {
+		key, err := st.readStreamedDoc(rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if key != nil {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
+	rfps, err := hexParams("rfingerprint", rfps)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	var result []*hkpstorage.Keyring
-	defer rows.Close()
-	for rows.Next() {
-		var bufStr string
-		var kr hkpstorage.Keyring
-		err = rows.Scan(&bufStr, &kr.CTime, &kr.MTime)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errors.WithStack(err)
-		}
-		var pk jsonhkp.PrimaryKey
-		err = json.Unmarshal([]byte(bufStr), &pk)
+	large := map[string]*hkpstorage.Keyring{}
+	err = inBatches(rfps, func(batch []string) error {
+		rows, err := st.Query(fetchKeyringsSQL, batch)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return errors.WithStack(err)
 		}
-
-		rfp := openpgp.Reverse(pk.Fingerprint)
-		key, err := readOneKey(pk.Bytes(), rfp)
+		defer rows.Close()
+		for rows.Next() {
+			var rfp string
+			var doc sql.RawBytes
+			var kr hkpstorage.Keyring
+			err = rows.Scan(&rfp, &doc, &kr.CTime, &kr.MTime)
+			if err != nil && err != sql.ErrNoRows {
+				return errors.WithStack(err)
+			}
+			if doc == nil {
+				large[rfp] = &kr
+				continue
+			}
+			key, err := st.readDoc(rfp, doc)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			kr.PrimaryKey = key
+			result = append(result, &kr)
+		}
+		return errors.WithStack(rows.Err())
+	})
+	if err != nil {
+		return nil, err
+	}
+	for rfp, kr := range large {
+		key, err := st.readStreamedDoc(rfp)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		kr.PrimaryKey = key
-		result = append(result, &kr)
+		if key != nil {
+			kr.PrimaryKey = key
+			result = append(result, kr)
+		}
 	}
-	err = rows.Err()
+	return result, nil
+}
+
+// ModTimes implements storage.ModTimeReader.
+func (st *storage) ModTimes(rfps []string) (map[string]time.Time, error) {
+	rfps, err := hexParams("rfingerprint", rfps)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	result := map[string]time.Time{}
+	err = inBatches(rfps, func(batch []string) error {
+		rows, err := st.Query("SELECT rfingerprint, mtime FROM keys WHERE rfingerprint = ANY($1) AND "+servedSQL, batch)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rfp string
+			var mtime time.Time
+			err = rows.Scan(&rfp, &mtime)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			result[rfp] = mtime
+		}
+		return errors.WithStack(rows.Err())
+	})
+	if err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
-	kr := openpgp.NewKeyReader(bytes.NewBuffer(b))
+var _ hkpstorage.ModTimeReader = (*storage)(nil)
+
+// readKeyDoc parses a key from its JSON document representation.
+func readKeyDoc(doc []byte) (*openpgp.PrimaryKey, error) {
+	return readKeyDocFrom(bytes.NewReader(doc))
+}
+
+// readKeyDocFrom parses a key from its JSON document representation read
+// from r. The document is decoded a packet at a time, so that no more of it
+// is held in memory than the packets of the key and the packet being read.
+func readKeyDocFrom(r io.Reader) (*openpgp.PrimaryKey, error) {
+	pk, err := jsonhkp.DecodePackets(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key, err := readOneKey(pk.Reader(), openpgp.Reverse(pk.Fingerprint))
+	if err != nil || key == nil {
+		return key, err
+	}
+	pk.RestoreProvenance(key)
+	return key, nil
+}
+
+func readOneKey(r io.Reader, rfingerprint string) (*openpgp.PrimaryKey, error) {
+	kr := openpgp.NewKeyReader(r)
 	keys, err := kr.Read()
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -602,7 +1109,13 @@ func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
 	return keys[0], nil
 }
 
-func (st *storage) upsertKeyOnInsert(pubkey *openpgp.PrimaryKey) (kc hkpstorage.KeyChange, err error) {
+func (st *storage) upsertKeyOnInsert(pubkey *openpgp.PrimaryKey) (hkpstorage.KeyChange, error) {
+	return hkpstorage.RetryUpdateConflicts(func() (hkpstorage.KeyChange, error) {
+		return st.mergeKeyOnInsert(pubkey)
+	})
+}
+
+func (st *storage) mergeKeyOnInsert(pubkey *openpgp.PrimaryKey) (kc hkpstorage.KeyChange, err error) {
 	var lastKey *openpgp.PrimaryKey
 	lastKeys, err := st.FetchKeys([]string{pubkey.RFingerprint})
 	if err == nil {
@@ -622,7 +1135,7 @@ func (st *storage) upsertKeyOnInsert(pubkey *openpgp.PrimaryKey) (kc hkpstorage.
 	if pubkey.UUID != lastKey.UUID {
 		return nil, errors.Errorf("upsert key %q lookup failed, found mismatch %q", pubkey.UUID, lastKey.UUID)
 	}
-	lastID := lastKey.KeyID()
+	lastID := lastKey.Fingerprint()
 	lastMD5 := lastKey.MD5
 	err = openpgp.Merge(lastKey, pubkey)
 	if err != nil {
@@ -633,37 +1146,102 @@ func (st *storage) upsertKeyOnInsert(pubkey *openpgp.PrimaryKey) (kc hkpstorage.
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		return hkpstorage.KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.KeyID(), NewDigest: lastKey.MD5}, nil
+		return hkpstorage.KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.Fingerprint(), NewDigest: lastKey.MD5}, nil
 	}
 	return hkpstorage.KeyNotChanged{ID: lastID, Digest: lastMD5}, nil
 }
 
-func (st *storage) insertKey(key *openpgp.PrimaryKey) (needUpsert bool, retErr error) {
-	tx, err := st.Begin()
+// insertSubkeySQL adds a subkey of a primary key, unless it is already
+// stored.
+const insertSubkeySQL = "INSERT INTO subkeys (rfingerprint, rsubfp) VALUES ($1, $2) " +
+	"ON CONFLICT (rsubfp) DO NOTHING"
+
+// insertBatch adds keys in a single transaction, returning those inserted
+// and those already stored, which need to be merged. A key which fails to
+// insert is rolled back alone, and recorded as failed in result.
+func (st *storage) insertBatch(keys []*openpgp.PrimaryKey, result *hkpstorage.InsertError) (inserted, existing []*openpgp.PrimaryKey) {
+	var errs []error
+	var failed []*openpgp.PrimaryKey
+	err := st.retryTx(func(tx *sql.Tx) error {
+		inserted, existing, errs, failed = nil, nil, nil, nil
+		for _, key := range keys {
+			needUpsert, err := st.insertKeySavepoint(tx, key)
+			if retryable(err) && !isUniqueViolation(err) {
+				return err
+			} else if err != nil {
+				errs = append(errs, err)
+				failed = append(failed, key)
+				continue
+			}
+			if needUpsert {
+				existing = append(existing, key)
+			} else {
+				inserted = append(inserted, key)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return false, errors.WithStack(err)
+		result.Errors = append(result.Errors, err)
+		result.Failed = append(result.Failed, keys...)
+		return nil, nil
 	}
-	defer func() {
-		if retErr != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
+	result.Errors = append(result.Errors, errs...)
+	result.Failed = append(result.Failed, failed...)
+	return inserted, existing
+}
+
+// insertKeySavepoint adds key in tx as insertKeyTx does, rolling back only
+// the changes made for key if it fails.
+//
+// A unique violation is tried once more: the insert waits for a concurrent
+// transaction adding the same key to commit before failing, so that the
+// retry finds the stored key. Any other unique violation is persistent.
+func (st *storage) insertKeySavepoint(tx *sql.Tx, key *openpgp.PrimaryKey) (needUpsert bool, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err = tx.Exec("SAVEPOINT insert_key")
+		if err != nil {
+			return false, errors.WithStack(err)
 		}
-	}()
-	return st.insertKeyTx(tx, key)
+		needUpsert, err = st.insertKeyTx(tx, key)
+		if err == nil {
+			_, err = tx.Exec("RELEASE SAVEPOINT insert_key")
+			return needUpsert, errors.WithStack(err)
+		}
+		_, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT insert_key")
+		if rbErr != nil {
+			return false, errors.WithStack(rbErr)
+		}
+		if !isUniqueViolation(err) {
+			break
+		}
+	}
+	return false, err
 }
 
+// insertKeyTx adds key in tx, returning needUpsert if a key with its
+// fingerprint is already stored, in which case nothing is changed.
 func (st *storage) insertKeyTx(tx *sql.Tx, key *openpgp.PrimaryKey) (needUpsert bool, retErr error) {
+	err := checkBlockedTx(tx, key)
+	if err != nil {
+		return false, err
+	}
+	// Keys are limited as they are stored, as well as when they are read,
+	// because merging may add to them.
+	err = openpgp.ApplyLimits(key, st.options...)
+	if err != nil {
+		return false, err
+	}
+
 	stmt, err := tx.Prepare("INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords) " +
-		"SELECT $1::TEXT, $2::TIMESTAMP, $3::TIMESTAMP, $4::TEXT, $5::JSONB, to_tsvector($6) " +
-		"WHERE NOT EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1)")
+		"VALUES ($1, $2, $3, $4, $5, to_tsvector($6)) " +
+		"ON CONFLICT (rfingerprint) DO NOTHING")
 	if err != nil {
 		return false, errors.WithStack(err)
 	}
 	defer stmt.Close()
 
-	subStmt, err := tx.Prepare("INSERT INTO subkeys (rfingerprint, rsubfp) " +
-		"SELECT $1::TEXT, $2::TEXT WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)")
+	subStmt, err := tx.Prepare(insertSubkeySQL)
 	if err != nil {
 		return false, errors.WithStack(err)
 	}
@@ -671,15 +1249,16 @@ func (st *storage) insertKeyTx(tx *sql.Tx, key *openpgp.PrimaryKey) (needUpsert
 
 	openpgp.Sort(key)
 
-	now := time.Now().UTC()
-	jsonKey := jsonhkp.NewPrimaryKey(key)
-	jsonBuf, err := json.Marshal(jsonKey)
+	now := st.clock.Now()
+	jsonStr, err := st.writeDoc(key)
 	if err != nil {
-		return false, errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+		return false, errors.WithStack(err)
 	}
 
-	jsonStr := string(jsonBuf)
-	keywords := keywordsTSVector(key)
+	var keywords string
+	if !st.deferIndexing {
+		keywords = st.keywordsTSVector(key)
+	}
 	result, err := stmt.Exec(&key.RFingerprint, &now, &now, &key.MD5, &jsonStr, &keywords)
 	if err != nil {
 		return false, errors.Wrapf(err, "cannot insert rfp=%q", key.RFingerprint)
@@ -688,13 +1267,19 @@ func (st *storage) insertKeyTx(tx *sql.Tx, key *openpgp.PrimaryKey) (needUpsert
 	var keysInserted int64
 	if keysInserted, err = result.RowsAffected(); err != nil {
 		// We arrive here if the DB driver doesn't support
-		// RowsAffected, although lib/pq is known to support it.
+		// RowsAffected, although pgx is known to support it.
 		// If it doesn't, then something has gone badly awry!
 		return false, errors.Wrapf(err, "rows affected not available when inserting rfp=%q", key.RFingerprint)
 	}
 	if keysInserted == 0 {
 		return true, nil
 	}
+	if st.deferIndexing {
+		err = queueIndexTx(tx, key.RFingerprint)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+	}
 
 	for _, subKey := range key.SubKeys {
 		_, err := subStmt.Exec(&key.RFingerprint, &subKey.RFingerprint)
@@ -803,11 +1388,12 @@ func (st *storage) bulkInsertCheckKeys(result *hkpstorage.InsertError) (n int, o
 		log.Warn("Error querying keys with NULLs. Stats may be inaccurate.")
 	}
 
+	// (0) Drop blocked keys
 	// (1) rfingerprint & md5 are also UNIQUE in keys_checked so no duplicates inside this same file allowed
 	// (2) Keep only keys with Duplicates in keys_copyin: delete 1st-stage checked keys & tuples with NULL fields
 	// (3) Insert single copy of in-file Duplicates, if they have no Duplicate in final keys table (in DB)
-	txStrs := []string{bulkTxFilterUniqueKeys, bulkTxPrepKeyStats, bulkTxFilterDupKeys}
-	msgStrs := []string{"bulkTx-filter-unique-keys", "bulkTx-prep-key-stats", "bulkTx-filter-dup-keys"}
+	txStrs := []string{bulkTxFilterBlockedKeys, bulkTxFilterUniqueKeys, bulkTxPrepKeyStats, bulkTxFilterDupKeys}
+	msgStrs := []string{"bulkTx-filter-blocked-keys", "bulkTx-filter-unique-keys", "bulkTx-prep-key-stats", "bulkTx-filter-dup-keys"}
 	err = st.bulkInsertSingleTx(txStrs, msgStrs)
 	if err != nil {
 		result.Errors = append(result.Errors, err)
@@ -840,53 +1426,6 @@ func (st *storage) bulkInsertCheckedKeysSubkeys(keys []*openpgp.PrimaryKey,
 	return nullKeys, nullSubkeys, true
 }
 
-func (st *storage) bulkInsertSendBunchTx(keystmt, msgSpec string, keysValueArgs []interface{}) (err error) {
-	// In single transaction...
-	tx, err := st.Begin()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-
-	stmt, err := tx.Prepare(keystmt)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	_, err = stmt.Exec(keysValueArgs...) // All keys in bunch
-	if err != nil {
-		return errors.Wrapf(err, "cannot simply send a bunch of %s to server (too large bunch?)", msgSpec)
-	}
-	err = stmt.Close()
-	if err != nil {
-		return errors.Wrapf(err, "failed to close xfer sending a bunch of %s to server", msgSpec)
-	}
-
-	return nil
-}
-
-func (st *storage) bulkInsertSendBunch(keystmt, subkeystmt string, keysValueArgs, subkeysValueArgs []interface{}) (err error) {
-
-	// Send all keys to in-mem tables to the pg server; *no constraints checked*
-	err = st.bulkInsertSendBunchTx(keystmt, "keys", keysValueArgs)
-	if err != nil {
-		return err
-	}
-
-	// Send all subkeys to in-mem tables to the pg server; *no constraints checked*
-	err = st.bulkInsertSendBunchTx(subkeystmt, "subkeys", subkeysValueArgs)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 type keyInsertArgs struct {
 	RFingerprint *string
 	jsonStrDoc   *string
@@ -898,56 +1437,71 @@ type subkeyInsertArgs struct {
 	subkeyRFingerprint *string
 }
 
-// Insert keys & subkeys to in-mem tables with no constraints at all: should have no errors!
+// Copy keys & subkeys to in-mem tables with no constraints at all, in batches
+// of bulkBatchSize keys: should have no errors!
 func (st *storage) bulkInsertDoCopy(keyInsArgs []keyInsertArgs, skeyInsArgs [][]subkeyInsertArgs,
 	result *hkpstorage.InsertError) (ok bool) {
-	lenKIA := len(keyInsArgs)
-	for idx, lastIdx := 0, 0; idx < lenKIA; lastIdx = idx {
-		totKeyArgs, totSubkeyArgs := 0, 0
-		keysValueStrings := make([]string, 0, keysInBunch)
-		keysValueArgs := make([]interface{}, 0, keysInBunch*6)			// *** must be less than 64k arguments ***
-		subkeysValueStrings := make([]string, 0, subkeysInBunch)
-		subkeysValueArgs := make([]interface{}, 0, subkeysInBunch*2)	// *** must be less than 64k arguments ***
-		insTime := make([]time.Time, 0, keysInBunch)	// stupid but anyway...
-		for i, j := 0, 0; idx < lenKIA; idx, i = idx+1, i+1 {
-			lenSKIA := len(skeyInsArgs[idx])
-			totKeyArgs += 6
-			totSubkeyArgs += 2 * lenSKIA
-			if (totKeyArgs > keysInBunch*6) || (totSubkeyArgs > subkeysInBunch*2) {
-				totKeyArgs -= 6
-				totSubkeyArgs -= 2 * lenSKIA
-				break
-			}
-			keysValueStrings = append(keysValueStrings,
-				fmt.Sprintf("($%d::TEXT, $%d::JSONB, $%d::TIMESTAMP, $%d::TIMESTAMP, $%d::TEXT, to_tsvector($%d))",
-					i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6))
-			insTime = insTime[:i+1] // re-slice +1
-			insTime[i] = time.Now().UTC()
-			keysValueArgs = append(keysValueArgs, *keyInsArgs[idx].RFingerprint, *keyInsArgs[idx].jsonStrDoc,
-				insTime[i], insTime[i], *keyInsArgs[idx].MD5, *keyInsArgs[idx].keywords)
-
-			for sidx := 0; sidx < lenSKIA; sidx, j = sidx+1, j+1 {
-				subkeysValueStrings = append(subkeysValueStrings, fmt.Sprintf("($%d::TEXT, $%d::TEXT)", j*2+1, j*2+2))
-				subkeysValueArgs = append(subkeysValueArgs,
-					*skeyInsArgs[idx][sidx].keyRFingerprint, *skeyInsArgs[idx][sidx].subkeyRFingerprint)
-			}
+	for len(keyInsArgs) > 0 {
+		n := len(keyInsArgs)
+		if n > st.bulkBatchSize {
+			n = st.bulkBatchSize
 		}
-		log.Debugf("Attempting bulk insertion of %d keys and a total of %d subkeys!", idx-lastIdx, totSubkeyArgs>>1)
-		keystmt := fmt.Sprintf("INSERT INTO %s (rfingerprint, doc, ctime, mtime, md5, keywords) VALUES %s",
-			keys_copyin_temp_table_name, strings.Join(keysValueStrings, ","))
-		subkeystmt := fmt.Sprintf("INSERT INTO %s (rfingerprint, rsubfp) VALUES %s",
-			subkeys_copyin_temp_table_name, strings.Join(subkeysValueStrings, ","))
-
-		err := st.bulkInsertSendBunch(keystmt, subkeystmt, keysValueArgs, subkeysValueArgs)
+		log.Debugf("Attempting bulk copy of %d keys", n)
+		nsub, err := st.bulkInsertCopyBatch(keyInsArgs[:n], skeyInsArgs[:n])
 		if err != nil {
 			result.Errors = append(result.Errors, err)
 			return false
 		}
-		log.Debugf("%d keys, %d subkeys sent to DB...", idx-lastIdx, totSubkeyArgs>>1)
+		log.Debugf("%d keys, %d subkeys sent to DB...", n, nsub)
+		keyInsArgs, skeyInsArgs = keyInsArgs[n:], skeyInsArgs[n:]
 	}
 	return true
 }
 
+// bulkInsertCopyBatch copies a batch of keys & subkeys to the in-mem tables
+// with COPY FROM, in a single transaction.
+func (st *storage) bulkInsertCopyBatch(keyInsArgs []keyInsertArgs, skeyInsArgs [][]subkeyInsertArgs) (nsub int, err error) {
+	ctx := context.Background()
+	conn, err := st.Conn(ctx)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().Begin(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer tx.Rollback(ctx)
+
+		now := st.clock.Now()
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{keys_copyin_temp_table_name},
+			[]string{"rfingerprint", "doc", "ctime", "mtime", "md5", "keywords"},
+			pgx.CopyFromSlice(len(keyInsArgs), func(i int) ([]interface{}, error) {
+				args := keyInsArgs[i]
+				return []interface{}{*args.RFingerprint, *args.jsonStrDoc, now, now, *args.MD5, *args.keywords}, nil
+			}))
+		if err != nil {
+			return errors.Wrap(err, "cannot copy keys to server")
+		}
+
+		var subkeyRows [][]interface{}
+		for _, subkeys := range skeyInsArgs {
+			for _, args := range subkeys {
+				subkeyRows = append(subkeyRows, []interface{}{*args.keyRFingerprint, *args.subkeyRFingerprint})
+			}
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{subkeys_copyin_temp_table_name},
+			[]string{"rfingerprint", "rsubfp"}, pgx.CopyFromRows(subkeyRows))
+		if err != nil {
+			return errors.Wrap(err, "cannot copy subkeys to server")
+		}
+		nsub = len(subkeyRows)
+		return errors.WithStack(tx.Commit(ctx))
+	})
+	return nsub, err
+}
+
 func (st *storage) bulkInsertCopyKeysToServer(keys []*openpgp.PrimaryKey, result *hkpstorage.InsertError) (int, bool) {
 	var key *openpgp.PrimaryKey
 	keyInsArgs := make([]keyInsertArgs, 0, len(keys))
@@ -956,16 +1510,21 @@ func (st *storage) bulkInsertCopyKeysToServer(keys []*openpgp.PrimaryKey, result
 
 	unprocessed, sidx, i := 0, 0, 0
 	for _, key = range keys {
+		err := openpgp.ApplyLimits(key, st.options...)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			unprocessed++
+			continue
+		}
 		openpgp.Sort(key)
-		jsonKey := jsonhkp.NewPrimaryKey(key)
-		jsonBuf, err := json.Marshal(jsonKey)
+		jsonStr, err := st.writeDoc(key)
 		if err != nil {
 			result.Errors = append(result.Errors,
-				errors.Wrapf(err, "pre-processing cannot serialize rfp=%q", key.RFingerprint))
+				errors.Wrap(err, "pre-processing"))
 			unprocessed++
 			continue
 		}
-		jsonStrs[i], theKeywords[i] = string(jsonBuf), keywordsTSVector(key)
+		jsonStrs[i], theKeywords[i] = jsonStr, st.keywordsTSVector(key)
 		keyInsArgs = keyInsArgs[:i+1] // re-slice +1
 		keyInsArgs[i] = keyInsertArgs{&key.RFingerprint, &jsonStrs[i], &key.MD5, &theKeywords[i]}
 
@@ -1071,39 +1630,44 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (u, n int, retErr error) {
 		log.Infof("Bulk insertion %s. Reverting to normal insertion.",
 			(map[bool]string{true: "skipped (small number of keys)", false: "failed"})[bulkSkip])
 
-		for _, key := range keys {
+		for len(keys) > 0 {
 			if count, max := len(result.Errors), maxInsertErrors; count > max {
 				result.Errors = append(result.Errors,
 					errors.Errorf("too many insert errors (%d > %d), bailing...", count, max))
+				result.Failed = append(result.Failed, keys...)
 				return u, n, result
 			}
 
-			if needUpsert, err := st.insertKey(key); err != nil {
-				result.Errors = append(result.Errors, err)
-				continue
-			} else if needUpsert {
+			batch := keys
+			if len(batch) > st.insertBatchSize {
+				batch = batch[:st.insertBatchSize]
+			}
+			keys = keys[len(batch):]
+
+			inserted, existing := st.insertBatch(batch, &result)
+			for _, key := range inserted {
+				st.Notify(hkpstorage.KeyAdded{
+					ID:     key.Fingerprint(),
+					Digest: key.MD5,
+				})
+				n++
+			}
+			for _, key := range existing {
 				kc, err := st.upsertKeyOnInsert(key)
 				if err != nil {
 					result.Errors = append(result.Errors, err)
+					result.Failed = append(result.Failed, key)
 					continue
-				} else {
-					switch kc.(type) {
-					case hkpstorage.KeyReplaced:
-						// FIXME: Listener in hockeypuck-load not really prepared for
-						// hkpstorage.KeyReplaced notifications but stats are updated...
-						st.Notify(kc)
-						u++
-					case hkpstorage.KeyNotChanged:
-						result.Duplicates = append(result.Duplicates, key)
-					}
 				}
-				continue
-			} else {
-				st.Notify(hkpstorage.KeyAdded{
-					ID:     key.KeyID(),
-					Digest: key.MD5,
-				})
-				n++
+				switch kc.(type) {
+				case hkpstorage.KeyReplaced:
+					// FIXME: Listener in hockeypuck-load not really prepared for
+					// hkpstorage.KeyReplaced notifications but stats are updated...
+					st.Notify(kc)
+					u++
+				case hkpstorage.KeyNotChanged:
+					result.Duplicates = append(result.Duplicates, key)
+				}
 			}
 		}
 	}
@@ -1114,26 +1678,43 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (u, n int, retErr error) {
 	return u, n, nil
 }
 
-func (st *storage) Replace(key *openpgp.PrimaryKey) (_ string, retErr error) {
-	tx, err := st.Begin()
-	if err != nil {
-		return "", errors.WithStack(err)
-	}
-	defer func() {
-		if retErr != nil {
-			tx.Rollback()
+func (st *storage) Replace(key *openpgp.PrimaryKey) (string, error) {
+	var md5 string
+	var change hkpstorage.KeyChange
+	err := st.retryTx(func(tx *sql.Tx) error {
+		var banned bool
+		err := tx.QueryRow("SELECT state = $1 FROM keys WHERE rfingerprint = $2",
+			string(hkpstorage.KeyStateBanned), key.RFingerprint).Scan(&banned)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.WithStack(err)
+		} else if banned {
+			return errors.Wrapf(hkpstorage.ErrKeyTombstoned, "key 0x%s is banned", key.KeyID())
+		}
+		md5, err = st.deleteTx(tx, key.Fingerprint())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// A replacement is authorized by the key owner, so it may restore a key
+		// removed by the retention policy.
+		_, err = tx.Exec("DELETE FROM tombstones WHERE rfingerprint = $1", key.RFingerprint)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = st.insertKeyTx(tx, key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if md5 != "" {
+			change = hkpstorage.KeyReplaced{OldID: key.Fingerprint(), OldDigest: md5, NewID: key.Fingerprint(), NewDigest: key.MD5}
 		} else {
-			retErr = tx.Commit()
+			change = hkpstorage.KeyAdded{ID: key.Fingerprint(), Digest: key.MD5}
 		}
-	}()
-	md5, err := st.deleteTx(tx, key.Fingerprint())
-	if err != nil {
-		return "", errors.WithStack(err)
-	}
-	_, err = st.insertKeyTx(tx, key)
+		return errors.WithStack(st.publishChange(tx, change))
+	})
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", err
 	}
+	st.Listeners.Notify(change)
 	return md5, nil
 }
 
@@ -1142,14 +1723,39 @@ func (st *storage) Delete(fp string) (_ string, retErr error) {
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	var change hkpstorage.KeyChange
 	defer func() {
 		if retErr != nil {
 			tx.Rollback()
-		} else {
-			retErr = tx.Commit()
+			return
+		}
+		retErr = tx.Commit()
+		if retErr == nil {
+			st.Listeners.Notify(change)
 		}
 	}()
-	md5, err := st.deleteTx(tx, fp)
+	// The key is kept, marked as deleted, so that it is not added again
+	// when it is offered by peers that still have it.
+	rfp := openpgp.Reverse(fp)
+	var md5 string
+	err = tx.QueryRow("UPDATE keys SET deleted_at = $1 WHERE rfingerprint = $2 AND deleted_at IS NULL RETURNING md5",
+		st.clock.Now(), rfp).Scan(&md5)
+	if err == sql.ErrNoRows {
+		return "", errors.WithStack(hkpstorage.ErrKeyNotFound)
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	// Metadata outlives replacement of the key, but not its deletion.
+	_, err = tx.Exec("DELETE FROM key_metadata WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	_, err = tx.Exec("DELETE FROM verified_addresses WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	change = hkpstorage.KeyRemoved{ID: fp, Digest: md5}
+	err = st.publishChange(tx, change)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -1163,13 +1769,19 @@ func (st *storage) deleteTx(tx *sql.Tx, fp string) (string, error) {
 		return "", errors.WithStack(err)
 	}
 	var md5 string
-	err = tx.QueryRow("DELETE FROM keys WHERE rfingerprint = $1 RETURNING md5", rfp).Scan(&md5)
+	var deleted bool
+	err = tx.QueryRow("DELETE FROM keys WHERE rfingerprint = $1 RETURNING md5, deleted_at IS NOT NULL",
+		rfp).Scan(&md5, &deleted)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", errors.WithStack(hkpstorage.ErrKeyNotFound)
 		}
 		return "", errors.WithStack(err)
 	}
+	if deleted {
+		// The digest of a deleted key has already been removed.
+		return "", nil
+	}
 	return md5, nil
 }
 
@@ -1178,50 +1790,86 @@ func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	var change hkpstorage.KeyChange
 	defer func() {
 		if retErr != nil {
 			tx.Rollback()
-		} else {
-			tx.Commit()
+			return
+		}
+		retErr = errors.WithStack(tx.Commit())
+		if retErr == nil {
+			st.Listeners.Notify(change)
 		}
 	}()
 
+	err = checkBlockedTx(tx, key)
+	if err != nil {
+		return err
+	}
+	err = openpgp.ApplyLimits(key, st.options...)
+	if err != nil {
+		return err
+	}
+
 	openpgp.Sort(key)
 
-	now := time.Now().UTC()
-	jsonKey := jsonhkp.NewPrimaryKey(key)
-	jsonBuf, err := json.Marshal(jsonKey)
+	now := st.clock.Now()
+	jsonStr, err := st.writeDoc(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// The key is only updated if it has not changed since it was merged.
+	var result sql.Result
+	if st.deferIndexing {
+		// The previous keywords remain searchable until the key is indexed.
+		result, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, doc = $3 "+
+			"WHERE rfingerprint = $4 AND md5 = $5",
+			&now, &key.MD5, &jsonStr, &key.RFingerprint, &lastMD5)
+	} else {
+		keywords := st.keywordsTSVector(key)
+		result, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4 "+
+			"WHERE rfingerprint = $5 AND md5 = $6",
+			&now, &key.MD5, &keywords, &jsonStr, &key.RFingerprint, &lastMD5)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+		return errors.WithStack(err)
 	}
-	keywords := keywordsTSVector(key)
-	_, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4 "+
-		"WHERE rfingerprint = $5",
-		&now, &key.MD5, &keywords, jsonBuf, &key.RFingerprint)
+	updated, err := result.RowsAffected()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	if updated == 0 {
+		return errors.Wrapf(hkpstorage.ErrUpdateConflict, "update of rfp=%q from md5=%q", key.RFingerprint, lastMD5)
+	}
+	if st.deferIndexing {
+		err = queueIndexTx(tx, key.RFingerprint)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	for _, subKey := range key.SubKeys {
-		_, err := tx.Exec("INSERT INTO subkeys (rfingerprint, rsubfp) "+
-			"SELECT $1::TEXT, $2::TEXT WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)",
-			&key.RFingerprint, &subKey.RFingerprint)
+		_, err := tx.Exec(insertSubkeySQL, &key.RFingerprint, &subKey.RFingerprint)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 	}
 
-	st.Notify(hkpstorage.KeyReplaced{
+	change = hkpstorage.KeyReplaced{
 		OldID:     lastID,
 		OldDigest: lastMD5,
-		NewID:     key.KeyID(),
+		NewID:     key.Fingerprint(),
 		NewDigest: key.MD5,
-	})
-	return nil
+	}
+	return errors.WithStack(st.publishChange(tx, change))
 }
 
-func keywordsTSVector(key *openpgp.PrimaryKey) string {
-	keywords := keywordsFromKey(key)
-	tsv, err := keywordsToTSVector(keywords)
+func (st *storage) keywordsTSVector(key *openpgp.PrimaryKey) string {
+	// Keywords are kept in user ID order, so that phrases can be matched.
+	var keywords []string
+	for _, uid := range key.UserIDs {
+		keywords = append(keywords, hkpstorage.UserIDKeywords(uid.Keywords)...)
+	}
+	tsv, err := keywordsToTSVector(st.keywordTokens(keywords))
 	if err != nil {
 		// In this case we've found a key that generated
 		// an invalid tsvector - this is pretty much guaranteed
@@ -1237,7 +1885,8 @@ func keywordsTSVector(key *openpgp.PrimaryKey) string {
 }
 
 // keywordsToTSVector converts a slice of keywords to a
-// PostgreSQL tsvector. If the resulting tsvector would
+// PostgreSQL tsvector of plain lexemes, in the given
+// order. If the resulting tsvector would
 // be considered invalid by PostgreSQL an error is
 // returned instead.
 func keywordsToTSVector(keywords []string) (string, error) {
@@ -1250,7 +1899,7 @@ func keywordsToTSVector(keywords []string) (string, error) {
 			return "", fmt.Errorf("keyword exceeds limit (%d >= %d)", l, lexemeLimit)
 		}
 	}
-	tsv := strings.Join(keywords, " & ")
+	tsv := strings.Join(keywords, " ")
 
 	// Allow overhead of 8 bytes for position per keyword.
 	if l := len([]byte(tsv)) + len(keywords)*8; l >= tsvectorLimit {
@@ -1259,47 +1908,6 @@ func keywordsToTSVector(keywords []string) (string, error) {
 	return tsv, nil
 }
 
-// keywordsFromKey returns a slice of searchable tokens
-// extracted from the UserID packets keywords string of
-// the given key.
-func keywordsFromKey(key *openpgp.PrimaryKey) []string {
-	m := make(map[string]bool)
-	for _, uid := range key.UserIDs {
-		s := strings.ToLower(uid.Keywords)
-		lbr, rbr := strings.Index(s, "<"), strings.LastIndex(s, ">")
-		if lbr != -1 && rbr > lbr {
-			email := s[lbr+1 : rbr]
-			m[email] = true
-
-			parts := strings.SplitN(email, "@", 2)
-			if len(parts) > 1 {
-				username, domain := parts[0], parts[1]
-				m[username] = true
-				m[domain] = true
-			}
-		}
-		if lbr != -1 {
-			fields := strings.FieldsFunc(s[:lbr], func(r rune) bool {
-				if !utf8.ValidRune(r) {
-					return true
-				}
-				if unicode.IsLetter(r) || unicode.IsNumber(r) || r == '-' {
-					return false
-				}
-				return true
-			})
-			for _, field := range fields {
-				m[field] = true
-			}
-		}
-	}
-	var result []string
-	for k := range m {
-		result = append(result, k)
-	}
-	return result
-}
-
 func subkeys(key *openpgp.PrimaryKey) []string {
 	var result []string
 	for _, subkey := range key.SubKeys {
@@ -1308,30 +1916,21 @@ func subkeys(key *openpgp.PrimaryKey) []string {
 	return result
 }
 
-func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
-	st.mu.Lock()
-	st.listeners = append(st.listeners, f)
-	st.mu.Unlock()
-}
-
-func (st *storage) Notify(change hkpstorage.KeyChange) error {
-	st.mu.Lock()
-	defer st.mu.Unlock()
-	log.Debugf("%v", change)
-	for _, f := range st.listeners {
-		// TODO: log error notifying listener?
-		f(change)
-	}
-	return nil
+func (st *storage) BulkNotify(sqlStr string) error {
+	return st.bulkNotify(sqlStr, st.sharedNotifications)
 }
 
-func (st *storage) BulkNotify(sqlStr string) error {
+// bulkNotify notifies listeners of the keys with the digests selected by
+// sqlStr as added, and publishes them to the other servers sharing the
+// database if publish is set.
+func (st *storage) bulkNotify(sqlStr string, publish bool) error {
 	rows, err := st.Query(sqlStr)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	defer rows.Close()
+	var msgs []*keyChangeMessage
 	for rows.Next() {
 		var md5 string
 		err := rows.Scan(&md5)
@@ -1342,12 +1941,32 @@ func (st *storage) BulkNotify(sqlStr string) error {
 				return errors.WithStack(err)
 			}
 		}
-		st.Notify(hkpstorage.KeyAdded{Digest: md5})
+		change := hkpstorage.KeyAdded{Digest: md5}
+		st.Listeners.Notify(change)
+		if publish {
+			msg, _ := st.keyChangeMessage(change)
+			msgs = append(msgs, msg)
+			if len(msgs) >= publishBatchSize {
+				err = st.publish(st.DB, msgs)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				msgs = msgs[:0]
+			}
+		}
 	}
 	err = rows.Err()
-	return errors.WithStack(err)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(msgs) > 0 {
+		return errors.WithStack(st.publish(st.DB, msgs))
+	}
+	return nil
 }
 
 func (st *storage) RenotifyAll() error {
-	return st.BulkNotify("SELECT md5 FROM keys")
+	// Other servers sharing the database have notified their own listeners
+	// of these keys already.
+	return st.bulkNotify("SELECT md5 FROM keys WHERE deleted_at IS NULL", false)
 }
@@ -21,21 +21,27 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	stdtesting "testing"
+	"time"
 
 	"hockeypuck/pgtest"
 	"hockeypuck/testing"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	gc "gopkg.in/check.v1"
 
 	"hockeypuck/hkp"
 	"hockeypuck/hkp/jsonhkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
 	"hockeypuck/openpgp"
 )
 
@@ -51,6 +57,7 @@ type S struct {
 	storage *storage
 	db      *sql.DB
 	srv     *httptest.Server
+	reqSrv  *httptest.Server
 }
 
 var _ = gc.Suite(&S{})
@@ -60,7 +67,7 @@ func (s *S) SetUpTest(c *gc.C) {
 
 	c.Log(s.URL)
 	var err error
-	s.db, err = sql.Open("postgres", s.URL)
+	s.db, err = sql.Open("pgx", s.URL)
 	c.Assert(err, gc.IsNil)
 
 	s.db.Exec("DROP DATABASE hkp")
@@ -80,6 +87,10 @@ func (s *S) TearDownTest(c *gc.C) {
 	if s.srv != nil {
 		s.srv.Close()
 	}
+	if s.reqSrv != nil {
+		s.reqSrv.Close()
+		s.reqSrv = nil
+	}
 	if s.db != nil {
 		s.db.Exec("DROP DATABASE hkp")
 		s.db.Close()
@@ -87,6 +98,23 @@ func (s *S) TearDownTest(c *gc.C) {
 	s.PGSuite.TearDownTest(c)
 }
 
+// requestTime is the time at which the signatures on the replace and delete
+// requests in the test data were made.
+var requestTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// requestURL returns the URL of a server whose clock is set shortly after
+// requestTime, so that it accepts the signed requests in the test data.
+func (s *S) requestURL(c *gc.C) string {
+	if s.reqSrv == nil {
+		r := httprouter.New()
+		handler, err := hkp.NewHandler(s.storage, hkp.Clock(mock.NewClock(requestTime.Add(time.Minute))))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		s.reqSrv = httptest.NewServer(r)
+	}
+	return s.reqSrv.URL
+}
+
 func (s *S) addKey(c *gc.C, keyname string) {
 	keytext, err := ioutil.ReadAll(testing.MustInput(keyname))
 	c.Assert(err, gc.IsNil)
@@ -167,6 +195,41 @@ func (s *S) TestAddDuplicates(c *gc.C) {
 	c.Assert(keyDocs[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
 }
 
+func (s *S) TestAddConcurrentDuplicates(c *gc.C) {
+	armor, err := ioutil.ReadAll(testing.MustInput("sksdigest.asc"))
+	c.Assert(err, gc.IsNil)
+
+	const n = 10
+	type result struct {
+		u, n int
+		err  error
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+			u, n, err := s.storage.Insert(keys)
+			results <- result{u, n, err}
+		}()
+	}
+	var inserted int
+	for i := 0; i < n; i++ {
+		r := <-results
+		if err, ok := r.err.(hkpstorage.InsertError); ok {
+			// Only duplicates may be reported.
+			c.Assert(err.Errors, gc.HasLen, 0)
+		} else {
+			c.Assert(r.err, gc.IsNil)
+		}
+		inserted += r.n
+	}
+	c.Assert(inserted, gc.Equals, 1)
+
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	c.Assert(keyDocs[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+}
+
 func (s *S) TestResolve(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x44a2d1db")
 	c.Assert(err, gc.IsNil)
@@ -228,6 +291,210 @@ func (s *S) TestResolve(c *gc.C) {
 	}
 }
 
+func (s *S) TestInsertBatch(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	stored := s.queryAllKeys(c)[0].MD5
+
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"uat.asc", "e68e311d.asc", "sksdigest.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	// A key with the digest of another stored key cannot be inserted.
+	keys[1].MD5 = stored
+
+	s.storage.insertBatchSize = 2
+	u, n, err := s.storage.Insert(keys)
+	c.Assert(u, gc.Equals, 0)
+	c.Assert(n, gc.Equals, 2)
+	insertErr, ok := err.(hkpstorage.InsertError)
+	c.Assert(ok, gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(insertErr.Errors, gc.HasLen, 1)
+	c.Assert(insertErr.Failed, gc.DeepEquals, keys[1:2])
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 3)
+}
+
+func (s *S) TestMatchKeywords(c *gc.C) {
+	s.addKey(c, "uat.asc")
+
+	for _, t := range []struct {
+		search string
+		match  hkpstorage.KeywordMatch
+		found  bool
+	}{
+		{"casey marshall", hkpstorage.MatchAllWords, true},
+		{"marshall casey", hkpstorage.MatchAllWords, true},
+		{"casey nobody", hkpstorage.MatchAllWords, false},
+		{"casey nobody", hkpstorage.MatchAnyWord, true},
+		{"alice nobody", hkpstorage.MatchAnyWord, false},
+		{"casey marshall", hkpstorage.MatchPhrase, true},
+		{"marshall casey", hkpstorage.MatchPhrase, false},
+		{"casey.marshall@gmail.com", hkpstorage.MatchPhrase, true},
+	} {
+		comment := gc.Commentf("search=%q match=%s", t.search, t.match)
+		rfps, err := s.storage.MatchKeywords([]string{t.search}, t.match)
+		c.Assert(err, gc.IsNil, comment)
+		if t.found {
+			c.Assert(rfps, gc.HasLen, 1, comment)
+		} else {
+			c.Assert(rfps, gc.HasLen, 0, comment)
+		}
+	}
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&match=phrase&search=casey+marshall")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *S) TestTrigramSearch(c *gc.C) {
+	s.addKey(c, "uat.asc")
+
+	// Substrings are not matched without the trigram index.
+	_, err := s.storage.MatchKeywords([]string{"marsh"}, hkpstorage.MatchSubstring)
+	c.Assert(err, gc.Equals, hkpstorage.ErrKeywordMatchNotAvailable)
+
+	st, err := New(s.db, nil, TrigramSearch())
+	c.Assert(err, gc.IsNil)
+	for _, t := range []struct {
+		search string
+		match  hkpstorage.KeywordMatch
+		found  bool
+	}{
+		{"marsh", hkpstorage.MatchSubstring, true},
+		{"Casey Mar", hkpstorage.MatchSubstring, true},
+		{"mar_h", hkpstorage.MatchSubstring, false},
+		{"marshal", hkpstorage.MatchFuzzy, true},
+		{"nobody", hkpstorage.MatchFuzzy, false},
+	} {
+		comment := gc.Commentf("search=%q match=%s", t.search, t.match)
+		rfps, err := st.(hkpstorage.KeywordMatcher).MatchKeywords([]string{t.search}, t.match)
+		c.Assert(err, gc.IsNil, comment)
+		if t.found {
+			c.Assert(rfps, gc.HasLen, 1, comment)
+		} else {
+			c.Assert(rfps, gc.HasLen, 0, comment)
+		}
+	}
+}
+
+func (s *S) TestMatchKeywordPage(c *gc.C) {
+	// Each of these keys has a user ID with the word "test".
+	s.addKey(c, "ecc_keys.asc")
+
+	// The keys were created in the order they appear in the file.
+	var newest []string
+	for _, key := range openpgp.MustReadArmorKeys(testing.MustInput("ecc_keys.asc")) {
+		newest = append([]string{key.RFingerprint}, newest...)
+	}
+	var all []string
+	for offset := 0; ; offset += 4 {
+		rfps, total, err := s.storage.MatchKeywordPage("test", hkpstorage.MatchAllWords, hkpstorage.OrderCreated, 4, offset)
+		c.Assert(err, gc.IsNil)
+		c.Assert(total, gc.Equals, 6)
+		if len(rfps) == 0 {
+			break
+		}
+		all = append(all, rfps...)
+	}
+	c.Assert(all, gc.DeepEquals, newest)
+
+	// Equally relevant matches are most recently modified first.
+	_, err := s.db.Exec("UPDATE keys SET mtime = now() + interval '1 hour' WHERE rfingerprint = $1", newest[3])
+	c.Assert(err, gc.IsNil)
+	rfps, _, err := s.storage.MatchKeywordPage("test", hkpstorage.MatchAllWords, hkpstorage.OrderRelevance, 1, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, newest[3:4])
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=index&options=mr&search=test&limit=4&offset=4")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "6")
+	c.Assert(res.Header.Get("X-HKP-Next-Offset"), gc.Equals, "")
+}
+
+func (s *S) TestMatchFiltered(c *gc.C) {
+	// One of these keys is EdDSA and five are ECDSA, of which one has a
+	// 1027-bit encoding.
+	s.addKey(c, "ecc_keys.asc")
+	s.addKey(c, "alice_signed.asc")
+
+	for _, t := range []struct {
+		search string
+		filter hkpstorage.KeyFilter
+		total  int
+	}{
+		{"", hkpstorage.KeyFilter{Algorithm: "ecdsa"}, 5},
+		{"", hkpstorage.KeyFilter{Algorithm: "rsa", MinBits: 2048}, 1},
+		{"", hkpstorage.KeyFilter{MinBits: 1000}, 2},
+		{"test", hkpstorage.KeyFilter{MinBits: 1000}, 1},
+		{"", hkpstorage.KeyFilter{CreatedAfter: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}, 6},
+		{"", hkpstorage.KeyFilter{CreatedBefore: time.Date(2019, 8, 31, 18, 23, 0, 0, time.UTC)}, 3},
+	} {
+		filter := t.filter
+		rfps, total, err := s.storage.MatchFiltered(t.search, hkpstorage.MatchAllWords, &filter, hkpstorage.OrderRelevance, 4, 0)
+		c.Assert(err, gc.IsNil)
+		c.Assert(total, gc.Equals, t.total, gc.Commentf("%+v", t.filter))
+		if t.total > 4 {
+			c.Assert(rfps, gc.HasLen, 4)
+		} else {
+			c.Assert(rfps, gc.HasLen, t.total)
+		}
+	}
+
+	// Capabilities are not recorded, so are checked by the handler on the
+	// matches of a search.
+	filter := hkpstorage.KeyFilter{Flags: openpgp.KeyFlagEncrypt}
+	_, _, err := s.storage.MatchFiltered("", hkpstorage.MatchAllWords, &filter, hkpstorage.OrderRelevance, 4, 0)
+	c.Assert(err, gc.Equals, hkpstorage.ErrFilterNotAvailable)
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=index&options=mr&search=test&algo=eddsa&flags=encrypt")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "1")
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=index&options=mr&search=test&flags=authenticate")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, "0")
+}
+
+func (s *S) TestDomainSearch(c *gc.C) {
+	s.addKey(c, "ecc_keys.asc")
+	s.addKey(c, "tails.asc")
+
+	for _, t := range []struct {
+		domain string
+		total  string
+	}{
+		{"example.com", "6"},
+		{"boum.org", "1"},
+	} {
+		res, err := http.Get(s.srv.URL + "/pks/lookup?op=index&options=mr&search=domain:" + t.domain)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(res.Header.Get("X-HKP-Total-Results"), gc.Equals, t.total)
+	}
+}
+
+func (s *S) TestResolveAmbiguous(c *gc.C) {
+	// The primary key of one key is a subkey of the other.
+	s.addKey(c, "subkey_collision/pubkey.asc")
+	s.addKey(c, "subkey_collision/subkey.asc")
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x8a7558a6cd80ea04")
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 2)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, "9430b6cd4fafd4ac7778897f8a7558a6cd80ea04")
+	c.Assert(keys[1].Fingerprint(), gc.Equals, "a0885fe268d9ae69397f96e29c84c406a496ac49")
+}
+
 func (s *S) TestResolveWithHyphen(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x2632c2c3")
 	c.Assert(err, gc.IsNil)
@@ -301,6 +568,62 @@ func (s *S) TestMerge(c *gc.C) {
 	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 2)
 }
 
+func (s *S) TestProvenance(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	keys, err := s.storage.FetchKeys([]string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	firstSeen := map[string]time.Time{}
+	for _, pkt := range keys[0].Packets() {
+		c.Assert(pkt.Provenance.Source, gc.Equals, hkpstorage.ProvenanceDirect)
+		c.Assert(pkt.Provenance.FirstSeen.IsZero(), gc.Equals, false)
+		firstSeen[pkt.UUID] = pkt.Provenance.FirstSeen
+	}
+
+	time.Sleep(time.Second)
+	s.addKey(c, "alice_signed.asc")
+	keys, err = s.storage.FetchKeys([]string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	var added int
+	for _, pkt := range keys[0].Packets() {
+		c.Assert(pkt.Provenance.Source, gc.Equals, hkpstorage.ProvenanceDirect)
+		if t, ok := firstSeen[pkt.UUID]; ok {
+			// Packets already stored keep their provenance.
+			c.Assert(pkt.Provenance.FirstSeen.Equal(t), gc.Equals, true)
+		} else {
+			c.Assert(pkt.Provenance.FirstSeen.After(firstSeen[keys[0].UUID]), gc.Equals, true)
+			added++
+		}
+	}
+	c.Assert(added, gc.Equals, 1)
+
+	// Provenance is not served.
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=index&options=json&search=alice@example.com")
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(strings.Contains(string(doc), "firstSeen"), gc.Equals, false)
+}
+
+func (s *S) TestUpdateConflict(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	stored := s.queryAllKeys(c)[0].MD5
+
+	// An update merged with a version of the key no longer stored is refused.
+	err := s.storage.Update(key, key.KeyID(), "0123456789abcdef0123456789abcdef")
+	c.Assert(hkpstorage.IsUpdateConflict(err), gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(s.queryAllKeys(c)[0].MD5, gc.Equals, stored)
+
+	err = s.storage.Update(key, key.KeyID(), stored)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.queryAllKeys(c)[0].MD5, gc.Equals, key.MD5)
+}
+
 func (s *S) TestEd25519(c *gc.C) {
 	s.addKey(c, "e68e311d.asc")
 
@@ -328,6 +651,27 @@ func (s *S) TestEd25519(c *gc.C) {
 	}
 }
 
+func (s *S) TestDeferIndexing(c *gc.C) {
+	s.storage.deferIndexing = true
+	s.addKey(c, "e68e311d.asc")
+
+	// Resolvable by fingerprint at once, but not searchable until indexed.
+	s.assertKey(c, "0x8d7c6b1a49166a46ff293af2d4236eabe68e311d", "Casey Marshall <casey.marshall@canonical.com>", true)
+	s.assertKeyNotFound(c, "casey")
+
+	n, err := s.storage.IndexPending()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = s.storage.IndexQueued(100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = s.storage.IndexPending()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	s.assertKey(c, "casey", "Casey Marshall <casey.marshall@canonical.com>", true)
+}
+
 func (s *S) assertKeyNotFound(c *gc.C, fp string) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + fp)
 	c.Assert(err, gc.IsNil)
@@ -362,14 +706,14 @@ func (s *S) TestReplace(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace.asc"))
 	c.Assert(err, gc.IsNil)
 	keysig, err := ioutil.ReadAll(testing.MustInput("replace.asc.asc"))
 	c.Assert(err, gc.IsNil)
-	res, err := http.PostForm(s.srv.URL+"/pks/replace", url.Values{
+	res, err := http.PostForm(s.requestURL(c)+"/pks/replace", url.Values{
 		"keytext": []string{string(keytext)},
 		"keysig":  []string{string(keysig)},
 	})
@@ -379,8 +723,8 @@ func (s *S) TestReplace(c *gc.C) {
 	_, err = ioutil.ReadAll(res.Body)
 	c.Assert(err, gc.IsNil)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", false)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", false)
 }
 
 func (s *S) TestReplaceNoSig(c *gc.C) {
@@ -389,21 +733,21 @@ func (s *S) TestReplaceNoSig(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
 	// Replace without signature gets ignored
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace.asc"))
 	c.Assert(err, gc.IsNil)
-	res, err := http.PostForm(s.srv.URL+"/pks/replace", url.Values{
+	res, err := http.PostForm(s.requestURL(c)+"/pks/replace", url.Values{
 		"keytext": []string{string(keytext)},
 	})
 	c.Assert(err, gc.IsNil)
 	defer res.Body.Close()
 	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 }
 
 func (s *S) TestAddDoesntReplace(c *gc.C) {
@@ -412,8 +756,8 @@ func (s *S) TestAddDoesntReplace(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
 	// Signature without replace directive gets ignored
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace.asc"))
@@ -430,8 +774,8 @@ func (s *S) TestAddDoesntReplace(c *gc.C) {
 	_, err = ioutil.ReadAll(res.Body)
 	c.Assert(err, gc.IsNil)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 }
 
 func (s *S) TestReplaceNotSelfSig(c *gc.C) {
@@ -440,20 +784,26 @@ func (s *S) TestReplaceNotSelfSig(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
-	// Signed by a different key than the one replaced
+	// Signed by a different key than the one replaced, which is added
+	// instead as it is not stored yet.
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace_notselfsig.asc"))
 	c.Assert(err, gc.IsNil)
 	keysig, err := ioutil.ReadAll(testing.MustInput("replace_notselfsig.asc.asc"))
 	c.Assert(err, gc.IsNil)
-	res, err := http.PostForm(s.srv.URL+"/pks/replace", url.Values{
+	res, err := http.PostForm(s.requestURL(c)+"/pks/replace", url.Values{
 		"keytext": []string{string(keytext)},
 		"keysig":  []string{string(keysig)},
 	})
 	c.Assert(err, gc.IsNil)
-	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
+	s.assertKey(c, "0x275982F0E210A4D919AC167386BF8444E38FF4F2", "mallorino", true)
 }
 
 func (s *S) TestDelete(c *gc.C) {
@@ -462,25 +812,30 @@ func (s *S) TestDelete(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace.asc"))
 	c.Assert(err, gc.IsNil)
-	keysig, err := ioutil.ReadAll(testing.MustInput("replace.asc.asc"))
+	keysig, err := ioutil.ReadAll(testing.MustInput("replace.delete.asc"))
 	c.Assert(err, gc.IsNil)
 
 	values := url.Values{
 		"keytext": []string{string(keytext)},
 		"keysig":  []string{string(keysig)},
 	}
-	res, err := http.PostForm(s.srv.URL+"/pks/delete", values)
+	res, err := http.PostForm(s.requestURL(c)+"/pks/delete", values)
 	c.Assert(err, gc.IsNil)
 	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
 	defer res.Body.Close()
 
-	s.assertKeyNotFound(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC")
-	s.assertKeyNotFound(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC")
+	s.assertKeyNotFound(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19")
+	s.assertKeyNotFound(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19")
+
+	// The deleted key is not accepted again.
+	blocked, err := s.storage.IsBlocked("7157e3d0ed874d14ab5def7cc0633f0e04fd5b19")
+	c.Assert(err, gc.IsNil)
+	c.Assert(blocked, gc.Equals, true)
 }
 
 func (s *S) TestDeleteNotSelfSig(c *gc.C) {
@@ -489,15 +844,15 @@ func (s *S) TestDeleteNotSelfSig(c *gc.C) {
 	keyDocs := s.queryAllKeys(c)
 	c.Assert(keyDocs, gc.HasLen, 1)
 
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
 
 	// Signed by a different key than the one replaced
 	keytext, err := ioutil.ReadAll(testing.MustInput("replace_notselfsig.asc"))
 	c.Assert(err, gc.IsNil)
-	keysig, err := ioutil.ReadAll(testing.MustInput("replace_notselfsig.asc.asc"))
+	keysig, err := ioutil.ReadAll(testing.MustInput("replace_notselfsig.delete.asc"))
 	c.Assert(err, gc.IsNil)
-	res, err := http.PostForm(s.srv.URL+"/pks/delete", url.Values{
+	res, err := http.PostForm(s.requestURL(c)+"/pks/delete", url.Values{
 		"keytext": []string{string(keytext)},
 		"keysig":  []string{string(keysig)},
 	})
@@ -505,7 +860,576 @@ func (s *S) TestDeleteNotSelfSig(c *gc.C) {
 	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
 
 	// Delete was not successful
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "somename", true)
-	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "somename", true)
+	s.assertKey(c, "0x7157E3D0ED874D14AB5DEF7CC0633F0E04FD5B19", "forgetme", true)
+
+}
+
+func (s *S) TestReadStreamedDoc(c *gc.C) {
+	defer func(n int) { docChunkSize = n }(docChunkSize)
+	docChunkSize = 100
+
+	s.addKey(c, "e68e311d.asc")
+	rfp := openpgp.Reverse("8d7c6b1a49166a46ff293af2d4236eabe68e311d")
+	keys, err := s.storage.FetchKeys([]string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+
+	// The document is read in many chunks, and parsed as they arrive.
+	key, err := s.storage.readStreamedDoc(rfp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.NotNil)
+	c.Assert(key.MD5, gc.Equals, keys[0].MD5)
+
+	key, err = s.storage.readStreamedDoc(openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.IsNil)
+}
+
+func (s *S) TestMetadata(c *gc.C) {
+	s.addKey(c, "e68e311d.asc")
+	rfp := openpgp.Reverse("8d7c6b1a49166a46ff293af2d4236eabe68e311d")
+
+	err := s.storage.SetMetadata(rfp, "hr/employee-id", "1234")
+	c.Assert(err, gc.IsNil)
+	err = s.storage.SetMetadata(rfp, "hr/employee-id", "5678")
+	c.Assert(err, gc.IsNil)
+	err = s.storage.SetMetadata(rfp, "employee-id", "1234")
+	c.Assert(err, gc.NotNil)
+	err = s.storage.SetMetadata(openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca"), "hr/employee-id", "1234")
+	c.Assert(err, gc.NotNil)
+
+	metadata, err := s.storage.Metadata([]string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(metadata, gc.DeepEquals, map[string]map[string]string{rfp: {"hr/employee-id": "5678"}})
+
+	err = s.storage.SetMetadata(rfp, "hr/employee-id", "")
+	c.Assert(err, gc.IsNil)
+	metadata, err = s.storage.Metadata([]string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(metadata, gc.HasLen, 0)
+}
+
+func (s *S) TestCountVerifiedKeys(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	rfp := openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	now := time.Now()
+	err := s.storage.SetVerified([]hkpstorage.VerifiedAddress{
+		{RFingerprint: rfp, Address: "alice@example.com", Verified: now},
+		{RFingerprint: rfp, Address: "alice@sub.example.com", Verified: now, Source: "keys.example.com"},
+	})
+	c.Assert(err, gc.IsNil)
+
+	for domain, expect := range map[string]int{
+		"example.com":     1,
+		"EXAMPLE.com":     1,
+		"sub.example.com": 1,
+		"ample.com":       0,
+		"example.org":     0,
+	} {
+		n, err := s.storage.CountVerifiedKeys(domain)
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, expect, gc.Commentf("domain=%s", domain))
+	}
+}
+
+func (s *S) TestFetchKeysBatched(c *gc.C) {
+	s.addKey(c, "e68e311d.asc")
+	s.addKey(c, "sksdigest.asc")
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 2)
+
+	// Pad the lookup so that it spans several batches, with the stored keys
+	// in different batches.
+	rfps := []string{keyDocs[0].RFingerprint}
+	for i := 0; i < maxArrayParam*2; i++ {
+		rfps = append(rfps, fmt.Sprintf("%040x", i))
+	}
+	rfps = append(rfps, strings.ToUpper(keyDocs[1].RFingerprint))
+
+	keys, err := s.storage.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 2)
+	keyrings, err := s.storage.FetchKeyrings(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keyrings, gc.HasLen, 2)
+	c.Assert(s.storage.Accessed(rfps), gc.IsNil)
+	md5s, err := s.storage.MatchMD5([]string{"DA84F40D830A7BE2A3C0B7F2E146BFAA"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(md5s, gc.HasLen, 1)
+
+	_, err = s.storage.FetchKeys([]string{keyDocs[0].RFingerprint, "' OR 1=1 --"})
+	c.Assert(err, gc.ErrorMatches, `invalid rfingerprint .*`)
+	_, err = s.storage.MatchMD5([]string{"' OR 1=1 --"})
+	c.Assert(err, gc.ErrorMatches, `invalid MD5 .*`)
+}
+
+func (s *S) TestRecoveryQueue(c *gc.C) {
+	now := time.Now().Truncate(time.Second)
+	err := s.storage.QueueRecovery([]hkpstorage.PendingRecovery{
+		{Digest: "b0d2c2aaaa3eb2a19e3bc53b0f69f5d0", HKPAddr: "192.0.2.1:11371", Queued: now.Add(-2 * time.Hour)},
+		{Digest: "DA84F40D830A7BE2A3C0B7F2E146BFAA", HKPAddr: "192.0.2.2:11371", Queued: now.Add(-time.Hour)},
+	})
+	c.Assert(err, gc.IsNil)
+	// Queueing again keeps the original position.
+	err = s.storage.QueueRecovery([]hkpstorage.PendingRecovery{
+		{Digest: "b0d2c2aaaa3eb2a19e3bc53b0f69f5d0", HKPAddr: "192.0.2.2:11371", Queued: now},
+	})
+	c.Assert(err, gc.IsNil)
+
+	pending, err := s.storage.PendingRecoveries(now, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pending, gc.HasLen, 2)
+	c.Assert(pending[0].Digest, gc.Equals, "b0d2c2aaaa3eb2a19e3bc53b0f69f5d0")
+	c.Assert(pending[0].HKPAddr, gc.Equals, "192.0.2.1:11371")
+	c.Assert(pending[1].Digest, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+
+	err = s.storage.DequeueRecovery([]string{"DA84F40D830A7BE2A3C0B7F2E146BFAA"})
+	c.Assert(err, gc.IsNil)
+	n, err := s.storage.ExpireRecovery(now.Add(-time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	pending, err = s.storage.PendingRecoveries(now, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pending, gc.HasLen, 0)
+}
+
+func (s *S) TestBulkInsert(c *gc.C) {
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"e68e311d.asc", "sksdigest.asc", "alice_signed.asc"} {
+		kr := openpgp.NewKeyReader(testing.MustInput(name))
+		readKeys, err := kr.Read()
+		c.Assert(err, gc.IsNil)
+		keys = append(keys, readKeys...)
+	}
+	// Duplicates in the same load are inserted once.
+	keys = append(keys, keys[0])
+
+	c.Assert(s.storage.DeferIndexes(), gc.IsNil)
+	s.storage.bulkBatchSize = 2
+	var result hkpstorage.InsertError
+	n, ok := s.storage.BulkInsert(keys, &result)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(result.Errors, gc.HasLen, 0)
+	c.Assert(n, gc.Equals, 3)
+	c.Assert(s.storage.RestoreIndexes(), gc.IsNil)
+
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 3)
+	rfps, err := s.storage.MatchKeyword([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+	var nfks int
+	err = s.db.QueryRow("SELECT count(*) FROM pg_constraint WHERE conname = 'subkeys_rfingerprint_fkey'").Scan(&nfks)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nfks, gc.Equals, 1)
+}
+
+func (s *S) TestSharedNotifications(c *gc.C) {
+	open := func() (*storage, chan hkpstorage.KeyChange) {
+		db, err := sql.Open("pgx", s.URL)
+		c.Assert(err, gc.IsNil)
+		st, err := New(db, nil, SharedNotifications())
+		c.Assert(err, gc.IsNil)
+		changes := make(chan hkpstorage.KeyChange, 10)
+		st.Subscribe(func(kc hkpstorage.KeyChange) error {
+			changes <- kc
+			return nil
+		})
+		return st.(*storage), changes
+	}
+	st1, changes1 := open()
+	defer st1.Close()
+	st2, changes2 := open()
+	defer st2.Close()
+
+	// Wait for the second server to listen.
+	time.Sleep(time.Second)
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	_, n, err := st1.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	for _, changes := range []chan hkpstorage.KeyChange{changes1, changes2} {
+		select {
+		case kc := <-changes:
+			c.Assert(kc, gc.DeepEquals, hkpstorage.KeyAdded{ID: keys[0].Fingerprint(), Digest: keys[0].MD5})
+		case <-time.After(10 * time.Second):
+			c.Fatal("key change not delivered")
+		}
+	}
+	// Servers do not deliver the changes they publish to themselves again.
+	select {
+	case kc := <-changes1:
+		c.Fatalf("unexpected change %v", kc)
+	case <-time.After(time.Second):
+	}
+
+	// Deletions are published once committed.
+	_, err = st1.Delete(keys[0].Fingerprint())
+	c.Assert(err, gc.IsNil)
+	for _, changes := range []chan hkpstorage.KeyChange{changes1, changes2} {
+		select {
+		case kc := <-changes:
+			c.Assert(kc, gc.DeepEquals, hkpstorage.KeyRemoved{ID: keys[0].Fingerprint(), Digest: keys[0].MD5})
+		case <-time.After(10 * time.Second):
+			c.Fatal("key change not delivered")
+		}
+	}
+}
+
+func (s *S) TestWarm(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	err := s.storage.Warm()
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.storage.Stats().Idle >= defaultWarmConns, gc.Equals, true)
+
+	keys, err := s.storage.FetchKeys([]string{openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+}
+
+func (s *S) TestEncryption(c *gc.C) {
+	// A key stored before encryption is enabled remains readable.
+	s.addKey(c, "alice_signed.asc")
+
+	keys, err := hkpstorage.ParseEncryptionKeys(strings.NewReader(
+		"old " + strings.Repeat("A", 43) + "=\n"))
+	c.Assert(err, gc.IsNil)
+	s.storage.encryption = keys
+	s.addKey(c, "uat.asc")
+
+	for _, doc := range s.queryAllKeys(c) {
+		if strings.Contains(doc.Doc, "casey") {
+			c.Fatalf("unencrypted document stored: %s", doc.Doc)
+		}
+	}
+	rfps, err := s.storage.MatchKeywords([]string{"casey marshall"}, hkpstorage.MatchPhrase)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+	fetched, err := s.storage.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+
+	// Rotate the key, and re-encrypt everything with the new one.
+	keys, err = hkpstorage.ParseEncryptionKeys(strings.NewReader(
+		"new " + strings.Repeat("B", 43) + "=\n" +
+			"old " + strings.Repeat("A", 43) + "=\n"))
+	c.Assert(err, gc.IsNil)
+	s.storage.encryption = keys
+	rfps, err = s.storage.MatchKeywords([]string{"casey marshall"}, hkpstorage.MatchPhrase)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+
+	n, err := s.storage.Reencrypt(1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = s.storage.Reencrypt(100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = s.storage.Reencrypt(100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	// The old key is no longer needed.
+	keys, err = hkpstorage.ParseEncryptionKeys(strings.NewReader(
+		"new " + strings.Repeat("B", 43) + "=\n"))
+	c.Assert(err, gc.IsNil)
+	s.storage.encryption = keys
+	for _, doc := range s.queryAllKeys(c) {
+		fetched, err := s.storage.FetchKeys([]string{doc.RFingerprint})
+		c.Assert(err, gc.IsNil)
+		c.Assert(fetched, gc.HasLen, 1)
+	}
+	rfps, err = s.storage.MatchKeywords([]string{"alice"}, hkpstorage.MatchAllWords)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+}
+
+func (s *S) TestSoftDelete(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+
+	md5, err := s.storage.Delete(key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	c.Assert(md5, gc.Equals, key.MD5)
+	_, err = s.storage.Delete(key.Fingerprint())
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+
+	// The key is kept, but no longer found.
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 1)
+	keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+	rfps, err := s.storage.Resolve([]string{key.KeyID()})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	rfps, err = s.storage.MatchMD5([]string{key.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	// It is not added again, as when offered by a recon peer.
+	_, err = hkpstorage.UpsertKey(s.storage, key)
+	c.Assert(hkpstorage.IsTombstoned(err), gc.Equals, true, gc.Commentf("%v", err))
+
+	// Its owner may restore it.
+	md5, err = s.storage.Replace(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(md5, gc.Equals, "")
+	keys, err = s.storage.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	tombstoned, err := s.storage.Tombstoned(key.RFingerprint)
+	c.Assert(err, gc.IsNil)
+	c.Assert(tombstoned, gc.Equals, false)
+}
+
+func (s *S) TestScanFingerprints(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	s.addKey(c, "uat.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+
+	expect := map[string]bool{}
+	for _, k := range openpgp.MustReadArmorKeys(testing.MustInput("uat.asc")) {
+		expect[k.RFingerprint] = true
+		for _, subKey := range k.SubKeys {
+			expect[subKey.RFingerprint] = true
+		}
+	}
+	// Deleted keys are not included.
+	_, err := s.storage.Delete(key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+
+	found := map[string]bool{}
+	err = s.storage.ScanFingerprints(func(rfp string) error {
+		found[rfp] = true
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(found, gc.DeepEquals, expect)
+}
+
+func (s *S) TestKeyState(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))[0]
+
+	state, err := s.storage.KeyState(key.RFingerprint)
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, gc.Equals, hkpstorage.KeyStateNormal)
+
+	lookups := func() (resolved, searched, fetched int) {
+		rfps, err := s.storage.Resolve([]string{key.KeyID()})
+		c.Assert(err, gc.IsNil)
+		resolved = len(rfps)
+		rfps, err = s.storage.MatchKeyword([]string{"casey"})
+		c.Assert(err, gc.IsNil)
+		searched = len(rfps)
+		keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+		c.Assert(err, gc.IsNil)
+		fetched = len(keys)
+		return
+	}
+	for _, t := range []struct {
+		state                       hkpstorage.KeyState
+		resolved, searched, fetched int
+	}{
+		{hkpstorage.KeyStateHidden, 1, 0, 1},
+		{hkpstorage.KeyStateSpam, 1, 0, 1},
+		{hkpstorage.KeyStateQuarantined, 0, 0, 0},
+		{hkpstorage.KeyStateBanned, 0, 0, 0},
+		{hkpstorage.KeyStateNormal, 1, 1, 1},
+	} {
+		comment := gc.Commentf("%s", t.state)
+		c.Assert(s.storage.SetKeyState(key.RFingerprint, t.state), gc.IsNil, comment)
+		state, err := s.storage.KeyState(key.RFingerprint)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(state, gc.Equals, t.state, comment)
+		resolved, searched, fetched := lookups()
+		c.Assert([]int{resolved, searched, fetched}, gc.DeepEquals,
+			[]int{t.resolved, t.searched, t.fetched}, comment)
+	}
+
+	c.Assert(s.storage.SetKeyState(key.RFingerprint, hkpstorage.KeyStateBanned), gc.IsNil)
+	rfps, err := s.storage.KeysInState(hkpstorage.KeyStateBanned, "", 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+	_, err = hkpstorage.UpsertKey(s.storage, key)
+	c.Assert(hkpstorage.IsTombstoned(err), gc.Equals, true)
+	_, err = s.storage.Replace(key)
+	c.Assert(hkpstorage.IsTombstoned(err), gc.Equals, true)
+
+	err = s.storage.SetKeyState(openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca"), hkpstorage.KeyStateHidden)
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+}
+
+func (s *S) TestLimits(c *gc.C) {
+	st, err := New(s.db, []openpgp.KeyReaderOption{openpgp.MaxUserIDSignatures(5)})
+	c.Assert(err, gc.IsNil)
+	key := openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0]
+	_, n, err := st.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	keys, err := st.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+	for _, uid := range keys[0].UserIDs {
+		c.Assert(len(uid.Signatures) <= 5+4, gc.Equals, true, gc.Commentf("%s", uid.Keywords))
+	}
+
+	st, err = New(s.db, []openpgp.KeyReaderOption{openpgp.MaxPackets(10)})
+	c.Assert(err, gc.IsNil)
+	key = openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))[0]
+	_, n, err = st.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.NotNil)
+	_, err = st.Replace(key)
+	c.Assert(openpgp.IsTooLarge(err), gc.Equals, true, gc.Commentf("%v", err))
+}
+
+func (s *S) TestBlock(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))[0]
+
+	blocked, err := s.storage.IsBlocked(key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	c.Assert(blocked, gc.Equals, false)
+
+	c.Assert(s.storage.Block(key.Fingerprint(), "court order"), gc.IsNil)
+	blocked, err = s.storage.IsBlocked(key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	c.Assert(blocked, gc.Equals, true)
+	keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+	list, err := s.storage.BlockedKeys()
+	c.Assert(err, gc.IsNil)
+	c.Assert(list, gc.HasLen, 1)
+	c.Assert(list[0].Fingerprint, gc.Equals, key.Fingerprint())
+	c.Assert(list[0].Reason, gc.Equals, "court order")
+
+	// Blocked keys are refused however they are submitted.
+	_, err = hkpstorage.UpsertKey(s.storage, key)
+	c.Assert(hkpstorage.IsBlocked(err), gc.Equals, true, gc.Commentf("%v", err))
+	_, n, err := s.storage.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.NotNil)
+	_, err = s.storage.Replace(key)
+	c.Assert(hkpstorage.IsBlocked(err), gc.Equals, true, gc.Commentf("%v", err))
+
+	c.Assert(s.storage.Unblock(key.Fingerprint()), gc.IsNil)
+	c.Assert(hkpstorage.IsNotFound(s.storage.Unblock(key.Fingerprint())), gc.Equals, true)
+	_, err = hkpstorage.UpsertKey(s.storage, key)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *S) TestCapacityReport(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	s.addKey(c, "weasel.asc")
+	weasel := openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0]
+
+	report, err := hkpstorage.Capacity(s.storage, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Keys, gc.Equals, int64(2))
+	c.Assert(report.KeywordEntries > 0, gc.Equals, true)
+	relations := map[string]hkpstorage.RelationSize{}
+	for _, rel := range report.Relations {
+		relations[rel.Name] = rel
+	}
+	c.Assert(relations["keys"].Table, gc.Equals, "")
+	c.Assert(relations["keys"].Bytes > 0, gc.Equals, true)
+	c.Assert(relations["keys_keywords"].Table, gc.Equals, "keys")
+
+	c.Assert(report.LargestKeys, gc.HasLen, 1)
+	c.Assert(report.LargestKeys[0].RFingerprint, gc.Equals, weasel.RFingerprint)
+	c.Assert(report.LargestKeys[0].Packets, gc.Equals, len(weasel.Packets()))
+	c.Assert(report.MostKeywords, gc.HasLen, 1)
+	c.Assert(report.Growth, gc.HasLen, 1)
+	c.Assert(report.Growth[0].Added, gc.Equals, int64(2))
+	c.Assert(report.GrowthRate(12), gc.Equals, float64(2))
+}
+
+func (s *S) TestClock(c *gc.C) {
+	created := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	clock := mock.NewClock(created)
+	s.storage.clock = clock
+
+	s.addKey(c, "alice_unsigned.asc")
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	c.Assert(keyDocs[0].CTime.Equal(created), gc.Equals, true)
+	c.Assert(keyDocs[0].MTime.Equal(created), gc.Equals, true)
+
+	// Only the modification time changes when the key is updated.
+	clock.Advance(time.Hour)
+	s.addKey(c, "alice_signed.asc")
+	keyDocs = s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	c.Assert(keyDocs[0].CTime.Equal(created), gc.Equals, true)
+	c.Assert(keyDocs[0].MTime.Equal(created.Add(time.Hour)), gc.Equals, true)
+}
+
+func (s *S) TestErasure(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))[0]
+	filed := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	byAddress := hkpstorage.ErasureRequest{ID: "1", Address: "casey.marshall@gmail.com", Contact: "casey", Filed: filed}
+	byKey := hkpstorage.ErasureRequest{ID: "2", Fingerprint: key.Fingerprint(), Contact: "casey", Filed: filed.Add(time.Hour)}
+	c.Assert(s.storage.FileErasure(byAddress), gc.IsNil)
+	c.Assert(s.storage.FileErasure(byKey), gc.IsNil)
+	pending, err := s.storage.ErasureRequests(hkpstorage.ErasurePending)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pending, gc.HasLen, 2)
+	c.Assert(pending[0].Address, gc.Equals, byAddress.Address)
+	c.Assert(pending[1].Fingerprint, gc.Equals, key.Fingerprint())
+	c.Assert(pending[1].Decided.IsZero(), gc.Equals, true)
+
+	rfps, err := s.storage.AddressKeys(byAddress.Address)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+
+	req, err := s.storage.DecideErasure("1", hkpstorage.ErasureApproved, filed.Add(2*time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(req.Status, gc.Equals, hkpstorage.ErasureApproved)
+	c.Assert(req.Decided.Equal(filed.Add(2*time.Hour)), gc.Equals, true)
+	_, err = s.storage.DecideErasure("1", hkpstorage.ErasureRejected, filed.Add(2*time.Hour))
+	c.Assert(errors.Is(err, hkpstorage.ErrErasureNotFound), gc.Equals, true)
+
+	n, err := hkpstorage.ApplyErasure(s.storage, req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	rfps, err = s.storage.AddressKeys(byAddress.Address)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	fps, addrs, err := hkpstorage.Suppressions(s.storage)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fps, gc.HasLen, 0)
+	c.Assert(addrs, gc.DeepEquals, []string{byAddress.Address})
+}
+
+func (s *S) TestTombstone(c *gc.C) {
+	s.addKey(c, "alice_signed.asc")
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	var changes []hkpstorage.KeyChange
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		changes = append(changes, kc)
+		return nil
+	})
+
+	// The key's digest leaves the prefix tree...
+	err := s.storage.Tombstone(key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.DeepEquals, []hkpstorage.KeyChange{
+		hkpstorage.KeyRemoved{ID: key.Fingerprint(), Digest: key.MD5},
+	})
 
+	// ...so it is refused when a recon peer offers it back.
+	_, err = hkpstorage.UpsertKey(s.storage, key)
+	c.Assert(hkpstorage.IsTombstoned(err), gc.Equals, true, gc.Commentf("%v", err))
 }
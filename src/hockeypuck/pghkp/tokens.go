@@ -0,0 +1,73 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.TokenStore = (*storage)(nil)
+
+func (st *storage) InsertToken(t hkpstorage.IssuedToken) error {
+	_, err := st.Exec(`INSERT INTO verification_tokens (id, address, source, issued, expires)
+VALUES ($1, $2, $3, $4, $5)`, t.ID, t.Address, t.Source, t.Issued, t.Expires)
+	return errors.WithStack(err)
+}
+
+func (st *storage) CountTokens(address, source string, since time.Time) (int, int, error) {
+	var byAddress, bySource int
+	err := st.QueryRow(`SELECT
+(SELECT count(*) FROM verification_tokens WHERE address = $1 AND issued >= $3),
+(SELECT count(*) FROM verification_tokens WHERE source = $2 AND issued >= $3)`,
+		address, source, since).Scan(&byAddress, &bySource)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	return byAddress, bySource, nil
+}
+
+func (st *storage) ConsumeToken(id string, now time.Time) (bool, error) {
+	// Consumed tokens expire immediately, but are kept until removed by
+	// ExpireTokens so that they still count towards the rate limits.
+	result, err := st.Exec(`UPDATE verification_tokens SET expires = issued
+WHERE id = $1 AND expires > $2`, id, now)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+func (st *storage) ExpireTokens(before time.Time) (int, error) {
+	result, err := st.Exec(`DELETE FROM verification_tokens WHERE expires < $1`, before)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return int(n), nil
+}
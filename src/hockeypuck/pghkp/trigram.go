@@ -0,0 +1,71 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"strings"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+// TrigramSearch indexes the trigrams of the user IDs of stored keys with the
+// pg_trgm extension, so that keyword searches may match substrings of user
+// IDs and words similar to those searched for. The extension is created if
+// it is not installed, which needs a database user allowed to do so, and
+// PostgreSQL 12 or later. Encrypted documents cannot be searched this way.
+func TrigramSearch() Option {
+	return func(st *storage) { st.trigramSearch = true }
+}
+
+// userIDsText is the expression of the lower-cased user IDs of a key, as
+// a JSON array, which is indexed by its trigrams. Queries must use it as it
+// is for the index to be used.
+const userIDsText = `lower(jsonb_path_query_array(doc, '$.userIDs[*].keywords')::TEXT)`
+
+var crTrigramIndexesSQL = []string{
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm;`,
+	`CREATE INDEX IF NOT EXISTS keys_userids_trgm ON keys USING gin((` + userIDsText + `) gin_trgm_ops);`,
+}
+
+// trigramConditions are the conditions on keys of a search of $1 with each
+// KeywordMatch answered by the trigram index.
+var trigramConditions = map[hkpstorage.KeywordMatch]string{
+	hkpstorage.MatchSubstring: userIDsText + ` LIKE $1`,
+	hkpstorage.MatchFuzzy:     `$1 <% ` + userIDsText,
+}
+
+// trigramRanks are the expressions ranking the matches of trigram
+// conditions. Substrings are matched or not.
+var trigramRanks = map[hkpstorage.KeywordMatch]string{
+	hkpstorage.MatchFuzzy: `word_similarity($1, ` + userIDsText + `)`,
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// trigramTerm returns the parameter of a trigram condition for a search, or
+// the empty string if the search cannot match anything.
+func trigramTerm(search string, match hkpstorage.KeywordMatch) string {
+	search = strings.ToLower(strings.TrimSpace(search))
+	if search == "" {
+		return ""
+	}
+	if match == hkpstorage.MatchSubstring {
+		return "%" + likeEscaper.Replace(search) + "%"
+	}
+	return search
+}
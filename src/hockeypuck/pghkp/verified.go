@@ -0,0 +1,105 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+var _ hkpstorage.VerificationStore = (*storage)(nil)
+
+func (st *storage) VerifiedAddresses(rfp string) ([]hkpstorage.VerifiedAddress, error) {
+	rows, err := st.Query(`SELECT rfingerprint, address, verified, source FROM verified_addresses
+WHERE rfingerprint = $1 ORDER BY address`, rfp)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanVerifiedAddresses(rows)
+}
+
+func (st *storage) VerifiedSince(t time.Time, limit int) ([]hkpstorage.VerifiedAddress, error) {
+	rows, err := st.Query(`SELECT rfingerprint, address, verified, source FROM verified_addresses
+WHERE source = '' AND verified >= $1 ORDER BY verified, rfingerprint, address LIMIT $2`, t, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanVerifiedAddresses(rows)
+}
+
+func (st *storage) CountVerifiedKeys(domain string) (int, error) {
+	var n int
+	err := st.QueryRow(`SELECT count(DISTINCT rfingerprint) FROM verified_addresses
+WHERE right(address, length($1::TEXT) + 1) = '@' || $1::TEXT`, strings.ToLower(domain)).Scan(&n)
+	return n, errors.WithStack(err)
+}
+
+func scanVerifiedAddresses(rows *sql.Rows) ([]hkpstorage.VerifiedAddress, error) {
+	defer rows.Close()
+	var result []hkpstorage.VerifiedAddress
+	for rows.Next() {
+		var va hkpstorage.VerifiedAddress
+		err := rows.Scan(&va.RFingerprint, &va.Address, &va.Verified, &va.Source)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, va)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (st *storage) SetVerified(addrs []hkpstorage.VerifiedAddress) (retErr error) {
+	if len(addrs) == 0 {
+		return nil
+	}
+	tx, err := st.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		} else {
+			retErr = tx.Commit()
+		}
+	}()
+	stmt, err := tx.Prepare(`INSERT INTO verified_addresses (rfingerprint, address, verified, source)
+SELECT $1::TEXT, $2::TEXT, $3, $4::TEXT WHERE EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1 AND deleted_at IS NULL)
+ON CONFLICT (rfingerprint, address) DO UPDATE SET verified = EXCLUDED.verified, source = EXCLUDED.source
+WHERE verified_addresses.verified < EXCLUDED.verified`)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer stmt.Close()
+	for _, va := range addrs {
+		_, err = stmt.Exec(va.RFingerprint, va.Address, va.Verified, va.Source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+)
+
+const (
+	matchMD5SQL      = "SELECT rfingerprint FROM keys WHERE md5 = ANY($1) AND " + servedSQL
+	fetchKeysSQL     = "SELECT rfingerprint, " + smallDocSQL + " FROM keys WHERE rfingerprint = ANY($1) AND " + servedSQL
+	fetchKeyringsSQL = "SELECT rfingerprint, " + smallDocSQL + ", ctime, mtime FROM keys WHERE rfingerprint = ANY($1) AND " + servedSQL
+)
+
+// warmStatements are the statements run by the most frequent lookups. Each
+// connection prepares and caches a statement the first time it is run.
+var warmStatements = []string{
+	matchMD5SQL,
+	fetchKeysSQL,
+	fetchKeyringsSQL,
+}
+
+// defaultWarmConns is the number of connections opened by Warm when the
+// number of idle connections is not configured, which is the database/sql
+// default.
+const defaultWarmConns = 2
+
+var _ hkpstorage.Warmer = (*storage)(nil)
+
+// Warm implements storage.Warmer. It fills the pool with as many
+// connections as it keeps idle, and prepares the statements of the most
+// frequent lookups on each of them, so that the first requests served need
+// neither.
+func (st *storage) Warm() error {
+	n := st.pool.MaxIdleConns
+	if n <= 0 {
+		n = defaultWarmConns
+	}
+	if st.pool.MaxConns > 0 && n > st.pool.MaxConns {
+		n = st.pool.MaxConns
+	}
+	ctx := context.Background()
+	// Connections are held until all have been warmed, so that each is a
+	// distinct connection.
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := st.Conn(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		conns = append(conns, conn)
+		for _, sqlStr := range warmStatements {
+			// No rows match, but running the statement prepares it.
+			rows, err := conn.QueryContext(ctx, sqlStr, []string{})
+			if err != nil {
+				return errors.Wrapf(err, "preparing %q", sqlStr)
+			}
+			rows.Close()
+		}
+	}
+	return nil
+}
@@ -5,7 +5,7 @@ import (
 	"os"
 	stdtesting "testing"
 
-	_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v4/stdlib"
 	gc "gopkg.in/check.v1"
 )
 
@@ -23,7 +23,7 @@ type S struct {
 var _ = gc.Suite(&S{})
 
 func (s *S) TestRun(c *gc.C) {
-	db, err := sql.Open("postgres", s.URL)
+	db, err := sql.Open("pgx", s.URL)
 	c.Assert(err, gc.IsNil)
 	var n int
 	err = db.QueryRow("SELECT 1").Scan(&n)
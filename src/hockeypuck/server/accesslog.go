@@ -0,0 +1,72 @@
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// accessLogSampler decides which requests are written to the access log,
+// so that busy servers can log every submission but only some lookups.
+type accessLogSampler struct {
+	mu          sync.RWMutex
+	defaultRate float64
+	routes      map[string]float64
+}
+
+func newAccessLogSampler(conf *accessLogConfig) *accessLogSampler {
+	a := &accessLogSampler{}
+	a.set(conf)
+	return a
+}
+
+// set changes the sampling rates, such as when the configuration is
+// reloaded.
+func (a *accessLogSampler) set(conf *accessLogConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaultRate = conf.DefaultRate
+	a.routes = conf.Routes
+}
+
+// rate returns the sampling rate for the most specific route matching path.
+func (a *accessLogSampler) rate(path string) float64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if rate, ok := a.routes[path]; ok {
+		return rate
+	}
+	rate, matched := a.defaultRate, ""
+	for route, routeRate := range a.routes {
+		if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) && len(route) > len(matched) {
+			rate, matched = routeRate, route
+		}
+	}
+	return rate
+}
+
+func (a *accessLogSampler) sample(path string) bool {
+	rate := a.rate(path)
+	if rate >= 1 {
+		return true
+	} else if rate <= 0 {
+		return false
+	}
+	return rand.Float64() < rate
+}
+
+// outcome classifies a response status for the access log.
+func outcome(statusCode int) string {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return "not-found"
+	case statusCode == http.StatusServiceUnavailable:
+		return "unavailable"
+	case statusCode >= 500:
+		return "server-error"
+	case statusCode >= 400:
+		return "client-error"
+	}
+	return "ok"
+}
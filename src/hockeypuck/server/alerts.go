@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/alert"
+	"hockeypuck/hkp/sks"
+	log "hockeypuck/logrus"
+)
+
+// newAlerter returns an Alerter sending to the configured alert targets, or
+// nil if there are none.
+func newAlerter(settings *Settings) (*alert.Alerter, error) {
+	conf := &settings.Alerts
+	options := []alert.Option{alert.Dedup(time.Duration(conf.DedupSecs) * time.Second)}
+	var targets int
+	if conf.Email != nil {
+		min, err := alert.ParseSeverity(conf.Email.MinSeverity)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		addr := conf.Email.SMTP.Host
+		if addr == "" {
+			addr = DefaultSMTPHost
+		}
+		var auth smtp.Auth
+		if conf.Email.SMTP.User != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			auth = smtp.PlainAuth(conf.Email.SMTP.ID, conf.Email.SMTP.User, conf.Email.SMTP.Password, host)
+		}
+		options = append(options, alert.To(&alert.Email{
+			Addr:     addr,
+			Auth:     auth,
+			From:     conf.Email.From,
+			To:       conf.Email.To,
+			Hostname: settings.Hostname,
+		}, min))
+		targets++
+	}
+	if conf.Webhook != nil {
+		min, err := alert.ParseSeverity(conf.Webhook.MinSeverity)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, alert.To(&alert.Webhook{
+			URL:      conf.Webhook.URL,
+			Hostname: settings.Hostname,
+		}, min))
+		targets++
+	}
+	if conf.PagerDuty != nil {
+		min, err := alert.ParseSeverity(conf.PagerDuty.MinSeverity)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, alert.To(&alert.PagerDuty{
+			RoutingKey: conf.PagerDuty.RoutingKey,
+			URL:        conf.PagerDuty.URL,
+			Hostname:   settings.Hostname,
+		}, min))
+		targets++
+	}
+	if targets == 0 {
+		return nil, nil
+	}
+	return alert.New(options...), nil
+}
+
+// pinger is implemented by storage backends whose connection can be checked.
+type pinger interface {
+	Ping() error
+}
+
+// monitorHealth periodically checks the storage backend and the rate at
+// which submitted keys are rejected, raising alerts when they are unhealthy.
+func (s *Server) monitorHealth() error {
+	conf := s.settings.Alerts
+	interval := time.Duration(conf.CheckIntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultAlertCheckIntervalSecs * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last insertCounts
+	if s.sksPeer != nil {
+		last = sourceCounts(s.sksPeer.Stats().Sources)
+	}
+	for {
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+		s.checkStorageHealth()
+		if s.sksPeer != nil {
+			counts := sourceCounts(s.sksPeer.Stats().Sources)
+			checkInsertErrors(s.alerts, &conf, counts.sub(last))
+			last = counts
+		}
+	}
+}
+
+func (s *Server) checkStorageHealth() {
+	p, ok := s.st.(pinger)
+	if !ok {
+		return
+	}
+	driver := s.settings.OpenPGP.DB.Driver
+	err := p.Ping()
+	if err != nil {
+		log.Errorf("storage health check failed: %v", err)
+		s.alerts.Raise(alert.Alert{
+			Severity:  alert.Critical,
+			Condition: alert.StorageHealth,
+			Subject:   driver,
+			Summary:   fmt.Sprintf("storage %q is unreachable", driver),
+			Details:   map[string]string{"error": err.Error()},
+		})
+		return
+	}
+	s.alerts.Resolve(alert.StorageHealth, driver)
+}
+
+// insertCounts totals the keys submitted from all sources.
+type insertCounts struct {
+	stored, rejected int
+}
+
+func (c insertCounts) sub(d insertCounts) insertCounts {
+	return insertCounts{stored: c.stored - d.stored, rejected: c.rejected - d.rejected}
+}
+
+func sourceCounts(sources sks.SourceStatMap) insertCounts {
+	var c insertCounts
+	for _, ss := range sources {
+		c.stored += ss.Accepted + ss.Merged
+		c.rejected += ss.Rejected
+	}
+	return c
+}
+
+func checkInsertErrors(alerts *alert.Alerter, conf *alertsConfig, delta insertCounts) {
+	total := delta.stored + delta.rejected
+	if conf.InsertErrorRate <= 0 || total <= 0 || total < conf.InsertErrorMin {
+		return
+	}
+	rate := float64(delta.rejected) / float64(total)
+	if rate < conf.InsertErrorRate {
+		return
+	}
+	alerts.Raise(alert.Alert{
+		Severity:  alert.Warning,
+		Condition: alert.InsertErrors,
+		Summary:   fmt.Sprintf("%d of %d submitted keys were rejected", delta.rejected, total),
+		Details: map[string]string{
+			"rejected":  fmt.Sprint(delta.rejected),
+			"submitted": fmt.Sprint(total),
+			"threshold": fmt.Sprint(conf.InsertErrorRate),
+		},
+	})
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp"
+)
+
+// newSubmissionChallenge returns the configured challenge on key
+// submissions, or nil if there is none. CAPTCHA responses are verified for
+// the client found by clientIP.
+func newSubmissionChallenge(settings *Settings, clientIP func(*http.Request) net.IP) (hkp.Challenge, error) {
+	conf := &settings.HKP.Challenge
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case ChallengeHashcash:
+		if settings.Hostname == "" {
+			return nil, errors.New("hashcash challenge requires a hostname")
+		}
+		return hkp.NewHashcashChallenge(conf.Bits, settings.Hostname, time.Duration(conf.MaxAgeSecs)*time.Second), nil
+	case ChallengeCaptcha:
+		if conf.VerifyURL == "" || conf.ResponseField == "" || conf.SecretFile == "" {
+			return nil, errors.New("CAPTCHA challenge requires verifyURL, secretFile and responseField")
+		}
+		secret, err := ioutil.ReadFile(conf.SecretFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return hkp.NewCaptchaChallenge(conf.VerifyURL, strings.TrimSpace(string(secret)), conf.ResponseField, clientIP), nil
+	}
+	return nil, errors.Errorf("invalid challenge type %q", conf.Type)
+}
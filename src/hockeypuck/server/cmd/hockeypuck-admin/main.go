@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	dryRun     = flag.Bool("dry-run", false, "show what would be changed, without changing it")
+	reason     = flag.String("reason", "", "reason recorded for a ban")
+)
+
+func usage() {
+	log.Errorf("usage: %s [flags] show <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] delete <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] ban <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] unban <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] quarantine <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] reindex <fingerprint>", os.Args[0])
+}
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) != 2 {
+		usage()
+		cmd.Die(errors.New("missing arguments"))
+	}
+
+	err = admin(settings, args[0], args[1])
+	cmd.Die(err)
+}
+
+func admin(settings *server.Settings, op string, arg string) error {
+	fp := strings.ToLower(strings.TrimPrefix(arg, "0x"))
+	if len(fp) != 40 && len(fp) != 64 || strings.Trim(fp, "0123456789abcdef") != "" {
+		return errors.Errorf("invalid fingerprint %q", arg)
+	}
+
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	switch op {
+	case "show":
+		return show(st, fp)
+	case "delete":
+		key, err := fetchKey(st, fp)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			fmt.Println("would delete:")
+			return describe(os.Stdout, key)
+		}
+		_, err = storage.DeleteKey(st, fp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{"fp": fp}).Info("deleted")
+		return nil
+	case "ban":
+		b, ok := st.(storage.Blocker)
+		if !ok {
+			return errors.Errorf("storage driver %q does not support banning keys", settings.OpenPGP.DB.Driver)
+		}
+		if *dryRun {
+			key, err := fetchKey(st, fp)
+			if storage.IsNotFound(err) {
+				fmt.Printf("would ban %s, which is not stored\n", fp)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			fmt.Println("would ban and delete:")
+			return describe(os.Stdout, key)
+		}
+		why := *reason
+		if why == "" {
+			why = "banned with hockeypuck-admin"
+		}
+		err := b.Block(fp, why)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{"fp": fp, "reason": why}).Info("banned")
+		return nil
+	case "unban":
+		b, ok := st.(storage.Blocker)
+		if !ok {
+			return errors.Errorf("storage driver %q does not support banning keys", settings.OpenPGP.DB.Driver)
+		}
+		if *dryRun {
+			blocked, err := b.IsBlocked(fp)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if !blocked {
+				return errors.Errorf("key %s is not banned", fp)
+			}
+			fmt.Printf("would unban %s\n", fp)
+			return nil
+		}
+		err := b.Unblock(fp)
+		if storage.IsNotFound(err) {
+			return errors.Errorf("key %s is not banned", fp)
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{"fp": fp}).Info("unbanned")
+		return nil
+	case "quarantine":
+		kss, ok := st.(storage.KeyStateStore)
+		if !ok {
+			return errors.Errorf("storage driver %q does not support key states", settings.OpenPGP.DB.Driver)
+		}
+		if *dryRun {
+			key, err := fetchKey(st, fp)
+			if err != nil {
+				return err
+			}
+			fmt.Println("would withhold from lookups:")
+			return describe(os.Stdout, key)
+		}
+		err := kss.SetKeyState(openpgp.Reverse(fp), storage.KeyStateQuarantined)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{"fp": fp}).Info("quarantined")
+		return nil
+	case "reindex":
+		if *dryRun {
+			key, err := fetchKey(st, fp)
+			if err != nil {
+				return err
+			}
+			fmt.Println("would reindex:")
+			return describe(os.Stdout, key)
+		}
+		err := storage.ReindexKey(st, fp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{"fp": fp}).Info("reindexed")
+		return nil
+	}
+	usage()
+	return errors.Errorf("invalid operation %q", op)
+}
+
+// show describes a key and its moderation state, whether or not it is
+// stored.
+func show(st storage.Storage, fp string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if b, ok := st.(storage.Blocker); ok {
+		blocked, err := b.IsBlocked(fp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Fprintf(w, "banned\t%v\n", blocked)
+	}
+	if kss, ok := st.(storage.KeyStateStore); ok {
+		state, err := kss.KeyState(openpgp.Reverse(fp))
+		if err == nil {
+			fmt.Fprintf(w, "state\t%s\n", state)
+		} else if !storage.IsNotFound(err) {
+			return errors.WithStack(err)
+		}
+	}
+	key, err := fetchKey(st, fp)
+	if storage.IsNotFound(err) {
+		fmt.Fprintf(w, "stored\tfalse\n")
+		return errors.WithStack(w.Flush())
+	} else if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return describe(os.Stdout, key)
+}
+
+func fetchKey(st storage.Storage, fp string) (*openpgp.PrimaryKey, error) {
+	rfp := openpgp.Reverse(fp)
+	keys, err := st.FetchKeys([]string{rfp})
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range keys {
+		if key.RFingerprint == rfp {
+			return key, nil
+		}
+	}
+	return nil, errors.Wrapf(storage.ErrKeyNotFound, "key %s", fp)
+}
+
+// describe writes what a key consists of, as it would be removed or changed.
+func describe(out io.Writer, key *openpgp.PrimaryKey) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	nsigs := len(key.Signatures)
+	for _, uid := range key.UserIDs {
+		nsigs += len(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		nsigs += len(uat.Signatures)
+	}
+	for _, subkey := range key.SubKeys {
+		nsigs += len(subkey.Signatures)
+	}
+	fmt.Fprintf(w, "pub\t%s%d/%s\t%s\n", openpgp.AlgorithmName(key.Algorithm), key.BitLen,
+		key.Fingerprint(), key.Creation.UTC().Format(time.RFC3339))
+	for _, uid := range key.UserIDs {
+		fmt.Fprintf(w, "uid\t%s\t%d signatures\n", uid.Keywords, len(uid.Signatures))
+	}
+	if len(key.UserAttributes) > 0 {
+		fmt.Fprintf(w, "uat\t%d user attributes\t\n", len(key.UserAttributes))
+	}
+	for _, subkey := range key.SubKeys {
+		fmt.Fprintf(w, "sub\t%s%d/%s\t%s\n", openpgp.AlgorithmName(subkey.Algorithm), subkey.BitLen,
+			subkey.Fingerprint(), subkey.Creation.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "total\t%d bytes\t%d signatures\n", key.Length, nsigs)
+	return errors.WithStack(w.Flush())
+}
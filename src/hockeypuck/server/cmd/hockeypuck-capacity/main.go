@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile   = flag.String("config", "", "config file")
+	top          = flag.Int("top", 20, "number of keys listed in each ranking")
+	growthMonths = flag.Int("growth-months", 12, "months over which the growth rate is averaged")
+	jsonOutput   = flag.Bool("json", false, "write the report as JSON")
+)
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	err = capacity(settings)
+	cmd.Die(err)
+}
+
+// capacity reports the space used by the keyserver database, and how fast it
+// is growing.
+func capacity(settings *server.Settings) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	if _, ok := st.(storage.CapacityReporter); !ok {
+		return errors.Errorf("storage driver %q does not report capacity", settings.OpenPGP.DB.Driver)
+	}
+	report, err := storage.Capacity(st, *top)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(report))
+	}
+	return errors.WithStack(writeReport(os.Stdout, report))
+}
+
+func writeReport(out io.Writer, report *storage.CapacityReport) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Capacity report generated %s\n\n", report.Generated.Format("2006-01-02 15:04:05 MST"))
+
+	var keysBytes, keywordsBytes int64
+	fmt.Fprintln(w, "RELATION\tTABLE\tSIZE\tROWS")
+	for _, rel := range report.Relations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", rel.Name, rel.Table, formatBytes(rel.Bytes), rel.Rows)
+		switch rel.Name {
+		case "keys":
+			keysBytes = rel.Bytes
+		case "keys_keywords":
+			keywordsBytes = rel.Bytes
+		}
+	}
+
+	fmt.Fprintf(w, "\nKeys stored:\t%d\n", report.Keys)
+	fmt.Fprintf(w, "Keyword index entries:\t%d\n", report.KeywordEntries)
+	if report.Keys > 0 {
+		fmt.Fprintf(w, "Keyword entries per key:\t%.1f\n", float64(report.KeywordEntries)/float64(report.Keys))
+	}
+	if keysBytes > 0 && keywordsBytes > 0 {
+		fmt.Fprintf(w, "Keyword index size:\t%.0f%% of keys table\n", 100*float64(keywordsBytes)/float64(keysBytes))
+	}
+
+	fmt.Fprintln(w, "\nLARGEST KEYS\tSIZE\tKEYWORDS\tPACKETS\tDUPLICATES\tRECERTIFICATIONS")
+	for _, key := range report.LargestKeys {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", openpgp.Reverse(key.RFingerprint), formatBytes(key.Bytes),
+			key.Keywords, key.Packets, key.Duplicates, key.Recertifications)
+	}
+	fmt.Fprintln(w, "\nMOST KEYWORDS\tSIZE\tKEYWORDS")
+	for _, key := range report.MostKeywords {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", openpgp.Reverse(key.RFingerprint), formatBytes(key.Bytes), key.Keywords)
+	}
+	fmt.Fprintln(w, "\nDUPLICATE-HEAVY KEYS\tSIZE\tPACKETS\tDUPLICATES\tRECERTIFICATIONS")
+	for _, key := range report.DuplicateHeavy {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", openpgp.Reverse(key.RFingerprint), formatBytes(key.Bytes),
+			key.Packets, key.Duplicates, key.Recertifications)
+	}
+
+	fmt.Fprintln(w, "\nMONTH\tADDED\tTOTAL")
+	var total int64
+	for _, period := range report.Growth {
+		total += period.Added
+		fmt.Fprintf(w, "%s\t%d\t%d\n", period.Start.Format("2006-01"), period.Added, total)
+	}
+	fmt.Fprintf(w, "\nMean growth over the last %d months:\t%.0f keys per month\n",
+		*growthMonths, report.GrowthRate(*growthMonths))
+	return w.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
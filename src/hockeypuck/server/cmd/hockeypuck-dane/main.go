@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/dane"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	domains    = flag.String("domain", "", "comma-separated domains to generate records for (default: the configured WKD domains)")
+	ttl        = flag.Int("ttl", 0, "TTL of the records in seconds (default: the zone's default TTL)")
+	jsonOutput = flag.Bool("json", false, "write the records as JSON")
+)
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	err = generate(settings)
+	cmd.Die(err)
+}
+
+// generate writes the OPENPGPKEY records of the keys with addresses verified
+// by this keyserver in each domain, for publication in a DNSSEC-signed zone.
+func generate(settings *server.Settings) error {
+	names := settings.HKP.VerifiedAddresses.WKDDomains
+	if *domains != "" {
+		names = strings.Split(*domains, ",")
+	}
+	if len(names) == 0 {
+		return errors.New("no domains given")
+	}
+
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	policy := append([]openpgp.PolicyOption{openpgp.DropMalformed()}, server.ServePolicy(settings)...)
+	records := []*dane.Record{}
+	for _, domain := range names {
+		domainRecords, err := dane.Records(st, strings.TrimSpace(domain), policy...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to generate records for %q", domain)
+		}
+		records = append(records, domainRecords...)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(records))
+	}
+	return errors.WithStack(dane.WriteZone(os.Stdout, records, *ttl))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/tomb.v2"
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/mrhkp"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	"hockeypuck/openpgp"
@@ -29,6 +31,8 @@ var (
 	count      = flag.Int("count", 15000, "keys per file")
 	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
 	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+	listing    = flag.Bool("listing", false, "write a machine-readable index of the keys in each dump file")
+	algNames   = flag.Bool("listing-algorithm-names", false, "name key algorithms in listings, rather than numbering them")
 )
 
 func main() {
@@ -92,6 +96,11 @@ func dump(settings *server.Settings) error {
 		return errors.WithStack(err)
 	}
 
+	// Local-only keys should not be in the prefix tree, but may have been
+	// added before they were configured as such.
+	localKeys := sks.NewLocalKeys(settings.OpenPGP.LocalOnly)
+	kw := openpgp.NewKeyWriter(server.ServePolicy(settings)...)
+
 	var t tomb.Tomb
 	ch := make(chan string)
 
@@ -105,7 +114,7 @@ func dump(settings *server.Settings) error {
 		for digest := range ch {
 			digests = append(digests, digest)
 			if len(digests) >= *count {
-				err := writeKeys(st, digests, i)
+				err := writeKeys(st, localKeys, kw, digests, i)
 				if err != nil {
 					return errors.WithStack(err)
 				}
@@ -114,7 +123,7 @@ func dump(settings *server.Settings) error {
 			}
 		}
 		if len(digests) > 0 {
-			err := writeKeys(st, digests, i)
+			err := writeKeys(st, localKeys, kw, digests, i)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -157,7 +166,7 @@ func traverse(root recon.PrefixNode, ch chan string) error {
 
 const chunksize = 20
 
-func writeKeys(st storage.Queryer, digests []string, num int) error {
+func writeKeys(st storage.Queryer, localKeys sks.LocalKeys, kw *openpgp.KeyWriter, digests []string, num int) error {
 	rfps, err := st.MatchMD5(digests)
 	if err != nil {
 		return errors.WithStack(err)
@@ -169,6 +178,10 @@ func writeKeys(st storage.Queryer, digests []string, num int) error {
 	}
 	defer f.Close()
 
+	ix := &mrhkp.Index{Fingerprint: true, AlgorithmNames: *algNames}
+	var records bytes.Buffer
+	var listed int
+
 	for len(rfps) > 0 {
 		var chunk []string
 		if len(rfps) > chunksize {
@@ -184,11 +197,43 @@ func writeKeys(st storage.Queryer, digests []string, num int) error {
 			return errors.WithStack(err)
 		}
 		for _, key := range keys {
-			err := openpgp.WritePackets(f, key)
+			if localKeys.Contains(key.Fingerprint()) {
+				continue
+			}
+			err := kw.Write(f, key)
 			if err != nil {
 				return errors.WithStack(err)
 			}
+			if *listing {
+				err = ix.WriteKey(&records, key)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				listed++
+			}
 		}
 	}
+	if *listing {
+		return writeListing(filepath.Join(*outputDir, fmt.Sprintf("hkp-dump-%04d.txt", num)), ix, listed, &records)
+	}
 	return nil
 }
+
+// writeListing writes the machine-readable index of a dump file, given the
+// number of keys it lists and their records.
+func writeListing(path string, ix *mrhkp.Index, n int, records *bytes.Buffer) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	err = ix.WriteInfo(f, n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = records.WriteTo(f)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
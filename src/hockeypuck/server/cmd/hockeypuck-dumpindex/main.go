@@ -0,0 +1,19 @@
+package main
+
+import (
+	"flag"
+
+	"hockeypuck/dumphkp"
+
+	"hockeypuck/server/cmd"
+)
+
+var (
+	dumpDir = flag.String("path", ".", "path of key dump files to index")
+)
+
+func main() {
+	flag.Parse()
+	err := dumphkp.BuildIndex(*dumpDir)
+	cmd.Die(err)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	reason     = flag.String("reason", "", "reason for filing an erasure request")
+	contact    = flag.String("contact", "", "contact for the requester of an erasure")
+)
+
+func usage() {
+	log.Errorf("usage: %s [flags] file <address or fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] list [pending|approved|rejected]", os.Args[0])
+	log.Errorf("       %s [flags] approve <id>", os.Args[0])
+	log.Errorf("       %s [flags] reject <id>", os.Args[0])
+}
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+		cmd.Die(errors.New("missing arguments"))
+	}
+
+	err = erasure(settings, args[0], args[1:])
+	cmd.Die(err)
+}
+
+func erasure(settings *server.Settings, op string, args []string) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	es, ok := st.(storage.ErasureStore)
+	if !ok {
+		return errors.Errorf("storage driver %q does not support erasure requests", settings.OpenPGP.DB.Driver)
+	}
+
+	switch {
+	case op == "file" && len(args) == 1:
+		req := storage.ErasureRequest{
+			Reason:  *reason,
+			Contact: *contact,
+			Status:  storage.ErasurePending,
+			Filed:   storage.SystemClock.Now(),
+		}
+		if strings.Contains(args[0], "@") {
+			req.Address = args[0]
+		} else {
+			req.Fingerprint = args[0]
+		}
+		err = req.Validate()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		req.ID, err = storage.RandomIDs.NewID()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = es.FileErasure(req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Println(req.ID)
+		return nil
+	case op == "list" && len(args) <= 1:
+		status := storage.ErasurePending
+		if len(args) == 1 {
+			status, err = storage.ParseErasureStatus(args[0])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		reqs, err := es.ErasureRequests(status)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, req := range reqs {
+			subject := req.Address
+			if req.Fingerprint != "" {
+				subject = "0x" + req.Fingerprint
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%q\n", req.ID, req.Filed.Format(time.RFC3339), subject, req.Contact, req.Reason)
+		}
+		return nil
+	case op == "approve" && len(args) == 1:
+		req, err := es.DecideErasure(args[0], storage.ErasureApproved, storage.SystemClock.Now())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n, err := storage.ApplyErasure(st, req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{
+			"id":          req.ID,
+			"address":     req.Address,
+			"fingerprint": req.Fingerprint,
+			"keys":        n,
+		}).Info("erasure request approved")
+		return nil
+	case op == "reject" && len(args) == 1:
+		req, err := es.DecideErasure(args[0], storage.ErasureRejected, storage.SystemClock.Now())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.WithFields(log.Fields{
+			"id": req.ID,
+		}).Info("erasure request rejected")
+		return nil
+	}
+	usage()
+	return errors.Errorf("invalid %q arguments", op)
+}
@@ -24,6 +24,10 @@ var (
 	configFile = flag.String("config", "", "config file")
 	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
 	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+
+	deferIndexes = flag.Bool("defer-indexes", false,
+		"drop secondary indexes while loading and recreate them afterwards; "+
+			"only use while the keyserver is not serving queries")
 )
 
 func main() {
@@ -97,7 +101,12 @@ func load(settings *server.Settings, args []string) error {
 	}
 	defer stats.WriteFile(statsFilename)
 
+	batch := sks.NewBatchInserter(ptree, sks.DefaultBatchSize)
+	localKeys := sks.NewLocalKeys(settings.OpenPGP.LocalOnly)
 	st.Subscribe(func(kc storage.KeyChange) error {
+		if localKeys.Excludes(kc) {
+			return nil
+		}
 		stats.Update(kc)
 		ka, ok := kc.(storage.KeyAdded)
 		if ok {
@@ -106,11 +115,33 @@ func load(settings *server.Settings, args []string) error {
 			if err != nil {
 				return errors.Wrapf(err, "bad digest %q", ka.Digest)
 			}
-			return ptree.Insert(&digestZp)
+			return batch.Insert(&digestZp)
 		}
 		return nil
 	})
 
+	if *deferIndexes {
+		bl, ok := st.(storage.BulkLoader)
+		if !ok {
+			return errors.Errorf("storage driver %q does not support deferred indexes", settings.OpenPGP.DB.Driver)
+		}
+		log.Infof("dropping indexes for bulk load")
+		err = bl.DeferIndexes()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			log.Infof("restoring indexes")
+			t := time.Now()
+			err := bl.RestoreIndexes()
+			if err != nil {
+				log.Errorf("failed to restore indexes, they will be recreated on next start: %v", err)
+				return
+			}
+			log.Infof("restored indexes in %v", time.Since(t))
+		}()
+	}
+
 	keyReaderOptions := server.KeyReaderOptions(settings)
 
 	for _, arg := range args {
@@ -133,15 +164,25 @@ func load(settings *server.Settings, args []string) error {
 			}
 			log.Infof("found %d keys in %q...", len(keys), file)
 			t := time.Now()
+			for _, key := range keys {
+				openpgp.SetProvenance(key, storage.ProvenanceImport, t)
+			}
 			u, n, err := st.Insert(keys)
+			var rejected int
 			if err != nil {
 				log.Errorf("some keys failed to insert from %q: %v", file, err)
 				if hke, ok := err.(storage.InsertError); ok {
 					for _, err := range hke.Errors {
 						log.Errorf("insert error: %v", err)
 					}
+					rejected = len(hke.Errors)
 				}
 			}
+			err = batch.Flush()
+			if err != nil {
+				return errors.Wrapf(err, "failed to update prefix tree from %q", file)
+			}
+			stats.AddSource(sks.SourceAdmin, sks.SourceStat{Accepted: n, Merged: u, Rejected: rejected})
 			if n > 0 || u > 0 {
 				log.Infof("inserted %d, updated %d keys from %q in %v", n, u, file, time.Since(t))
 			}
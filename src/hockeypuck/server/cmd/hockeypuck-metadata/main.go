@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+)
+
+func usage() {
+	log.Errorf("usage: %s [flags] get <fingerprint>", os.Args[0])
+	log.Errorf("       %s [flags] set <fingerprint> <namespace/name> <value>", os.Args[0])
+	log.Errorf("       %s [flags] delete <fingerprint> <namespace/name>", os.Args[0])
+}
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		cmd.Die(errors.New("missing arguments"))
+	}
+
+	err = metadata(settings, args[0], args[1:])
+	cmd.Die(err)
+}
+
+func metadata(settings *server.Settings, op string, args []string) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	ms, ok := st.(storage.MetadataStore)
+	if !ok {
+		return errors.Errorf("storage driver %q does not support key metadata", settings.OpenPGP.DB.Driver)
+	}
+	rfp := openpgp.Reverse(strings.ToLower(strings.TrimPrefix(args[0], "0x")))
+
+	switch {
+	case op == "get" && len(args) == 1:
+		all, err := ms.Metadata([]string{rfp})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var names []string
+		for name := range all[rfp] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s=%s\n", name, all[rfp][name])
+		}
+		return nil
+	case op == "set" && len(args) == 3:
+		if args[2] == "" {
+			return errors.New("empty value, use delete to remove metadata")
+		}
+		return errors.WithStack(ms.SetMetadata(rfp, args[1], args[2]))
+	case op == "delete" && len(args) == 2:
+		return errors.WithStack(ms.SetMetadata(rfp, args[1], ""))
+	}
+	usage()
+	return errors.Errorf("invalid %q arguments", op)
+}
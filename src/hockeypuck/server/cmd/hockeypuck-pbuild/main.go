@@ -82,7 +82,12 @@ func pbuild(settings *server.Settings) error {
 	stats := sks.NewStats()
 
 	var n int
+	batch := sks.NewBatchInserter(ptree, sks.DefaultBatchSize)
+	localKeys := sks.NewLocalKeys(settings.OpenPGP.LocalOnly)
 	st.Subscribe(func(kc storage.KeyChange) error {
+		if localKeys.Excludes(kc) {
+			return nil
+		}
 		ka, ok := kc.(storage.KeyAdded)
 		if ok {
 			var digestZp cf.Zp
@@ -90,7 +95,7 @@ func pbuild(settings *server.Settings) error {
 			if err != nil {
 				return errors.Wrapf(err, "bad digest %q", ka.Digest)
 			}
-			err = ptree.Insert(&digestZp)
+			err = batch.Insert(&digestZp)
 			if err != nil {
 				return errors.Wrapf(err, "failed to insert digest %q", ka.Digest)
 			}
@@ -112,5 +117,8 @@ func pbuild(settings *server.Settings) error {
 		}
 	}()
 	err = st.RenotifyAll()
-	return errors.WithStack(err)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(batch.Flush())
 }
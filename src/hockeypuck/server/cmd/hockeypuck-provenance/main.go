@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+)
+
+func usage() {
+	log.Errorf("usage: %s [flags] <fingerprint>", os.Args[0])
+}
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) != 1 {
+		usage()
+		cmd.Die(errors.New("missing arguments"))
+	}
+
+	err = provenance(settings, args[0])
+	cmd.Die(err)
+}
+
+// provenance lists each packet of a stored key with when it was first seen
+// and the class of source it came from.
+func provenance(settings *server.Settings, fp string) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	rfp := openpgp.Reverse(strings.ToLower(strings.TrimPrefix(fp, "0x")))
+	keys, err := st.FetchKeys([]string{rfp})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, key := range keys {
+		if key.RFingerprint != rfp {
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PACKET\tFIRST SEEN\tSOURCE")
+		writePacket(w, "pub "+key.Fingerprint(), &key.Packet)
+		writeSigs(w, key.Signatures)
+		for _, uid := range key.UserIDs {
+			writePacket(w, fmt.Sprintf("uid %q", uid.Keywords), &uid.Packet)
+			writeSigs(w, uid.Signatures)
+		}
+		for _, uat := range key.UserAttributes {
+			writePacket(w, "uat", &uat.Packet)
+			writeSigs(w, uat.Signatures)
+		}
+		for _, subkey := range key.SubKeys {
+			writePacket(w, "sub "+subkey.Fingerprint(), &subkey.Packet)
+			writeSigs(w, subkey.Signatures)
+		}
+		for _, other := range key.Others {
+			writePacket(w, fmt.Sprintf("other tag %d", other.Tag), other)
+		}
+		return errors.WithStack(w.Flush())
+	}
+	return errors.Errorf("key %s not found", fp)
+}
+
+func writeSigs(w io.Writer, sigs []*openpgp.Signature) {
+	for _, sig := range sigs {
+		writePacket(w, fmt.Sprintf("  sig 0x%02x by %s", sig.SigType, openpgp.Reverse(sig.RIssuerKeyID)), &sig.Packet)
+	}
+}
+
+func writePacket(w io.Writer, desc string, pkt *openpgp.Packet) {
+	firstSeen, source := "unknown", "unknown"
+	if !pkt.Provenance.FirstSeen.IsZero() {
+		firstSeen = pkt.Provenance.FirstSeen.UTC().Format(time.RFC3339)
+	}
+	if pkt.Provenance.Source != "" {
+		source = pkt.Provenance.Source
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\n", desc, firstSeen, source)
+}
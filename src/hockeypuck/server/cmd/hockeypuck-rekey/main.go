@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	batchSize  = flag.Int("batch", 1000, "number of keys re-encrypted in each transaction")
+)
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	err = rekey(settings)
+	cmd.Die(err)
+}
+
+// rekey encrypts all stored keys with the current encryption key, so that
+// keys rotated out may be removed from the configuration once it completes.
+// Keys stored before encryption was enabled are encrypted too.
+func rekey(settings *server.Settings) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	r, ok := st.(storage.Reencrypter)
+	if !ok {
+		return errors.Errorf("storage driver %q does not support encryption", settings.OpenPGP.DB.Driver)
+	}
+	var total int
+	for {
+		n, err := r.Reencrypt(*batchSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		log.Infof("re-encrypted %d keys", total)
+	}
+	log.Infof("all keys are encrypted with the current key")
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	cf "hockeypuck/conflux"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+)
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		log.Errorf("usage: %s [flags] <fingerprint1> [fingerprint2 .. fingerprintN]", os.Args[0])
+		cmd.Die(errors.New("missing fingerprint arguments"))
+	}
+
+	err = remerge(settings, args)
+	cmd.Die(err)
+}
+
+func remerge(settings *server.Settings, fps []string) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	ptree, err := sks.NewPrefixTree(settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer ptree.Close()
+
+	localKeys := sks.NewLocalKeys(settings.OpenPGP.LocalOnly)
+	st.Subscribe(func(kc storage.KeyChange) error {
+		if localKeys.Excludes(kc) {
+			return nil
+		}
+		for _, digest := range kc.RemoveDigests() {
+			var digestZp cf.Zp
+			err := sks.DigestZp(digest, &digestZp)
+			if err != nil {
+				return errors.Wrapf(err, "bad digest %q", digest)
+			}
+			err = ptree.Remove(&digestZp)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		for _, digest := range kc.InsertDigests() {
+			var digestZp cf.Zp
+			err := sks.DigestZp(digest, &digestZp)
+			if err != nil {
+				return errors.Wrapf(err, "bad digest %q", digest)
+			}
+			err = ptree.Insert(&digestZp)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+
+	userAgent := fmt.Sprintf("%s/%s", settings.Software, settings.Version)
+	remerger := sks.NewRemerger(st, &settings.Conflux.Recon.Settings, server.KeyReaderOptions(settings), userAgent)
+	var failed int
+	for _, fp := range fps {
+		change, err := remerger.Remerge(fp)
+		if err != nil {
+			log.Errorf("failed to remerge %q: %v", fp, err)
+			failed++
+			continue
+		}
+		log.Infof("remerged %q: %v", fp, change)
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to remerge %d of %d keys", failed, len(fps))
+	}
+	return nil
+}
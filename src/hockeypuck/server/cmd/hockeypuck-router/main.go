@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/router"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+)
+
+func main() {
+	flag.Parse()
+
+	if len(flag.Args()) != 0 {
+		flag.Usage()
+		cmd.Die(errors.New("unexpected command line arguments"))
+	}
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	err = serve(settings)
+	cmd.Die(err)
+}
+
+func serve(settings *server.Settings) error {
+	level, err := log.ParseLevel(strings.ToLower(settings.LogLevel))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.SetLevel(level)
+
+	rt, err := router.New(settings.Router.Shards,
+		router.Replicas(settings.Router.Replicas),
+		router.HTTPClient(&http.Client{
+			Timeout: time.Duration(settings.Router.TimeoutSecs) * time.Second,
+		}),
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	r := httprouter.New()
+	rt.Register(r)
+	log.Infof("routing to %d shards on %s", len(settings.Router.Shards), settings.HKP.Bind)
+	return errors.WithStack(http.ListenAndServe(settings.HKP.Bind, r))
+}
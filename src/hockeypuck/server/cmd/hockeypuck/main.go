@@ -9,6 +9,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	log "hockeypuck/logrus"
 	"hockeypuck/server"
 	"hockeypuck/server/cmd"
 )
@@ -27,19 +28,9 @@ func main() {
 		cmd.Die(errors.New("unexpected command line arguments"))
 	}
 
-	var (
-		settings *server.Settings
-		err      error
-	)
-	if configFile != nil {
-		conf, err := ioutil.ReadFile(*configFile)
-		if err != nil {
-			cmd.Die(errors.WithStack(err))
-		}
-		settings, err = server.ParseSettings(string(conf))
-		if err != nil {
-			cmd.Die(errors.WithStack(err))
-		}
+	settings, err := readSettings()
+	if err != nil {
+		cmd.Die(err)
 	}
 
 	cpuFile := cmd.StartCPUProf(*cpuProf, nil)
@@ -52,7 +43,7 @@ func main() {
 	srv.Start()
 
 	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for {
 			select {
@@ -60,6 +51,14 @@ func main() {
 				switch sig {
 				case syscall.SIGINT, syscall.SIGTERM:
 					srv.Stop()
+				case syscall.SIGHUP:
+					settings, err := readSettings()
+					if err == nil {
+						err = srv.Reload(settings)
+					}
+					if err != nil {
+						log.Errorf("failed to reload configuration: %v", err)
+					}
 				case syscall.SIGUSR1:
 					srv.LogRotate()
 				case syscall.SIGUSR2:
@@ -73,3 +72,15 @@ func main() {
 	err = srv.Wait()
 	cmd.Die(err)
 }
+
+func readSettings() (*server.Settings, error) {
+	conf, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	settings, err := server.ParseSettings(string(conf))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	log "hockeypuck/logrus"
+)
+
+// Content encodings offered, in order of preference when a client accepts
+// more than one equally.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+var compressEncodings = []string{encodingZstd, encodingGzip}
+
+// compressedTypes are the media types of responses which are compressed:
+// armored keys, index pages and JSON documents. Binary keys compress poorly
+// and are sent as they are.
+var compressedTypes = []string{
+	"text/",
+	"application/json",
+	"application/pgp-keys",
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+var zstdWriters = sync.Pool{New: func() interface{} {
+	zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		// Only returned for invalid options.
+		panic(err)
+	}
+	return zw
+}}
+
+// compressor compresses responses for clients which accept it.
+type compressor struct {
+	minLength int
+}
+
+func newCompressor(conf *compressionConfig) *compressor {
+	return &compressor{minLength: conf.MinLength}
+}
+
+func (c *compressor) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		if encoding == "" || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minLength: c.minLength}
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				log.Debugf("failed to complete compressed response: %v", err)
+			}
+		}()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// negotiateEncoding returns the preferred content encoding among those
+// accepted by an Accept-Encoding header, or the empty string if none are.
+func negotiateEncoding(accept string) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		for _, encoding := range compressEncodings {
+			if name != encoding || q <= 0 {
+				continue
+			}
+			if q > bestQ || (q == bestQ && preference(encoding) < preference(best)) {
+				best, bestQ = encoding, q
+			}
+		}
+	}
+	return best
+}
+
+func preference(encoding string) int {
+	for i, e := range compressEncodings {
+		if e == encoding {
+			return i
+		}
+	}
+	return len(compressEncodings)
+}
+
+// compressWriter buffers the start of a response until it is known whether
+// it is worth compressing, then either compresses the rest or passes it
+// through.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding  string
+	minLength int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.buf.Write(b)
+		if cw.buf.Len() < cw.minLength {
+			return len(b), nil
+		}
+		err := cw.decide()
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// compressible returns whether the response may be compressed.
+func (cw *compressWriter) compressible() bool {
+	if cw.status < 200 || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide starts the response, compressed if it is compressible and at
+// least minLength bytes have been buffered, and writes the buffer.
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	h := cw.Header()
+	if cw.compressible() {
+		h.Add("Vary", "Accept-Encoding")
+		if cw.buf.Len() >= cw.minLength {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			// The compressed representation differs from the one the
+			// entity tag was computed for.
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			cw.enc = cw.newEncoder()
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+func (cw *compressWriter) newEncoder() io.WriteCloser {
+	switch cw.encoding {
+	case encodingZstd:
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(cw.ResponseWriter)
+		return zw
+	default:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		return gw
+	}
+}
+
+// Flush sends what has been written so far, compressing the response if it
+// is compressible whatever its length, as a streamed response is likely to
+// be long.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		minLength := cw.minLength
+		cw.minLength = 0
+		err := cw.decide()
+		cw.minLength = minLength
+		if err != nil {
+			return
+		}
+	}
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *zstd.Encoder:
+		enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close completes the response, and returns its encoder to the pool.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			// Nothing was written.
+			return nil
+		}
+		err := cw.decide()
+		if err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *zstd.Encoder:
+		zstdWriters.Put(enc)
+	}
+	cw.enc = nil
+	return err
+}
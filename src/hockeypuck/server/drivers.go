@@ -0,0 +1,10 @@
+package server
+
+// Storage drivers distributed with Hockeypuck, which register themselves when
+// imported. Drivers maintained elsewhere are compiled in by importing them
+// here, or from a main package.
+import (
+	_ "hockeypuck/dumphkp"
+	_ "hockeypuck/leveldbhkp"
+	_ "hockeypuck/pghkp"
+)
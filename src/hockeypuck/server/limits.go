@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp"
+	log "hockeypuck/logrus"
+)
+
+// newSoftLimits returns the configured soft limits on submitted keys.
+func newSoftLimits(settings *Settings) (*hkp.SoftLimits, error) {
+	conf := &settings.OpenPGP.SoftLimits
+	limits := &hkp.SoftLimits{
+		Mode:          conf.Mode,
+		MaxKeyLength:  conf.MaxKeyLength,
+		MaxSignatures: conf.MaxSignatures,
+	}
+	if conf.EnforceAfter != "" {
+		t, err := time.Parse("2006-01-02", conf.EnforceAfter)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, conf.EnforceAfter)
+		}
+		if err != nil {
+			return nil, errors.Errorf("invalid softLimits.enforceAfter %q", conf.EnforceAfter)
+		}
+		limits.EnforceAfter = t
+	}
+	if conf.From != "" {
+		addr := conf.SMTP.Host
+		if addr == "" {
+			addr = DefaultSMTPHost
+		}
+		var auth smtp.Auth
+		if conf.SMTP.User != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			auth = smtp.PlainAuth(conf.SMTP.ID, conf.SMTP.User, conf.SMTP.Password, host)
+		}
+		limits.Notifier = &hkp.EmailOwnerNotifier{
+			Addr:     addr,
+			Auth:     auth,
+			From:     conf.From,
+			Hostname: settings.Hostname,
+		}
+	} else if conf.Mode == hkp.LimitsWarn {
+		log.Warningf("softLimits.from is not set, key owners will not be notified of limit violations")
+	}
+	return limits, nil
+}
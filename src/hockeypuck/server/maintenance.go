@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+const defaultMaintenanceTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>{{ .Message }}</p>
+<p>Please try again in {{ .RetryAfter }} seconds.</p>
+</body>
+</html>
+`
+
+// maintenance answers public HTTP requests with 503 Service Unavailable while
+// enabled. It can be toggled at runtime through the admin API; internal
+// operations such as reconciliation and dumps are unaffected, as are the
+// requests of peers which requestPriority treats as critical.
+type maintenance struct {
+	mu      sync.RWMutex
+	enabled bool
+
+	message    string
+	retryAfter int
+	t          *template.Template
+}
+
+type maintenancePage struct {
+	Message    string
+	RetryAfter int
+}
+
+func newMaintenance(conf *maintenanceConfig) (*maintenance, error) {
+	m := &maintenance{
+		enabled:    conf.Enabled,
+		message:    conf.Message,
+		retryAfter: conf.RetryAfterSecs,
+	}
+	var err error
+	if conf.Template != "" {
+		m.t, err = template.New(filepath.Base(conf.Template)).ParseFiles(conf.Template)
+	} else {
+		m.t, err = template.New("maintenance").Parse(defaultMaintenanceTemplate)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return m, nil
+}
+
+func (m *maintenance) set(enabled bool) {
+	m.mu.Lock()
+	m.enabled = enabled
+	m.mu.Unlock()
+	if enabled {
+		log.Info("entering maintenance mode")
+	} else {
+		log.Info("leaving maintenance mode")
+	}
+}
+
+func (m *maintenance) isEnabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled
+}
+
+func (m *maintenance) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !m.isEnabled() || requestPriority(req) == priorityCritical {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var buf bytes.Buffer
+		err := m.t.Execute(&buf, &maintenancePage{Message: m.message, RetryAfter: m.retryAfter})
+		if err != nil {
+			log.Errorf("failed to render maintenance page: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(buf.Bytes())
+	})
+}
+
+// SetMaintenance enables or disables maintenance mode. While enabled, public
+// HTTP requests are refused with 503 Service Unavailable.
+func (s *Server) SetMaintenance(enabled bool) {
+	s.maintenance.set(enabled)
+}
+
+// Maintenance reports whether the server is in maintenance mode.
+func (s *Server) Maintenance() bool {
+	return s.maintenance.isEnabled()
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
 )
 
 var serverMetrics = struct {
@@ -15,6 +17,9 @@ var serverMetrics = struct {
 	keysAdded           prometheus.Counter
 	keysIgnored         prometheus.Counter
 	keysUpdated         prometheus.Counter
+	requestsShed        *prometheus.CounterVec
+	requestsRateLimited *prometheus.CounterVec
+	rateLimitErrors     prometheus.Counter
 }{
 	httpRequestDuration: prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -45,6 +50,29 @@ var serverMetrics = struct {
 			Help:      "Keys updated since startup",
 		},
 	),
+	requestsShed: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "http_requests_shed",
+			Help:      "Requests refused under load since startup",
+		},
+		[]string{"priority"},
+	),
+	requestsRateLimited: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "http_requests_rate_limited",
+			Help:      "Requests refused for exceeding a rate limit since startup",
+		},
+		[]string{"route"},
+	),
+	rateLimitErrors: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "rate_limit_store_errors",
+			Help:      "Requests allowed without a rate limit as the rate limit store failed, since startup",
+		},
+	),
 }
 
 var metricsRegister sync.Once
@@ -55,6 +83,9 @@ func registerMetrics() {
 		prometheus.MustRegister(serverMetrics.keysAdded)
 		prometheus.MustRegister(serverMetrics.keysIgnored)
 		prometheus.MustRegister(serverMetrics.keysUpdated)
+		prometheus.MustRegister(serverMetrics.requestsShed)
+		prometheus.MustRegister(serverMetrics.requestsRateLimited)
+		prometheus.MustRegister(serverMetrics.rateLimitErrors)
 	})
 }
 
@@ -73,3 +104,76 @@ func metricsStorageNotifier(kc storage.KeyChange) error {
 func recordHTTPRequestDuration(method string, statusCode int, duration time.Duration) {
 	serverMetrics.httpRequestDuration.WithLabelValues(method, strconv.Itoa(statusCode)).Observe(duration.Seconds())
 }
+
+func recordRequestShed(priority string) {
+	serverMetrics.requestsShed.WithLabelValues(priority).Inc()
+}
+
+func recordRequestRateLimited(route string) {
+	serverMetrics.requestsRateLimited.WithLabelValues(route).Inc()
+}
+
+func recordRateLimitStoreError() {
+	serverMetrics.rateLimitErrors.Inc()
+}
+
+// domainVerifiedKeys is the number of keys with an address verified in each
+// watched domain, updated by Server.countWatchedDomains.
+var domainVerifiedKeys = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "hockeypuck",
+		Name:      "domain_verified_keys",
+		Help:      "Keys with an address verified in a watched domain",
+	},
+	[]string{"domain"},
+)
+
+func registerDomainMetrics() {
+	err := prometheus.Register(domainVerifiedKeys)
+	if err != nil {
+		log.Warningf("failed to register metric: %v", err)
+	}
+}
+
+// registerSigVerifierMetrics reports how often signature verifications are
+// answered from the cache of v.
+func registerFingerprintFilterMetrics(f *storage.FingerprintFilter) {
+	c := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "fingerprint_filter_skipped_lookups",
+			Help:      "Lookups by fingerprint answered as not found without querying storage",
+		},
+		func() float64 { return float64(f.Skipped()) },
+	)
+	err := prometheus.Register(c)
+	if err != nil {
+		log.Warningf("failed to register metric: %v", err)
+	}
+}
+
+func registerSigVerifierMetrics(v *openpgp.SigVerifier) {
+	for _, c := range []prometheus.Collector{
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: "hockeypuck",
+				Name:      "sig_verification_cache_hits",
+				Help:      "Signature verifications answered from the cache since startup",
+			},
+			func() float64 { return float64(v.Stats().Hits) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: "hockeypuck",
+				Name:      "sig_verification_cache_misses",
+				Help:      "Signatures verified since startup",
+			},
+			func() float64 { return float64(v.Stats().Misses) },
+		),
+	} {
+		err := prometheus.Register(c)
+		if err != nil {
+			log.Warningf("failed to register metric: %v", err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/conflux/recon"
+	log "hockeypuck/logrus"
+)
+
+// Routes with separate rate limit budgets.
+const (
+	rateRouteGet       = "get"
+	rateRouteIndex     = "index"
+	rateRouteAdd       = "add"
+	rateRouteHashQuery = "hashquery"
+	rateRouteDefault   = "default"
+)
+
+const (
+	rateExpireInterval = time.Minute
+	// ipv6PrefixLen is the length of the prefix by which IPv6 clients are
+	// limited, as a client is usually given a whole /64.
+	ipv6PrefixLen = 64
+)
+
+// ratePolicy is the configuration of a rateLimiter, replaced as a whole
+// when the configuration is reloaded.
+type ratePolicy struct {
+	conf    rateLimitConfig
+	allow   recon.IPMatcher
+	proxies []*net.IPNet
+}
+
+// newRatePolicy returns the rate limit policy configured, which exempts the
+// recon partners and networks allowed to reconcile in rs.
+func newRatePolicy(conf *rateLimitConfig, rs *recon.Settings) (*ratePolicy, error) {
+	allowed := *rs
+	allowed.AllowCIDRs = append(allowed.AllowCIDRs[:len(allowed.AllowCIDRs):len(allowed.AllowCIDRs)], conf.AllowCIDRs...)
+	allow, err := allowed.Matcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rate limit allowlist")
+	}
+	p := &ratePolicy{conf: *conf, allow: allow}
+	for _, cidr := range conf.TrustedProxies {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", cidr)
+		}
+		p.proxies = append(p.proxies, ipnet)
+	}
+	return p, nil
+}
+
+func (p *ratePolicy) budget(route string) rateBudget {
+	if !p.conf.Enabled {
+		return rateBudget{}
+	}
+	switch route {
+	case rateRouteGet:
+		return p.conf.Get
+	case rateRouteIndex:
+		return p.conf.Index
+	case rateRouteAdd:
+		return p.conf.Add
+	case rateRouteHashQuery:
+		return p.conf.HashQuery
+	}
+	return p.conf.Default
+}
+
+func (p *ratePolicy) trustedProxy(ip net.IP) bool {
+	for _, ipnet := range p.proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making a request, which is
+// given by the X-Forwarded-For header of requests from trusted proxies.
+func (p *ratePolicy) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !p.trustedProxy(ip) {
+		return ip
+	}
+	// Each proxy appends the address it received the request from, so the
+	// client is the last address not belonging to a trusted proxy.
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !p.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientIP returns the address of the client making a request, through the
+// trusted proxies of the current rate limit policy, or of the policy
+// configured at startup if requests are not limited.
+func (s *Server) clientIP(req *http.Request) net.IP {
+	if s.rateLimiter != nil {
+		return s.rateLimiter.currentPolicy().clientIP(req)
+	}
+	return s.clientPolicy.clientIP(req)
+}
+
+// clientKey returns the key by which a client's requests are counted.
+func clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6PrefixLen, 8*net.IPv6len)).String()
+}
+
+// size returns the number of tokens a bucket holds when full.
+func (b rateBudget) size() float64 {
+	return math.Max(1, float64(b.Burst))
+}
+
+// rateBucket is the token bucket of a client's requests to a route.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have been refilled.
+	full time.Time
+}
+
+// take takes a token from the bucket if one is available under budget b,
+// and otherwise returns how long it will be until one is.
+func (rb *rateBucket) take(b rateBudget, now time.Time) (bool, time.Duration) {
+	rb.tokens = math.Min(b.size(), rb.tokens+now.Sub(rb.last).Seconds()*b.Rate)
+	rb.last = now
+	ok := rb.tokens >= 1
+	if ok {
+		rb.tokens--
+	}
+	rb.full = now.Add(time.Duration((b.size() - rb.tokens) / b.Rate * float64(time.Second)))
+	if ok {
+		return true, 0
+	}
+	return false, time.Duration((1 - rb.tokens) / b.Rate * float64(time.Second))
+}
+
+// rateStore holds the token buckets of clients.
+type rateStore interface {
+	// take takes a token from the bucket with the given key under budget
+	// b, and otherwise returns how long it will be until one is.
+	take(key string, b rateBudget, now time.Time) (bool, time.Duration, error)
+	// expire forgets the buckets which have been refilled, as they are the
+	// same as new ones.
+	expire(now time.Time)
+	close() error
+}
+
+// memoryRateStore holds token buckets in memory, limiting clients of this
+// server only.
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{buckets: map[string]*rateBucket{}}
+}
+
+func (ms *memoryRateStore) take(key string, b rateBudget, now time.Time) (bool, time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rb, ok := ms.buckets[key]
+	if !ok {
+		rb = &rateBucket{tokens: b.size(), last: now}
+		ms.buckets[key] = rb
+	}
+	ok, wait := rb.take(b, now)
+	return ok, wait, nil
+}
+
+func (ms *memoryRateStore) expire(now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for k, rb := range ms.buckets {
+		if !now.Before(rb.full) {
+			delete(ms.buckets, k)
+		}
+	}
+}
+
+func (ms *memoryRateStore) close() error {
+	return nil
+}
+
+// redisRateScript takes a token from the bucket in a hash at KEYS[1], given
+// the rate and size of the bucket, returning whether one was taken and how
+// many seconds it will be until one is. The time of the Redis server is used,
+// so that the clocks of the servers sharing it do not matter. The hash
+// expires when the bucket has been refilled.
+var redisRateScript = newRedisScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local size = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or size
+local last = tonumber(b[2]) or now
+tokens = math.min(size, tokens + math.max(0, now - last) * rate)
+local taken = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((size - tokens) / rate * 1000) + 1000)
+return {taken, tostring(wait)}
+`)
+
+// redisRateStore holds token buckets in Redis, so that servers sharing it
+// limit clients together.
+type redisRateStore struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisRateStore(conf *rateLimitRedisConfig) *redisRateStore {
+	timeout := time.Duration(conf.TimeoutMillis) * time.Millisecond
+	return &redisRateStore{
+		client: newRedisClient(conf.Address, conf.Password, conf.DB, timeout),
+		prefix: conf.KeyPrefix,
+	}
+}
+
+func (rs *redisRateStore) take(key string, b rateBudget, now time.Time) (bool, time.Duration, error) {
+	reply, err := redisRateScript.run(rs.client, []string{rs.prefix + key},
+		strconv.FormatFloat(b.Rate, 'g', -1, 64), strconv.FormatFloat(b.size(), 'g', -1, 64))
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, errors.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	taken, _ := values[0].(int64)
+	waitStr, _ := values[1].(string)
+	wait, err := strconv.ParseFloat(waitStr, 64)
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "unexpected rate limit script reply %v", reply)
+	}
+	return taken == 1, time.Duration(wait * float64(time.Second)), nil
+}
+
+func (rs *redisRateStore) expire(now time.Time) {
+	// Buckets expire in Redis.
+}
+
+func (rs *redisRateStore) close() error {
+	return rs.client.close()
+}
+
+// rateLimiter refuses requests from clients which exceed the budget of
+// requests to a route, with 429 Too Many Requests.
+type rateLimiter struct {
+	mu     sync.Mutex
+	policy *ratePolicy
+	store  rateStore
+}
+
+// newRateLimiter returns a rate limiter holding its buckets in the Redis
+// server configured by policy, or in memory if there is none.
+func newRateLimiter(policy *ratePolicy) *rateLimiter {
+	rl := &rateLimiter{policy: policy}
+	if policy.conf.Redis.Address != "" {
+		rl.store = newRedisRateStore(&policy.conf.Redis)
+	} else {
+		rl.store = newMemoryRateStore()
+	}
+	return rl
+}
+
+// setPolicy changes the budgets, such as when the configuration is
+// reloaded. Clients keep the tokens they have, up to the new burst sizes.
+// The store is not changed.
+func (rl *rateLimiter) setPolicy(policy *ratePolicy) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if policy.conf.Redis != rl.policy.conf.Redis {
+		log.Warning("rate limit store is changed when the server is restarted")
+	}
+	rl.policy = policy
+}
+
+func (rl *rateLimiter) currentPolicy() *ratePolicy {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.policy
+}
+
+// run forgets idle clients until dying is closed.
+func (rl *rateLimiter) run(dying <-chan struct{}) error {
+	defer rl.store.close()
+	ticker := time.NewTicker(rateExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dying:
+			return nil
+		case now := <-ticker.C:
+			rl.store.expire(now)
+		}
+	}
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		policy := rl.currentPolicy()
+		route := requestRateRoute(req)
+		b := policy.budget(route)
+		ip := policy.clientIP(req)
+		if b.Rate <= 0 || ip == nil || policy.allow.Match(ip) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ok, wait, err := rl.store.take(route+":"+clientKey(ip), b, time.Now())
+		if err != nil {
+			// Requests are not refused for want of the store.
+			recordRateLimitStoreError()
+			log.Debugf("failed to take rate limit token: %v", err)
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !ok {
+			recordRequestRateLimited(route)
+			log.Debugf("rate limited %s request from %s", route, ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requestRateRoute classifies a request by the rate limit budget it is
+// counted against.
+func requestRateRoute(req *http.Request) string {
+	switch path := req.URL.Path; {
+	case path == "/pks/hashquery":
+		return rateRouteHashQuery
+	case path == "/pks/add" || path == "/vks/v1/upload":
+		return rateRouteAdd
+	case strings.HasPrefix(path, "/key/"),
+		strings.HasPrefix(path, "/vks/v1/by-fingerprint/"),
+		strings.HasPrefix(path, "/vks/v1/by-keyid/"),
+		strings.HasPrefix(path, "/vks/v1/by-email/"):
+		return rateRouteGet
+	case strings.HasPrefix(path, "/email/"):
+		return rateRouteIndex
+	case path == "/pks/lookup":
+		switch req.URL.Query().Get("op") {
+		case "get", "hget":
+			return rateRouteGet
+		case "index", "vindex":
+			return rateRouteIndex
+		}
+	}
+	return rateRouteDefault
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redisMaxIdle is the number of idle connections kept for reuse.
+const redisMaxIdle = 16
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient is a minimal Redis client, sufficient to run the scripts of
+// the shared rate limit store. Connections are reused, and discarded after
+// any error.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(addr, password string, db int, timeout time.Duration) *redisClient {
+	return &redisClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		_, err = rc.do(c.timeout, "AUTH", c.password)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to authenticate to redis")
+		}
+	}
+	if c.db != 0 {
+		_, err = rc.do(c.timeout, "SELECT", strconv.Itoa(c.db))
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "failed to select redis database %d", c.db)
+		}
+	}
+	return rc, nil
+}
+
+// do sends a command and returns its reply, which is a string, an int64, a
+// []interface{} of replies, or nil. Error replies are returned as a
+// redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		rc, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.do(c.timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// close closes the idle connections.
+func (c *redisClient) close() error {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	err := rc.conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err = io.WriteString(rc.conn, sb.String())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) readLine() (string, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", errors.Errorf("malformed redis reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		return n, errors.WithStack(err)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(rc.r, buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			reply, err := rc.readReply()
+			if rerr, ok := err.(redisError); ok {
+				// Errors within an array are replies like any other.
+				reply = rerr
+			} else if err != nil {
+				return nil, err
+			}
+			replies[i] = reply
+		}
+		return replies, nil
+	}
+	return nil, errors.Errorf("unexpected redis reply %q", line)
+}
+
+// redisScript is a Lua script run by its digest, which is loaded when Redis
+// does not have it yet.
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) *redisScript {
+	sum := sha1.Sum([]byte(src))
+	return &redisScript{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+func (s *redisScript) run(c *redisClient, keys []string, args ...string) (interface{}, error) {
+	cmd := append([]string{"EVALSHA", s.sha, strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, args...)
+	reply, err := c.do(cmd...)
+	if rerr, ok := err.(redisError); ok && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", s.src
+		reply, err = c.do(cmd...)
+	}
+	return reply, err
+}
@@ -1,28 +1,41 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/carbocation/interpose"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
 	"gopkg.in/tomb.v2"
 
 	"hockeypuck/hkp"
+	"hockeypuck/hkp/admin"
+	"hockeypuck/hkp/alert"
+	"hockeypuck/hkp/analytics"
+	"hockeypuck/hkp/blocklist"
+	"hockeypuck/hkp/ldap"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
 	"hockeypuck/metrics"
 	"hockeypuck/openpgp"
-	"hockeypuck/pghkp"
+	"hockeypuck/opensearch"
+	"hockeypuck/tracing"
 )
 
 type Server struct {
@@ -33,20 +46,45 @@ type Server struct {
 	sksPeer         *sks.Peer
 	logWriter       io.WriteCloser
 	metricsListener *metrics.Metrics
+	spanExporter    *tracing.OTLPExporter
+	analytics       *analytics.Analytics
+	attestor        *hkp.Attestor
+	maintenance     *maintenance
+	shedder         *loadShedder
+	rateLimiter     *rateLimiter
+	clientPolicy    *ratePolicy
+	accessLog       *accessLogSampler
+	accessTracker   *storage.AccessTracker
+	hotList         *storage.HotList
+	fpFilter        *storage.FingerprintFilter
+	indexWorkers    *storage.IndexWorkers
+	tokens          *storage.Tokens
+	searchFeeder    *storage.SearchFeeder
+	alerts          *alert.Alerter
+	blocklist       *blocklist.Updater
+	pusher          *hkp.Pusher
+	suppressions    *openpgp.Suppressions
+	admin           *admin.Handler
 
 	t                 tomb.Tomb
 	hkpAddr, hkpsAddr string
+
+	// httpServers are drained on shutdown.
+	mu          sync.Mutex
+	httpServers []*http.Server
+	stopOnce    sync.Once
 }
 
 type statusCodeResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	size       int
 }
 
 func NewStatusCodeResponseWriter(w http.ResponseWriter) *statusCodeResponseWriter {
 	// WriteHeader is not called if our response implicitly
 	// returns 200 OK, so we default to that status code.
-	return &statusCodeResponseWriter{w, http.StatusOK}
+	return &statusCodeResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 func (scrw *statusCodeResponseWriter) WriteHeader(code int) {
@@ -54,6 +92,12 @@ func (scrw *statusCodeResponseWriter) WriteHeader(code int) {
 	scrw.ResponseWriter.WriteHeader(code)
 }
 
+func (scrw *statusCodeResponseWriter) Write(b []byte) (int, error) {
+	n, err := scrw.ResponseWriter.Write(b)
+	scrw.size += n
+	return n, err
+}
+
 func KeyWriterOptions(settings *Settings) []openpgp.KeyWriterOption {
 	var opts []openpgp.KeyWriterOption
 	if settings.OpenPGP.Headers.Comment != "" {
@@ -77,12 +121,76 @@ func KeyReaderOptions(settings *Settings) []openpgp.KeyReaderOption {
 	if settings.OpenPGP.MaxPacketLength > 0 {
 		opts = append(opts, openpgp.MaxPacketLen(settings.OpenPGP.MaxPacketLength))
 	}
+	if settings.OpenPGP.MaxArmoredLength > 0 {
+		opts = append(opts, openpgp.MaxArmorLen(settings.OpenPGP.MaxArmoredLength))
+	}
+	if settings.OpenPGP.MaxPackets > 0 {
+		opts = append(opts, openpgp.MaxPackets(settings.OpenPGP.MaxPackets))
+	}
+	if settings.OpenPGP.MaxUserIDSignatures > 0 {
+		opts = append(opts, openpgp.MaxUserIDSignatures(settings.OpenPGP.MaxUserIDSignatures))
+	}
+	if mode := settings.OpenPGP.VerifySelfSignatures; mode != "" {
+		// The mode is validated by ParseSettings.
+		selfSigMode, _ := openpgp.ParseSelfSigMode(mode)
+		opts = append(opts, openpgp.VerifySelfSigs(selfSigMode))
+	}
+	if policy := settings.OpenPGP.UnknownCriticalSubpackets; policy != "" {
+		// The policy is validated by ParseSettings.
+		criticalPolicy, _ := openpgp.ParseCriticalSubpacketPolicy(policy)
+		opts = append(opts, openpgp.UnknownCriticalSubpackets(criticalPolicy))
+	}
+	if settings.OpenPGP.StripThirdPartyCertifications {
+		opts = append(opts, openpgp.AttestedCertificationsOnly())
+	}
 	if len(settings.OpenPGP.Blacklist) > 0 {
 		opts = append(opts, openpgp.Blacklist(settings.OpenPGP.Blacklist))
 	}
 	return opts
 }
 
+func ServePolicy(settings *Settings) []openpgp.PolicyOption {
+	var opts []openpgp.PolicyOption
+	policy := settings.OpenPGP.ServePolicy
+	if policy.StripUserAttributes {
+		opts = append(opts, openpgp.StripUserAttributes())
+	}
+	if policy.Minimal {
+		opts = append(opts, openpgp.Minimal())
+	}
+	if policy.RedactUserIDs {
+		opts = append(opts, openpgp.RedactUserIDs())
+	}
+	if policy.MaxCertifications > 0 {
+		opts = append(opts, openpgp.MaxCertifications(policy.MaxCertifications))
+	}
+	return opts
+}
+
+func UpsertOptions(settings *Settings) []storage.UpsertOption {
+	var opts []storage.UpsertOption
+	if len(settings.OpenPGP.Pinned) > 0 {
+		opts = append(opts, storage.Pinned(settings.OpenPGP.Pinned))
+	}
+	if flooding := settings.OpenPGP.Flooding; flooding.Threshold > 0 {
+		// The action is validated by NewServer.
+		action, _ := storage.ParseFloodAction(flooding.Action)
+		opts = append(opts, storage.Flooding(storage.FloodPolicy{
+			Threshold:         flooding.Threshold,
+			Action:            action,
+			MaxCertifications: flooding.MaxCertifications,
+		}))
+	}
+	if settings.OpenPGP.HonorPreferredKeyserver {
+		if settings.Hostname != "" {
+			opts = append(opts, storage.HonorPreferredKeyserver([]string{settings.Hostname}))
+		} else {
+			log.Warningf("honorPreferredKeyserver requires hostname to be set")
+		}
+	}
+	return opts
+}
+
 func NewServer(settings *Settings) (*Server, error) {
 	if settings == nil {
 		defaults := DefaultSettings()
@@ -98,8 +206,49 @@ func NewServer(settings *Settings) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if flooding := settings.OpenPGP.Flooding; flooding.Threshold > 0 {
+		action, err := storage.ParseFloodAction(flooding.Action)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid flooding policy")
+		}
+		if _, ok := s.st.(storage.KeyStateStore); !ok && action == storage.FloodQuarantine {
+			log.Warningf("storage driver %q does not support key states, flooded keys are capped instead of quarantined", settings.OpenPGP.DB.Driver)
+		}
+	}
+
+	if conf := settings.OpenPGP.SigVerification; conf.Enabled {
+		workers := conf.Workers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		v := openpgp.NewSigVerifier(workers, conf.CacheSize)
+		openpgp.SetSigVerifier(v)
+		registerSigVerifierMetrics(v)
+	}
 
+	if conf := settings.Tracing; conf != nil {
+		if conf.Endpoint == "" {
+			return nil, errors.New("tracing endpoint not configured")
+		}
+		ratio := conf.SampleRatio
+		if ratio == 0 {
+			ratio = DefaultTracingSampleRatio
+		}
+		var options []tracing.OTLPOption
+		if conf.ServiceName != "" {
+			options = append(options, tracing.ServiceName(conf.ServiceName))
+		}
+		if len(conf.Headers) > 0 {
+			options = append(options, tracing.Headers(conf.Headers))
+		}
+		s.spanExporter = tracing.NewOTLPExporter(conf.Endpoint, options...)
+		s.spanExporter.Start()
+		tracing.SetTracer(tracing.NewTracer(s.spanExporter, tracing.SampleRatio(ratio)))
+	}
+
+	s.accessLog = newAccessLogSampler(&settings.HKP.AccessLog)
 	s.middle = interpose.New()
+	s.middle.Use(tracing.Middleware)
 	s.middle.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			start := time.Now()
@@ -107,14 +256,23 @@ func NewServer(settings *Settings) (*Server, error) {
 			scrw := NewStatusCodeResponseWriter(rw)
 			next.ServeHTTP(scrw, req)
 			duration := time.Since(start)
+			recordHTTPRequestDuration(req.Method, scrw.statusCode, duration)
+			if !s.accessLog.sample(req.URL.Path) {
+				return
+			}
 			fields := log.Fields{
 				req.Method:    req.URL.String(),
 				"duration":    duration.String(),
 				"from":        req.RemoteAddr,
 				"host":        req.Host,
+				"outcome":     outcome(scrw.statusCode),
+				"size":        scrw.size,
 				"status-code": scrw.statusCode,
 				"user-agent":  req.UserAgent(),
 			}
+			if span := tracing.FromContext(req.Context()); span != nil {
+				fields["trace"] = span.Context.TraceID.String()
+			}
 			proxyHeaders := []string{
 				"x-forwarded-for",
 				"x-forwarded-host",
@@ -126,28 +284,207 @@ func NewServer(settings *Settings) (*Server, error) {
 				}
 			}
 			log.WithFields(fields).Info()
-			recordHTTPRequestDuration(req.Method, scrw.statusCode, duration)
 		})
 	})
+	s.maintenance, err = newMaintenance(&settings.HKP.Maintenance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.middle.Use(s.maintenance.middleware)
+	s.clientPolicy, err = newRatePolicy(&settings.HKP.RateLimit, &settings.Conflux.Recon.Settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if settings.HKP.RateLimit.Enabled {
+		s.rateLimiter = newRateLimiter(s.clientPolicy)
+		s.middle.Use(s.rateLimiter.middleware)
+	}
+	if settings.HKP.LoadShedding.Enabled {
+		s.shedder = newLoadShedder(&settings.HKP.LoadShedding, s.st)
+		s.middle.Use(s.shedder.middleware)
+	}
+	if settings.HKP.Compression.Enabled {
+		s.middle.Use(newCompressor(&settings.HKP.Compression).middleware)
+	}
 	s.middle.UseHandler(s.r)
 
 	keyReaderOptions := KeyReaderOptions(settings)
+	if len(settings.OpenPGP.Blocklists.Feeds) > 0 {
+		bl := openpgp.NewBlocklist()
+		s.blocklist, err = newBlocklistUpdater(bl, s.st, settings)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keyReaderOptions = append(keyReaderOptions, openpgp.Blocklisted(bl))
+	}
+	if es, ok := s.st.(storage.ErasureStore); ok {
+		s.suppressions = openpgp.NewSuppressions()
+		err = loadSuppressions(s.suppressions, es)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keyReaderOptions = append(keyReaderOptions, openpgp.Suppressed(s.suppressions))
+	}
 	userAgent := fmt.Sprintf("%s/%s", settings.Software, settings.Version)
-	s.sksPeer, err = sks.NewPeer(s.st, settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings, keyReaderOptions, userAgent)
+	s.alerts, err = newAlerter(settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	localKeys := sks.NewLocalKeys(settings.OpenPGP.LocalOnly)
+	peerOptions := []sks.PeerOption{sks.UpsertOptions(UpsertOptions(settings)...), sks.LocalOnly(localKeys)}
+	if s.alerts != nil {
+		peerOptions = append(peerOptions, sks.Alerts(s.alerts, settings.Alerts.ReconDivergence))
+	}
+	if rs, ok := s.st.(storage.RecoveryStore); ok {
+		peerOptions = append(peerOptions, sks.RecoveryQueue(rs))
+	} else {
+		log.Warningf("storage driver %q does not support a persistent recovery queue", settings.OpenPGP.DB.Driver)
+	}
+	s.sksPeer, err = sks.NewPeer(s.st, settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings, keyReaderOptions, userAgent,
+		peerOptions...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	s.metricsListener = metrics.NewMetrics(settings.Metrics)
 
+	if settings.Admin != nil {
+		s.admin, err = admin.NewHandler(s.st,
+			admin.Tokens(settings.Admin.Tokens),
+			admin.PeerManager(s.sksPeer),
+			admin.MaintenanceSwitch(s),
+			admin.StatsFunc(s.stats))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
 	keyWriterOptions := KeyWriterOptions(settings)
 	options := []hkp.HandlerOption{
 		hkp.StatsFunc(s.stats),
 		hkp.SelfSignedOnly(settings.HKP.Queries.SelfSignedOnly),
 		hkp.FingerprintOnly(settings.HKP.Queries.FingerprintOnly),
+		hkp.ExposeMetadata(settings.HKP.Queries.ExposeMetadata),
+		hkp.AmbiguousKeyIDs(settings.HKP.Queries.AmbiguousKeyIDs),
+		hkp.ResolveSigners(settings.HKP.Queries.ResolveSigners),
+		hkp.DefaultMatch(settings.HKP.Queries.DefaultMatch),
 		hkp.KeyReaderOptions(keyReaderOptions),
 		hkp.KeyWriterOptions(keyWriterOptions),
+		hkp.ServePolicy(ServePolicy(settings)...),
+		hkp.MaxServeLength(settings.OpenPGP.MaxServeLength),
+		hkp.MaxAddLength(settings.HKP.MaxAddLength),
+		hkp.SubmissionFunc(s.sksPeer.RecordSubmission),
+		hkp.LocalOnly(localKeys),
+		hkp.ContentSecurityPolicy(settings.HKP.ContentSecurityPolicy),
+	}
+	if settings.OpenPGP.StripThirdPartyCertifications {
+		options = append(options, hkp.AttestedCertificationsOnly())
+	}
+	if settings.HKP.Analytics.Enabled {
+		s.analytics = analytics.New(settings.HKP.Analytics.K)
+		options = append(options, hkp.SearchAnalytics(s.analytics))
+	}
+	if settings.HKP.Attestation.KeyFile != "" {
+		s.attestor, err = newAttestor(settings.HKP.Attestation.KeyFile, s.attestation)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, hkp.Attestations(s.attestor))
+	}
+	if conf := settings.HKP.VerifiedAddresses; conf.Enabled {
+		vopts, err := verifiedAddressOptions(s.st, settings)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, vopts...)
+		if conf.Tokens.SecretFile != "" {
+			s.tokens, err = newTokens(s.st, settings)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if s.tokens != nil {
+				options = append(options, hkp.VerificationTokens(s.tokens))
+			}
+			if conf.Email.From != "" {
+				sender, err := newVerificationSender(settings)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				options = append(options, hkp.VerificationMail(sender))
+			}
+		}
+	}
+	if len(settings.HKP.Push.Peers) > 0 {
+		peers, err := pushPeers(settings)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, hkp.PushPeers(peers...))
+	}
+	if len(settings.HKP.Push.Targets) > 0 {
+		s.pusher, err = newPusher(s.st, settings, localKeys)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
+	if settings.OpenPGP.AccessTracking.Enabled || settings.OpenPGP.Retention.Enabled {
+		if r, ok := s.st.(storage.Retainer); ok {
+			s.accessTracker = storage.NewAccessTracker(r, settings.OpenPGP.AccessTracking.BatchSize,
+				time.Duration(settings.OpenPGP.AccessTracking.FlushSecs)*time.Second)
+			options = append(options, hkp.AccessTracking(s.accessTracker))
+		} else {
+			log.Warningf("storage driver %q does not support access tracking", settings.OpenPGP.DB.Driver)
+		}
+	}
+	if conf := settings.OpenPGP.WarmUp; conf.Enabled && conf.HotListFile != "" {
+		s.hotList = storage.NewHotList(conf.HotKeys)
+		options = append(options, hkp.HotKeys(s.hotList))
+	}
+	if conf := settings.OpenPGP.FingerprintFilter; conf.Enabled {
+		if scanner, ok := s.st.(storage.FingerprintScanner); ok {
+			s.fpFilter = storage.NewFingerprintFilter(s.st, scanner, conf.Capacity,
+				time.Duration(conf.RebuildSecs)*time.Second)
+			options = append(options, hkp.FingerprintFilter(s.fpFilter))
+			registerFingerprintFilterMetrics(s.fpFilter)
+			if !settings.OpenPGP.DB.SharedNotifications {
+				log.Warningf("fingerprint filter learns of keys added by other servers sharing the database only when rebuilt; enable sharedNotifications if the database is shared")
+			}
+		} else {
+			log.Warningf("storage driver %q does not support a fingerprint filter", settings.OpenPGP.DB.Driver)
+		}
+	}
+	if settings.OpenPGP.Indexing.Deferred {
+		if ix, ok := s.st.(storage.Indexer); ok {
+			s.indexWorkers = storage.NewIndexWorkers(ix, settings.OpenPGP.Indexing.Workers,
+				settings.OpenPGP.Indexing.BatchSize, time.Duration(settings.OpenPGP.Indexing.IntervalSecs)*time.Second)
+		} else {
+			log.Warningf("storage driver %q does not support deferred indexing", settings.OpenPGP.DB.Driver)
+		}
+	}
+	if settings.OpenPGP.Search.Provider != "" {
+		sp, err := dialSearch(&settings.OpenPGP.Search)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.searchFeeder = storage.NewSearchFeeder(s.st, sp)
+		options = append(options, hkp.SearchProvider(sp))
+	}
+	if settings.OpenPGP.SoftLimits.Mode != "" {
+		limits, err := newSoftLimits(settings)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, hkp.Limits(limits))
+	}
+	options = append(options, hkp.ClientIP(s.clientIP))
+	challenge, err := newSubmissionChallenge(settings, s.clientIP)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if challenge != nil {
+		options = append(options, hkp.SubmissionChallenge(challenge, settings.HKP.Challenge.BypassTokens))
+	}
+	options = append(options, hkp.UpsertOptions(UpsertOptions(settings)...))
 	if settings.IndexTemplate != "" {
 		options = append(options, hkp.IndexTemplate(settings.IndexTemplate))
 	}
@@ -176,12 +513,65 @@ func NewServer(settings *Settings) (*Server, error) {
 	return s, nil
 }
 
+// DialStorage opens the configured storage with one of the registered
+// storage drivers.
 func DialStorage(settings *Settings) (storage.Storage, error) {
-	switch settings.OpenPGP.DB.Driver {
-	case "postgres-jsonb":
-		return pghkp.Dial(settings.OpenPGP.DB.DSN, KeyReaderOptions(settings))
+	db := settings.OpenPGP.DB
+	encryption, err := encryptionKeys(&db.Encryption)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	st, err := storage.Dial(db.Driver, db.DSN, &storage.Config{
+		KeyReaderOptions: KeyReaderOptions(settings),
+		DeferIndexing:    settings.OpenPGP.Indexing.Deferred,
+		BulkBatchSize:    db.BulkBatchSize,
+		InsertBatchSize:  db.InsertBatchSize,
+
+		MaxConns:            db.MaxConns,
+		MaxIdleConns:        db.MaxIdleConns,
+		MaxConnLifetime:     time.Duration(db.ConnMaxLifetimeSecs) * time.Second,
+		MaxConnIdleTime:     time.Duration(db.ConnMaxIdleSecs) * time.Second,
+		StatementTimeout:    time.Duration(db.StatementTimeoutSecs) * time.Second,
+		HealthCheckPeriod:   time.Duration(db.HealthCheckSecs) * time.Second,
+		Encryption:          encryption,
+		TrigramSearch:       db.TrigramSearch,
+		SharedNotifications: db.SharedNotifications,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := st.(storage.Reencrypter); encryption != nil && !ok {
+		// Keys must not be stored unencrypted when encryption is expected.
+		st.Close()
+		return nil, errors.Errorf("storage driver %q does not support encryption", db.Driver)
+	}
+	return st, nil
+}
+
+// encryptionKeys returns the keys with which storage is encrypted, or nil if
+// it is not.
+func encryptionKeys(conf *dbEncryptionConfig) (*storage.EncryptionKeys, error) {
+	switch {
+	case conf.KeyFile != "" && len(conf.KeyCommand) > 0:
+		return nil, errors.New("encryption keys must be read from a file or a command, not both")
+	case conf.KeyFile != "":
+		return storage.LoadEncryptionKeys(conf.KeyFile)
+	case len(conf.KeyCommand) > 0:
+		return storage.FetchEncryptionKeys(conf.KeyCommand)
 	}
-	return nil, errors.Errorf("storage driver %q not supported", settings.OpenPGP.DB.Driver)
+	return nil, nil
+}
+
+func dialSearch(config *searchConfig) (storage.SearchProvider, error) {
+	switch config.Provider {
+	case "opensearch":
+		var options []opensearch.Option
+		if config.Index != "" {
+			options = append(options, opensearch.Index(config.Index))
+		}
+		return opensearch.New(config.URL, options...)
+	}
+	return nil, errors.Errorf("search provider %q not supported", config.Provider)
 }
 
 type stats struct {
@@ -195,12 +585,16 @@ type stats struct {
 	ReconAddr     string           `json:"reconAddr"`
 	Software      string           `json:"software"`
 	Peers         []statsPeer      `json:"peers"`
+	MailsyncPeers []string         `json:"mailsyncPeers,omitempty"`
 	NumKeys       int              `json:"numkeys,omitempty"`
 	ServerContact string           `json:"server_contact,omitempty"`
 
-	Total  int
-	Hourly []loadStat
-	Daily  []loadStat
+	Total   int
+	Hourly  []loadStat
+	Daily   []loadStat
+	Sources sks.SourceStatMap `json:",omitempty"`
+
+	Analytics *analytics.Summary `json:"analytics,omitempty"`
 }
 
 type statsQueryConfig struct {
@@ -246,7 +640,11 @@ func (s *Server) stats() (interface{}, error) {
 		ReconAddr: s.settings.Conflux.Recon.Settings.ReconAddr,
 		Software:  s.settings.Software,
 
-		Total: sksStats.Total,
+		Total:   sksStats.Total,
+		Sources: sksStats.Sources,
+	}
+	if s.analytics != nil {
+		result.Analytics = s.analytics.Summary()
 	}
 
 	if s.settings.SksCompat {
@@ -295,6 +693,9 @@ func (s *Server) stats() (interface{}, error) {
 		}
 	}
 	sort.Sort(statsPeers(result.Peers))
+	if pks := s.settings.OpenPGP.PKS; pks != nil {
+		result.MailsyncPeers = append(result.MailsyncPeers, pks.To...)
+	}
 	return result, nil
 }
 
@@ -340,15 +741,88 @@ func (s *Server) registerWebroot(webroot string) error {
 func (s *Server) Start() error {
 	s.openLog()
 
+	if s.alerts != nil {
+		s.alerts.Start()
+		s.t.Go(s.monitorHealth)
+	}
+
+	if s.settings.OpenPGP.WarmUp.Enabled {
+		s.warmUp()
+	}
+
 	s.t.Go(s.listenAndServeHKP)
 	if s.settings.HKPS != nil {
 		s.t.Go(s.listenAndServeHKPS)
 	}
+	if s.settings.LDAP != nil {
+		s.t.Go(s.listenAndServeLDAP)
+	}
+	if s.admin != nil {
+		s.t.Go(s.listenAndServeAdmin)
+	}
 
 	if s.sksPeer != nil {
 		s.sksPeer.Start()
 	}
 
+	if s.attestor != nil {
+		s.t.Go(s.refreshAttestations)
+	}
+
+	if s.blocklist != nil {
+		s.blocklist.Start()
+	}
+
+	if s.pusher != nil {
+		s.pusher.Start()
+	}
+
+	if s.suppressions != nil {
+		s.t.Go(func() error { return s.refreshSuppressions(s.st.(storage.ErasureStore)) })
+	}
+
+	if s.accessTracker != nil {
+		s.accessTracker.Start()
+	}
+
+	if s.fpFilter != nil {
+		s.fpFilter.Start()
+	}
+
+	if s.indexWorkers != nil {
+		s.indexWorkers.Start()
+	}
+
+	if s.tokens != nil {
+		s.tokens.Start()
+	}
+
+	if s.searchFeeder != nil {
+		s.searchFeeder.Start()
+	}
+
+	if s.settings.OpenPGP.Retention.Enabled {
+		s.t.Go(s.applyRetention)
+	}
+
+	if s.shedder != nil {
+		s.t.Go(func() error { return s.shedder.run(s.t.Dying()) })
+	}
+
+	if s.rateLimiter != nil {
+		s.t.Go(func() error { return s.rateLimiter.run(s.t.Dying()) })
+	}
+
+	if len(s.settings.HKP.VerifiedAddresses.WatchedDomains) > 0 {
+		if vs, ok := s.st.(storage.VerificationStore); ok {
+			registerDomainMetrics()
+			s.t.Go(func() error { return s.countWatchedDomains(vs) })
+		} else {
+			log.Warningf("storage driver %q does not support verified addresses, watched domains are not counted",
+				s.settings.OpenPGP.DB.Driver)
+		}
+	}
+
 	if s.metricsListener != nil {
 		s.metricsListener.Start()
 	}
@@ -356,6 +830,348 @@ func (s *Server) Start() error {
 	return nil
 }
 
+func verifiedAddressOptions(st storage.Storage, settings *Settings) ([]hkp.HandlerOption, error) {
+	vs, ok := st.(storage.VerificationStore)
+	if !ok {
+		log.Warningf("storage driver %q does not support verified addresses", settings.OpenPGP.DB.Driver)
+		return nil, nil
+	}
+	conf := settings.HKP.VerifiedAddresses
+	options := []hkp.HandlerOption{hkp.UserIDVerifier(hkp.NewStorageVerifier(vs))}
+	if conf.Export {
+		if settings.HKP.Attestation.KeyFile == "" || settings.Hostname == "" {
+			return nil, errors.New("verified address export requires an attestation key and hostname")
+		}
+		kf, err := os.Open(settings.HKP.Attestation.KeyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer kf.Close()
+		signer, err := hkp.ReadAttestationKey(kf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read attestation key %q", settings.HKP.Attestation.KeyFile)
+		}
+		options = append(options, hkp.VerifiedAddressExport(signer, settings.Hostname))
+	}
+	var trusted xopenpgp.EntityList
+	for _, keyFile := range conf.TrustedKeyFiles {
+		el, err := readKeyRing(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read trusted key %q", keyFile)
+		}
+		trusted = append(trusted, el...)
+	}
+	if len(trusted) > 0 {
+		options = append(options, hkp.VerifiedAddressImport(trusted))
+	}
+	for _, peer := range conf.Peers {
+		el, err := readKeyRing(peer.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read verification peer key %q", peer.KeyFile)
+		}
+		options = append(options, hkp.VerifiedAddressPeer(peer.Hostname, el))
+	}
+	if len(conf.WKDDomains) > 0 {
+		options = append(options, hkp.WKDDomains(conf.WKDDomains))
+	}
+	return options, nil
+}
+
+func newTokens(st storage.Storage, settings *Settings) (*storage.Tokens, error) {
+	ts, ok := st.(storage.TokenStore)
+	if !ok {
+		log.Warningf("storage driver %q does not support verification tokens", settings.OpenPGP.DB.Driver)
+		return nil, nil
+	}
+	conf := settings.HKP.VerifiedAddresses.Tokens
+	secret, err := ioutil.ReadFile(conf.SecretFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return storage.NewTokens(ts, bytes.TrimSpace(secret),
+		storage.TokenTTL(time.Duration(conf.TTLSecs)*time.Second),
+		storage.TokenRateLimit(time.Duration(conf.RateWindowSecs)*time.Second, conf.MaxPerAddress, conf.MaxPerSource))
+}
+
+func newVerificationSender(settings *Settings) (*hkp.EmailVerificationSender, error) {
+	conf := settings.HKP.VerifiedAddresses.Email
+	if settings.Hostname == "" {
+		return nil, errors.New("verifiedAddresses.email requires hostname to be set")
+	}
+	addr := conf.SMTP.Host
+	if addr == "" {
+		addr = DefaultSMTPHost
+	}
+	var auth smtp.Auth
+	if conf.SMTP.User != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		auth = smtp.PlainAuth(conf.SMTP.ID, conf.SMTP.User, conf.SMTP.Password, host)
+	}
+	return &hkp.EmailVerificationSender{
+		Addr:     addr,
+		Auth:     auth,
+		From:     conf.From,
+		Hostname: settings.Hostname,
+	}, nil
+}
+
+func readKeyRing(keyFile string) (xopenpgp.EntityList, error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	el, err := xopenpgp.ReadArmoredKeyRing(f)
+	return el, errors.WithStack(err)
+}
+
+func pushPeers(settings *Settings) ([]*hkp.PushPeer, error) {
+	var peers []*hkp.PushPeer
+	for _, conf := range settings.HKP.Push.Peers {
+		el, err := readKeyRing(conf.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read push peer key %q", conf.KeyFile)
+		}
+		peer := &hkp.PushPeer{
+			Name:        conf.Name,
+			Keyring:     el,
+			AllowDelete: conf.AllowDelete,
+		}
+		if !conf.Trusted {
+			peer.UpsertOptions = UpsertOptions(settings)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+func newPusher(st storage.Storage, settings *Settings, localKeys sks.LocalKeys) (*hkp.Pusher, error) {
+	if settings.HKP.Attestation.KeyFile == "" || settings.Hostname == "" {
+		return nil, errors.New("pushing keys requires an attestation key and hostname")
+	}
+	kf, err := os.Open(settings.HKP.Attestation.KeyFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer kf.Close()
+	signer, err := hkp.ReadAttestationKey(kf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read attestation key %q", settings.HKP.Attestation.KeyFile)
+	}
+	return hkp.NewPusher(st, signer, settings.Hostname, settings.HKP.Push.Targets,
+		hkp.PushInterval(time.Duration(settings.HKP.Push.IntervalSecs)*time.Second),
+		hkp.PushLocalOnly(localKeys))
+}
+
+func newBlocklistUpdater(bl *openpgp.Blocklist, st storage.Storage, settings *Settings) (*blocklist.Updater, error) {
+	feeds, err := blocklistFeeds(settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	interval := time.Duration(settings.OpenPGP.Blocklists.IntervalSecs) * time.Second
+	return blocklist.New(bl, st, feeds, blocklist.Interval(interval))
+}
+
+// blocklistFeeds returns the configured blocklist feeds.
+func blocklistFeeds(settings *Settings) ([]*blocklist.Feed, error) {
+	var feeds []*blocklist.Feed
+	for _, feedConf := range settings.OpenPGP.Blocklists.Feeds {
+		el, err := readKeyRing(feedConf.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read blocklist key %q", feedConf.KeyFile)
+		}
+		name := feedConf.Name
+		if name == "" {
+			name = feedConf.URL
+		}
+		feeds = append(feeds, &blocklist.Feed{
+			Name:         name,
+			URL:          feedConf.URL,
+			SignatureURL: feedConf.SignatureURL,
+			Keyring:      el,
+		})
+	}
+	return feeds, nil
+}
+
+func newAttestor(keyFile string, f func() (*hkp.Attestation, error)) (*hkp.Attestor, error) {
+	kf, err := os.Open(keyFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer kf.Close()
+	signer, err := hkp.ReadAttestationKey(kf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read attestation key %q", keyFile)
+	}
+	return hkp.NewAttestor(signer, f)
+}
+
+func (s *Server) attestation() (*hkp.Attestation, error) {
+	result, err := s.stats()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	st := result.(*stats)
+	att := &hkp.Attestation{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Hostname: st.Hostname,
+		Software: st.Software,
+		Version:  st.Version,
+		NumKeys:  st.Total,
+	}
+	for _, peer := range st.Peers {
+		att.Peers = append(att.Peers, peer.Name)
+	}
+	return att, nil
+}
+
+func (s *Server) refreshAttestations() error {
+	interval := time.Duration(s.settings.HKP.Attestation.IntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultAttestationIntervalSecs * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := s.attestor.Refresh()
+		if err != nil {
+			log.Errorf("failed to sign attestation: %v", err)
+		}
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) applyRetention() error {
+	conf := s.settings.OpenPGP.Retention
+	policy := storage.RetentionPolicy{
+		InactiveFor: time.Duration(conf.InactiveYears) * 365 * 24 * time.Hour,
+		UnusedFor:   time.Duration(conf.UnusedMonths) * 30 * 24 * time.Hour,
+	}
+	interval := time.Duration(conf.IntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultRetentionIntervalSecs * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+		n, err := storage.ApplyRetention(s.st, policy)
+		if err != nil {
+			log.Errorf("retention policy failed: %v", err)
+		}
+		log.Infof("retention policy removed %d stale keys", n)
+	}
+}
+
+// warmUp prepares storage and the prefix tree to serve requests, and reads
+// the keys fetched most often before the last restart so that they are
+// cached. Failures are logged, as the server can serve requests regardless.
+func (s *Server) warmUp() {
+	start := time.Now()
+	if w, ok := s.st.(storage.Warmer); ok {
+		err := w.Warm()
+		if err != nil {
+			log.Warningf("failed to warm storage: %v", err)
+		}
+	} else {
+		log.Warningf("storage driver %q does not support warm-up", s.settings.OpenPGP.DB.Driver)
+	}
+	if s.sksPeer != nil {
+		err := s.sksPeer.WarmUp()
+		if err != nil {
+			log.Warningf("failed to warm prefix tree: %v", err)
+		}
+	}
+	if s.hotList != nil {
+		rfps, err := storage.LoadHotList(s.settings.OpenPGP.WarmUp.HotListFile)
+		if err != nil {
+			log.Warningf("failed to load hot keys: %v", err)
+		}
+		if conf := s.settings.OpenPGP.WarmUp; conf.HotKeys > 0 && len(rfps) > conf.HotKeys {
+			rfps = rfps[:conf.HotKeys]
+		}
+		n, err := storage.WarmKeys(s.st, rfps)
+		if err != nil {
+			log.Warningf("failed to warm hot keys: %v", err)
+		}
+		log.Infof("warmed %d of %d hot keys", n, len(rfps))
+	}
+	log.Infof("warm-up completed in %v", time.Since(start))
+}
+
+// countWatchedDomains periodically updates the number of keys with an
+// address verified in each watched domain.
+func (s *Server) countWatchedDomains(vs storage.VerificationStore) error {
+	conf := s.settings.HKP.VerifiedAddresses
+	interval := time.Duration(conf.WatchedDomainsIntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultWatchedDomainsIntervalSecs * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, domain := range conf.WatchedDomains {
+			domain = strings.ToLower(domain)
+			n, err := vs.CountVerifiedKeys(domain)
+			if err != nil {
+				log.Errorf("failed to count verified keys in %q: %v", domain, err)
+				continue
+			}
+			domainVerifiedKeys.WithLabelValues(domain).Set(float64(n))
+		}
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadSuppressions sets the keys and addresses suppressed to those erased by
+// approved erasure requests.
+func loadSuppressions(s *openpgp.Suppressions, es storage.ErasureStore) error {
+	fps, addrs, err := storage.Suppressions(es)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.Set(fps, addrs)
+	return nil
+}
+
+// refreshSuppressions periodically reloads the suppressions, so that
+// erasure requests approved with hockeypuck-erasure take effect.
+func (s *Server) refreshSuppressions(es storage.ErasureStore) error {
+	interval := time.Duration(s.settings.OpenPGP.Erasure.IntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultErasureIntervalSecs * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+		err := loadSuppressions(s.suppressions, es)
+		if err != nil {
+			log.Errorf("failed to load erasure suppressions: %v", err)
+		}
+	}
+}
+
 type nopCloser struct {
 	io.Writer
 }
@@ -395,21 +1211,155 @@ func (s *Server) LogRotate() {
 	w.Close()
 }
 
+// Reload applies the settings which may change while the server is running:
+// the recon partners and the networks other peers may connect from, the
+// blocklist feeds, rate limits, the load shedding thresholds, access log
+// sampling, and the log file and level. Requests and recon sessions in
+// progress are not interrupted. Other settings are applied when the server is
+// restarted.
+//
+// Nothing is changed if the recon settings, rate limits or blocklist feeds
+// are invalid.
+func (s *Server) Reload(settings *Settings) error {
+	reconConf := &settings.Conflux.Recon.Settings
+	_, err := reconConf.Matcher()
+	if err != nil {
+		return errors.Wrap(err, "invalid recon partners")
+	}
+
+	ratePolicy, err := newRatePolicy(&settings.HKP.RateLimit, reconConf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	feeds, err := blocklistFeeds(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if s.blocklist != nil {
+		err = s.blocklist.SetFeeds(feeds)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if len(feeds) > 0 {
+		log.Warning("blocklist feeds are applied when the server is restarted")
+	}
+
+	err = s.sksPeer.SetPartners(reconConf.Partners, reconConf.AllowCIDRs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if s.shedder != nil {
+		s.shedder.setConfig(&settings.HKP.LoadShedding)
+	} else if settings.HKP.LoadShedding.Enabled {
+		log.Warning("load shedding is enabled when the server is restarted")
+	}
+	if s.rateLimiter != nil {
+		s.rateLimiter.setPolicy(ratePolicy)
+	} else if settings.HKP.RateLimit.Enabled {
+		log.Warning("rate limits are enabled when the server is restarted")
+	}
+	s.accessLog.set(&settings.HKP.AccessLog)
+
+	s.settings.LogFile = settings.LogFile
+	s.settings.LogLevel = settings.LogLevel
+	s.LogRotate()
+
+	log.WithFields(log.Fields{
+		"partners":   len(reconConf.Partners),
+		"blocklists": len(feeds),
+	}).Info("configuration reloaded")
+	return nil
+}
+
 func (s *Server) Wait() error {
 	return s.t.Wait()
 }
 
+// Stop shuts the server down. New connections are refused while the HKP
+// requests and the recon session in progress are given up to the drain
+// timeout to finish. Pending key changes are then passed on, and storage is
+// closed.
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Server) stop() {
 	defer s.closeLog()
 
+	timeout := time.Duration(s.settings.DrainTimeoutSecs) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	log.Infof("draining connections for up to %s", timeout)
+	s.drainHTTP(ctx)
+	// An abandoned recon session may still be writing to storage, which is
+	// then left open for the process to exit with.
+	abandoned := false
 	if s.sksPeer != nil {
-		s.sksPeer.Stop()
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.sksPeer.Stop()
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Warning("abandoning recon session still in progress")
+			abandoned = true
+		}
 	}
 	if s.metricsListener != nil {
 		s.metricsListener.Stop()
 	}
+	if s.hotList != nil {
+		err := s.hotList.Save(s.settings.OpenPGP.WarmUp.HotListFile)
+		if err != nil {
+			log.Errorf("failed to save hot keys: %v", err)
+		}
+	}
+	if s.accessTracker != nil {
+		err := s.accessTracker.Stop()
+		if err != nil {
+			log.Errorf("failed to record key accesses: %v", err)
+		}
+	}
+	if s.fpFilter != nil {
+		s.fpFilter.Stop()
+	}
+	if s.indexWorkers != nil {
+		s.indexWorkers.Stop()
+	}
+	if s.tokens != nil {
+		s.tokens.Stop()
+	}
+	if s.searchFeeder != nil {
+		s.searchFeeder.Stop()
+	}
+	if s.blocklist != nil {
+		s.blocklist.Stop()
+	}
+	if s.pusher != nil {
+		s.pusher.Stop()
+	}
+	if s.spanExporter != nil {
+		tracing.SetTracer(nil)
+		s.spanExporter.Stop()
+	}
 	s.t.Kill(nil)
 	s.t.Wait()
+	if s.alerts != nil {
+		s.alerts.Stop()
+	}
+	if abandoned {
+		log.Warning("not closing storage in use by abandoned recon session")
+	} else {
+		err := s.st.Close()
+		if err != nil {
+			log.Errorf("failed to close storage: %v", err)
+		}
+	}
+	log.Info("stopped")
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -441,18 +1391,63 @@ func (s *Server) newListener(addr string) (net.Listener, error) {
 
 	s.t.Go(func() error {
 		<-s.t.Dying()
-		return ln.Close()
+		// The listener may already have been closed by draining.
+		ln.Close()
+		return nil
 	})
 	return tcpKeepAliveListener{ln.(*net.TCPListener)}, nil
 }
 
+// serveHTTP serves HTTP requests on ln until the server is drained.
+func (s *Server) serveHTTP(ln net.Listener, handler http.Handler) error {
+	conf := &s.settings.HKP.Timeouts
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(conf.ReadHeaderSecs) * time.Second,
+		ReadTimeout:       time.Duration(conf.ReadSecs) * time.Second,
+		WriteTimeout:      time.Duration(conf.WriteSecs) * time.Second,
+		IdleTimeout:       time.Duration(conf.IdleSecs) * time.Second,
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
+	}
+	s.mu.Lock()
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// drainHTTP stops accepting HTTP connections, and waits for the requests in
+// progress to complete until ctx is done, when any still in progress are
+// abandoned.
+func (s *Server) drainHTTP(ctx context.Context) {
+	s.mu.Lock()
+	servers := s.httpServers
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				log.Warningf("abandoning HTTP requests still in progress: %v", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
 func (s *Server) listenAndServeHKP() error {
 	ln, err := newListener(s, s.settings.HKP.Bind)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	s.hkpAddr = ln.Addr().String()
-	return http.Serve(ln, s.middle)
+	return s.serveHTTP(ln, s.middle)
 }
 
 func (s *Server) listenAndServeHKPS() error {
@@ -472,5 +1467,43 @@ func (s *Server) listenAndServeHKPS() error {
 	}
 	s.hkpsAddr = ln.Addr().String()
 	ln = tls.NewListener(ln, config)
-	return http.Serve(ln, s.middle)
+	return s.serveHTTP(ln, s.middle)
+}
+
+func (s *Server) listenAndServeAdmin() error {
+	bind := s.settings.Admin.Bind
+	if bind == "" {
+		bind = DefaultAdminBind
+	}
+	ln, err := newListener(s, bind)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	r := httprouter.New()
+	s.admin.Register(r)
+	return s.serveHTTP(ln, r)
+}
+
+func (s *Server) listenAndServeLDAP() error {
+	conf := s.settings.LDAP
+	bind := conf.Bind
+	if bind == "" {
+		bind = DefaultLDAPBind
+	}
+	ln, err := newListener(s, bind)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	options := []ldap.Option{
+		ldap.Software(s.settings.Software, s.settings.Version),
+		ldap.ServePolicy(ServePolicy(s.settings)...),
+		ldap.KeyWriterOptions(KeyWriterOptions(s.settings)),
+	}
+	if conf.BaseDN != "" {
+		options = append(options, ldap.BaseDN(conf.BaseDN))
+	}
+	if conf.MaxResults > 0 {
+		options = append(options, ldap.MaxResults(conf.MaxResults))
+	}
+	return ldap.New(s.st, options...).Serve(ln)
 }
@@ -23,6 +23,7 @@ import (
 
 	"hockeypuck/conflux/recon"
 	"hockeypuck/metrics"
+	"hockeypuck/openpgp"
 )
 
 type confluxConfig struct {
@@ -39,13 +40,319 @@ type reconConfig struct {
 }
 
 const (
-	DefaultHKPBind = ":11371"
+	DefaultHKPBind  = ":11371"
+	DefaultLDAPBind = ":389"
+
+	DefaultAdminBind = "localhost:11374"
+
+	DefaultTracingSampleRatio = 1.0
+
+	DefaultDrainTimeoutSecs = 30
+
+	DefaultHTTPReadHeaderTimeoutSecs = 10
+	DefaultHTTPReadTimeoutSecs       = 60
+	DefaultHTTPWriteTimeoutSecs      = 300
+	DefaultHTTPIdleTimeoutSecs       = 120
+	DefaultHTTPMaxHeaderBytes        = 64 << 10
+
+	// DefaultMaxAddLength allows for a key of DefaultMaxKeyLength, armored
+	// and form encoded.
+	DefaultMaxAddLength = 4 << 20
+
+	DefaultAttestationIntervalSecs = 3600
+	DefaultPushIntervalSecs        = 5
+
+	DefaultMaintenanceMessage        = "This keyserver is undergoing maintenance."
+	DefaultMaintenanceRetryAfterSecs = 600
+
+	// DefaultContentSecurityPolicy allows the inline styles and photo
+	// images used by the bundled templates, and nothing from elsewhere.
+	DefaultContentSecurityPolicy = "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; object-src 'none'; frame-ancestors 'none'"
 )
 
 type HKPConfig struct {
 	Bind string `toml:"bind"`
 
+	Timeouts httpTimeoutsConfig `toml:"timeouts"`
+
+	// MaxAddLength limits the length of a key submission request to
+	// /pks/add, /pks/replace, /pks/revoke or /vks/v1/upload. Longer
+	// requests are refused with 413 Request Entity Too Large before they
+	// are parsed.
+	MaxAddLength int `toml:"maxAddLength"`
+
 	Queries queryConfig `toml:"queries"`
+
+	Analytics analyticsConfig `toml:"analytics"`
+
+	// Content-Security-Policy sent with lookup responses. Set to an empty
+	// string to disable.
+	ContentSecurityPolicy string `toml:"contentSecurityPolicy"`
+
+	Attestation attestationConfig `toml:"attestation"`
+
+	VerifiedAddresses verifiedAddressesConfig `toml:"verifiedAddresses"`
+
+	Push pushConfig `toml:"push"`
+
+	Maintenance maintenanceConfig `toml:"maintenance"`
+
+	AccessLog accessLogConfig `toml:"accessLog"`
+
+	LoadShedding loadSheddingConfig `toml:"loadShedding"`
+
+	RateLimit rateLimitConfig `toml:"rateLimit"`
+
+	Challenge challengeConfig `toml:"challenge"`
+
+	Compression compressionConfig `toml:"compression"`
+}
+
+// httpTimeoutsConfig limits how long clients may take over requests, and
+// how large their headers may be, so that slow clients cannot hold
+// connections open indefinitely. It applies to the HKP, HKPS and admin
+// listeners. A timeout of zero is unlimited.
+type httpTimeoutsConfig struct {
+	// Time to read the headers of a request
+	ReadHeaderSecs int `toml:"readHeaderSecs"`
+	// Time to read a whole request, including its body
+	ReadSecs int `toml:"readSecs"`
+	// Time from the end of reading the headers of a request to the end of
+	// writing its response
+	WriteSecs int `toml:"writeSecs"`
+	// Time to wait for the next request on a kept-alive connection
+	IdleSecs       int `toml:"idleSecs"`
+	MaxHeaderBytes int `toml:"maxHeaderBytes"`
+}
+
+// compressionConfig configures compressing armored keys, index pages and
+// JSON responses with zstd or gzip, for clients which accept either.
+type compressionConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Responses shorter than this are sent uncompressed.
+	MinLength int `toml:"minLength"`
+}
+
+// loadSheddingConfig configures refusing requests while the server is under
+// pressure. Keyword searches are refused once any threshold is exceeded,
+// other requests at 125% of a threshold and key lookups by key ID or
+// fingerprint at 150%. Requests from peer keyservers are never refused.
+// A threshold of zero is not checked.
+type loadSheddingConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Number of goroutines
+	MaxGoroutines int `toml:"maxGoroutines"`
+	// Fraction of the storage connection pool in use, from 0 to 1. Only
+	// applies if db.maxConns is set.
+	MaxPoolUse float64 `toml:"maxPoolUse"`
+	// Moving average of response latency
+	MaxLatencyMillis int `toml:"maxLatencyMillis"`
+	// Sent as the Retry-After header on refused requests
+	RetryAfterSecs int `toml:"retryAfterSecs"`
+}
+
+// rateLimitConfig configures limiting the rate of requests from each client
+// IP address, with a separate budget for each kind of request. Clients
+// exceeding a budget are refused with 429 Too Many Requests. Recon partners
+// and the networks allowed to reconcile are not limited.
+type rateLimitConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Key lookups, by op=get or op=hget and their VKS and key path
+	// equivalents
+	Get rateBudget `toml:"get"`
+	// Searches listing keys, by op=index or op=vindex and by email
+	Index rateBudget `toml:"index"`
+	// Key submissions to /pks/add and /vks/v1/upload
+	Add rateBudget `toml:"add"`
+	// Requests for keys by digest from peers, to /pks/hashquery
+	HashQuery rateBudget `toml:"hashquery"`
+	// Any other request
+	Default rateBudget `toml:"default"`
+	// Further networks, in CIDR notation, whose requests are not limited
+	AllowCIDRs []string `toml:"allowCIDRs"`
+	// Reverse proxies, in CIDR notation, whose X-Forwarded-For header is
+	// trusted to give the address of the client
+	TrustedProxies []string `toml:"trustedProxies"`
+	// Redis server shared by servers behind a load balancer, so that
+	// clients are limited by all of them together rather than by each
+	Redis rateLimitRedisConfig `toml:"redis"`
+}
+
+// rateLimitRedisConfig configures the Redis server holding rate limits.
+// Limits are held in memory if no address is given. Requests are allowed
+// when the Redis server cannot be reached.
+type rateLimitRedisConfig struct {
+	// host:port of the Redis server
+	Address  string `toml:"address"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	// Prefix of the keys holding rate limits
+	KeyPrefix     string `toml:"keyPrefix"`
+	TimeoutMillis int    `toml:"timeoutMillis"`
+}
+
+// Submission challenge types.
+const (
+	ChallengeHashcash = "hashcash"
+	ChallengeCaptcha  = "captcha"
+)
+
+// challengeConfig configures an anti-abuse challenge which key submissions
+// to /pks/add, /pks/replace, /pks/revoke and /vks/v1/upload must meet, to
+// slow down automated flooding of junk keys.
+type challengeConfig struct {
+	// "hashcash" requires a proof of work stamp for the hostname in an
+	// X-Hashcash header. "captcha" requires a CAPTCHA response in the
+	// submission form. Submissions are not challenged if empty.
+	Type string `toml:"type"`
+	// Bits of work a hashcash stamp must prove
+	Bits int `toml:"bits"`
+	// How far from now the date of a hashcash stamp may be
+	MaxAgeSecs int `toml:"maxAgeSecs"`
+	// siteverify API URL of the CAPTCHA provider, such as
+	// https://hcaptcha.com/siteverify
+	VerifyURL string `toml:"verifyURL"`
+	// File containing the site's secret for the siteverify API
+	SecretFile string `toml:"secretFile"`
+	// Form field carrying the CAPTCHA response, such as h-captcha-response.
+	// As /vks/v1/upload takes a JSON body, it is given there in the query
+	// string.
+	ResponseField string `toml:"responseField"`
+	// Tokens exempting submissions from the challenge, given as a bearer
+	// token or in HTTP basic authentication, for clients such as gpg which
+	// cannot meet it
+	BypassTokens []string `toml:"bypassTokens"`
+}
+
+// rateBudget is a token bucket: requests are allowed at a sustained rate
+// per second, and in bursts of up to a number of requests. A rate of zero
+// is not limited.
+type rateBudget struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+type accessLogConfig struct {
+	// Fraction of requests logged, for paths not listed in Routes
+	DefaultRate float64 `toml:"defaultRate"`
+	// Fraction of requests logged by path, e.g. "/pks/lookup" = 0.01.
+	// Paths ending in "/" match any path below them.
+	Routes map[string]float64 `toml:"routes"`
+}
+
+type maintenanceConfig struct {
+	// Start in maintenance mode. Maintenance mode is switched at runtime
+	// with PUT and DELETE /admin/maintenance on the admin API.
+	Enabled bool `toml:"enabled"`
+	// Message shown on the maintenance page
+	Message string `toml:"message"`
+	// Sent as the Retry-After header on maintenance responses
+	RetryAfterSecs int `toml:"retryAfterSecs"`
+	// Optional template for the maintenance page
+	Template string `toml:"template"`
+}
+
+type attestationConfig struct {
+	// Armored, unencrypted private key used to sign attestations. Signed
+	// attestations are published only if this is set.
+	KeyFile string `toml:"keyFile"`
+	// How often a new attestation is signed
+	IntervalSecs int `toml:"intervalSecs"`
+}
+
+type verifiedAddressesConfig struct {
+	// Show the verification state of user IDs recorded in storage
+	Enabled bool `toml:"enabled"`
+	// Publish the addresses verified by this keyserver at /pks/verified,
+	// signed by the attestation key. Requires hostname to be set.
+	Export bool `toml:"export"`
+	// Armored public keys of the keyservers whose signed exports are
+	// accepted at /pks/verified. Addresses imported from them are attributed
+	// to the fingerprint of the signing key.
+	TrustedKeyFiles []string `toml:"trustedKeyFiles"`
+	// Keyservers whose signed exports are accepted at /pks/verified, and
+	// to which the addresses imported from them are attributed
+	Peers []verificationPeerConfig `toml:"peers"`
+
+	Tokens tokensConfig `toml:"tokens"`
+
+	// Verification tokens requested for addresses on keys uploaded through
+	// the VKS API at /vks/v1/request-verify are sent by email from this
+	// address, linking to /pks/verify on hostname. Requires tokens.
+	Email verificationEmailConfig `toml:"email"`
+
+	// Domains for which the number of keys with a verified address in the
+	// domain is exported as a metric, to monitor coverage of an
+	// organization's staff
+	WatchedDomains []string `toml:"watchedDomains"`
+	// How often the watched domain metrics are updated
+	WatchedDomainsIntervalSecs int `toml:"watchedDomainsIntervalSecs"`
+
+	// Domains whose Web Key Directory is served at /.well-known/openpgpkey/,
+	// publishing keys with verified addresses in the domain. The domain
+	// must resolve to this keyserver, or openpgpkey.<domain> must for the
+	// advanced method.
+	WKDDomains []string `toml:"wkdDomains"`
+}
+
+// pushConfig configures pushing changed keys directly between keyservers
+// under the same administration, so that they propagate without waiting
+// for recon.
+type pushConfig struct {
+	// Keyservers to which changed keys are pushed, signed by the attestation
+	// key. Each is a base URL, or an hkp:// or hkps:// address or bare domain
+	// resolved through its SRV records. Requires hostname to be set.
+	Targets []string `toml:"targets"`
+	// How often changed keys are pushed
+	IntervalSecs int `toml:"intervalSecs"`
+	// Keyservers whose signed pushes are accepted at /pks/push
+	Peers []pushPeerConfig `toml:"peers"`
+}
+
+type pushPeerConfig struct {
+	// Name identifying the peer in logs and statistics
+	Name string `toml:"name"`
+	// Armored public keys the peer signs pushes with
+	KeyFile string `toml:"keyFile"`
+	// Allow the peer to delete keys
+	AllowDelete bool `toml:"allowDelete"`
+	// Allow the peer to change pinned keys and keys maintained on other
+	// keyservers; otherwise pushed keys are subject to the same policy as
+	// anonymous submissions
+	Trusted bool `toml:"trusted"`
+}
+
+type tokensConfig struct {
+	// File containing the secret key with which verification tokens are
+	// signed, at least 32 bytes long. Tokens are redeemed at /pks/verify
+	// only if this is set.
+	SecretFile string `toml:"secretFile"`
+	// How long a token remains valid after it is issued
+	TTLSecs int `toml:"ttlSecs"`
+	// Limits on the tokens issued to an address, or requested by a client
+	// address, within each rate window
+	RateWindowSecs int `toml:"rateWindowSecs"`
+	MaxPerAddress  int `toml:"maxPerAddress"`
+	MaxPerSource   int `toml:"maxPerSource"`
+}
+
+type verificationPeerConfig struct {
+	// Hostname the peer issues its exports as
+	Hostname string `toml:"hostname"`
+	// Armored public keys the peer signs its exports with
+	KeyFile string `toml:"keyFile"`
+}
+
+type verificationEmailConfig struct {
+	From string     `toml:"from"`
+	SMTP SMTPConfig `toml:"smtp"`
+}
+
+type analyticsConfig struct {
+	// Collect aggregate search statistics, reported with server stats
+	Enabled bool `toml:"enabled"`
+	// Minimum number of searches for a domain before it is reported
+	K int `toml:"k"`
 }
 
 type queryConfig struct {
@@ -53,6 +360,18 @@ type queryConfig struct {
 	SelfSignedOnly bool `toml:"selfSignedOnly"`
 	// Only allow fingerprint / key ID queries; no UID keyword searching allowed
 	FingerprintOnly bool `toml:"keywordSearchDisabled"`
+	// Include key metadata in these namespaces in JSON responses
+	ExposeMetadata []string `toml:"exposeMetadata"`
+	// Policy for key ID lookups matching more than one key: "all" serves
+	// every match, flagged as ambiguous in index output, and "reject"
+	// refuses to serve them.
+	AmbiguousKeyIDs string `toml:"ambiguousKeyIDs"`
+	// Identify the signers of third-party certifications in JSON responses
+	ResolveSigners bool `toml:"resolveSigners"`
+	// How the words of keyword searches are combined when a lookup does not
+	// select it with the match parameter: "all" (the default), "any",
+	// "phrase", or, where storage indexes trigrams, "substring" or "fuzzy"
+	DefaultMatch string `toml:"defaultMatch"`
 }
 
 type HKPSConfig struct {
@@ -61,6 +380,41 @@ type HKPSConfig struct {
 	Key  string `toml:"key"`
 }
 
+// LDAPConfig configures a read-only LDAP listener serving keys in the PGP
+// LDAP schema, for clients which cannot use HKP.
+type LDAPConfig struct {
+	Bind string `toml:"bind"`
+	// Base DN of the directory; keys are served under ou=PGP Keys in it
+	BaseDN string `toml:"baseDN"`
+	// Maximum number of entries returned by a search
+	MaxResults int `toml:"maxResults"`
+}
+
+// AdminConfig configures the admin API listener, with which operators
+// moderate keys and manage recon without changing storage by hand.
+type AdminConfig struct {
+	Bind string `toml:"bind"`
+	// Bearer tokens accepted, by the name of the operator or tool holding
+	// them, which is logged with the changes each makes
+	Tokens map[string]string `toml:"tokens"`
+}
+
+// TracingConfig configures the export of request traces to an
+// OpenTelemetry collector.
+type TracingConfig struct {
+	// Base URL of the collector's OTLP/HTTP endpoint, such as
+	// http://localhost:4318
+	Endpoint string `toml:"endpoint"`
+	// Name the service is identified by in traces
+	ServiceName string `toml:"serviceName"`
+	// Fraction of traces started here which are recorded, between 0 and 1,
+	// or all of them if unset. Traces continued from a caller are recorded
+	// if the caller's are.
+	SampleRatio float64 `toml:"sampleRatio"`
+	// Headers sent to the collector, such as to authenticate
+	Headers map[string]string `toml:"headers"`
+}
+
 type PKSConfig struct {
 	From string     `toml:"from"`
 	To   []string   `toml:"to"`
@@ -86,13 +440,101 @@ const (
 )
 
 type DBConfig struct {
+	// Storage driver: "postgres-jsonb"; "leveldb", an embedded database
+	// needing no external services; "dump", read-only key dump files; or
+	// another driver compiled in
 	Driver string `toml:"driver"`
-	DSN    string `toml:"dsn"`
+	// Data source: a PostgreSQL connection string, or the directory of the
+	// embedded database or key dump files. If it is a URL whose scheme
+	// names a driver, such as postgres://host/hockeypuck or
+	// leveldb:///var/lib/hockeypuck/keys, that driver is used.
+	DSN string `toml:"dsn"`
+	// Number of keys copied to the database in each transaction when
+	// loading keys in bulk
+	BulkBatchSize int `toml:"bulkBatchSize"`
+	// Number of keys added in each transaction when there are too few to
+	// load in bulk, such as while catching up with recon peers
+	InsertBatchSize int `toml:"insertBatchSize"`
+
+	// Maximum number of open database connections; 0 for no limit
+	MaxConns int `toml:"maxConns"`
+	// Maximum number of idle database connections kept open
+	MaxIdleConns int `toml:"maxIdleConns"`
+	// Close database connections after they have been open this long
+	ConnMaxLifetimeSecs int `toml:"connMaxLifetimeSecs"`
+	// Close database connections after they have been idle this long
+	ConnMaxIdleSecs int `toml:"connMaxIdleSecs"`
+	// Abort database statements which run for longer than this
+	StatementTimeoutSecs int `toml:"statementTimeoutSecs"`
+	// How often idle database connections are checked; 0 disables checks
+	HealthCheckSecs int `toml:"healthCheckSecs"`
+
+	// Index the trigrams of user IDs, so that keyword searches may match
+	// substrings of them and similar words. PostgreSQL only; the pg_trgm
+	// extension is created if it is not installed.
+	TrigramSearch bool `toml:"trigramSearch"`
+
+	// Publish key changes to other hockeypuck servers sharing the
+	// database, and apply theirs to the recon prefix tree and caches of
+	// this one. PostgreSQL only, with LISTEN/NOTIFY; listening holds one
+	// connection.
+	SharedNotifications bool `toml:"sharedNotifications"`
+
+	Encryption dbEncryptionConfig `toml:"encryption"`
+}
+
+// dbEncryptionConfig configures encrypting the key material held in the
+// database, for deployments in which the database server is not trusted
+// with it. Keys are given one per line, as an identifier followed by the
+// base64 encoding of a 32-byte key, the first being the key with which
+// keys are encrypted. Other keys are used only to read keys stored before
+// it was rotated. Encryption is enabled if either source is set.
+type dbEncryptionConfig struct {
+	// File from which the keys are read
+	KeyFile string `toml:"keyFile"`
+	// Command, such as a key management service client, which writes the
+	// keys to its standard output
+	KeyCommand []string `toml:"keyCommand"`
 }
 
 const (
 	DefaultStatsRefreshHours = 4
 	DefaultNWorkers          = 8
+
+	DefaultRetentionInactiveYears = 5
+	DefaultRetentionUnusedMonths  = 12
+	DefaultRetentionIntervalSecs  = 86400
+
+	DefaultBlocklistIntervalSecs = 3600
+
+	DefaultErasureIntervalSecs = 300
+
+	DefaultWatchedDomainsIntervalSecs = 3600
+
+	DefaultLoadSheddingMaxGoroutines    = 10000
+	DefaultLoadSheddingMaxPoolUse       = 0.9
+	DefaultLoadSheddingMaxLatencyMillis = 2000
+	DefaultLoadSheddingRetryAfterSecs   = 10
+
+	DefaultRateLimitGetRate            = 10
+	DefaultRateLimitGetBurst           = 20
+	DefaultRateLimitIndexRate          = 1
+	DefaultRateLimitIndexBurst         = 5
+	DefaultRateLimitAddRate            = 0.2
+	DefaultRateLimitAddBurst           = 5
+	DefaultRateLimitHashQueryRate      = 1
+	DefaultRateLimitHashQueryBurst     = 10
+	DefaultRateLimitRedisKeyPrefix     = "hockeypuck:ratelimit:"
+	DefaultRateLimitRedisTimeoutMillis = 100
+
+	DefaultChallengeBits       = 20
+	DefaultChallengeMaxAgeSecs = 2 * 86400
+
+	DefaultCompressionMinLength = 1024
+
+	DefaultSigVerificationCacheSize = 1000000
+
+	DefaultWarmUpHotKeys = 10000
 )
 
 type OpenPGPArmorHeaders struct {
@@ -139,10 +581,277 @@ type OpenPGPConfig struct {
 	// blocks casually malicious content.
 	MaxPacketLength int `toml:"maxPacketLength"`
 
+	// MaxArmoredLength limits the length of ASCII-armored key material
+	// submitted in a single request. Longer submissions are refused with 413
+	// Request Entity Too Large before they are decoded.
+	MaxArmoredLength int `toml:"maxArmoredLength"`
+
+	// MaxPackets limits the total number of packets in a key. Like
+	// MaxKeyLength, keys exceeding it are dropped when read, and refused
+	// when they would exceed it once merged with the stored key.
+	MaxPackets int `toml:"maxPackets"`
+
+	// MaxUserIDSignatures limits the number of third-party certifications on
+	// each user ID or user attribute. Keys exceeding it are truncated to the
+	// most recent certifications when read and when stored; self-signatures
+	// are always kept. Flooded keys with many thousands of certifications
+	// otherwise exceed the limits of the keyword index.
+	MaxUserIDSignatures int `toml:"maxUserIDSignatures"`
+
+	Flooding floodingConfig `toml:"flooding"`
+
+	// StripThirdPartyCertifications strips the third-party certifications
+	// on user IDs and user attributes which the owner of the key has not
+	// approved in an attestation key signature, as keys.openpgp.org does.
+	// Keys are stripped as they are read, so that they are stored, served
+	// and reconciled without them.
+	StripThirdPartyCertifications bool `toml:"stripThirdPartyCertifications"`
+
+	// VerifySelfSignatures cryptographically verifies the self-signatures of
+	// keys as they are read and merged. In "permissive" mode, forged or
+	// malformed self-signatures are dropped; in "strict" mode, user IDs,
+	// user attributes and subkeys left without a valid self-signature are
+	// dropped as well. Empty, the default, stores self-signatures verbatim.
+	VerifySelfSignatures string `toml:"verifySelfSignatures"`
+
+	// UnknownCriticalSubpackets determines what becomes of signatures with
+	// critical subpackets that Hockeypuck does not understand, which it can
+	// neither parse nor verify. "retain", the default, stores and serves
+	// them unmodified so that features of later specifications survive the
+	// merge pipeline; "reject" drops them.
+	UnknownCriticalSubpackets string `toml:"unknownCriticalSubpackets"`
+
+	// MaxServeLength limits the length of key material served in response
+	// to a single lookup. Keys above this length are served in segments: the
+	// self-signed key first, followed by batches of third-party
+	// certifications, each retrieved with a continuation parameter. Zero
+	// disables segmentation.
+	MaxServeLength int `toml:"maxServeLength"`
+
 	// Blacklist contains a list of public key fingerprints that are not
 	// allowed on this server at all. These keys are silently dropped from
 	// inserts, updates, and lookups.
 	Blacklist []string `toml:"blacklist"`
+
+	Blocklists blocklistsConfig `toml:"blocklists"`
+
+	Erasure erasureConfig `toml:"erasure"`
+
+	SoftLimits softLimitsConfig `toml:"softLimits"`
+
+	// Pinned contains a list of public key fingerprints whose stored version
+	// may not be changed by recon or anonymous submissions. Pinned keys can
+	// only be changed by signed replace or delete requests, or by loading
+	// them with hockeypuck-load. This protects important keys, such as
+	// distribution signing keys, from certificate flooding.
+	Pinned []string `toml:"pinned"`
+
+	// LocalOnly contains a list of public key fingerprints which are stored
+	// and served by this server, but never shared with recon partners or
+	// included in dumps. This isolates internal directory keys co-hosted on
+	// a public keyserver.
+	LocalOnly []string `toml:"localOnly"`
+
+	// HonorPreferredKeyserver refuses unauthenticated updates to keys whose
+	// owner has designated a preferred keyserver other than this one, as
+	// identified by Hostname.
+	HonorPreferredKeyserver bool `toml:"honorPreferredKeyserver"`
+
+	Retention retentionConfig `toml:"retention"`
+
+	AccessTracking accessTrackingConfig `toml:"accessTracking"`
+
+	WarmUp warmUpConfig `toml:"warmUp"`
+
+	FingerprintFilter fingerprintFilterConfig `toml:"fingerprintFilter"`
+
+	ServePolicy servePolicyConfig `toml:"servePolicy"`
+
+	Indexing indexingConfig `toml:"indexing"`
+
+	Search searchConfig `toml:"search"`
+
+	SigVerification sigVerificationConfig `toml:"sigVerification"`
+}
+
+// floodingConfig configures the treatment of keys flooded with third-party
+// certifications, as they are submitted, pushed or recovered by recon. A key
+// is flooded if any of its user IDs or user attributes has more than
+// Threshold certifications. Its certifications are then either stripped of
+// those which cannot be verified with a signer's key held by this keyserver,
+// or capped to the most recent on each user ID, or the key is quarantined
+// for review. A zero threshold disables the policy.
+type floodingConfig struct {
+	Threshold int `toml:"threshold"`
+	// "strip", "cap" or "quarantine"
+	Action string `toml:"action"`
+	// Certifications kept on each user ID by "cap", defaulting to the
+	// threshold, or of those which verify by "strip", defaulting to all
+	MaxCertifications int `toml:"maxCertifications"`
+}
+
+// softLimitsConfig configures limits on the size of keys submitted with
+// op=add, applied to keys as they would be stored. Unlike MaxKeyLength,
+// these limits may be phased in: in "warn" mode, keys exceeding them are
+// accepted until EnforceAfter, and their owners are notified at the
+// addresses verified on them, after which they are refused as in "reject"
+// mode. An empty mode disables the limits.
+type softLimitsConfig struct {
+	Mode string `toml:"mode"`
+	// Date from which warn mode limits are enforced, as YYYY-MM-DD or in
+	// RFC 3339 format
+	EnforceAfter string `toml:"enforceAfter"`
+	// Limits on the total length of a key's packets, and the number of
+	// signatures on it. Zero is unlimited.
+	MaxKeyLength  int `toml:"maxKeyLength"`
+	MaxSignatures int `toml:"maxSignatures"`
+	// Owners are notified by email if From is set
+	From string     `toml:"from"`
+	SMTP SMTPConfig `toml:"smtp"`
+}
+
+// sigVerificationConfig configures a shared pool of workers verifying
+// signatures, which remembers signatures already verified so that keys
+// resubmitted or recovered through recon are checked cheaply.
+type sigVerificationConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Maximum number of signatures verified at once; defaults to the
+	// number of CPUs
+	Workers int `toml:"workers"`
+	// Maximum number of verified signatures remembered
+	CacheSize int `toml:"cacheSize"`
+}
+
+// searchConfig configures an external search index used for keyword
+// searches. The index is updated as keys are stored, so keys stored before it
+// was configured are not indexed until they change.
+type searchConfig struct {
+	// Search provider; "opensearch" is supported. Empty disables external
+	// search.
+	Provider string `toml:"provider"`
+	// Base URL of the search cluster
+	URL string `toml:"url"`
+	// Name of the index used to store keys
+	Index string `toml:"index"`
+}
+
+// indexingConfig configures keyword indexing of stored keys. Deferred keys
+// are queued for indexing by background workers rather than indexed as they
+// are stored, so they can be fetched by fingerprint at once, and searched for
+// shortly after.
+type indexingConfig struct {
+	Deferred bool `toml:"deferred"`
+	// Number of background workers
+	Workers int `toml:"workers"`
+	// Maximum number of keys indexed in each transaction
+	BatchSize int `toml:"batchSize"`
+	// How often an idle worker checks the queue
+	IntervalSecs int `toml:"intervalSecs"`
+}
+
+// servePolicyConfig selects the packets served for each key, in lookups,
+// dumps and PKS mail. Stored keys are not modified.
+type servePolicyConfig struct {
+	// Omit user attributes, such as photo IDs
+	StripUserAttributes bool `toml:"stripUserAttributes"`
+	// Serve only the primary key, user IDs and their self-signatures
+	Minimal bool `toml:"minimal"`
+	// Omit user IDs and user attributes
+	RedactUserIDs bool `toml:"redactUserIDs"`
+	// Maximum number of third-party certifications per user ID, or zero
+	// for unlimited
+	MaxCertifications int `toml:"maxCertifications"`
+}
+
+// accessTrackingConfig configures recording when keys were last fetched.
+// Accesses are accumulated in memory and written in batches. Tracking is
+// always enabled when a retention policy is.
+type accessTrackingConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Maximum number of keys written at once
+	BatchSize int `toml:"batchSize"`
+	// How often accumulated accesses are written
+	FlushSecs int `toml:"flushSecs"`
+}
+
+// warmUpConfig configures preparing the server to serve requests at full
+// speed when it starts: storage connections are opened and statements
+// prepared, the prefix tree root is read, and the keys fetched most often
+// before the last restart, as saved in HotListFile, are read so that they
+// are cached.
+type warmUpConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File in which the most frequently fetched keys are saved when the
+	// server stops. If empty, no keys are warmed.
+	HotListFile string `toml:"hotListFile"`
+	// Maximum number of keys saved and warmed
+	HotKeys int `toml:"hotKeys"`
+}
+
+// fingerprintFilterConfig configures an in-memory filter of the fingerprints
+// of stored keys, consulted before storage is queried for lookups by
+// fingerprint so that lookups for keys which do not exist are answered
+// without a database round-trip. The filter takes about 1.2 bytes per
+// fingerprint held.
+//
+// Keys added by other servers sharing the database are only learned when
+// the filter is rebuilt, and until then are not found by fingerprint, unless
+// the database is configured with sharedNotifications. The filter is then
+// also rebuilt whenever notifications may have been missed.
+type fingerprintFilterConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Number of fingerprints the filter is sized for when first built;
+	// afterwards it is sized for the number of fingerprints stored
+	Capacity int `toml:"capacity"`
+	// How often the filter is rebuilt, so that deleted keys are forgotten
+	// and keys added by other servers are learned
+	RebuildSecs int `toml:"rebuildSecs"`
+}
+
+// blocklistsConfig configures externally maintained blocklists, which are
+// fetched periodically and applied in addition to Blacklist. Keys become
+// blocked by fingerprint, or by a user ID matching a blocked pattern, and
+// are dropped like blacklisted keys. Stored keys are deleted when their
+// fingerprint becomes blocked.
+type blocklistsConfig struct {
+	// How often each feed is fetched
+	IntervalSecs int `toml:"intervalSecs"`
+
+	Feeds []blocklistFeedConfig `toml:"feeds"`
+}
+
+type blocklistFeedConfig struct {
+	// Name identifying the feed in logs
+	Name string `toml:"name"`
+	// HTTPS URL of the list
+	URL string `toml:"url"`
+	// HTTPS URL of the list's armored detached signature; defaults to url
+	// with ".asc" appended
+	SignatureURL string `toml:"signatureURL"`
+	// Armored public keys trusted to sign the list
+	KeyFile string `toml:"keyFile"`
+}
+
+// erasureConfig configures the suppression of keys and user IDs erased by
+// approved erasure requests, which are filed at /pks/erasure and moderated
+// with hockeypuck-erasure. Suppressed keys and user IDs are dropped from
+// keys received by submission or reconciliation.
+type erasureConfig struct {
+	// How often approved requests are reloaded from storage
+	IntervalSecs int `toml:"intervalSecs"`
+}
+
+// retentionConfig configures removal of keys which have been revoked or
+// expired for a long time and are no longer fetched. Removed keys are
+// tombstoned, so that they are not fetched again through reconciliation.
+type retentionConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Years since the key was revoked or expired
+	InactiveYears int `toml:"inactiveYears"`
+	// Months since the key was last fetched
+	UnusedMonths int `toml:"unusedMonths"`
+	// How often the policy is applied
+	IntervalSecs int `toml:"intervalSecs"`
 }
 
 func DefaultOpenPGP() OpenPGPConfig {
@@ -158,18 +867,42 @@ func DefaultOpenPGP() OpenPGPConfig {
 		},
 		MaxKeyLength:    DefaultMaxKeyLength,
 		MaxPacketLength: DefaultMaxPacketLength,
+		Retention: retentionConfig{
+			InactiveYears: DefaultRetentionInactiveYears,
+			UnusedMonths:  DefaultRetentionUnusedMonths,
+			IntervalSecs:  DefaultRetentionIntervalSecs,
+		},
+		SigVerification: sigVerificationConfig{
+			CacheSize: DefaultSigVerificationCacheSize,
+		},
+		WarmUp: warmUpConfig{
+			HotKeys: DefaultWarmUpHotKeys,
+		},
+		Blocklists: blocklistsConfig{
+			IntervalSecs: DefaultBlocklistIntervalSecs,
+		},
+		Erasure: erasureConfig{
+			IntervalSecs: DefaultErasureIntervalSecs,
+		},
 	}
 }
 
 type Settings struct {
 	Conflux confluxConfig `toml:"conflux"`
 
+	Router RouterConfig `toml:"router"`
+
 	IndexTemplate  string `toml:"indexTemplate"`
 	VIndexTemplate string `toml:"vindexTemplate"`
 	StatsTemplate  string `toml:"statsTemplate"`
 
 	HKP  HKPConfig   `toml:"hkp"`
 	HKPS *HKPSConfig `toml:"hkps"`
+	LDAP *LDAPConfig `toml:"ldap"`
+
+	Admin *AdminConfig `toml:"admin"`
+
+	Tracing *TracingConfig `toml:"tracing"`
 
 	Metrics *metrics.Settings `toml:"metrics"`
 
@@ -186,8 +919,82 @@ type Settings struct {
 	Version  string `toml:"version"`
 
 	SksCompat bool `toml:"sksCompat"`
+
+	Alerts alertsConfig `toml:"alerts"`
+
+	// DrainTimeoutSecs limits how long shutdown waits for HKP requests and
+	// the recon session in progress to finish, before they are abandoned.
+	DrainTimeoutSecs int `toml:"drainTimeoutSecs"`
+}
+
+// alertsConfig configures the alerts sent to operators. Alerts are only sent
+// if at least one of email, webhook or pagerDuty is configured.
+type alertsConfig struct {
+	// Minimum interval between repeats of the same alert
+	DedupSecs int `toml:"dedupSecs"`
+	// How often storage health and the insert error rate are checked
+	CheckIntervalSecs int `toml:"checkIntervalSecs"`
+	// Alert when a recon session finds at least this many keys missing
+	// from this keyserver. Zero disables the alert.
+	ReconDivergence int `toml:"reconDivergence"`
+	// Alert when at least this fraction of the keys submitted within a
+	// check interval are rejected, once at least InsertErrorMin keys have
+	// been submitted. Zero disables the alert.
+	InsertErrorRate float64 `toml:"insertErrorRate"`
+	InsertErrorMin  int     `toml:"insertErrorMin"`
+
+	Email     *alertEmailConfig     `toml:"email"`
+	Webhook   *alertWebhookConfig   `toml:"webhook"`
+	PagerDuty *alertPagerDutyConfig `toml:"pagerDuty"`
+}
+
+// Each alert target receives alerts of at least its minimum severity: one
+// of "info" (the default), "warning" or "critical".
+
+type alertEmailConfig struct {
+	From        string     `toml:"from"`
+	To          []string   `toml:"to"`
+	SMTP        SMTPConfig `toml:"smtp"`
+	MinSeverity string     `toml:"minSeverity"`
+}
+
+type alertWebhookConfig struct {
+	URL         string `toml:"url"`
+	MinSeverity string `toml:"minSeverity"`
+}
+
+type alertPagerDutyConfig struct {
+	RoutingKey string `toml:"routingKey"`
+	// Events API v2 endpoint, defaults to PagerDuty's
+	URL         string `toml:"url"`
+	MinSeverity string `toml:"minSeverity"`
+}
+
+const (
+	DefaultAlertDedupSecs         = 3600
+	DefaultAlertCheckIntervalSecs = 60
+	DefaultAlertReconDivergence   = 10000
+	DefaultAlertInsertErrorRate   = 0.5
+	DefaultAlertInsertErrorMin    = 100
+)
+
+// RouterConfig configures hockeypuck-router, which fronts a cluster of
+// Hockeypuck servers that each store a shard of the keys.
+type RouterConfig struct {
+	// Base URLs of the shard servers. Keys are assigned to shards by
+	// their URL, so every router must list the same URLs.
+	Shards []string `toml:"shards"`
+	// Points on the hash ring per shard
+	Replicas int `toml:"replicas"`
+	// Timeout for requests to shards
+	TimeoutSecs int `toml:"timeoutSecs"`
 }
 
+const (
+	DefaultRouterReplicas    = 100
+	DefaultRouterTimeoutSecs = 30
+)
+
 const (
 	DefaultLogLevel    = "INFO"
 	DefaultLevelDBPath = "recon.db"
@@ -206,14 +1013,71 @@ func DefaultSettings() Settings {
 			},
 		},
 		HKP: HKPConfig{
-			Bind: DefaultHKPBind,
+			Bind:                  DefaultHKPBind,
+			ContentSecurityPolicy: DefaultContentSecurityPolicy,
+			Timeouts: httpTimeoutsConfig{
+				ReadHeaderSecs: DefaultHTTPReadHeaderTimeoutSecs,
+				ReadSecs:       DefaultHTTPReadTimeoutSecs,
+				WriteSecs:      DefaultHTTPWriteTimeoutSecs,
+				IdleSecs:       DefaultHTTPIdleTimeoutSecs,
+				MaxHeaderBytes: DefaultHTTPMaxHeaderBytes,
+			},
+			MaxAddLength: DefaultMaxAddLength,
+			Attestation: attestationConfig{
+				IntervalSecs: DefaultAttestationIntervalSecs,
+			},
+			Push: pushConfig{
+				IntervalSecs: DefaultPushIntervalSecs,
+			},
+			AccessLog: accessLogConfig{
+				DefaultRate: 1,
+			},
+			LoadShedding: loadSheddingConfig{
+				MaxGoroutines:    DefaultLoadSheddingMaxGoroutines,
+				MaxPoolUse:       DefaultLoadSheddingMaxPoolUse,
+				MaxLatencyMillis: DefaultLoadSheddingMaxLatencyMillis,
+				RetryAfterSecs:   DefaultLoadSheddingRetryAfterSecs,
+			},
+			RateLimit: rateLimitConfig{
+				Get:       rateBudget{Rate: DefaultRateLimitGetRate, Burst: DefaultRateLimitGetBurst},
+				Index:     rateBudget{Rate: DefaultRateLimitIndexRate, Burst: DefaultRateLimitIndexBurst},
+				Add:       rateBudget{Rate: DefaultRateLimitAddRate, Burst: DefaultRateLimitAddBurst},
+				HashQuery: rateBudget{Rate: DefaultRateLimitHashQueryRate, Burst: DefaultRateLimitHashQueryBurst},
+				Redis: rateLimitRedisConfig{
+					KeyPrefix:     DefaultRateLimitRedisKeyPrefix,
+					TimeoutMillis: DefaultRateLimitRedisTimeoutMillis,
+				},
+			},
+			Challenge: challengeConfig{
+				Bits:       DefaultChallengeBits,
+				MaxAgeSecs: DefaultChallengeMaxAgeSecs,
+			},
+			Compression: compressionConfig{
+				MinLength: DefaultCompressionMinLength,
+			},
+			Maintenance: maintenanceConfig{
+				Message:        DefaultMaintenanceMessage,
+				RetryAfterSecs: DefaultMaintenanceRetryAfterSecs,
+			},
 		},
-		Metrics:   metricsSettings,
-		OpenPGP:   DefaultOpenPGP(),
-		LogLevel:  DefaultLogLevel,
-		Software:  "Hockeypuck",
-		Version:   "~unreleased",
-		SksCompat: false,
+		Metrics: metricsSettings,
+		OpenPGP: DefaultOpenPGP(),
+		Router: RouterConfig{
+			Replicas:    DefaultRouterReplicas,
+			TimeoutSecs: DefaultRouterTimeoutSecs,
+		},
+		Alerts: alertsConfig{
+			DedupSecs:         DefaultAlertDedupSecs,
+			CheckIntervalSecs: DefaultAlertCheckIntervalSecs,
+			ReconDivergence:   DefaultAlertReconDivergence,
+			InsertErrorRate:   DefaultAlertInsertErrorRate,
+			InsertErrorMin:    DefaultAlertInsertErrorMin,
+		},
+		LogLevel:         DefaultLogLevel,
+		Software:         "Hockeypuck",
+		Version:          "~unreleased",
+		SksCompat:        false,
+		DrainTimeoutSecs: DefaultDrainTimeoutSecs,
 	}
 }
 
@@ -231,6 +1095,14 @@ func ParseSettings(data string) (*Settings, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	_, err = openpgp.ParseSelfSigMode(doc.Hockeypuck.OpenPGP.VerifySelfSignatures)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err = openpgp.ParseCriticalSubpacketPolicy(doc.Hockeypuck.OpenPGP.UnknownCriticalSubpackets)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
 	return &doc.Hockeypuck, nil
 }
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+// Request priorities for load shedding. Under pressure, requests of the
+// lowest priorities are refused first.
+const (
+	// Keyword searches, which are the most expensive lookups.
+	priorityLow = iota
+	// Key submissions and other requests not otherwise classified.
+	priorityNormal
+	// Key lookups by key ID or fingerprint.
+	priorityHigh
+	// Requests from peer keyservers, which are never refused.
+	priorityCritical
+)
+
+var priorityNames = []string{"low", "normal", "high", "critical"}
+
+// Load, as a fraction of the configured thresholds, at or above which
+// requests of each priority are refused.
+var shedAtLoad = []float64{
+	priorityLow:    1.0,
+	priorityNormal: 1.25,
+	priorityHigh:   1.5,
+}
+
+const (
+	shedSampleInterval = time.Second
+	// latencyWeight is the weight of each response in the moving average of
+	// response latency.
+	latencyWeight = 0.05
+)
+
+// loadShedder refuses low-priority requests with 503 Service Unavailable
+// while the server is under pressure, so that it remains responsive to the
+// rest. Pressure is sampled periodically from the number of goroutines, the
+// use of the storage connection pool and the average response latency, each
+// relative to its configured threshold.
+type loadShedder struct {
+	pool storage.Pooled
+
+	// shedBelow is the lowest priority of request which is served.
+	shedBelow int32
+
+	mu      sync.Mutex
+	conf    loadSheddingConfig
+	latency float64 // moving average, in seconds
+}
+
+func newLoadShedder(conf *loadSheddingConfig, st storage.Storage) *loadShedder {
+	ls := &loadShedder{conf: *conf}
+	if pool, ok := st.(storage.Pooled); ok {
+		ls.pool = pool
+	} else if conf.MaxPoolUse > 0 {
+		log.Warningf("storage does not report connection pool use, load shedding ignores it")
+	}
+	return ls
+}
+
+// setConfig changes the thresholds, such as when the configuration is
+// reloaded. If load shedding is disabled, no requests are refused.
+func (ls *loadShedder) setConfig(conf *loadSheddingConfig) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if conf.Enabled {
+		ls.conf = *conf
+	} else {
+		ls.conf = loadSheddingConfig{}
+	}
+}
+
+func (ls *loadShedder) config() loadSheddingConfig {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.conf
+}
+
+// run samples the load until dying is closed.
+func (ls *loadShedder) run(dying <-chan struct{}) error {
+	ticker := time.NewTicker(shedSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dying:
+			return nil
+		case <-ticker.C:
+		}
+		ls.update(ls.load())
+	}
+}
+
+// load returns the greatest of the measures of pressure, as a fraction of
+// their thresholds.
+func (ls *loadShedder) load() float64 {
+	conf := ls.config()
+	var load float64
+	if conf.MaxGoroutines > 0 {
+		load = float64(runtime.NumGoroutine()) / float64(conf.MaxGoroutines)
+	}
+	if ls.pool != nil && conf.MaxPoolUse > 0 {
+		if stats := ls.pool.PoolStats(); stats.MaxConns > 0 {
+			use := float64(stats.InUse) / float64(stats.MaxConns)
+			load = maxLoad(load, use/conf.MaxPoolUse)
+		}
+	}
+	if conf.MaxLatencyMillis > 0 {
+		ls.mu.Lock()
+		latency := ls.latency
+		ls.mu.Unlock()
+		load = maxLoad(load, latency*1000/float64(conf.MaxLatencyMillis))
+	}
+	return load
+}
+
+func maxLoad(a, b float64) float64 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+func (ls *loadShedder) update(load float64) {
+	shedBelow := int32(priorityLow)
+	for priority, at := range shedAtLoad {
+		if load >= at {
+			shedBelow = int32(priority + 1)
+		}
+	}
+	prev := atomic.SwapInt32(&ls.shedBelow, shedBelow)
+	if shedBelow > prev {
+		log.Warningf("load %.2f, refusing %s priority requests", load, priorityNames[shedBelow-1])
+	} else if shedBelow < prev {
+		if shedBelow == priorityLow {
+			log.Infof("load %.2f, no longer refusing requests", load)
+		} else {
+			log.Infof("load %.2f, refusing only %s priority requests", load, priorityNames[shedBelow-1])
+		}
+	}
+}
+
+func (ls *loadShedder) observe(d time.Duration) {
+	ls.mu.Lock()
+	ls.latency += latencyWeight * (d.Seconds() - ls.latency)
+	ls.mu.Unlock()
+}
+
+func (ls *loadShedder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		priority := requestPriority(req)
+		if priority < int(atomic.LoadInt32(&ls.shedBelow)) {
+			recordRequestShed(priorityNames[priority])
+			w.Header().Set("Retry-After", strconv.Itoa(ls.config().RetryAfterSecs))
+			http.Error(w, "server busy, please try again later", http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(w, req)
+		ls.observe(time.Since(start))
+	})
+}
+
+// requestPriority classifies a request for load shedding.
+func requestPriority(req *http.Request) int {
+	switch path := req.URL.Path; {
+	case path == "/pks/push" || path == "/pks/hashquery":
+		return priorityCritical
+	case path == "/pks/verified" && req.Method == http.MethodPost:
+		return priorityCritical
+	case strings.HasPrefix(path, "/key/"):
+		return priorityHigh
+	case strings.HasPrefix(path, "/vks/v1/by-fingerprint/"), strings.HasPrefix(path, "/vks/v1/by-keyid/"):
+		return priorityHigh
+	case strings.HasPrefix(path, "/email/"), strings.HasPrefix(path, "/vks/v1/by-email/"):
+		return priorityLow
+	case path == "/pks/lookup":
+		q := req.URL.Query()
+		switch q.Get("op") {
+		case "hget":
+			return priorityHigh
+		case "get":
+			if strings.HasPrefix(q.Get("search"), "0x") {
+				return priorityHigh
+			}
+			return priorityLow
+		case "index", "vindex":
+			return priorityLow
+		}
+	}
+	return priorityNormal
+}
@@ -19,6 +19,7 @@ package testing
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -36,3 +37,14 @@ func MustInput(name string) *os.File {
 	}
 	return f
 }
+
+// MustInputString returns the contents of the unit test data file name.
+func MustInputString(name string) string {
+	f := MustInput(name)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		panic(fmt.Errorf("cannot read unit test data file %q: %v", name, err))
+	}
+	return string(b)
+}
@@ -0,0 +1,298 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	DefaultServiceName   = "hockeypuck"
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 4096
+	DefaultFlushInterval = 5 * time.Second
+	DefaultTimeout       = 10 * time.Second
+)
+
+var droppedSpans = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "hockeypuck",
+	Subsystem: "tracing",
+	Name:      "dropped_spans_total",
+	Help:      "Spans dropped because the export queue was full or the collector failed",
+})
+
+func init() {
+	prometheus.MustRegister(droppedSpans)
+}
+
+// OTLPExporter exports spans in batches to an OpenTelemetry collector, with
+// the OTLP/HTTP protocol in its JSON encoding. Spans are dropped rather than
+// delaying the work they trace if the collector falls behind.
+type OTLPExporter struct {
+	url           string
+	serviceName   string
+	headers       map[string]string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+
+	queue chan *Span
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// OTLPOption configures an OTLPExporter.
+type OTLPOption func(*OTLPExporter)
+
+// ServiceName sets the service.name resource attribute of exported spans.
+func ServiceName(name string) OTLPOption {
+	return func(e *OTLPExporter) { e.serviceName = name }
+}
+
+// Headers sets headers sent with each export, such as to authenticate to
+// the collector.
+func Headers(headers map[string]string) OTLPOption {
+	return func(e *OTLPExporter) { e.headers = headers }
+}
+
+// HTTPClient sets the client used to export spans.
+func HTTPClient(client *http.Client) OTLPOption {
+	return func(e *OTLPExporter) { e.client = client }
+}
+
+// FlushInterval sets how often queued spans are exported, when fewer than a
+// batch are queued.
+func FlushInterval(d time.Duration) OTLPOption {
+	return func(e *OTLPExporter) { e.flushInterval = d }
+}
+
+// NewOTLPExporter returns an exporter to the collector at endpoint, such as
+// http://localhost:4318, to whose /v1/traces path spans are posted. It must
+// be started with Start.
+func NewOTLPExporter(endpoint string, options ...OTLPOption) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	e := &OTLPExporter{
+		url:           url,
+		serviceName:   DefaultServiceName,
+		client:        &http.Client{Timeout: DefaultTimeout},
+		batchSize:     DefaultBatchSize,
+		flushInterval: DefaultFlushInterval,
+		queue:         make(chan *Span, DefaultQueueSize),
+		stop:          make(chan struct{}),
+	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
+}
+
+// Export implements Exporter.
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		droppedSpans.Inc()
+	}
+}
+
+// Start exports queued spans in the background.
+func (e *OTLPExporter) Start() {
+	e.wg.Add(1)
+	go e.run()
+}
+
+// Stop exports the spans remaining in the queue and stops.
+func (e *OTLPExporter) Stop() {
+	close(e.stop)
+	e.wg.Wait()
+}
+
+func (e *OTLPExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	err := e.post(batch)
+	if err != nil {
+		droppedSpans.Add(float64(len(batch)))
+		log.Warningf("failed to export %d spans: %v", len(batch), err)
+	}
+}
+
+func (e *OTLPExporter) post(batch []*Span) error {
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an export request. IDs are hex-encoded and
+// 64-bit integers are decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpStatusError is the status code of a failed span.
+const otlpStatusError = 2
+
+func (e *OTLPExporter) request(batch []*Span) *otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes()),
+		}
+		if s.Parent != (SpanID{}) {
+			spans[i].ParentSpanID = s.Parent.String()
+		}
+		if s.Err != nil {
+			spans[i].Status = &otlpStatus{Code: otlpStatusError, Message: s.Err.Error()}
+		}
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", e.serviceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DefaultServiceName}, Spans: spans}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	var result []otlpKeyValue
+	for _, attr := range attrs {
+		var v otlpValue
+		switch value := attr.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			continue
+		}
+		result = append(result, otlpKeyValue{Key: attr.Key, Value: v})
+	}
+	return result
+}
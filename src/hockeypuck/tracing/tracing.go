@@ -0,0 +1,319 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package tracing records spans of the work done to serve requests, recon
+// and key parsing, and exports them to an OpenTelemetry collector over OTLP,
+// so that operators can find where slow lookups spend their time. Trace
+// context is propagated from and to other services in W3C traceparent
+// headers.
+//
+// Tracing is disabled until a Tracer is installed with SetTracer; spans
+// started while it is disabled are nil, and do nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanKind is the role of a span in a request between services.
+type SpanKind int
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanContext identifies a span and the trace it belongs to, and whether
+// the trace is sampled.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Valid returns whether the span context identifies a span.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Attribute is a named value describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{Key: key, Value: value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute { return Attribute{Key: key, Value: int64(value)} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute { return Attribute{Key: key, Value: value} }
+
+// Span is a timed operation within a trace. The methods of a nil Span do
+// nothing, so that code need not check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+	End     time.Time
+	// Err is the error the operation failed with, if any.
+	Err error
+
+	mu    sync.Mutex
+	attrs []Attribute
+	ended bool
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// Attributes returns the attributes of the span.
+func (s *Span) Attributes() []Attribute {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attribute(nil), s.attrs...)
+}
+
+// SetError marks the span as failed with err, if it is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and, if its trace is sampled, queues it for export.
+// Only the first call has any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// SpanContext returns the identity of the span, or the zero SpanContext if
+// the span is nil.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// Exporter sends finished spans to be stored.
+type Exporter interface {
+	// Export queues a finished span. It must not block.
+	Export(s *Span)
+}
+
+// Tracer starts spans and passes them to an exporter when they finish.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+
+	mu  sync.Mutex
+	rng *mathrand.Rand
+}
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// SampleRatio sets the fraction of traces started by this service which are
+// sampled. Traces continued from another service are sampled if that
+// service sampled them. By default all traces are sampled.
+func SampleRatio(ratio float64) Option {
+	return func(t *Tracer) { t.sampleRatio = ratio }
+}
+
+// NewTracer returns a Tracer exporting its spans with exporter.
+func NewTracer(exporter Exporter, options ...Option) *Tracer {
+	var seed [8]byte
+	rand.Read(seed[:])
+	t := &Tracer{
+		exporter:    exporter,
+		sampleRatio: 1,
+		rng:         mathrand.New(mathrand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+	for _, option := range options {
+		option(t)
+	}
+	return t
+}
+
+func (t *Tracer) newIDs(traceID *TraceID, spanID *SpanID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if traceID != nil {
+		t.rng.Read(traceID[:])
+	}
+	t.rng.Read(spanID[:])
+}
+
+func (t *Tracer) sample() bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Float64() < t.sampleRatio
+}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   *Tracer
+)
+
+// SetTracer installs the Tracer which starts spans, or disables tracing if
+// t is nil.
+func SetTracer(t *Tracer) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracer = t
+}
+
+func currentTracer() *Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return tracer
+}
+
+// Enabled returns whether a Tracer is installed.
+func Enabled() bool {
+	return currentTracer() != nil
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// FromContext returns the span carried by ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns a copy of ctx carrying span, so that the spans
+// started with it are its children.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// ContextWithRemote returns a copy of ctx carrying the span context of a
+// caller in another service, so that the spans started with it continue
+// the caller's trace.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a span of the given kind as a child of the span carried by
+// ctx, or of the remote caller's span, or as the root of a new trace. The
+// returned context carries the new span. If tracing is disabled the span is
+// nil and ctx is returned as it is.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, Name: name, Kind: kind, Start: time.Now(), attrs: attrs}
+	if parent := FromContext(ctx); parent != nil {
+		s.Context.TraceID = parent.Context.TraceID
+		s.Context.Sampled = parent.Context.Sampled
+		s.Parent = parent.Context.SpanID
+		t.newIDs(nil, &s.Context.SpanID)
+	} else if remote, ok := remoteContext(ctx); ok {
+		s.Context.TraceID = remote.TraceID
+		s.Context.Sampled = remote.Sampled
+		s.Parent = remote.SpanID
+		t.newIDs(nil, &s.Context.SpanID)
+	} else {
+		t.newIDs(&s.Context.TraceID, &s.Context.SpanID)
+		s.Context.Sampled = t.sample()
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+func remoteContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok && sc.Valid()
+}
+
+// String describes the span for logs.
+func (s *Span) String() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s trace=%s span=%s", s.Name, s.Context.TraceID, s.Context.SpanID)
+}
@@ -0,0 +1,210 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	stdtesting "testing"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(s *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+type TracingSuite struct {
+	rec *recorder
+}
+
+var _ = gc.Suite(&TracingSuite{})
+
+func (s *TracingSuite) SetUpTest(c *gc.C) {
+	s.rec = &recorder{}
+	SetTracer(NewTracer(s.rec))
+}
+
+func (s *TracingSuite) TearDownTest(c *gc.C) {
+	SetTracer(nil)
+}
+
+func (s *TracingSuite) TestDisabled(c *gc.C) {
+	SetTracer(nil)
+	ctx := context.Background()
+	ctx2, span := Start(ctx, "noop", KindInternal)
+	c.Assert(span, gc.IsNil)
+	c.Assert(ctx2, gc.Equals, ctx)
+	span.SetAttributes(String("a", "b"))
+	span.SetError(errors.New("ignored"))
+	span.Finish()
+}
+
+func (s *TracingSuite) TestChildSpans(c *gc.C) {
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	_, child := Start(ctx, "child", KindInternal, String("k", "v"))
+	child.SetError(errors.New("boom"))
+	child.Finish()
+	child.Finish()
+	parent.Finish()
+
+	c.Assert(s.rec.spans, gc.HasLen, 2)
+	c.Assert(s.rec.spans[0], gc.Equals, child)
+	c.Assert(child.Context.TraceID, gc.Equals, parent.Context.TraceID)
+	c.Assert(child.Parent, gc.Equals, parent.Context.SpanID)
+	c.Assert(child.Context.SpanID, gc.Not(gc.Equals), parent.Context.SpanID)
+	c.Assert(child.Attributes(), gc.DeepEquals, []Attribute{String("k", "v")})
+	c.Assert(child.Err, gc.ErrorMatches, "boom")
+	c.Assert(parent.Parent, gc.Equals, SpanID{})
+}
+
+func (s *TracingSuite) TestUnsampled(c *gc.C) {
+	SetTracer(NewTracer(s.rec, SampleRatio(0)))
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	_, child := Start(ctx, "child", KindInternal)
+	child.Finish()
+	parent.Finish()
+	c.Assert(parent.Context.Sampled, gc.Equals, false)
+	c.Assert(s.rec.spans, gc.HasLen, 0)
+}
+
+func (s *TracingSuite) TestTraceparent(c *gc.C) {
+	const value = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, ok := ParseTraceparent(value)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(sc.Sampled, gc.Equals, true)
+	c.Assert(sc.TraceID.String(), gc.Equals, "0af7651916cd43dd8448eb211c80319c")
+	c.Assert(sc.SpanID.String(), gc.Equals, "b7ad6b7169203331")
+	c.Assert(FormatTraceparent(sc), gc.Equals, value)
+
+	for _, invalid := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		c.Check(ok, gc.Equals, false, gc.Commentf("%q", invalid))
+	}
+}
+
+func (s *TracingSuite) TestMiddleware(c *gc.C) {
+	var inner *Span
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var span *Span
+		_, span = Start(req.Context(), "storage.Resolve", KindInternal)
+		span.Finish()
+		inner = span
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	req := httptest.NewRequest("GET", "/pks/lookup?op=get&search=alice", nil)
+	req.Header.Set(TraceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Assert(w.Code, gc.Equals, http.StatusNotFound)
+
+	c.Assert(s.rec.spans, gc.HasLen, 2)
+	server := s.rec.spans[1]
+	c.Assert(server.Name, gc.Equals, "GET /pks/lookup")
+	c.Assert(server.Kind, gc.Equals, KindServer)
+	c.Assert(server.Context.TraceID.String(), gc.Equals, "0af7651916cd43dd8448eb211c80319c")
+	c.Assert(server.Parent.String(), gc.Equals, "b7ad6b7169203331")
+	c.Assert(inner.Parent, gc.Equals, server.Context.SpanID)
+	c.Assert(server.Attributes(), gc.DeepEquals, []Attribute{
+		String("http.method", "GET"),
+		String("http.target", "/pks/lookup?op=get&search=alice"),
+		String("http.user_agent", ""),
+		Int("http.status_code", http.StatusNotFound),
+	})
+
+	out := http.Header{}
+	Inject(ContextWithSpan(context.Background(), server), out)
+	sc, ok := ParseTraceparent(out.Get(TraceparentHeader))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(sc, gc.Equals, server.Context)
+}
+
+func (s *TracingSuite) TestOTLPExporter(c *gc.C) {
+	var mu sync.Mutex
+	var bodies []map[string]interface{}
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, gc.Equals, "/v1/traces")
+		c.Check(req.Header.Get("Content-Type"), gc.Equals, "application/json")
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, gc.IsNil)
+		var doc map[string]interface{}
+		c.Check(json.Unmarshal(body, &doc), gc.IsNil)
+		mu.Lock()
+		bodies = append(bodies, doc)
+		auth = req.Header.Get("Authorization")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(srv.URL, ServiceName("keys.example.com"),
+		Headers(map[string]string{"Authorization": "Bearer secret"}))
+	e.Start()
+	SetTracer(NewTracer(e))
+	ctx, parent := Start(context.Background(), "GET /pks/lookup", KindServer)
+	_, child := Start(ctx, "storage.Resolve", KindInternal, Int("keys", 2), Bool("cached", false))
+	child.SetError(errors.New("timeout"))
+	child.Finish()
+	parent.Finish()
+	e.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(bodies, gc.HasLen, 1)
+	c.Assert(auth, gc.Equals, "Bearer secret")
+	rs := bodies[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := rs["resource"].(map[string]interface{})
+	c.Assert(resource["attributes"], gc.DeepEquals, []interface{}{
+		map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "keys.example.com"}},
+	})
+	spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	c.Assert(spans, gc.HasLen, 2)
+	span := spans[0].(map[string]interface{})
+	c.Assert(span["name"], gc.Equals, "storage.Resolve")
+	c.Assert(span["traceId"], gc.Equals, parent.Context.TraceID.String())
+	c.Assert(span["parentSpanId"], gc.Equals, parent.Context.SpanID.String())
+	c.Assert(span["kind"], gc.Equals, float64(KindInternal))
+	c.Assert(span["status"], gc.DeepEquals, map[string]interface{}{"code": float64(2), "message": "timeout"})
+	c.Assert(span["attributes"], gc.DeepEquals, []interface{}{
+		map[string]interface{}{"key": "keys", "value": map[string]interface{}{"intValue": "2"}},
+		map[string]interface{}{"key": "cached", "value": map[string]interface{}{"boolValue": false}},
+	})
+	_, ok := spans[1].(map[string]interface{})["parentSpanId"]
+	c.Assert(ok, gc.Equals, false)
+}